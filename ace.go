@@ -0,0 +1,193 @@
+package epub
+
+// This file holds the integration with Ace by DAISY, the EPUB
+// accessibility checker (https://daisy.github.io/ace/).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// AceOptions controls how RunAce invokes Ace.
+type AceOptions struct {
+	// Command is the Ace executable to run. If empty, "ace" is looked
+	// up on the PATH.
+	Command string
+	// Args are extra arguments passed to Ace before the book name,
+	// such as "--lang" and "fr".
+	Args []string
+}
+
+// AceReport is the parsed JSON report Ace writes for a book. Only the
+// parts of the report that are useful for checking a book are
+// included; the full report has much more detail about the book's
+// outline and data.
+type AceReport struct {
+	Title string
+	// Outcome is the overall result: "pass" or "fail".
+	Outcome string
+	// Files holds the results for each file in the book that Ace
+	// checked.
+	Files []AceFileResult
+}
+
+// AceFileResult is the result of checking one file in the book.
+type AceFileResult struct {
+	// URL is the path of the file, relative to the package document.
+	URL     string
+	Outcome string
+	// Violations are the rules the file broke.
+	Violations []AceViolation
+}
+
+// AceViolation is one accessibility rule a file broke.
+type AceViolation struct {
+	// Rule is the ID of the rule, such as "color-contrast".
+	Rule        string
+	Description string
+	// Impact is how serious the violation is: "minor", "moderate",
+	// "serious", or "critical".
+	Impact  string
+	HelpURL string
+	// Tags are the rulesets the rule belongs to, such as "wcag2a".
+	Tags []string
+	// HTML is the offending markup, if Ace reported it.
+	HTML string
+	// File is the path of the file the violation is in.
+	File string
+}
+
+// aceJSON mirrors the EARL-based layout of Ace's report.json.
+type aceJSON struct {
+	Title  string `json:"dct:title"`
+	Result struct {
+		Outcome string `json:"earl:outcome"`
+	} `json:"earl:result"`
+	Assertions []struct {
+		Subject struct {
+			URL string `json:"url"`
+		} `json:"earl:testSubject"`
+		Result struct {
+			Outcome string `json:"earl:outcome"`
+		} `json:"earl:result"`
+		Assertions []struct {
+			Test struct {
+				Impact      string `json:"earl:impact"`
+				Title       string `json:"dct:title"`
+				Description string `json:"dct:description"`
+				Help        struct {
+					URL string `json:"url"`
+				} `json:"help"`
+				Tags []string `json:"rulesetTags"`
+			} `json:"earl:test"`
+			Result struct {
+				Description string `json:"dct:description"`
+				HTML        string `json:"html"`
+			} `json:"earl:result"`
+		} `json:"assertions"`
+	} `json:"assertions"`
+}
+
+// ParseAceReport parses the report.json file that Ace writes.
+func ParseAceReport(r io.Reader) (*AceReport, error) {
+	var raw aceJSON
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("unable to parse Ace report: %v", err)
+	}
+	rep := &AceReport{Title: raw.Title, Outcome: raw.Result.Outcome}
+	for _, a := range raw.Assertions {
+		f := AceFileResult{URL: a.Subject.URL, Outcome: a.Result.Outcome}
+		for _, v := range a.Assertions {
+			desc := v.Result.Description
+			if desc == "" {
+				desc = v.Test.Description
+			}
+			f.Violations = append(f.Violations, AceViolation{
+				Rule:        v.Test.Title,
+				Description: desc,
+				Impact:      v.Test.Impact,
+				HelpURL:     v.Test.Help.URL,
+				Tags:        v.Test.Tags,
+				HTML:        v.Result.HTML,
+				File:        f.URL,
+			})
+		}
+		rep.Files = append(rep.Files, f)
+	}
+	return rep, nil
+}
+
+// Violations returns every violation in the report, in file order.
+func (r *AceReport) Violations() []AceViolation {
+	var ret []AceViolation
+	for _, f := range r.Files {
+		ret = append(ret, f.Violations...)
+	}
+	return ret
+}
+
+// aceImpacts ranks violation impacts from least to most serious.
+var aceImpacts = map[string]int{"minor": 1, "moderate": 2, "serious": 3, "critical": 4}
+
+// ViolationsAtLeast returns the violations in the report whose impact
+// is at least as serious as the given one. This is handy for build
+// gates that tolerate minor problems.
+func (r *AceReport) ViolationsAtLeast(impact string) []AceViolation {
+	var ret []AceViolation
+	for _, v := range r.Violations() {
+		if aceImpacts[v.Impact] >= aceImpacts[impact] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// RunAce serializes the book, runs Ace on it, and returns the parsed
+// report. Ace must be installed separately (it's a Node.js program,
+// installed with "npm install -g @daisy/ace").
+//
+// A report with violations isn't an error; check the report's
+// Outcome or Violations. An error is returned if the book can't be
+// serialized, or if Ace can't be run or doesn't produce a report.
+func (e *EPub) RunAce(ctx context.Context, opts AceOptions) (*AceReport, error) {
+	buf, err := e.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "epub-ace")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	book := filepath.Join(dir, "book.epub")
+	if err := os.WriteFile(book, buf, 0666); err != nil {
+		return nil, err
+	}
+	out := filepath.Join(dir, "report")
+
+	command := opts.Command
+	if command == "" {
+		command = "ace"
+	}
+	args := append([]string{"--silent", "--force", "--outdir", out}, opts.Args...)
+	cmd := exec.CommandContext(ctx, command, append(args, book)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	f, err := os.Open(filepath.Join(out, "report.json"))
+	if err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("running %v: %v: %s", command, runErr, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, fmt.Errorf("%v didn't write a report: %v", command, err)
+	}
+	defer f.Close()
+	return ParseAceReport(f)
+}
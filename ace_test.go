@@ -0,0 +1,124 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const aceReport = `{
+  "@type": "earl:report",
+  "dct:title": "Title",
+  "earl:result": {"earl:outcome": "fail"},
+  "assertions": [
+    {
+      "@type": "earl:assertion",
+      "earl:testSubject": {"url": "a.xhtml"},
+      "earl:result": {"earl:outcome": "fail"},
+      "assertions": [
+        {
+          "@type": "earl:assertion",
+          "earl:assertedBy": "axe-core",
+          "earl:test": {
+            "earl:impact": "serious",
+            "dct:title": "color-contrast",
+            "dct:description": "Ensures text has enough contrast",
+            "help": {"url": "https://dequeuniversity.com/rules/axe/color-contrast"},
+            "rulesetTags": ["wcag2aa", "cat.color"]
+          },
+          "earl:result": {"earl:outcome": "fail", "html": "<p class=\"pale\">A</p>"}
+        },
+        {
+          "@type": "earl:assertion",
+          "earl:test": {"earl:impact": "minor", "dct:title": "epub-type-has-matching-role"},
+          "earl:result": {"earl:outcome": "fail", "dct:description": "Element has no ARIA role"}
+        }
+      ]
+    }
+  ]
+}`
+
+func TestParseAceReport(t *testing.T) {
+	r, err := ParseAceReport(strings.NewReader(aceReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Title != "Title" || r.Outcome != "fail" || len(r.Files) != 1 || r.Files[0].URL != "a.xhtml" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	v := r.Violations()
+	if len(v) != 2 {
+		t.Fatalf("got %v violations, want 2", len(v))
+	}
+	if v[0].Rule != "color-contrast" || v[0].Impact != "serious" || v[0].File != "a.xhtml" || v[0].Description != "Ensures text has enough contrast" || len(v[0].Tags) != 2 {
+		t.Errorf("unexpected violation %+v", v[0])
+	}
+	if v[1].Description != "Element has no ARIA role" {
+		t.Errorf("result description not preferred over test description: %+v", v[1])
+	}
+	if got := r.ViolationsAtLeast("serious"); len(got) != 1 || got[0].Rule != "color-contrast" {
+		t.Errorf("ViolationsAtLeast(serious) = %+v", got)
+	}
+	if _, err := ParseAceReport(strings.NewReader("not json")); err == nil {
+		t.Errorf("ParseAceReport accepted a bad report")
+	}
+}
+
+func TestRunAce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake Ace is a shell script")
+	}
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.json")
+	if err := os.WriteFile(report, []byte(aceReport), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := filepath.Join(dir, "args")
+	// The fake Ace records its arguments and copies the report into the
+	// --outdir directory.
+	script := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	ace := script("ace", `echo "$@" > `+args+`
+while [ $# -gt 0 ]; do
+  if [ "$1" = --outdir ]; then out=$2; fi
+  shift
+done
+mkdir -p "$out" && cp `+report+` "$out/report.json"
+`)
+
+	e := simpleBook(t)
+	r, err := e.RunAce(context.Background(), AceOptions{Command: ace, Args: []string{"--lang", "en"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Outcome != "fail" || len(r.Violations()) != 2 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	got, err := os.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "--silent --force --outdir ") || !strings.Contains(string(got), " --lang en ") || !strings.HasSuffix(strings.TrimSpace(string(got)), "book.epub") {
+		t.Errorf("Ace was run with %q", got)
+	}
+
+	failing := script("failing", "echo 'no such book' >&2\nexit 1\n")
+	if _, err := e.RunAce(context.Background(), AceOptions{Command: failing}); err == nil || !strings.Contains(err.Error(), "no such book") {
+		t.Errorf("RunAce with a failing Ace = %v, want its error output", err)
+	}
+	silent := script("silent", "exit 0\n")
+	if _, err := e.RunAce(context.Background(), AceOptions{Command: silent}); err == nil {
+		t.Errorf("RunAce succeeded without a report")
+	}
+	if _, err := New().RunAce(context.Background(), AceOptions{Command: ace}); err == nil {
+		t.Errorf("RunAce succeeded on a book that can't be serialized")
+	}
+}
@@ -0,0 +1,131 @@
+package epub
+
+// This file holds the code for images' alt text.
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ImageID returns the ID of the image with the given path in the
+// book, such as one added by AddImagePage.
+func (e *EPub) ImageID(path string) (Id, error) {
+	for _, i := range e.images {
+		if i.name == path {
+			return i.id, nil
+		}
+	}
+	return "", errorf(ErrNotFound, "no image with path %v", path)
+}
+
+// SetAltText registers alt text for the image with the given ID. When
+// the book is written, img elements showing the image that have no
+// alt text, including the ones on pages generated by AddImagePage, get
+// this text. Cover pages generated by AddCoverPage afterwards use it
+// too, rather than the book's title.
+func (e *EPub) SetAltText(id Id, alt string) error {
+	i, err := e.findImage(id)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(alt) == "" {
+		return fmt.Errorf("alt text for %v is empty; use SetDecorativeImage for decorative images", i.name)
+	}
+	i.alt, i.decorative = alt, false
+	e.hasAltText = true
+	return nil
+}
+
+// SetDecorativeImage marks the image with the given ID as decorative,
+// such as a flourish between sections, so img elements showing it
+// are expected to have empty alt text and Warnings doesn't report
+// them.
+func (e *EPub) SetDecorativeImage(id Id) error {
+	i, err := e.findImage(id)
+	if err != nil {
+		return err
+	}
+	i.alt, i.decorative = "", true
+	return nil
+}
+
+var (
+	imgRE     = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	srcAttrRE = regexp.MustCompile(`(?i)\ssrc\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	altAttrRE = regexp.MustCompile(`(?i)\salt\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// imageForSrc returns the image an img element in the named XHTML
+// file refers to, or nil if it isn't one of the book's images.
+func (e *EPub) imageForSrc(name string, tag []byte) *image {
+	m := srcAttrRE.FindSubmatch(tag)
+	if m == nil {
+		return nil
+	}
+	src := html.UnescapeString(string(m[1]) + string(m[2]))
+	if u, err := url.PathUnescape(src); err == nil {
+		src = u
+	}
+	target := path.Join(path.Dir(name), src)
+	for i := range e.images {
+		if e.images[i].name == target {
+			return &e.images[i]
+		}
+	}
+	return nil
+}
+
+// fillAltText adds registered alt text to img elements in the named
+// XHTML file's contents that don't have any.
+func (e *EPub) fillAltText(name string, c []byte) []byte {
+	if !imgRE.Match(c) {
+		return c
+	}
+	return imgRE.ReplaceAllFunc(c, func(tag []byte) []byte {
+		i := e.imageForSrc(name, tag)
+		if i == nil || i.alt == "" {
+			return tag
+		}
+		alt := " " + attrPair("alt", i.alt)
+		if m := altAttrRE.FindSubmatch(tag); m != nil {
+			if strings.TrimSpace(string(m[1])+string(m[2])) != "" {
+				return tag
+			}
+			return altAttrRE.ReplaceAllLiteral(tag, []byte(alt))
+		}
+		t := string(tag)
+		if strings.HasSuffix(t, "/>") {
+			return []byte(strings.TrimRight(strings.TrimSuffix(t, "/>"), " ") + alt + " />")
+		}
+		return []byte(strings.TrimSuffix(t, ">") + alt + ">")
+	})
+}
+
+// altTextWarnings returns warnings for img elements without alt text
+// that don't show decorative images.
+func (e *EPub) altTextWarnings() []string {
+	var warnings []string
+	for _, x := range e.spineOrder() {
+		c := e.prepareXHTML(x, e.version)
+		for _, tag := range imgRE.FindAll(c, -1) {
+			m := altAttrRE.FindSubmatch(tag)
+			if m != nil && strings.TrimSpace(string(m[1])+string(m[2])) != "" {
+				continue
+			}
+			i := e.imageForSrc(x.name, tag)
+			if i != nil && i.decorative {
+				continue
+			}
+			what := "an image"
+			if i != nil {
+				what = "image " + i.name
+			}
+			warnings = append(warnings, fmt.Sprintf("%v: %v has no alt text; use SetAltText, or SetDecorativeImage if it's decorative", x.name, what))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,159 @@
+package epub
+
+// This file holds publisher-provided annotations, such as editor
+// commentary or study notes, which go in the book as a W3C Web
+// Annotation sidecar file linked from the package document.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// RelAnnotations is the link relation AddAnnotations links the book's
+// annotations with. No relation is standardized for this yet, so it's
+// the Web Annotation vocabulary's IRI for a collection of annotations,
+// which is what study and education reading systems look for.
+const RelAnnotations = "http://www.w3.org/ns/oa#AnnotationCollection"
+
+// annotationMediaType is the media type of Web Annotation files.
+const annotationMediaType = `application/ld+json; profile="http://www.w3.org/ns/anno.jsonld"`
+
+// webAnnotationMotivations are the motivations the Web Annotation
+// vocabulary defines.
+var webAnnotationMotivations = map[string]bool{
+	"assessing": true, "bookmarking": true, "classifying": true, "commenting": true,
+	"describing": true, "editing": true, "highlighting": true, "identifying": true,
+	"linking": true, "moderating": true, "questioning": true, "replying": true,
+	"tagging": true,
+}
+
+// Annotation is a note on part of the book, for AddAnnotations.
+type Annotation struct {
+	// Target is the ID of the XHTML file the note is about, and
+	// Fragment the ID of the element in it, or empty for the whole
+	// file.
+	Target   Id
+	Fragment string
+	// Body is the text of the note, and Format its media type,
+	// "text/plain" or "text/html". An empty Format is plain text.
+	Body   string
+	Format string
+	// Motivation is why the note was written, from the Web Annotation
+	// vocabulary: "commenting", the default, "describing",
+	// "linking", and so on.
+	Motivation string
+	// Creator is the name of whoever wrote the note, if it's anyone
+	// in particular.
+	Creator string
+}
+
+// webAnnotation is an annotation as it's written in the sidecar file.
+type webAnnotation struct {
+	ID         string           `json:"id"`
+	Type       string           `json:"type"`
+	Motivation string           `json:"motivation"`
+	Creator    *annotationAgent `json:"creator,omitempty"`
+	Body       annotationBody   `json:"body"`
+	Target     string           `json:"target"`
+}
+
+type annotationAgent struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type annotationBody struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Format   string `json:"format"`
+	Language string `json:"language,omitempty"`
+}
+
+type annotationPage struct {
+	Type       string          `json:"type"`
+	StartIndex int             `json:"startIndex"`
+	Items      []webAnnotation `json:"items"`
+}
+
+type annotationCollection struct {
+	Context string         `json:"@context"`
+	Type    string         `json:"type"`
+	Label   string         `json:"label,omitempty"`
+	Total   int            `json:"total"`
+	First   annotationPage `json:"first"`
+}
+
+// AddAnnotations adds the publisher's annotations on the book, such as
+// editor commentary or study notes, as a W3C Web Annotation collection
+// in JSON-LD. Path is the relative path in the book to the file, such
+// as "notes.jsonld", and label names the collection, or is empty. The
+// file is listed in the manifest, and linked from the package
+// metadata with RelAnnotations so reading systems can find it, though
+// only in v3 books, since ePub 2 has no links. Reading systems that
+// don't know the relation ignore it.
+//
+// The notes' targets are written relative to the file as the book
+// stands when they're added, so files should be given their final
+// zip paths (see SetZipPath) first.
+//
+// Returns the ID of the added file, or an error if a note is invalid.
+func (e *EPub) AddAnnotations(path, label string, notes []Annotation) (Id, error) {
+	if len(notes) == 0 {
+		return "", errors.New("no annotations to add")
+	}
+	id := e.nextId("annotations")
+	from := e.zipName(id, path)
+	items := make([]webAnnotation, len(notes))
+	for i, n := range notes {
+		x, err := e.findXHTML(n.Target)
+		if err != nil {
+			return "", err
+		}
+		if n.Body == "" {
+			return "", fmt.Errorf("annotation %v on %v has no body", i, n.Target)
+		}
+		format := n.Format
+		if format == "" {
+			format = "text/plain"
+		}
+		if format != "text/plain" && format != "text/html" {
+			return "", fmt.Errorf("annotation %v on %v has format %q; it must be text/plain or text/html", i, n.Target, format)
+		}
+		motivation := n.Motivation
+		if motivation == "" {
+			motivation = "commenting"
+		}
+		if !webAnnotationMotivations[motivation] {
+			return "", fmt.Errorf("annotation %v on %v has unknown motivation %q", i, n.Target, motivation)
+		}
+		target := e.zipName(x.id, x.name)
+		if n.Fragment != "" {
+			target += "#" + n.Fragment
+		}
+		a := webAnnotation{
+			ID:         fmt.Sprintf("#a%d", i+1),
+			Type:       "Annotation",
+			Motivation: motivation,
+			Body:       annotationBody{Type: "TextualBody", Value: n.Body, Format: format, Language: e.language()},
+			Target:     relativeLink(from, target),
+		}
+		if n.Creator != "" {
+			a.Creator = &annotationAgent{Type: "Person", Name: n.Creator}
+		}
+		items[i] = a
+	}
+	c, err := json.MarshalIndent(annotationCollection{
+		Context: "http://www.w3.org/ns/anno.jsonld",
+		Type:    "AnnotationCollection",
+		Label:   label,
+		Total:   len(items),
+		First:   annotationPage{Type: "AnnotationPage", Items: items},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	e.media = append(e.media, media{name: path, contents: append(c, '\n'), mediaType: annotationMediaType, id: id})
+	e.links = append(e.links, relatedLink{rel: RelAnnotations, mediaType: annotationMediaType, id: id})
+	return id, nil
+}
@@ -0,0 +1,158 @@
+package epub
+
+// This file holds the hooks that let callers audit the book's text.
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Issue is a problem a content audit found in the book.
+type Issue struct {
+	// Path is the path of the XHTML file in the book. Audits can leave
+	// it empty; it's filled in with the path of the file being
+	// audited.
+	Path string
+	// Message describes the problem.
+	Message string
+	// If true the issue is only a warning: it's reported by Warnings
+	// rather than failing Validate.
+	Warning bool
+}
+
+func (i Issue) String() string {
+	return i.Path + ": " + i.Message
+}
+
+// AuditError is returned by Validate when content audits find issues
+// that aren't warnings. It matches ErrContentAudit with errors.Is.
+type AuditError struct {
+	Issues []Issue
+}
+
+func (e *AuditError) Error() string {
+	msgs := make([]string, len(e.Issues))
+	for i, is := range e.Issues {
+		msgs[i] = is.String()
+	}
+	return fmt.Sprintf("content audit found %v issue(s): %v", len(e.Issues), strings.Join(msgs, "; "))
+}
+
+func (e *AuditError) Unwrap() error {
+	return ErrContentAudit
+}
+
+// AddContentAudit adds a check that's run over the text of each XHTML
+// file, in spine order, when the book is validated. It's meant for
+// spell-checkers, banned-word lists, placeholder detectors (see
+// PlaceholderAudit), and the like.
+//
+// Audit is called with the path of each file, as given to AddXHTML,
+// and its text: the contents of the body with markup removed,
+// entities decoded, and one line per paragraph, heading, or other
+// block. Issues it returns that aren't warnings make Validate fail,
+// and so stop the book being written; warnings are reported by
+// Warnings.
+func (e *EPub) AddContentAudit(audit func(path string, text string) []Issue) {
+	e.audits = append(e.audits, audit)
+}
+
+// audit runs the content audits, and returns the issues they find.
+func (e *EPub) audit() []Issue {
+	if len(e.audits) == 0 {
+		return nil
+	}
+	var issues []Issue
+	for _, x := range e.spineOrder() {
+		text := xhtmlText(x.contents)
+		for _, a := range e.audits {
+			for _, is := range a(x.name, text) {
+				if is.Path == "" {
+					is.Path = x.name
+				}
+				issues = append(issues, is)
+			}
+		}
+	}
+	return issues
+}
+
+// validateContent runs the content audits and returns an error if
+// they find any issues that aren't warnings.
+func (e *EPub) validateContent() error {
+	var errs []Issue
+	for _, is := range e.audit() {
+		if !is.Warning {
+			errs = append(errs, is)
+		}
+	}
+	if len(errs) > 0 {
+		return &AuditError{Issues: errs}
+	}
+	return nil
+}
+
+// auditWarnings returns the warnings the content audits find.
+func (e *EPub) auditWarnings() []string {
+	var warnings []string
+	for _, is := range e.audit() {
+		if is.Warning {
+			warnings = append(warnings, is.String())
+		}
+	}
+	return warnings
+}
+
+var (
+	bodyRE      = regexp.MustCompile(`(?is)<body\b[^>]*>(.*)</body\s*>`)
+	nonTextRE   = regexp.MustCompile(`(?is)<(script|style)\b[^>]*>.*?</(script|style)\s*>`)
+	blockEndRE  = regexp.MustCompile(`(?i)</(p|h[1-6]|li|div|dt|dd|blockquote|pre|tr|td|th|figcaption|section|aside)\s*>|<br\b[^>]*>`)
+	blankLineRE = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// xhtmlText returns the text of XHTML contents, for content audits.
+func xhtmlText(c []byte) string {
+	s := string(c)
+	if m := bodyRE.FindStringSubmatch(s); m != nil {
+		s = m[1]
+	}
+	s = nonTextRE.ReplaceAllString(s, "")
+	s = spaceRE.ReplaceAllString(s, " ")
+	s = blockEndRE.ReplaceAllString(s, "\n")
+	s = tagRE.ReplaceAllString(s, "")
+	lines := strings.Split(html.UnescapeString(s), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return strings.TrimSpace(blankLineRE.ReplaceAllString(strings.Join(lines, "\n"), "\n"))
+}
+
+// PlaceholderAudit returns a content audit, for AddContentAudit, that
+// reports text left over from drafts: the editor's "TK" (to come),
+// "TODO", "XXX", and "lorem ipsum". Extra patterns are regular
+// expressions to report as well. The issues aren't warnings, so a
+// book with placeholders fails Validate.
+func PlaceholderAudit(extra ...string) (func(path string, text string) []Issue, error) {
+	patterns := []string{`\bTK\b`, `\bTODO\b`, `\bXXX\b`, `(?i)\blorem ipsum\b`}
+	var res []*regexp.Regexp
+	for _, p := range append(patterns, extra...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return func(path, text string) []Issue {
+		var issues []Issue
+		for n, line := range strings.Split(text, "\n") {
+			for _, re := range res {
+				if m := re.FindString(line); m != "" {
+					issues = append(issues, Issue{Message: fmt.Sprintf("placeholder %q in line %v: %v", m, n+1, line)})
+				}
+			}
+		}
+		return issues
+	}, nil
+}
@@ -0,0 +1,104 @@
+package epub
+
+// Benchmarks for serializing books of various shapes. See the
+// Performance section of the README for the budget these are expected
+// to stay within; run them with
+//
+//	go test -run NONE -bench Serialize -benchmem
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// syntheticBook builds a book with the given number of chapters, each
+// with paragraphs paragraphs of text, and the given number of images.
+func syntheticBook(tb testing.TB, chapters, paragraphs, images int) *EPub {
+	e := New()
+	e.SetTitle("Synthetic")
+	e.AddAuthor("Benchmark")
+	e.AddLanguage("en")
+	para := "<p>" + strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit. ", 10) + "</p>\n"
+	for c := 0; c < chapters; c++ {
+		name := fmt.Sprintf("xhtml/chapter%v.xhtml", c)
+		body := fmt.Sprintf("<h1>Chapter %v</h1>\n%s", c, strings.Repeat(para, paragraphs))
+		if _, err := e.AddXHTML(name, xhtmlPage(fmt.Sprintf("Chapter %v", c), body)); err != nil {
+			tb.Fatal(err)
+		}
+		e.AddNavpoint(fmt.Sprintf("Chapter %v", c), name, c)
+	}
+	if images > 0 {
+		c := testPNG(tb, 600, 800)
+		for i := 0; i < images; i++ {
+			if _, err := e.AddImage(fmt.Sprintf("images/%v.png", i), c); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return e
+}
+
+func benchmarkSerialize(b *testing.B, version float64, chapters, paragraphs, images int) {
+	e := syntheticBook(b, chapters, paragraphs, images)
+	e.SetVersion(version)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := e.Serialize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerializeSmallV2(b *testing.B)    { benchmarkSerialize(b, 2, 5, 20, 1) }
+func BenchmarkSerializeSmallV3(b *testing.B)    { benchmarkSerialize(b, 3, 5, 20, 1) }
+func BenchmarkSerializeMediumV2(b *testing.B)   { benchmarkSerialize(b, 2, 40, 100, 10) }
+func BenchmarkSerializeMediumV3(b *testing.B)   { benchmarkSerialize(b, 3, 40, 100, 10) }
+func BenchmarkSerializeHugeText(b *testing.B)   { benchmarkSerialize(b, 3, 300, 200, 0) }
+func BenchmarkSerializeHugeImages(b *testing.B) { benchmarkSerialize(b, 3, 10, 5, 500) }
+
+// TestSerializeAllocBudget fails if serializing any of the benchmark
+// books allocates more than the README's performance budget allows.
+// Time isn't checked, since it depends too much on the machine, and
+// nothing is checked under the race detector, which allocates for its
+// own bookkeeping.
+func TestSerializeAllocBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts aren't meaningful under the race detector")
+	}
+	tests := []struct {
+		name                         string
+		version                      float64
+		chapters, paragraphs, images int
+		budget                       float64
+	}{
+		{"SmallV2", 2, 5, 20, 1, 1000},
+		{"SmallV3", 3, 5, 20, 1, 1000},
+		{"MediumV2", 2, 40, 100, 10, 5000},
+		{"MediumV3", 3, 40, 100, 10, 5000},
+		{"HugeText", 3, 300, 200, 0, 25000},
+		{"HugeImages", 3, 10, 5, 500, 20000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if testing.Short() && tt.budget > 5000 {
+				t.Skip("skipping huge book in short mode")
+			}
+			e := syntheticBook(t, tt.chapters, tt.paragraphs, tt.images)
+			e.SetVersion(tt.version)
+			var err error
+			allocs := testing.AllocsPerRun(2, func() {
+				if err == nil {
+					_, err = e.Serialize()
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allocs > tt.budget {
+				t.Errorf("Serialize made %v allocations, want at most %v (see the Performance section of the README)", allocs, tt.budget)
+			}
+		})
+	}
+}
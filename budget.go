@@ -0,0 +1,125 @@
+package epub
+
+// This file holds the code for checking the book against size
+// budgets.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// budgetOffenders is the number of files listed when the book is over
+// its size budget.
+const budgetOffenders = 5
+
+// SetSizeBudget sets size budgets, in bytes, for the whole book and
+// for each image in it. Zero means no budget. Retailers limit the size
+// of uploads, and some charge delivery fees by size (Amazon's 70%
+// royalty option, for example), so it's useful to catch growth at
+// build time.
+//
+// A book bigger than its total budget fails Validate, and so can't be
+// written; the error lists the largest files. Images bigger than the
+// per-image budget are reported by Warnings. Sizes are of the files
+// before compression, so text-heavy books come in well under the
+// budget once zipped; images and fonts barely compress.
+func (e *EPub) SetSizeBudget(total, perImage int64) error {
+	if total < 0 || perImage < 0 {
+		return errors.New("size budgets can't be negative")
+	}
+	e.sizeBudget, e.imageBudget = total, perImage
+	return nil
+}
+
+// sizedFile is the name and size of one of the book's files.
+type sizedFile struct {
+	name string
+	size int64
+}
+
+// fileSizes returns the names and uncompressed sizes of the files in
+// the book, largest first.
+func (e *EPub) fileSizes() []sizedFile {
+	var files []sizedFile
+	e.eachFile(func(name string, contents []byte) {
+		files = append(files, sizedFile{name, int64(len(contents))})
+	})
+	sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+	return files
+}
+
+// eachFile calls add with the name and contents of each of the files
+// added to the book. Generated files, such as the package document,
+// aren't included.
+func (e *EPub) eachFile(add func(name string, contents []byte)) {
+	for _, x := range e.xhtml {
+		add(x.name, x.contents)
+	}
+	for _, i := range e.images {
+		add(i.name, i.contents)
+	}
+	for _, s := range e.styles {
+		add(s.name, s.contents)
+	}
+	for _, f := range e.fonts {
+		add(f.name, f.contents)
+	}
+	for _, s := range e.bookScripts() {
+		add(s.name, s.contents)
+	}
+	for _, m := range e.media {
+		add(m.name, m.contents)
+	}
+}
+
+// validateSize checks the book against its total size budget.
+func (e *EPub) validateSize() error {
+	if e.sizeBudget == 0 {
+		return nil
+	}
+	files := e.fileSizes()
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	if total <= e.sizeBudget {
+		return nil
+	}
+	if len(files) > budgetOffenders {
+		files = files[:budgetOffenders]
+	}
+	var largest []string
+	for _, f := range files {
+		largest = append(largest, fmt.Sprintf("%v (%v)", f.name, formatSize(f.size)))
+	}
+	return errorf(ErrOverBudget, "book is %v, over its %v size budget; largest files: %v", formatSize(total), formatSize(e.sizeBudget), strings.Join(largest, ", "))
+}
+
+// sizeWarnings returns warnings for images over the per-image size
+// budget.
+func (e *EPub) sizeWarnings() []string {
+	if e.imageBudget == 0 {
+		return nil
+	}
+	var warnings []string
+	for _, i := range e.images {
+		if n := int64(len(i.contents)); n > e.imageBudget {
+			warnings = append(warnings, fmt.Sprintf("image %v is %v, over the %v per-image size budget", i.name, formatSize(n), formatSize(e.imageBudget)))
+		}
+	}
+	return warnings
+}
+
+// formatSize returns n bytes in human-readable form.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
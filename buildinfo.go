@@ -0,0 +1,203 @@
+package epub
+
+// This file holds the build manifest, which records how a book was
+// produced so a copy of it can be traced back to its build.
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// buildManifestPath is where the build manifest goes in the book.
+const buildManifestPath = "META-INF/build.json"
+
+// modulePath is the path of this package's module, whose version the
+// build manifest records.
+const modulePath = "github.com/writingtoole/epub"
+
+// BuildManifest records how a book was produced: the version of this
+// package and of Go that wrote it, the options it was written with,
+// and the hashes and modification times of its files. It's written
+// into the book by SetBuildManifest, and can be marshaled as JSON for
+// a sidecar file.
+type BuildManifest struct {
+	// Generator is this package's module path and version, which is
+	// "(devel)" when it isn't built as a versioned module.
+	Generator string `json:"generator"`
+	// GoVersion is the version of Go the program was built with.
+	GoVersion string `json:"goVersion"`
+	// Built is when the book was written: its dcterms:modified
+	// metadata if it has any, and otherwise the time the manifest was
+	// made, in RFC 3339 format.
+	Built string `json:"built"`
+	// Options holds the settings that affect how the book is written,
+	// by name, such as "version" and "fontObfuscation". Hooks and
+	// other functions are recorded by how many there are, since their
+	// code can't be.
+	Options map[string]string `json:"options"`
+	// Resources are the book's files, ordered by path.
+	Resources []BuildResource `json:"resources"`
+}
+
+// BuildResource is a file in a BuildManifest.
+type BuildResource struct {
+	// Path is the file's zip entry name, and ID its manifest ID.
+	Path string `json:"path"`
+	ID   Id     `json:"id"`
+	// SHA256 is the hex SHA-256 hash of the file's contents as they
+	// were added to the book, before any preparation for writing.
+	SHA256 string `json:"sha256"`
+	// Modified is the file's modification time (see SetModTime) in
+	// RFC 3339 format, if it has one.
+	Modified string `json:"modified,omitempty"`
+}
+
+// SetBuildManifest controls whether the book's build manifest, as
+// returned by BuildManifest, is written into it as
+// META-INF/build.json. It's off by default. Reading systems ignore
+// the file.
+func (e *EPub) SetBuildManifest(include bool) {
+	e.buildManifest = include
+}
+
+// BuildManifest returns the manifest recording how the book is being
+// built.
+func (e *EPub) BuildManifest() BuildManifest {
+	m := BuildManifest{
+		Generator: modulePath + " " + moduleVersion(),
+		GoVersion: runtime.Version(),
+		Built:     time.Now().UTC().Format(time.RFC3339),
+		Options:   e.buildOptions(),
+	}
+	for _, md := range e.metadata {
+		if md.kind == "dcterms:modified" {
+			m.Built = md.value
+		}
+	}
+	add := func(id Id, name string, contents []byte) {
+		sum := sha256.Sum256(contents)
+		r := BuildResource{Path: e.zipName(id, name), ID: id, SHA256: hex.EncodeToString(sum[:])}
+		if t, ok := e.modTimes[id]; ok {
+			r.Modified = t.UTC().Format(time.RFC3339)
+		}
+		m.Resources = append(m.Resources, r)
+	}
+	for _, i := range e.images {
+		add(i.id, i.name, i.contents)
+	}
+	for _, x := range e.xhtml {
+		add(x.id, x.name, x.contents)
+	}
+	for _, s := range e.styles {
+		add(s.id, s.name, s.contents)
+	}
+	for _, s := range e.bookScripts() {
+		add(s.id, s.name, s.contents)
+	}
+	for _, f := range e.fonts {
+		add(f.id, f.name, f.contents)
+	}
+	for _, md := range e.media {
+		add(md.id, md.name, md.contents)
+	}
+	sort.Slice(m.Resources, func(i, j int) bool { return m.Resources[i].Path < m.Resources[j].Path })
+	return m
+}
+
+// moduleVersion returns the version of this package's module the
+// program was built with, or "(devel)".
+func moduleVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if bi.Main.Path == modulePath && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	for _, d := range bi.Deps {
+		if d.Path == modulePath {
+			if d.Replace != nil {
+				return d.Version + " => " + d.Replace.Path + " " + d.Replace.Version
+			}
+			return d.Version
+		}
+	}
+	return "(devel)"
+}
+
+// buildOptions returns the settings the book is written with, for the
+// build manifest.
+func (e *EPub) buildOptions() map[string]string {
+	opts := map[string]string{
+		"version":           strconv.FormatFloat(e.version, 'f', -1, 64),
+		"fixedLayout":       strconv.FormatBool(e.fixedLayout),
+		"ncx":               strconv.FormatBool(e.wantNCX(e.version)),
+		"contentProfile":    e.contentProfile.String(),
+		"strict":            strconv.FormatBool(e.strict),
+		"stripScripts":      strconv.FormatBool(e.stripScripts),
+		"normalizeText":     strconv.FormatBool(e.normalizeText),
+		"propagateLanguage": strconv.FormatBool(e.propagateLanguage),
+		"autoOrient":        strconv.FormatBool(e.autoOrient),
+		"autoSortKeys":      strconv.FormatBool(e.autoSortKeys),
+		"drmFree":           strconv.FormatBool(e.drmFree),
+		"embargo":           strconv.FormatBool(e.embargo),
+		"fontObfuscation":   strconv.FormatBool(e.obfuscateFonts),
+		"iccPolicy":         strconv.Itoa(int(e.iccPolicy)),
+		"metadataOrder":     strconv.Itoa(int(e.metadataOrder)),
+		"preload":           strconv.Itoa(e.preload),
+		"tocLabelMax":       strconv.Itoa(e.tocLabelMax),
+		"beforeWriteHooks":  strconv.Itoa(len(e.beforeWrite)),
+		"resourceHooks":     strconv.Itoa(len(e.resourceWrite)),
+		"contentAudits":     strconv.Itoa(len(e.audits)),
+		"hyphenators":       strconv.Itoa(len(e.hyphenators)),
+	}
+	if e.xmlIndentSet {
+		opts["xmlIndent"] = strconv.Quote(e.xmlIndent)
+	}
+	if e.deflater != nil {
+		opts["deflater"] = fmt.Sprintf("%T", e.deflater)
+	}
+	if e.sanitizer != nil {
+		opts["sanitizer"] = "true"
+	}
+	return opts
+}
+
+// validateBuildManifest checks that the build manifest won't clash
+// with a file of the book's own.
+func (e *EPub) validateBuildManifest() error {
+	if !e.buildManifest {
+		return nil
+	}
+	for _, p := range e.zipPaths {
+		if p == buildManifestPath {
+			return errorf(ErrReserved, "zip path %q is reserved in books with a build manifest", p)
+		}
+	}
+	return nil
+}
+
+// addBuildManifest adds the build manifest to the book, if it has one.
+func (e *EPub) addBuildManifest(z *zip.Writer) error {
+	if !e.buildManifest {
+		return nil
+	}
+	c, err := json.MarshalIndent(e.BuildManifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := z.Create(buildManifestPath)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(c, '\n'))
+	return err
+}
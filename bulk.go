@@ -0,0 +1,261 @@
+package epub
+
+// This file holds the APIs for adding many files to a book at once,
+// and for editing many books at once.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceKind identifies the kind of file in an AddRequest.
+type ResourceKind int
+
+const (
+	KindXHTML ResourceKind = iota
+	KindImage
+	KindStylesheet
+	KindJavaScript
+	KindFont
+	KindAudio
+	KindVideo
+)
+
+// AddRequest describes a single file to add to a book with AddAll.
+type AddRequest struct {
+	Kind ResourceKind
+	// Source is the name of a file to read, from the file system set
+	// with WithFS if there is one. The added file gets its
+	// modification time, as with AddImageFile. If empty, Contents is
+	// used instead.
+	Source   string
+	Contents []byte
+	// Dest is the name the file should have in the ePub book.
+	Dest string
+	// Order is the spine order for XHTML files, as with AddXHTML.
+	Order int
+}
+
+// prepared is the result of the concurrent part of adding a file.
+type prepared struct {
+	contents []byte
+	image    image     // For images, decoded and oriented
+	modTime  time.Time // Of the source file, if it's known
+	err      error
+}
+
+// AddAll adds many files to the book at once. Reading files from disk
+// and decoding images is done concurrently by up to parallelism
+// workers, which can speed up adding asset-heavy books such as comics
+// considerably. The files are then added to the book in the order
+// given, so the result is the same as adding them one at a time.
+//
+// Returns the IDs of the added files, in the same order as items. If
+// reading or decoding any file fails nothing is added to the book, and
+// the error for the first failing item is returned. Files rejected
+// when they're added, such as fonts that aren't OpenType, stop AddAll
+// at that point; the IDs of the files added so far are returned along
+// with the error. AddAll stops early if ctx is cancelled.
+func (e *EPub) AddAll(ctx context.Context, items []AddRequest, parallelism int) ([]Id, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]prepared, len(items))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = e.prepare(items[i])
+			}
+		}()
+	}
+feed:
+	for i := range items {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		if re, ok := r.err.(*ResourceError); ok {
+			return nil, re
+		}
+		if r.err != nil {
+			return nil, &ResourceError{Op: "add", Path: items[i].Dest, Err: r.err}
+		}
+	}
+
+	ids := make([]Id, len(items))
+	for i, it := range items {
+		r := results[i]
+		var err error
+		switch it.Kind {
+		case KindImage:
+			im := r.image
+			im.id = e.nextId("img")
+			e.addImageEntry(im)
+			ids[i] = im.id
+		case KindXHTML:
+			ids[i], err = e.addXHTML(it.Dest, r.contents, it.Order)
+		case KindStylesheet:
+			ids[i], err = e.addStylesheet(it.Dest, r.contents, nil)
+		case KindJavaScript:
+			ids[i], err = e.addJavaScript(it.Dest, r.contents, nil)
+		case KindFont:
+			ids[i], err = e.AddFont(it.Dest, r.contents)
+		case KindAudio:
+			ids[i], err = e.AddAudio(it.Dest, r.contents)
+		case KindVideo:
+			ids[i], err = e.AddVideo(it.Dest, r.contents)
+		default:
+			err = fmt.Errorf("unknown resource kind %v", it.Kind)
+		}
+		if err == nil && !r.modTime.IsZero() {
+			err = e.SetModTime(ids[i], r.modTime)
+		}
+		if err != nil {
+			return ids[:i], &ResourceError{Op: "add", Path: it.Dest, Err: err}
+		}
+	}
+	return ids, nil
+}
+
+// prepare does the slow, independent part of adding a file: reading
+// it and, for images, decoding and orienting it as AddImage does.
+func (e *EPub) prepare(it AddRequest) prepared {
+	var r prepared
+	r.contents = it.Contents
+	if it.Source != "" {
+		r.contents, r.modTime, r.err = e.readSource(it.Source)
+		if r.err != nil {
+			return r
+		}
+	}
+	if it.Kind == KindImage {
+		r.image, r.err = e.newImage(it.Dest, r.contents)
+	}
+	return r
+}
+
+// BulkError is returned by BulkEdit when some of the books couldn't
+// be edited. Each error is a *ResourceError whose Path is the book's
+// file name and whose Op is "open", "edit", or "write".
+type BulkError struct {
+	Errors []*ResourceError
+}
+
+func (e *BulkError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%v of the books failed: %v", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// BulkEdit opens each of the named ePub files, calls fn to edit it,
+// and writes it back out in place, in its own version. Up to
+// parallelism books are edited concurrently, so fn must be safe to
+// call from several goroutines at once. It's meant for catalog-wide
+// fixes, such as renaming a publisher or replacing covers.
+//
+// A book is only rewritten if it was opened and edited without error,
+// and it's written to a temporary file that replaces the original
+// only once it's complete, so failures leave the original untouched.
+// Failures don't stop the other books being edited; if any book fails
+// the error is a *BulkError reporting each one, in the order of
+// paths.
+func BulkEdit(paths []string, fn func(*EPub) error, parallelism int) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	errs := make([]*ResourceError, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = bulkEditOne(paths[i], fn)
+			}
+		}()
+	}
+	for i := range paths {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var failed []*ResourceError
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return &BulkError{Errors: failed}
+	}
+	return nil
+}
+
+// bulkEditOne opens, edits, and rewrites a single book for BulkEdit.
+func bulkEditOne(name string, fn func(*EPub) error) *ResourceError {
+	e, err := Open(name)
+	if err != nil {
+		return &ResourceError{Op: "open", Path: name, Err: err}
+	}
+	if err := fn(e); err != nil {
+		return &ResourceError{Op: "edit", Path: name, Err: err}
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		return &ResourceError{Op: "write", Path: name, Err: err}
+	}
+	if err := replaceFile(name, book); err != nil {
+		return &ResourceError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+// replaceFile replaces the named file with contents, by writing them
+// to a temporary file in the same directory and renaming it over the
+// original.
+func replaceFile(name string, contents []byte) error {
+	mode := os.FileMode(0666)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
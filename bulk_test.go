@@ -0,0 +1,110 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddAll(t *testing.T) {
+	e := New()
+	var items []AddRequest
+	for i := 0; i < 20; i++ {
+		items = append(items, AddRequest{Kind: KindImage, Contents: testPNG(t, i+1, 10), Dest: fmt.Sprintf("images/%v.png", i)})
+	}
+	items = append(items, AddRequest{Kind: KindXHTML, Contents: []byte("<html/>"), Dest: "a.xhtml"})
+	ids, err := e.AddAll(context.Background(), items, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(items) {
+		t.Fatalf("AddAll returned %v ids, want %v", len(ids), len(items))
+	}
+	for i := 0; i < 20; i++ {
+		info, err := e.ImageInfo(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Width != i+1 {
+			t.Errorf("image %v has width %v, want %v", ids[i], info.Width, i+1)
+		}
+	}
+	if e.xhtml[0].id != ids[20] {
+		t.Errorf("xhtml id = %v, want %v", e.xhtml[0].id, ids[20])
+	}
+
+	bad := []AddRequest{{Kind: KindImage, Contents: []byte("not an image"), Dest: "images/bad.png"}}
+	if _, err := e.AddAll(context.Background(), bad, 2); err == nil {
+		t.Errorf("AddAll with a bad image succeeded")
+	}
+	if len(e.images) != 20 {
+		t.Errorf("failed AddAll added images; have %v, want 20", len(e.images))
+	}
+}
+
+func TestBulkEdit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bulkedit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for i := 0; i < 5; i++ {
+		e := simpleBook(t)
+		e.AddPublisher("Old Pub")
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, fmt.Sprintf("%v.epub", i))
+		if err := os.WriteFile(p, book, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	bad := filepath.Join(dir, "bad.epub")
+	if err := os.WriteFile(bad, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, bad, filepath.Join(dir, "missing.epub"))
+
+	err = BulkEdit(paths, func(e *EPub) error {
+		for i, m := range e.metadata {
+			if m.kind == "dc:publisher" && m.value == "Old Pub" {
+				e.metadata[i].value = "New Pub"
+			}
+		}
+		return nil
+	}, 3)
+	var be *BulkError
+	if !errors.As(err, &be) {
+		t.Fatalf("BulkEdit() = %v, want a *BulkError", err)
+	}
+	if len(be.Errors) != 2 || be.Errors[0].Path != bad || be.Errors[0].Op != "open" || be.Errors[1].Op != "open" {
+		t.Errorf("BulkEdit() errors = %v, want open errors for the bad and missing books", be.Errors)
+	}
+	for _, p := range paths[:5] {
+		book, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opf := zipFile(t, book, "OPS/content.opf"); !strings.Contains(opf, "New Pub") || strings.Contains(opf, "Old Pub") {
+			t.Errorf("%v not edited:\n%s", p, opf)
+		}
+	}
+
+	before, _ := os.ReadFile(paths[4])
+	err = BulkEdit(paths[4:5], func(e *EPub) error { return errors.New("refused") }, 1)
+	if !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors[0].Op != "edit" {
+		t.Errorf("BulkEdit() = %v, want an edit error", err)
+	}
+	if after, _ := os.ReadFile(paths[4]); !bytes.Equal(after, before) {
+		t.Errorf("BulkEdit rewrote a book whose edit failed")
+	}
+}
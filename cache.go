@@ -0,0 +1,104 @@
+package epub
+
+// This file holds the cache of compressed files that lets books be
+// rewritten quickly after small changes.
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// CompressionCache holds the compressed forms of the files in books,
+// keyed by a hash of their contents, so that writing a book again
+// after a change only compresses the files that changed. It's meant for
+// watch-mode builders, which rebuild a book every time a source file
+// changes: with a shared cache, rebuilding an image-heavy book after
+// editing one chapter only compresses that chapter.
+//
+// A CompressionCache can be shared by any number of books, including
+// ones being written concurrently. Set it on a book with
+// SetCompressionCache.
+type CompressionCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[[sha256.Size]byte]*list.Element
+	// lru holds the cached entries, most recently used first.
+	lru *list.List
+	// hits and misses count lookups, for tests.
+	hits, misses int
+}
+
+// cacheEntry is an entry in a CompressionCache.
+type cacheEntry struct {
+	key [sha256.Size]byte
+	d   *deflated
+}
+
+// NewCompressionCache returns an empty cache that holds up to maxBytes
+// of compressed files. When it's full the files that were used least
+// recently are dropped. Zero means no limit.
+func NewCompressionCache(maxBytes int64) *CompressionCache {
+	return &CompressionCache{
+		maxBytes: maxBytes,
+		entries:  make(map[[sha256.Size]byte]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// SetCompressionCache makes the book compress its files through c when
+// it's written, reusing the compressed forms of files that haven't
+// changed since they were last written with the same cache. The
+// generated files, such as the package document, are always
+// compressed afresh. Passing nil turns caching off again.
+func (e *EPub) SetCompressionCache(c *CompressionCache) {
+	e.compressionCache = c
+}
+
+// writeCache returns the cache files are compressed through when the
+// book is written, or nil if there isn't one.
+func (e *EPub) writeCache() entryCache {
+	if e.compressionCache == nil {
+		return nil
+	}
+	return e.compressionCache
+}
+
+// get returns the compressed form of f, compressing it if the cache
+// doesn't already hold it.
+func (c *CompressionCache) get(f zipEntry, dl Deflater) (*deflated, error) {
+	key := sha256.Sum256(f.contents)
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.hits++
+		d := el.Value.(*cacheEntry).d
+		c.mu.Unlock()
+		return d, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// Compress without holding the lock, so books being written
+	// concurrently don't wait on each other.
+	d, err := deflate(f.contents, dl)
+	if err != nil {
+		return nil, err
+	}
+	// Don't hold on to the book's own copy of the file.
+	d.contents = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key, d})
+		c.size += int64(len(d.compressed))
+	}
+	for c.maxBytes > 0 && c.size > c.maxBytes && c.lru.Len() > 0 {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.d.compressed))
+	}
+	return d, nil
+}
@@ -0,0 +1,164 @@
+package epub
+
+// This file holds the code for metadata about single chapters, such as
+// the stories in an anthology.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"path"
+	"strings"
+)
+
+// ChapterMetadata is metadata about a single XHTML file in the book,
+// for books such as anthologies and magazines whose chapters have
+// their own authors and publication histories.
+type ChapterMetadata struct {
+	// Authors are the chapter's authors.
+	Authors []string
+	// Date is the date the chapter was first published, as YYYY,
+	// YYYY-MM, or YYYY-MM-DD.
+	Date string
+	// Source is where the chapter was first published, such as the
+	// magazine a story first appeared in.
+	Source string
+}
+
+// Credit is a chapter's entry in a credits page, as passed to a
+// theme's CreditsPage template.
+type Credit struct {
+	// Title is the chapter's label in the table of contents, or the
+	// content of its title element if it has no entry there.
+	Title string
+	// Href is the chapter's href, relative to the credits page.
+	Href string
+	ChapterMetadata
+}
+
+// SetChapterMetadata sets the metadata of the XHTML file with the
+// given ID, replacing any it already has. In v3 books the metadata is
+// written into the package metadata as meta elements refining the
+// file's spine itemref, with the dcterms:creator, dcterms:date, and
+// dcterms:source properties. Use AddCreditsPage to also show it to
+// readers, which works for v2 books too.
+func (e *EPub) SetChapterMetadata(id Id, md ChapterMetadata) error {
+	x, err := e.findXHTML(id)
+	if err != nil {
+		return err
+	}
+	if md.Date != "" && !revisionDateRE.MatchString(md.Date) {
+		return fmt.Errorf("chapter date %q isn't of the form YYYY, YYYY-MM, or YYYY-MM-DD", md.Date)
+	}
+	md.Authors = append([]string(nil), md.Authors...)
+	x.meta = &md
+	return nil
+}
+
+// ChapterMetadata returns the metadata of the XHTML file with the
+// given ID, and whether it has any.
+func (e *EPub) ChapterMetadata(id Id) (ChapterMetadata, bool) {
+	x, err := e.findXHTML(id)
+	if err != nil || x.meta == nil {
+		return ChapterMetadata{}, false
+	}
+	md := *x.meta
+	md.Authors = append([]string(nil), md.Authors...)
+	return md, true
+}
+
+// itemrefID returns the ID of the spine itemref for x, which is only
+// needed if metadata refines it.
+func itemrefID(x xhtml) string {
+	if x.meta == nil {
+		return ""
+	}
+	return "ref-" + string(x.id)
+}
+
+// chapterMetaElements returns the chapter metadata as v3 package
+// metadata elements refining the spine itemrefs.
+func (e *EPub) chapterMetaElements() []xmlElement {
+	var ret []xmlElement
+	for _, x := range e.spineOrder() {
+		ref := itemrefID(x)
+		if ref == "" {
+			continue
+		}
+		add := func(property, value string) {
+			if value != "" {
+				ret = append(ret, newElement("meta", e.plainText(value), "refines", "#"+ref, "property", property))
+			}
+		}
+		for _, a := range x.meta.Authors {
+			add("dcterms:creator", a)
+		}
+		add("dcterms:date", x.meta.Date)
+		add("dcterms:source", x.meta.Source)
+	}
+	return ret
+}
+
+// creditsPath is where AddCreditsPage puts the credits page.
+const creditsPath = "xhtml/credits.xhtml"
+
+// AddCreditsPage generates a "Credits" page listing the chapters with
+// metadata set with SetChapterMetadata, in reading order, using the
+// book's theme, and adds it to the book with the given spine order.
+// Anthologies and magazines conventionally put one at the end of the
+// book, so order should normally put it there. The chapter metadata
+// should be set before this is called.
+//
+// Returns the ID of the generated page.
+func (e *EPub) AddCreditsPage(order int) (Id, error) {
+	d := e.pageData()
+	for _, x := range e.spineOrder() {
+		if x.meta == nil {
+			continue
+		}
+		d.Credits = append(d.Credits, Credit{Title: e.chapterTitle(x), Href: relativeHref(creditsPath, x.name), ChapterMetadata: *x.meta})
+	}
+	if len(d.Credits) == 0 {
+		return "", errors.New("no chapters have metadata")
+	}
+	t := e.pageTheme().CreditsPage
+	if t == nil {
+		// Themes written before credits pages existed.
+		t = creditsTemplate
+	}
+	x, err := e.renderPage(t, "Credits", d)
+	if err != nil {
+		return "", err
+	}
+	return e.AddXHTML(creditsPath, x, order)
+}
+
+// chapterTitle returns the title of x for the credits page: its label
+// in the table of contents, or the content of its title element.
+func (e *EPub) chapterTitle(x xhtml) string {
+	var find func(np []*Navpoint) string
+	find = func(np []*Navpoint) string {
+		for _, n := range np {
+			if strings.SplitN(n.filename, "#", 2)[0] == x.name {
+				label, _ := e.tocLabel(e.navpointLabel(n))
+				return label
+			}
+			if l := find(n.navpoints); l != "" {
+				return l
+			}
+		}
+		return ""
+	}
+	if l := find(e.navpoints); l != "" {
+		return l
+	}
+	if m := titleRE.FindSubmatch(x.contents); m != nil {
+		return strings.Join(strings.Fields(e.plainText(string(m[1]))), " ")
+	}
+	return path.Base(x.name)
+}
+
+var creditsTemplate = template.Must(template.New("credits").Parse(`<div class="credits">
+<h1>Credits</h1>
+{{range .Credits}}<p class="credit"><a href="{{.Href}}">{{.Title}}</a>{{if .Authors}}, by {{range $i, $a := .Authors}}{{if $i}} and {{end}}{{$a}}{{end}}{{end}}.{{if .Source}} First published in {{.Source}}{{if .Date}}, {{.Date}}{{end}}.{{else if .Date}} First published {{.Date}}.{{end}}</p>
+{{end}}</div>`))
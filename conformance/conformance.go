@@ -0,0 +1,388 @@
+// Package conformance builds a corpus of small books, each exercising
+// one feature of the epub package's writers, and checks them with
+// EPUBCheck, the reference validator reading systems are tested
+// against. Its tests compare each book's EPUBCheck report with a
+// golden report, so changes to the writers are guarded end to end
+// rather than only by string comparisons in unit tests.
+//
+// EPUBCheck is a Java program, so it isn't run unless it's available:
+// the tests run the command in the EPUBCHECK environment variable,
+// such as "java -jar /opt/epubcheck/epubcheck.jar", or epubcheck if
+// it's on the PATH, and are skipped otherwise. Run
+//
+//	go test ./conformance -update
+//
+// to record the current reports as the golden ones after checking
+// them.
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/writingtoole/epub"
+)
+
+// Case is a book in the corpus.
+type Case struct {
+	// Name identifies the case, such as "toc-nesting-v3". It's also
+	// the name of the case's golden report.
+	Name string
+	// Version is the ePub version the book is written as.
+	Version float64
+	// Build makes the book, without writing it.
+	Build func() (*epub.EPub, error)
+}
+
+// feature is a feature the corpus exercises, and the versions it's
+// exercised in.
+type feature struct {
+	name     string
+	versions []float64
+	build    func(e *epub.EPub) error
+}
+
+// features are the features the corpus exercises. Each is built on top
+// of a minimal book with a title, language, and one page.
+var features = []feature{
+	{"minimal", []float64{2, 3, 3.3}, func(e *epub.EPub) error { return nil }},
+	{"toc-nesting", []float64{2, 3}, buildTOCNesting},
+	{"fixed-layout", []float64{3}, buildFixedLayout},
+	{"fonts", []float64{2, 3, 3.3}, buildFonts},
+	{"rtl", []float64{2, 3}, buildRTL},
+}
+
+// Cases returns the corpus: each feature in each version it applies
+// to.
+func Cases() []Case {
+	var cases []Case
+	for _, f := range features {
+		for _, v := range f.versions {
+			f, v := f, v
+			cases = append(cases, Case{
+				Name:    fmt.Sprintf("%v-v%v", f.name, v),
+				Version: v,
+				Build: func() (*epub.EPub, error) {
+					e, err := base(v)
+					if err != nil {
+						return nil, err
+					}
+					if err := f.build(e); err != nil {
+						return nil, err
+					}
+					return e, nil
+				},
+			})
+		}
+	}
+	return cases
+}
+
+// page returns an XHTML page with the given title and body, in the
+// given language and direction.
+func page(title, lang, dir, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="%[2]v" dir="%[3]v">
+<head>
+<title>%[1]v</title>
+</head>
+<body>
+%[4]v
+</body>
+</html>
+`, title, lang, dir, body)
+}
+
+// base returns the minimal book every case starts from. Its UUID is
+// fixed, so reports don't change from run to run.
+func base(version float64) (*epub.EPub, error) {
+	e := epub.New()
+	if err := e.SetVersion(version); err != nil {
+		return nil, err
+	}
+	if err := e.SetUUID("urn:uuid:5b3a3f2e-6c1d-4a8e-9f0b-2d7c4e1a9b60"); err != nil {
+		return nil, err
+	}
+	e.SetTitle("Conformance")
+	e.AddAuthor("The epub authors")
+	if err := e.AddLanguage("en"); err != nil {
+		return nil, err
+	}
+	if _, err := e.AddXHTML("text/start.xhtml", page("Start", "en", "ltr", `<h1 id="start">Start</h1>
+<p>The first page.</p>`)); err != nil {
+		return nil, err
+	}
+	e.AddNavpoint("Start", "text/start.xhtml", 1)
+	return e, nil
+}
+
+// buildTOCNesting adds chapters with sections and subsections, for a
+// table of contents three levels deep.
+func buildTOCNesting(e *epub.EPub) error {
+	for c := 1; c <= 2; c++ {
+		name := fmt.Sprintf("text/chapter%d.xhtml", c)
+		var body strings.Builder
+		fmt.Fprintf(&body, "<h1>Chapter %d</h1>\n", c)
+		for s := 1; s <= 2; s++ {
+			fmt.Fprintf(&body, "<h2 id=\"s%d\">Section %d.%d</h2>\n<p>Text.</p>\n", s, c, s)
+			fmt.Fprintf(&body, "<h3 id=\"s%d-1\">Subsection %d.%d.1</h3>\n<p>Text.</p>\n", s, c, s)
+		}
+		if _, err := e.AddXHTML(name, page(fmt.Sprintf("Chapter %d", c), "en", "ltr", body.String())); err != nil {
+			return err
+		}
+		ch := e.AddNavpoint(fmt.Sprintf("Chapter %d", c), name, c+1)
+		for s := 1; s <= 2; s++ {
+			sec := ch.AddNavpoint(fmt.Sprintf("Section %d.%d", c, s), fmt.Sprintf("%v#s%d", name, s), s)
+			sec.AddNavpoint(fmt.Sprintf("Subsection %d.%d.1", c, s), fmt.Sprintf("%v#s%d-1", name, s), 1)
+		}
+	}
+	return nil
+}
+
+// buildFixedLayout makes the book fixed layout, with two image pages.
+func buildFixedLayout(e *epub.EPub) error {
+	e.SetFixedLayout(true)
+	for i, c := range []color.Gray{{Y: 0x40}, {Y: 0xc0}} {
+		img := image.NewGray(image.Rect(0, 0, 60, 80))
+		for p := range img.Pix {
+			img.Pix[p] = c.Y
+		}
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			return err
+		}
+		if _, err := e.AddImagePage(fmt.Sprintf("images/page%d.png", i+1), b.Bytes(), fmt.Sprintf("Page %d", i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildFonts embeds two faces of a font, with a stylesheet of
+// @font-face rules linked into the book's pages.
+func buildFonts(e *epub.EPub) error {
+	for _, f := range []struct {
+		path, subfamily string
+		weight          int
+	}{
+		{"fonts/Serif-Regular.otf", "Regular", 400},
+		{"fonts/Serif-Bold.otf", "Bold", 700},
+	} {
+		if _, err := e.AddFont(f.path, font("Conformance Serif", f.subfamily, f.weight)); err != nil {
+			return err
+		}
+	}
+	if _, err := e.AddFontFaceStylesheet("css/fonts.css", true); err != nil {
+		return err
+	}
+	_, err := e.AddStylesheet("css/main.css", `body { font-family: "Conformance Serif", serif; }`)
+	return err
+}
+
+// buildRTL adds a right-to-left page in Hebrew, with a stylesheet
+// that sets its direction too.
+func buildRTL(e *epub.EPub) error {
+	if err := e.AddLanguage("he"); err != nil {
+		return err
+	}
+	if _, err := e.AddStylesheet("css/rtl.css", `html[dir="rtl"] body { direction: rtl; unicode-bidi: embed; }`); err != nil {
+		return err
+	}
+	if _, err := e.AddXHTML("text/hebrew.xhtml", page("עברית", "he", "rtl", `<h1 id="he">עברית</h1>
+<p>שלום עולם. This sentence mixes directions: <span dir="ltr" xml:lang="en">left to right</span>.</p>`)); err != nil {
+		return err
+	}
+	e.AddNavpoint("עברית", "text/hebrew.xhtml", 2)
+	return nil
+}
+
+// font returns a minimal OpenType font with the given names and weight:
+// just its name and OS/2 tables, which is all the epub package reads.
+func font(family, subfamily string, weight int) []byte {
+	var strs, records []byte
+	for _, n := range []struct {
+		id int
+		s  string
+	}{{1, family}, {2, subfamily}} {
+		var s []byte
+		for _, u := range utf16.Encode([]rune(n.s)) {
+			s = append(s, byte(u>>8), byte(u))
+		}
+		rec := make([]byte, 12)
+		binary.BigEndian.PutUint16(rec, 3)
+		binary.BigEndian.PutUint16(rec[2:], 1)
+		binary.BigEndian.PutUint16(rec[4:], 0x409)
+		binary.BigEndian.PutUint16(rec[6:], uint16(n.id))
+		binary.BigEndian.PutUint16(rec[8:], uint16(len(s)))
+		binary.BigEndian.PutUint16(rec[10:], uint16(len(strs)))
+		records = append(records, rec...)
+		strs = append(strs, s...)
+	}
+	name := make([]byte, 6)
+	binary.BigEndian.PutUint16(name[2:], 2)
+	binary.BigEndian.PutUint16(name[4:], uint16(6+len(records)))
+	name = append(append(name, records...), strs...)
+	os2 := make([]byte, 96)
+	binary.BigEndian.PutUint16(os2[4:], uint16(weight))
+
+	tables := []struct {
+		tag  string
+		data []byte
+	}{{"OS/2", os2}, {"name", name}}
+	f := make([]byte, 12+16*len(tables))
+	copy(f, "OTTO")
+	binary.BigEndian.PutUint16(f[4:], uint16(len(tables)))
+	for i, t := range tables {
+		r := f[12+16*i:]
+		copy(r, t.tag)
+		binary.BigEndian.PutUint32(r[8:], uint32(len(f)))
+		binary.BigEndian.PutUint32(r[12:], uint32(len(t.data)))
+		f = append(f, t.data...)
+	}
+	return f
+}
+
+// Message is a problem EPUBCheck reported.
+type Message struct {
+	// Severity is "FATAL", "ERROR", "WARNING", or "USAGE", and ID
+	// EPUBCheck's ID for the check, such as "RSC-005".
+	Severity string
+	ID       string
+	// Path is the file in the book the problem is in, or empty if it's
+	// about the book as a whole.
+	Path string
+}
+
+func (m Message) String() string {
+	if m.Path == "" {
+		return m.Severity + " " + m.ID
+	}
+	return m.Severity + " " + m.ID + " " + m.Path
+}
+
+// Report is what EPUBCheck reported about a book, sorted, without
+// duplicates. It doesn't include message texts or line numbers, which
+// change between EPUBCheck releases, so golden reports only change
+// when the problems do.
+type Report []Message
+
+// String returns the report as it's stored in golden files: one
+// message per line.
+func (r Report) String() string {
+	var b strings.Builder
+	for _, m := range r {
+		b.WriteString(m.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// ParseReport reads a golden report, in the format String writes.
+func ParseReport(golden []byte) (Report, error) {
+	var r Report
+	for i, l := range strings.Split(string(golden), "\n") {
+		f := strings.Fields(l)
+		switch len(f) {
+		case 0:
+		case 2:
+			r = append(r, Message{Severity: f[0], ID: f[1]})
+		case 3:
+			r = append(r, Message{Severity: f[0], ID: f[1], Path: f[2]})
+		default:
+			return nil, fmt.Errorf("line %v of report is malformed: %q", i+1, l)
+		}
+	}
+	return r, nil
+}
+
+// epubcheckJSON is the part of EPUBCheck's JSON output the report is
+// made from.
+type epubcheckJSON struct {
+	Messages []struct {
+		ID        string `json:"ID"`
+		Severity  string `json:"severity"`
+		Locations []struct {
+			Path string `json:"path"`
+		} `json:"locations"`
+	} `json:"messages"`
+}
+
+// ErrNoEPUBCheck is returned by Command when EPUBCheck isn't
+// available.
+var ErrNoEPUBCheck = errors.New("EPUBCheck not found; set EPUBCHECK or put epubcheck on the PATH")
+
+// Command returns the command that runs EPUBCheck: the one in the
+// EPUBCHECK environment variable, split into words, or epubcheck if
+// it's on the PATH.
+func Command() ([]string, error) {
+	if c := strings.Fields(os.Getenv("EPUBCHECK")); len(c) > 0 {
+		return c, nil
+	}
+	p, err := exec.LookPath("epubcheck")
+	if err != nil {
+		return nil, ErrNoEPUBCheck
+	}
+	return []string{p}, nil
+}
+
+// Check runs EPUBCheck, with the command from Command, on the
+// serialized book, in the temporary directory dir, and returns its
+// report.
+func Check(command []string, book []byte, dir string) (Report, error) {
+	in := filepath.Join(dir, "book.epub")
+	out := filepath.Join(dir, "report.json")
+	if err := os.WriteFile(in, book, 0666); err != nil {
+		return nil, err
+	}
+	args := append(append([]string(nil), command[1:]...), in, "--json", out)
+	var stderr bytes.Buffer
+	cmd := exec.Command(command[0], args...)
+	cmd.Stderr = &stderr
+	// EPUBCheck exits with an error status when it finds problems, so
+	// that only matters if it wrote no report.
+	runErr := cmd.Run()
+	c, err := os.ReadFile(out)
+	if err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("%v: %v\n%s", strings.Join(command, " "), runErr, stderr.Bytes())
+		}
+		return nil, err
+	}
+	var j epubcheckJSON
+	if err := json.Unmarshal(c, &j); err != nil {
+		return nil, fmt.Errorf("unable to parse EPUBCheck report: %v", err)
+	}
+	seen := make(map[Message]bool)
+	var r Report
+	for _, m := range j.Messages {
+		paths := []string{""}
+		if len(m.Locations) > 0 {
+			paths = paths[:0]
+			for _, l := range m.Locations {
+				paths = append(paths, filepath.ToSlash(l.Path))
+			}
+		}
+		for _, p := range paths {
+			msg := Message{Severity: m.Severity, ID: m.ID, Path: p}
+			if !seen[msg] {
+				seen[msg] = true
+				r = append(r, msg)
+			}
+		}
+	}
+	sort.Slice(r, func(a, b int) bool { return r[a].String() < r[b].String() })
+	return r, nil
+}
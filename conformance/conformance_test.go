@@ -0,0 +1,115 @@
+package conformance
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/writingtoole/epub"
+	"github.com/writingtoole/epub/epubtest"
+)
+
+var update = flag.Bool("update", false, "update golden EPUBCheck reports")
+
+// TestCases checks that every book in the corpus builds, passes the
+// package's own checks, and can be read back, whether or not
+// EPUBCheck is available.
+func TestCases(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, c := range Cases() {
+		t.Run(c.Name, func(t *testing.T) {
+			if seen[c.Name] {
+				t.Fatalf("case name %v is used more than once", c.Name)
+			}
+			seen[c.Name] = true
+			e, err := c.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := e.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			epubtest.AssertPackage(t, b)
+			if w := e.Warnings(); len(w) > 0 {
+				t.Errorf("Warnings() = %q", w)
+			}
+			if _, err := epub.Parse(b); err != nil {
+				t.Errorf("Parse: %v", err)
+			}
+		})
+	}
+}
+
+// TestEPUBCheck compares EPUBCheck's report on each book in the corpus
+// with its golden report in testdata. A case with no golden report is
+// expected to pass cleanly.
+func TestEPUBCheck(t *testing.T) {
+	command, err := Command()
+	if errors.Is(err, ErrNoEPUBCheck) {
+		t.Skip(err)
+	}
+	for _, c := range Cases() {
+		t.Run(c.Name, func(t *testing.T) {
+			e, err := c.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := e.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Check(command, b, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", c.Name+".golden")
+			if *update {
+				if len(got) == 0 {
+					if err := os.Remove(golden); err != nil && !os.IsNotExist(err) {
+						t.Fatal(err)
+					}
+					return
+				}
+				if err := os.MkdirAll("testdata", 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, []byte(got.String()), 0666); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var want Report
+			if g, err := os.ReadFile(golden); err == nil {
+				if want, err = ParseReport(g); err != nil {
+					t.Fatal(err)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("EPUBCheck reported\n%vwant\n%v(run with -update to accept)", got, want)
+			}
+		})
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	r := Report{
+		{Severity: "ERROR", ID: "RSC-005", Path: "OPS/text/start.xhtml"},
+		{Severity: "WARNING", ID: "PKG-010"},
+	}
+	got, err := ParseReport([]byte(r.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("ParseReport(%q) = %v, want %v", r.String(), got, r)
+	}
+	if _, err := ParseReport([]byte("ERROR\n")); err == nil {
+		t.Errorf("ParseReport accepted a malformed line")
+	}
+}
@@ -0,0 +1,51 @@
+package epub
+
+// This file holds the code for getting and replacing the cover of a
+// book, such as one read with Open.
+
+import (
+	"bytes"
+	img "image"
+)
+
+// Cover returns the ID and contents of the book's cover image. For
+// books read with Open the cover is found from either the v2 cover
+// meta element or the v3 cover-image manifest property, whichever
+// the book uses. It's an error matching ErrNotFound if the book has no
+// cover.
+func (e *EPub) Cover() (Id, []byte, error) {
+	if e.coverID == "" {
+		return "", nil, errorf(ErrNotFound, "the book has no cover image")
+	}
+	i, err := e.findImage(e.coverID)
+	if err != nil {
+		return "", nil, err
+	}
+	return i.id, i.contents, nil
+}
+
+// ReplaceCover replaces the contents of the book's cover image, as
+// found by Cover. The cover keeps its ID and path, so cover pages and
+// anything else that refer to it show the new image; as with
+// AddImage, the new image's format is detected from its contents, and
+// it's prudent for it to match the extension of the path.
+func (e *EPub) ReplaceCover(contents []byte) error {
+	id, _, err := e.Cover()
+	if err != nil {
+		return err
+	}
+	i, err := e.findImage(id)
+	if err != nil {
+		return err
+	}
+	cfg, format, err := img.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return &ResourceError{Op: "decode", Path: i.name, Err: err}
+	}
+	contents, cfg, err = e.orientImage(contents, format, cfg)
+	if err != nil {
+		return &ResourceError{Op: "orient", Path: i.name, Err: err}
+	}
+	i.contents, i.filetype, i.cfg = contents, format, &cfg
+	return nil
+}
@@ -0,0 +1,82 @@
+package epub
+
+// This file holds the check that the files stylesheets refer to are
+// in the book.
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	cssCommentRE = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssURLRE     = regexp.MustCompile(`(?i)\burl\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+	cssImportRE  = regexp.MustCompile(`(?i)@import\s+(?:"([^"]*)"|'([^']*)')`)
+	urlSchemeRE  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+)
+
+// cssReferences returns the targets of the @import rules and url()
+// values in the CSS contents c, in the order they appear.
+func cssReferences(c []byte) []string {
+	c = cssCommentRE.ReplaceAll(c, nil)
+	var refs []string
+	for _, re := range []*regexp.Regexp{cssImportRE, cssURLRE} {
+		for _, m := range re.FindAllSubmatch(c, -1) {
+			for _, g := range m[1:] {
+				if g != nil {
+					refs = append(refs, string(g))
+					break
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// validateStyleReferences checks that the files the book's
+// stylesheets import or refer to with url(), such as fonts and
+// background images, are in the book. References to other sites and
+// data URLs aren't checked.
+func (e *EPub) validateStyleReferences() error {
+	names := make(map[string]bool)
+	for _, i := range e.images {
+		names[e.zipName(i.id, i.name)] = true
+	}
+	for _, x := range e.xhtml {
+		names[e.zipName(x.id, x.name)] = true
+	}
+	for _, s := range e.styles {
+		names[e.zipName(s.id, s.name)] = true
+	}
+	for _, s := range e.scripts {
+		names[e.zipName(s.id, s.name)] = true
+	}
+	for _, f := range e.fonts {
+		names[e.zipName(f.id, f.name)] = true
+	}
+	for _, m := range e.media {
+		names[e.zipName(m.id, m.name)] = true
+	}
+
+	for _, s := range e.styles {
+		from := e.zipName(s.id, s.name)
+		for _, ref := range cssReferences(e.styleContents(s)) {
+			target := strings.TrimSpace(ref)
+			if i := strings.IndexAny(target, "?#"); i >= 0 {
+				target = target[:i]
+			}
+			if target == "" || urlSchemeRE.MatchString(target) || strings.HasPrefix(target, "//") {
+				continue
+			}
+			if p, err := url.PathUnescape(target); err == nil {
+				target = p
+			}
+			if !names[path.Join(path.Dir(from), target)] {
+				return errorf(ErrNotFound, "stylesheet %v refers to %q, which isn't in the book", s.name, ref)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package epub
+
+// This file holds the hook for compressing books with a Deflate
+// implementation other than the standard library's.
+
+import "io"
+
+// Deflater makes the writers that compress the files in a book, for
+// SetDeflater. Whatever it returns must write the raw Deflate format
+// (RFC 1951), as compress/flate does, since that's the only
+// compression ePub allows.
+type Deflater interface {
+	// NewWriter returns a writer that compresses what's written to it
+	// into w. Closing it must flush all the compressed data to w, but
+	// not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// DeflaterFunc adapts a function to a Deflater, so an alternative
+// flate package can be used with something like
+//
+//	e.SetDeflater(epub.DeflaterFunc(func(w io.Writer) (io.WriteCloser, error) {
+//		return flate.NewWriter(w, flate.BestCompression)
+//	}))
+type DeflaterFunc func(w io.Writer) (io.WriteCloser, error)
+
+// NewWriter calls f(w).
+func (f DeflaterFunc) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return f(w)
+}
+
+// SetDeflater makes the book compress its files with d when it's
+// written, rather than with compress/flate at its best compression.
+// Faster implementations, such as github.com/klauspost/compress/flate,
+// can cut the time large books take to write substantially. Files
+// compressed through a CompressionCache shared with books that use a
+// different Deflater may have been compressed by either. Passing nil
+// goes back to compress/flate.
+func (e *EPub) SetDeflater(d Deflater) {
+	e.deflater = d
+}
@@ -0,0 +1,260 @@
+package epub
+
+// This file holds the code that derives accessible editions of a
+// book: a large-print variant, and the book's text laid out for
+// braille embossers.
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// largePrintCSSRE matches CSS declarations that get in the way of large
+// print: font sizes in absolute units, which don't scale with the base
+// font, justified text, columns, and hyphenation.
+var largePrintCSSRE = regexp.MustCompile(`(?i)^\s*(?:font-size\s*:\s*[\d.]+\s*(?:px|pt|pc|cm|mm|in)\b|text-align\s*:\s*justify\b|(?:-webkit-|-moz-)?column(?:s|-[a-z-]+)\s*:|(?:-webkit-|-moz-|-epub-|adobe-)?hyphen(?:s|ate)\s*:)`)
+
+// largePrintCSS is the stylesheet added to large-print variants. Its
+// argument is the scale of the base font, as a percentage.
+const largePrintCSS = `html {
+  font-size: %g%%;
+}
+body {
+  line-height: 1.5;
+  word-spacing: 0.1em;
+}
+p, li, dd, blockquote {
+  text-align: left;
+}
+`
+
+// SerializeLargePrint returns a large-print edition of the book, along
+// with notes describing what was changed. The book itself isn't
+// modified. Scale is the size of the base font relative to the
+// reading system's default, such as 1.5; zero gives 1.5, which takes
+// the common 12 point default to the 18 points large-print guidelines
+// ask for.
+//
+// The large-print edition:
+//   - has a stylesheet linked into every XHTML file that scales the
+//     base font and widens the spacing between lines and words;
+//   - has font sizes in absolute units, such as "12pt", removed from
+//     its stylesheets, so text scales with the base font, along with
+//     justification, columns, and hyphenation;
+//   - isn't hyphenated (see SetHyphenation);
+//   - declares the schema:accessibilityFeature "largePrint", if it's a
+//     v3 book.
+func (e *EPub) SerializeLargePrint(scale float64) ([]byte, []string, error) {
+	v, notes, err := e.largePrintVariant(scale)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := v.Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, notes, nil
+}
+
+// WriteLargePrint writes the large-print edition of the book, as
+// described for SerializeLargePrint, to the named file. It returns the
+// notes describing what was changed.
+func (e *EPub) WriteLargePrint(scale float64, name string) ([]string, error) {
+	buf, notes, err := e.SerializeLargePrint(scale)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(name, buf, 0666); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// largePrintVariant returns a large-print copy of the book, and notes
+// about the changes. The copy shares unmodified contents with the
+// original.
+func (e *EPub) largePrintVariant(scale float64) (*EPub, []string, error) {
+	if scale == 0 {
+		scale = 1.5
+	}
+	if scale < 1 {
+		return nil, nil, fmt.Errorf("large print scale %v is less than 1", scale)
+	}
+	v := *e
+	var notes []string
+	v.styles = make([]style, len(e.styles), len(e.styles)+1)
+	for i, s := range e.styles {
+		v.styles[i] = s
+		c, removed := removeCSS(s.contents, largePrintCSSRE)
+		if len(removed) > 0 {
+			v.styles[i].contents = c
+			notes = append(notes, fmt.Sprintf("removed CSS that stops text scaling from %v: %v", s.name, strings.Join(removed, "; ")))
+		}
+	}
+	name := "largeprint.css"
+	for n := 2; v.hasStyle(name); n++ {
+		name = fmt.Sprintf("largeprint%d.css", n)
+	}
+	v.lastId = make(map[string]int, len(e.lastId))
+	for k, n := range e.lastId {
+		v.lastId[k] = n
+	}
+	v.styles = append(v.styles, style{
+		name:     name,
+		contents: []byte(fmt.Sprintf(largePrintCSS, scale*100)),
+		id:       v.nextId("css"),
+		opts:     &StyleOptions{},
+	})
+	if len(e.hyphenators) > 0 {
+		v.hyphenators = nil
+		notes = append(notes, "turned off hyphenation")
+	}
+	if e.version >= 3 {
+		v.rawMetadata = append(append([]string(nil), e.rawMetadata...), `<meta property="schema:accessibilityFeature">largePrint</meta>`)
+	}
+	return &v, notes, nil
+}
+
+// hasStyle reports whether the book has a stylesheet with the given
+// path.
+func (e *EPub) hasStyle(name string) bool {
+	for _, s := range e.styles {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// BRFOptions controls the layout of the text SerializeBRF produces.
+type BRFOptions struct {
+	// CellsPerLine and LinesPerPage are the size of the embosser's
+	// pages. Zero gives 40 and 25, the common 11 by 11.5 inch braille
+	// page.
+	CellsPerLine int
+	LinesPerPage int
+	// Translate, if not nil, translates each paragraph into ASCII
+	// braille, as a braille translator such as liblouis does. Without
+	// it the text is left untranslated, for translation later.
+	Translate func(paragraph string) string
+}
+
+// brfFold maps typographic characters to their closest ASCII
+// equivalents, for braille-ready text.
+var brfFold = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201c", `"`, "\u201d", `"`,
+	"\u2013", "-", "\u2014", "--", "\u2026", "...",
+	"\u00a0", " ", "\u00ad", "",
+)
+
+// SerializeBRF returns the text of the book's XHTML files, in spine
+// order, laid out for a braille embosser in the manner of a BRF
+// (Braille Ready Format) file: ASCII only, lines no longer than the
+// page is wide, CR LF line endings, and a form feed at the end of each
+// page. Paragraphs start with a two cell indent, and each XHTML file
+// starts on a new page. Images, scripts, and styling are left out.
+//
+// The result is only braille if opts.Translate translates it, since
+// this package doesn't translate text into braille itself; without a
+// translator typographic punctuation is folded to ASCII and other
+// characters outside ASCII become "?".
+func (e *EPub) SerializeBRF(opts BRFOptions) ([]byte, error) {
+	width, height := opts.CellsPerLine, opts.LinesPerPage
+	if width == 0 {
+		width = 40
+	}
+	if height == 0 {
+		height = 25
+	}
+	if width < 10 || height < 1 {
+		return nil, fmt.Errorf("braille page of %v cells by %v lines is too small", width, height)
+	}
+	var b strings.Builder
+	line := 0
+	newline := func() {
+		b.WriteString("\r\n")
+		line++
+		if line == height {
+			b.WriteString("\f")
+			line = 0
+		}
+	}
+	for i, x := range e.spineOrder() {
+		if i > 0 && line > 0 {
+			b.WriteString("\f")
+			line = 0
+		}
+		for _, p := range strings.Split(xhtmlText(x.contents), "\n") {
+			if p == "" {
+				continue
+			}
+			p = brfFold.Replace(p)
+			if opts.Translate != nil {
+				p = opts.Translate(p)
+			}
+			for _, l := range wrapBRF("  "+brfASCII(p), width) {
+				b.WriteString(l)
+				newline()
+			}
+		}
+	}
+	if line > 0 {
+		b.WriteString("\f")
+	}
+	return []byte(b.String()), nil
+}
+
+// WriteBRF writes the book's text laid out for a braille embosser, as
+// described for SerializeBRF, to the named file.
+func (e *EPub) WriteBRF(name string, opts BRFOptions) error {
+	buf, err := e.SerializeBRF(opts)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf, 0666)
+}
+
+// brfASCII replaces the characters of s that aren't printable ASCII
+// with "?".
+func brfASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// wrapBRF breaks s into lines no longer than width, at spaces where it
+// can, keeping the indent at the start of s. Words longer than a line
+// are split.
+func wrapBRF(s string, width int) []string {
+	var lines []string
+	cur := s[:len(s)-len(strings.TrimLeft(s, " "))]
+	empty := true // Whether cur has no words yet
+	for _, w := range strings.Fields(s) {
+		if !empty && len(cur)+1+len(w) > width {
+			lines = append(lines, cur)
+			cur, empty = "", true
+		}
+		for len(cur)+len(w) > width {
+			n := width - len(cur)
+			lines = append(lines, cur+w[:n])
+			cur, w = "", w[n:]
+		}
+		switch {
+		case w == "":
+		case empty:
+			cur += w
+			empty = false
+		default:
+			cur += " " + w
+		}
+	}
+	if !empty {
+		lines = append(lines, cur)
+	}
+	return lines
+}
@@ -0,0 +1,301 @@
+package epub
+
+// This file holds the code to compare two serialized books.
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DiffReport describes the differences between two books, as found
+// by Diff.
+type DiffReport struct {
+	// Metadata lists the package metadata that changed.
+	Metadata []MetadataChange
+	// Added, Removed, and Changed are the paths of the files in the
+	// book's archive that were added, removed, or whose contents
+	// changed, sorted.
+	Added   []string
+	Removed []string
+	Changed []string
+	// OldSpine and NewSpine are the paths of the spine files, in
+	// order, if the spine changed.
+	OldSpine []string
+	NewSpine []string
+	// OldTOC and NewTOC are the table of contents entries, if they
+	// changed. Each entry is the label and target of a TOC entry,
+	// indented two spaces per level of nesting.
+	OldTOC []string
+	NewTOC []string
+}
+
+// MetadataChange is a change to one kind of metadata. Name is the
+// element name without its namespace prefix, such as "title", or for
+// meta elements "meta" and the property or name attribute, such as
+// "meta dcterms:modified". Old and New hold all the values of that
+// kind in each book.
+type MetadataChange struct {
+	Name string
+	Old  []string
+	New  []string
+}
+
+// Empty reports whether the books are the same.
+func (r *DiffReport) Empty() bool {
+	return len(r.Metadata) == 0 && len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0 &&
+		r.OldSpine == nil && r.NewSpine == nil && r.OldTOC == nil && r.NewTOC == nil
+}
+
+// String returns a human-readable summary of the differences.
+func (r *DiffReport) String() string {
+	var b strings.Builder
+	for _, m := range r.Metadata {
+		fmt.Fprintf(&b, "metadata %v: %q -> %q\n", m.Name, m.Old, m.New)
+	}
+	for _, p := range r.Added {
+		fmt.Fprintf(&b, "added %v\n", p)
+	}
+	for _, p := range r.Removed {
+		fmt.Fprintf(&b, "removed %v\n", p)
+	}
+	for _, p := range r.Changed {
+		fmt.Fprintf(&b, "changed %v\n", p)
+	}
+	if r.OldSpine != nil || r.NewSpine != nil {
+		fmt.Fprintf(&b, "spine: %v -> %v\n", r.OldSpine, r.NewSpine)
+	}
+	if r.OldTOC != nil || r.NewTOC != nil {
+		fmt.Fprintf(&b, "table of contents:\n  %v\n->\n  %v\n", strings.Join(r.OldTOC, "\n  "), strings.Join(r.NewTOC, "\n  "))
+	}
+	return b.String()
+}
+
+// bookSummary is the parts of a serialized book that Diff compares.
+type bookSummary struct {
+	hashes   map[string][sha256.Size]byte
+	metadata map[string][]string
+	spine    []string
+	toc      []string
+}
+
+// Diff compares two serialized books, such as two editions of the
+// same book, and reports how they differ: changed metadata, files
+// that were added, removed, or changed (by comparing content
+// hashes), and changes to the spine and table of contents. The books
+// can be any ePub v2 or v3 files, not just ones this package wrote.
+func Diff(a, b []byte) (*DiffReport, error) {
+	old, err := summarizeBook(a)
+	if err != nil {
+		return nil, fmt.Errorf("old book: %v", err)
+	}
+	cur, err := summarizeBook(b)
+	if err != nil {
+		return nil, fmt.Errorf("new book: %v", err)
+	}
+	r := &DiffReport{}
+
+	for _, name := range unionKeys(old.metadata, cur.metadata) {
+		if !equalStrings(old.metadata[name], cur.metadata[name]) {
+			r.Metadata = append(r.Metadata, MetadataChange{Name: name, Old: old.metadata[name], New: cur.metadata[name]})
+		}
+	}
+	for p, h := range cur.hashes {
+		oh, ok := old.hashes[p]
+		switch {
+		case !ok:
+			r.Added = append(r.Added, p)
+		case oh != h:
+			r.Changed = append(r.Changed, p)
+		}
+	}
+	for p := range old.hashes {
+		if _, ok := cur.hashes[p]; !ok {
+			r.Removed = append(r.Removed, p)
+		}
+	}
+	sort.Strings(r.Added)
+	sort.Strings(r.Removed)
+	sort.Strings(r.Changed)
+	if !equalStrings(old.spine, cur.spine) {
+		r.OldSpine, r.NewSpine = old.spine, cur.spine
+	}
+	if !equalStrings(old.toc, cur.toc) {
+		r.OldTOC, r.NewTOC = old.toc, cur.toc
+	}
+	return r, nil
+}
+
+// summarizeBook unpacks and parses a serialized book.
+func summarizeBook(book []byte) (*bookSummary, error) {
+	z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		return nil, err
+	}
+	s := &bookSummary{hashes: make(map[string][sha256.Size]byte), metadata: make(map[string][]string)}
+	files, err := zipContents(z)
+	if err != nil {
+		return nil, err
+	}
+	for name, c := range files {
+		s.hashes[name] = sha256.Sum256(c)
+	}
+
+	container, ok := files["META-INF/container.xml"]
+	if !ok {
+		return nil, errors.New("no META-INF/container.xml")
+	}
+	root, err := parseXML(bytes.NewReader(container))
+	if err != nil {
+		return nil, err
+	}
+	rf := root.find("rootfile")
+	if rf == nil {
+		return nil, errors.New("container has no rootfile")
+	}
+	opfName := rf.attr("full-path")
+	opfData, ok := files[opfName]
+	if !ok {
+		return nil, fmt.Errorf("no package document %v", opfName)
+	}
+	opf, err := parseXML(bytes.NewReader(opfData))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", opfName, err)
+	}
+
+	if md := opf.find("metadata"); md != nil {
+		for _, m := range md.elements() {
+			name := m.name
+			if name == "meta" {
+				name = "meta " + m.attr("property") + m.attr("name")
+			}
+			value := m.textContent()
+			if value == "" {
+				value = m.attr("content")
+			}
+			s.metadata[name] = append(s.metadata[name], value)
+		}
+		for _, v := range s.metadata {
+			sort.Strings(v)
+		}
+	}
+
+	resolve := func(from, href string) string {
+		if u, err := url.Parse(href); err == nil {
+			href = u.Path
+		}
+		return path.Join(path.Dir(from), href)
+	}
+	hrefs := make(map[string]string)
+	nav, ncx := "", ""
+	for _, item := range opf.findAll("item") {
+		p := resolve(opfName, item.attr("href"))
+		hrefs[item.attr("id")] = p
+		if strings.Contains(" "+item.attr("properties")+" ", " nav ") {
+			nav = p
+		}
+		if item.attr("media-type") == "application/x-dtbncx+xml" {
+			ncx = p
+		}
+	}
+	for _, ref := range opf.findAll("itemref") {
+		s.spine = append(s.spine, hrefs[ref.attr("idref")])
+	}
+
+	switch {
+	case nav != "":
+		n, err := parseXML(bytes.NewReader(files[nav]))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %v: %v", nav, err)
+		}
+		for _, t := range n.findAll("nav") {
+			if t.attr("type") == "toc" {
+				s.toc = navTOC(t, nav, "", resolve)
+			}
+		}
+	case ncx != "":
+		n, err := parseXML(bytes.NewReader(files[ncx]))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %v: %v", ncx, err)
+		}
+		if m := n.find("navMap"); m != nil {
+			s.toc = ncxTOC(m, ncx, "", resolve)
+		}
+	}
+	return s, nil
+}
+
+// navTOC flattens the entries of a v3 nav element.
+func navTOC(n *xnode, from, indent string, resolve func(string, string) string) []string {
+	var ret []string
+	for _, c := range n.elements() {
+		switch c.name {
+		case "li":
+			if a := c.find("a"); a != nil {
+				ret = append(ret, fmt.Sprintf("%s%s (%s)", indent, a.textContent(), resolve(from, a.attr("href"))))
+			}
+			for _, ol := range c.elements() {
+				if ol.name == "ol" {
+					ret = append(ret, navTOC(ol, from, indent+"  ", resolve)...)
+				}
+			}
+		case "ol":
+			ret = append(ret, navTOC(c, from, indent, resolve)...)
+		}
+	}
+	return ret
+}
+
+// ncxTOC flattens the navPoints of an NCX navMap or navPoint.
+func ncxTOC(n *xnode, from, indent string, resolve func(string, string) string) []string {
+	var ret []string
+	for _, c := range n.elements() {
+		if c.name != "navPoint" {
+			continue
+		}
+		label, src := "", ""
+		if l := c.find("navLabel"); l != nil {
+			label = l.textContent()
+		}
+		if content := c.find("content"); content != nil {
+			src = resolve(from, content.attr("src"))
+		}
+		ret = append(ret, fmt.Sprintf("%s%s (%s)", indent, label, src))
+		ret = append(ret, ncxTOC(c, from, indent+"  ", resolve)...)
+	}
+	return ret
+}
+
+// unionKeys returns the keys of both maps, sorted.
+func unionKeys(a, b map[string][]string) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// equalStrings reports whether two string slices are the same.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
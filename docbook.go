@@ -0,0 +1,424 @@
+package epub
+
+// This file holds the importer for DocBook XML files.
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// docbookSimple maps DocBook elements to the XHTML elements they
+// convert to directly.
+var docbookSimple = map[string]string{
+	"para": "p", "simpara": "p", "formalpara": "div", "emphasis": "em",
+	"literal": "code", "code": "code", "command": "code", "filename": "code",
+	"option": "code", "varname": "code", "function": "code", "classname": "code",
+	"replaceable": "var", "userinput": "kbd", "computeroutput": "samp",
+	"programlisting": "pre", "screen": "pre", "literallayout": "pre",
+	"blockquote": "blockquote", "quote": "q", "citetitle": "cite",
+	"subscript": "sub", "superscript": "sup", "abbrev": "abbr", "acronym": "abbr",
+	"itemizedlist": "ul", "orderedlist": "ol", "listitem": "li",
+	"variablelist": "dl", "term": "dt", "note": "div", "tip": "div",
+	"warning": "div", "caution": "div", "important": "div", "sidebar": "div",
+	"example": "div", "informalexample": "div", "figure": "div",
+	"informalfigure": "div", "mediaobject": "div", "inlinemediaobject": "span",
+	"caption": "div", "table": "table", "informaltable": "table",
+	"thead": "thead", "tbody": "tbody", "tfoot": "tfoot", "row": "tr",
+	"epigraph": "blockquote", "attribution": "p", "phrase": "span",
+}
+
+// docbookChapters are the DocBook elements that become chapters.
+var docbookChapters = map[string]bool{
+	"chapter": true, "preface": true, "appendix": true, "article": true,
+	"glossary": true, "bibliography": true, "colophon": true, "dedication": true,
+	"acknowledgements": true,
+}
+
+// docbookSections are the DocBook section elements.
+var docbookSections = map[string]bool{
+	"section": true, "sect1": true, "sect2": true, "sect3": true,
+	"sect4": true, "sect5": true, "simplesect": true, "refsection": true,
+}
+
+// indexEntry is a single term for a generated index.
+type indexEntry struct {
+	term    string
+	page    string // Relative to the book root
+	id      string // The term's anchor in page
+	section string // The title of the section the term is in
+}
+
+// docbookImporter holds the state needed while importing a DocBook
+// file.
+type docbookImporter struct {
+	e      *EPub
+	dir    string            // Directory the DocBook file is in
+	page   string            // Name in the book of the file being converted
+	depth  int               // Section nesting depth
+	pages  map[string]string // Which page each element ID ends up on
+	images map[string]bool   // Images already added, by name in the book
+	index  []indexEntry
+	anchor int // Counter for generated anchor IDs
+	inline int // Footnote nesting depth, inside which paragraphs are spans
+	// The names of the elements being converted, innermost last.
+	parents []string
+	section string // The title of the innermost chapter or section
+	alt     string // Alt text for images, from the enclosing figure's title
+	err     error
+}
+
+// ImportDocBook creates a new book from a DocBook XML file. Source is
+// the name of the DocBook file on disk; images it references are read
+// relative to it.
+//
+// Each chapter, preface, appendix, and so on becomes an XHTML file
+// with a navpoint, and sections inside them become child
+// navpoints. Figures are converted to images, cross references are
+// resolved across files, and index terms are collected into a
+// generated index page at the end of the book. Metadata is taken from
+// the book's info element.
+//
+// The conversion is best-effort; elements that have no XHTML
+// equivalent are dropped, but their contents are kept.
+func ImportDocBook(source string) (*EPub, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	root, err := parseXML(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", source, err)
+	}
+
+	e := New()
+	d := &docbookImporter{
+		e:      e,
+		dir:    filepath.Dir(source),
+		pages:  make(map[string]string),
+		images: make(map[string]bool),
+	}
+	d.info(root)
+	if lang := root.attr("lang"); lang != "" {
+		e.AddLanguage(lang)
+	}
+
+	var chapters []*xnode
+	if docbookChapters[root.name] {
+		chapters = append(chapters, root)
+	} else {
+		for _, c := range root.elements() {
+			if c.name == "part" {
+				for _, pc := range c.elements() {
+					if docbookChapters[pc.name] {
+						chapters = append(chapters, pc)
+					}
+				}
+			} else if docbookChapters[c.name] {
+				chapters = append(chapters, c)
+			}
+		}
+	}
+	if len(chapters) == 0 {
+		return nil, fmt.Errorf("%v has no chapters", source)
+	}
+
+	// Work out which file every ID lands in first, so cross references
+	// can point forward.
+	names := make([]string, len(chapters))
+	for i, c := range chapters {
+		names[i] = fmt.Sprintf("xhtml/chapter%03d.xhtml", i+1)
+		d.collectIDs(c, names[i])
+	}
+
+	for i, c := range chapters {
+		d.page = names[i]
+		title := docbookTitle(c)
+		np := d.e.AddNavpoint(title, d.page, i+1)
+		d.sectionNavpoints(c, np)
+		d.depth = 0
+		conv := &converter{element: d.element}
+		conv.convert(c)
+		if _, err := e.AddXHTML(d.page, xhtmlPage(title, conv.b.String())); err != nil {
+			return nil, err
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.index) > 0 {
+		if err := d.addIndex(len(chapters) + 1); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// info records the book's metadata from its info element.
+func (d *docbookImporter) info(root *xnode) {
+	var info *xnode
+	for _, c := range root.elements() {
+		if c.name == "info" || c.name == "bookinfo" || c.name == "articleinfo" {
+			info = c
+		}
+	}
+	if t := docbookTitle(root); t != "" {
+		d.e.SetTitle(t)
+	}
+	if info == nil {
+		return
+	}
+	for _, a := range info.findAll("author") {
+		if n := a.textContent(); n != "" {
+			d.e.AddAuthor(n)
+		}
+	}
+	for _, p := range info.findAll("publishername") {
+		d.e.AddPublisher(p.textContent())
+	}
+	if a := info.find("abstract"); a != nil {
+		d.e.AddDescription(a.textContent())
+	}
+	for _, s := range info.findAll("subjectterm") {
+		d.e.AddSubject(s.textContent())
+	}
+}
+
+// docbookTitle returns the title of a DocBook element, looking in its
+// info element if necessary.
+func docbookTitle(n *xnode) string {
+	for _, c := range n.elements() {
+		switch c.name {
+		case "title":
+			return c.textContent()
+		case "info", "bookinfo", "chapterinfo", "articleinfo", "sectioninfo":
+			for _, ic := range c.elements() {
+				if ic.name == "title" {
+					return ic.textContent()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// collectIDs records that every element with an ID under n will be
+// written to the named page.
+func (d *docbookImporter) collectIDs(n *xnode, page string) {
+	if id := n.attr("id"); id != "" {
+		d.pages[id] = page
+	}
+	for _, c := range n.elements() {
+		d.collectIDs(c, page)
+	}
+}
+
+// sectionNavpoints adds child navpoints to np for the top-level
+// sections in the chapter n. Sections are given IDs if they don't
+// already have them.
+func (d *docbookImporter) sectionNavpoints(n *xnode, np *Navpoint) {
+	order := 0
+	for _, c := range n.elements() {
+		if !docbookSections[c.name] {
+			continue
+		}
+		title := docbookTitle(c)
+		if title == "" {
+			continue
+		}
+		order++
+		id := c.attr("id")
+		if id == "" {
+			id = "section" + strconv.Itoa(order)
+			c.setAttr("id", id)
+		}
+		np.AddNavpoint(title, d.page+"#"+id, order)
+	}
+}
+
+// link returns the href for a cross reference to the given ID.
+func (d *docbookImporter) link(id string) string {
+	page, ok := d.pages[id]
+	if !ok || page == d.page {
+		return "#" + id
+	}
+	return relativeHref(d.page, page) + "#" + id
+}
+
+// element writes the XHTML for a single DocBook element.
+func (d *docbookImporter) element(c *converter, n *xnode) {
+	parent := ""
+	if len(d.parents) > 0 {
+		parent = d.parents[len(d.parents)-1]
+	}
+	d.parents = append(d.parents, n.name)
+	defer func() { d.parents = d.parents[:len(d.parents)-1] }()
+
+	switch {
+	case docbookChapters[n.name]:
+		defer func(s string) { d.section = s }(d.section)
+		d.section = docbookTitle(n)
+		c.wrap("div", n, attrPair("class", n.name))
+		return
+	case docbookSections[n.name]:
+		defer func(s string) { d.section = s }(d.section)
+		d.section = docbookTitle(n)
+		d.depth++
+		c.wrap("div", n, attrPair("class", n.name))
+		d.depth--
+		return
+	}
+	switch n.name {
+	case "title":
+		switch {
+		case parent == "table" || parent == "informaltable":
+			c.wrap("caption", n)
+		case parent == "" || parent == "book" || parent == "part" || docbookChapters[parent] || docbookSections[parent]:
+			level := d.depth + 1
+			if level > 6 {
+				level = 6
+			}
+			c.wrap("h"+strconv.Itoa(level), n)
+		default:
+			// The title of a figure, example, note, and so on.
+			c.wrap("p", n, attrPair("class", "caption"))
+		}
+	case "figure", "informalfigure":
+		defer func(alt string) { d.alt = alt }(d.alt)
+		d.alt = docbookTitle(n)
+		c.wrap("div", n, attrPair("class", n.name))
+	case "info", "bookinfo", "chapterinfo", "sectioninfo", "remark", "titleabbrev":
+		// Metadata, dropped.
+	case "emphasis":
+		if r := n.attr("role"); r == "bold" || r == "strong" {
+			c.wrap("strong", n)
+		} else {
+			c.wrap("em", n)
+		}
+	case "link", "ulink":
+		href := n.attr("href")
+		if href == "" {
+			href = n.attr("url")
+		}
+		if l := n.attr("linkend"); l != "" {
+			href = d.link(l)
+		}
+		c.wrap("a", n, attrPair("href", href))
+	case "xref":
+		l := n.attr("linkend")
+		fmt.Fprintf(&c.b, `<a %s>%s</a>`, attrPair("href", d.link(l)), html.EscapeString(l))
+	case "anchor":
+		fmt.Fprintf(&c.b, `<a %s></a>`, attrPair("id", n.attr("id")))
+	case "footnote":
+		// Footnotes sit inside paragraphs, so their own paragraphs
+		// can't be p elements.
+		d.inline++
+		c.wrap("span", n, attrPair("class", "footnote"))
+		d.inline--
+	case "entry":
+		c.wrap("td", n)
+	case "tgroup", "imageobject", "textobject":
+		c.children(n)
+	case "imagedata":
+		d.img(c, n)
+	case "indexterm":
+		d.indexterm(c, n)
+	case "varlistentry":
+		c.children(n)
+	default:
+		if tag, ok := docbookSimple[n.name]; ok {
+			if tag == "p" && d.inline > 0 {
+				tag = "span"
+			}
+			if n.name != tag {
+				c.wrap(tag, n, attrPair("class", n.name))
+			} else {
+				c.wrap(tag, n)
+			}
+			return
+		}
+		c.children(n)
+	}
+}
+
+// img adds the referenced image to the book and writes an img element
+// for it.
+func (d *docbookImporter) img(c *converter, n *xnode) {
+	src := n.attr("fileref")
+	if src == "" {
+		return
+	}
+	name := "images/" + path.Base(src)
+	if !d.images[name] {
+		if _, err := d.e.AddImageFile(filepath.Join(d.dir, filepath.FromSlash(src)), name); err != nil {
+			if d.err == nil {
+				d.err = err
+			}
+			return
+		}
+		d.images[name] = true
+	}
+	fmt.Fprintf(&c.b, `<img %s %s />`, attrPair("src", relativeHref(d.page, name)), attrPair("alt", d.alt))
+}
+
+// indexterm writes an anchor for an index term and records it for the
+// generated index.
+func (d *docbookImporter) indexterm(c *converter, n *xnode) {
+	var parts []string
+	for _, l := range []string{"primary", "secondary", "tertiary"} {
+		if p := n.find(l); p != nil {
+			parts = append(parts, p.textContent())
+		}
+	}
+	if len(parts) == 0 {
+		return
+	}
+	d.anchor++
+	id := "indexterm" + strconv.Itoa(d.anchor)
+	fmt.Fprintf(&c.b, `<a %s></a>`, attrPair("id", id))
+	d.index = append(d.index, indexEntry{term: strings.Join(parts, ", "), page: d.page, id: id, section: d.section})
+}
+
+// addIndex adds a generated index page to the end of the book. Terms
+// that differ only in case share an entry, and each link is labelled
+// with the title of the section the term is in, or failing that its
+// number among the term's links.
+func (d *docbookImporter) addIndex(order int) error {
+	sort.SliceStable(d.index, func(i, j int) bool {
+		return strings.ToLower(d.index[i].term) < strings.ToLower(d.index[j].term)
+	})
+	page := "xhtml/index.xhtml"
+	var b strings.Builder
+	b.WriteString("<h1>Index</h1>\n<ul class=\"index\">\n")
+	n := 0
+	for i, ie := range d.index {
+		href := attrPair("href", relativeHref(page, ie.page)+"#"+ie.id)
+		if i > 0 && strings.EqualFold(d.index[i-1].term, ie.term) {
+			b.WriteString(", ")
+			n++
+		} else {
+			if i > 0 {
+				b.WriteString("</li>\n")
+			}
+			fmt.Fprintf(&b, "<li>%s: ", html.EscapeString(ie.term))
+			n = 1
+		}
+		label := html.EscapeString(ie.section)
+		if label == "" {
+			label = strconv.Itoa(n)
+		}
+		fmt.Fprintf(&b, "<a %s>%s</a>", href, label)
+	}
+	b.WriteString("</li>\n</ul>")
+	if _, err := d.e.AddXHTML(page, xhtmlPage("Index", b.String())); err != nil {
+		return err
+	}
+	d.e.AddNavpoint("Index", page, order)
+	return nil
+}
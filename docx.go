@@ -0,0 +1,513 @@
+package epub
+
+// This file holds the importer for word processor (.docx) files.
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// docxStyle is the subset of a Word paragraph style we carry over to
+// the generated stylesheet.
+type docxStyle struct {
+	heading int // Heading level, or 0 if this isn't a heading style
+	bold    bool
+	italic  bool
+	size    int // Font size in half-points
+	align   string
+	font    string
+}
+
+// docxChapter is a chapter being built up from a .docx file.
+type docxChapter struct {
+	title    string
+	body     strings.Builder
+	sections []docxSection
+}
+
+// docxSection is a second-level heading inside a chapter.
+type docxSection struct {
+	title string
+	id    string
+}
+
+// docxImporter holds the state needed while importing a .docx file.
+type docxImporter struct {
+	e        *EPub
+	z        *zip.Reader
+	rels     map[string]string     // Relationship targets, by ID
+	styles   map[string]*docxStyle // Paragraph styles, by style ID
+	used     map[string]bool       // Style IDs that appear in the document
+	images   map[string]string     // Book names of images, by .docx name
+	chapters []*docxChapter
+	inList   bool
+	ids      *slugger // Generates heading IDs
+	err      error
+}
+
+// ImportDOCX creates a new book from a word processor (.docx) file.
+//
+// Paragraphs are converted to XHTML, with each Heading 1 paragraph
+// starting a new chapter and navpoint, and Heading 2 paragraphs
+// becoming child navpoints. Paragraph styles are mapped to classes in
+// a generated stylesheet, embedded images are added to the book with
+// AddImage, and the title and author are taken from the document
+// properties.
+//
+// The conversion is best-effort. Things like text boxes, comments,
+// tracked changes, and most character formatting beyond bold,
+// italic, and underline aren't carried over.
+func ImportDOCX(source string) (*EPub, error) {
+	zr, err := zip.OpenReader(source)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	e := New()
+	d := &docxImporter{
+		e:      e,
+		z:      &zr.Reader,
+		rels:   make(map[string]string),
+		styles: make(map[string]*docxStyle),
+		used:   make(map[string]bool),
+		images: make(map[string]string),
+		ids:    &slugger{slug: Slug, used: make(map[string]bool)},
+	}
+	if err := d.readProperties(); err != nil {
+		return nil, err
+	}
+	if err := d.readRels(); err != nil {
+		return nil, err
+	}
+	if err := d.readStyles(); err != nil {
+		return nil, err
+	}
+	doc, err := d.parse("word/document.xml")
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("%v has no word/document.xml", source)
+	}
+	body := doc.find("body")
+	if body == nil {
+		return nil, fmt.Errorf("%v has no document body", source)
+	}
+	d.blocks(body)
+	d.endList()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return e, d.write()
+}
+
+// parse parses the named XML file in the .docx archive. It returns
+// nil if the file doesn't exist.
+func (d *docxImporter) parse(name string) (*xnode, error) {
+	for _, f := range d.z.File {
+		if f.Name != name {
+			continue
+		}
+		c, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		n, err := parseXML(bytes.NewReader(c))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %v: %v", name, err)
+		}
+		return n, nil
+	}
+	return nil, nil
+}
+
+// readProperties copies the document properties into the book's
+// metadata.
+func (d *docxImporter) readProperties() error {
+	core, err := d.parse("docProps/core.xml")
+	if err != nil || core == nil {
+		return err
+	}
+	for _, c := range core.elements() {
+		v := c.textContent()
+		if v == "" {
+			continue
+		}
+		switch c.name {
+		case "title":
+			d.e.SetTitle(v)
+		case "creator":
+			d.e.AddAuthor(v)
+		case "description":
+			d.e.AddDescription(v)
+		case "subject":
+			d.e.AddSubject(v)
+		case "language":
+			d.e.AddLanguage(v)
+		}
+	}
+	return nil
+}
+
+// readRels reads the document's relationships, which map the IDs used
+// by images and hyperlinks to their targets.
+func (d *docxImporter) readRels() error {
+	rels, err := d.parse("word/_rels/document.xml.rels")
+	if err != nil || rels == nil {
+		return err
+	}
+	for _, r := range rels.findAll("Relationship") {
+		d.rels[r.attr("Id")] = r.attr("Target")
+	}
+	return nil
+}
+
+// readStyles reads the paragraph styles from the document.
+func (d *docxImporter) readStyles() error {
+	styles, err := d.parse("word/styles.xml")
+	if err != nil || styles == nil {
+		return err
+	}
+	for _, s := range styles.findAll("style") {
+		if s.attr("type") != "paragraph" {
+			continue
+		}
+		id := s.attr("styleId")
+		ds := &docxStyle{}
+		name := ""
+		if n := s.find("name"); n != nil {
+			name = strings.ToLower(n.attr("val"))
+		}
+		if strings.HasPrefix(name, "heading ") {
+			ds.heading, _ = strconv.Atoi(strings.TrimPrefix(name, "heading "))
+		} else if name == "title" {
+			ds.heading = 1
+		}
+		if o := s.find("outlineLvl"); o != nil && ds.heading == 0 {
+			if l, err := strconv.Atoi(o.attr("val")); err == nil {
+				ds.heading = l + 1
+			}
+		}
+		ds.bold = s.find("b") != nil
+		ds.italic = s.find("i") != nil
+		if sz := s.find("sz"); sz != nil {
+			ds.size, _ = strconv.Atoi(sz.attr("val"))
+		}
+		if jc := s.find("jc"); jc != nil {
+			ds.align = jc.attr("val")
+		}
+		if f := s.find("rFonts"); f != nil {
+			ds.font = f.attr("ascii")
+		}
+		d.styles[id] = ds
+	}
+	return nil
+}
+
+// current returns the chapter being built, starting an untitled one
+// if necessary.
+func (d *docxImporter) current() *docxChapter {
+	if len(d.chapters) == 0 {
+		d.chapters = append(d.chapters, &docxChapter{})
+	}
+	return d.chapters[len(d.chapters)-1]
+}
+
+// blocks converts the block-level elements in n.
+func (d *docxImporter) blocks(n *xnode) {
+	for _, c := range n.elements() {
+		switch c.name {
+		case "p":
+			d.paragraph(c)
+		case "tbl":
+			d.endList()
+			d.table(c)
+		case "sdt", "sdtContent", "customXml":
+			d.blocks(c)
+		}
+	}
+}
+
+// endList closes off the list being built, if there is one.
+func (d *docxImporter) endList() {
+	if d.inList {
+		d.current().body.WriteString("</ul>\n")
+		d.inList = false
+	}
+}
+
+// paragraph converts a single paragraph.
+func (d *docxImporter) paragraph(p *xnode) {
+	styleID := ""
+	isList := false
+	if ppr := p.find("pPr"); ppr != nil {
+		if s := ppr.find("pStyle"); s != nil {
+			styleID = s.attr("val")
+		}
+		isList = ppr.find("numPr") != nil
+	}
+	level := 0
+	if s, ok := d.styles[styleID]; ok {
+		level = s.heading
+	}
+	text := d.runs(p)
+
+	if level > 0 {
+		d.endList()
+		title := p.textContent()
+		if level == 1 {
+			d.chapters = append(d.chapters, &docxChapter{title: title})
+		}
+		ch := d.current()
+		if level > 6 {
+			level = 6
+		}
+		id := d.ids.id(title)
+		if level == 2 && title != "" {
+			ch.sections = append(ch.sections, docxSection{title: title, id: id})
+		}
+		fmt.Fprintf(&ch.body, "<h%v %s>%s</h%v>\n", level, attrPair("id", id), text, level)
+		return
+	}
+
+	ch := d.current()
+	class := ""
+	if styleID != "" {
+		d.used[styleID] = true
+		class = " " + attrPair("class", "docx-"+styleID)
+	}
+	if isList {
+		if !d.inList {
+			ch.body.WriteString("<ul>\n")
+			d.inList = true
+		}
+		fmt.Fprintf(&ch.body, "<li%s>%s</li>\n", class, text)
+		return
+	}
+	d.endList()
+	fmt.Fprintf(&ch.body, "<p%s>%s</p>\n", class, text)
+}
+
+// runs returns the XHTML for the runs, hyperlinks, and images in a
+// paragraph.
+func (d *docxImporter) runs(p *xnode) string {
+	var b strings.Builder
+	for _, c := range p.elements() {
+		switch c.name {
+		case "r":
+			b.WriteString(d.run(c))
+		case "hyperlink":
+			inner := d.runs(c)
+			if t, ok := d.rels[c.attr("id")]; ok {
+				fmt.Fprintf(&b, `<a %s>%s</a>`, attrPair("href", t), inner)
+			} else if a := c.attr("anchor"); a != "" {
+				fmt.Fprintf(&b, `<a %s>%s</a>`, attrPair("href", "#"+a), inner)
+			} else {
+				b.WriteString(inner)
+			}
+		case "ins", "smartTag", "sdt", "sdtContent", "fldSimple":
+			b.WriteString(d.runs(c))
+		}
+	}
+	return b.String()
+}
+
+// run returns the XHTML for a single run of text.
+func (d *docxImporter) run(r *xnode) string {
+	var b strings.Builder
+	for _, c := range r.elements() {
+		switch c.name {
+		case "t":
+			b.WriteString(html.EscapeString(c.textContentRaw()))
+		case "tab":
+			b.WriteString(" ")
+		case "br", "cr":
+			b.WriteString("<br />")
+		case "drawing", "pict":
+			b.WriteString(d.image(c))
+		}
+	}
+	s := b.String()
+	if rpr := r.find("rPr"); rpr != nil && s != "" {
+		if on(rpr.find("u")) && rpr.find("u").attr("val") != "none" {
+			s = `<span class="underline">` + s + "</span>"
+		}
+		if on(rpr.find("i")) {
+			s = "<em>" + s + "</em>"
+		}
+		if on(rpr.find("b")) {
+			s = "<strong>" + s + "</strong>"
+		}
+	}
+	return s
+}
+
+// on reports whether a Word toggle property is present and turned on.
+func on(n *xnode) bool {
+	if n == nil {
+		return false
+	}
+	v := n.attr("val")
+	return v != "false" && v != "0" && v != "off"
+}
+
+// image adds the image embedded in a drawing to the book and returns
+// a placeholder img element for it. The src is filled in when the
+// chapter is written, since we don't yet know which file it ends up
+// in.
+func (d *docxImporter) image(n *xnode) string {
+	blip := n.find("blip")
+	if blip == nil {
+		blip = n.find("imagedata")
+	}
+	if blip == nil {
+		return ""
+	}
+	id := blip.attr("embed")
+	if id == "" {
+		id = blip.attr("id")
+	}
+	target, ok := d.rels[id]
+	if !ok {
+		return ""
+	}
+	name, ok := d.images[target]
+	if !ok {
+		src := path.Clean(path.Join("word", target))
+		var contents []byte
+		for _, f := range d.z.File {
+			if f.Name != src {
+				continue
+			}
+			var err error
+			contents, err = readZipFile(f)
+			if err != nil {
+				d.setErr(err)
+				return ""
+			}
+		}
+		if contents == nil {
+			return ""
+		}
+		name = "images/" + path.Base(target)
+		if _, err := d.e.AddImage(name, contents); err != nil {
+			// Formats like EMF that we can't decode get dropped.
+			return ""
+		}
+		d.images[target] = name
+	}
+	alt := ""
+	if p := n.find("docPr"); p != nil {
+		alt = p.attr("descr")
+	}
+	// Chapters are written into xhtml/, so images are one level up.
+	return fmt.Sprintf(`<img %s %s />`, attrPair("src", relativeHref("xhtml/x.xhtml", name)), attrPair("alt", alt))
+}
+
+// table converts a table.
+func (d *docxImporter) table(t *xnode) {
+	ch := d.current()
+	ch.body.WriteString("<table>\n")
+	for _, tr := range t.elements() {
+		if tr.name != "tr" {
+			continue
+		}
+		ch.body.WriteString("<tr>")
+		for _, tc := range tr.elements() {
+			if tc.name != "tc" {
+				continue
+			}
+			ch.body.WriteString("<td>")
+			for _, p := range tc.elements() {
+				if p.name == "p" {
+					fmt.Fprintf(&ch.body, "<p>%s</p>", d.runs(p))
+				}
+			}
+			ch.body.WriteString("</td>")
+		}
+		ch.body.WriteString("</tr>\n")
+	}
+	ch.body.WriteString("</table>\n")
+}
+
+func (d *docxImporter) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// stylesheet returns the generated CSS for the paragraph styles used
+// in the document.
+func (d *docxImporter) stylesheet() string {
+	var ids []string
+	for id := range d.used {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	b.WriteString(".underline { text-decoration: underline; }\n")
+	for _, id := range ids {
+		s, ok := d.styles[id]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, ".docx-%s {", id)
+		if s.bold {
+			b.WriteString(" font-weight: bold;")
+		}
+		if s.italic {
+			b.WriteString(" font-style: italic;")
+		}
+		if s.size > 0 {
+			fmt.Fprintf(&b, " font-size: %vpt;", float64(s.size)/2)
+		}
+		switch s.align {
+		case "center", "right", "left":
+			fmt.Fprintf(&b, " text-align: %s;", s.align)
+		case "both", "distribute":
+			b.WriteString(" text-align: justify;")
+		}
+		if s.font != "" {
+			fmt.Fprintf(&b, " font-family: %s;", cssString(s.font))
+		}
+		b.WriteString(" }\n")
+	}
+	return b.String()
+}
+
+// write adds the converted chapters and generated stylesheet to the
+// book.
+func (d *docxImporter) write() error {
+	css := "css/docx.css"
+	if _, err := d.e.AddStylesheet(css, d.stylesheet()); err != nil {
+		return err
+	}
+	if len(d.chapters) == 0 {
+		d.current()
+	}
+	for i, ch := range d.chapters {
+		page := fmt.Sprintf("xhtml/chapter%03d.xhtml", i+1)
+		title := ch.title
+		if title == "" {
+			title = d.e.title
+		}
+		if _, err := d.e.AddXHTML(page, xhtmlPage(title, ch.body.String(), relativeHref(page, css))); err != nil {
+			return err
+		}
+		if ch.title == "" {
+			continue
+		}
+		np := d.e.AddNavpoint(ch.title, page, i+1)
+		for j, s := range ch.sections {
+			np.AddNavpoint(s.title, page+"#"+s.id, j+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package epub
+
+// This file holds the code that declares a book DRM-free.
+
+import (
+	"bytes"
+	"html/template"
+)
+
+// SetDRMFree declares the book DRM-free, as publishers who sell
+// their books without digital rights management conventionally do.
+// When the book is written a colophon block saying so is added to the
+// end of the last file in the spine, and a meta element named
+// "drm-free" with content "true" is written into the package
+// metadata, in both v2 and v3 books.
+//
+// The block is rendered from the book theme's DRMFreeNotice template
+// as a div with class "drm-free", for stylesheets to style.
+func (e *EPub) SetDRMFree(drmFree bool) {
+	e.drmFree = drmFree
+}
+
+// DRMFree returns whether the book has been declared DRM-free.
+func (e *EPub) DRMFree() bool {
+	return e.drmFree
+}
+
+// drmFreeElements returns the package metadata declaring the book
+// DRM-free, if it is.
+func (e *EPub) drmFreeElements() []xmlElement {
+	if !e.drmFree {
+		return nil
+	}
+	return []xmlElement{newElement("meta", "", "name", "drm-free", "content", "true")}
+}
+
+// drmFreeNotice renders the DRM-free colophon block.
+func (e *EPub) drmFreeNotice() ([]byte, error) {
+	t := e.pageTheme().DRMFreeNotice
+	if t == nil {
+		// Themes written before DRM-free notices existed.
+		t = drmFreeTemplate
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, e.pageData()); err != nil {
+		return nil, err
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// validateDRMFree checks that the DRM-free notice can be rendered.
+func (e *EPub) validateDRMFree() error {
+	if !e.drmFree {
+		return nil
+	}
+	_, err := e.drmFreeNotice()
+	return err
+}
+
+// addDRMFreeNotice adds the DRM-free colophon block to the end of the
+// body of c, if x is the last file in the spine and doesn't have one
+// already, as books read with Open do.
+func (e *EPub) addDRMFreeNotice(x xhtml, c []byte) []byte {
+	if _, next := e.spineNeighbours(x); next != nil || bytes.Contains(c, []byte(`<div class="drm-free">`)) {
+		return c
+	}
+	end := bodyCloseRE.FindIndex(c)
+	if end == nil {
+		return c
+	}
+	// Validate has already checked that the notice renders.
+	block, err := e.drmFreeNotice()
+	if err != nil {
+		return c
+	}
+	ret := make([]byte, 0, len(c)+len(block))
+	ret = append(ret, c[:end[0]]...)
+	ret = append(ret, block...)
+	return append(ret, c[end[0]:]...)
+}
+
+var drmFreeTemplate = template.Must(template.New("drmfree").Parse(`<div class="drm-free">
+<p>This book is DRM-free. {{with .Publishers}}{{index . 0}}{{else}}The publisher{{end}} sells it without digital rights management, so you can read it on any device or app you like, and keep it for as long as you like.</p>
+<p>Please respect the author's work: don't share copies of this book with people who haven't bought it.</p>
+</div>`))
@@ -0,0 +1,458 @@
+package epub
+
+// This file holds the importer for DAISY 3 / NIMAS dtbook XML files.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dtbookSimple maps dtbook elements to the XHTML elements they
+// convert to directly.
+var dtbookSimple = map[string]string{
+	"p": "p", "h1": "h1", "h2": "h2", "h3": "h3", "h4": "h4", "h5": "h5", "h6": "h6",
+	"em": "em", "strong": "strong", "sub": "sub", "sup": "sup", "code": "code",
+	"blockquote": "blockquote", "li": "li", "dl": "dl", "dt": "dt", "dd": "dd",
+	"table": "table", "tr": "tr", "td": "td", "th": "th", "thead": "thead",
+	"tbody": "tbody", "tfoot": "tfoot", "q": "q", "cite": "cite", "abbr": "abbr",
+	"acronym": "abbr", "dfn": "dfn", "kbd": "kbd", "samp": "samp", "span": "span",
+	"div": "div", "address": "address", "bdo": "bdo",
+	"level": "div", "level1": "div", "level2": "div", "level3": "div",
+	"level4": "div", "level5": "div", "level6": "div",
+	"sidebar": "div", "note": "div", "annotation": "div", "prodnote": "div",
+	"imggroup": "div", "caption": "p", "poem": "div", "linegroup": "div",
+	"line": "p", "epigraph": "blockquote", "byline": "p", "dateline": "p",
+	"author": "p", "doctitle": "h1", "docauthor": "p", "covertitle": "p",
+	"bridgehead": "p", "hd": "p", "title": "p",
+}
+
+// dtbookImporter holds the state needed while importing a dtbook
+// file.
+type dtbookImporter struct {
+	e      *EPub
+	dir    string            // Directory the dtbook file is in
+	page   string            // Name in the book of the file being converted
+	pages  map[string]string // Which page each element ID ends up on
+	images map[string]string // Names in the book of images already added, by source file
+	names  map[string]bool   // Image names in the book that are taken
+	smil   map[string]*xnode // SMIL files the NCX refers to, by name on disk
+	err    error
+}
+
+// dtbookPart is a dtbook element that becomes an XHTML file.
+type dtbookPart struct {
+	n       *xnode
+	page    string
+	chapter int // The chapter number, or 0 for the front matter
+}
+
+// ImportDTBook creates a new book from a DAISY 3 or NIMAS dtbook XML
+// file. Source is the name of the dtbook file on disk; images it
+// references are read relative to it.
+//
+// The book's front matter becomes one XHTML file and each top-level
+// level1 element in the body and rear matter becomes a chapter. If
+// there's a DAISY NCX beside the dtbook file, with the same name but
+// an .ncx extension, its navMap becomes the table of contents;
+// otherwise level1 and level2 headings are turned into navpoints.
+// Links and note references are resolved across chapters, and page
+// numbers are preserved as page targets. Metadata is taken from the
+// dtbook head.
+//
+// The conversion is best-effort; elements that have no XHTML
+// equivalent are dropped, but their contents are kept.
+func ImportDTBook(source string) (*EPub, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	root, err := parseXML(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", source, err)
+	}
+	if root.name != "dtbook" {
+		return nil, fmt.Errorf("%v is not a dtbook file", source)
+	}
+
+	e := New()
+	d := &dtbookImporter{
+		e:      e,
+		dir:    filepath.Dir(source),
+		pages:  make(map[string]string),
+		images: make(map[string]string),
+		names:  make(map[string]bool),
+		smil:   make(map[string]*xnode),
+	}
+
+	if head := root.find("head"); head != nil {
+		for _, m := range head.findAll("meta") {
+			d.meta(m.attr("name"), m.attr("content"))
+		}
+	}
+	if lang := root.attr("lang"); lang != "" {
+		e.AddLanguage(lang)
+	}
+
+	book := root.find("book")
+	if book == nil {
+		return nil, fmt.Errorf("%v has no book element", source)
+	}
+	var parts []dtbookPart
+	chapter := 0
+	for _, part := range book.elements() {
+		switch part.name {
+		case "frontmatter":
+			parts = append(parts, dtbookPart{n: part, page: "xhtml/front.xhtml"})
+		case "bodymatter", "rearmatter":
+			for _, l := range part.elements() {
+				chapter++
+				parts = append(parts, dtbookPart{n: l, page: fmt.Sprintf("xhtml/chapter%03d.xhtml", chapter), chapter: chapter})
+			}
+		}
+	}
+
+	// Work out which file every ID lands in first, so links can point
+	// forward.
+	for _, p := range parts {
+		d.collectIDs(p.n, p.page)
+	}
+	ncx, err := d.ncxNavpoints(strings.TrimSuffix(source, filepath.Ext(source)) + ".ncx")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range parts {
+		d.page = p.page
+		title := e.title
+		if p.chapter > 0 {
+			title = heading(p.n)
+			if !ncx {
+				d.navpoints(p.n, p.chapter)
+			}
+		}
+		body := d.convert(p.n)
+		if _, err := e.AddXHTML(d.page, xhtmlPage(title, body)); err != nil {
+			return nil, err
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return e, nil
+}
+
+// collectIDs records that every element with an ID under n will be
+// written to the named page.
+func (d *dtbookImporter) collectIDs(n *xnode, page string) {
+	if id := n.attr("id"); id != "" {
+		d.pages[id] = page
+	}
+	for _, c := range n.elements() {
+		d.collectIDs(c, page)
+	}
+}
+
+// link returns the href for a link to the given ID.
+func (d *dtbookImporter) link(id string) string {
+	page, ok := d.pages[id]
+	if !ok || page == d.page {
+		return "#" + id
+	}
+	return relativeHref(d.page, page) + "#" + id
+}
+
+// href returns the href for an a element's href attribute. Links
+// within the dtbook are resolved to the file their target ends up in;
+// anything else is kept as it is.
+func (d *dtbookImporter) href(h string) string {
+	if strings.HasPrefix(h, "#") {
+		return d.link(h[1:])
+	}
+	return h
+}
+
+// invalidIDChars matches runs of characters that can't appear in the
+// IDs we generate.
+var invalidIDChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// newID returns an unused XML ID for an element on the current page,
+// based on base.
+func (d *dtbookImporter) newID(base string) string {
+	base = strings.Trim(invalidIDChars.ReplaceAllString(base, "-"), "-")
+	id := base
+	for n := 2; d.pages[id] != ""; n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	d.pages[id] = d.page
+	return id
+}
+
+// ncxNavpoints builds the book's table of contents from the navMap of
+// the named DAISY NCX, if it exists. Navpoints whose targets can't be
+// found in the dtbook are left out, and their children added to their
+// parents. It reports whether the NCX was used.
+func (d *dtbookImporter) ncxNavpoints(name string) (bool, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	root, err := parseXML(f)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %v: %v", name, err)
+	}
+	navMap := root.find("navMap")
+	if navMap == nil {
+		return false, nil
+	}
+	d.addNCXPoints(filepath.Dir(name), navMap, nil)
+	return true, d.err
+}
+
+// addNCXPoints adds navpoints for the navPoint elements in n, under
+// parent if it isn't nil. Dir is the directory the NCX is in.
+func (d *dtbookImporter) addNCXPoints(dir string, n *xnode, parent *Navpoint) {
+	order := 0
+	for _, p := range n.findAll("navPoint") {
+		label := ""
+		if l := p.find("navLabel"); l != nil {
+			if t := l.find("text"); t != nil {
+				label = strings.TrimSpace(t.textContent())
+			}
+		}
+		href := ""
+		if c := p.find("content"); c != nil {
+			href = d.ncxTarget(dir, c.attr("src"))
+		}
+		np := parent
+		if label != "" && href != "" {
+			order++
+			if parent == nil {
+				np = d.e.AddNavpoint(label, href, order)
+			} else {
+				np = parent.AddNavpoint(label, href, order)
+			}
+		}
+		d.addNCXPoints(dir, p, np)
+	}
+}
+
+// ncxTarget returns the name in the book of the target of an NCX
+// content element's src, following it through a SMIL file to the
+// dtbook if need be, or the empty string if it can't be found.
+func (d *dtbookImporter) ncxTarget(dir, src string) string {
+	file, id, _ := strings.Cut(src, "#")
+	if strings.EqualFold(path.Ext(file), ".smil") && id != "" {
+		_, id, _ = strings.Cut(d.smilText(filepath.Join(dir, filepath.FromSlash(file)), id), "#")
+	}
+	page, ok := d.pages[id]
+	if !ok {
+		return ""
+	}
+	return page + "#" + id
+}
+
+// smilText returns the src of the text element of the element with
+// the given ID in the named SMIL file, or the empty string if there
+// isn't one.
+func (d *dtbookImporter) smilText(name, id string) string {
+	root, ok := d.smil[name]
+	if !ok {
+		if f, err := os.Open(name); err == nil {
+			root, _ = parseXML(f)
+			f.Close()
+		}
+		d.smil[name] = root
+	}
+	if root == nil {
+		return ""
+	}
+	n := findID(root, id)
+	if n == nil {
+		return ""
+	}
+	if n.name != "text" {
+		if n = findElement(n, "text"); n == nil {
+			return ""
+		}
+	}
+	return n.attr("src")
+}
+
+// findID returns the element under n, or n itself, with the given ID.
+func findID(n *xnode, id string) *xnode {
+	if n.attr("id") == id {
+		return n
+	}
+	for _, c := range n.elements() {
+		if f := findID(c, id); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// findElement returns the first element under n with the given name.
+func findElement(n *xnode, name string) *xnode {
+	for _, c := range n.elements() {
+		if c.name == name {
+			return c
+		}
+		if f := findElement(c, name); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// meta records a dtbook metadata entry in the book.
+func (d *dtbookImporter) meta(name, content string) {
+	if content == "" {
+		return
+	}
+	switch strings.ToLower(name) {
+	case "dc:title", "dtb:title":
+		d.e.SetTitle(content)
+	case "dc:creator":
+		d.e.AddAuthor(content)
+	case "dc:language":
+		d.e.AddLanguage(content)
+	case "dc:publisher":
+		d.e.AddPublisher(content)
+	case "dc:subject":
+		d.e.AddSubject(content)
+	case "dc:description":
+		d.e.AddDescription(content)
+	}
+}
+
+// heading returns the text of the first heading in the level element
+// n, or the empty string if it has none.
+func heading(n *xnode) string {
+	for _, c := range n.elements() {
+		switch c.name {
+		case "h1", "h2", "h3", "h4", "h5", "h6", "hd", "title":
+			return c.textContent()
+		}
+	}
+	return ""
+}
+
+// navpoints adds navpoints for the level1 element n and the level2
+// elements inside it. The level2 elements are given IDs if they don't
+// already have them.
+func (d *dtbookImporter) navpoints(n *xnode, order int) {
+	label := heading(n)
+	if label == "" {
+		return
+	}
+	np := d.e.AddNavpoint(label, d.page, order)
+	sub := 0
+	for _, c := range n.elements() {
+		if c.name != "level2" {
+			continue
+		}
+		l := heading(c)
+		if l == "" {
+			continue
+		}
+		sub++
+		id := c.attr("id")
+		if id == "" {
+			id = "section" + strconv.Itoa(sub)
+			c.setAttr("id", id)
+		}
+		np.AddNavpoint(l, d.page+"#"+id, sub)
+	}
+}
+
+// convert returns the XHTML for the dtbook element n.
+func (d *dtbookImporter) convert(n *xnode) string {
+	c := &converter{element: d.element}
+	c.convert(n)
+	return c.b.String()
+}
+
+// element writes the XHTML for a single dtbook element.
+func (d *dtbookImporter) element(c *converter, n *xnode) {
+	switch n.name {
+	case "pagenum":
+		d.pagenum(c, n)
+	case "list":
+		tag := "ul"
+		if n.attr("type") == "ol" {
+			tag = "ol"
+		}
+		c.wrap(tag, n)
+	case "a":
+		c.wrap("a", n, attrPair("href", d.href(n.attr("href"))))
+	case "noteref", "annoref":
+		c.wrap("a", n, attrPair("href", d.link(strings.TrimPrefix(n.attr("idref"), "#"))))
+	case "br":
+		c.b.WriteString("<br />")
+	case "img":
+		d.img(c, n)
+	default:
+		if tag, ok := dtbookSimple[n.name]; ok {
+			if n.name != tag {
+				c.wrap(tag, n, attrPair("class", n.name))
+			} else {
+				c.wrap(tag, n)
+			}
+			return
+		}
+		c.children(n)
+	}
+}
+
+// pagenum converts a page number into a page break marker and a
+// matching page target.
+func (d *dtbookImporter) pagenum(c *converter, n *xnode) {
+	label := n.textContent()
+	id := n.attr("id")
+	if id == "" {
+		id = d.newID("page-" + label)
+	}
+	fmt.Fprintf(&c.b, `<span class="pagenum" %s %s></span>`, attrPair("id", id), attrPair("title", label))
+	d.e.AddPageTarget(label, d.page+"#"+id)
+}
+
+// img adds the referenced image to the book and writes an img element
+// for it.
+func (d *dtbookImporter) img(c *converter, n *xnode) {
+	src := n.attr("src")
+	if src == "" {
+		return
+	}
+	source := filepath.Join(d.dir, filepath.FromSlash(src))
+	name, ok := d.images[source]
+	if !ok {
+		// Images from different directories may share a name.
+		base := path.Base(src)
+		ext := path.Ext(base)
+		name = "images/" + base
+		for n := 2; d.names[name]; n++ {
+			name = fmt.Sprintf("images/%v-%v%v", strings.TrimSuffix(base, ext), n, ext)
+		}
+		if _, err := d.e.AddImageFile(source, name); err != nil {
+			if d.err == nil {
+				d.err = err
+			}
+			return
+		}
+		d.images[source] = name
+		d.names[name] = true
+	}
+	fmt.Fprintf(&c.b, `<img %s %s />`, attrPair("src", relativeHref(d.page, name)), attrPair("alt", n.attr("alt")))
+}
@@ -0,0 +1,154 @@
+package epub
+
+// This file holds the code to write v2 and v3 versions of a book at
+// the same time.
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// deflated is a compressed zip entry that can be copied into more
+// than one archive.
+type deflated struct {
+	contents   []byte
+	compressed []byte
+	crc        uint32
+}
+
+// entryCache is a source of compressed zip entries that compresses
+// each file only once.
+type entryCache interface {
+	get(f zipEntry, dl Deflater) (*deflated, error)
+}
+
+// deflateCache holds compressed zip entries by name, so a file that's
+// the same in two books is only compressed once.
+type deflateCache map[string]*deflated
+
+// writeZipEntries writes entries into z. If cache isn't nil, entries
+// are compressed through it, with dl if it isn't nil.
+func writeZipEntries(z *zip.Writer, entries []zipEntry, cache entryCache, dl Deflater) error {
+	for _, f := range entries {
+		if cache == nil {
+			w, err := z.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: f.modified})
+			if err != nil {
+				return err
+			}
+			length, err := w.Write(f.contents)
+			if err != nil {
+				return &ResourceError{Op: "write", Path: f.name, Err: fmt.Errorf("wrote %v of %v bytes: %w", length, len(f.contents), err)}
+			}
+			continue
+		}
+		d, err := cache.get(f, dl)
+		if err != nil {
+			return &ResourceError{Op: "write", Path: f.name, Err: err}
+		}
+		w, err := z.CreateRaw(&zip.FileHeader{
+			Name:               f.name,
+			Method:             zip.Deflate,
+			CRC32:              d.crc,
+			CompressedSize64:   uint64(len(d.compressed)),
+			UncompressedSize64: uint64(len(f.contents)),
+			Modified:           f.modified,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(d.compressed); err != nil {
+			return &ResourceError{Op: "write", Path: f.name, Err: err}
+		}
+	}
+	return nil
+}
+
+// get returns the compressed form of f, compressing it if the cache
+// doesn't already hold it.
+func (c deflateCache) get(f zipEntry, dl Deflater) (*deflated, error) {
+	if d, ok := c[f.name]; ok && bytes.Equal(d.contents, f.contents) {
+		return d, nil
+	}
+	d, err := deflate(f.contents, dl)
+	if err != nil {
+		return nil, err
+	}
+	c[f.name] = d
+	return d, nil
+}
+
+// deflate compresses contents with dl, or if it's nil at maximum
+// compression.
+func deflate(contents []byte, dl Deflater) (*deflated, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if dl != nil {
+		var err error
+		if w, err = dl.NewWriter(&buf); err != nil {
+			return nil, err
+		}
+	} else if fw, ok := flatePool.Get().(*flate.Writer); ok {
+		fw.Reset(&buf)
+		w = pooledFlate{fw}
+	} else {
+		fw, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = pooledFlate{fw}
+	}
+	_, err := w.Write(contents)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &deflated{contents: contents, compressed: buf.Bytes(), crc: crc32.ChecksumIEEE(contents)}, nil
+}
+
+// SerializeBoth returns the book serialized as both a v2 and a v3
+// book. It's faster than calling SerializeV2 and SerializeV3, since
+// files that are the same in both books, such as images, are only
+// compressed once.
+func (e *EPub) SerializeBoth() (v2, v3 []byte, err error) {
+	if err := e.runBeforeWrite(); err != nil {
+		return nil, nil, err
+	}
+	var cache entryCache = make(deflateCache)
+	if e.compressionCache != nil {
+		cache = e.compressionCache
+	}
+	if v2, err = e.serializeV2(cache); err != nil {
+		return nil, nil, err
+	}
+	if v3, err = e.serializeV3(cache); err != nil {
+		return nil, nil, err
+	}
+	return v2, v3, nil
+}
+
+// WriteBoth writes the book as both a v2 and a v3 book, to
+// basePath.epub2.epub and basePath.epub3.epub. Many distribution
+// workflows still need both.
+func (e *EPub) WriteBoth(basePath string) error {
+	return e.WriteBothTo(basePath+".epub2.epub", basePath+".epub3.epub")
+}
+
+// WriteBothTo writes the book as a v2 book to the file v2Name and as a
+// v3 book to the file v3Name, as with WriteBoth.
+func (e *EPub) WriteBothTo(v2Name, v3Name string) error {
+	v2, v3, err := e.SerializeBoth()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(v2Name, v2, 0666); err != nil {
+		return err
+	}
+	return os.WriteFile(v3Name, v3, 0666)
+}
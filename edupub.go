@@ -0,0 +1,141 @@
+package epub
+
+// This file holds the EDUPUB profile for educational books.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Edition is the audience of an educational book's edition.
+type Edition int
+
+const (
+	StudentEdition Edition = iota
+	TeacherEdition
+)
+
+// EduProfile holds the EDUPUB metadata of an educational book.
+type EduProfile struct {
+	Edition Edition
+	// StudentEdition identifies the student edition a teacher's
+	// edition goes with, such as "urn:isbn:9780000000000". Teacher's
+	// editions must have one.
+	StudentEdition string
+	// Level is the educational level the book is for, such as
+	// "Grade 7".
+	Level string
+	// Objectives are the learning objectives the book teaches.
+	Objectives []LearningObjective
+}
+
+// LearningObjective is something an educational book teaches.
+type LearningObjective struct {
+	// Text describes the objective.
+	Text string
+	// Framework and Code identify the objective in a standards
+	// framework, such as "Common Core" and "CCSS.MATH.CONTENT.7.RP.A.1",
+	// if it's in one.
+	Framework string
+	Code      string
+}
+
+// SetEduProfile makes the book an EDUPUB book, the EPUB 3 profile for
+// educational publishing. Passing nil turns the profile off again.
+//
+// The book's package metadata gets a dc:type of "edupub", and
+// teacher's editions also get one of "teacher-edition" and a dc:source
+// identifying the student edition. The level is written as
+// schema:educationalLevel, and each learning objective as a
+// schema:teaches meta element, refined with schema:educationalFramework
+// and schema:codeValue if it's in a framework.
+//
+// EDUPUB books must be v3 books, and have stricter structural
+// requirements, which Validate checks: the book needs a table of
+// contents and a bodymatter landmark (see SetLandmark), and every
+// XHTML file in the spine must either carry structural semantics, as
+// an epub:type attribute such as epub:type="chapter" on its body or a
+// section, or be tagged as a landmark.
+func (e *EPub) SetEduProfile(p *EduProfile) error {
+	if p == nil {
+		e.eduProfile = nil
+		return nil
+	}
+	if p.Edition == TeacherEdition && p.StudentEdition == "" {
+		return errors.New("teacher's editions must identify their student edition")
+	}
+	for _, o := range p.Objectives {
+		if o.Text == "" {
+			return errors.New("learning objectives must have text")
+		}
+	}
+	c := *p
+	c.Objectives = append([]LearningObjective(nil), p.Objectives...)
+	e.eduProfile = &c
+	return nil
+}
+
+// eduElements returns the EDUPUB metadata as v3 package metadata
+// elements.
+func (e *EPub) eduElements() []xmlElement {
+	p := e.eduProfile
+	if p == nil {
+		return nil
+	}
+	ret := []xmlElement{newElement("dc:type", "edupub")}
+	if p.Edition == TeacherEdition {
+		ret = append(ret, newElement("dc:type", "teacher-edition"), newElement("dc:source", e.plainText(p.StudentEdition)))
+	}
+	if p.Level != "" {
+		ret = append(ret, newElement("meta", e.plainText(p.Level), "property", "schema:educationalLevel"))
+	}
+	for i, o := range p.Objectives {
+		id := fmt.Sprintf("objective%d", i+1)
+		ret = append(ret, newElement("meta", e.plainText(o.Text), "property", "schema:teaches", "id", id))
+		if o.Framework != "" {
+			ret = append(ret, newElement("meta", e.plainText(o.Framework), "refines", "#"+id, "property", "schema:educationalFramework"))
+		}
+		if o.Code != "" {
+			ret = append(ret, newElement("meta", e.plainText(o.Code), "refines", "#"+id, "property", "schema:codeValue"))
+		}
+	}
+	return ret
+}
+
+// epubTypeRE matches an epub:type attribute.
+var epubTypeRE = regexp.MustCompile(`\sepub:type\s*=`)
+
+// validateEduProfile checks that an EDUPUB book meets the profile's
+// structural requirements.
+func (e *EPub) validateEduProfile() error {
+	if e.eduProfile == nil {
+		return nil
+	}
+	if e.version < 3 {
+		return errorf(ErrUnsupportedVersion, "EDUPUB books must be v3 books, not v%v", e.version)
+	}
+	var problems []string
+	if len(e.navpoints) == 0 {
+		problems = append(problems, "the book has no table of contents")
+	}
+	landmarks := make(map[Id]bool)
+	hasBody := false
+	for _, l := range e.landmarks {
+		landmarks[l.id] = true
+		hasBody = hasBody || l.kind == LandmarkBodyMatter
+	}
+	if !hasBody {
+		problems = append(problems, "the book has no bodymatter landmark")
+	}
+	for _, x := range e.spineOrder() {
+		if !landmarks[x.id] && !epubTypeRE.Match(x.contents) {
+			problems = append(problems, fmt.Sprintf("%v has no structural semantics", x.name))
+		}
+	}
+	if len(problems) > 0 {
+		return errorf(ErrProfile, "not a valid EDUPUB book: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package epub
+
+// This file holds the book's on-sale date, for retail workflows with
+// strict laydown dates, and the embargo that keeps the book from being
+// written before it.
+
+import (
+	"time"
+)
+
+// onSaleProperty is the metadata property the on-sale date is written
+// as: DCMI's "available", the date the resource becomes available,
+// which is how ONIX's on-sale date is carried in package metadata.
+const onSaleProperty = "dcterms:available"
+
+// onSaleFormat is the format of on-sale dates in the package metadata.
+const onSaleFormat = "2006-01-02T15:04:05Z"
+
+// now returns the current time. It's a variable so tests can change
+// the clock embargoes are checked against.
+var now = time.Now
+
+// SetOnSaleDate sets the date the book goes on sale, after which
+// retailers may sell it. It's written into the package metadata, in
+// UTC, as a meta element with the property (v3) or name (v2)
+// "dcterms:available". The zero time removes the date.
+//
+// The date is only informational unless SetEmbargo turns the embargo
+// on.
+func (e *EPub) SetOnSaleDate(t time.Time) {
+	e.onSale = t
+}
+
+// OnSaleDate returns the date set with SetOnSaleDate, or the zero time
+// if there isn't one.
+func (e *EPub) OnSaleDate() time.Time {
+	return e.onSale
+}
+
+// SetEmbargo controls whether the book can be written before its
+// on-sale date. When it's on, Write, Serialize, and the other methods
+// that write the book fail with ErrEmbargoed until the date has
+// passed, so files of embargoed titles can't leak from a build
+// pipeline early. Turning it back off overrides the embargo, for
+// review copies and the like. It's off by default.
+func (e *EPub) SetEmbargo(enforce bool) {
+	e.embargo = enforce
+}
+
+// onSaleElements returns the package metadata holding the on-sale
+// date for a book of the given version, if it has one.
+func (e *EPub) onSaleElements(version float64) []xmlElement {
+	if e.onSale.IsZero() {
+		return nil
+	}
+	date := e.onSale.UTC().Format(onSaleFormat)
+	if version >= 3 {
+		return []xmlElement{newElement("meta", date, "property", onSaleProperty)}
+	}
+	return []xmlElement{newElement("meta", "", "name", onSaleProperty, "content", date)}
+}
+
+// validateEmbargo checks that the book isn't embargoed.
+func (e *EPub) validateEmbargo() error {
+	if !e.embargo || e.onSale.IsZero() {
+		return nil
+	}
+	if t := now(); t.Before(e.onSale) {
+		return errorf(ErrEmbargoed, "the book is embargoed until %v", e.onSale.UTC().Format(onSaleFormat))
+	}
+	return nil
+}
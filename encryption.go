@@ -0,0 +1,317 @@
+package epub
+
+// This file holds the code that writes META-INF/encryption.xml, for
+// books with obfuscated fonts or resources encrypted by other tools,
+// such as LCP, and that undoes font obfuscation in books being read.
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// fontObfuscation is the algorithm URI of IDPF font obfuscation.
+const fontObfuscation = "http://www.idpf.org/2008/embedding"
+
+// obfuscatedLength is how many bytes at the start of a font IDPF font
+// obfuscation scrambles.
+const obfuscatedLength = 1040
+
+// adobeObfuscation is the algorithm URI of Adobe's font obfuscation,
+// which predates IDPF's and is still found in v2 books.
+const adobeObfuscation = "http://ns.adobe.com/pdf/enc#RC"
+
+// adobeObfuscatedLength is how many bytes at the start of a font
+// Adobe's obfuscation scrambles.
+const adobeObfuscatedLength = 1024
+
+// Encryption describes how a resource in the book is encrypted, for
+// SetEncryption.
+type Encryption struct {
+	// Algorithm is the URI of the encryption algorithm, such as
+	// "http://www.w3.org/2001/04/xmlenc#aes256-cbc".
+	Algorithm string
+	// KeyURI and KeyType locate the key the resource was encrypted
+	// with, as a ds:RetrievalMethod; for LCP they're
+	// "license.lcpl#/encryption/content_key" and
+	// "http://readium.org/2014/01/lcp#EncryptedContentKey". Both are
+	// optional.
+	KeyURI, KeyType string
+}
+
+// SetFontObfuscation controls whether the book's fonts are obfuscated
+// with the IDPF algorithm when it's written, as some font licenses
+// require. Obfuscation isn't encryption: it only stops fonts being
+// copied out of the book and used as they are. Fonts are obfuscated
+// after any OnResourceWrite hooks have seen them, keyed by the book's
+// primary identifier (see PrimaryIdentifier), and listed in the book's
+// META-INF/encryption.xml. It's off by default.
+//
+// Reading systems for ePub 2 generally only understand Adobe's
+// obfuscation, so books written as v2 may not display their fonts.
+func (e *EPub) SetFontObfuscation(obfuscate bool) {
+	e.obfuscateFonts = obfuscate
+}
+
+// SetEncryption records that the resource with the given ID is
+// encrypted as enc says, so that it's listed in the book's
+// META-INF/encryption.xml. This package doesn't encrypt anything
+// itself; the resource should be encrypted as it's written, with an
+// OnResourceWrite hook, or afterwards by a tool such as an LCP
+// encrypter that reads encryption.xml. Passing a nil enc removes the
+// resource's encryption. Encryption set for a font overrides font
+// obfuscation.
+//
+// Resources placed under META-INF with SetZipPath can't be encrypted,
+// since reading systems must be able to read everything there.
+func (e *EPub) SetEncryption(id Id, enc *Encryption) error {
+	if !e.hasID(id) {
+		return errorf(ErrNotFound, "no resource with ID %v", id)
+	}
+	if enc == nil {
+		delete(e.encryption, id)
+		return nil
+	}
+	if enc.Algorithm == "" {
+		return fmt.Errorf("encryption of %v has no algorithm", id)
+	}
+	if e.encryption == nil {
+		e.encryption = make(map[Id]Encryption)
+	}
+	e.encryption[id] = *enc
+	return nil
+}
+
+// encryptedResources returns the encryption of the book's encrypted
+// resources, by ID.
+func (e *EPub) encryptedResources() map[Id]Encryption {
+	ret := make(map[Id]Encryption)
+	if e.obfuscateFonts {
+		for _, f := range e.fonts {
+			ret[f.id] = Encryption{Algorithm: fontObfuscation}
+		}
+	}
+	for id, enc := range e.encryption {
+		ret[id] = enc
+	}
+	return ret
+}
+
+// encryptedEntries returns the encryption of the book's encrypted
+// resources, by zip entry name.
+func (e *EPub) encryptedEntries() map[string]Encryption {
+	enc := e.encryptedResources()
+	if len(enc) == 0 {
+		return nil
+	}
+	ret := make(map[string]Encryption)
+	add := func(id Id, name string) {
+		if x, ok := enc[id]; ok {
+			ret[e.zipName(id, name)] = x
+		}
+	}
+	for _, i := range e.images {
+		add(i.id, i.name)
+	}
+	for _, x := range e.xhtml {
+		add(x.id, x.name)
+	}
+	for _, s := range e.styles {
+		add(s.id, s.name)
+	}
+	for _, s := range e.scripts {
+		add(s.id, s.name)
+	}
+	for _, f := range e.fonts {
+		add(f.id, f.name)
+	}
+	for _, m := range e.media {
+		add(m.id, m.name)
+	}
+	return ret
+}
+
+// validateEncryption checks that nothing under META-INF is encrypted,
+// and that the book's encryption.xml won't clash with a file of the
+// book's own.
+func (e *EPub) validateEncryption() error {
+	entries := e.encryptedEntries()
+	if len(entries) == 0 {
+		return nil
+	}
+	for name := range entries {
+		if strings.HasPrefix(name, "META-INF/") {
+			return fmt.Errorf("%v is under META-INF, so it can't be encrypted", name)
+		}
+	}
+	for _, p := range e.zipPaths {
+		if p == "META-INF/encryption.xml" {
+			return errorf(ErrReserved, "zip path %q is reserved in books with encrypted resources", p)
+		}
+	}
+	return nil
+}
+
+// addEncryption adds META-INF/encryption.xml to the book, if it has
+// encrypted resources. It lists them in the order of their names, so
+// it's the same each time the book is written.
+func (e *EPub) addEncryption(z *zip.Writer) error {
+	entries := e.encryptedEntries()
+	if len(entries) == 0 {
+		return nil
+	}
+	var names []string
+	for n := range entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	w, err := z.Create("META-INF/encryption.xml")
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#" xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+`)
+	for _, n := range names {
+		enc := entries[n]
+		fmt.Fprintf(&b, "  <enc:EncryptedData>\n    <enc:EncryptionMethod %s />\n", attrPair("Algorithm", enc.Algorithm))
+		if enc.KeyURI != "" || enc.KeyType != "" {
+			b.WriteString("    <ds:KeyInfo>\n      <ds:RetrievalMethod")
+			if enc.KeyURI != "" {
+				b.WriteString(" " + attrPair("URI", enc.KeyURI))
+			}
+			if enc.KeyType != "" {
+				b.WriteString(" " + attrPair("Type", enc.KeyType))
+			}
+			b.WriteString(" />\n    </ds:KeyInfo>\n")
+		}
+		fmt.Fprintf(&b, "    <enc:CipherData>\n      <enc:CipherReference %s />\n    </enc:CipherData>\n  </enc:EncryptedData>\n", attrPair("URI", escapePath(n)))
+	}
+	b.WriteString("</encryption>\n")
+	_, err = w.Write([]byte(b.String()))
+	return err
+}
+
+// obfuscateEntries obfuscates the fonts among entries, if the book's
+// fonts are obfuscated.
+func (e *EPub) obfuscateEntries(entries []zipEntry) []zipEntry {
+	var fonts map[string]bool
+	for name, enc := range e.encryptedEntries() {
+		if enc.Algorithm == fontObfuscation {
+			if fonts == nil {
+				fonts = make(map[string]bool)
+			}
+			fonts[name] = true
+		}
+	}
+	if fonts == nil {
+		return entries
+	}
+	for i := range entries {
+		if fonts[entries[i].name] {
+			entries[i].contents = e.obfuscate(entries[i].contents)
+		}
+	}
+	return entries
+}
+
+// obfuscate returns a copy of a font with IDPF font obfuscation
+// applied, keyed by the book's primary identifier. Obfuscating an
+// obfuscated font restores it.
+func (e *EPub) obfuscate(raw []byte) []byte {
+	return obfuscateFont(raw, e.PrimaryIdentifier())
+}
+
+// obfuscateFont returns a copy of a font with IDPF font obfuscation
+// applied: its first 1040 bytes are XORed with the SHA-1 hash of the
+// book's unique identifier, less any whitespace.
+func obfuscateFont(raw []byte, uid string) []byte {
+	key := sha1.Sum([]byte(strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, uid)))
+	return xorPrefix(raw, key[:], obfuscatedLength)
+}
+
+// adobeObfuscateFont returns a copy of a font with Adobe's font
+// obfuscation applied: its first 1024 bytes are XORed with the 16
+// bytes of the book's unique identifier, which must be a UUID.
+func adobeObfuscateFont(raw []byte, uid string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.NewReplacer("urn:uuid:", "", "-", "", ":", "").Replace(strings.TrimSpace(uid)))
+	if err != nil || len(key) != 16 {
+		return nil, errorf(ErrUnsupportedFormat, "fonts are obfuscated with Adobe's algorithm, but the book's identifier %q isn't a UUID", uid)
+	}
+	return xorPrefix(raw, key, adobeObfuscatedLength), nil
+}
+
+// xorPrefix returns a copy of b with its first n bytes XORed with the
+// repeated key.
+func xorPrefix(b, key []byte, n int) []byte {
+	ret := append([]byte(nil), b...)
+	for i := 0; i < len(ret) && i < n; i++ {
+		ret[i] ^= key[i%len(key)]
+	}
+	return ret
+}
+
+// readEncryption undoes the obfuscation of the fonts listed in the
+// book's META-INF/encryption.xml, if it has one, and turns on font
+// obfuscation if they used IDPF's, so the book is written as it was
+// read. Books with resources that are really encrypted, as with DRM,
+// can't be read.
+func (br *bookReader) readEncryption(opf *xnode) error {
+	c, ok := br.files["META-INF/encryption.xml"]
+	if !ok {
+		return nil
+	}
+	root, err := parseXML(bytes.NewReader(c))
+	if err != nil {
+		return fmt.Errorf("unable to parse META-INF/encryption.xml: %v", err)
+	}
+	uid := ""
+	for _, id := range opf.findAll("identifier") {
+		if id.attr("id") == opf.attr("unique-identifier") {
+			uid = id.textContent()
+			break
+		}
+	}
+	for _, ed := range root.findAll("EncryptedData") {
+		alg := ""
+		if m := ed.find("EncryptionMethod"); m != nil {
+			alg = m.attr("Algorithm")
+		}
+		ref := ed.find("CipherReference")
+		if ref == nil {
+			continue
+		}
+		name, err := url.PathUnescape(ref.attr("URI"))
+		if err != nil {
+			return errorf(ErrUnsupportedFormat, "bad cipher reference %q in META-INF/encryption.xml", ref.attr("URI"))
+		}
+		raw, ok := br.files[name]
+		if !ok {
+			return errorf(ErrNotFound, "encrypted file %v isn't in the book", name)
+		}
+		switch alg {
+		case fontObfuscation:
+			br.files[name] = obfuscateFont(raw, uid)
+			br.e.SetFontObfuscation(true)
+		case adobeObfuscation:
+			if br.files[name], err = adobeObfuscateFont(raw, uid); err != nil {
+				return err
+			}
+		default:
+			return errorf(ErrUnsupportedFormat, "%v is encrypted with %v, so the book can't be read", name, alg)
+		}
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
-// Package epub creates ePub v2.0 format ebooks.
+// Package epub creates ePub v2.0 and v3 format ebooks.
 //
 // An ePub file consists of one or more XHTML files that represent
 // the text of your book, the resources those files reference, and the
@@ -26,8 +26,10 @@
 //
 // Limitations
 //
-// Currently this package doesn't support adding fonts or JavaScript
-// files, nor does it support encrypted or DRM'd books.
+// This package doesn't encrypt books or apply DRM; SetEncryption only
+// lists resources for an external tool to encrypt, and books with
+// encrypted resources can't be read back in. Fonts can be obfuscated
+// (see SetFontObfuscation). V3 media overlays aren't supported.
 //
 // By default this package writes out ePub v2.0 format files. You can
 // write V3 files either by calling the WriteV3 method directly, or
@@ -35,14 +37,24 @@
 package epub
 
 import (
+	"archive/zip"
 	"bytes"
-	"errors"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/xml"
 	"fmt"
-	"io/ioutil"
+	"html"
+	"io"
+	"io/fs"
 	"log"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofrs/uuid"
 
@@ -59,25 +71,182 @@ type EPub struct {
 	images    []image
 	xhtml     []xhtml
 	navpoints []*Navpoint
+	pages     []pageTarget
 	styles    []style
 	scripts   []javascript
 	fonts     []font
+	media     []media
 	lastId    map[string]int
 	uuid      string
 	title     string
 	authors   []string
 	artists   []string
-	// If true then do a bit of preprocessing to xhtml
-	// files when writing v3 format books.
-	fixV2XHTML bool
-	coverID    Id
+	narrators []string
+	coverID   Id
+	// If true the book is tagged as fixed-layout (pre-paginated)
+	// when written as a v3 book.
+	fixedLayout bool
+	// The theme used to style the book and its generated pages, if any.
+	theme *Theme
+	// The first error from an option passed to New, which Validate
+	// returns.
+	optionErr error
 	// Some V3 properties
 	seriesName string // The name of the series this book belongs to, if any
 	setName    string // The name of the set this book belongs to, if any
 	entry      string // The entry number in the series/set
-
+	// Opaque OPF bits we don't understand but need to write back out.
+	rawMetadata     []string
+	rawPackageAttrs []pair
+	// Index into images, by image ID
+	imageIndex map[Id]int
+	// Whether to write an NCX file. Nil means use the version's
+	// default: always for v2 books, never for v3.
+	ncx *bool
+	// Manifest IDs of the files we generate ourselves.
+	navID Id
+	ncxID Id
+	// Zip entry names for resources placed outside OPS, by ID.
+	zipPaths map[Id]string
+	// Structural parts of the book, for the guide and landmarks.
+	landmarks []landmark
+	// CSS custom properties, and the stylesheet they're written into.
+	// If ownVarSheet is true the sheet is one we generated.
+	styleVars   []styleVar
+	varSheet    Id
+	ownVarSheet bool
+	// If true scripts are left out of the book when it's written.
+	stripScripts bool
+	// The policy added XHTML is sanitized with, if any.
+	sanitizer *SanitizePolicy
+	// If true metadata and labels are normalized when written.
+	normalizeText bool
+	// If true the book's language is added to XHTML files without one.
+	propagateLanguage bool
+	// If true the v2 cover meta element is written in v3 books too,
+	// for reading systems that only look there.
+	coverMeta bool
+	// If true the version was set explicitly with SetVersion.
+	versionSet bool
+	// The book's revision history, oldest first.
+	revisions []Revision
+	// Size budgets in bytes for the whole book and for each image. Zero
+	// means no budget.
+	sizeBudget  int64
+	imageBudget int64
+	// The retailers the book is meant for, whose guidelines Warnings
+	// checks against.
+	retailers []Retailer
+	// Hierarchical subjects, and how they're written. A zero
+	// subjectStyle means the default.
+	subjectPaths     [][]string
+	subjectStyle     SubjectStyle
+	subjectSeparator string
+	// The letter case subjects are written in.
+	subjectCase SubjectCase
+	// If true sort keys are derived for the title and names when the
+	// book is written, using the transliterator if there is one.
+	autoSortKeys   bool
+	transliterator Transliterator
+	// The previous and next links added to XHTML files, if any.
+	navLinks *NavLinks
+	// The function that makes IDs for headings without one, if any.
+	headingSlug func(string) string
+	// The longest TOC label, in characters, and the ellipsis that ends
+	// shortened ones. Zero means no limit.
+	tocLabelMax int
+	tocEllipsis string
+	// Checks run over the book's text when it's validated.
+	audits []func(path string, text string) []Issue
+	// If true some image has alt text registered with SetAltText.
+	hasAltText bool
+	// The parts the book's chapters are grouped into, if any.
+	parts []*Part
+	// How chapters are numbered, if they are.
+	numbering *ChapterNumbering
+	// The stamps laid over image pages, and the number of image pages
+	// added so far.
+	pageStamps []PageStamp
+	imagePages int
+	// What happens to the ICC profiles in images when the book is
+	// written, and the converter used for ICCConvert.
+	iccPolicy      ICCPolicy
+	colorConverter ColorConverter
+	// If true JPEG images are rotated to match their EXIF orientation
+	// when they're added.
+	autoOrient bool
+	// The order the package metadata is written in.
+	metadataOrder MetadataOrder
+	// The indent the generated XML files are written with, if
+	// xmlIndentSet is true.
+	xmlIndentSet bool
+	xmlIndent    string
+	// If true the book is declared DRM-free when it's written.
+	drmFree bool
+	// If true the book is in strict mode. ignoredErrs holds errors from
+	// methods that have no way to return them, for strict mode to
+	// report.
+	strict      bool
+	ignoredErrs []error
+	// The function non-fatal issues are reported to as the book is
+	// written, if any.
+	warningHandler func(Warning)
+	// The flavour of XHTML content documents are written as.
+	contentProfile ContentProfile
+	// The cache files are compressed through when the book is written,
+	// if any.
+	compressionCache *CompressionCache
+	// The periodical the book is an issue of, if any.
+	periodical *Periodical
+	// The book's EDUPUB metadata, if it's an EDUPUB book.
+	eduProfile *EduProfile
+	// The hooks registered with OnBeforeWrite and OnResourceWrite.
+	beforeWrite   []func(*EPub) error
+	resourceWrite []func(path string, data []byte) ([]byte, error)
+	// The style policies applied to the package metadata, by element
+	// name.
+	metadataStyles map[string]MetadataStyle
+	// The stylesheets set with SetLanguageStyle, by lower-cased
+	// language tag, and whether the built-in ones are used.
+	languageStyles   map[string]Id
+	languageDefaults bool
+	// The hyphenators set with SetHyphenation, by lower-cased language
+	// tag.
+	hyphenators map[string]Hyphenator
+	// The links to related resources added with AddLink.
+	links []relatedLink
+	// The Deflater set with SetDeflater, if any.
+	deflater Deflater
+	// Whether fonts are obfuscated, and the encryption of resources
+	// set with SetEncryption.
+	obfuscateFonts bool
+	encryption     map[Id]Encryption
+	// The modification times of resources, by ID.
+	modTimes map[Id]time.Time
+	// How many spine pages to put ahead of the table of contents, set
+	// with SetPreload.
+	preload int
+	// If true the build manifest is written into the book.
+	buildManifest bool
+	// The file system source files are read from, if it isn't the
+	// operating system's.
+	fsys fs.FS
+	// The book's list of illustrations.
+	illustrations []pageTarget
+	// When the book goes on sale, and whether it can't be written
+	// before then.
+	onSale  time.Time
+	embargo bool
+	// What's worked out from the book's files, cached while the book
+	// is being written. See cachePrepared.
+	prepared *preparedCache
 }
 
+// pair is a property of a metadata entry or an attribute. In
+// metadata it refines the entry: v2 books write it as an attribute of
+// the entry's element, named v2prefix+key, and v3 books as a meta
+// element refining the entry, with the property v3prefix+key. See
+// MetadataEntry.
 type pair struct {
 	key string
 	// Key prefix for ePub v2 books
@@ -87,24 +256,66 @@ type pair struct {
 	value    string
 	// Metadata scheme
 	scheme string
+	// Language of the value, if it's not the book's language
+	lang string
+	// If true the pair is only written for v3 books
+	v3only bool
 }
 
+// metadata is an entry in the package metadata. Kind is the element
+// name, such as "dc:title", and pairs the properties refining it.
 type metadata struct {
 	kind  string
 	value string
 	pairs []pair
+	// Attributes of the element this package doesn't model, such as
+	// xml:lang, kept from a book that was read in.
+	attrs []xml.Attr
 }
 
 type style struct {
 	name     string
-	contents string
+	contents []byte
 	id       Id
+	// Options for stylesheets that are linked into the book's XHTML
+	// files automatically.
+	opts *StyleOptions
+}
+
+// StyleOptions controls how a stylesheet added with
+// AddStylesheetWithOptions is linked into the book's XHTML files.
+type StyleOptions struct {
+	// Media is the media query the stylesheet applies to, such as
+	// "screen" or "(prefers-color-scheme: dark)". Optional.
+	Media string
+	// Title is the stylesheet's title. Reading systems that support
+	// alternate stylesheets use this as the name of the style to offer
+	// the reader. Required for alternate stylesheets.
+	Title string
+	// Alternate marks the stylesheet as an alternate stylesheet
+	// (rel="alternate stylesheet"), for things like night themes.
+	Alternate bool
 }
 
 type javascript struct {
 	name     string
-	contents string
+	contents []byte
 	id       Id
+	// Options for scripts that are linked into the book's XHTML files
+	// automatically.
+	opts *ScriptOptions
+}
+
+// ScriptOptions controls how a script added with
+// AddJavaScriptWithOptions is linked into the book's XHTML files.
+type ScriptOptions struct {
+	// Module marks the script as an ES module (type="module") rather
+	// than a classic script.
+	Module bool
+	// Defer and Async set the corresponding script element
+	// attributes.
+	Defer bool
+	Async bool
 }
 
 type font struct {
@@ -115,10 +326,18 @@ type font struct {
 
 type xhtml struct {
 	name      string
-	contents  string
+	contents  []byte
 	id        Id
 	order     int // Explicit ordering for file
 	baseOrder int // Implicit order for file
+	// The flavour of XHTML the file is written as, if it differs from
+	// the book's.
+	profile ContentProfile
+	// The file's own metadata, if it has any.
+	meta *ChapterMetadata
+	// The linear and properties attributes of the file's spine
+	// itemref, kept from a book that was read in.
+	linear, spineProps string
 }
 
 type image struct {
@@ -126,6 +345,20 @@ type image struct {
 	contents []byte
 	filetype string
 	id       Id
+	// The decoded image config, if we've needed it. Decoding is done
+	// at most once per image.
+	cfg *img.Config
+	// The image's registered alt text, and whether it's decorative.
+	alt        string
+	decorative bool
+}
+
+// ImageInfo describes an image that's been added to the book.
+type ImageInfo struct {
+	Width  int
+	Height int
+	// Format is the image format, such as "jpeg" or "png".
+	Format string
 }
 
 // Id holds an identifier for an item that's been added to the book.
@@ -137,14 +370,30 @@ type Navpoint struct {
 	filename  string
 	order     int
 	navpoints []*Navpoint
+	// Whether the navpoint is for a chapter added with AddChapter, or
+	// a part added with AddPart.
+	chapter bool
+	part    bool
+	// Whether the navpoint is for a periodical's article, and the
+	// article's byline.
+	article bool
+	byline  string
+}
+
+// pageTarget is an entry in the book's page list, mapping a page
+// number in a print edition to a point in the book.
+type pageTarget struct {
+	label    string
+	filename string
 }
 
 // NamespaceUUID is the namespace we're using for all V5 UUIDs
 var NamespaceUUID = uuid.Must(uuid.FromString("443ed275-966f-4099-8bee-5a6e1e474bb4"))
 
-// New creates a new empty ePub file.
-func New() *EPub {
-	ret := &EPub{lastId: make(map[string]int), version: 2, fixV2XHTML: true}
+// New creates a new empty ePub file, configured with any options
+// given.
+func New(opts ...Option) *EPub {
+	ret := &EPub{lastId: make(map[string]int), version: 2, navID: "nav", ncxID: "ncx"}
 	u, err := uuid.NewV4()
 	if err != nil {
 		panic(fmt.Sprintf("can't create UUID: %v", err))
@@ -155,56 +404,227 @@ func New() *EPub {
 		value: ret.uuid,
 		pairs: []pair{{key: "id", value: "BookId"}},
 	})
+	for _, o := range opts {
+		o(ret)
+	}
 
 	return ret
 }
 
+// setOptionErr records an error from an option passed to New, keeping
+// only the first.
+func (e *EPub) setOptionErr(err error) {
+	if e.optionErr == nil {
+		e.optionErr = err
+	}
+}
+
 // SetVersion sets the default version of the ePub file. Throws an
-// error if an unrecognized version is specified; currently only 2 and
-// 3 are recognized.
+// error if an unrecognized version is specified; currently only 2, 3,
+// and 3.3 are recognized.
+//
+// Version 3.3 writes a v3 book that targets the EPUB 3.3 W3C
+// recommendation rather than EPUB 3.0: resources get the current core
+// media types, and Warnings reports features that 3.3 deprecates.
 func (e *EPub) SetVersion(version float64) error {
-	if version != 2 && version != 3 {
-		return fmt.Errorf("EPub version %v is unsupported", version)
+	if version != 2 && version != 3 && version != 3.3 {
+		return errorf(ErrUnsupportedVersion, "EPub version %v is unsupported", version)
 	}
 	e.version = version
+	e.versionSet = true
 	return nil
 }
 
+// SetFixedLayout marks the book as a fixed layout (pre-paginated)
+// book. This is generally only useful for image-only books, such as
+// comics or board books, and is only written out for v3 books.
+func (e *EPub) SetFixedLayout(fixed bool) {
+	e.fixedLayout = fixed
+}
+
+// SetNCX controls whether the book gets an NCX table of contents
+// (toc.ncx). By default v2 books have one, since it's required, and v3
+// books don't, since the v3 nav document replaces it. Including an NCX
+// in a v3 book helps older reading systems; leaving it out of a v2
+// book makes an invalid book, but some pipelines add their own.
+func (e *EPub) SetNCX(include bool) {
+	e.ncx = &include
+}
+
+// wantNCX reports whether an NCX file should be written for a book of
+// the given version.
+func (e *EPub) wantNCX(version float64) bool {
+	if e.ncx != nil {
+		return *e.ncx
+	}
+	return version == 2
+}
+
+// spineTOC returns the ID of the NCX the spine of a book of the given
+// version refers to, or the empty string if the book has no NCX.
+func (e *EPub) spineTOC(version float64) Id {
+	if e.wantNCX(version) {
+		return e.ncxID
+	}
+	return ""
+}
+
 func (e *EPub) Version() float64 {
 	return e.version
 }
 
 // UUID returns the currently assigned UUID for this epub.
 func (e *EPub) UUID() string {
-	return strings.TrimPrefix("urn:uuid:", e.uuid)
+	return strings.TrimPrefix(e.uuid, "urn:uuid:")
 }
 
 // SetUUID overrides the default UUID assigned to this epub. Since
 // many ebook readers use the UUID to identify a book it's usually
 // wise to assign the same UUID to different revisions of a book.
+//
+// SetUUID may be called at any point before the book is written;
+// everywhere the UUID is used (the package identifier and the NCX
+// dtb:uid, unless another identifier has been made primary with
+// SetPrimaryIdentifier) picks up the new value.
 func (e *EPub) SetUUID(uu string) error {
 	u, err := uuid.FromString(uu)
 	if err != nil {
 		return err
 	}
+	old := e.uuid
 	e.uuid = "urn:uuid:" + u.String()
-	log.Printf("Setting uuid, theoretically %q", e.uuid)
 	for i, m := range e.metadata {
-		if m.kind == "dc:identifier" {
-			log.Printf("Set id to %q", e.uuid)
+		if m.kind == "dc:identifier" && m.value == old {
 			e.metadata[i].value = e.uuid
 		}
 	}
 	return nil
 }
 
+// isBookID reports whether m is the identifier entry the package's
+// unique-identifier refers to.
+func isBookID(m metadata) bool {
+	if m.kind != "dc:identifier" {
+		return false
+	}
+	for _, p := range m.pairs {
+		if p.key == "id" && p.value == "BookId" {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *EPub) nextId(class string) Id {
-	last, ok := e.lastId[class]
-	if !ok {
+	for {
+		last := e.lastId[class] + 1
+		e.lastId[class] = last
+		id := Id(class + strconv.Itoa(last))
+		if id != e.navID && id != e.ncxID {
+			return id
+		}
+	}
+}
+
+// SetGeneratedIDs sets the manifest IDs used for the files this
+// package generates: the v3 nav document and the NCX. The defaults
+// are "nav" and "ncx". The IDs must be distinct, must be valid XML
+// IDs, and can't be the ID of anything already added to the book;
+// resources added later never get these IDs.
+func (e *EPub) SetGeneratedIDs(nav, ncx Id) error {
+	if nav == ncx {
+		return errorf(ErrInvalidArgument, "nav and NCX IDs must differ, both are %q", nav)
+	}
+	for _, id := range []Id{nav, ncx} {
+		if !xmlIDRE.MatchString(string(id)) {
+			return errorf(ErrInvalidArgument, "%q is not a valid XML ID", id)
+		}
+		if e.hasID(id) {
+			return errorf(ErrDuplicateID, "ID %q is already used by a resource in the book", id)
+		}
+	}
+	e.navID, e.ncxID = nav, ncx
+	return nil
+}
+
+// xmlIDRE matches valid XML IDs (NCNames), restricted to ASCII.
+var xmlIDRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// manifestIDs returns the IDs of every resource added to the book.
+func (e *EPub) manifestIDs() []Id {
+	var ids []Id
+	for _, i := range e.images {
+		ids = append(ids, i.id)
+	}
+	for _, x := range e.xhtml {
+		ids = append(ids, x.id)
 	}
-	last++
-	e.lastId[class] = last
-	return Id(class + strconv.Itoa(last))
+	for _, s := range e.styles {
+		ids = append(ids, s.id)
+	}
+	for _, s := range e.scripts {
+		ids = append(ids, s.id)
+	}
+	for _, f := range e.fonts {
+		ids = append(ids, f.id)
+	}
+	for _, m := range e.media {
+		ids = append(ids, m.id)
+	}
+	return ids
+}
+
+// hasID reports whether a resource in the book has the given ID.
+func (e *EPub) hasID(id Id) bool {
+	for _, i := range e.manifestIDs() {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetZipPath places the resource with the given ID at zipPath in the
+// ePub container, rather than in the OPS directory alongside the
+// package document. This is for advanced OCF layouts, such as
+// putting files directly under META-INF; most books never need it.
+// The manifest href is rewritten relative to the package document.
+//
+// zipPath must be a clean, relative, slash-separated path, and can't
+// be one of the files this package writes itself.
+func (e *EPub) SetZipPath(id Id, zipPath string) error {
+	if !e.hasID(id) {
+		return errorf(ErrNotFound, "no resource with ID %v", id)
+	}
+	if zipPath == "" || path.IsAbs(zipPath) || path.Clean(zipPath) != zipPath || strings.HasPrefix(zipPath, "../") {
+		return errorf(ErrInvalidArgument, "zip path %q must be a clean relative path", zipPath)
+	}
+	switch zipPath {
+	case "mimetype", "META-INF/container.xml", "OPS/content.opf", "OPS/book.opf", "OPS/toc.ncx", "OPS/__toc.xhtml":
+		return errorf(ErrReserved, "zip path %q is reserved", zipPath)
+	}
+	if e.zipPaths == nil {
+		e.zipPaths = make(map[Id]string)
+	}
+	e.zipPaths[id] = zipPath
+	return nil
+}
+
+// zipName returns the name of the zip entry for a resource.
+func (e *EPub) zipName(id Id, name string) string {
+	if p, ok := e.zipPaths[id]; ok {
+		return p
+	}
+	return "OPS/" + name
+}
+
+// manifestHref returns the href the package document uses for a
+// resource, percent-encoded.
+func (e *EPub) manifestHref(id Id, name string) string {
+	if p, ok := e.zipPaths[id]; ok {
+		return relativeHref("OPS/content.opf", p)
+	}
+	return escapePath(name)
 }
 
 // AddImage adds an image to the ePub book. Path is the relative path
@@ -215,14 +635,55 @@ func (e *EPub) nextId(class string) Id {
 // filename, so while it isn't required it is prudent to have the file
 // extension match the filetype.
 func (e *EPub) AddImage(path string, contents []byte) (Id, error) {
-	_, fmt, err := img.DecodeConfig(bytes.NewReader(contents))
+	i, err := e.newImage(path, contents)
 	if err != nil {
 		return "", err
 	}
-	i := image{name: path, filetype: fmt, contents: contents, id: e.nextId("img")}
+	i.id = e.nextId("img")
+	e.addImageEntry(i)
+	return i.id, nil
+}
 
+// newImage decodes an image being added to the book and orients it
+// as SetAutoOrient says. It's safe to call concurrently, as AddAll
+// does. The image doesn't have an ID yet.
+func (e *EPub) newImage(path string, contents []byte) (image, error) {
+	cfg, format, err := img.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return image{}, &ResourceError{Op: "decode", Path: path, Err: err}
+	}
+	contents, cfg, err = e.orientImage(contents, format, cfg)
+	if err != nil {
+		return image{}, &ResourceError{Op: "orient", Path: path, Err: err}
+	}
+	return image{name: path, filetype: format, contents: contents, cfg: &cfg}, nil
+}
+
+// addImageEntry appends an image to the book and indexes it by ID.
+func (e *EPub) addImageEntry(i image) {
+	if e.imageIndex == nil {
+		e.imageIndex = make(map[Id]int)
+	}
+	e.imageIndex[i.id] = len(e.images)
 	e.images = append(e.images, i)
-	return i.id, nil
+}
+
+// ImageInfo returns the dimensions and format of an image in the
+// book. Images added with AddImageRegardless are decoded the first
+// time their info is needed; the result is cached.
+func (e *EPub) ImageInfo(id Id) (ImageInfo, error) {
+	i, err := e.findImage(id)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	if i.cfg == nil {
+		cfg, _, err := img.DecodeConfig(bytes.NewReader(i.contents))
+		if err != nil {
+			return ImageInfo{}, &ResourceError{Op: "decode", Path: i.name, Err: err}
+		}
+		i.cfg = &cfg
+	}
+	return ImageInfo{Width: i.cfg.Width, Height: i.cfg.Height, Format: i.filetype}, nil
 }
 
 // AddImageRegardless adds an image to the ePub book. Path is the
@@ -248,7 +709,7 @@ func (e *EPub) AddImageRegardless(path string, contents []byte) (Id, error) {
 
 	i := image{name: path, filetype: fmt, contents: contents, id: e.nextId("img")}
 
-	e.images = append(e.images, i)
+	e.addImageEntry(i)
 	return i.id, nil
 
 }
@@ -260,11 +721,66 @@ func (e *EPub) AddImageRegardless(path string, contents []byte) (Id, error) {
 // Returns the ID of the added file, or an error if something went
 // wrong reading the file.
 func (e *EPub) AddImageFile(source, dest string) (Id, error) {
-	c, err := ioutil.ReadFile(source)
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.AddImage(dest, c)
+	})
+}
+
+// AddImagePage adds an image to the ePub book along with an XHTML
+// page that displays it, for image-only books such as board books
+// and comics. Path is the relative path in the book to the image, and
+// contents is the image itself. The page is named after the image
+// with an .xhtml extension, sized to the image, and appended to the
+// book's spine. If label is not empty a top-level navpoint pointing
+// to the page is added as well.
+//
+// Image-only books should generally be marked as fixed layout with
+// SetFixedLayout. Page numbers and running heads can be laid over the
+// pages with SetPageStamps.
+//
+// Returns the ID of the XHTML page, or an error if the image couldn't
+// be decoded.
+func (e *EPub) AddImagePage(path string, contents []byte, label string) (Id, error) {
+	imgID, err := e.AddImage(path, contents)
 	if err != nil {
 		return "", err
 	}
-	return e.AddImage(dest, c)
+	info, err := e.ImageInfo(imgID)
+	if err != nil {
+		return "", err
+	}
+
+	page := strings.TrimSuffix(path, filepath.Ext(path)) + ".xhtml"
+	return e.addImagePage(page, info, label, attrPair("src", escapePath(filepath.Base(path))))
+}
+
+// addImagePage adds an XHTML page at path holding one image, whose
+// dimensions are info and whose source attributes are img, and a
+// navpoint to it if label isn't empty.
+func (e *EPub) addImagePage(page string, info ImageInfo, label, img string) (Id, error) {
+	e.imagePages++
+	stampStyle, stamps := e.stampHTML(e.imagePages)
+	x := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+<title>%s</title>
+<meta name="viewport" content="width=%v, height=%v" />
+<style type="text/css">body { margin: 0; padding: 0; } img { width: 100%%; height: 100%%; }%s</style>
+</head>
+<body>
+<div><img %s %s /></div>
+%s</body>
+</html>
+`, html.EscapeString(label), info.Width, info.Height, stampStyle, img, attrPair("alt", label), stamps)
+	id, err := e.AddXHTML(page, x)
+	if err != nil {
+		return "", err
+	}
+	if label != "" {
+		e.AddNavpoint(label, page, len(e.navpoints)+1)
+	}
+	return id, nil
 }
 
 // AddJavaScript adds a JavaScript file to the ePub book. Path is the
@@ -273,7 +789,11 @@ func (e *EPub) AddImageFile(source, dest string) (Id, error) {
 //
 // Returns the ID of the added file, or an error if something went wrong.
 func (e *EPub) AddJavaScript(path, contents string) (Id, error) {
-	j := javascript{name: path, contents: contents, id: e.nextId("js")}
+	return e.addJavaScript(path, []byte(contents), nil)
+}
+
+func (e *EPub) addJavaScript(path string, contents []byte, opts *ScriptOptions) (Id, error) {
+	j := javascript{name: path, contents: contents, id: e.nextId("js"), opts: opts}
 	e.scripts = append(e.scripts, j)
 	return j.id, nil
 }
@@ -285,20 +805,55 @@ func (e *EPub) AddJavaScript(path, contents string) (Id, error) {
 // Returns the ID of the added file, or an error if something went
 // wrong reading the file.
 func (e *EPub) AddJavaScriptFile(source, dest string) (Id, error) {
-	c, err := ioutil.ReadFile(source)
-	if err != nil {
-		return "", err
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.addJavaScript(dest, c, nil)
+	})
+}
+
+// AddJavaScriptWithOptions adds a JavaScript file to the ePub book and
+// links it into every XHTML file in the book when the book is
+// written. Path is the relative path in the book to the javascript
+// file, contents is the JavaScript itself, and opts controls the
+// attributes of the generated script elements.
+//
+// XHTML files that already reference the script are left alone. When
+// writing v3 books, XHTML files that include scripts are
+// automatically given the "scripted" manifest property.
+func (e *EPub) AddJavaScriptWithOptions(path, contents string, opts ScriptOptions) (Id, error) {
+	return e.addJavaScript(path, []byte(contents), &opts)
+}
+
+// SetStripScripts controls whether the book is written without
+// scripts, for distribution channels that reject scripted content.
+// When set, script elements and event handler attributes (onclick
+// and friends) are removed from every XHTML file, and JavaScript
+// files added to the book are left out. Nothing is removed from the
+// book itself, so the same book can be written both ways.
+func (e *EPub) SetStripScripts(strip bool) {
+	e.stripScripts = strip
+}
+
+// bookScripts returns the JavaScript files to write into the book.
+func (e *EPub) bookScripts() []javascript {
+	if e.stripScripts {
+		return nil
 	}
-	return e.AddJavaScript(dest, string(c))
+	return e.scripts
 }
 
 // AddFont adds a font to the ePub book. Path is the relative path in
 // the book to the font, and contents is the contents of the font.
+// Fonts whose embedding permissions forbid embedding them are refused
+// with an error matching ErrRestrictedFont.
 //
 // Returns the ID of the added file, or an error if something went wrong.
 func (e *EPub) AddFont(path string, contents []byte) (Id, error) {
 	if !strings.HasSuffix(path, ".otf") {
-		return "", errors.New("Only opentype fonts are supported")
+		return "", errorf(ErrUnsupportedFormat, "Only opentype fonts are supported")
+	}
+
+	if fi, err := readFontInfo(contents); err == nil && fi.Embedding.Restricted() {
+		return "", errorf(ErrRestrictedFont, "font %v (%v %v) has a restricted license that forbids embedding it", path, fi.Family, fi.Subfamily)
 	}
 
 	f := font{name: path, contents: contents, id: e.nextId("font")}
@@ -312,11 +867,9 @@ func (e *EPub) AddFont(path string, contents []byte) (Id, error) {
 //
 // Returns the ID of the added file, or an error if something went wrong.
 func (e *EPub) AddFontFile(source, dest string) (Id, error) {
-	c, err := ioutil.ReadFile(source)
-	if err != nil {
-		return "", err
-	}
-	return e.AddFont(dest, c)
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.AddFont(dest, c)
+	})
 }
 
 // AddXHTML adds an xhtml file to the ePub book. Path is the relative
@@ -329,13 +882,24 @@ func (e *EPub) AddFontFile(source, dest string) (Id, error) {
 // implicit order of '0') If multiple files are given the same order
 // then they're sub-sorted by the order they were added.
 func (e *EPub) AddXHTML(path string, contents string, order ...int) (Id, error) {
+	return e.addXHTML(path, []byte(contents), order...)
+}
+
+func (e *EPub) addXHTML(path string, contents []byte, order ...int) (Id, error) {
 	if len(order) > 1 {
-		return "", fmt.Errorf("Too many order parameters given")
+		return "", errorf(ErrInvalidArgument, "Too many order parameters given")
 	}
 	o := 0
 	if len(order) == 1 {
 		o = order[0]
 	}
+	if e.sanitizer != nil {
+		c, err := e.sanitizer.sanitize(contents)
+		if err != nil {
+			return "", &ResourceError{Op: "sanitize", Path: path, Err: err}
+		}
+		contents = c
+	}
 	x := xhtml{
 		name:      path,
 		contents:  contents,
@@ -354,27 +918,28 @@ func (e *EPub) AddXHTML(path string, contents string, order ...int) (Id, error)
 // Returns the ID of the added file, or an error if something went
 // wrong.
 func (e *EPub) AddXHTMLFile(source, dest string, order ...int) (Id, error) {
-	c, err := ioutil.ReadFile(source)
-	if err != nil {
-		return "", err
-	}
-	return e.AddXHTML(dest, string(c), order...)
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.addXHTML(dest, c, order...)
+	})
 }
 
 // AddNavpoint adds a top-level navpoint.
 //
 // Navpoints are part of the book's table of contents. The label is
 // the string that will be shown in the TOC (note that many ereaders
-// do *not* do HTML unescaping). Name is the URI of the point in the
-// book this navpoint points to. Not every file in a book needs a
-// navpoint that points to it -- all navpoints are optional.
+// do *not* do HTML unescaping; see SetNormalizeText). Name is the URI
+// of the point in the book this navpoint points to. Not every file in
+// a book needs a navpoint that points to it -- all navpoints are
+// optional.
 //
 // Some ereaders do not permit fragment IDs in the URI for top-level navpoints.
 //
 // The order parameter is used to sort the navpoints when building the
 // book's TOC.  Navpoints do not need to be added to the book in the
 // order they appear in the TOC, the order numbers do not have to
-// start from 1, and there may be gaps in the order.
+// start from 1, and there may be gaps in the order. Navpoints with
+// the same order appear in the order they were added, so the TOC is
+// the same every time the book is built.
 //
 // Note that the order that entries appear in the table of contents,
 // and the order that files appear in the book, don't have to be
@@ -392,7 +957,8 @@ func (e *EPub) AddNavpoint(label string, name string, order int) *Navpoint {
 // AddNavpoint adds a child navpoint. Label is the name that will be
 // shown in the TOC, name is the URI of the point in the book this
 // navpoint points to, and order is the order of the navpoint in the
-// TOC.
+// TOC among its siblings, which are in the order they were added if
+// they have the same order.
 //
 // Child URIs typically refer to a point in the parent Navpoint's file
 // and, indeed, some ereaders require this. That is, if the parent
@@ -404,11 +970,33 @@ func (n *Navpoint) AddNavpoint(label string, name string, order int) *Navpoint {
 	return nn
 }
 
+// sortedNavpoints returns a copy of np sorted by order. Navpoints with
+// the same order stay in the order they were added.
+func sortedNavpoints(np []*Navpoint) []*Navpoint {
+	np = append([]*Navpoint(nil), np...)
+	sort.SliceStable(np, func(i, j int) bool { return np[i].order < np[j].order })
+	return np
+}
+
+// AddPageTarget adds an entry to the book's page list. Label is the
+// page number as printed in the source edition of the book, and name
+// is the URI of the point in the book where that page starts,
+// typically a fragment ID in an XHTML file.
+//
+// Page targets are written in the order they were added.
+func (e *EPub) AddPageTarget(label string, name string) {
+	e.pages = append(e.pages, pageTarget{label: label, filename: name})
+}
+
 // AddStylesheet adds a CSS stylesheet to the ePub book. Path is the
 // relative path to the CSS file in the book, while contents is the
 // contents of the stylesheet.
 func (e *EPub) AddStylesheet(path, contents string) (Id, error) {
-	s := style{name: path, contents: contents, id: e.nextId("css")}
+	return e.addStylesheet(path, []byte(contents), nil)
+}
+
+func (e *EPub) addStylesheet(path string, contents []byte, opts *StyleOptions) (Id, error) {
+	s := style{name: path, contents: contents, id: e.nextId("css"), opts: opts}
 	e.styles = append(e.styles, s)
 	return s.id, nil
 }
@@ -417,12 +1005,23 @@ func (e *EPub) AddStylesheet(path, contents string) (Id, error) {
 // stylesheet. source is the name of the file on disk, while dest is
 // the name the stylesheet has in the ePub file.
 func (e *EPub) AddStylesheetFile(source, dest string) (Id, error) {
-	c, err := ioutil.ReadFile(source)
-	if err != nil {
-		return "", err
-	}
-	return e.AddStylesheet(dest, string(c))
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.addStylesheet(dest, c, nil)
+	})
+}
 
+// AddStylesheetWithOptions adds a CSS stylesheet to the ePub book and
+// links it into every XHTML file in the book when the book is
+// written. Path is the relative path to the CSS file in the book,
+// contents is the contents of the stylesheet, and opts controls the
+// attributes of the generated link elements.
+//
+// XHTML files that already link to the stylesheet are left alone.
+func (e *EPub) AddStylesheetWithOptions(path, contents string, opts StyleOptions) (Id, error) {
+	if opts.Alternate && opts.Title == "" {
+		return "", errorf(ErrInvalidArgument, "alternate stylesheets must have a title")
+	}
+	return e.addStylesheet(path, []byte(contents), &opts)
 }
 
 // SetCoverImage notes which image is the cover.
@@ -452,10 +1051,10 @@ func (e *EPub) Write(name string) error {
 	switch e.version {
 	case 2:
 		return e.WriteV2(name)
-	case 3:
+	case 3, 3.3:
 		return e.WriteV3(name)
 	default:
-		return fmt.Errorf("Unable to write epub version %v files", e.version)
+		return errorf(ErrUnsupportedVersion, "Unable to write epub version %v files", e.version)
 	}
 }
 
@@ -466,9 +1065,141 @@ func (e *EPub) Serialize() ([]byte, error) {
 	switch e.version {
 	case 2:
 		return e.SerializeV2()
-	case 3:
+	case 3, 3.3:
 		return e.SerializeV3()
 	default:
-		return nil, fmt.Errorf("Unable to create epub version %v files", e.version)
+		return nil, errorf(ErrUnsupportedVersion, "Unable to create epub version %v files", e.version)
+	}
+}
+
+// flatePool holds flate writers for reuse across zip entries and
+// books. A writer at BestCompression allocates over half a megabyte
+// of state, so making a new one for every file adds up quickly.
+var flatePool sync.Pool
+
+// pooledFlate is a flate writer that goes back in the pool when it's
+// closed.
+type pooledFlate struct {
+	*flate.Writer
+}
+
+func (p pooledFlate) Close() error {
+	err := p.Writer.Close()
+	flatePool.Put(p.Writer)
+	return err
+}
+
+// registerCompressor sets up z to deflate its files with d, or if d
+// is nil at maximum compression, using pooled flate writers.
+func registerCompressor(z *zip.Writer, d Deflater) {
+	if d != nil {
+		z.RegisterCompressor(zip.Deflate, d.NewWriter)
+		return
+	}
+	z.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		if fw, ok := flatePool.Get().(*flate.Writer); ok {
+			fw.Reset(out)
+			return pooledFlate{fw}, nil
+		}
+		fw, err := flate.NewWriter(out, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		return pooledFlate{fw}, nil
+	})
+}
+
+// contentSize returns the total size of the files in the book, which
+// is a reasonable first guess at the size of the serialized book.
+func (e *EPub) contentSize() int {
+	n := 0
+	for _, i := range e.images {
+		n += len(i.contents)
+	}
+	for _, x := range e.xhtml {
+		n += len(x.contents)
+	}
+	for _, s := range e.styles {
+		n += len(s.contents)
+	}
+	for _, s := range e.scripts {
+		n += len(s.contents)
+	}
+	for _, f := range e.fonts {
+		n += len(f.contents)
 	}
+	for _, m := range e.media {
+		n += len(m.contents)
+	}
+	return n
+}
+
+// zipEntry is a file to write into the book's zip archive.
+type zipEntry struct {
+	name     string
+	contents []byte
+	modified time.Time // The zero time if the entry has no modification time
+}
+
+// zipEntries returns the book's files, prepared for a book of the
+// given version, in the order they go in the zip archive. Streaming
+// readers can start rendering before the whole archive has arrived,
+// so the order follows reading: the cover image, then the
+// stylesheets and fonts the first page needs, then the XHTML in
+// spine order, and finally the remaining images, scripts, and media.
+//
+// Within each group of resources files are ordered by a hash of
+// their contents, so the archive's layout doesn't depend on the
+// order files were added and only changes when their contents do.
+func (e *EPub) zipEntries(version float64) ([]zipEntry, error) {
+	var entries, images []zipEntry
+	for _, i := range e.images {
+		c, err := e.imageContents(i)
+		if err != nil {
+			return nil, err
+		}
+		ze := zipEntry{e.zipName(i.id, i.name), c, e.modTimes[i.id]}
+		if i.id == e.coverID {
+			entries = append(entries, ze)
+		} else {
+			images = append(images, ze)
+		}
+	}
+	var group []zipEntry
+	for _, s := range e.styles {
+		group = append(group, zipEntry{e.zipName(s.id, s.name), e.styleContents(s), e.modTimes[s.id]})
+	}
+	for _, f := range e.fonts {
+		group = append(group, zipEntry{e.zipName(f.id, f.name), f.contents, e.modTimes[f.id]})
+	}
+	entries = append(entries, sortByHash(group)...)
+	for _, x := range e.spineOrder() {
+		entries = append(entries, zipEntry{e.zipName(x.id, x.name), e.prepareXHTML(x, version), e.modTimes[x.id]})
+	}
+	entries = append(entries, sortByHash(images)...)
+	group = nil
+	for _, s := range e.bookScripts() {
+		group = append(group, zipEntry{e.zipName(s.id, s.name), s.contents, e.modTimes[s.id]})
+	}
+	for _, m := range e.media {
+		group = append(group, zipEntry{e.zipName(m.id, m.name), m.contents, e.modTimes[m.id]})
+	}
+	return append(entries, sortByHash(group)...), nil
+}
+
+// sortByHash sorts entries by the SHA-256 hash of their contents,
+// then by name for files with identical contents.
+func sortByHash(entries []zipEntry) []zipEntry {
+	sums := make(map[string][sha256.Size]byte, len(entries))
+	for _, ze := range entries {
+		sums[ze.name] = sha256.Sum256(ze.contents)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := sums[entries[i].name], sums[entries[j].name]
+		if c := bytes.Compare(a[:], b[:]); c != 0 {
+			return c < 0
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
 }
@@ -0,0 +1,3830 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	img "image"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// zipFile returns the contents of the named file in a serialized
+// book.
+func zipFile(t *testing.T, book []byte, name string) string {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		c, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(c)
+	}
+	t.Fatalf("book has no file %v", name)
+	return ""
+}
+
+// simpleBook returns a minimal valid book.
+func simpleBook(t *testing.T) *EPub {
+	t.Helper()
+	e := New()
+	e.SetTitle("Title")
+	e.AddLanguage("en")
+	if _, err := e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>")); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSetUUID(t *testing.T) {
+	const u = "0b7c1a2e-6f1d-4c64-9a51-2b1f6d7e8c90"
+	e := simpleBook(t)
+	if err := e.SetUUID(u); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.UUID(); got != u {
+		t.Errorf("UUID() = %q, want %q", got, u)
+	}
+	if err := e.SetUUID("not a uuid"); err == nil {
+		t.Errorf("SetUUID accepted an invalid UUID")
+	}
+
+	v2, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, v2, "OPS/content.opf")
+	if !strings.Contains(opf, `<dc:identifier id="BookId">urn:uuid:`+u+`</dc:identifier>`) {
+		t.Errorf("v2 package identifier not updated:\n%s", opf)
+	}
+	if ncx := zipFile(t, v2, "OPS/toc.ncx"); !strings.Contains(ncx, `"dtb:uid" content="urn:uuid:`+u+`"`) {
+		t.Errorf("NCX dtb:uid not updated:\n%s", ncx)
+	}
+
+	v3, err := e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, v3, "OPS/book.opf"); !strings.Contains(opf, `<dc:identifier id="BookId">urn:uuid:`+u+`</dc:identifier>`) {
+		t.Errorf("v3 package identifier not updated:\n%s", opf)
+	}
+}
+
+func TestSetPrimaryIdentifier(t *testing.T) {
+	const isbn = "urn:isbn:9780000000002"
+	e := simpleBook(t)
+	if err := e.SetPrimaryIdentifier(isbn); err == nil {
+		t.Errorf("SetPrimaryIdentifier accepted an identifier that wasn't added")
+	}
+	if err := e.AddIdentifier(isbn, "ISBN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddIdentifier(isbn, "ISBN"); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("AddIdentifier of an identifier added twice returned %v, want ErrDuplicateID", err)
+	}
+	if err := e.SetPrimaryIdentifier(isbn); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.PrimaryIdentifier(); got != isbn {
+		t.Errorf("PrimaryIdentifier() = %q, want %q", got, isbn)
+	}
+
+	v2, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, v2, "OPS/content.opf")
+	if !strings.Contains(opf, `<dc:identifier id="BookId" opf:scheme="ISBN">`+isbn+`</dc:identifier>`) {
+		t.Errorf("v2 package doesn't use the ISBN as BookId:\n%s", opf)
+	}
+	if strings.Count(opf, `id="BookId"`) != 1 {
+		t.Errorf("v2 package has more than one BookId:\n%s", opf)
+	}
+	if ncx := zipFile(t, v2, "OPS/toc.ncx"); !strings.Contains(ncx, `"dtb:uid" content="`+isbn+`"`) {
+		t.Errorf("NCX dtb:uid isn't the ISBN:\n%s", ncx)
+	}
+
+	v3, err := e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf = zipFile(t, v3, "OPS/book.opf")
+	if !strings.Contains(opf, `<dc:identifier id="BookId">`+isbn+`</dc:identifier>`) || strings.Count(opf, `id="BookId"`) != 1 {
+		t.Errorf("v3 package doesn't use the ISBN as BookId:\n%s", opf)
+	}
+}
+
+func TestNCX(t *testing.T) {
+	for _, tc := range []struct {
+		version float64
+		ncx     *bool
+		want    bool
+	}{
+		{2, nil, true},
+		{3, nil, false},
+		{2, new(bool), false},
+		{3, func() *bool { b := true; return &b }(), true},
+	} {
+		e := simpleBook(t)
+		e.SetVersion(tc.version)
+		if tc.ncx != nil {
+			e.SetNCX(*tc.ncx)
+		}
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "OPS/content.opf"
+		if tc.version == 3 {
+			name = "OPS/book.opf"
+		}
+		opf := zipFile(t, b, name)
+		hasSpineToc := strings.Contains(opf, `<spine toc="ncx">`)
+		hasItem := strings.Contains(opf, `media-type="application/x-dtbncx+xml"`)
+		if hasSpineToc != tc.want || hasItem != tc.want {
+			t.Errorf("v%v book with ncx setting %v: spine toc %v, manifest item %v, want %v:\n%s", tc.version, tc.ncx, hasSpineToc, hasItem, tc.want, opf)
+		}
+		if tc.want {
+			zipFile(t, b, "OPS/toc.ncx")
+		}
+	}
+}
+
+func TestNCXDepth(t *testing.T) {
+	e := simpleBook(t)
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "toc.ncx", zipFile(t, b, "OPS/toc.ncx"), `<meta name="dtb:depth" content="1" />`)
+
+	part := e.AddNavpoint("Part", "a.xhtml", 1)
+	part.AddNavpoint("Chapter", "a.xhtml#c1", 1).AddNavpoint("Section", "a.xhtml#s1", 1)
+	part.AddNavpoint("Chapter 2", "a.xhtml#c2", 2)
+	e.AddNavpoint("Afterword", "a.xhtml#after", 2)
+	if b, err = e.SerializeV2(); err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "toc.ncx", zipFile(t, b, "OPS/toc.ncx"), `<meta name="dtb:depth" content="3" />`)
+}
+
+func TestSpineOrderLeavesFiles(t *testing.T) {
+	e := New()
+	e.SetTitle("Title")
+	e.AddLanguage("en")
+	for i, name := range []string{"c.xhtml", "a.xhtml", "b.xhtml"} {
+		if _, err := e.AddXHTML(name, xhtmlPage(name, "<p>"+name+"</p>"), []int{3, 1, 2}[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/content.opf")
+	if !regexp.MustCompile(`(?s)<itemref idref="xhtml2" />\s*<itemref idref="xhtml3" />\s*<itemref idref="xhtml1" />`).MatchString(opf) {
+		t.Errorf("spine isn't in order:\n%s", opf)
+	}
+	var names []string
+	for _, x := range e.xhtml {
+		names = append(names, x.name)
+	}
+	if want := []string{"c.xhtml", "a.xhtml", "b.xhtml"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("writing the spine reordered the book's files to %q, want %q", names, want)
+	}
+}
+
+func TestSetGeneratedIDs(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.SetGeneratedIDs("xhtml1", "toc"); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("SetGeneratedIDs with an ID used by a resource returned %v, want ErrDuplicateID", err)
+	}
+	if err := e.SetGeneratedIDs("same", "same"); err == nil {
+		t.Errorf("SetGeneratedIDs accepted identical IDs")
+	}
+	if err := e.SetGeneratedIDs("xhtml2", "toc"); err != nil {
+		t.Fatal(err)
+	}
+	// The next XHTML file would have been xhtml2, so it should skip it.
+	id, err := e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "xhtml2" {
+		t.Errorf("AddXHTML used reserved ID %v", id)
+	}
+	e.SetVersion(3)
+	e.SetNCX(true)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	for _, want := range []string{`<item id="xhtml2" href="__toc.xhtml" media-type="application/xhtml+xml" properties="nav" />`, `<item id="toc" href="toc.ncx"`, `<spine toc="toc">`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package missing %s:\n%s", want, opf)
+		}
+	}
+}
+
+func TestSetZipPath(t *testing.T) {
+	e := simpleBook(t)
+	id, err := e.AddStylesheet("css/extra.css", "p { margin: 0 }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"", "/abs.css", "../up.css", "a//b.css", "mimetype", "OPS/content.opf"} {
+		if err := e.SetZipPath(id, p); err == nil {
+			t.Errorf("SetZipPath accepted %q", p)
+		}
+	}
+	if err := e.SetZipPath("nosuchid", "META-INF/x.css"); err == nil {
+		t.Errorf("SetZipPath accepted an unknown ID")
+	}
+	if err := e.SetZipPath(id, "META-INF/extra.css"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipFile(t, b, "META-INF/extra.css")
+	opf := zipFile(t, b, "OPS/content.opf")
+	if want := `href="../META-INF/extra.css"`; !strings.Contains(opf, want) {
+		t.Errorf("package missing %s:\n%s", want, opf)
+	}
+}
+
+func TestHrefEscaping(t *testing.T) {
+	const (
+		spaced  = "My Chapter 1.xhtml"
+		unicode = "text/caf\u00e9\u202f2.xhtml"
+	)
+	e := simpleBook(t)
+	for _, name := range []string{spaced, unicode} {
+		if _, err := e.AddXHTML(name, xhtmlPage("T", "<p>T</p>")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.AddNavpoint("One", spaced+"#part 1", 1)
+	e.AddNavpoint("Two", unicode, 2)
+
+	for _, version := range []float64{2, 3} {
+		e.SetVersion(version)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Zip entries keep their raw names.
+		zipFile(t, b, "OPS/"+spaced)
+		zipFile(t, b, "OPS/"+unicode)
+
+		opfName, tocName := "OPS/content.opf", "OPS/toc.ncx"
+		if version == 3 {
+			opfName, tocName = "OPS/book.opf", "OPS/__toc.xhtml"
+		}
+		opf, toc := zipFile(t, b, opfName), zipFile(t, b, tocName)
+		for _, want := range []string{`href="My%20Chapter%201.xhtml"`, `href="text/caf%C3%A9%E2%80%AF2.xhtml"`} {
+			if !strings.Contains(opf, want) {
+				t.Errorf("v%v package missing %s:\n%s", version, want, opf)
+			}
+		}
+		for _, want := range []string{`"My%20Chapter%201.xhtml#part%201"`, `"text/caf%C3%A9%E2%80%AF2.xhtml"`} {
+			if !strings.Contains(toc, want) {
+				t.Errorf("v%v table of contents missing %s:\n%s", version, want, toc)
+			}
+		}
+	}
+}
+
+func TestRelativeHref(t *testing.T) {
+	for _, tc := range []struct{ from, target, want string }{
+		{"a.xhtml", "b.xhtml", "b.xhtml"},
+		{"text/a.xhtml", "css/my style.css", "../css/my%20style.css"},
+		{"text/a.xhtml", "text/\u00fcber.png", "%C3%BCber.png"},
+		{"a.xhtml", "c:d.xhtml", "./c:d.xhtml"},
+	} {
+		if got := relativeHref(tc.from, tc.target); got != tc.want {
+			t.Errorf("relativeHref(%q, %q) = %q, want %q", tc.from, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestEscapeLink(t *testing.T) {
+	for _, tc := range []struct{ link, want string }{
+		{"ch 1.xhtml", "ch%201.xhtml"},
+		{"ch%201.xhtml", "ch%25201.xhtml"},
+		{"ch%201.xhtml#part%201", "ch%25201.xhtml#part%25201"},
+		{"ch 1.xhtml#part 1", "ch%201.xhtml#part%201"},
+		{"100%.xhtml#50%", "100%25.xhtml#50%25"},
+		{"a%2.xhtml", "a%252.xhtml"},
+		{"a?b.xhtml#c?d/e", "a%3Fb.xhtml#c?d/e"},
+		{"(a)+b's.xhtml", "(a)+b's.xhtml"},
+		{"text/caf\u00e9.xhtml", "text/caf%C3%A9.xhtml"},
+		{"c:d.xhtml#e:f", "./c:d.xhtml#e:f"},
+		{"#note", "#note"},
+	} {
+		got := escapeLink(tc.link)
+		if got != tc.want {
+			t.Errorf("escapeLink(%q) = %q, want %q", tc.link, got, tc.want)
+		}
+		// Reading systems must get the raw name back.
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Errorf("escapeLink(%q) = %q, which doesn't parse: %v", tc.link, got, err)
+			continue
+		}
+		back := strings.TrimPrefix(u.Path, "./")
+		if strings.Contains(tc.link, "#") {
+			back += "#" + u.Fragment
+		}
+		if back != tc.link {
+			t.Errorf("escapeLink(%q) = %q, which unescapes to %q", tc.link, got, back)
+		}
+	}
+}
+
+func TestEscapedNamesRoundTrip(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		e := simpleBook(t)
+		e.SetVersion(v)
+		const name = "text/100%25 a%20b.xhtml"
+		if _, err := e.AddXHTML(name, xhtmlPage("B", "<p>B</p>")); err != nil {
+			t.Fatal(err)
+		}
+		e.AddNavpoint("B", name+"#top", 2)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toc, opf := "OPS/toc.ncx", "OPS/content.opf"
+		if v == 3 {
+			toc, opf = "OPS/__toc.xhtml", "OPS/book.opf"
+		}
+		wantContains(t, opf, zipFile(t, b, opf), `href="text/100%2525%20a%2520b.xhtml"`)
+		wantContains(t, toc, zipFile(t, b, toc), `="text/100%2525%20a%2520b.xhtml#top"`)
+		r, err := Parse(b)
+		if err != nil {
+			t.Fatalf("v%v: Parse() = %v", v, err)
+		}
+		if got := r.xhtml[len(r.xhtml)-1].name; got != name {
+			t.Errorf("v%v: file read back as %q, want %q", v, got, name)
+		}
+		if got := r.navpoints[len(r.navpoints)-1].filename; got != name+"#top" {
+			t.Errorf("v%v: navpoint read back pointing to %q, want %q", v, got, name+"#top")
+		}
+	}
+}
+
+func TestLinkSingleQuoted(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	if _, err := e.AddStylesheetWithOptions("css/a.css", "p {}", StyleOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddJavaScriptWithOptions("js/a.js", "var x;", ScriptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	page := `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>B</title>
+<link rel='stylesheet' type='text/css' href='css/a.css' />
+<script type='text/javascript' src='js/a.js'></script>
+</head><body><p>B</p></body></html>`
+	if _, err := e.AddXHTML("b.xhtml", page); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := zipFile(t, b, "OPS/b.xhtml")
+	for _, ref := range []string{"css/a.css", "js/a.js"} {
+		if n := strings.Count(x, ref); n != 1 {
+			t.Errorf("b.xhtml refers to %v %v times, want once:\n%s", ref, n, x)
+		}
+	}
+}
+
+func TestAddImagePageEscaping(t *testing.T) {
+	e := New()
+	e.SetTitle("Comic")
+	if _, err := e.AddImagePage("images/page 1.png", testPNG(t, 2, 2), ""); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := zipFile(t, b, "OPS/images/page 1.xhtml"); !strings.Contains(page, `src="page%201.png"`) {
+		t.Errorf("image page doesn't escape the image's name:\n%s", page)
+	}
+}
+
+func TestEPUB33(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.SetVersion(3.1); err == nil {
+		t.Errorf("SetVersion accepted 3.1")
+	}
+	if err := e.SetVersion(3.3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddFont("fonts/body.otf", []byte("OTTO")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddJavaScript("js/app.js", "var x;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<epub:switch id="s"></epub:switch>`)); err != nil {
+		t.Fatal(err)
+	}
+	e.AddRawMetadata(`<meta property="rendition:spread">portrait</meta>`)
+
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	for _, want := range []string{`version="3.0"`, `href="fonts/body.otf" media-type="font/otf"`, `media-type="text/javascript"`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package missing %s:\n%s", want, opf)
+		}
+	}
+	if w := e.Warnings(); len(w) != 2 {
+		t.Errorf("Warnings() = %q, want 2 warnings", w)
+	}
+
+	// Plain v3 books keep the EPUB 3.0 media types and have no warnings.
+	e.SetVersion(3)
+	b, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/book.opf"); !strings.Contains(opf, `media-type="application/opentype"`) {
+		t.Errorf("v3 package should use application/opentype for fonts:\n%s", opf)
+	}
+	if w := e.Warnings(); len(w) != 0 {
+		t.Errorf("v3 Warnings() = %q, want none", w)
+	}
+}
+
+func TestLandmarks(t *testing.T) {
+	e := simpleBook(t)
+	img, err := e.AddImage("images/cover.png", testPNG(t, 10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover, err := e.AddCoverPage(img, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetLandmark("xhtml1", LandmarkBodyMatter, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetLandmark(cover, "sidebar", ""); err == nil {
+		t.Errorf("SetLandmark accepted an unknown landmark")
+	}
+	if err := e.SetLandmark(img, LandmarkIndex, ""); err == nil {
+		t.Errorf("SetLandmark accepted a non-XHTML ID")
+	}
+
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/content.opf")
+	for _, want := range []string{
+		`<reference type="cover" title="Cover" href="xhtml/cover.xhtml" />`,
+		`<reference type="text" title="Start of Content" href="a.xhtml" />`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("guide missing %s:\n%s", want, opf)
+		}
+	}
+
+	b, err = e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav := zipFile(t, b, "OPS/__toc.xhtml")
+	for _, want := range []string{
+		`<nav epub:type="landmarks" hidden="hidden">`,
+		`<a epub:type="cover" href="xhtml/cover.xhtml">Cover</a>`,
+		`<a epub:type="bodymatter" href="a.xhtml">Start of Content</a>`,
+	} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("landmarks missing %s:\n%s", want, nav)
+		}
+	}
+	if opf := zipFile(t, b, "OPS/book.opf"); strings.Contains(opf, "<guide>") {
+		t.Errorf("v3 book without an NCX has a guide:\n%s", opf)
+	}
+}
+
+func TestSetStyleVariable(t *testing.T) {
+	e := simpleBook(t)
+	for _, bad := range [][2]string{{"accent", "red"}, {"--accent", ""}, {"--accent", "red; color: blue"}} {
+		if err := e.SetStyleVariable(bad[0], bad[1]); err == nil {
+			t.Errorf("SetStyleVariable(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+	for _, v := range [][2]string{{"--accent", "#000"}, {"--body-font", "serif"}, {"--accent", "#aa3344"}} {
+		if err := e.SetStyleVariable(v[0], v[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = ":root {\n  --accent: #aa3344;\n  --body-font: serif;\n}\n"
+	if css := zipFile(t, b, "OPS/css/variables.css"); css != want {
+		t.Errorf("variables.css = %q, want %q", css, want)
+	}
+	if x := zipFile(t, b, "OPS/a.xhtml"); !strings.Contains(x, `href="css/variables.css"`) {
+		t.Errorf("a.xhtml doesn't link variables.css:\n%s", x)
+	}
+
+	// Moving the variables into an existing sheet drops the generated one.
+	id, err := e.AddStylesheet("css/main.css", "p { color: var(--accent); }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetStyleVariableSheet(id); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if css := zipFile(t, b, "OPS/css/main.css"); css != want+"p { color: var(--accent); }\n" {
+		t.Errorf("main.css = %q", css)
+	}
+	if opf := zipFile(t, b, "OPS/content.opf"); strings.Contains(opf, "variables.css") {
+		t.Errorf("generated stylesheet still in the manifest:\n%s", opf)
+	}
+}
+
+func TestSetStripScripts(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	if _, err := e.AddJavaScriptWithOptions("js/app.js", "var x;", ScriptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	body := `<p onclick="go()" class="x">Hi</p><script type="text/javascript">go();</script><script src="js/other.js" /><p>onward="not an attribute"</p>`
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", body)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/book.opf"); !strings.Contains(opf, "js/app.js") || !strings.Contains(opf, "scripted") {
+		t.Errorf("unstripped book is missing its scripts:\n%s", opf)
+	}
+
+	e.SetStripScripts(true)
+	if b, err = e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	if strings.Contains(opf, "js/app.js") || strings.Contains(opf, "scripted") {
+		t.Errorf("stripped book still has scripts:\n%s", opf)
+	}
+	x := zipFile(t, b, "OPS/b.xhtml")
+	if strings.Contains(x, "<script") || strings.Contains(x, "onclick") {
+		t.Errorf("stripped XHTML still has scripts:\n%s", x)
+	}
+	if !strings.Contains(x, `<p class="x">Hi</p>`) || !strings.Contains(x, `onward="not an attribute"`) {
+		t.Errorf("stripping damaged the XHTML:\n%s", x)
+	}
+	if z, _ := zip.NewReader(bytes.NewReader(b), int64(len(b))); z != nil {
+		for _, f := range z.File {
+			if f.Name == "OPS/js/app.js" {
+				t.Errorf("stripped book contains %v", f.Name)
+			}
+		}
+	}
+}
+
+func TestSetNormalizeText(t *testing.T) {
+	e := New()
+	e.SetTitle("Caf&eacute; <i>Society</i>")
+	e.AddAuthor("Ann &amp; Bob")
+	e.AddLanguage("en")
+	if _, err := e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>")); err != nil {
+		t.Fatal(err)
+	}
+	e.AddNavpoint("Chapter&nbsp;1: &ldquo;Begin&rdquo;", "a.xhtml", 1)
+	e.SetNormalizeText(true)
+
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/content.opf")
+	for _, want := range []string{"<dc:title>Café Society</dc:title>", ">Ann &amp; Bob</dc:creator>"} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package missing %s:\n%s", want, opf)
+		}
+	}
+	ncx := zipFile(t, b, "OPS/toc.ncx")
+	if want := "<text>Chapter\u00a01: \u201cBegin\u201d</text>"; !strings.Contains(ncx, want) {
+		t.Errorf("NCX missing %s:\n%s", want, ncx)
+	}
+}
+
+func TestSetPropagateLanguage(t *testing.T) {
+	e := simpleBook(t)
+	e.AddLanguage("de")
+	if _, err := e.AddXHTML("b.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="fr"><head><title>B</title></head><body><p>B</p></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := zipFile(t, b, "OPS/a.xhtml"); strings.Contains(x, "lang=") {
+		t.Errorf("language added without SetPropagateLanguage:\n%s", x)
+	}
+
+	e.SetPropagateLanguage(true)
+	for _, tc := range []struct {
+		version float64
+		want    string
+	}{
+		{2, `<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en">`},
+		{3, `<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">`},
+	} {
+		e.SetVersion(tc.version)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := zipFile(t, b, "OPS/a.xhtml"); !strings.Contains(x, tc.want) {
+			t.Errorf("v%v a.xhtml missing %s:\n%s", tc.version, tc.want, x)
+		}
+		if x := zipFile(t, b, "OPS/b.xhtml"); strings.Contains(x, `"en"`) {
+			t.Errorf("v%v b.xhtml language was overridden:\n%s", tc.version, x)
+		}
+	}
+}
+
+func TestZipOrder(t *testing.T) {
+	names := func(e *EPub) string {
+		t.Helper()
+		book, err := e.SerializeV2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, f := range z.File {
+			ret = append(ret, f.Name)
+		}
+		return strings.Join(ret, " ")
+	}
+	build := func(reverse bool) *EPub {
+		e := New()
+		e.SetTitle("Title")
+		add := []func(){
+			func() { e.AddImage("images/b.png", testPNG(t, 2, 2)) },
+			func() { e.AddImage("images/a.png", testPNG(t, 3, 3)) },
+			func() { e.AddXHTML("c2.xhtml", xhtmlPage("2", "<p>2</p>"), 2) },
+			func() { e.AddXHTML("c1.xhtml", xhtmlPage("1", "<p>1</p>"), 1) },
+			func() { e.AddStylesheet("main.css", "p { margin: 0; }") },
+		}
+		for i := range add {
+			if reverse {
+				i = len(add) - 1 - i
+			}
+			add[i]()
+		}
+		cover, err := e.AddImage("images/cover.png", testPNG(t, 4, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.SetCoverImage(cover)
+		return e
+	}
+
+	got := names(build(false))
+	if want := "mimetype META-INF/container.xml OPS/content.opf OPS/toc.ncx OPS/images/cover.png OPS/main.css OPS/c1.xhtml OPS/c2.xhtml OPS/images/"; !strings.HasPrefix(got, want) {
+		t.Errorf("zip order = %v, want it to start %v", got, want)
+	}
+	if rev := names(build(true)); rev != got {
+		t.Errorf("zip order depends on the order files were added:\n%v\n%v", got, rev)
+	}
+}
+
+func TestRender(t *testing.T) {
+	e := simpleBook(t)
+	e.AddNavpoint("A", "a.xhtml", 1)
+	book, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		render func() ([]byte, error)
+		file   string
+	}{
+		{e.RenderPackageDocument, "OPS/content.opf"},
+		{e.RenderNCX, "OPS/toc.ncx"},
+	} {
+		got, err := c.render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := zipFile(t, book, c.file); string(got) != want {
+			t.Errorf("rendered %v differs from the book's:\n%s\nwant:\n%s", c.file, got, want)
+		}
+	}
+
+	e.SetVersion(3)
+	book, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav, err := e.RenderNav()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := zipFile(t, book, "OPS/__toc.xhtml"); string(nav) != want {
+		t.Errorf("rendered nav differs from the book's:\n%s\nwant:\n%s", nav, want)
+	}
+	opf, err := e.RenderPackageDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(opf, []byte(`version="3.0"`)) {
+		t.Errorf("v3 book rendered a v2 package document:\n%s", opf)
+	}
+}
+
+func TestSetDRMFree(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		e := simpleBook(t)
+		e.SetVersion(v)
+		e.AddPublisher("Pub & Co")
+		e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"), -1)
+		e.SetDRMFree(true)
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatalf("v%v: %v", v, err)
+		}
+		opf := "OPS/content.opf"
+		if v == 3 {
+			opf = "OPS/book.opf"
+		}
+		if got := zipFile(t, book, opf); !strings.Contains(got, `<meta name="drm-free" content="true" />`) {
+			t.Errorf("v%v package document has no drm-free meta:\n%s", v, got)
+		}
+		last := zipFile(t, book, "OPS/a.xhtml")
+		if n := strings.Count(last, `<div class="drm-free">`); n != 1 {
+			t.Errorf("v%v last file has %d DRM-free notices, want 1:\n%s", v, n, last)
+		}
+		if !strings.Contains(last, "This book is DRM-free. Pub &amp; Co sells it") {
+			t.Errorf("v%v notice doesn't name the publisher:\n%s", v, last)
+		}
+		if got := zipFile(t, book, "OPS/b.xhtml"); strings.Contains(got, "drm-free") {
+			t.Errorf("v%v notice added to a file that isn't last:\n%s", v, got)
+		}
+	}
+
+	e := simpleBook(t)
+	if e.DRMFree() {
+		t.Errorf("DRMFree() = true for a new book")
+	}
+	e.SetDRMFree(true)
+	if !e.DRMFree() {
+		t.Errorf("DRMFree() = false after SetDRMFree(true)")
+	}
+	e.SetDRMFree(false)
+	if e.DRMFree() {
+		t.Errorf("DRMFree() = true after SetDRMFree(false)")
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zipFile(t, book, "OPS/a.xhtml"); strings.Contains(got, "drm-free") {
+		t.Errorf("notice added after SetDRMFree(false):\n%s", got)
+	}
+}
+
+func TestValidateStyleReferences(t *testing.T) {
+	e := simpleBook(t)
+	e.AddImage("images/bg.png", testPNG(t, 4, 4))
+	e.AddFont("fonts/My Font.otf", []byte("font"))
+	e.AddStylesheet("css/base.css", "p { margin: 0; }")
+	e.AddStylesheet("css/main.css", `@import "base.css";
+@import url('base.css') screen;
+/* url(missing.png) is commented out */
+@font-face { font-family: My; src: url("../fonts/My%20Font.otf?v=2"); }
+body { background: url(../images/bg.png) no-repeat; }
+.logo { background: url(data:image/png;base64,AAAA), url(https://example.com/a.png); }
+`)
+	if err := e.Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+
+	for _, css := range []string{
+		`@import "missing.css";`,
+		`body { background: url( '../images/missing.png' ); }`,
+		`@font-face { src: url(fonts/My%20Font.otf); }`,
+	} {
+		e := simpleBook(t)
+		e.AddFont("fonts/My Font.otf", []byte("font"))
+		e.AddStylesheet("css/broken.css", css)
+		if err := e.Validate(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Validate() = %v for %q, want ErrNotFound", err, css)
+		}
+	}
+}
+
+func TestSetStrict(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		setup func(e *EPub)
+		want  error
+	}{
+		{"empty author", func(e *EPub) { e.AddAuthor(" ") }, nil},
+		{"duplicate path", func(e *EPub) {
+			e.AddImage("images/a.png", testPNG(t, 2, 2))
+			e.AddImage("images/a.png", testPNG(t, 3, 3))
+		}, ErrDuplicatePath},
+		{"moved onto another file", func(e *EPub) {
+			id, _ := e.AddStylesheet("css/a.css", "p {}")
+			e.SetZipPath(id, "OPS/a.xhtml")
+		}, ErrDuplicatePath},
+		{"bad cover", func(e *EPub) { e.SetCoverImage("nope") }, ErrNotFound},
+		{"oversize image", func(e *EPub) {
+			e.AddImage("images/a.png", testPNG(t, 64, 64))
+			e.SetSizeBudget(0, 10)
+		}, ErrOverBudget},
+	} {
+		e := simpleBook(t)
+		c.setup(e)
+		if err := e.Validate(); err != nil {
+			t.Errorf("%v: Validate() = %v without strict mode", c.name, err)
+		}
+		e.SetStrict(true)
+		err := e.Validate()
+		if err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("%v: Validate() = %v in strict mode, want %v", c.name, err, c.want)
+		}
+	}
+
+	e := simpleBook(t)
+	e.AddAuthor("Jane Doe")
+	e.SetStrict(true)
+	if err := e.Validate(); err != nil {
+		t.Errorf("Validate() = %v in strict mode for a good book", err)
+	}
+}
+
+func TestSetWarningHandler(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetStripScripts(true)
+	e.SetTOCLabelLimit(8, "")
+	e.AddXHTML("b.xhtml", xhtmlPage("B", `<p>B</p><script>x()</script><math><mi>x</mi></math>`))
+	e.AddNavpoint("A very long label", "b.xhtml", 1)
+	var got []string
+	e.SetWarningHandler(func(w Warning) { got = append(got, w.String()) })
+	if _, err := e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a.xhtml: DOCTYPE rewritten for XHTML5",
+		"b.xhtml: DOCTYPE rewritten for XHTML5",
+		"b.xhtml: scripts removed",
+		"b.xhtml: manifest properties inferred: mathml",
+		`b.xhtml: table of contents label "A very long label" shortened to "A very…"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings = %q, want %q", got, want)
+	}
+
+	got = nil
+	e.SetWarningHandler(nil)
+	if _, err := e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("warnings = %q after removing the handler", got)
+	}
+}
+
+func TestManifestPreview(t *testing.T) {
+	e := simpleBook(t)
+	cover, _ := e.AddImage("images/cover.png", testPNG(t, 4, 4))
+	e.SetCoverImage(cover)
+	b, _ := e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"), -1)
+	p, err := e.ManifestPreview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ManifestPlan{
+		Items: []ManifestItem{
+			{ID: "ncx", Href: "toc.ncx", MediaType: "application/x-dtbncx+xml"},
+			{ID: cover, Href: "images/cover.png", MediaType: "image/png"},
+			{ID: "xhtml1", Href: "a.xhtml", MediaType: "application/xhtml+xml"},
+			{ID: b, Href: "b.xhtml", MediaType: "application/xhtml+xml"},
+		},
+		Spine: []Id{b, "xhtml1"},
+	}
+	for i := range p.Items {
+		if len(p.Items[i].Properties) == 0 {
+			p.Items[i].Properties = nil
+		}
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("v2 ManifestPreview() = %+v, want %+v", p, want)
+	}
+
+	e.SetVersion(3)
+	p, err = e.ManifestPreview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Items[0]; !reflect.DeepEqual(got.Properties, []string{"cover-image"}) {
+		t.Errorf("v3 cover item = %+v, want cover-image property", got)
+	}
+	if got := p.Items[len(p.Items)-1]; got.ID != "nav" || !reflect.DeepEqual(got.Properties, []string{"nav"}) {
+		t.Errorf("last v3 item = %+v, want the nav document", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.AddCreator("Someone", "auth"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("AddCreator with a bad role returned %v, want ErrInvalidRole", err)
+	}
+	if err := e.SetVersion(4); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("SetVersion(4) returned %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := e.ImageInfo("nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ImageInfo of a missing image returned %v, want ErrNotFound", err)
+	}
+	_, err := e.AddImage("images/bad.png", []byte("not an image"))
+	var re *ResourceError
+	if !errors.As(err, &re) || re.Op != "decode" || re.Path != "images/bad.png" || !errors.Is(err, img.ErrFormat) {
+		t.Errorf("AddImage of a bad image returned %#v, want a decode ResourceError", err)
+	}
+
+	e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>"))
+	if _, err := e.Serialize(); !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("Serialize with a file added twice returned %v, want ErrDuplicatePath", err)
+	}
+	if err := New().Validate(); !errors.Is(err, ErrEmptySpine) {
+		t.Errorf("Validate of an empty book returned %v, want ErrEmptySpine", err)
+	}
+
+	invalid := map[string]error{
+		"SetGeneratedIDs(same)":    e.SetGeneratedIDs("toc", "toc"),
+		"SetGeneratedIDs(bad ID)":  e.SetGeneratedIDs("1nav", "toc"),
+		"SetZipPath(unclean)":      e.SetZipPath(e.xhtml[0].id, "../a.xhtml"),
+		"AddVideoTrack(bad kind)":  e.AddVideoTrack("video1", "track1", "lyrics", "en", "Lyrics"),
+		"SetStyleVariable(name)":   e.SetStyleVariable("color", "red"),
+		"SetStyleVariable(value)":  e.SetStyleVariable("--color", "red; }"),
+		"RegisterTheme(nil)":       RegisterTheme(nil),
+		"RegisterTheme(no name)":   RegisterTheme(&Theme{}),
+		"RegisterTheme(duplicate)": RegisterTheme(&Theme{Name: "classic"}),
+	}
+	_, invalid["AddStylesheetWithOptions(untitled)"] = e.AddStylesheetWithOptions("css/alt.css", "p {}", StyleOptions{Alternate: true})
+	_, invalid["AddXHTML(two orders)"] = e.AddXHTML("c.xhtml", xhtmlPage("C", "<p>C</p>"), 1, 2)
+	for name, err := range invalid {
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%v returned %v, want ErrInvalidArgument", name, err)
+		}
+	}
+
+	book, err := simpleBook(t).SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"META-INF/container.xml", "OPS/content.opf"} {
+		bad := editZip(t, book, name, func(string) string { return "<package" })
+		if _, err := ReadFrom(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("ReadFrom with a malformed %v returned %v, want ErrUnsupportedFormat", name, err)
+		}
+	}
+
+	// IDs can only collide if they're changed behind the package's
+	// back, as a book read in or a bug might.
+	e = simpleBook(t)
+	id, err := e.AddImage("images/a.png", testPNG(t, 2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.images[0].id = "xhtml1"
+	if err := e.Validate(); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Validate with a manifest ID used twice returned %v, want ErrDuplicateID", err)
+	}
+	e.images[0].id = e.navID
+	if err := e.Validate(); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Validate with a resource using the nav's ID returned %v, want ErrDuplicateID", err)
+	}
+	e.images[0].id = id
+	e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"))
+	e.xhtml[1].id = e.xhtml[0].id
+	if err := e.validateSpine(); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("validateSpine with an itemref used twice returned %v, want ErrDuplicateID", err)
+	}
+}
+
+func TestVideoTracks(t *testing.T) {
+	e := simpleBook(t)
+	v, err := e.AddVideo("video/v.mp4", []byte("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := e.AddAudio("audio/a.mp3", []byte("audio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := e.AddTextTrack("video/v.vtt", "WEBVTT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		video, track Id
+		want         error
+	}{
+		{"nope", tr, ErrNotFound},
+		{a, tr, ErrUnsupportedFormat},
+		{tr, tr, ErrUnsupportedFormat},
+		{v, a, ErrUnsupportedFormat},
+		{v, "nope", ErrNotFound},
+	} {
+		if err := e.AddVideoTrack(c.video, c.track, "captions", "en", "English"); !errors.Is(err, c.want) {
+			t.Errorf("AddVideoTrack(%v, %v) = %v, want %v", c.video, c.track, err, c.want)
+		}
+	}
+	for id, want := range map[Id]error{"nope": ErrNotFound, a: ErrUnsupportedFormat, tr: ErrUnsupportedFormat} {
+		if _, err := e.VideoMarkup(id, "a.xhtml", "No video"); !errors.Is(err, want) {
+			t.Errorf("VideoMarkup(%v) = %v, want %v", id, err, want)
+		}
+	}
+
+	if err := e.AddVideoTrack(v, tr, "captions", "en", "English"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.VideoMarkup(v, "a.xhtml", "No video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "video markup", got, `<video src="video/v.mp4"`, `<track kind="captions" src="video/v.vtt" srclang="en" label="English" />`)
+}
+
+func TestMediaPosterAndFallback(t *testing.T) {
+	e := simpleBook(t)
+	v, err := e.AddVideo("video/v.mp4", []byte("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := e.AddAudio("audio/a.mp3", []byte("audio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := e.AddImage("images/poster.png", testPNG(t, 4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := e.AddXHTML("fallback.xhtml", xhtmlPage("Fallback", "<p>No video</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetMediaPoster(a, img); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("SetMediaPoster(audio) = %v, want ErrUnsupportedFormat", err)
+	}
+	if err := e.SetMediaPoster(v, "nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetMediaPoster(missing image) = %v, want ErrNotFound", err)
+	}
+	if err := e.SetMediaFallback(v, "nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetMediaFallback(missing XHTML) = %v, want ErrNotFound", err)
+	}
+	if err := e.SetMediaPoster(v, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetMediaFallback(v, fb); err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.VideoMarkup(v, "xhtml/a.xhtml", "No video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "video markup", got, `poster="../images/poster.png"`, `<a href="../fallback.xhtml">No video</a>`)
+
+	want := `href="video/v.mp4" media-type="video/mp4" fallback="` + string(fb) + `"`
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "content.opf", zipFile(t, b, "OPS/content.opf"), want)
+	b, err = e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "book.opf", zipFile(t, b, "OPS/book.opf"), want)
+}
+
+func TestRoles(t *testing.T) {
+	roles := ValidRoles()
+	if len(roles) != len(validRoles) || !sort.StringsAreSorted(roles) {
+		t.Errorf("ValidRoles() isn't every role, sorted: %v", roles)
+	}
+	if d, ok := RoleDescription("aut"); !ok || d != "Author" {
+		t.Errorf(`RoleDescription("aut") = %q, %v`, d, ok)
+	}
+	if _, ok := RoleDescription("xyz"); ok {
+		t.Errorf(`RoleDescription("xyz") claims it's valid`)
+	}
+
+	e := New()
+	for role, want := range map[string]string{
+		"auth":        `did you mean "aut" (Author)?`,
+		"AUT":         `did you mean "aut" (Author)?`,
+		"Illustrator": `did you mean "ill" (Illustrator)?`,
+		"translat":    `did you mean "trl" (Translator)?`,
+		"edx":         `"edc" (Editor of compilation) or "edm"`,
+		"zz":          `invalid role "zz"`,
+	} {
+		err := e.AddCreator("Someone", role)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("AddCreator(%q) returned %v, want it to mention %v", role, err, want)
+		}
+	}
+}
+
+func TestAddCreatorPerson(t *testing.T) {
+	e := simpleBook(t)
+	p := Person{
+		Name:             "Haruki Murakami",
+		SortName:         "Murakami, Haruki",
+		Role:             "aut",
+		AlternateScripts: map[string]string{"ja": "村上 春樹"},
+		DisplaySeq:       1,
+	}
+	if err := e.AddCreatorPerson(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddContributorPerson(Person{Name: "Jay Rubin", Role: "trl"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddCreatorPerson(Person{Role: "aut"}); err == nil {
+		t.Errorf("AddCreatorPerson accepted a person without a name")
+	}
+	if err := e.AddCreatorPerson(Person{Name: "X", Role: "auth"}); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("AddCreatorPerson with a bad role returned %v, want ErrInvalidRole", err)
+	}
+
+	v2, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, v2, "OPS/content.opf")
+	if want := `<dc:creator opf:role="aut" opf:file-as="Murakami, Haruki">Haruki Murakami</dc:creator>`; !strings.Contains(opf, want) {
+		t.Errorf("v2 package doesn't contain %v:\n%s", want, opf)
+	}
+	if strings.Contains(opf, "display-seq") || strings.Contains(opf, "村上") {
+		t.Errorf("v2 package has v3-only refinements:\n%s", opf)
+	}
+
+	v3, err := e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf = zipFile(t, v3, "OPS/book.opf")
+	for _, want := range []string{
+		`property="role" scheme="marc:relators">aut</meta>`,
+		`property="file-as">Murakami, Haruki</meta>`,
+		`property="alternate-script" xml:lang="ja">村上 春樹</meta>`,
+		`property="display-seq">1</meta>`,
+		`<dc:contributor id="id`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("v3 package doesn't contain %v:\n%s", want, opf)
+		}
+	}
+}
+
+func TestContributorHelpers(t *testing.T) {
+	e := simpleBook(t)
+	e.AddIllustrator("Ila")
+	e.AddTranslator("Tom")
+	e.AddEditor("Eve")
+	e.AddNarrator("Ned")
+
+	v2, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, v2, "OPS/content.opf")
+	for _, want := range []string{
+		`<dc:creator opf:role="ill">Ila</dc:creator>`,
+		`<dc:contributor opf:role="trl">Tom</dc:contributor>`,
+		`<dc:contributor opf:role="edt">Eve</dc:contributor>`,
+		`<dc:contributor opf:role="nrt">Ned</dc:contributor>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("v2 package doesn't contain %v:\n%s", want, opf)
+		}
+	}
+	if strings.Contains(opf, "media:narrator") {
+		t.Errorf("v2 package has a media:narrator:\n%s", opf)
+	}
+
+	v3, err := e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, v3, "OPS/book.opf"); !strings.Contains(opf, `<meta property="media:narrator">Ned</meta>`) {
+		t.Errorf("v3 package has no media:narrator:\n%s", opf)
+	}
+}
+
+func TestWriteAuto(t *testing.T) {
+	name := t.TempDir() + "/book.epub"
+	read := func() []byte {
+		t.Helper()
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	e := simpleBook(t)
+	if dropped, err := e.WriteAuto(name); err != nil || len(dropped) != 0 {
+		t.Fatalf("WriteAuto = %v, %v", dropped, err)
+	}
+	zipFile(t, read(), "OPS/content.opf")
+
+	e.SetSeries("Series")
+	e.SetFixedLayout(true)
+	if got := e.Features(); len(got) != 2 || got[0].Name != "series and set metadata" || got[1].Version != 3 {
+		t.Errorf("Features() = %v", got)
+	}
+	if dropped, err := e.WriteAuto(name); err != nil || len(dropped) != 0 {
+		t.Fatalf("WriteAuto = %v, %v", dropped, err)
+	}
+	zipFile(t, read(), "OPS/book.opf")
+
+	e.SetVersion(2)
+	dropped, err := e.WriteAuto(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 2 {
+		t.Errorf("WriteAuto with a forced v2 dropped %v, want both features", dropped)
+	}
+	zipFile(t, read(), "OPS/content.opf")
+}
+
+func TestWriteBoth(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddImage("images/a.png", testPNG(t, 10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir() + "/book"
+	if err := e.WriteBoth(base); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := os.ReadFile(base + ".epub2.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, err := os.ReadFile(base + ".epub3.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipFile(t, v2, "OPS/content.opf")
+	zipFile(t, v3, "OPS/book.opf")
+	if a, b := zipFile(t, v2, "OPS/images/a.png"), zipFile(t, v3, "OPS/images/a.png"); a != b || a != string(testPNG(t, 10, 10)) {
+		t.Errorf("shared image differs between the books")
+	}
+	if a, b := zipFile(t, v2, "OPS/a.xhtml"), zipFile(t, v3, "OPS/a.xhtml"); a == b {
+		t.Errorf("v3 XHTML wasn't prepared for v3:\n%s", b)
+	}
+	want, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(want), int64(len(want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if zipFile(t, v2, f.Name) != zipFile(t, want, f.Name) {
+			t.Errorf("WriteBoth's %v differs from SerializeV2's", f.Name)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := e.WriteBothTo(dir+"/old.epub", dir+"/new.epub"); err != nil {
+		t.Fatal(err)
+	}
+	for name, opf := range map[string]string{"old.epub": "OPS/content.opf", "new.epub": "OPS/book.opf"} {
+		b, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zipFile(t, b, opf)
+	}
+	if err := e.WriteBothTo(dir+"/missing/old.epub", dir+"/new.epub"); err == nil {
+		t.Errorf("WriteBothTo succeeded writing into a missing directory")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	build := func(title string, extra bool) []byte {
+		t.Helper()
+		e := simpleBook(t)
+		e.SetTitle(title)
+		if err := e.SetUUID("0b7c1a2e-6f1d-4c64-9a51-2b1f6d7e8c90"); err != nil {
+			t.Fatal(err)
+		}
+		e.AddNavpoint("A", "a.xhtml", 1)
+		if extra {
+			if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>")); err != nil {
+				t.Fatal(err)
+			}
+			e.AddNavpoint("B", "b.xhtml", 2)
+		}
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return book
+	}
+	a := build("Title", false)
+	r, err := Diff(a, build("Title", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Empty() {
+		t.Errorf("identical books differ:\n%v", r)
+	}
+
+	r, err = Diff(a, build("Second Edition", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Metadata) != 1 || r.Metadata[0].Name != "title" || r.Metadata[0].New[0] != "Second Edition" {
+		t.Errorf("Metadata = %+v, want a title change", r.Metadata)
+	}
+	if len(r.Added) != 1 || r.Added[0] != "OPS/b.xhtml" || len(r.Removed) != 0 {
+		t.Errorf("Added = %v, Removed = %v, want [OPS/b.xhtml] and nothing", r.Added, r.Removed)
+	}
+	if want := []string{"OPS/a.xhtml", "OPS/b.xhtml"}; !equalStrings(r.NewSpine, want) {
+		t.Errorf("NewSpine = %v, want %v", r.NewSpine, want)
+	}
+	if want := []string{"A (OPS/a.xhtml)", "B (OPS/b.xhtml)"}; !equalStrings(r.NewTOC, want) {
+		t.Errorf("NewTOC = %v, want %v", r.NewTOC, want)
+	}
+
+	if _, err := Diff(a, []byte("not a zip")); err == nil {
+		t.Errorf("Diff accepted a file that isn't a book")
+	}
+}
+
+func TestAddRevision(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.AddRevision("1.0", "2024-01-15", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddRevision("1.1", "2024-03", "Fixed typos & errata"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddRevision("1.1", "2024-04", ""); err == nil {
+		t.Errorf("AddRevision accepted a duplicate version")
+	}
+	if err := e.AddRevision("1.2", "March 2024", ""); err == nil {
+		t.Errorf("AddRevision accepted a bad date")
+	}
+	want := []Revision{{Version: "1.0", Date: "2024-01-15"}, {Version: "1.1", Date: "2024-03", Notes: "Fixed typos & errata"}}
+	revs := e.Revisions()
+	if !reflect.DeepEqual(revs, want) {
+		t.Errorf("Revisions() = %+v, want %+v", revs, want)
+	}
+	revs[0].Version = "changed"
+	if got := e.Revisions(); got[0].Version != "1.0" {
+		t.Errorf("changing the result of Revisions() changed the book's history: %+v", got)
+	}
+	id, err := e.AddVersionHistoryPage(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Errorf("AddVersionHistoryPage returned no ID")
+	}
+
+	for _, v := range []float64{2, 3} {
+		e.SetVersion(v)
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "OPS/content.opf"
+		if v == 3 {
+			name = "OPS/book.opf"
+		}
+		opf := zipFile(t, book, name)
+		for _, want := range []string{`<meta name="revision" content="1.0 (2024-01-15)" />`, `<meta name="revision" content="1.1 (2024-03): Fixed typos &amp; errata" />`} {
+			if !strings.Contains(opf, want) {
+				t.Errorf("v%v package doesn't contain %q:\n%s", v, want, opf)
+			}
+		}
+		page := zipFile(t, book, "OPS/xhtml/history.xhtml")
+		if i, j := strings.Index(page, "1.1 (2024-03)"), strings.Index(page, "1.0 (2024-01-15)"); i < 0 || j < i || !strings.Contains(page, "<dd>Fixed typos &amp; errata</dd>") {
+			t.Errorf("unexpected version history page:\n%s", page)
+		}
+	}
+
+	if _, err := simpleBook(t).AddVersionHistoryPage(100); err == nil {
+		t.Errorf("AddVersionHistoryPage succeeded with no revisions")
+	}
+}
+
+func TestSetSizeBudget(t *testing.T) {
+	e := simpleBook(t)
+	big := testPNG(t, 300, 300)
+	if _, err := e.AddImage("images/big.png", big); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddImage("images/small.png", testPNG(t, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetSizeBudget(-1, 0); err == nil {
+		t.Errorf("SetSizeBudget accepted a negative budget")
+	}
+
+	if err := e.SetSizeBudget(1<<30, int64(len(big))-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Validate(); err != nil {
+		t.Errorf("Validate() = %v for a book under budget", err)
+	}
+	if w := strings.Join(e.Warnings(), "\n"); !strings.Contains(w, "images/big.png") || strings.Contains(w, "images/small.png") {
+		t.Errorf("unexpected size warnings:\n%s", w)
+	}
+
+	e.SetSizeBudget(100, 0)
+	err := e.Validate()
+	if !errors.Is(err, ErrOverBudget) {
+		t.Fatalf("Validate() = %v, want ErrOverBudget", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "largest files: images/big.png") {
+		t.Errorf("over budget error doesn't list the largest file first: %v", msg)
+	}
+	if len(e.Warnings()) != 0 {
+		t.Errorf("Warnings() = %v with no per-image budget", e.Warnings())
+	}
+	if _, err := e.Serialize(); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("Serialize() = %v for a book over budget, want ErrOverBudget", err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	e := simpleBook(t)
+	for i := 0; i < 20; i++ {
+		body := strings.Repeat(fmt.Sprintf("<p>Paragraph %d of a chapter that goes on for a while.</p>\n", i), 200)
+		if _, err := e.AddXHTML(fmt.Sprintf("ch%d.xhtml", i), xhtmlPage("Chapter", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.AddImage("images/photo.jpg", testJPEG(t, 400, 300)); err != nil {
+		t.Fatal(err)
+	}
+	compressed, uncompressed := e.EstimateSize()
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed >= uncompressed {
+		t.Errorf("EstimateSize() = %v, %v; compressed should be smaller", compressed, uncompressed)
+	}
+	if got, want := float64(compressed), float64(len(book)); got < want*0.75 || got > want*1.25 {
+		t.Errorf("EstimateSize() compressed = %v, want within 25%% of the real %v", compressed, len(book))
+	}
+}
+
+func TestAddSubjectPath(t *testing.T) {
+	subjects := func(e *EPub) []string {
+		t.Helper()
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, m := range regexp.MustCompile(`<dc:subject>([^<]*)</dc:subject>`).FindAllStringSubmatch(zipFile(t, book, "OPS/content.opf"), -1) {
+			ret = append(ret, m[1])
+		}
+		return ret
+	}
+
+	e := simpleBook(t)
+	e.AddSubject("Fiction")
+	if err := e.AddSubjectPath("Fiction", " Fantasy ", "Epic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSubjectPath("Fiction", "Fantasy", "Urban"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSubjectPath("Fiction", ""); err == nil {
+		t.Errorf("AddSubjectPath accepted an empty level")
+	}
+	if got, want := subjects(e), []string{"Fiction", "Fantasy", "Epic", "Fiction / Fantasy / Epic", "Urban", "Fiction / Fantasy / Urban"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default subjects = %q, want %q", got, want)
+	}
+
+	if err := e.SetSubjectStyle(SubjectPaths, " > "); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(e), []string{"Fiction", "Fiction > Fantasy > Epic", "Fiction > Fantasy > Urban"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("path subjects = %q, want %q", got, want)
+	}
+	if err := e.SetSubjectStyle(SubjectLevels, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(e), []string{"Fiction", "Fantasy", "Epic", "Urban"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("level subjects = %q, want %q", got, want)
+	}
+	if err := e.SetSubjectStyle(0, ""); err == nil {
+		t.Errorf("SetSubjectStyle accepted no style")
+	}
+}
+
+func TestSetSubjectCase(t *testing.T) {
+	subjects := func(e *EPub) []string {
+		t.Helper()
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, m := range regexp.MustCompile(`<dc:subject>([^<]*)</dc:subject>`).FindAllStringSubmatch(zipFile(t, book, "OPS/content.opf"), -1) {
+			ret = append(ret, m[1])
+		}
+		return ret
+	}
+
+	e := simpleBook(t)
+	for _, s := range []string{"Science  Fiction", " science fiction", "", "  ", "LORD OF THE RINGS", "Cooking"} {
+		e.AddSubject(s)
+	}
+	e.AddSubjectPath("cooking", "Baking")
+	if got, want := subjects(e), []string{"Science Fiction", "LORD OF THE RINGS", "Cooking", "Baking", "cooking / Baking"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default subjects = %q, want %q", got, want)
+	}
+	if err := e.SetSubjectCase(SubjectLowerCase); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(e), []string{"science fiction", "lord of the rings", "cooking", "baking", "cooking / baking"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lower case subjects = %q, want %q", got, want)
+	}
+	if err := e.SetSubjectCase(SubjectTitleCase); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(e), []string{"Science Fiction", "Lord of the Rings", "Cooking", "Baking", "Cooking / Baking"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("title case subjects = %q, want %q", got, want)
+	}
+	if err := e.SetSubjectCase(SubjectCase(7)); err == nil {
+		t.Errorf("SetSubjectCase accepted an invalid case")
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	for _, c := range []struct{ title, lang, want string }{
+		{"The Hobbit", "en", "Hobbit"},
+		{"  an Unexpected Party ", "en-GB", "Unexpected Party"},
+		{"A", "en", "A"},
+		{"Theory of Everything", "en", "Theory of Everything"},
+		{"L’Étranger", "fr", "Étranger"},
+		{"Les Misérables", "fr", "Misérables"},
+		{"Die Verwandlung", "de", "Verwandlung"},
+		{"The Hobbit", "", "The Hobbit"},
+	} {
+		if got := TitleSortKey(c.title, c.lang); got != c.want {
+			t.Errorf("TitleSortKey(%q, %q) = %q, want %q", c.title, c.lang, got, c.want)
+		}
+	}
+	for _, c := range []struct{ name, lang, want string }{
+		{"Jane Austen", "en", "Austen, Jane"},
+		{"Mary Ann Evans", "en", "Evans, Mary Ann"},
+		{"Austen, Jane", "en", "Austen, Jane"},
+		{"Homer", "en", "Homer"},
+		{"村上 春樹", "ja", "村上 春樹"},
+	} {
+		if got := NameSortKey(c.name, c.lang); got != c.want {
+			t.Errorf("NameSortKey(%q, %q) = %q, want %q", c.name, c.lang, got, c.want)
+		}
+	}
+}
+
+type testTransliterator map[string]string
+
+func (t testTransliterator) Reading(s, lang string) (string, bool) {
+	r, ok := t[s]
+	return r, ok
+}
+
+func TestSetAutoSortKeys(t *testing.T) {
+	e := New()
+	e.SetTitle("The Title")
+	e.AddLanguage("en")
+	if _, err := e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>")); err != nil {
+		t.Fatal(err)
+	}
+	e.AddAuthor("Jane Austen")
+	e.AddAuthor("村上春樹")
+	e.AddCreatorPerson(Person{Name: "Mary Shelley", SortName: "Shelley, Mary W."})
+	e.SetAutoSortKeys(true, testTransliterator{"村上春樹": "むらかみはるき"})
+
+	book, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/content.opf")
+	for _, want := range []string{`opf:file-as="Austen, Jane">Jane Austen<`, `opf:file-as="むらかみはるき">村上春樹<`, `opf:file-as="Shelley, Mary W.">Mary Shelley<`, `<dc:title>The Title</dc:title>`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("v2 package doesn't contain %q:\n%s", want, opf)
+		}
+	}
+	book, err = e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf = zipFile(t, book, "OPS/book.opf")
+	if !regexp.MustCompile(`property="file-as">Title</meta>`).MatchString(opf) {
+		t.Errorf("v3 package has no title sort key:\n%s", opf)
+	}
+
+	e.SetAutoSortKeys(false, nil)
+	book, err = e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, book, "OPS/content.opf"); strings.Contains(opf, "Austen, Jane") {
+		t.Errorf("sort keys written with SetAutoSortKeys(false):\n%s", opf)
+	}
+}
+
+func TestSetNavLinks(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddXHTML("xhtml/c.xhtml", xhtmlPage("C", "<p>C</p>"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"), 2); err != nil {
+		t.Fatal(err)
+	}
+	e.SetNavLinks(&NavLinks{Header: true, Footer: true, Next: "Onward & up"})
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := zipFile(t, book, "OPS/a.xhtml")
+	if strings.Contains(a, `class="prev"`) || strings.Count(a, `<a class="next" rel="next" href="b.xhtml">Onward &amp; up</a>`) != 2 {
+		t.Errorf("unexpected links in the first file:\n%s", a)
+	}
+	b := zipFile(t, book, "OPS/b.xhtml")
+	if !strings.Contains(b, `<div class="navlinks"><a class="prev" rel="prev" href="a.xhtml">Previous</a> <a class="next" rel="next" href="xhtml/c.xhtml">Onward &amp; up</a></div>`) {
+		t.Errorf("unexpected links in the middle file:\n%s", b)
+	}
+	c := zipFile(t, book, "OPS/xhtml/c.xhtml")
+	if strings.Contains(c, `class="next"`) || !strings.Contains(c, `href="../b.xhtml"`) {
+		t.Errorf("unexpected links in the last file:\n%s", c)
+	}
+
+	e.SetNavLinks(&NavLinks{})
+	book, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := zipFile(t, book, "OPS/b.xhtml"); strings.Count(b, "navlinks") != 1 || strings.Index(b, "navlinks") < strings.Index(b, "<p>B</p>") {
+		t.Errorf("links aren't only in the footer by default:\n%s", b)
+	}
+	e.SetNavLinks(nil)
+	book, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := zipFile(t, book, "OPS/b.xhtml"); strings.Contains(b, "navlinks") {
+		t.Errorf("links added after SetNavLinks(nil):\n%s", b)
+	}
+}
+
+func TestSetHeadingIDs(t *testing.T) {
+	for _, c := range []struct{ text, want string }{
+		{"Chapter 1: The Storm", "chapter-1-the-storm"},
+		{"  Notes & Queries!", "notes-queries"},
+		{"1984", "h-1984"},
+		{"Über Café", "über-café"},
+		{"???", "section"},
+	} {
+		if got := Slug(c.text); got != c.want {
+			t.Errorf("Slug(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+
+	e := New()
+	e.SetTitle("Title")
+	body := `<h1>Notes</h1><p id="notes-2">x</p><h2 class="x">Notes</h2><h2>Notes &amp; <em>More</em></h2><h3 id="kept">Kept</h3>`
+	if _, err := e.AddXHTML("xhtml/a.xhtml", xhtmlPage("A", body)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.HeadingAnchors(), []HeadingAnchor{{Path: "xhtml/a.xhtml", ID: "kept", Level: 3, Text: "Kept"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HeadingAnchors() without SetHeadingIDs = %+v, want %+v", got, want)
+	}
+
+	e.SetHeadingIDs(Slug)
+	want := []HeadingAnchor{
+		{"xhtml/a.xhtml", "notes", 1, "Notes"},
+		{"xhtml/a.xhtml", "notes-3", 2, "Notes"},
+		{"xhtml/a.xhtml", "notes-more", 2, "Notes & More"},
+		{"xhtml/a.xhtml", "kept", 3, "Kept"},
+	}
+	if got := e.HeadingAnchors(); !reflect.DeepEqual(got, want) {
+		t.Errorf("HeadingAnchors() = %+v, want %+v", got, want)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := zipFile(t, book, "OPS/xhtml/a.xhtml")
+	for _, s := range []string{`<h1 id="notes">`, `<h2 class="x" id="notes-3">`, `<h2 id="notes-more">`, `<h3 id="kept">`} {
+		if !strings.Contains(a, s) {
+			t.Errorf("written file doesn't contain %q:\n%s", s, a)
+		}
+	}
+
+	e.SetHeadingIDs(func(string) string { return "custom" })
+	if got := e.HeadingAnchors(); got[0].ID != "custom" || got[1].ID != "custom-2" {
+		t.Errorf("HeadingAnchors() with a custom slug = %+v", got)
+	}
+}
+
+func TestSetTOCLabelLimit(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetNCX(true)
+	e.AddNavpoint("Short", "a.xhtml", 1)
+	e.AddNavpoint("In Which Our Hero Sets Out &amp; Meets a Rather Talkative Dragon", "a.xhtml#x", 2)
+	if err := e.SetTOCLabelLimit(3, "..."); err == nil {
+		t.Errorf("SetTOCLabelLimit accepted a limit no longer than the ellipsis")
+	}
+	if err := e.SetTOCLabelLimit(30, ""); err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav := zipFile(t, book, "OPS/__toc.xhtml")
+	for _, want := range []string{`<a href="a.xhtml">Short</a>`, `<a href="a.xhtml#x" title="In Which Our Hero Sets Out &amp; Meets a Rather Talkative Dragon">In Which Our Hero Sets Out…</a>`} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("nav doesn't contain %q:\n%s", want, nav)
+		}
+	}
+	if ncx := zipFile(t, book, "OPS/toc.ncx"); !strings.Contains(ncx, "<text>In Which Our Hero Sets Out…</text>") {
+		t.Errorf("NCX label wasn't shortened:\n%s", ncx)
+	}
+}
+
+func TestAddContentAudit(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", "<h1>Chapter&#160;Two</h1>\n<p>It was a <em>dark</em> and\n stormy night. TK</p><style>p { }</style><p>Colour &amp; flavour.</p>")); err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	e.AddContentAudit(func(path, text string) []Issue {
+		texts = append(texts, path+"|"+text)
+		if strings.Contains(text, "Colour") {
+			return []Issue{{Message: "British spelling", Warning: true}}
+		}
+		return nil
+	})
+	if err := e.Validate(); err != nil {
+		t.Fatalf("Validate() = %v with only warnings", err)
+	}
+	if want := []string{"a.xhtml|A", "b.xhtml|Chapter Two\nIt was a dark and stormy night. TK\nColour & flavour."}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("audited text = %q, want %q", texts, want)
+	}
+	if w := e.Warnings(); len(w) != 1 || w[0] != "b.xhtml: British spelling" {
+		t.Errorf("Warnings() = %q", w)
+	}
+
+	audit, err := PlaceholderAudit(`\[citation needed\]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddContentAudit(audit)
+	err = e.Validate()
+	var ae *AuditError
+	if !errors.Is(err, ErrContentAudit) || !errors.As(err, &ae) {
+		t.Fatalf("Validate() = %v, want an AuditError", err)
+	}
+	if len(ae.Issues) != 1 || ae.Issues[0].Path != "b.xhtml" || !strings.Contains(ae.Issues[0].Message, `"TK" in line 2`) {
+		t.Errorf("audit issues = %+v", ae.Issues)
+	}
+	if _, err := e.Serialize(); !errors.Is(err, ErrContentAudit) {
+		t.Errorf("Serialize() = %v for a book with placeholders", err)
+	}
+	if _, err := PlaceholderAudit("("); err == nil {
+		t.Errorf("PlaceholderAudit accepted a bad pattern")
+	}
+}
+
+func TestAltText(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddImagePage("images/p1.png", testPNG(t, 10, 10), ""); err != nil {
+		t.Fatal(err)
+	}
+	flourish, err := e.AddImage("images/flourish.png", testPNG(t, 4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `<p><img src="../images/flourish.png" alt=""/></p><p><img src='../images/p1.png'></p><img src="../images/other.png" alt="Other" />`
+	if _, err := e.AddXHTML("xhtml/b.xhtml", xhtmlPage("B", body)); err != nil {
+		t.Fatal(err)
+	}
+	if w := strings.Join(e.Warnings(), "\n"); strings.Count(w, "no alt text") != 3 {
+		t.Errorf("expected 3 alt text warnings, got:\n%s", w)
+	}
+
+	p1, err := e.ImageID("images/p1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetAltText(p1, ""); err == nil {
+		t.Errorf("SetAltText accepted empty alt text")
+	}
+	if err := e.SetAltText(p1, `A fox & a "hound"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetDecorativeImage(flourish); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.Warnings(); len(w) != 0 {
+		t.Errorf("Warnings() = %q after registering alt text", w)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const alt = `alt="A fox &amp; a &#34;hound&#34;"`
+	if p := zipFile(t, book, "OPS/images/p1.xhtml"); !strings.Contains(p, `<img src="p1.png" `+alt+` />`) {
+		t.Errorf("image page doesn't have the registered alt text:\n%s", p)
+	}
+	b := zipFile(t, book, "OPS/xhtml/b.xhtml")
+	for _, want := range []string{`<img src='../images/p1.png' ` + alt + `>`, `<img src="../images/flourish.png" alt=""/>`} {
+		if !strings.Contains(b, want) {
+			t.Errorf("written file doesn't contain %q:\n%s", want, b)
+		}
+	}
+	if _, err := e.AddCoverPage(p1, 0); err != nil {
+		t.Fatal(err)
+	}
+	book, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := zipFile(t, book, "OPS/xhtml/cover.xhtml"); !strings.Contains(c, `alt="A fox &amp; a &#34;hound&#34;"`) {
+		t.Errorf("cover page doesn't use the registered alt text:\n%s", c)
+	}
+	if _, err := e.ImageID("images/none.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ImageID of a missing image = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGenerateInlineTOC(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.GenerateInlineTOC(0); err == nil {
+		t.Errorf("GenerateInlineTOC succeeded with no navpoints")
+	}
+	if _, err := e.AddXHTML("xhtml/b.xhtml", xhtmlPage("B", "<h2 id='s 1'>S</h2>"), 3); err != nil {
+		t.Fatal(err)
+	}
+	e.AddNavpoint("Two", "xhtml/b.xhtml", 2).AddNavpoint("Section <em>1</em>", "xhtml/b.xhtml#s 1", 1)
+	e.AddNavpoint("One & Only", "a.xhtml", 1)
+
+	id, err := e.GenerateInlineTOC(1, InlineTOCHeading("Table"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc := zipFile(t, book, "OPS/xhtml/toc.xhtml")
+	for _, want := range []string{"<h1>Table</h1>", `<a href="../a.xhtml">One &amp; Only</a>`, `<a href="b.xhtml">Two</a>`, `<a href="b.xhtml#s%201">Section 1</a>`} {
+		if !strings.Contains(toc, want) {
+			t.Errorf("inline TOC doesn't contain %q:\n%s", want, toc)
+		}
+	}
+	if strings.Index(toc, "One") > strings.Index(toc, "Two") {
+		t.Errorf("inline TOC isn't in navpoint order:\n%s", toc)
+	}
+	if opf := zipFile(t, book, "OPS/content.opf"); !strings.Contains(opf, `<reference type="toc" title="Table of Contents" href="xhtml/toc.xhtml" />`) {
+		t.Errorf("inline TOC isn't tagged as the TOC landmark:\n%s", opf)
+	}
+	if id == "" {
+		t.Errorf("GenerateInlineTOC returned no ID")
+	}
+
+	if _, err := e.GenerateInlineTOC(1, InlineTOCPath("short.xhtml"), InlineTOCDepth(1)); err != nil {
+		t.Fatal(err)
+	}
+	book, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toc := zipFile(t, book, "OPS/short.xhtml"); strings.Contains(toc, "Section") || !strings.Contains(toc, "<h1>Contents</h1>") {
+		t.Errorf("unexpected depth-limited inline TOC:\n%s", toc)
+	}
+}
+
+func TestAddPart(t *testing.T) {
+	e := simpleBook(t)
+	e.AddNavpoint("Prologue", "a.xhtml", 1)
+	one := e.AddPart("Part One")
+	if _, err := one.AddDivider(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := one.AddChapter("Chapter 1", "xhtml/c1.xhtml", xhtmlPage("1", "<p>1</p>")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := one.AddChapter("Chapter 2", "xhtml/c2.xhtml", xhtmlPage("2", "<p>2</p>")); err != nil {
+		t.Fatal(err)
+	}
+	two := e.AddPart("Part Two")
+	if err := e.Validate(); err == nil {
+		t.Errorf("Validate accepted a part with no chapters")
+	}
+	if _, err := two.AddChapter("Chapter 3", "xhtml/c3.xhtml", xhtmlPage("3", "<p>3</p>")); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, m := range regexp.MustCompile(`(?s)<text>([^<]*)</text>\s*</navLabel>\s*<content src="([^"]*)"`).FindAllStringSubmatch(zipFile(t, book, "OPS/toc.ncx"), -1) {
+		labels = append(labels, m[1]+"="+m[2])
+	}
+	if want := []string{"Prologue=a.xhtml", "Part One=xhtml/part01.xhtml", "Chapter 1=xhtml/c1.xhtml", "Chapter 2=xhtml/c2.xhtml", "Part Two=xhtml/c3.xhtml", "Chapter 3=xhtml/c3.xhtml"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("TOC = %q, want %q", labels, want)
+	}
+	if ncx := zipFile(t, book, "OPS/toc.ncx"); !regexp.MustCompile(`(?s)Part One.*<navPoint[^>]*>\s*<navLabel>\s*<text>Chapter 1.*</navPoint>\s*</navPoint>`).MatchString(ncx) {
+		t.Errorf("chapters aren't nested under their part:\n%s", ncx)
+	}
+	if p := zipFile(t, book, "OPS/xhtml/part01.xhtml"); !strings.Contains(p, "<h1>Part One</h1>") {
+		t.Errorf("unexpected divider page:\n%s", p)
+	}
+	opf := zipFile(t, book, "OPS/content.opf")
+	if i, j := strings.Index(opf, `<itemref idref="xhtml1"`), strings.Index(opf, `<itemref idref="xhtml2"`); i < 0 || j < i {
+		t.Errorf("divider isn't before the part's chapters in the spine:\n%s", opf)
+	}
+}
+
+func TestSetChapterNumbering(t *testing.T) {
+	e := New()
+	e.SetTitle("Title")
+	if _, err := e.AddChapter("Beginnings", "xhtml/c1.xhtml", xhtmlPage("1", `<h1 class="ch">Beginnings</h1><p>1</p>`)); err != nil {
+		t.Fatal(err)
+	}
+	p := e.AddPart("Part One")
+	id2, err := p.AddChapter("Middles", "xhtml/c2.xhtml", xhtmlPage("2", "<p>2</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = e.AddPart("Part Two")
+	if _, err := p.AddChapter("Ends", "xhtml/c3.xhtml", xhtmlPage("3", "<p>3</p>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetChapterNumbering(&ChapterNumbering{Format: "Chapter"}); err == nil {
+		t.Errorf("SetChapterNumbering accepted a format without a number")
+	}
+	if l, ok := e.ChapterLabel(id2); !ok || l != "Middles" {
+		t.Errorf("ChapterLabel() without numbering = %q, %v", l, ok)
+	}
+
+	if err := e.SetChapterNumbering(&ChapterNumbering{Format: "Chapter %d — %s", Headings: true}); err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := e.ChapterLabel(id2); !ok || l != "Chapter 2 — Middles" {
+		t.Errorf("ChapterLabel() = %q, %v, want Chapter 2 — Middles", l, ok)
+	}
+	book, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ncx := zipFile(t, book, "OPS/toc.ncx")
+	for _, want := range []string{"<text>Chapter 1 — Beginnings</text>", "<text>Part One</text>", "<text>Chapter 2 — Middles</text>", "<text>Chapter 3 — Ends</text>"} {
+		if !strings.Contains(ncx, want) {
+			t.Errorf("NCX doesn't contain %q:\n%s", want, ncx)
+		}
+	}
+	if c := zipFile(t, book, "OPS/xhtml/c1.xhtml"); !strings.Contains(c, `<h1 class="ch">Chapter 1 — Beginnings</h1>`) {
+		t.Errorf("heading wasn't numbered:\n%s", c)
+	}
+	if c := zipFile(t, book, "OPS/xhtml/c3.xhtml"); !strings.Contains(c, "<body>\n<h1>Chapter 3 — Ends</h1>") {
+		t.Errorf("heading wasn't added:\n%s", c)
+	}
+
+	e.SetChapterNumbering(&ChapterNumbering{Format: "%d%%: %s", RestartPerPart: true})
+	if l, _ := e.ChapterLabel(id2); l != "1%: Middles" {
+		t.Errorf("ChapterLabel() restarting per part = %q, want 1%%: Middles", l)
+	}
+	if _, ok := e.ChapterLabel("nope"); ok {
+		t.Errorf("ChapterLabel() of a missing file succeeded")
+	}
+}
+
+func TestSetPageStamps(t *testing.T) {
+	e := New()
+	e.SetTitle("Comic & Co")
+	e.SetFixedLayout(true)
+	if err := e.SetPageStamps(PageStamp{Text: "x", Position: StampPosition(42)}); err == nil {
+		t.Errorf("SetPageStamps accepted an invalid position")
+	}
+	if _, err := e.AddImagePage("images/p1.png", testPNG(t, 10, 10), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetPageStamps(PageStamp{Text: "%s", Position: StampTopCenter, Class: "head"}, PageStamp{Text: "Page %d", Position: StampBottomRight}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddImagePage("images/p2.png", testPNG(t, 10, 10), ""); err != nil {
+		t.Fatal(err)
+	}
+	e.SetPageStamps()
+	if _, err := e.AddImagePage("images/p3.png", testPNG(t, 10, 10), ""); err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := zipFile(t, book, "OPS/images/p1.xhtml"); strings.Contains(p, "stamp") {
+		t.Errorf("page stamped before SetPageStamps:\n%s", p)
+	}
+	p2 := zipFile(t, book, "OPS/images/p2.xhtml")
+	for _, want := range []string{`<div class="stamp head" style="top: 2%; left: 0; right: 0; text-align: center;">Comic &amp; Co</div>`, `>Page 2</div>`, ".stamp { position: absolute;"} {
+		if !strings.Contains(p2, want) {
+			t.Errorf("stamped page doesn't contain %q:\n%s", want, p2)
+		}
+	}
+	if p := zipFile(t, book, "OPS/images/p3.xhtml"); strings.Contains(p, "stamp") {
+		t.Errorf("page stamped after stamps were cleared:\n%s", p)
+	}
+}
+
+func TestSetMetadataOrder(t *testing.T) {
+	build := func(o MetadataOrder) string {
+		e := New()
+		e.SetMetadataOrder(o)
+		e.AddPublisher("Pub")
+		e.AddAuthor("Author")
+		e.AddLanguage("en")
+		e.SetTitle("Title")
+		e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>"))
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zipFile(t, b, "OPS/content.opf")
+	}
+	order := func(opf string) []string {
+		var got []string
+		for _, m := range regexp.MustCompile(`<dc:(\w+)`).FindAllStringSubmatch(opf, -1) {
+			got = append(got, m[1])
+		}
+		return got
+	}
+	if got, want := order(build(MetadataStandard)), []string{"identifier", "title", "language", "creator", "publisher"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("standard order = %v, want %v", got, want)
+	}
+	if got, want := order(build(MetadataInsertion)), []string{"identifier", "publisher", "creator", "language", "title"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("insertion order = %v, want %v", got, want)
+	}
+}
+
+func TestSetMetadataStyle(t *testing.T) {
+	e := New()
+	e.SetTitle("  the lord  Of the RINGS:   the fellowship of the ring. ")
+	e.AddLanguage("en")
+	e.AddSubject("Fantasy Fiction.")
+	e.AddSubject("Stories I'm fond of, from the UK")
+	e.AddDescription("Unchanged  description.")
+	e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>"))
+	if err := e.SetMetadataStyle("dc:nonsense", &MetadataStyle{}); err == nil {
+		t.Errorf("SetMetadataStyle(dc:nonsense) succeeded")
+	}
+	if err := e.SetMetadataStyle("dc:title", &MetadataStyle{Case: CaseTitle, TrimPeriod: true, CollapseSpace: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetMetadataStyle("dc:subject", &MetadataStyle{Case: CaseSentence, TrimPeriod: true}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/content.opf")
+	for _, want := range []string{
+		">The Lord of the RINGS: The Fellowship of the Ring</dc:title>",
+		">Fantasy fiction</dc:subject>",
+		">Stories I'm fond of, from the UK</dc:subject>",
+		">Unchanged  description.</dc:description>",
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document doesn't contain %q:\n%s", want, opf)
+		}
+	}
+	if e.title != "  the lord  Of the RINGS:   the fellowship of the ring. " {
+		t.Errorf("SetMetadataStyle changed the book's title to %q", e.title)
+	}
+
+	e.SetMetadataStyle("dc:title", nil)
+	b, err = e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/content.opf"); !strings.Contains(opf, ">  the lord  Of the RINGS:") {
+		t.Errorf("title still styled after removing its policy:\n%s", opf)
+	}
+}
+
+func TestSetHyphenation(t *testing.T) {
+	// The patterns Liang's thesis uses to hyphenate "hyphenation".
+	const patterns = `% Liang's example
+\patterns{hy3ph he2n hena4 hen5at 1na n2at 1tio 2io o2n}
+\hyphenation{ta-ble}`
+	h, err := NewPatternHyphenator(patterns, "pro-ject", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for word, want := range map[string][]int{"hyphenation": {2, 6}, "Hyphenation": {2, 6}, "table": {2}, "Project": {3}, "hyphen": {2}, "hyp": nil} {
+		if got := h.Hyphenate(word); !reflect.DeepEqual(got, want) {
+			t.Errorf("Hyphenate(%q) = %v, want %v", word, got, want)
+		}
+	}
+	if _, err := NewPatternHyphenator("% nothing", "", 2, 3); err == nil {
+		t.Errorf("NewPatternHyphenator succeeded with no patterns")
+	}
+
+	e := simpleBook(t)
+	if err := e.SetHyphenation("en", h); err != nil {
+		t.Fatal(err)
+	}
+	body := `<p class="hyphenation">Hyphenation &amp; table<br/>hyphenation2 hyph` + "\u00ad" + `enation</p><pre>hyphenation</pre><p>table</p>`
+	src := xhtmlPage("Hyphenation", body)
+	e.AddXHTML("b.xhtml", src)
+	e.AddXHTML("c.xhtml", strings.Replace(src, "<html ", `<html xml:lang="fr" `, 1))
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sh = "\u00ad"
+	want := `<p class="hyphenation">Hy` + sh + `phen` + sh + `ation &amp; ta` + sh + `ble<br/>hyphenation2 hyph` + sh + `enation</p><pre>hyphenation</pre><p>ta` + sh + `ble</p>`
+	if got := zipFile(t, book, "OPS/b.xhtml"); !strings.Contains(got, want) || !strings.Contains(got, "<title>Hyphenation</title>") {
+		t.Errorf("hyphenated file is\n%s\nwant it to contain\n%s", got, want)
+	}
+	if got := zipFile(t, book, "OPS/c.xhtml"); strings.Contains(got, "ta"+sh) {
+		t.Errorf("French file was hyphenated:\n%s", got)
+	}
+	if strings.Contains(string(e.xhtml[1].contents), sh+"phen") {
+		t.Errorf("hyphenation changed the book's copy of the file")
+	}
+}
+
+func TestSetXMLIndent(t *testing.T) {
+	e := simpleBook(t)
+	e.SetTitle("Salt & Pepper")
+	e.AddNavpoint("Q&A", "a.xhtml", 1)
+	if err := e.SetXMLIndent("x"); err == nil {
+		t.Errorf("SetXMLIndent(%q) succeeded, want error", "x")
+	}
+	if err := e.SetXMLIndent("\t"); err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.SerializeV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/book.opf")
+	for _, want := range []string{"\n\t<metadata xmlns:dc=", ">Salt &amp; Pepper</dc:title>\n\t\t<dc:language", "\n\t\t<item id="} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document doesn't contain %q:\n%s", want, opf)
+		}
+	}
+	nav := zipFile(t, book, "OPS/__toc.xhtml")
+	if want := "\t\t\t\t<a href=\"a.xhtml\">Q&amp;A</a>\n"; !strings.Contains(nav, want) {
+		t.Errorf("nav document doesn't contain %q:\n%s", want, nav)
+	}
+	for name, f := range map[string]string{"OPS/book.opf": opf, "OPS/__toc.xhtml": nav} {
+		d := xml.NewDecoder(strings.NewReader(f))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%v isn't well-formed: %v", name, err)
+				break
+			}
+		}
+	}
+
+	e.SetXMLIndent("")
+	ncx, err := e.RenderNCX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ncx, []byte("\n")) {
+		t.Errorf("compact NCX has line breaks:\n%s", ncx)
+	}
+	if want := "<navLabel><text>Q&amp;A</text></navLabel>"; !bytes.Contains(ncx, []byte(want)) {
+		t.Errorf("compact NCX doesn't contain %q:\n%s", want, ncx)
+	}
+}
+
+func TestXMLEscaping(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetNCX(true)
+	e.AddPublisher("Fish &amp; Chips")
+	e.AddDescription("Salt & <i>pepper</i>")
+	e.AddNavpoint("Q&A", "a.xhtml", 1)
+	e.AddPageTarget(`"1"`, "a.xhtml#p1")
+	id, _ := e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>B</p>"))
+	e.SetLandmark(id, LandmarkColophon, "Notes & Queries")
+	e.AddPackageAttribute("prefix", `a: "b"`)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]string{
+		"OPS/book.opf":    {"<dc:publisher id=\"id4\">Fish &amp; Chips</dc:publisher>", "Salt &amp; &lt;i>pepper&lt;/i>", `prefix="a: &#34;b&#34;"`, `title="Notes &amp; Queries"`},
+		"OPS/toc.ncx":     {"<text>Q&amp;A</text>", `<text>"1"</text>`},
+		"OPS/__toc.xhtml": {">Q&amp;A</a>", ">Notes &amp; Queries</a>"},
+	}
+	for name, wants := range files {
+		f := zipFile(t, b, name)
+		for _, want := range wants {
+			if !strings.Contains(f, want) {
+				t.Errorf("%v doesn't contain %q:\n%s", name, want, f)
+			}
+		}
+		d := xml.NewDecoder(strings.NewReader(f))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%v isn't well-formed: %v", name, err)
+				break
+			}
+		}
+	}
+}
+
+func TestRegisterMediaType(t *testing.T) {
+	t.Cleanup(func() {
+		mediaTypesMu.Lock()
+		delete(mediaTypes, ".xpgt")
+		delete(mediaTypes, ".flac")
+		mediaTypesMu.Unlock()
+	})
+	e := simpleBook(t)
+	if _, err := e.AddResource("templates/page.xpgt", []byte("<template/>")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("AddResource() = %v for an unregistered type, want ErrUnsupportedFormat", err)
+	}
+	if err := RegisterMediaType(".xpgt", "application/vnd.adobe-page-template+xml", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterMediaType(".flac", "audio/flac", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ ext, mt string }{{"xpgt", "a/b"}, {".x", "nope"}, {".x", "a/"}} {
+		if err := RegisterMediaType(c.ext, c.mt, false); err == nil {
+			t.Errorf("RegisterMediaType(%q, %q) succeeded", c.ext, c.mt)
+		}
+	}
+	if mt, core, ok := LookupMediaType("A.PLS"); mt != "application/pls+xml" || !core || !ok {
+		t.Errorf("LookupMediaType(A.PLS) = %q, %v, %v", mt, core, ok)
+	}
+
+	id, err := e.AddResource("templates/page.xpgt", []byte("<template/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddAudio("audio/a.flac", []byte("flac")); err != nil {
+		t.Errorf("AddAudio() = %v for a registered audio type", err)
+	}
+	if _, err := e.AddResource("images/a.png", testPNG(t, 2, 2)); err == nil {
+		t.Errorf("AddResource accepted an image")
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/content.opf")
+	for _, want := range []string{
+		`<item id="` + string(id) + `" href="templates/page.xpgt" media-type="application/vnd.adobe-page-template+xml" />`,
+		`href="audio/a.flac" media-type="audio/flac"`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document lacks %s:\n%s", want, opf)
+		}
+	}
+	if w := e.Warnings(); len(w) != 2 || !strings.Contains(w[0], "page.xpgt") {
+		t.Errorf("Warnings() = %q, want warnings for the two foreign files", w)
+	}
+}
+
+func TestSetContentProfile(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<section epub:type="chapter"><p>B</p></section>`)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := e.AddXHTML("c.xhtml", "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>C</title></head><body><p>C</p></body></html>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetFileContentProfile(c, ProfileXHTML11); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetFileContentProfile("nope", ProfileXHTML11); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetFileContentProfile(nope) = %v, want ErrNotFound", err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zipFile(t, book, "OPS/b.xhtml"); !strings.Contains(got, "<!DOCTYPE html>") || !strings.Contains(got, `xmlns:epub="http://www.idpf.org/2007/ops"`) {
+		t.Errorf("b.xhtml isn't XHTML5:\n%s", got)
+	}
+	if got := zipFile(t, book, "OPS/c.xhtml"); !strings.Contains(got, xhtml11Doctype) {
+		t.Errorf("c.xhtml isn't XHTML 1.1:\n%s", got)
+	}
+	if w := e.Warnings(); len(w) != 1 || !strings.Contains(w[0], "c.xhtml is written as XHTML 1.1") {
+		t.Errorf("Warnings() = %q, want one for c.xhtml", w)
+	}
+
+	e.SetVersion(2)
+	e.SetContentProfile(ProfileXHTML11)
+	if w := e.Warnings(); len(w) != 2 || !strings.Contains(w[0], "section element") || !strings.Contains(w[1], "epub: attributes") {
+		t.Errorf("Warnings() = %q, want warnings for b.xhtml's HTML5 markup", w)
+	}
+	if p := e.XHTMLPage("T", "<p/>"); !strings.Contains(p, xhtml11Doctype) {
+		t.Errorf("XHTMLPage() = %s, want an XHTML 1.1 page", p)
+	}
+	e.SetContentProfile(ProfileXHTML5)
+	if p := e.XHTMLPage("T", "<p/>"); !strings.Contains(p, "<!DOCTYPE html>") {
+		t.Errorf("XHTMLPage() = %s, want an XHTML5 page", p)
+	}
+}
+
+// TestContentProfileV2PassThrough pins the v2 output of ProfileAuto:
+// files are written as they were given, as they were before content
+// profiles existed.
+func TestContentProfileV2PassThrough(t *testing.T) {
+	e := simpleBook(t)
+	page := "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>B</title></head><body><p><img src=\"a.png\" alt=\"\" /></p></body></html>"
+	if _, err := e.AddXHTML("b.xhtml", page); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	e.SetWarningHandler(func(w Warning) {
+		if strings.Contains(w.Message, "DOCTYPE") {
+			warnings = append(warnings, w.String())
+		}
+	})
+	book, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zipFile(t, book, "OPS/b.xhtml"); got != page {
+		t.Errorf("v2 b.xhtml = %s, want it unchanged:\n%s", got, page)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("DOCTYPE warnings = %q for files passed through unchanged", warnings)
+	}
+
+	warnings = nil
+	e.SetContentProfile(ProfileXHTML11)
+	if book, err = e.SerializeV2(); err != nil {
+		t.Fatal(err)
+	}
+	if got := zipFile(t, book, "OPS/b.xhtml"); !strings.Contains(got, xhtml11Doctype) {
+		t.Errorf("b.xhtml isn't rewritten as XHTML 1.1:\n%s", got)
+	}
+	if want := []string{"b.xhtml: DOCTYPE rewritten for XHTML 1.1"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("DOCTYPE warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	if _, err := e.AddStylesheetWithOptions("css/book.css", "p {}", StyleOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	page, err := e.Fragment("text/notes.xhtml", "Notes", `<h1>Notes</h1><p>One &hellip; & two<br>three<p class=x>four <img src="a.png"></div><ul><li>a<li>b</ul>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<!DOCTYPE html>",
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="en" lang="en">`,
+		"<title>Notes</title>",
+		`<link rel="stylesheet" type="text/css" href="../css/book.css" />`,
+		`<h1>Notes</h1><p>One … &amp; two<br />three</p><p class="x">four <img src="a.png" /></p><ul><li>a</li><li>b</li></ul>`,
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("Fragment() lacks %s:\n%s", want, page)
+		}
+	}
+	if err := xml.Unmarshal(page, new(struct{})); err != nil {
+		t.Errorf("Fragment() isn't well-formed: %v\n%s", err, page)
+	}
+
+	id, err := e.AddFragment("text/notes.xhtml", "Notes", "<p>Notes</p>", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, err := e.findXHTML(id); err != nil || !strings.Contains(string(x.contents), "<p>Notes</p>") || x.order != 5 {
+		t.Errorf("AddFragment() added %+v, %v", x, err)
+	}
+}
+
+func TestSetCompressionCache(t *testing.T) {
+	cache := NewCompressionCache(0)
+	build := func(chapter string) []byte {
+		t.Helper()
+		e := simpleBook(t)
+		e.SetCompressionCache(cache)
+		if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", chapter)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddImage("images/photo.png", testPNG(t, 20, 20)); err != nil {
+			t.Fatal(err)
+		}
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return book
+	}
+
+	first := build("<p>First draft</p>")
+	if cache.hits != 0 || cache.misses != 3 {
+		t.Errorf("first build: %v hits, %v misses; want 0, 3", cache.hits, cache.misses)
+	}
+	second := build("<p>Second draft</p>")
+	if cache.hits != 2 || cache.misses != 4 {
+		t.Errorf("second build: %v hits, %v misses; want 2, 4", cache.hits, cache.misses)
+	}
+	if got := zipFile(t, first, "OPS/b.xhtml"); !strings.Contains(got, "First draft") {
+		t.Errorf("first b.xhtml = %s", got)
+	}
+	if got := zipFile(t, second, "OPS/b.xhtml"); !strings.Contains(got, "Second draft") {
+		t.Errorf("second b.xhtml = %s", got)
+	}
+	if a, b := zipFile(t, first, "OPS/images/photo.png"), zipFile(t, second, "OPS/images/photo.png"); a != b {
+		t.Errorf("cached image differs between builds")
+	}
+
+	small := NewCompressionCache(1)
+	e := simpleBook(t)
+	e.SetCompressionCache(small)
+	if _, err := e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if small.lru.Len() != 0 || small.size != 0 {
+		t.Errorf("cache holds %v entries of %v bytes, over its limit", small.lru.Len(), small.size)
+	}
+}
+
+func TestSetDeflater(t *testing.T) {
+	writers := 0
+	fast := DeflaterFunc(func(w io.Writer) (io.WriteCloser, error) {
+		writers++
+		return flate.NewWriter(w, flate.BestSpeed)
+	})
+	e := simpleBook(t)
+	e.SetDeflater(fast)
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writers == 0 {
+		t.Errorf("Serialize didn't use the deflater")
+	}
+	if got := zipFile(t, book, "OPS/a.xhtml"); !strings.Contains(got, "<p>A</p>") {
+		t.Errorf("a.xhtml = %s", got)
+	}
+
+	writers = 0
+	v2, _, err := e.SerializeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writers == 0 {
+		t.Errorf("SerializeBoth didn't use the deflater")
+	}
+	if got := zipFile(t, v2, "OPS/a.xhtml"); !strings.Contains(got, "<p>A</p>") {
+		t.Errorf("v2 a.xhtml = %s", got)
+	}
+
+	e.SetDeflater(DeflaterFunc(func(w io.Writer) (io.WriteCloser, error) {
+		return nil, errors.New("no deflating today")
+	}))
+	if _, err := e.Serialize(); err == nil {
+		t.Errorf("Serialize with a failing deflater succeeded")
+	}
+}
+
+func TestOutline(t *testing.T) {
+	e := simpleBook(t)
+	b, err := e.AddXHTML("text/b c.xhtml", xhtmlPage("Chapter &  verse", "<p>B</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := e.AddNavpoint("One", "a.xhtml", 1)
+	one.AddNavpoint("One [a]", "a.xhtml#s1", 1)
+	e.AddNavpoint("Two", "text/b c.xhtml", 2)
+
+	md, err := e.Outline(OutlineMarkdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Title
+
+## Table of contents
+
+- [One](a.xhtml)
+  - [One \[a\]](a.xhtml#s1)
+- [Two](text/b%20c.xhtml)
+
+## Reading order
+
+1. [a.xhtml](a.xhtml) A
+2. [text/b c.xhtml](text/b%20c.xhtml) Chapter & verse
+`
+	if string(md) != want {
+		t.Errorf("Outline(OutlineMarkdown) = %s, want %s", md, want)
+	}
+
+	js, err := e.Outline(OutlineJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o BookOutline
+	if err := json.Unmarshal(js, &o); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.TOC) != 2 || len(o.TOC[0].Children) != 1 || o.TOC[0].Children[0].Path != "a.xhtml#s1" {
+		t.Errorf("Outline(OutlineJSON) TOC = %+v", o.TOC)
+	}
+	if len(o.Spine) != 2 || o.Spine[1] != (SpineEntry{ID: b, Path: "text/b c.xhtml", Title: "Chapter & verse"}) {
+		t.Errorf("Outline(OutlineJSON) spine = %+v", o.Spine)
+	}
+	if _, err := e.Outline(OutlineFormat(9)); err == nil {
+		t.Errorf("Outline(9) succeeded")
+	}
+}
+
+func TestImportTOC(t *testing.T) {
+	e := simpleBook(t)
+	for _, p := range []string{"b.xhtml", "c.xhtml"} {
+		if _, err := e.AddXHTML(p, xhtmlPage(p, "<p>X</p>")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.AddNavpoint("Old", "a.xhtml", 1)
+	for _, bad := range []string{
+		`{"toc": [{"label": "One", "path": "a.xhtml"}], "spine": [{"path": "missing.xhtml"}]}`,
+		`{"toc": [{"label": "", "path": "a.xhtml"}]}`,
+		`{"spine": [{"path": "a.xhtml"}, {"path": "a.xhtml"}]}`,
+		`{"tco": []}`,
+		`{"toc": [`,
+	} {
+		if err := e.ImportTOC(strings.NewReader(bad)); err == nil {
+			t.Errorf("ImportTOC(%s) succeeded", bad)
+		}
+	}
+	doc := `{
+  "toc": [
+    {"label": "Start", "path": "c.xhtml", "children": [{"label": "Part", "path": "c.xhtml#p"}]},
+    {"label": "Then", "path": "a.xhtml"}
+  ],
+  "spine": [{"path": "c.xhtml"}, {"id": "xhtml1"}]
+}`
+	if err := e.ImportTOC(strings.NewReader(doc)); err != nil {
+		t.Fatal(err)
+	}
+	md, err := e.Outline(OutlineMarkdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Title
+
+## Table of contents
+
+- [Start](c.xhtml)
+  - [Part](c.xhtml#p)
+- [Then](a.xhtml)
+
+## Reading order
+
+1. [c.xhtml](c.xhtml) c.xhtml
+2. [a.xhtml](a.xhtml) A
+3. [b.xhtml](b.xhtml) b.xhtml
+`
+	if string(md) != want {
+		t.Errorf("Outline after ImportTOC = %s, want %s", md, want)
+	}
+}
+
+func TestSetEduProfile(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.SetEduProfile(&EduProfile{Edition: TeacherEdition}); err == nil {
+		t.Errorf("SetEduProfile accepted a teacher's edition without a student edition")
+	}
+	p := &EduProfile{
+		Edition:        TeacherEdition,
+		StudentEdition: "urn:isbn:9780000000001",
+		Level:          "Grade 7",
+		Objectives:     []LearningObjective{{Text: "Compute unit rates", Framework: "Common Core", Code: "CCSS.MATH.CONTENT.7.RP.A.1"}},
+	}
+	if err := e.SetEduProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Validate(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Validate() = %v for a v2 EDUPUB book, want ErrUnsupportedVersion", err)
+	}
+	e.SetVersion(3)
+	err := e.Validate()
+	if !errors.Is(err, ErrProfile) {
+		t.Fatalf("Validate() = %v, want ErrProfile", err)
+	}
+	for _, want := range []string{"no table of contents", "no bodymatter landmark", "a.xhtml has no structural semantics"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to mention %q", err, want)
+		}
+	}
+
+	ch, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<section epub:type="chapter"><h1>B</h1></section>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddNavpoint("B", "b.xhtml", 1)
+	if err := e.SetLandmark(ch, LandmarkBodyMatter, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetLandmark("xhtml1", LandmarkTitlePage, ""); err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/book.opf")
+	for _, want := range []string{
+		"<dc:type>edupub</dc:type>",
+		"<dc:type>teacher-edition</dc:type>",
+		"<dc:source>urn:isbn:9780000000001</dc:source>",
+		`<meta property="schema:educationalLevel">Grade 7</meta>`,
+		`<meta property="schema:teaches" id="objective1">Compute unit rates</meta>`,
+		`<meta refines="#objective1" property="schema:codeValue">CCSS.MATH.CONTENT.7.RP.A.1</meta>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document lacks %s:\n%s", want, opf)
+		}
+	}
+}
+
+func TestWriteHooks(t *testing.T) {
+	e := simpleBook(t)
+	calls := 0
+	e.OnBeforeWrite(func(b *EPub) error {
+		calls++
+		b.SetTitle("Final Title")
+		return nil
+	})
+	e.OnResourceWrite(func(path string, data []byte) ([]byte, error) {
+		if !strings.HasSuffix(path, ".xhtml") {
+			return data, nil
+		}
+		return bytes.Replace(data, []byte("</body>"), []byte("<script src=\"stats.js\"></script></body>"), 1), nil
+	})
+	e.OnResourceWrite(func(path string, data []byte) ([]byte, error) {
+		return bytes.Replace(data, []byte("stats.js"), []byte("analytics.js"), 1), nil
+	})
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("OnBeforeWrite hook called %v times, want 1", calls)
+	}
+	if opf := zipFile(t, book, "OPS/content.opf"); !strings.Contains(opf, "Final Title") {
+		t.Errorf("OnBeforeWrite hook's change not written:\n%s", opf)
+	}
+	if x := zipFile(t, book, "OPS/a.xhtml"); !strings.Contains(x, `<script src="analytics.js"></script></body>`) {
+		t.Errorf("OnResourceWrite hooks not applied in order:\n%s", x)
+	}
+	if strings.Contains(string(e.xhtml[0].contents), "script") {
+		t.Errorf("OnResourceWrite hook changed the book's own copy of a.xhtml")
+	}
+
+	if _, _, err := e.SerializeBoth(); err != nil || calls != 2 {
+		t.Errorf("SerializeBoth() = %v, with %v hook calls; want 2", err, calls)
+	}
+	e.OnResourceWrite(func(path string, data []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+	var re *ResourceError
+	if _, err := e.Serialize(); !errors.As(err, &re) || re.Op != "transform" {
+		t.Errorf("Serialize() = %v, want a transform ResourceError", err)
+	}
+	e.OnBeforeWrite(func(*EPub) error { return errors.New("stop") })
+	if _, err := e.Serialize(); err == nil || err.Error() != "stop" {
+		t.Errorf("Serialize() = %v, want the OnBeforeWrite hook's error", err)
+	}
+}
+
+// FuzzSetters feeds hostile strings into the setters whose values end
+// up in the book's markup, and checks that every XML file in the
+// written book is still well-formed.
+func FuzzSetters(f *testing.F) {
+	for _, s := range []string{`"`, `'`, `<`, `>`, `&`, `&amp;`, `"><script>x</script>`, `' onload='x`, "a\tb\nc\rd", "\x00\x01\x1f", "\xff\xfe", "￾", "]]>", `<!--`} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		e := simpleBook(t)
+		e.SetTitle(s)
+		e.AddAuthor(s)
+		e.AddSubject(s)
+		if err := e.AddPackageAttribute("data-fuzz", s); err != nil {
+			t.Fatal(err)
+		}
+		p, err := e.AddImage("p.png", testPNG(t, 2, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetAltText(p, "Alt "+s); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddStylesheetWithOptions("s.css", "p { color: red; }", StyleOptions{Title: s, Media: s}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetPageStamps(PageStamp{Text: "%d", Position: StampTopLeft, Class: s}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddImagePage("page.png", testPNG(t, 2, 2), "Page"); err != nil {
+			t.Fatal(err)
+		}
+		v, err := e.AddVideo("v.mp4", []byte("video"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := e.AddTextTrack("t.vtt", "WEBVTT\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.AddVideoTrack(v, tr, "captions", s, s); err != nil {
+			t.Fatal(err)
+		}
+		video, err := e.VideoMarkup(v, "b.xhtml", "No video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<p><img src="p.png" alt="" /></p>`+video, "s.css"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.AddNavpoint(s, "a.xhtml", 1).AddNavpoint(s, "b.xhtml", 1)
+		if err := e.SetLandmark(b, LandmarkBodyMatter, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetChapterMetadata(b, ChapterMetadata{Authors: []string{s}, Source: s}); err != nil {
+			t.Fatal(err)
+		}
+		for _, version := range []float64{2, 3} {
+			if err := e.SetVersion(version); err != nil {
+				t.Fatal(err)
+			}
+			book, err := e.Serialize()
+			if err != nil {
+				t.Fatalf("v%v: %v", version, err)
+			}
+			z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, zf := range z.File {
+				switch path.Ext(zf.Name) {
+				case ".opf", ".ncx", ".xhtml", ".xml":
+				default:
+					continue
+				}
+				r, err := zf.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				d := xml.NewDecoder(r)
+				for {
+					if _, err = d.Token(); err != nil {
+						break
+					}
+				}
+				r.Close()
+				if err != io.EOF {
+					t.Errorf("v%v: %v isn't well-formed with %q: %v", version, zf.Name, s, err)
+				}
+			}
+		}
+	})
+}
+
+// FuzzPrepareXHTML checks that the fixes made to XHTML files as
+// they're written can't panic or hang on malformed markup, and don't
+// modify the original contents.
+func FuzzPrepareXHTML(f *testing.F) {
+	for _, s := range []string{
+		xhtmlPage("A", "<h1>A</h1><p><img src='p.png' alt=''/></p>"),
+		profilePage(ProfileXHTML5, "A", `<section epub:type="chapter"><h2>B</h2><script>x()</script></section>`),
+		`<?xml version="1.0"?><!DOCTYPE html><html><head></head><body onload="x()"><h1 id="a">A</h1></body></html>`,
+		`<html><body><h1>`,
+		`<!DOCTYPE html PUBLIC "`,
+		`</head></body></html><head><body>`,
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		e := simpleBook(t)
+		e.SetPropagateLanguage(true)
+		e.SetStripScripts(true)
+		e.SetNavLinks(&NavLinks{Header: true, Footer: true})
+		e.SetDRMFree(true)
+		e.SetHeadingIDs(Slug)
+		h, err := NewPatternHyphenator("hy3ph he2n 1na n2at 1tio", "", 2, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetHyphenation("en", h); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetChapterNumbering(&ChapterNumbering{Format: "%d. ", Headings: true}); err != nil {
+			t.Fatal(err)
+		}
+		p, err := e.AddImage("p.png", testPNG(t, 2, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetAltText(p, "Alt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddStylesheet("s.css", "p { color: red; }"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddJavaScript("s.js", "var a;"); err != nil {
+			t.Fatal(err)
+		}
+		id, err := e.AddXHTML("b.xhtml", s)
+		if err != nil {
+			return
+		}
+		e.AddNavpoint("B", "b.xhtml", 2)
+		x, err := e.findXHTML(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, version := range []float64{2, 3} {
+			for _, profile := range []ContentProfile{ProfileAuto, ProfileXHTML11, ProfileXHTML5} {
+				e.SetContentProfile(profile)
+				e.prepareXHTML(*x, version)
+				if string(x.contents) != s {
+					t.Fatalf("prepareXHTML(%q) modified its input", s)
+				}
+			}
+		}
+	})
+}
+
+func TestAddLink(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetTitle("Book Two")
+	for _, tc := range []struct{ rel, href string }{
+		{"next", "https://example.com/"},
+		{"", "https://example.com/"},
+		{RelNext, "/books/3"},
+	} {
+		if err := e.AddLink(tc.rel, tc.href, ""); err == nil {
+			t.Errorf("AddLink(%q, %q) succeeded", tc.rel, tc.href)
+		}
+	}
+	if err := e.AddLink(RelAcquisition, "https://example.com/buy?a=1&b=2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddLink(RelPreview, "https://example.com/trailer.mp4", "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddAlsoByPage("A. Writer", nil, 100); err == nil {
+		t.Errorf("AddAlsoByPage with no catalog succeeded")
+	}
+	if _, err := e.AddAlsoByPage("A. Writer", []CatalogEntry{
+		{Title: "Stand Alone"},
+		{Title: "Book Three", Series: "Trilogy", Position: "3"},
+		{Title: "Book Two", Series: "Trilogy", Position: "2"},
+		{Title: "Book One", Series: "Trilogy", Position: "1", Href: "https://example.com/one"},
+	}, 100); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	for _, want := range []string{
+		`<link rel="http://opds-spec.org/acquisition" href="https://example.com/buy?a=1&amp;b=2" />`,
+		`<link rel="http://opds-spec.org/acquisition/sample" href="https://example.com/trailer.mp4" media-type="video/mp4" />`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document doesn't contain %q:\n%s", want, opf)
+		}
+	}
+	page := zipFile(t, b, "OPS/xhtml/alsoby.xhtml")
+	want := []string{"Also by A. Writer", "Trilogy", `<a href="https://example.com/one">Book One</a>`, "Book Three", "Stand Alone"}
+	last := -1
+	for _, w := range want {
+		i := strings.Index(page, w)
+		if i <= last {
+			t.Errorf("%q missing or out of order in:\n%s", w, page)
+		}
+		last = i
+	}
+	if strings.Contains(page, "Book Two") {
+		t.Errorf("Also by page lists the book itself:\n%s", page)
+	}
+}
+
+func TestAddArtist(t *testing.T) {
+	e := simpleBook(t)
+	e.AddArtist("Ann Artist")
+	if err := e.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []float64{2, 3} {
+		e.SetVersion(v)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opf := "OPS/content.opf"
+		if v == 3 {
+			opf = "OPS/book.opf"
+		}
+		got := zipFile(t, b, opf)
+		wantContains(t, fmt.Sprintf("v%v package document", v), got, ">Ann Artist</dc:creator>")
+		if !regexp.MustCompile(`(opf:role="art"[^>]*>Ann Artist<|>Ann Artist</dc:creator>\s*<meta [^>]*property="role"[^>]*>art</meta>)`).MatchString(got) {
+			t.Errorf("v%v package document doesn't give Ann Artist the art role:\n%s", v, got)
+		}
+	}
+}
+
+func TestSetSet(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.SetSet("Collected Works"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetSet("Other Works"); err == nil {
+		t.Errorf("SetSet succeeded twice")
+	}
+	if err := e.SetEntryNumber("2"); err != nil {
+		t.Fatal(err)
+	}
+	e.SetVersion(3)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "book.opf", zipFile(t, b, "OPS/book.opf"), `property="belongs-to-collection" id="seriesinfo">Collected Works</meta>`, `>set</meta>`, `>2</meta>`)
+
+	e.SetVersion(2)
+	if b, err = e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/content.opf"); strings.Contains(opf, "Collected Works") {
+		t.Errorf("v2 package document has the set name:\n%s", opf)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s := NewSeries("Trilogy", "A. Writer")
+	s.Languages = []string{"en"}
+	css, err := s.AddStylesheetWithOptions("css/series.css", "p { margin: 0; }", StyleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Volume("", "x"); err == nil {
+		t.Errorf("Volume with entry x succeeded")
+	}
+	var uuids []string
+	for i, title := range []string{"Book One", "Book Two"} {
+		e, err := s.Volume(title, fmt.Sprint(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.AddXHTML("a.xhtml", xhtmlPage(title, "<p>A</p>")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opf := zipFile(t, b, "OPS/book.opf")
+		for _, want := range []string{
+			">" + title + "</dc:title>",
+			">A. Writer</dc:creator>",
+			`>Trilogy</meta>`,
+			`<item id="` + string(css) + `" href="css/series.css"`,
+		} {
+			if !strings.Contains(opf, want) {
+				t.Errorf("%v package document doesn't contain %q:\n%s", title, want, opf)
+			}
+		}
+		if page := zipFile(t, b, "OPS/a.xhtml"); !strings.Contains(page, "css/series.css") {
+			t.Errorf("%v page doesn't link the series stylesheet:\n%s", title, page)
+		}
+		uuids = append(uuids, e.UUID())
+	}
+	if uuids[0] == uuids[1] {
+		t.Errorf("volumes have the same UUID %v", uuids[0])
+	}
+	if _, err := s.Volume("Book Two Again", "2"); err == nil {
+		t.Errorf("Volume reusing entry 2 succeeded")
+	}
+	if _, err := s.AddFont("late.otf", nil); err == nil {
+		t.Errorf("AddFont after volumes succeeded")
+	}
+	again := NewSeries("Trilogy")
+	e, err := again.Volume("Book One", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.UUID() != uuids[0] {
+		t.Errorf("rebuilt volume UUID = %v, want %v", e.UUID(), uuids[0])
+	}
+	if got := s.Catalog(); len(got) != 2 || got[1].Title != "Book Two" || got[1].Position != "2" {
+		t.Errorf("Catalog() = %+v", got)
+	}
+}
+
+func TestCheckSemanticType(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{string(TypeChapter), ""},
+		{"bodymatter  chapter z3998:fiction", ""},
+		{"chaptre", `unknown epub:type "chaptre"; did you mean "chapter"?`},
+		{"Footnote", `unknown epub:type "Footnote"; did you mean "footnote"?`},
+		{"chapter xyzzyx", `unknown epub:type "xyzzyx"`},
+	} {
+		err := CheckSemanticType(tc.value)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("CheckSemanticType(%q) = %v", tc.value, err)
+		case tc.want != "" && (!errors.Is(err, ErrUnknownSemanticType) || err.Error() != tc.want):
+			t.Errorf("CheckSemanticType(%q) = %v, want %v", tc.value, err, tc.want)
+		}
+	}
+
+	e := simpleBook(t)
+	e.SetVersion(3)
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<section epub:type="chaptre"><p>B</p></section>`)); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.Warnings(); len(w) != 1 || !strings.Contains(w[0], `b.xhtml: unknown epub:type "chaptre"`) {
+		t.Errorf("Warnings() = %q", w)
+	}
+	if _, err := e.Serialize(); err != nil {
+		t.Errorf("Serialize() = %v, want success outside strict mode", err)
+	}
+	e.SetStrict(true)
+	if _, err := e.Serialize(); !errors.Is(err, ErrUnknownSemanticType) {
+		t.Errorf("Serialize() in strict mode = %v, want ErrUnknownSemanticType", err)
+	}
+}
+
+func TestAddFiles(t *testing.T) {
+	dir := t.TempDir()
+	e := simpleBook(t)
+	e.SetVersion(3)
+	for _, c := range []struct {
+		dest      string
+		contents  []byte
+		add       func(source, dest string) (Id, error)
+		mediaType string
+	}{
+		{"css/book.css", []byte("p { margin: 0; }"), e.AddStylesheetFile, "text/css"},
+		{"js/book.js", []byte("var x = 1;"), e.AddJavaScriptFile, "application/javascript"},
+		{"fonts/book.otf", testFont("Book", "Regular", 400, false), e.AddFontFile, "application/opentype"},
+		{"audio/a.mp3", []byte("audio"), e.AddAudioFile, "audio/mpeg"},
+		{"video/v.mp4", []byte("video"), e.AddVideoFile, "video/mp4"},
+		{"data/a.pls", []byte("<lexicon/>"), e.AddResourceFile, "application/pls+xml"},
+	} {
+		src := dir + "/" + path.Base(c.dest)
+		if err := os.WriteFile(src, c.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		id, err := c.add(src, c.dest)
+		if err != nil {
+			t.Fatalf("adding %v: %v", c.dest, err)
+		}
+		if _, ok := e.ModTime(id); !ok {
+			t.Errorf("%v has no modification time", c.dest)
+		}
+		if _, err := c.add(dir+"/missing", "missing/"+c.dest); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("adding missing %v = %v, want fs.ErrNotExist", c.dest, err)
+		}
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := zipFile(t, b, "OPS/"+c.dest); got != string(c.contents) {
+			t.Errorf("%v = %q, want %q", c.dest, got, c.contents)
+		}
+		wantContains(t, "book.opf", zipFile(t, b, "OPS/book.opf"), `href="`+c.dest+`" media-type="`+c.mediaType+`"`)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	dir := t.TempDir()
+	src := dir + "/b.xhtml"
+	if err := os.WriteFile(src, []byte(xhtmlPage("B", "<p>B</p>")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(src, then, then); err != nil {
+		t.Fatal(err)
+	}
+	e := simpleBook(t)
+	id, err := e.AddXHTMLFile(src, "b.xhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.ModTime(id); !ok || !got.Equal(then) {
+		t.Errorf("ModTime(%v) = %v, %v; want %v", id, got, ok, then)
+	}
+	if _, ok := e.LastModified(); ok {
+		t.Errorf("LastModified() reports every resource has a time, but a.xhtml has none")
+	}
+	if err := e.SetModTime("nope", then); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetModTime(nope) = %v, want ErrNotFound", err)
+	}
+
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if f.Name == "OPS/b.xhtml" && !f.Modified.Equal(then) {
+			t.Errorf("b.xhtml zip entry modified at %v, want %v", f.Modified, then)
+		}
+	}
+
+	name := dir + "/book.epub"
+	if wrote, err := e.WriteIfChanged(name); err != nil || !wrote {
+		t.Fatalf("first WriteIfChanged() = %v, %v; want true", wrote, err)
+	}
+	if wrote, err := e.WriteIfChanged(name); err != nil || !wrote {
+		t.Errorf("WriteIfChanged() with an undated resource = %v, %v; want true", wrote, err)
+	}
+	for _, r := range e.manifestIDs() {
+		e.SetModTime(r, then)
+	}
+	if wrote, err := e.WriteIfChanged(name); err != nil || wrote {
+		t.Errorf("WriteIfChanged() of an unchanged book = %v, %v; want false", wrote, err)
+	}
+	e.SetModTime(id, time.Now().Add(time.Hour))
+	if wrote, err := e.WriteIfChanged(name); err != nil || !wrote {
+		t.Errorf("WriteIfChanged() after a change = %v, %v; want true", wrote, err)
+	}
+}
+
+func TestSetPreload(t *testing.T) {
+	e := New()
+	e.SetTitle("Title")
+	e.AddLanguage("en")
+	cover, err := e.AddImage("cover.png", testPNG(t, 4, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetCoverImage(cover)
+	for _, name := range []string{"one.png", "two.png"} {
+		if _, err := e.AddImage(name, testPNG(t, 2, len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.AddXHTML("a.xhtml", xhtmlPage("A", `<p><img src="one.png" alt="" /> <a href="b.xhtml">B</a></p>`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddXHTML("b.xhtml", xhtmlPage("B", `<p><img src="two.png" alt="" /></p>`)); err != nil {
+		t.Fatal(err)
+	}
+	order := func() []string {
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range z.File {
+			names = append(names, path.Base(f.Name))
+		}
+		return names
+	}
+	want := []string{"mimetype", "container.xml", "content.opf", "toc.ncx", "cover.png", "a.xhtml", "b.xhtml", "one.png", "two.png"}
+	if got := order(); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries without preloading = %v, want %v", got, want)
+	}
+	e.SetPreload(1)
+	want = []string{"mimetype", "container.xml", "content.opf", "cover.png", "a.xhtml", "one.png", "toc.ncx", "b.xhtml", "two.png"}
+	if got := order(); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries preloading one page = %v, want %v", got, want)
+	}
+}
+
+func TestAddAnnotations(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	a := e.xhtml[0].id
+	for _, n := range []Annotation{
+		{Target: "nope", Body: "Note"},
+		{Target: a},
+		{Target: a, Body: "Note", Motivation: "musing"},
+		{Target: a, Body: "Note", Format: "text/markdown"},
+	} {
+		if _, err := e.AddAnnotations("notes.jsonld", "", []Annotation{n}); err == nil {
+			t.Errorf("AddAnnotations(%+v) succeeded", n)
+		}
+	}
+	if _, err := e.AddAnnotations("notes/study.jsonld", "Study notes", []Annotation{
+		{Target: a, Fragment: "p1", Body: "Compare chapter 3.", Creator: "A. Editor"},
+		{Target: a, Body: "<p>Written in exile.</p>", Format: "text/html", Motivation: "describing"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.Warnings(); len(w) != 0 {
+		t.Errorf("Warnings() = %q", w)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	want := `<link rel="http://www.w3.org/ns/oa#AnnotationCollection" href="notes/study.jsonld" media-type="application/ld+json; profile=&#34;http://www.w3.org/ns/anno.jsonld&#34;" />`
+	if !strings.Contains(opf, want) {
+		t.Errorf("package document doesn't contain %q:\n%s", want, opf)
+	}
+	var c struct {
+		Type  string `json:"type"`
+		Label string `json:"label"`
+		First struct {
+			Items []struct {
+				Motivation string `json:"motivation"`
+				Target     string `json:"target"`
+				Body       struct {
+					Value  string `json:"value"`
+					Format string `json:"format"`
+				} `json:"body"`
+			} `json:"items"`
+		} `json:"first"`
+	}
+	if err := json.Unmarshal([]byte(zipFile(t, b, "OPS/notes/study.jsonld")), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Type != "AnnotationCollection" || c.Label != "Study notes" || len(c.First.Items) != 2 {
+		t.Fatalf("annotations = %+v", c)
+	}
+	if got := c.First.Items[0]; got.Target != "../a.xhtml#p1" || got.Motivation != "commenting" || got.Body.Format != "text/plain" {
+		t.Errorf("first annotation = %+v", got)
+	}
+	if got := c.First.Items[1]; got.Target != "../a.xhtml" || got.Body.Value != "<p>Written in exile.</p>" {
+		t.Errorf("second annotation = %+v", got)
+	}
+}
+
+func TestSerializeLargePrint(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.AddStylesheet("css/main.css", "p { font-size: 11pt; text-align: justify; margin: 0 }\nh1 { font-size: 1.5em; }\n")
+	if _, _, err := e.SerializeLargePrint(0.5); err == nil {
+		t.Errorf("SerializeLargePrint(0.5) succeeded")
+	}
+	book, notes, err := e.SerializeLargePrint(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || !strings.Contains(notes[0], "font-size: 11pt; text-align: justify") {
+		t.Errorf("notes = %q", notes)
+	}
+	if css := zipFile(t, book, "OPS/css/main.css"); css != "p { margin: 0 }\nh1 { font-size: 1.5em; }\n" {
+		t.Errorf("main.css = %q", css)
+	}
+	if css := zipFile(t, book, "OPS/largeprint.css"); !strings.Contains(css, "font-size: 150%;") {
+		t.Errorf("largeprint.css = %q", css)
+	}
+	if page := zipFile(t, book, "OPS/a.xhtml"); !strings.Contains(page, `href="largeprint.css"`) {
+		t.Errorf("a.xhtml doesn't link the large print stylesheet:\n%s", page)
+	}
+	if opf := zipFile(t, book, "OPS/book.opf"); !strings.Contains(opf, `<meta property="schema:accessibilityFeature">largePrint</meta>`) {
+		t.Errorf("package document doesn't declare large print:\n%s", opf)
+	}
+	if len(e.styles) != 1 || string(e.styles[0].contents) != "p { font-size: 11pt; text-align: justify; margin: 0 }\nh1 { font-size: 1.5em; }\n" {
+		t.Errorf("SerializeLargePrint changed the book's stylesheets")
+	}
+
+	name := t.TempDir() + "/large.epub"
+	if _, err := e.WriteLargePrint(0.5, name); err == nil {
+		t.Errorf("WriteLargePrint(0.5) succeeded")
+	}
+	if _, err := os.Stat(name); err == nil {
+		t.Errorf("failed WriteLargePrint left a file behind")
+	}
+	written, err := e.WriteLargePrint(0, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, notes) {
+		t.Errorf("WriteLargePrint notes = %q, want %q", written, notes)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if css := zipFile(t, b, "OPS/largeprint.css"); !strings.Contains(css, "font-size: 150%;") {
+		t.Errorf("written largeprint.css = %q", css)
+	}
+}
+
+func TestSerializeBRF(t *testing.T) {
+	e := New()
+	e.AddXHTML("a.xhtml", xhtmlPage("A", "<h1>One</h1><p>“It was a dark and stormy night” — the rain fell in torrents.</p>"))
+	e.AddXHTML("b.xhtml", xhtmlPage("B", "<h1>Two</h1><p>Café.</p>"))
+	if _, err := e.SerializeBRF(BRFOptions{CellsPerLine: 5}); err == nil {
+		t.Errorf("SerializeBRF with 5 cells per line succeeded")
+	}
+	b, err := e.SerializeBRF(BRFOptions{CellsPerLine: 20, LinesPerPage: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "  One\r\n" +
+		"  \"It was a dark and\r\n" +
+		"stormy night\" -- the\r\n\f" +
+		"rain fell in\r\n" +
+		"torrents.\r\n\f" +
+		"  Two\r\n" +
+		"  Caf?.\r\n\f"
+	if string(b) != want {
+		t.Errorf("SerializeBRF() = %q, want %q", b, want)
+	}
+	b, err = e.SerializeBRF(BRFOptions{Translate: strings.ToUpper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "  ONE\r\n  \"IT WAS A DARK AND STORMY NIGHT\" --\r\nTHE RAIN") {
+		t.Errorf("translated SerializeBRF() = %q", b)
+	}
+
+	name := t.TempDir() + "/book.brf"
+	if err := e.WriteBRF(name, BRFOptions{CellsPerLine: 5}); err == nil {
+		t.Errorf("WriteBRF with 5 cells per line succeeded")
+	}
+	if err := e.WriteBRF(name, BRFOptions{CellsPerLine: 20, LinesPerPage: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(name); err != nil || string(got) != want {
+		t.Errorf("WriteBRF wrote %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestRemoteResources(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	png := testPNG(t, 2, 2)
+	e.AddXHTML("b.xhtml", xhtmlPage("B", `<p><img src="https://example.com/img/pic.png?v=1&amp;w=2" alt="" /> <a href="https://example.com/">site</a></p>
+<audio src="https://example.com/a.mp3" controls="controls"></audio>`))
+	e.AddStylesheet("css/main.css", `@import "//cdn.example.com/base.css"; body { background: url(data:image/png;base64,AAAA) }`)
+	var warnings []string
+	for _, w := range e.Warnings() {
+		if strings.Contains(w, "from the web") {
+			warnings = append(warnings, w)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Errorf("remote resource warnings = %q, want 2", warnings)
+	}
+	e.SetStrict(true)
+	if err := e.Validate(); !errors.Is(err, ErrRemoteResource) {
+		t.Errorf("Validate() in strict mode = %v, want ErrRemoteResource", err)
+	}
+	e.SetStrict(false)
+
+	var fetched []string
+	ids, err := e.LocalizeRemoteResources(func(u string) ([]byte, error) {
+		fetched = append(fetched, u)
+		switch u {
+		case "https://example.com/img/pic.png?v=1&w=2", "https://cdn.example.com/bg.png":
+			return png, nil
+		case "https://cdn.example.com/base.css":
+			return []byte(`p { background: url("https://cdn.example.com/bg.png") } @font-face { src: url(https://cdn.example.com/f.woff2) }`), nil
+		}
+		return nil, fmt.Errorf("unexpected fetch of %v", u)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || len(fetched) != 3 {
+		t.Errorf("LocalizeRemoteResources() added %v, fetched %q; want 3 each", ids, fetched)
+	}
+	for _, w := range e.Warnings() {
+		if strings.Contains(w, "from the web") {
+			t.Errorf("warning after LocalizeRemoteResources: %v", w)
+		}
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := zipFile(t, b, "OPS/b.xhtml")
+	for _, want := range []string{`src="remote/pic.png"`, `href="https://example.com/"`, `src="https://example.com/a.mp3"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("b.xhtml doesn't contain %q:\n%s", want, page)
+		}
+	}
+	if css := zipFile(t, b, "OPS/css/main.css"); !strings.Contains(css, `@import "../remote/base.css"`) {
+		t.Errorf("main.css = %q", css)
+	}
+	if css := zipFile(t, b, "OPS/remote/base.css"); !strings.Contains(css, `url("bg.png")`) || !strings.Contains(css, "url(https://cdn.example.com/f.woff2)") {
+		t.Errorf("base.css = %q", css)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	for _, want := range []string{`href="b.xhtml" media-type="application/xhtml+xml" properties="remote-resources"`, `href="remote/base.css" media-type="text/css" properties="remote-resources"`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document doesn't contain %q:\n%s", want, opf)
+		}
+	}
+}
+
+func TestNavpointTies(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetNCX(true)
+	var want []string
+	for i := 0; i < 50; i++ {
+		label := fmt.Sprintf("Entry %02d", i)
+		e.AddNavpoint(label, fmt.Sprintf("a.xhtml#p%d", i), i%2)
+		if i%2 == 0 {
+			want = append(want, label)
+		}
+	}
+	for i := 1; i < 50; i += 2 {
+		want = append(want, fmt.Sprintf("Entry %02d", i))
+	}
+	entryRE := regexp.MustCompile(`Entry \d\d`)
+	for n := 0; n < 3; n++ {
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"OPS/__toc.xhtml", "OPS/toc.ncx"} {
+			if got := entryRE.FindAllString(zipFile(t, b, name), -1); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%v entries = %v, want %v", name, got, want)
+			}
+		}
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	e.SetFontObfuscation(true)
+	id := e.xhtml[0].id
+	then := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	e.SetModTime(id, then)
+	e.SetBuildManifest(true)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m BuildManifest
+	if err := json.Unmarshal([]byte(zipFile(t, b, "META-INF/build.json")), &m); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(m.Generator, "github.com/writingtoole/epub ") || m.GoVersion == "" || m.Built == "" {
+		t.Errorf("manifest = %+v", m)
+	}
+	if m.Options["version"] != "3" || m.Options["fontObfuscation"] != "true" {
+		t.Errorf("options = %v", m.Options)
+	}
+	sum := sha256.Sum256(e.xhtml[0].contents)
+	want := []BuildResource{{Path: "OPS/a.xhtml", ID: id, SHA256: hex.EncodeToString(sum[:]), Modified: "2021-03-04T05:06:07Z"}}
+	if !reflect.DeepEqual(m.Resources, want) {
+		t.Errorf("resources = %+v, want %+v", m.Resources, want)
+	}
+
+	img, err := e.AddImage("x.png", testPNG(t, 2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetZipPath(img, "META-INF/build.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Validate(); !errors.Is(err, ErrReserved) {
+		t.Errorf("Validate() with a file at META-INF/build.json = %v, want ErrReserved", err)
+	}
+}
+
+func TestWithFS(t *testing.T) {
+	then := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"src/a.xhtml":  {Data: []byte(xhtmlPage("A", "<p>A</p>")), ModTime: then},
+		"src/pic.png":  {Data: testPNG(t, 3, 3), ModTime: then},
+		"src/main.css": {Data: []byte("p { margin: 0 }"), ModTime: then},
+	}
+	e := New(WithFS(fsys))
+	a, err := e.AddXHTMLFile("src/a.xhtml", "a.xhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.ModTime(a); !ok || !got.Equal(then) {
+		t.Errorf("ModTime(%v) = %v, %v; want %v", a, got, ok, then)
+	}
+	if _, err := e.AddImageFile("src/missing.png", "missing.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("AddImageFile of a missing file = %v, want fs.ErrNotExist", err)
+	}
+	ids, err := e.AddAll(context.Background(), []AddRequest{{Kind: KindImage, Source: "src/pic.png", Dest: "pic.png"}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := e.ImageInfo(ids[0]); err != nil || info.Width != 3 {
+		t.Errorf("ImageInfo(%v) = %+v, %v", ids[0], info, err)
+	}
+	if got, ok := e.ModTime(ids[0]); !ok || !got.Equal(then) {
+		t.Errorf("ModTime(%v) after AddAll = %v, %v; want %v", ids[0], got, ok, then)
+	}
+
+	f, err := fsys.Open("src/main.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	css, err := e.AddReader(KindStylesheet, f, "main.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.ModTime(css); !ok || !got.Equal(then) {
+		t.Errorf("ModTime(%v) = %v, %v; want %v", css, got, ok, then)
+	}
+	b, err := e.AddReader(KindXHTML, strings.NewReader(xhtmlPage("B", "<p>B</p>")), "b.xhtml", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.ModTime(b); ok {
+		t.Errorf("resource read from a strings.Reader has a modification time")
+	}
+	if _, err := e.AddReader(ResourceKind(99), strings.NewReader(""), "x"); err == nil {
+		t.Errorf("AddReader with an unknown kind succeeded")
+	}
+}
+
+func TestMetadataEntry(t *testing.T) {
+	me := NewMetadataEntry("dc:publisher", "Acme & Sons").
+		Refine("file-as", "Acme").
+		RefineScheme("role", "pbl", "marc:relators").
+		RefineV3("alternate-script", "アクメ", "ja")
+	v2, err := me.XML(2, "pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<dc:publisher opf:file-as="Acme" opf:role="pbl">Acme &amp; Sons</dc:publisher>`; v2 != want {
+		t.Errorf("XML(2) = %v, want %v", v2, want)
+	}
+	v3, err := me.XML(3, "pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<dc:publisher id="pub">Acme &amp; Sons</dc:publisher>
+<meta refines="#pub" property="file-as">Acme</meta>
+<meta refines="#pub" property="role" scheme="marc:relators">pbl</meta>
+<meta refines="#pub" property="alternate-script" xml:lang="ja">アクメ</meta>`
+	if v3 != want {
+		t.Errorf("XML(3) =\n%v\nwant\n%v", v3, want)
+	}
+
+	e := simpleBook(t)
+	if err := e.AddMetadataEntry(me); err != nil {
+		t.Fatal(err)
+	}
+	me.Refine("display-seq", "1")
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/content.opf"); !strings.Contains(opf, `<dc:publisher opf:file-as="Acme" opf:role="pbl">`) || strings.Contains(opf, "display-seq") {
+		t.Errorf("v2 package has the wrong publisher entry:\n%s", opf)
+	}
+	e.SetVersion(3)
+	if b, err = e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/book.opf"); !strings.Contains(opf, `property="alternate-script" xml:lang="ja">アクメ</meta>`) {
+		t.Errorf("v3 package lacks the publisher's refinements:\n%s", opf)
+	}
+
+	for _, bad := range []*MetadataEntry{
+		NewMetadataEntry("dc:identifier", "x"),
+		NewMetadataEntry("bad name", "x"),
+		NewMetadataEntry("dc:rights", " "),
+		NewMetadataEntry("dc:rights", "x").Refine("", "y"),
+	} {
+		if err := e.AddMetadataEntry(bad); err == nil {
+			t.Errorf("AddMetadataEntry(%+v) succeeded", bad.m)
+		}
+	}
+}
+
+func TestAddPlates(t *testing.T) {
+	e := simpleBook(t)
+	lange := &Person{Name: "Dorothea Lange", Role: "pht"}
+	plates := []Plate{
+		{Path: "images/p1.png", Contents: testPNG(t, 4, 3), Caption: "Migrant Mother, 1936", Credit: "Library of Congress", Creator: lange},
+		{Path: "images/p2.png", Contents: testPNG(t, 4, 3), Alt: "A dust storm", Caption: "Dust & wind", Creator: lange},
+		{Path: "images/p3.png", Contents: testPNG(t, 4, 3), Alt: "A farmhouse"},
+	}
+	id, err := e.AddPlates("xhtml/plates.xhtml", "Plates", 100, plates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("AddPlates returned an empty ID")
+	}
+	if _, err := e.AddPlates("xhtml/more.xhtml", "More", 101, []Plate{{Path: "images/p4.png", Contents: testPNG(t, 1, 1)}}); err == nil {
+		t.Errorf("AddPlates accepted a plate with no alt text or caption")
+	}
+	if _, err := e.ImageID("images/p4.png"); err == nil {
+		t.Errorf("refused plates section left its image in the book")
+	}
+
+	e.AddIllustrationTarget("A map & key", "a.xhtml#map")
+
+	e.SetVersion(3)
+	e.SetNCX(true)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := zipFile(t, b, "OPS/xhtml/plates.xhtml")
+	for _, want := range []string{
+		`<h1>Plates</h1>`,
+		`<div class="plate" id="plate1">`,
+		`<img src="../images/p1.png" alt="Migrant Mother, 1936" />`,
+		`<p class="caption">Dust &amp; wind</p>`,
+		`<p class="credit">Library of Congress</p>`,
+		`alt="A farmhouse"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("plates page doesn't contain %v:\n%s", want, page)
+		}
+	}
+	nav := zipFile(t, b, "OPS/__toc.xhtml")
+	if !regexp.MustCompile(`(?s)<nav epub:type="loi".*<a href="xhtml/plates.xhtml#plate2">Dust &amp; wind</a>.*<a href="xhtml/plates.xhtml#plate3">A farmhouse</a>.*<a href="a.xhtml#map">A map &amp; key</a>`).MatchString(nav) {
+		t.Errorf("nav document has no list of illustrations:\n%s", nav)
+	}
+	ncx := zipFile(t, b, "OPS/toc.ncx")
+	if !strings.Contains(ncx, `<navList class="loi">`) || !strings.Contains(ncx, `<content src="xhtml/plates.xhtml#plate1"`) || !strings.Contains(ncx, `<content src="a.xhtml#map"`) {
+		t.Errorf("NCX has no list of illustrations:\n%s", ncx)
+	}
+	opf := zipFile(t, b, "OPS/book.opf")
+	if n := strings.Count(opf, ">Dorothea Lange</dc:contributor>"); n != 1 {
+		t.Errorf("package lists the plates' photographer %v times, want 1:\n%s", n, opf)
+	}
+
+	r, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(r.illustrations); got != 4 {
+		t.Errorf("reopened book has %v illustrations, want 4", got)
+	}
+}
+
+func TestOnSaleDate(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) }
+
+	e := simpleBook(t)
+	onSale := time.Date(2026, 11, 3, 5, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	e.SetOnSaleDate(onSale)
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatalf("SerializeV2 of a book with an on-sale date but no embargo failed: %v", err)
+	}
+	if want := `<meta name="dcterms:available" content="2026-11-03T10:00:00Z"`; !strings.Contains(zipFile(t, b, "OPS/content.opf"), want) {
+		t.Errorf("v2 package doesn't contain %v", want)
+	}
+
+	e.SetEmbargo(true)
+	if _, err := e.SerializeV2(); !errors.Is(err, ErrEmbargoed) {
+		t.Errorf("SerializeV2 of an embargoed book = %v, want ErrEmbargoed", err)
+	}
+	e.SetVersion(3)
+	if _, err := e.Serialize(); !errors.Is(err, ErrEmbargoed) {
+		t.Errorf("Serialize of an embargoed book = %v, want ErrEmbargoed", err)
+	}
+	now = func() time.Time { return onSale }
+	if b, err = e.Serialize(); err != nil {
+		t.Fatalf("Serialize on the on-sale date failed: %v", err)
+	}
+	if want := `<meta property="dcterms:available">2026-11-03T10:00:00Z</meta>`; !strings.Contains(zipFile(t, b, "OPS/book.opf"), want) {
+		t.Errorf("v3 package doesn't contain %v", want)
+	}
+	r, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.OnSaleDate(); !got.Equal(onSale) {
+		t.Errorf("reopened book's OnSaleDate() = %v, want %v", got, onSale)
+	}
+
+	now = func() time.Time { return time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) }
+	e.SetEmbargo(false)
+	if _, err := e.Serialize(); err != nil {
+		t.Errorf("Serialize with the embargo overridden failed: %v", err)
+	}
+}
+
+func TestContainsFold(t *testing.T) {
+	for _, tc := range []struct {
+		b, s string
+		want bool
+	}{
+		{"a { background: URL(//x/y.png) }", "url(", true},
+		{"@IMPORT 'x.css';", "@import", true},
+		{"a { background: none }", "url(", false},
+		{"ur", "url(", false},
+		{"xxurl(", "url(", true},
+	} {
+		if got := containsFold([]byte(tc.b), tc.s); got != tc.want {
+			t.Errorf("containsFold(%q, %q) = %v, want %v", tc.b, tc.s, got, tc.want)
+		}
+	}
+	if refs := cssRemoteRefs([]byte("/* x */ p { background: URL(https://example.com/a.png) }")); len(refs) != 1 || refs[0].kind != "image" {
+		t.Errorf("cssRemoteRefs() = %+v, want one image", refs)
+	}
+}
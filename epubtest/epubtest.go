@@ -0,0 +1,336 @@
+// Package epubtest provides helpers for testing code that generates
+// ePub books: unpacking serialized books, comparing them against
+// golden directories, and checking the package document's manifest
+// and spine for structural mistakes.
+//
+// The helpers work on serialized books (the output of
+// epub.EPub.Serialize, or the contents of an .epub file), so they
+// don't depend on how the book was made.
+package epubtest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Update makes AssertGolden rewrite golden directories rather than
+// compare against them. Tests usually set it from a flag:
+//
+//	flag.BoolVar(&epubtest.Update, "update", false, "update golden files")
+var Update bool
+
+// Files returns the contents of every file in a serialized book, keyed
+// by zip entry name.
+func Files(book []byte) (map[string][]byte, error) {
+	z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte, len(z.File))
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		c, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %v: %v", f.Name, err)
+		}
+		files[f.Name] = c
+	}
+	return files, nil
+}
+
+// modifiedRE matches the v3 modification timestamp, which changes every
+// time a book is written.
+var modifiedRE = regexp.MustCompile(`(<meta property="dcterms:modified">)[^<]*(</meta>)`)
+
+// normalize masks the parts of a file that legitimately change between
+// runs.
+func normalize(c []byte) []byte {
+	return modifiedRE.ReplaceAll(c, []byte("${1}MODIFIED${2}"))
+}
+
+// WriteGolden writes the files in a serialized book into dir, which is
+// created if necessary. Existing files in dir are not removed. Nothing
+// is written if any entry's name would put it outside dir.
+func WriteGolden(book []byte, dir string) error {
+	files, err := Files(book)
+	if err != nil {
+		return err
+	}
+	for name := range files {
+		if !localName(name) {
+			return fmt.Errorf("zip entry %q is outside the book", name)
+		}
+	}
+	for name, c := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, normalize(c), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localName reports whether a zip entry name stays inside the
+// directory it's extracted into.
+func localName(name string) bool {
+	p := filepath.Clean(filepath.FromSlash(name))
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return false
+	}
+	return p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
+// DiffGolden compares the files in a serialized book with the golden
+// files in dir, and returns a description of each difference. The v3
+// dcterms:modified timestamp is ignored.
+func DiffGolden(book []byte, dir string) ([]string, error) {
+	files, err := Files(book)
+	if err != nil {
+		return nil, err
+	}
+	golden := make(map[string][]byte)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		c, err := os.ReadFile(p)
+		golden[filepath.ToSlash(rel)] = c
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	for name, c := range files {
+		g, ok := golden[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%v: not in golden files", name))
+			continue
+		}
+		if d := diffContents(normalize(c), normalize(g)); d != "" {
+			diffs = append(diffs, fmt.Sprintf("%v: %v", name, d))
+		}
+	}
+	for name := range golden {
+		if _, ok := files[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%v: missing from book", name))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// diffContents describes the first difference between two files, or
+// returns the empty string if they're the same.
+func diffContents(got, want []byte) string {
+	if bytes.Equal(got, want) {
+		return ""
+	}
+	gl, wl := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := 0; i < len(gl) && i < len(wl); i++ {
+		if gl[i] != wl[i] {
+			return fmt.Sprintf("line %v is %q, want %q", i+1, gl[i], wl[i])
+		}
+	}
+	return fmt.Sprintf("has %v lines, want %v", len(gl), len(wl))
+}
+
+// AssertGolden fails the test if the serialized book differs from the
+// golden files in dir. If Update is set the golden files are rewritten
+// instead.
+func AssertGolden(tb testing.TB, book []byte, dir string) {
+	tb.Helper()
+	if Update {
+		if err := os.RemoveAll(dir); err != nil {
+			tb.Fatal(err)
+		}
+		if err := WriteGolden(book, dir); err != nil {
+			tb.Fatal(err)
+		}
+		return
+	}
+	diffs, err := DiffGolden(book, dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, d := range diffs {
+		tb.Error(d)
+	}
+}
+
+// The bits of the container and package documents CheckPackage looks
+// at.
+type container struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type packageDoc struct {
+	UniqueID    string `xml:"unique-identifier,attr"`
+	Identifiers []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"metadata>identifier"`
+	Items []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// CheckPackage checks the structure of a serialized book and returns
+// an error describing every problem found. It checks that:
+//   - the mimetype file comes first, is uncompressed, and is correct;
+//   - the container lists package documents that exist;
+//   - the unique-identifier refers to a dc:identifier;
+//   - manifest IDs are unique and every href refers to a file in the
+//     book;
+//   - every file in the book, other than the container and package
+//     files, is in the manifest;
+//   - the spine isn't empty, refers only to manifest items, and lists
+//     each item once, and its toc attribute refers to a manifest item.
+func CheckPackage(book []byte) error {
+	z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		return err
+	}
+	files, err := Files(book)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if len(z.File) == 0 || z.File[0].Name != "mimetype" {
+		fail("mimetype is not the first file")
+	} else if z.File[0].Method != zip.Store {
+		fail("mimetype is compressed")
+	}
+	if m, ok := files["mimetype"]; ok && string(m) != "application/epub+zip" {
+		fail("mimetype is %q", m)
+	}
+
+	var c container
+	if err := xml.Unmarshal(files["META-INF/container.xml"], &c); err != nil {
+		fail("unable to parse META-INF/container.xml: %v", err)
+	}
+	if len(c.Rootfiles) == 0 {
+		fail("container lists no package documents")
+	}
+	listed := map[string]bool{"mimetype": true, "META-INF/container.xml": true}
+	for _, rf := range c.Rootfiles {
+		listed[rf.FullPath] = true
+	}
+	manifested := make(map[string]bool)
+	for _, rf := range c.Rootfiles {
+		opf, ok := files[rf.FullPath]
+		if !ok {
+			fail("package document %v doesn't exist", rf.FullPath)
+			continue
+		}
+		var p packageDoc
+		if err := xml.Unmarshal(opf, &p); err != nil {
+			fail("unable to parse %v: %v", rf.FullPath, err)
+			continue
+		}
+		checkPackageDoc(rf.FullPath, p, files, manifested, fail)
+	}
+	for name := range files {
+		if !listed[name] && !manifested[name] && !strings.HasPrefix(name, "META-INF/") {
+			fail("%v isn't in the manifest", name)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(strings.Join(problems, "\n"))
+}
+
+// checkPackageDoc checks the package document named opf, noting the
+// files its manifest refers to in manifested.
+func checkPackageDoc(opf string, p packageDoc, files map[string][]byte, manifested map[string]bool, fail func(string, ...interface{})) {
+	found := false
+	for _, id := range p.Identifiers {
+		found = found || id.ID == p.UniqueID
+	}
+	if !found {
+		fail("%v: unique-identifier %q doesn't refer to a dc:identifier", opf, p.UniqueID)
+	}
+
+	ids := make(map[string]bool)
+	for _, item := range p.Items {
+		if ids[item.ID] {
+			fail("%v: manifest ID %v is used more than once", opf, item.ID)
+		}
+		ids[item.ID] = true
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			fail("%v: manifest item %v has a bad href %q", opf, item.ID, item.Href)
+			continue
+		}
+		name := path.Join(path.Dir(opf), href)
+		if _, ok := files[name]; !ok {
+			fail("%v: manifest item %v refers to %v, which doesn't exist", opf, item.ID, name)
+		}
+		manifested[name] = true
+	}
+
+	if len(p.Spine.Itemrefs) == 0 {
+		fail("%v: spine is empty", opf)
+	}
+	seen := make(map[string]bool)
+	for _, ref := range p.Spine.Itemrefs {
+		if !ids[ref.IDRef] {
+			fail("%v: spine refers to %v, which isn't in the manifest", opf, ref.IDRef)
+		}
+		if seen[ref.IDRef] {
+			fail("%v: spine lists %v more than once", opf, ref.IDRef)
+		}
+		seen[ref.IDRef] = true
+	}
+	if p.Spine.TOC != "" && !ids[p.Spine.TOC] {
+		fail("%v: spine toc %v isn't in the manifest", opf, p.Spine.TOC)
+	}
+}
+
+// AssertPackage fails the test if CheckPackage finds problems with the
+// serialized book.
+func AssertPackage(tb testing.TB, book []byte) {
+	tb.Helper()
+	if err := CheckPackage(book); err != nil {
+		tb.Error(err)
+	}
+}
@@ -0,0 +1,120 @@
+package epubtest_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/writingtoole/epub"
+	"github.com/writingtoole/epub/epubtest"
+)
+
+func book(t *testing.T, version float64) []byte {
+	t.Helper()
+	e := epub.New()
+	e.SetVersion(version)
+	e.SetTitle("Title")
+	e.AddLanguage("en")
+	e.AddStylesheet("css/main.css", "p { margin: 0; }")
+	if _, err := e.AddXHTML("a b.xhtml", `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>A</title></head><body><p>A</p></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	e.AddNavpoint("A", "a b.xhtml", 1)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGolden(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		dir := t.TempDir()
+		b := book(t, v)
+		if err := epubtest.WriteGolden(b, dir); err != nil {
+			t.Fatal(err)
+		}
+		epubtest.AssertGolden(t, b, dir)
+
+		// A fresh book has a new UUID, and so differs.
+		diffs, err := epubtest.DiffGolden(book(t, v), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) == 0 || !strings.Contains(diffs[0], "urn:uuid:") {
+			t.Errorf("v%v: DiffGolden missed a changed UUID: %q", v, diffs)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "OPS", "extra.xhtml"), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		diffs, err = epubtest.DiffGolden(b, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) != 1 || diffs[0] != "OPS/extra.xhtml: missing from book" {
+			t.Errorf("v%v: DiffGolden = %q, want a missing file", v, diffs)
+		}
+	}
+}
+
+func TestWriteGoldenOutsideDir(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "OPS/../../escape.txt", "/tmp/escape.txt"} {
+		var buf bytes.Buffer
+		z := zip.NewWriter(&buf)
+		for _, n := range []string{"OPS/a.xhtml", name} {
+			w, err := z.Create(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("x"))
+		}
+		z.Close()
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "golden")
+		if err := epubtest.WriteGolden(buf.Bytes(), dir); err == nil {
+			t.Errorf("WriteGolden accepted entry %q", name)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "escape.txt")); err == nil {
+			t.Errorf("WriteGolden wrote %q outside its directory", name)
+		}
+		if _, err := os.Stat(dir); err == nil {
+			t.Errorf("WriteGolden wrote files before rejecting %q", name)
+		}
+	}
+}
+
+func TestCheckPackage(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		epubtest.AssertPackage(t, book(t, v))
+	}
+
+	// Add a stray file to a good book.
+	files, err := epubtest.Files(book(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, name := range []string{"mimetype", "META-INF/container.xml", "OPS/content.opf", "OPS/toc.ncx", "OPS/stray.png"} {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(files[name])
+	}
+	z.Close()
+	err = epubtest.CheckPackage(buf.Bytes())
+	if err == nil {
+		t.Fatal("CheckPackage accepted a broken book")
+	}
+	for _, want := range []string{"mimetype is compressed", "OPS/stray.png isn't in the manifest", "refers to OPS/a b.xhtml, which doesn't exist"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("CheckPackage error doesn't mention %q:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package epub
+
+// This file holds the errors this package returns, so callers can
+// check what went wrong with errors.Is and errors.As rather than by
+// matching messages.
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidRole is returned for creator and contributor roles
+	// that aren't MARC relator codes.
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrInvalidArgument is returned for arguments that can't be used
+	// as given, such as malformed IDs, paths, or names.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrDuplicatePath is returned when validating or writing a book
+	// in which two files share a path, or an XHTML file appears in the
+	// spine more than once.
+	ErrDuplicatePath = errors.New("duplicate path")
+	// ErrDuplicateID is returned when an identifier or manifest ID is
+	// used more than once.
+	ErrDuplicateID = errors.New("duplicate ID")
+	// ErrUnsupportedVersion is returned for ePub versions this package
+	// can't write.
+	ErrUnsupportedVersion = errors.New("unsupported ePub version")
+	// ErrUnsupportedFormat is returned for files whose format can't be
+	// put in a book, such as fonts that aren't OpenType.
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+	// ErrNotFound is returned when an ID or identifier doesn't refer
+	// to anything in the book, or a stylesheet refers to a file that
+	// isn't in it.
+	ErrNotFound = errors.New("not found")
+	// ErrReserved is returned for names this package reserves for the
+	// files and attributes it writes itself.
+	ErrReserved = errors.New("reserved name")
+	// ErrEmptySpine is returned when writing a book with no XHTML
+	// files.
+	ErrEmptySpine = errors.New("spine is empty")
+	// ErrOverBudget is returned when the book is bigger than the size
+	// budget set with SetSizeBudget.
+	ErrOverBudget = errors.New("over size budget")
+	// ErrContentAudit is returned when a content audit added with
+	// AddContentAudit finds problems. The error is an *AuditError.
+	ErrContentAudit = errors.New("content audit failed")
+	// ErrRestrictedFont is returned when adding a font whose
+	// embedding permissions forbid embedding it.
+	ErrRestrictedFont = errors.New("font embedding is restricted")
+	// ErrProfile is returned when writing a book that doesn't meet the
+	// requirements of a publishing profile it's set to, such as
+	// EDUPUB.
+	ErrProfile = errors.New("profile requirements not met")
+	// ErrUnknownSemanticType is returned for epub:type values that
+	// aren't in the structural semantics vocabulary.
+	ErrUnknownSemanticType = errors.New("unknown semantic type")
+	// ErrRemoteResource is returned for XHTML files and stylesheets
+	// that load resources from the web that must be in the book.
+	ErrRemoteResource = errors.New("remote resource")
+	// ErrEmbargoed is returned when writing a book before its on-sale
+	// date while the embargo set with SetEmbargo is on.
+	ErrEmbargoed = errors.New("embargoed")
+)
+
+// ResourceError records a failure to add, decode, or write one of the
+// book's files.
+type ResourceError struct {
+	// Op is the operation that failed: "add", "decode", "orient",
+	// "convert", "sanitize", "transform" (for OnResourceWrite hooks), or
+	// "write", for LocalizeRemoteResources "fetch", or for BulkEdit
+	// "open" or "edit".
+	Op string
+	// Path is the path of the file in the book, or for BulkEdit the
+	// name of the book's file.
+	Path string
+	Err  error
+}
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("unable to %v %v: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+// sentinelError is an error with its own message that matches one of
+// the package's sentinel errors with errors.Is.
+type sentinelError struct {
+	msg      string
+	sentinel error
+}
+
+func (e *sentinelError) Error() string {
+	return e.msg
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.sentinel
+}
+
+// errorf returns an error with the formatted message that wraps
+// sentinel.
+func errorf(sentinel error, format string, args ...interface{}) error {
+	return &sentinelError{msg: fmt.Sprintf(format, args...), sentinel: sentinel}
+}
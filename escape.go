@@ -0,0 +1,64 @@
+package epub
+
+// This file holds the escaping we use for the attributes we write into
+// XHTML and reformatted XML. Every attribute value this package
+// interpolates into markup by hand should go through escapeAttr, so a
+// quote or stray control character in a title, path, or label can't
+// break out of its attribute or make the file malformed.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// attrEscaper escapes the characters that are special in quoted
+// attribute values. Quotes are escaped the way html.EscapeString and
+// encoding/xml escape them, so values are safe in either kind of
+// quotes, and whitespace other than spaces is escaped so it survives
+// attribute value normalization.
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+	"\t", "&#x9;",
+	"\n", "&#xA;",
+	"\r", "&#xD;",
+)
+
+// escapeAttr returns s escaped for use as a quoted attribute value.
+// Characters XML doesn't allow, and invalid UTF-8, are replaced with
+// U+FFFD, as encoding/xml does.
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(xmlChars(s))
+}
+
+// attrPair formats an attribute, with its value escaped, such as
+// `href="a.xhtml"`.
+func attrPair(name, value string) string {
+	return fmt.Sprintf(`%s="%s"`, name, escapeAttr(value))
+}
+
+// xmlChars returns s with any characters XML doesn't allow, and any
+// invalid UTF-8, replaced with U+FFFD.
+func xmlChars(s string) string {
+	if utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool { return !isXMLChar(r) }) < 0 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if isXMLChar(r) {
+			return r
+		}
+		return utf8.RuneError
+	}, s)
+}
+
+// isXMLChar reports whether r is a character XML allows in documents.
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= utf8.MaxRune
+}
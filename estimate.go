@@ -0,0 +1,127 @@
+package epub
+
+// This file holds the code that estimates the size of the written book
+// without writing it.
+
+import (
+	"compress/flate"
+	"strings"
+)
+
+const (
+	// sampleSize is the most of each file sampled for its compression
+	// ratio, and sampleBudget the most sampled in all.
+	sampleSize   = 32 << 10
+	sampleBudget = 256 << 10
+	// bestRatio is roughly how much smaller BestCompression, which books
+	// are written with, makes text than the BestSpeed used for
+	// sampling.
+	bestRatio = 0.9
+	// zipEntryOverhead is the size of a file's zip headers, apart from
+	// its name, which appears twice.
+	zipEntryOverhead = 30 + 46 + 16
+	// genericRatio is the compression ratio assumed for generated files
+	// and when there's nothing to sample.
+	genericRatio = 0.3
+)
+
+// EstimateSize quickly estimates the size of the book, compressed as
+// written and uncompressed, without writing it. It's meant for showing
+// the size live as content is added, where writing the book at full
+// compression every time would be too slow.
+//
+// Files in formats that are already compressed, such as JPEG images
+// and WOFF fonts, are counted at their own size. The compression ratio
+// of the rest is measured by quickly compressing samples of them, and
+// the size of the generated files, such as the package document and
+// table of contents, is estimated from the number of files and entries
+// in them. The estimate is usually within a fifth of the real size,
+// and tends to be high.
+func (e *EPub) EstimateSize() (compressed, uncompressed int64) {
+	var text, sampled, sampledOut int64
+	var fw *flate.Writer
+	files := 0
+	e.eachFile(func(name string, contents []byte) {
+		n := int64(len(contents))
+		files++
+		uncompressed += n
+		compressed += zipEntryOverhead + 2*int64(len("OPS/")+len(name))
+		if precompressed(name) {
+			compressed += n
+			return
+		}
+		text += n
+		if sampled >= sampleBudget {
+			return
+		}
+		s := contents
+		if len(s) > sampleSize {
+			s = s[:sampleSize]
+		}
+		var c countWriter
+		if fw == nil {
+			fw, _ = flate.NewWriter(&c, flate.BestSpeed)
+		} else {
+			fw.Reset(&c)
+		}
+		fw.Write(s)
+		fw.Close()
+		sampled += int64(len(s))
+		sampledOut += c.n
+	})
+	ratio := genericRatio
+	if sampled > 0 {
+		ratio = float64(sampledOut) / float64(sampled) * bestRatio
+	}
+	compressed += int64(float64(text) * ratio)
+
+	gen := e.generatedSize(files)
+	uncompressed += gen
+	compressed += int64(float64(gen)*genericRatio) + 4*(zipEntryOverhead+20)
+	return compressed, uncompressed
+}
+
+// generatedSize estimates the uncompressed size of the files written
+// for a book with the given number of added files: the mimetype file,
+// container.xml, the package document, and the tables of contents.
+func (e *EPub) generatedSize(files int) int64 {
+	navpoints := 0
+	var count func(np []*Navpoint)
+	count = func(np []*Navpoint) {
+		for _, n := range np {
+			navpoints++
+			count(n.navpoints)
+		}
+	}
+	count(e.navpoints)
+	n := 20 + 250 // mimetype and container.xml
+	n += 800 + 120*files + 40*len(e.xhtml) + 100*len(e.metadata)
+	n += 2 * (400 + 150*navpoints) // NCX and nav document
+	return int64(n)
+}
+
+// precompressed reports whether the named file is in a format that's
+// already compressed, and so won't get any smaller in the book.
+func precompressed(name string) bool {
+	mt, _, ok := LookupMediaType(name)
+	if !ok {
+		return false
+	}
+	switch {
+	case mt == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "audio/"), strings.HasPrefix(mt, "video/"):
+		return true
+	}
+	return mt == "font/woff" || mt == "font/woff2"
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -38,9 +38,8 @@ func ExampleNew() {
 	b.AddNavpoint("Chapter 2", "xhtml/file2.xhtml", 11)
 
 	// Add an actual table of contents. This appears inline in the book,
-	// an dis is different than (and unrelated to) the one built from
-	// navpoints.
-	b.AddXHTMLFile("source/toc.xhtml", "xhtml/toc.xhtml", 2)
+	// and is generated from the navpoints added above.
+	b.GenerateInlineTOC(2)
 
 	b.Write("mybook.epub")
 }
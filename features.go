@@ -0,0 +1,110 @@
+package epub
+
+// This file holds the code that works out which ePub version a book
+// needs.
+
+import (
+	"os"
+	"strings"
+)
+
+// Feature is a feature of the book that needs a particular ePub
+// version.
+type Feature struct {
+	// Name describes the feature, such as "fixed layout".
+	Name string
+	// Version is the lowest ePub version that supports the feature.
+	Version float64
+}
+
+// Features returns the features the book uses that need something
+// newer than ePub v2. Books that use none of them can be written as
+// v2 books without losing anything.
+func (e *EPub) Features() []Feature {
+	var f []Feature
+	if e.seriesName != "" || e.setName != "" {
+		f = append(f, Feature{"series and set metadata", 3})
+	}
+	if p := e.periodical; p != nil && (p.Issue != "" || p.Volume != "" || p.Frequency != "" || p.ISSN != "") {
+		f = append(f, Feature{"periodical issue metadata", 3})
+	}
+	if e.eduProfile != nil {
+		f = append(f, Feature{"EDUPUB profile", 3})
+	}
+	if len(e.links) > 0 {
+		f = append(f, Feature{"related links", 3})
+	}
+	if e.fixedLayout {
+		f = append(f, Feature{"fixed layout", 3})
+	}
+	if len(e.narrators) > 0 {
+		f = append(f, Feature{"media overlay narrators", 3})
+	}
+	for _, m := range e.media {
+		if strings.HasPrefix(m.mediaType, "audio/") || strings.HasPrefix(m.mediaType, "video/") {
+			f = append(f, Feature{"audio and video", 3})
+			break
+		}
+	}
+	for _, x := range e.xhtml {
+		if mathRE.Match(x.contents) {
+			f = append(f, Feature{"MathML", 3})
+			break
+		}
+	}
+creators:
+	for _, m := range e.metadata {
+		for _, p := range m.pairs {
+			if p.v3only {
+				f = append(f, Feature{"alternate scripts and display order for creators", 3})
+				break creators
+			}
+		}
+	}
+	return f
+}
+
+// WriteAuto writes the book to the named file in the lowest ePub
+// version that supports every feature the book uses (see Features):
+// v2 if it can, and v3 otherwise.
+//
+// If the book's version was set explicitly with SetVersion, that
+// version is written instead, and WriteAuto returns the features the
+// book uses that the version can't represent. Those features are left
+// out of the written book.
+func (e *EPub) WriteAuto(name string) ([]Feature, error) {
+	features := e.Features()
+	version := e.version
+	if !e.versionSet {
+		version = 2
+		for _, f := range features {
+			if f.Version > version {
+				version = f.Version
+			}
+		}
+	}
+	var dropped []Feature
+	for _, f := range features {
+		if f.Version > version {
+			dropped = append(dropped, f)
+		}
+	}
+
+	var buf []byte
+	var err error
+	switch version {
+	case 2:
+		buf, err = e.SerializeV2()
+	case 3, 3.3:
+		buf, err = e.SerializeV3()
+	default:
+		err = errorf(ErrUnsupportedVersion, "Unable to write epub version %v files", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(name, buf, 0666); err != nil {
+		return nil, err
+	}
+	return dropped, nil
+}
@@ -0,0 +1,65 @@
+package epub
+
+// This file holds the code that generates @font-face rules for the
+// book's fonts.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AddFontFaceStylesheet generates a stylesheet with an @font-face rule
+// for each font added to the book, and adds it to the book at path.
+// Each rule's font-family, font-weight, and font-style are read from
+// the font's name and OS/2 tables, as reported by FontInfo, so the fonts of a family share a
+// font-family and are told apart by weight and style. The fonts
+// should be added before this is called.
+//
+// If link is true the stylesheet is linked into every XHTML file, as
+// with AddStylesheetWithOptions; otherwise it's up to the book's
+// other stylesheets or XHTML files to refer to it.
+//
+// Returns the ID of the generated stylesheet.
+func (e *EPub) AddFontFaceStylesheet(path string, link bool) (Id, error) {
+	if len(e.fonts) == 0 {
+		return "", errors.New("the book has no fonts")
+	}
+	var b strings.Builder
+	for i, f := range e.fonts {
+		rule, _, err := e.fontFaceRule(f, path)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(rule)
+	}
+	var opts *StyleOptions
+	if link {
+		opts = &StyleOptions{}
+	}
+	return e.addStylesheet(path, []byte(b.String()), opts)
+}
+
+// fontFaceRule returns an @font-face rule for f, for a stylesheet at
+// path in the book, and the font's family.
+func (e *EPub) fontFaceRule(f font, path string) (rule, family string, err error) {
+	ff, err := readFontInfo(f.contents)
+	if err != nil {
+		return "", "", &ResourceError{Op: "decode", Path: f.name, Err: err}
+	}
+	style := "normal"
+	if ff.Italic {
+		style = "italic"
+	}
+	rule = fmt.Sprintf("@font-face {\n  font-family: %s;\n  font-weight: %d;\n  font-style: %s;\n  src: url(%s) format(\"opentype\");\n}\n",
+		cssString(ff.Family), ff.Weight, style, cssString(relativeHref("OPS/"+path, e.zipName(f.id, f.name))))
+	return rule, ff.Family, nil
+}
+
+// cssString returns s as a quoted CSS string.
+func cssString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\A `).Replace(s) + `"`
+}
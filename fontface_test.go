@@ -0,0 +1,326 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testFont returns a minimal OpenType font with the given names, and
+// an OS/2 table with the given weight and style if weight isn't 0.
+func testFont(family, subfamily string, weight int, italic bool) []byte {
+	// The name table, with Windows English names.
+	var strs []byte
+	var records []byte
+	for _, n := range []struct {
+		id int
+		s  string
+	}{{1, family}, {2, subfamily}} {
+		var s []byte
+		for _, u := range utf16.Encode([]rune(n.s)) {
+			s = append(s, byte(u>>8), byte(u))
+		}
+		rec := make([]byte, 12)
+		binary.BigEndian.PutUint16(rec, 3)
+		binary.BigEndian.PutUint16(rec[2:], 1)
+		binary.BigEndian.PutUint16(rec[4:], 0x409)
+		binary.BigEndian.PutUint16(rec[6:], uint16(n.id))
+		binary.BigEndian.PutUint16(rec[8:], uint16(len(s)))
+		binary.BigEndian.PutUint16(rec[10:], uint16(len(strs)))
+		records = append(records, rec...)
+		strs = append(strs, s...)
+	}
+	name := make([]byte, 6)
+	binary.BigEndian.PutUint16(name[2:], 2)
+	binary.BigEndian.PutUint16(name[4:], uint16(6+len(records)))
+	name = append(append(name, records...), strs...)
+
+	tables := []struct {
+		tag  string
+		data []byte
+	}{{"name", name}}
+	if weight != 0 {
+		os2 := make([]byte, 96)
+		binary.BigEndian.PutUint16(os2[4:], uint16(weight))
+		if italic {
+			binary.BigEndian.PutUint16(os2[62:], 1)
+		}
+		tables = append(tables, struct {
+			tag  string
+			data []byte
+		}{"OS/2", os2})
+	}
+
+	font := make([]byte, 12+16*len(tables))
+	copy(font, "OTTO")
+	binary.BigEndian.PutUint16(font[4:], uint16(len(tables)))
+	for i, t := range tables {
+		r := font[12+16*i:]
+		copy(r, t.tag)
+		binary.BigEndian.PutUint32(r[8:], uint32(len(font)))
+		binary.BigEndian.PutUint32(r[12:], uint32(len(t.data)))
+		font = append(font, t.data...)
+	}
+	return font
+}
+
+func TestAddFontFaceStylesheet(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddFontFaceStylesheet("css/fonts.css", true); err == nil {
+		t.Errorf("AddFontFaceStylesheet succeeded with no fonts")
+	}
+	e.AddFont("fonts/Serif-Regular.otf", testFont("Book Serif", "Regular", 400, false))
+	e.AddFont("fonts/Serif-BoldItalic.otf", testFont(`Book "Serif"`, "Bold Italic", 700, true))
+	e.AddFont("fonts/Serif-Italic.otf", testFont("Book Serif", "Semibold Italic", 0, false))
+	id, err := e.AddFontFaceStylesheet("css/fonts.css", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `@font-face {
+  font-family: "Book Serif";
+  font-weight: 400;
+  font-style: normal;
+  src: url("../fonts/Serif-Regular.otf") format("opentype");
+}
+
+@font-face {
+  font-family: "Book \"Serif\"";
+  font-weight: 700;
+  font-style: italic;
+  src: url("../fonts/Serif-BoldItalic.otf") format("opentype");
+}
+
+@font-face {
+  font-family: "Book Serif";
+  font-weight: 600;
+  font-style: italic;
+  src: url("../fonts/Serif-Italic.otf") format("opentype");
+}
+`
+	if got := zipFile(t, book, "OPS/css/fonts.css"); got != want {
+		t.Errorf("font-face stylesheet (%v) = %s, want %s", id, got, want)
+	}
+	if got := zipFile(t, book, "OPS/a.xhtml"); !strings.Contains(got, `href="css/fonts.css"`) {
+		t.Errorf("font-face stylesheet not linked:\n%s", got)
+	}
+
+	e = simpleBook(t)
+	e.AddFont("fonts/bad.otf", []byte("not a font"))
+	var re *ResourceError
+	if _, err := e.AddFontFaceStylesheet("css/fonts.css", false); !errors.As(err, &re) || re.Path != "fonts/bad.otf" {
+		t.Errorf("AddFontFaceStylesheet() = %v for a bad font, want a ResourceError for it", err)
+	}
+}
+
+func TestFontInfo(t *testing.T) {
+	withFSType := func(font []byte, fsType FontEmbedding) []byte {
+		tables, err := fontTables(font)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(tables["OS/2"][8:], uint16(fsType))
+		return font
+	}
+
+	e := simpleBook(t)
+	id, err := e.AddFont("fonts/a.otf", withFSType(testFont("Book Serif", "Bold Italic", 700, true), EmbedEditable|EmbedNoSubsetting))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := e.FontInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FontInfo{Family: "Book Serif", Subfamily: "Bold Italic", Weight: 700, Italic: true, Embedding: EmbedEditable | EmbedNoSubsetting}); fi != want {
+		t.Errorf("FontInfo() = %+v, want %+v", fi, want)
+	}
+	if fi.Embedding.Installable() || fi.Embedding.Restricted() || fi.Embedding.PreviewPrint() {
+		t.Errorf("editable font embedding %#x misreported", fi.Embedding)
+	}
+	if len(e.Warnings()) != 0 {
+		t.Errorf("Warnings() = %q for an editable font", e.Warnings())
+	}
+
+	if _, err := e.AddFont("fonts/r.otf", withFSType(testFont("Locked", "Regular", 400, false), EmbedRestricted)); !errors.Is(err, ErrRestrictedFont) {
+		t.Errorf("AddFont() = %v for a restricted font, want ErrRestrictedFont", err)
+	}
+	// Fonts with a less restrictive bit set as well have that
+	// permission.
+	if _, err := e.AddFont("fonts/p.otf", withFSType(testFont("Preview", "Regular", 400, false), EmbedRestricted|EmbedPreviewPrint)); err != nil {
+		t.Errorf("AddFont() = %v for a preview and print font", err)
+	}
+	if w := e.Warnings(); len(w) != 1 || !strings.Contains(w[0], "fonts/p.otf") {
+		t.Errorf("Warnings() = %q, want a warning for the preview and print font", w)
+	}
+
+	id, _ = e.AddFont("fonts/bad.otf", []byte("font"))
+	var re *ResourceError
+	if _, err := e.FontInfo(id); !errors.As(err, &re) || re.Op != "decode" {
+		t.Errorf("FontInfo() = %v for a bad font, want a decode ResourceError", err)
+	}
+	if _, err := e.FontInfo("nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FontInfo() = %v for a missing font, want ErrNotFound", err)
+	}
+}
+
+func TestSetLanguageStyle(t *testing.T) {
+	inLanguage := func(lang, body string) string {
+		return strings.Replace(xhtmlPage("A", body), "<html ", `<html xml:lang="`+lang+`" `, 1)
+	}
+	e := simpleBook(t)
+	e.SetLanguageDefaults(true)
+	e.AddXHTML("b.xhtml", inLanguage("ja", "<p>日本語</p>"))
+	e.AddXHTML("c.xhtml", inLanguage("zh-Hant", "<p>中文</p>"))
+	e.AddXHTML("d.xhtml", inLanguage("he", "<p>עברית</p>"))
+	font, err := e.AddFont("fonts/Ming.otf", testFont("Book Ming", "Regular", 400, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.SetLanguageStyle("zh", LanguageStyle{Font: font, FontFamily: "serif", LineHeight: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct {
+		lang  string
+		style LanguageStyle
+	}{{"not a tag", LanguageStyle{}}, {"ko", LanguageStyle{LineHeight: "2; color: red"}}, {"ko", LanguageStyle{Font: "nonesuch"}}} {
+		if _, err := e.SetLanguageStyle(s.lang, s.style); err == nil {
+			t.Errorf("SetLanguageStyle(%q, %+v) succeeded", s.lang, s.style)
+		}
+	}
+	var book []byte
+	for i := 0; i < 2; i++ {
+		if book, err = e.Serialize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(e.styles); n != 3 {
+		t.Errorf("book has %v stylesheets after writing it twice, want 3", n)
+	}
+	if got := zipFile(t, book, "OPS/css/lang-ja.css"); !strings.Contains(got, `"Noto Serif CJK JP", serif;`) || !strings.Contains(got, "  writing-mode: horizontal-tb;\n") {
+		t.Errorf("default Japanese stylesheet is\n%s", got)
+	}
+	want := `@font-face {
+  font-family: "Book Ming";
+  font-weight: 400;
+  font-style: normal;
+  src: url("../fonts/Ming.otf") format("opentype");
+}
+
+body {
+  font-family: "Book Ming", serif;
+  line-height: 2;
+}
+`
+	if got := zipFile(t, book, "OPS/css/lang-zh.css"); got != want {
+		t.Errorf("Chinese stylesheet = %s, want %s", got, want)
+	}
+	for name, want := range map[string]string{"b.xhtml": "css/lang-ja.css", "c.xhtml": "css/lang-zh.css", "d.xhtml": "css/lang-he.css"} {
+		if got := zipFile(t, book, "OPS/"+name); !strings.Contains(got, `<link rel="stylesheet" type="text/css" href="`+want+`" />`) {
+			t.Errorf("%v doesn't link %v:\n%s", name, want, got)
+		}
+	}
+	if got := zipFile(t, book, "OPS/a.xhtml"); strings.Contains(got, "css/lang-") {
+		t.Errorf("English file links a language stylesheet:\n%s", got)
+	}
+}
+
+func TestDefaultLanguageStyle(t *testing.T) {
+	for lang, want := range map[string]string{"ja": "1.75", "zh-Hant": "1.75", "ur-PK": "2.2", "HE": "1.6"} {
+		if s, ok := DefaultLanguageStyle(lang); !ok || s.LineHeight != want || s.FontFamily == "" {
+			t.Errorf("DefaultLanguageStyle(%q) = %+v, %v, want line height %v", lang, s, ok, want)
+		}
+	}
+	for _, lang := range []string{"en", "fr-CA", ""} {
+		if s, ok := DefaultLanguageStyle(lang); ok {
+			t.Errorf("DefaultLanguageStyle(%q) = %+v, want none", lang, s)
+		}
+	}
+}
+
+func TestSetFontObfuscation(t *testing.T) {
+	e := simpleBook(t)
+	font := testFont("Book Serif", "Regular", 400, false)
+	fid, err := e.AddFont("fonts/Serif.otf", font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iid, err := e.AddImage("images/a.png", testPNG(t, 4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetEncryption("nope", &Encryption{Algorithm: "x"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetEncryption(nope) = %v, want ErrNotFound", err)
+	}
+	e.SetFontObfuscation(true)
+	lcp := &Encryption{
+		Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc",
+		KeyURI:    "license.lcpl#/encryption/content_key",
+		KeyType:   "http://readium.org/2014/01/lcp#EncryptedContentKey",
+	}
+	if err := e.SetEncryption(iid, lcp); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"mimetype", "META-INF/container.xml", "META-INF/encryption.xml"} {
+		if z.File[i].Name != want {
+			t.Errorf("zip entry %v is %v, want %v", i, z.File[i].Name, want)
+		}
+	}
+	enc := zipFile(t, b, "META-INF/encryption.xml")
+	for _, want := range []string{
+		`<enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding" />
+    <enc:CipherData>
+      <enc:CipherReference URI="OPS/fonts/Serif.otf" />`,
+		`<ds:RetrievalMethod URI="license.lcpl#/encryption/content_key" Type="http://readium.org/2014/01/lcp#EncryptedContentKey" />`,
+		`<enc:CipherReference URI="OPS/images/a.png" />`,
+	} {
+		if !strings.Contains(enc, want) {
+			t.Errorf("encryption.xml doesn't contain %q:\n%s", want, enc)
+		}
+	}
+	got := []byte(zipFile(t, b, "OPS/fonts/Serif.otf"))
+	if bytes.Equal(got, font) {
+		t.Errorf("font wasn't obfuscated")
+	}
+	if !bytes.Equal(e.obfuscate(got), font) {
+		t.Errorf("deobfuscated font differs from the original")
+	}
+
+	p, err := e.ManifestPreview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range p.Items {
+		switch {
+		case i.ID == fid && (i.Encryption == nil || i.Encryption.Algorithm != fontObfuscation):
+			t.Errorf("font's manifest item encryption = %+v", i.Encryption)
+		case i.ID == iid && (i.Encryption == nil || *i.Encryption != *lcp):
+			t.Errorf("image's manifest item encryption = %+v", i.Encryption)
+		case i.ID != fid && i.ID != iid && i.Encryption != nil:
+			t.Errorf("%v is encrypted", i.ID)
+		}
+	}
+
+	if err := e.SetZipPath(iid, "META-INF/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Serialize(); err == nil {
+		t.Errorf("Serialize with an encrypted file under META-INF succeeded")
+	}
+}
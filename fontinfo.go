@@ -0,0 +1,222 @@
+package epub
+
+// This file holds the code that reads the names, style, and embedding
+// permissions of the book's fonts.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// FontInfo describes a font that's been added to the book, as read
+// from its name and OS/2 tables.
+type FontInfo struct {
+	// Family and Subfamily are the font's family and style names, such
+	// as "Minion Pro" and "Bold Italic".
+	Family    string
+	Subfamily string
+	// Weight is the font's CSS weight, from 100 to 900 for most fonts.
+	Weight int
+	// Italic is true for italic and oblique fonts.
+	Italic bool
+	// Embedding is the font's embedding permissions, its OS/2 fsType.
+	Embedding FontEmbedding
+}
+
+// FontEmbedding holds the embedding permission bits of a font, as set
+// by its foundry in the fsType field of its OS/2 table.
+type FontEmbedding uint16
+
+const (
+	// EmbedRestricted fonts may not be embedded in documents at all.
+	EmbedRestricted FontEmbedding = 0x0002
+	// EmbedPreviewPrint fonts may be embedded in documents that are
+	// only viewed or printed, not edited.
+	EmbedPreviewPrint FontEmbedding = 0x0004
+	// EmbedEditable fonts may be embedded in documents that are
+	// edited.
+	EmbedEditable FontEmbedding = 0x0008
+	// EmbedNoSubsetting fonts may only be embedded whole.
+	EmbedNoSubsetting FontEmbedding = 0x0100
+	// EmbedBitmapOnly fonts may only have their bitmaps embedded.
+	EmbedBitmapOnly FontEmbedding = 0x0200
+)
+
+// Installable reports whether the font may be embedded without
+// restriction: none of the usage permission bits are set.
+func (f FontEmbedding) Installable() bool {
+	return f&(EmbedRestricted|EmbedPreviewPrint|EmbedEditable) == 0
+}
+
+// Restricted reports whether the font may not be embedded. Fonts that
+// also set a less restrictive permission bit are treated as having
+// that permission, as the OpenType specification says.
+func (f FontEmbedding) Restricted() bool {
+	return f&EmbedRestricted != 0 && f&(EmbedPreviewPrint|EmbedEditable) == 0
+}
+
+// PreviewPrint reports whether the font may only be embedded in
+// documents that are viewed or printed.
+func (f FontEmbedding) PreviewPrint() bool {
+	return f&EmbedPreviewPrint != 0 && f&EmbedEditable == 0
+}
+
+// FontInfo returns the names, style, and embedding permissions of a
+// font in the book.
+func (e *EPub) FontInfo(id Id) (FontInfo, error) {
+	for _, f := range e.fonts {
+		if f.id == id {
+			fi, err := readFontInfo(f.contents)
+			if err != nil {
+				return FontInfo{}, &ResourceError{Op: "decode", Path: f.name, Err: err}
+			}
+			return fi, nil
+		}
+	}
+	return FontInfo{}, errorf(ErrNotFound, "no font with id %v", id)
+}
+
+// fontWarnings returns warnings for fonts whose embedding permissions
+// forbid or limit embedding them in the book. Only books read with
+// Open can have fonts that forbid embedding, since AddFont refuses
+// them.
+func (e *EPub) fontWarnings() []string {
+	var warnings []string
+	for _, f := range e.fonts {
+		fi, err := readFontInfo(f.contents)
+		if err != nil {
+			continue
+		}
+		switch {
+		case fi.Embedding.Restricted():
+			warnings = append(warnings, fmt.Sprintf("font %v (%v %v) has a restricted license that forbids embedding it", f.name, fi.Family, fi.Subfamily))
+		case fi.Embedding.PreviewPrint():
+			warnings = append(warnings, fmt.Sprintf("font %v (%v %v) may only be embedded in documents that can't be edited; check its license allows ebooks", f.name, fi.Family, fi.Subfamily))
+		case fi.Embedding&EmbedBitmapOnly != 0:
+			warnings = append(warnings, fmt.Sprintf("font %v (%v %v) may only have its bitmaps embedded", f.name, fi.Family, fi.Subfamily))
+		}
+	}
+	return warnings
+}
+
+// fontTables returns the tables of an OpenType font, by tag.
+func fontTables(c []byte) (map[string][]byte, error) {
+	if len(c) < 12 {
+		return nil, errors.New("font is truncated")
+	}
+	switch string(c[:4]) {
+	case "OTTO", "\x00\x01\x00\x00", "true":
+	default:
+		return nil, errors.New("not an OpenType font")
+	}
+	n := int(binary.BigEndian.Uint16(c[4:]))
+	if len(c) < 12+16*n {
+		return nil, errors.New("font table directory is truncated")
+	}
+	tables := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		r := c[12+16*i:]
+		off, length := binary.BigEndian.Uint32(r[8:]), binary.BigEndian.Uint32(r[12:])
+		if uint64(off)+uint64(length) > uint64(len(c)) {
+			return nil, fmt.Errorf("font table %q is truncated", r[:4])
+		}
+		tables[string(r[:4])] = c[off : off+length]
+	}
+	return tables, nil
+}
+
+// readFontInfo reads the names, weight, style, and embedding
+// permissions of an OpenType font. The typographic family and
+// subfamily names are preferred to the legacy ones, which only allow
+// four styles per family. If the font has no OS/2 table the weight
+// and style are guessed from the subfamily name, and embedding is
+// taken to be allowed.
+func readFontInfo(c []byte) (FontInfo, error) {
+	tables, err := fontTables(c)
+	if err != nil {
+		return FontInfo{}, err
+	}
+	names, err := fontNames(tables["name"])
+	if err != nil {
+		return FontInfo{}, err
+	}
+	fi := FontInfo{Family: names[16], Subfamily: names[17], Weight: 400}
+	if fi.Family == "" {
+		fi.Family = names[1]
+	}
+	if fi.Family == "" {
+		return FontInfo{}, errors.New("font has no family name")
+	}
+	if fi.Subfamily == "" {
+		fi.Subfamily = names[2]
+	}
+	if os2 := tables["OS/2"]; len(os2) >= 64 {
+		if w := int(binary.BigEndian.Uint16(os2[4:])); w >= 1 && w <= 1000 {
+			fi.Weight = w
+		}
+		fi.Embedding = FontEmbedding(binary.BigEndian.Uint16(os2[8:]))
+		// fsSelection bits 0 and 9 mark italic and oblique fonts.
+		fi.Italic = binary.BigEndian.Uint16(os2[62:])&(1<<0|1<<9) != 0
+		return fi, nil
+	}
+	sub := strings.ToLower(strings.Replace(fi.Subfamily, " ", "", -1))
+	for _, w := range subfamilyWeights {
+		if strings.Contains(sub, w.name) {
+			fi.Weight = w.weight
+			break
+		}
+	}
+	fi.Italic = strings.Contains(sub, "italic") || strings.Contains(sub, "oblique")
+	return fi, nil
+}
+
+// subfamilyWeights are the weights of fonts whose subfamily names
+// contain the given words, checked in order so "semibold" isn't taken
+// for "bold".
+var subfamilyWeights = []struct {
+	name   string
+	weight int
+}{
+	{"extralight", 200}, {"ultralight", 200}, {"semibold", 600}, {"demibold", 600},
+	{"extrabold", 800}, {"ultrabold", 800}, {"thin", 100}, {"light", 300},
+	{"medium", 500}, {"bold", 700}, {"black", 900}, {"heavy", 900},
+}
+
+// fontNames returns the English names in a font's name table, by name
+// ID. Windows Unicode names are preferred to Macintosh Roman ones.
+func fontNames(t []byte) (map[int]string, error) {
+	if len(t) < 6 {
+		return nil, errors.New("font has no name table")
+	}
+	n, base := int(binary.BigEndian.Uint16(t[2:])), int(binary.BigEndian.Uint16(t[4:]))
+	if len(t) < 6+12*n {
+		return nil, errors.New("font name table is truncated")
+	}
+	names := make(map[int]string)
+	for i := 0; i < n; i++ {
+		r := t[6+12*i:]
+		platform, encoding, lang := binary.BigEndian.Uint16(r), binary.BigEndian.Uint16(r[2:]), binary.BigEndian.Uint16(r[4:])
+		id := int(binary.BigEndian.Uint16(r[6:]))
+		length, off := int(binary.BigEndian.Uint16(r[8:])), base+int(binary.BigEndian.Uint16(r[10:]))
+		if off+length > len(t) {
+			continue
+		}
+		s := t[off : off+length]
+		switch {
+		case platform == 3 && (encoding == 1 || encoding == 10) && lang == 0x409:
+			u := make([]uint16, len(s)/2)
+			for j := range u {
+				u[j] = binary.BigEndian.Uint16(s[2*j:])
+			}
+			names[id] = string(utf16.Decode(u))
+		case platform == 1 && encoding == 0 && lang == 0:
+			if _, ok := names[id]; !ok {
+				names[id] = string(s)
+			}
+		}
+	}
+	return names, nil
+}
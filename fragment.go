@@ -0,0 +1,155 @@
+package epub
+
+// This file holds the helpers that turn snippets of HTML into
+// complete XHTML pages.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// Fragment wraps a snippet of HTML body content, such as
+// "<h1>Notes</h1><p>Some notes&hellip;", in a complete XHTML document
+// with the given title, for callers that generate pages from small
+// pieces. Path is where the page will go in the book, which links are
+// made relative to.
+//
+// The snippet is parsed leniently and written back out as well-formed
+// XHTML: unclosed elements are closed, void elements such as br are
+// self-closed, HTML entities are replaced by the characters they name,
+// and attributes are quoted. The page gets the DOCTYPE of the book's
+// content profile (see SetContentProfile), language attributes from
+// the book's first language, and links to the stylesheets added with
+// options. The snippet isn't otherwise filtered; see SetSanitizer for
+// untrusted input.
+func (e *EPub) Fragment(path, title, snippet string) ([]byte, error) {
+	body, err := fragmentXHTML(snippet)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse fragment: %w", err)
+	}
+	page := []byte(e.XHTMLPage(title, body))
+	page = addLanguage(page, e.language(), e.bookProfile(e.version))
+	return e.linkStylesheets(path, page), nil
+}
+
+// AddFragment wraps a snippet of HTML in a page with Fragment and adds
+// it to the book at path, as with AddXHTML.
+//
+// Returns the ID of the added file, or an error if something went
+// wrong.
+func (e *EPub) AddFragment(path, title, snippet string, order ...int) (Id, error) {
+	c, err := e.Fragment(path, title, snippet)
+	if err != nil {
+		return "", err
+	}
+	return e.addXHTML(path, c, order...)
+}
+
+// htmlVoidElements are the HTML elements that never have content.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// closesP are the elements whose start tags end an open p element.
+var closesP = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "div": true, "dl": true,
+	"figure": true, "footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "header": true, "hr": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "ul": true,
+}
+
+// impliesEnd reports whether a start tag for next ends an open
+// element top, as HTML's optional end tags allow.
+func impliesEnd(top, next string) bool {
+	top, next = strings.ToLower(top), strings.ToLower(next)
+	switch top {
+	case "p":
+		return closesP[next]
+	case "li":
+		return next == "li"
+	case "dt", "dd":
+		return next == "dt" || next == "dd"
+	}
+	return false
+}
+
+// fragmentXHTML parses a snippet of HTML leniently and returns it as
+// well-formed XHTML.
+func fragmentXHTML(snippet string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader("<fragment>" + snippet + "</fragment>"))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	var b strings.Builder
+	var open []string
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := fragmentName(t.Name)
+			if len(open) == 0 {
+				open = append(open, name)
+				continue
+			}
+			// As in HTML, some start tags end the element before them.
+			if top := open[len(open)-1]; len(open) > 1 && impliesEnd(top, name) {
+				b.WriteString("</" + top + ">")
+				open = open[:len(open)-1]
+			}
+			b.WriteString("<" + name)
+			for _, a := range t.Attr {
+				b.WriteString(" " + attrPair(fragmentName(a.Name), a.Value))
+			}
+			if htmlVoidElements[strings.ToLower(name)] {
+				// Void elements get no end tag of their own, though the
+				// decoder may make one up.
+				b.WriteString(" />")
+				continue
+			}
+			b.WriteString(">")
+			open = append(open, name)
+		case xml.EndElement:
+			name := fragmentName(t.Name)
+			if htmlVoidElements[strings.ToLower(name)] {
+				continue
+			}
+			// Close everything back to the matching start tag; stray
+			// end tags are dropped.
+			for i := len(open) - 1; i > 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				for len(open) > i {
+					b.WriteString("</" + open[len(open)-1] + ">")
+					open = open[:len(open)-1]
+				}
+				break
+			}
+		case xml.CharData:
+			b.WriteString(html.EscapeString(string(t)))
+		}
+	}
+	for len(open) > 1 {
+		b.WriteString("</" + open[len(open)-1] + ">")
+		open = open[:len(open)-1]
+	}
+	return b.String(), nil
+}
+
+// fragmentName returns the name of an element or attribute as written,
+// with its prefix if it has one.
+func fragmentName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
@@ -0,0 +1,93 @@
+package epub
+
+// This file holds the code that reads the files books are built from,
+// from the operating system, an fs.FS such as an embed.FS, or any
+// io.Reader.
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// WithFS makes the book read the source files named in the Add*File
+// methods and in AddAll requests from fsys rather than the operating
+// system's file system, so books can be built from assets embedded
+// with go:embed. Names are then fs.FS names: slash-separated and
+// relative to the root of fsys, such as "assets/cover.jpg".
+func WithFS(fsys fs.FS) Option {
+	return func(e *EPub) {
+		e.fsys = fsys
+	}
+}
+
+// readSource reads the named source file, from the file system set
+// with WithFS if there is one, and returns its contents and
+// modification time. The time is zero if it isn't known.
+func (e *EPub) readSource(name string) ([]byte, time.Time, error) {
+	if e.fsys == nil {
+		c, err := os.ReadFile(name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var t time.Time
+		if fi, err := os.Stat(name); err == nil {
+			t = fi.ModTime()
+		}
+		return c, t, nil
+	}
+	c, err := fs.ReadFile(e.fsys, name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var t time.Time
+	if fi, err := fs.Stat(e.fsys, name); err == nil {
+		t = fi.ModTime()
+	}
+	return c, t, nil
+}
+
+// AddReader reads a file of the given kind from r and adds it to the
+// book as dest, as the kind's Add method does; order is the spine
+// order for XHTML files, as with AddXHTML. If r is an fs.File or an
+// *os.File, the resource gets the file's modification time (see
+// SetModTime).
+//
+// Returns the ID of the added file, or an error if something went
+// wrong reading or adding it.
+func (e *EPub) AddReader(kind ResourceKind, r io.Reader, dest string, order ...int) (Id, error) {
+	c, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	var id Id
+	switch kind {
+	case KindImage:
+		id, err = e.AddImage(dest, c)
+	case KindXHTML:
+		id, err = e.addXHTML(dest, c, order...)
+	case KindStylesheet:
+		id, err = e.addStylesheet(dest, c, nil)
+	case KindJavaScript:
+		id, err = e.addJavaScript(dest, c, nil)
+	case KindFont:
+		id, err = e.AddFont(dest, c)
+	case KindAudio:
+		id, err = e.AddAudio(dest, c)
+	case KindVideo:
+		id, err = e.AddVideo(dest, c)
+	default:
+		err = fmt.Errorf("unknown resource kind %v", kind)
+	}
+	if err != nil {
+		return "", err
+	}
+	if f, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil && !fi.ModTime().IsZero() {
+			e.SetModTime(id, fi.ModTime())
+		}
+	}
+	return id, nil
+}
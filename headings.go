@@ -0,0 +1,150 @@
+package epub
+
+// This file holds the code that gives headings IDs, so the table of
+// contents and cross-references can link to them.
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Slug turns heading text into an ID, such as "chapter-1-the-storm"
+// for "Chapter 1: The Storm". Letters and digits are lowercased and
+// kept, other runs of characters become single hyphens, and IDs that
+// wouldn't start with a letter get an "h-" prefix, since XML IDs
+// can't start with a digit. It's the default for SetHeadingIDs.
+func Slug(text string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	s := b.String()
+	if s == "" {
+		return "section"
+	}
+	if r := []rune(s)[0]; !unicode.IsLetter(r) {
+		s = "h-" + s
+	}
+	return s
+}
+
+// HeadingAnchor is a heading in the book that can be linked to.
+type HeadingAnchor struct {
+	// Path is the path of the XHTML file in the book, as given to
+	// AddXHTML.
+	Path string
+	// ID is the heading's ID; Path#ID links to it.
+	ID    string
+	Level int
+	Text  string
+}
+
+// SetHeadingIDs gives every h1 to h6 heading without an ID one when
+// the book is written, made by slug from the heading's text, so the
+// table of contents, cross-references, and external tools can link to
+// them. Pass Slug for the default IDs. Colliding IDs are numbered
+// ("notes", "notes-2", and so on), avoiding IDs already in the file,
+// so the IDs are stable as long as the file's headings don't change.
+// Passing nil turns this off again.
+//
+// The ImportDOCX and ImportLaTeX importers always use Slug for the
+// headings their navpoints point at.
+func (e *EPub) SetHeadingIDs(slug func(string) string) {
+	e.headingSlug = slug
+}
+
+// HeadingAnchors returns the book's headings in spine order, with the
+// IDs they'll have when the book is written. Headings that don't have
+// an ID, and won't be given one because SetHeadingIDs wasn't called,
+// are left out.
+func (e *EPub) HeadingAnchors() []HeadingAnchor {
+	var anchors []HeadingAnchor
+	for _, x := range e.spineOrder() {
+		_, a := addHeadingIDs(x.contents, e.headingSlug)
+		for i := range a {
+			a[i].Path = x.name
+		}
+		anchors = append(anchors, a...)
+	}
+	return anchors
+}
+
+var (
+	headingRE = regexp.MustCompile(`(?is)<h([1-6])\b([^>]*)>(.*?)</h[1-6]\s*>`)
+	idAttrRE  = regexp.MustCompile(`\sid\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// addHeadingIDs returns XHTML contents with IDs made by slug added to
+// headings that don't have one, along with the file's headings. If
+// slug is nil, the contents are returned unchanged and only headings
+// that already have IDs are returned.
+func addHeadingIDs(c []byte, slug func(string) string) ([]byte, []HeadingAnchor) {
+	used := make(map[string]bool)
+	for _, m := range idAttrRE.FindAllSubmatch(c, -1) {
+		used[string(m[1])+string(m[2])] = true
+	}
+	s := &slugger{slug: slug, used: used}
+	var anchors []HeadingAnchor
+	var b bytes.Buffer
+	last := 0
+	for _, loc := range headingRE.FindAllSubmatchIndex(c, -1) {
+		level, _ := strconv.Atoi(string(c[loc[2]:loc[3]]))
+		attrs := c[loc[4]:loc[5]]
+		text := headingText(string(c[loc[6]:loc[7]]))
+		if m := idAttrRE.FindSubmatch(attrs); m != nil {
+			anchors = append(anchors, HeadingAnchor{ID: string(m[1]) + string(m[2]), Level: level, Text: text})
+			continue
+		}
+		if slug == nil {
+			continue
+		}
+		id := s.id(text)
+		anchors = append(anchors, HeadingAnchor{ID: id, Level: level, Text: text})
+		b.Write(c[last:loc[5]])
+		b.WriteString(" " + attrPair("id", id))
+		last = loc[5]
+	}
+	if last == 0 {
+		return c, anchors
+	}
+	b.Write(c[last:])
+	return b.Bytes(), anchors
+}
+
+// headingText returns the plain text of a heading's XHTML contents.
+func headingText(h string) string {
+	return strings.TrimSpace(spaceRE.ReplaceAllString(html.UnescapeString(tagRE.ReplaceAllString(h, "")), " "))
+}
+
+// slugger hands out unique IDs made from text.
+type slugger struct {
+	slug func(string) string
+	used map[string]bool // IDs already in use
+}
+
+// id returns a unique ID for text.
+func (s *slugger) id(text string) string {
+	base := s.slug(text)
+	if base == "" {
+		base = "section"
+	}
+	id := base
+	for n := 2; s.used[id]; n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	s.used[id] = true
+	return id
+}
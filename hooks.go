@@ -0,0 +1,59 @@
+package epub
+
+// This file holds the hooks callers can register to customize how the
+// book is written.
+
+// OnBeforeWrite registers a function that's called with the book each
+// time it's written with Write, Serialize, or their version-specific
+// and dual forms, before it's validated. It can make last-minute
+// changes to the book, such as adding a generated page; returning an
+// error stops the book being written, and the error is returned.
+// Hooks are called in the order they were registered.
+func (e *EPub) OnBeforeWrite(hook func(*EPub) error) {
+	e.beforeWrite = append(e.beforeWrite, hook)
+}
+
+// OnResourceWrite registers a function that transforms the book's
+// files as they're written, such as to insert an analytics snippet
+// into every XHTML file or make final text replacements. It's called
+// with each file's path in the archive, such as "OPS/chapter1.xhtml",
+// and its contents as they'd otherwise be written, after everything
+// this package does to them, and returns the contents to write
+// instead. The contents passed in must not be modified; return a new
+// slice to change them. Returning an error stops the book being
+// written, and the error is returned as a *ResourceError.
+//
+// The files this package generates, such as the package document and
+// tables of contents, aren't passed to the hook. Hooks are called in
+// the order they were registered, each with the output of the one
+// before.
+func (e *EPub) OnResourceWrite(hook func(path string, data []byte) ([]byte, error)) {
+	e.resourceWrite = append(e.resourceWrite, hook)
+}
+
+// runBeforeWrite calls the book's OnBeforeWrite hooks, then adds the
+// default language styles it needs, so that hooks that add files get
+// them styled too.
+func (e *EPub) runBeforeWrite() error {
+	for _, h := range e.beforeWrite {
+		if err := h(e); err != nil {
+			return err
+		}
+	}
+	return e.addLanguageDefaults()
+}
+
+// transformEntries passes entries through the book's OnResourceWrite
+// hooks.
+func (e *EPub) transformEntries(entries []zipEntry) ([]zipEntry, error) {
+	for i := range entries {
+		for _, h := range e.resourceWrite {
+			c, err := h(entries[i].name, entries[i].contents)
+			if err != nil {
+				return nil, &ResourceError{Op: "transform", Path: entries[i].name, Err: err}
+			}
+			entries[i].contents = c
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,351 @@
+package epub
+
+// This file holds the pass that inserts soft hyphens into the text of
+// XHTML files, for reading systems that can't hyphenate by
+// themselves.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Hyphenator finds the places words in a language can be hyphenated.
+// NewPatternHyphenator returns one that uses TeX hyphenation patterns.
+type Hyphenator interface {
+	// Hyphenate returns the byte offsets in word at which it may be
+	// broken with a hyphen, in increasing order.
+	Hyphenate(word string) []int
+}
+
+// patternHyphenator hyphenates words with Liang's algorithm, as TeX
+// does.
+type patternHyphenator struct {
+	patterns   map[string][]int // Each pattern's values, by its letters
+	maxLen     int              // The length of the longest pattern, in runes
+	exceptions map[string][]int
+	// The fewest letters left before and after a hyphen.
+	leftMin, rightMin int
+}
+
+var (
+	texPatternsRE   = regexp.MustCompile(`\\patterns\s*\{([^}]*)\}`)
+	texExceptionsRE = regexp.MustCompile(`\\hyphenation\s*\{([^}]*)\}`)
+)
+
+// NewPatternHyphenator returns a Hyphenator that uses Liang's
+// algorithm, as TeX does, with the given hyphenation patterns, such as
+// "hy3ph" and ".ach4", and exceptions, which are words written with
+// their hyphens, such as "ta-ble". Words are broken leaving at least
+// leftMin letters before the hyphen and rightMin after it; TeX uses 2
+// and 3 for English.
+//
+// Patterns and exceptions are separated by whitespace, as in the
+// .pat.txt and .hyp.txt files of the hyph-utf8 project, which has
+// patterns for most languages. TeX pattern files, such as
+// hyph-en-us.tex, can be passed as patterns as they are; their
+// comments are ignored, and the contents of their \patterns and
+// \hyphenation commands are used.
+func NewPatternHyphenator(patterns, exceptions string, leftMin, rightMin int) (Hyphenator, error) {
+	if leftMin < 1 || rightMin < 1 {
+		return nil, fmt.Errorf("leftMin and rightMin must be at least 1, not %v and %v", leftMin, rightMin)
+	}
+	h := &patternHyphenator{
+		patterns:   make(map[string][]int),
+		exceptions: make(map[string][]int),
+		leftMin:    leftMin,
+		rightMin:   rightMin,
+	}
+	patterns = texCommentRE.ReplaceAllString(patterns, "$1")
+	if m := texPatternsRE.FindAllStringSubmatch(patterns, -1); m != nil {
+		var pats, excs []string
+		for _, p := range m {
+			pats = append(pats, p[1])
+		}
+		for _, e := range texExceptionsRE.FindAllStringSubmatch(patterns, -1) {
+			excs = append(excs, e[1])
+		}
+		patterns = strings.Join(pats, "\n")
+		exceptions = strings.Join(append(excs, exceptions), "\n")
+	}
+	for _, p := range strings.Fields(patterns) {
+		var letters []rune
+		values := []int{0}
+		for _, r := range strings.ToLower(p) {
+			if r >= '0' && r <= '9' {
+				values[len(values)-1] = int(r - '0')
+				continue
+			}
+			letters = append(letters, r)
+			values = append(values, 0)
+		}
+		if len(letters) == 0 {
+			return nil, fmt.Errorf("hyphenation pattern %q has no letters", p)
+		}
+		h.patterns[string(letters)] = values
+		if len(letters) > h.maxLen {
+			h.maxLen = len(letters)
+		}
+	}
+	if len(h.patterns) == 0 {
+		return nil, fmt.Errorf("no hyphenation patterns")
+	}
+	for _, x := range strings.Fields(exceptions) {
+		var word strings.Builder
+		var offsets []int
+		for _, r := range strings.ToLower(x) {
+			if r == '-' {
+				offsets = append(offsets, word.Len())
+				continue
+			}
+			word.WriteRune(r)
+		}
+		h.exceptions[word.String()] = offsets
+	}
+	return h, nil
+}
+
+func (h *patternHyphenator) Hyphenate(word string) []int {
+	runes := []rune(word)
+	if len(runes) < h.leftMin+h.rightMin {
+		return nil
+	}
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	if offsets, ok := h.exceptions[string(lower)]; ok {
+		// Exceptions' offsets are into the lower-cased word, which
+		// may not be the same length as the word itself.
+		var ret []int
+		for _, o := range offsets {
+			n := utf8.RuneCountInString(string(lower)[:o])
+			ret = append(ret, len(string(runes[:n])))
+		}
+		return ret
+	}
+
+	// points[i] is the highest value any pattern gives the gap before
+	// s[i], where s is the word with its boundaries marked.
+	s := append(append([]rune{'.'}, lower...), '.')
+	points := make([]int, len(s)+1)
+	for i := range s {
+		for j := i + 1; j <= len(s) && j-i <= h.maxLen; j++ {
+			values, ok := h.patterns[string(s[i:j])]
+			if !ok {
+				continue
+			}
+			for k, v := range values {
+				if v > points[i+k] {
+					points[i+k] = v
+				}
+			}
+		}
+	}
+	var ret []int
+	offset := 0
+	for i, r := range runes {
+		// The gap before runes[i] is the gap before s[i+1].
+		if i >= h.leftMin && i <= len(runes)-h.rightMin && points[i+1]%2 == 1 {
+			ret = append(ret, offset)
+		}
+		offset += utf8.RuneLen(r)
+	}
+	return ret
+}
+
+// SetHyphenation makes the book insert soft hyphens into the text of
+// its XHTML files in a language, such as "en" or "de-CH", at the
+// places h finds, when it's written. Reading systems that don't
+// hyphenate text themselves, as many e-ink readers don't, break lines
+// at soft hyphens, which makes justified text much less gappy. A
+// file's language is found as for SetLanguageStyle, and hyphenation
+// for a language applies to its more specific tags too. Passing a nil
+// Hyphenator turns hyphenation off for the language again.
+//
+// Only words in text are hyphenated, not attribute values, and the
+// contents of the head and of code, pre, kbd, samp, script, style,
+// math, and svg elements are left alone, as are words that already
+// have soft hyphens, or have digits in them. The files the book holds
+// aren't changed.
+func (e *EPub) SetHyphenation(lang string, h Hyphenator) error {
+	if !languageTagRE.MatchString(lang) {
+		return fmt.Errorf("%q is not a language tag", lang)
+	}
+	key := strings.ToLower(lang)
+	if h == nil {
+		delete(e.hyphenators, key)
+		return nil
+	}
+	if e.hyphenators == nil {
+		e.hyphenators = make(map[string]Hyphenator)
+	}
+	e.hyphenators[key] = h
+	return nil
+}
+
+// hyphenator returns the Hyphenator for text in lang, if there is one.
+func (e *EPub) hyphenator(lang string) Hyphenator {
+	for _, l := range languageFallbacks(lang) {
+		if h, ok := e.hyphenators[l]; ok {
+			return h
+		}
+	}
+	return nil
+}
+
+// noHyphenation holds the elements whose contents aren't hyphenated.
+var noHyphenation = map[string]bool{
+	"head": true, "code": true, "pre": true, "kbd": true, "samp": true,
+	"script": true, "style": true, "math": true, "svg": true,
+}
+
+// softHyphen is the character inserted where words may be hyphenated.
+const softHyphen = "\u00ad"
+
+// hyphenate inserts soft hyphens into the words in the text of the
+// XHTML contents c, if the book hyphenates their language.
+func (e *EPub) hyphenate(c []byte) []byte {
+	if len(e.hyphenators) == 0 {
+		return c
+	}
+	lang := contentLanguage(c)
+	if lang == "" {
+		lang = e.language()
+	}
+	h := e.hyphenator(lang)
+	if h == nil {
+		return c
+	}
+	var b bytes.Buffer
+	b.Grow(len(c) + len(c)/8)
+	skip := 0 // The depth of elements whose contents are left alone
+	for len(c) > 0 {
+		i := bytes.IndexByte(c, '<')
+		if i < 0 {
+			i = len(c)
+		}
+		if skip == 0 {
+			hyphenateText(&b, c[:i], h)
+		} else {
+			b.Write(c[:i])
+		}
+		c = c[i:]
+		if len(c) == 0 {
+			break
+		}
+		end := markupEnd(c)
+		tag := c[:end]
+		c = c[end:]
+		b.Write(tag)
+		name, closing, empty := tagName(tag)
+		if !noHyphenation[name] || empty {
+			continue
+		}
+		if closing {
+			if skip > 0 {
+				skip--
+			}
+		} else {
+			skip++
+		}
+	}
+	return b.Bytes()
+}
+
+// markupEnd returns the length of the markup at the start of c, which
+// starts with "<": a tag, comment, CDATA section, processing
+// instruction, or declaration.
+func markupEnd(c []byte) int {
+	for _, d := range []struct{ start, end string }{{"<!--", "-->"}, {"<![CDATA[", "]]>"}, {"<?", "?>"}} {
+		if bytes.HasPrefix(c, []byte(d.start)) {
+			if i := bytes.Index(c[len(d.start):], []byte(d.end)); i >= 0 {
+				return len(d.start) + i + len(d.end)
+			}
+			return len(c)
+		}
+	}
+	quote := byte(0)
+	for i := 1; i < len(c); i++ {
+		switch {
+		case quote != 0:
+			if c[i] == quote {
+				quote = 0
+			}
+		case c[i] == '"' || c[i] == '\'':
+			quote = c[i]
+		case c[i] == '>':
+			return i + 1
+		}
+	}
+	return len(c)
+}
+
+// tagName returns the lower-cased local name of the element a tag
+// starts or ends, and whether it's an end tag or an empty-element tag.
+// Other markup has no name.
+func tagName(tag []byte) (name string, closing, empty bool) {
+	t := tag[1:]
+	if len(t) > 0 && t[0] == '/' {
+		closing, t = true, t[1:]
+	}
+	end := bytes.IndexFunc(t, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/' || r == '>'
+	})
+	if end < 0 {
+		end = len(t)
+	}
+	name = strings.ToLower(string(t[:end]))
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, closing, bytes.HasSuffix(tag, []byte("/>"))
+}
+
+// hyphenateText writes the XHTML text t to b with soft hyphens
+// inserted into its words. Entity and character references are
+// copied as they are.
+func hyphenateText(b *bytes.Buffer, t []byte, h Hyphenator) {
+	for len(t) > 0 {
+		if t[0] == '&' {
+			i := bytes.IndexByte(t, ';')
+			if i < 0 {
+				i = len(t) - 1
+			}
+			b.Write(t[:i+1])
+			t = t[i+1:]
+			continue
+		}
+		r, n := utf8.DecodeRune(t)
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			b.Write(t[:n])
+			t = t[n:]
+			continue
+		}
+		end := bytes.IndexFunc(t, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\u00ad' && !unicode.Is(unicode.Mn, r)
+		})
+		if end < 0 {
+			end = len(t)
+		}
+		word := t[:end]
+		t = t[end:]
+		if bytes.ContainsRune(word, '\u00ad') || bytes.IndexFunc(word, unicode.IsDigit) >= 0 {
+			b.Write(word)
+			continue
+		}
+		last := 0
+		for _, o := range h.Hyphenate(string(word)) {
+			if o <= last || o >= len(word) {
+				continue
+			}
+			b.Write(word[last:o])
+			b.WriteString(softHyphen)
+			last = o
+		}
+		b.Write(word[last:])
+	}
+}
@@ -0,0 +1,150 @@
+package epub
+
+// This file holds the code that controls the color profiles embedded
+// in images.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ICCPolicy says what happens to the ICC color profiles embedded in
+// the book's images when it's written.
+type ICCPolicy int
+
+const (
+	// ICCPreserve leaves images exactly as they were added. It's the
+	// default.
+	ICCPreserve ICCPolicy = iota
+	// ICCStrip removes embedded profiles from JPEG and PNG images, so
+	// reading systems treat them as sRGB. The pixel values aren't
+	// changed, so images made in a wide-gamut space will look duller;
+	// use ICCConvert to keep their colors.
+	ICCStrip
+	// ICCConvert converts images with embedded profiles to sRGB with
+	// the ColorConverter given to SetICCPolicy.
+	ICCConvert
+)
+
+// ColorConverter converts images to sRGB for ICCConvert. This package
+// doesn't include a color management engine, so conversion is done by
+// a converter the caller supplies, such as one wrapping LittleCMS.
+type ColorConverter interface {
+	// ToSRGB returns the image contents converted to sRGB. Format is
+	// the image format, "jpeg" or "png". The result should have no
+	// embedded profile, or an sRGB one.
+	ToSRGB(contents []byte, format string) ([]byte, error)
+}
+
+// SetICCPolicy controls what happens to the color profiles embedded
+// in the book's JPEG and PNG images when it's written. Wide-gamut
+// profiles, such as Adobe RGB or Display P3, render badly on many
+// e-readers, which ignore them. Converter is only used, and is
+// required, for ICCConvert. Images without an embedded profile are
+// never changed, and the images added to the book aren't modified.
+func (e *EPub) SetICCPolicy(p ICCPolicy, converter ColorConverter) error {
+	switch p {
+	case ICCPreserve, ICCStrip:
+	case ICCConvert:
+		if converter == nil {
+			return errors.New("ICCConvert needs a ColorConverter")
+		}
+	default:
+		return errors.New("unknown ICC policy")
+	}
+	e.iccPolicy, e.colorConverter = p, converter
+	return nil
+}
+
+// imageContents returns the contents of i as they should be written
+// into the book, with the ICC policy applied.
+func (e *EPub) imageContents(i image) ([]byte, error) {
+	if e.iccPolicy == ICCPreserve || !hasICCProfile(i.contents) {
+		return i.contents, nil
+	}
+	if e.iccPolicy == ICCConvert {
+		c, err := e.colorConverter.ToSRGB(i.contents, i.filetype)
+		if err != nil {
+			return nil, &ResourceError{Op: "convert", Path: i.name, Err: err}
+		}
+		return c, nil
+	}
+	return stripICCProfile(i.contents), nil
+}
+
+var (
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+	jpegICCMarker  = []byte("ICC_PROFILE\x00")
+	errBadSegments = errors.New("malformed image")
+)
+
+// hasICCProfile reports whether the JPEG or PNG image contents embed
+// an ICC profile.
+func hasICCProfile(c []byte) bool {
+	found := false
+	imageSegments(c, func(_, _ int, icc bool) {
+		found = found || icc
+	})
+	return found
+}
+
+// stripICCProfile returns JPEG or PNG image contents without their
+// embedded ICC profile. Contents that can't be parsed are returned
+// unchanged.
+func stripICCProfile(c []byte) []byte {
+	var out bytes.Buffer
+	start := 0
+	err := imageSegments(c, func(off, end int, icc bool) {
+		if icc {
+			out.Write(c[start:off])
+			start = end
+		}
+	})
+	if err != nil {
+		return c
+	}
+	out.Write(c[start:])
+	return out.Bytes()
+}
+
+// imageSegments calls f with the byte range of each segment (JPEG) or
+// chunk (PNG) before the image data, saying whether it holds an ICC
+// profile. It returns an error if the contents can't be parsed.
+func imageSegments(c []byte, f func(off, end int, icc bool)) error {
+	switch {
+	case bytes.HasPrefix(c, pngSignature):
+		for off := len(pngSignature); off+12 <= len(c); {
+			n := int(binary.BigEndian.Uint32(c[off:]))
+			end := off + 12 + n
+			if n < 0 || end > len(c) {
+				return errBadSegments
+			}
+			typ := string(c[off+4 : off+8])
+			if typ == "IDAT" || typ == "IEND" {
+				return nil
+			}
+			f(off, end, typ == "iCCP")
+			off = end
+		}
+	case len(c) > 2 && c[0] == 0xff && c[1] == 0xd8:
+		for off := 2; off+4 <= len(c); {
+			if c[off] != 0xff {
+				return errBadSegments
+			}
+			marker := c[off+1]
+			if marker == 0xda || marker == 0xd9 {
+				// Start of scan, or end of image.
+				return nil
+			}
+			n := int(binary.BigEndian.Uint16(c[off+2:]))
+			end := off + 2 + n
+			if n < 2 || end > len(c) {
+				return errBadSegments
+			}
+			f(off, end, marker == 0xe2 && bytes.HasPrefix(c[off+4:end], jpegICCMarker))
+			off = end
+		}
+	}
+	return errBadSegments
+}
@@ -0,0 +1,321 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	img "image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testPNG returns an encoded PNG image of the given size.
+func testPNG(tb testing.TB, w, h int) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, img.NewRGBA(img.Rect(0, 0, w, h))); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testJPEG returns an encoded JPEG image of the given size.
+func testJPEG(tb testing.TB, w, h int) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img.NewRGBA(img.Rect(0, 0, w, h)), nil); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestImageInfo(t *testing.T) {
+	e := New()
+	c := testPNG(t, 30, 20)
+	for _, add := range []func(string, []byte) (Id, error){e.AddImage, e.AddImageRegardless} {
+		id, err := add("images/a.png", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := e.ImageInfo(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (ImageInfo{Width: 30, Height: 20, Format: "png"}); info != want {
+			t.Errorf("ImageInfo(%v) = %+v, want %+v", id, info, want)
+		}
+	}
+	if _, err := e.ImageInfo("img99"); err == nil {
+		t.Errorf("ImageInfo of a missing image succeeded")
+	}
+}
+
+// imageBook builds a book of 1000 image pages, as a comic or picture
+// book would be, and validates it. Each page's viewport needs the
+// size of its image.
+func imageBook(tb testing.TB, page []byte) *EPub {
+	e := New()
+	e.SetTitle("Pictures")
+	e.AddLanguage("en")
+	for i := 0; i < 1000; i++ {
+		if _, err := e.AddImagePage(fmt.Sprintf("pages/%04d.jpg", i), page, fmt.Sprintf("Page %v", i+1)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := e.Validate(); err != nil {
+		tb.Fatal(err)
+	}
+	return e
+}
+
+// BenchmarkImageBook builds, validates, and writes a book of 1000
+// image pages. Building is where image configs are decoded; writing
+// doesn't decode any.
+func BenchmarkImageBook(b *testing.B) {
+	page := testJPEG(b, 600, 800)
+	b.Run("Build", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			imageBook(b, page)
+		}
+	})
+	b.Run("Serialize", func(b *testing.B) {
+		e := imageBook(b, page)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := e.Serialize(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// fakeConverter is a ColorConverter that strips profiles and counts
+// its calls.
+type fakeConverter struct {
+	calls int
+	err   error
+}
+
+func (f *fakeConverter) ToSRGB(c []byte, format string) ([]byte, error) {
+	f.calls++
+	return stripICCProfile(c), f.err
+}
+
+func TestSetICCPolicy(t *testing.T) {
+	p := testPNG(t, 4, 4)
+	// Put an iCCP chunk after the IHDR chunk, which is 25 bytes long.
+	iccp := append([]byte{0, 0, 0, 4}, "iCCPabcd\x00\x00\x00\x00"...)
+	withPNG := append(append(append([]byte{}, p[:33]...), iccp...), p[33:]...)
+	j := testJPEG(t, 4, 4)
+	app2 := append([]byte{0xff, 0xe2, 0, 16}, "ICC_PROFILE\x00\x01\x01"...)
+	withJPEG := append(append(append([]byte{}, j[:2]...), app2...), j[2:]...)
+	for _, c := range [][]byte{withPNG, withJPEG} {
+		if !hasICCProfile(c) {
+			t.Fatalf("hasICCProfile() = false, want true")
+		}
+		if _, _, err := img.DecodeConfig(bytes.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hasICCProfile(p) || hasICCProfile(j) {
+		t.Errorf("hasICCProfile() = true for image without a profile")
+	}
+	if got := stripICCProfile(withPNG); !bytes.Equal(got, p) {
+		t.Errorf("stripICCProfile(png) didn't remove the iCCP chunk")
+	}
+	if got := stripICCProfile(withJPEG); !bytes.Equal(got, j) {
+		t.Errorf("stripICCProfile(jpeg) didn't remove the APP2 segment")
+	}
+
+	conv := &fakeConverter{}
+	for _, tc := range []struct {
+		policy ICCPolicy
+		want   []byte
+		calls  int
+	}{
+		{ICCPreserve, withPNG, 0},
+		{ICCStrip, p, 0},
+		{ICCConvert, p, 1},
+	} {
+		e := simpleBook(t)
+		e.AddImage("images/a.png", withPNG)
+		e.AddImage("images/b.png", p)
+		conv.calls = 0
+		if err := e.SetICCPolicy(tc.policy, conv); err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := zipFile(t, b, "OPS/images/a.png"); got != string(tc.want) {
+			t.Errorf("policy %v: image with profile not written as expected", tc.policy)
+		}
+		if got := zipFile(t, b, "OPS/images/b.png"); got != string(p) {
+			t.Errorf("policy %v: image without profile changed", tc.policy)
+		}
+		if conv.calls != tc.calls {
+			t.Errorf("policy %v: converter called %v times, want %v", tc.policy, conv.calls, tc.calls)
+		}
+		if !bytes.Equal(e.images[0].contents, withPNG) {
+			t.Errorf("policy %v: added image was modified", tc.policy)
+		}
+	}
+
+	e := simpleBook(t)
+	if err := e.SetICCPolicy(ICCConvert, nil); err == nil {
+		t.Errorf("SetICCPolicy(ICCConvert, nil) succeeded, want error")
+	}
+	e.AddImage("images/a.png", withPNG)
+	e.SetICCPolicy(ICCConvert, &fakeConverter{err: errors.New("no")})
+	var re *ResourceError
+	if _, err := e.Serialize(); !errors.As(err, &re) || re.Path != "images/a.png" {
+		t.Errorf("Serialize() with failing converter = %v, want ResourceError for images/a.png", err)
+	}
+}
+
+// withOrientation returns JPEG contents with an EXIF segment giving
+// orientation o.
+func withOrientation(c []byte, o byte) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	tiff[19] = o
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(seg) + 2)}, seg...)
+	return append(append(append([]byte{}, c[:2]...), app1...), c[2:]...)
+}
+
+func TestSetAutoOrient(t *testing.T) {
+	// A 16x8 image, red on the left and blue on the right.
+	m := img.NewRGBA(img.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			m.Set(x, y, c)
+		}
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, m, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	c := withOrientation(b.Bytes(), 6)
+	if got := exifOrientation(c); got != 6 {
+		t.Fatalf("exifOrientation() = %v, want 6", got)
+	}
+
+	e := simpleBook(t)
+	id, err := e.AddImage("images/a.jpg", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := e.Warnings(); len(w) != 1 || !strings.Contains(w[0], "images/a.jpg has EXIF orientation 6") {
+		t.Errorf("Warnings() = %q, want orientation warning", w)
+	}
+	if info, _ := e.ImageInfo(id); info.Width != 16 {
+		t.Errorf("image without auto orientation is %v wide, want 16", info.Width)
+	}
+
+	e = simpleBook(t)
+	e.SetAutoOrient(true)
+	id, err = e.AddImage("images/a.jpg", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := e.Warnings(); len(w) != 0 {
+		t.Errorf("Warnings() = %q, want none", w)
+	}
+	info, _ := e.ImageInfo(id)
+	if info.Width != 8 || info.Height != 16 {
+		t.Fatalf("rotated image is %vx%v, want 8x16", info.Width, info.Height)
+	}
+	got, err := jpeg.Decode(bytes.NewReader(e.images[0].contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turning clockwise puts the left of the image at the top.
+	if r, _, bl, _ := got.At(4, 2).RGBA(); r < bl {
+		t.Errorf("top of rotated image isn't red")
+	}
+	if r, _, bl, _ := got.At(4, 13).RGBA(); r > bl {
+		t.Errorf("bottom of rotated image isn't blue")
+	}
+
+	// AddAll orients images the same way.
+	e = simpleBook(t)
+	e.SetAutoOrient(true)
+	ids, err := e.AddAll(context.Background(), []AddRequest{{Kind: KindImage, Contents: c, Dest: "images/a.jpg"}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := e.ImageInfo(ids[0]); info.Width != 8 || info.Height != 16 {
+		t.Errorf("image rotated by AddAll is %vx%v, want 8x16", info.Width, info.Height)
+	}
+	if exifOrientation(e.images[0].contents) > 1 {
+		t.Errorf("image added by AddAll still has its orientation tag")
+	}
+}
+
+func TestExifOrientationBadSegments(t *testing.T) {
+	j := testJPEG(t, 4, 4)
+	for _, n := range []byte{0, 1} {
+		c := append(append([]byte{0xff, 0xd8, 0xff, 0xe1, 0, n}, "Exif\x00\x00"...), j[2:]...)
+		if got := exifOrientation(c); got != 0 {
+			t.Errorf("exifOrientation(segment length %v) = %v, want 0", n, got)
+		}
+		e := simpleBook(t)
+		e.SetWarningHandler(func(Warning) {})
+		if _, err := e.AddImageRegardless("images/a.jpg", c); err != nil {
+			t.Fatal(err)
+		}
+		e.Warnings()
+		if _, err := e.Serialize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddImagePageSet(t *testing.T) {
+	e := simpleBook(t)
+	if _, err := e.AddImagePageSet("None"); err == nil {
+		t.Errorf("AddImagePageSet with no images succeeded")
+	}
+	if _, err := e.AddImagePageSet("Squashed", PageImage{"s/small.png", testPNG(t, 30, 40)}, PageImage{"s/wide.png", testPNG(t, 90, 40)}); err == nil {
+		t.Errorf("AddImagePageSet with mismatched aspect ratios succeeded")
+	}
+	if len(e.images) != 0 {
+		t.Errorf("refused image set left %v images in the book", len(e.images))
+	}
+	if _, err := e.AddImagePageSet("Page 1",
+		PageImage{"pages/hi/p1.png", testPNG(t, 60, 80)},
+		PageImage{"pages/p1.png", testPNG(t, 30, 40)},
+		PageImage{"pages/mid/p1,b.png", testPNG(t, 45, 60)},
+	); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		version    float64
+		want, skip string
+	}{
+		{3, `<img src="p1.png" srcset="p1.png 1x, mid/p1%2Cb.png 1.5x, hi/p1.png 2x" alt="Page 1" />`, ""},
+		{2, `<img src="p1.png" alt="Page 1" />`, "srcset"},
+	} {
+		e.SetVersion(tc.version)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := zipFile(t, b, "OPS/pages/p1.xhtml")
+		if !strings.Contains(page, tc.want) || !strings.Contains(page, `content="width=30, height=40"`) {
+			t.Errorf("v%v page = %s, want %s at 30x40", tc.version, page, tc.want)
+		}
+		if tc.skip != "" && strings.Contains(page, tc.skip) {
+			t.Errorf("v%v page has %v:\n%s", tc.version, tc.skip, page)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package epub
+
+// This file holds image pages with the page image at several
+// resolutions, for fixed layout books read on both high-density
+// tablets and low-resolution e-ink readers.
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PageImage is one resolution of a page image, for AddImagePageSet.
+type PageImage struct {
+	// Path is the relative path to the image in the book.
+	Path     string
+	Contents []byte
+}
+
+// AddImagePageSet is like AddImagePage, but takes the page image at
+// several resolutions. The page is laid out at the size of the
+// smallest image, which is its src, so reading systems that don't
+// choose between resolutions, as e-ink readers generally don't, load
+// the small image, and the others are listed in the img element's
+// srcset attribute with their pixel densities, so high-density
+// tablets can load the larger ones. The images must all have the same
+// aspect ratio, to within 1%, and different widths. The page's path
+// is the smallest image's, with an .xhtml extension.
+//
+// XHTML 1.1 has no srcset attribute, so in v2 books, and files written
+// as XHTML 1.1 with SetContentProfile, the page only has the smallest
+// image; the others are still included in the book, so there's little
+// point giving more than one resolution to books that might be
+// written as v2.
+//
+// Returns the ID of the XHTML page.
+func (e *EPub) AddImagePageSet(label string, images ...PageImage) (_ Id, err error) {
+	if len(images) == 0 {
+		return "", fmt.Errorf("image page %q has no images", label)
+	}
+	n := len(e.images)
+	defer func() {
+		// Don't leave the images of a set that's refused in the book.
+		if err != nil {
+			for _, i := range e.images[n:] {
+				delete(e.imageIndex, i.id)
+			}
+			e.images = e.images[:n]
+		}
+	}()
+	type sized struct {
+		path string
+		info ImageInfo
+	}
+	var set []sized
+	for _, i := range images {
+		id, err := e.AddImage(i.Path, i.Contents)
+		if err != nil {
+			return "", err
+		}
+		info, err := e.ImageInfo(id)
+		if err != nil {
+			return "", err
+		}
+		set = append(set, sized{i.Path, info})
+	}
+	sort.SliceStable(set, func(i, j int) bool { return set[i].info.Width < set[j].info.Width })
+	base := set[0]
+	for _, s := range set[1:] {
+		if s.info.Width == base.info.Width {
+			return "", fmt.Errorf("images %v and %v are the same width", base.path, s.path)
+		}
+		// Compare width/height ratios without dividing.
+		a, b := s.info.Width*base.info.Height, base.info.Width*s.info.Height
+		if d := a - b; d*100 > b || -d*100 > b {
+			return "", fmt.Errorf("image %v (%vx%v) doesn't have the aspect ratio of %v (%vx%v)", s.path, s.info.Width, s.info.Height, base.path, base.info.Width, base.info.Height)
+		}
+	}
+
+	page := strings.TrimSuffix(base.path, filepath.Ext(base.path)) + ".xhtml"
+	img := attrPair("src", relativeHref(page, base.path))
+	if len(set) > 1 {
+		var srcset []string
+		for _, s := range set {
+			density := math.Round(float64(s.info.Width)/float64(base.info.Width)*100) / 100
+			// Commas separate srcset's candidates.
+			href := strings.Replace(relativeHref(page, s.path), ",", "%2C", -1)
+			srcset = append(srcset, href+" "+strconv.FormatFloat(density, 'f', -1, 64)+"x")
+		}
+		img += " " + attrPair("srcset", strings.Join(srcset, ", "))
+	}
+	return e.addImagePage(page, base.info, label, img)
+}
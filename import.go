@@ -0,0 +1,221 @@
+package epub
+
+// This file holds the helpers shared by the importers that build
+// books from other document formats.
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// maxZipEntrySize is the most that's read from any one file in a zip
+// archive being imported or opened, so a small hostile archive can't
+// expand into gigabytes. It's a variable so tests can lower it.
+var maxZipEntrySize int64 = 256 << 20
+
+// readZipFile returns the contents of a file in a zip archive. It
+// fails if the file is larger than maxZipEntrySize.
+func readZipFile(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(maxZipEntrySize) {
+		return nil, fmt.Errorf("%v is too large (%v bytes)", f.Name, f.UncompressedSize64)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	c, err := io.ReadAll(io.LimitReader(r, maxZipEntrySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v: %v", f.Name, err)
+	}
+	if int64(len(c)) > maxZipEntrySize {
+		return nil, fmt.Errorf("%v is larger than %v bytes", f.Name, maxZipEntrySize)
+	}
+	return c, nil
+}
+
+// xnode is a node in a parsed XML document. Text nodes have an empty
+// name.
+type xnode struct {
+	name     string
+	space    string // The element's namespace URI, if it has one
+	attrs    []xml.Attr
+	children []*xnode
+	text     string
+}
+
+// parseXML parses an XML document into a tree of xnodes and returns
+// the root element. Element and attribute names are matched without
+// their namespaces, which is fine for the formats we import.
+func parseXML(r io.Reader) (*xnode, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	root := &xnode{}
+	stack := []*xnode{root}
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &xnode{name: t.Name.Local, space: t.Name.Space, attrs: t.Attr}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.children = append(top.children, &xnode{text: string(t)})
+		}
+	}
+	for _, c := range root.children {
+		if c.name != "" {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no root element found")
+}
+
+// attr returns the value of the named attribute, ignoring
+// namespaces, or the empty string if there isn't one.
+func (n *xnode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// setAttr sets the named attribute.
+func (n *xnode) setAttr(name, value string) {
+	for i, a := range n.attrs {
+		if a.Name.Local == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// find returns the first descendant element with the given name, or
+// nil if there isn't one.
+func (n *xnode) find(name string) *xnode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+		if f := c.find(name); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// findAll returns all the descendant elements with the given name.
+func (n *xnode) findAll(name string) []*xnode {
+	var ret []*xnode
+	for _, c := range n.children {
+		if c.name == name {
+			ret = append(ret, c)
+		}
+		ret = append(ret, c.findAll(name)...)
+	}
+	return ret
+}
+
+// elements returns the child elements of n, skipping text.
+func (n *xnode) elements() []*xnode {
+	var ret []*xnode
+	for _, c := range n.children {
+		if c.name != "" {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// textContent returns all the text inside n with whitespace
+// collapsed.
+func (n *xnode) textContent() string {
+	var b strings.Builder
+	var walk func(*xnode)
+	walk = func(n *xnode) {
+		b.WriteString(n.text)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// textContentRaw returns all the text inside n without collapsing
+// whitespace.
+func (n *xnode) textContentRaw() string {
+	var b strings.Builder
+	b.WriteString(n.text)
+	for _, c := range n.children {
+		b.WriteString(c.textContentRaw())
+	}
+	return b.String()
+}
+
+// xhtmlPage wraps body in a complete XHTML 1.1 document with the given
+// title. Stylesheets are hrefs of CSS files to link in. The DOCTYPE is
+// rewritten to suit the file's content profile when the book is
+// written.
+func xhtmlPage(title, body string, stylesheets ...string) string {
+	return profilePage(ProfileXHTML11, title, body, stylesheets...)
+}
+
+// converter turns a tree of source elements into XHTML. Each source
+// format supplies an element function which writes the XHTML for a
+// single element, calling convert to recurse into children.
+type converter struct {
+	b       strings.Builder
+	element func(c *converter, n *xnode)
+}
+
+// convert writes the XHTML for n and its descendants.
+func (c *converter) convert(n *xnode) {
+	if n.name == "" {
+		c.b.WriteString(html.EscapeString(n.text))
+		return
+	}
+	c.element(c, n)
+}
+
+// children writes the XHTML for n's children.
+func (c *converter) children(n *xnode) {
+	for _, ch := range n.children {
+		c.convert(ch)
+	}
+}
+
+// wrap writes n's children wrapped in the given XHTML element. Extra
+// attributes are written as-is and must already be escaped, as with
+// attrPair.
+func (c *converter) wrap(tag string, n *xnode, attrs ...string) {
+	c.b.WriteString("<" + tag)
+	if id := n.attr("id"); id != "" {
+		c.b.WriteString(" " + attrPair("id", id))
+	}
+	for _, a := range attrs {
+		c.b.WriteString(" " + a)
+	}
+	c.b.WriteString(">")
+	c.children(n)
+	c.b.WriteString("</" + tag + ">")
+}
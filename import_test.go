@@ -0,0 +1,402 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// importedFiles serializes a book built by an importer and returns the
+// contents of the named files in it.
+func importedFiles(t *testing.T, e *EPub, names ...string) map[string]string {
+	t.Helper()
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string]string)
+	for _, n := range names {
+		ret[n] = zipFile(t, b, n)
+	}
+	return ret
+}
+
+// wantContains reports an error for each of the strings in want that
+// aren't in the named file.
+func wantContains(t *testing.T, name, got string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			t.Errorf("%v doesn't contain %q:\n%s", name, w, got)
+		}
+	}
+}
+
+func TestImportDTBook(t *testing.T) {
+	e, err := ImportDTBook(filepath.Join("testdata", "dtbook", "book.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.title, "Tides & Currents"; got != want {
+		t.Errorf("title = %q, want %q", got, want)
+	}
+	f := importedFiles(t, e, "OPS/xhtml/front.xhtml", "OPS/xhtml/chapter001.xhtml", "OPS/xhtml/chapter002.xhtml", "OPS/xhtml/chapter003.xhtml", "OPS/toc.ncx", "OPS/content.opf", "OPS/images/figure.png", "OPS/images/figure-2.png")
+	wantContains(t, "front.xhtml", f["OPS/xhtml/front.xhtml"],
+		`<h1 class="doctitle">Tides &amp; Currents</h1>`,
+		`<p class="docauthor">Ada Marsh</p>`)
+	wantContains(t, "chapter001.xhtml", f["OPS/xhtml/chapter001.xhtml"],
+		`<title>The Moon</title>`,
+		`<h1>The Moon</h1>`,
+		`<span class="pagenum" id="p1" title="1"></span>`,
+		`<p>The moon pulls <em>everything</em> toward it.</p>`,
+		`<div id="section1" class="level2">`,
+		`<h2>Spring Tides</h2>`,
+		`<img src="../images/figure.png" alt="A tide chart" />`,
+		`<p class="caption">Tide chart</p>`,
+		`<div id="neap" class="level2">`,
+		`<ol><li>Quarter moon</li><li>Low range</li></ol>`)
+	wantContains(t, "chapter002.xhtml", f["OPS/xhtml/chapter002.xhtml"],
+		`<span class="pagenum" id="page-2" title="2"></span>`,
+		`<a href="#n1">note 1</a>`,
+		`<a href="chapter003.xhtml#n2">note 2</a>`,
+		`<a href="chapter001.xhtml#neap">neap tides</a>`,
+		`<div id="n1" class="note"><p>The sun matters too.</p></div>`,
+		`<img src="../images/figure-2.png" alt="A sun chart" />`)
+	wantContains(t, "chapter003.xhtml", f["OPS/xhtml/chapter003.xhtml"],
+		`<span class="pagenum" id="page-iv-notes" title="iv notes"></span>`,
+		`<div id="n2" class="note"><p>So does the wind.</p></div>`)
+	wantContains(t, "content.opf", f["OPS/content.opf"],
+		`<dc:creator`, `Ada Marsh</dc:creator>`,
+		`<dc:publisher>Harbor Press</dc:publisher>`,
+		`<dc:language>en</dc:language>`)
+
+	ncx := f["OPS/toc.ncx"]
+	wantContains(t, "toc.ncx", ncx,
+		`<text>The Moon</text>`,
+		`<content src="xhtml/chapter001.xhtml" />`,
+		`<text>Spring Tides</text>`,
+		`<content src="xhtml/chapter001.xhtml#section1" />`,
+		`<text>Neap Tides</text>`,
+		`<content src="xhtml/chapter001.xhtml#neap" />`,
+		`<text>The Sun</text>`,
+		`<content src="xhtml/chapter002.xhtml" />`,
+		`<content src="xhtml/chapter001.xhtml#p1" />`,
+		`<content src="xhtml/chapter002.xhtml#page-2" />`,
+		`<content src="xhtml/chapter003.xhtml#page-iv-notes" />`)
+	if i, j := strings.Index(ncx, "<text>Spring Tides</text>"), strings.Index(ncx, "<text>The Sun</text>"); i < 0 || j < 0 || i > j {
+		t.Errorf("toc.ncx doesn't nest Spring Tides under The Moon:\n%s", ncx)
+	}
+	if !strings.Contains(ncx, "<pageList>") || strings.Count(ncx, "<pageTarget") != 3 {
+		t.Errorf("toc.ncx doesn't have a page list with three targets:\n%s", ncx)
+	}
+}
+
+func TestImportDTBookNCX(t *testing.T) {
+	e, err := ImportDTBook(filepath.Join("testdata", "dtbook", "daisy", "book.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ncx := importedFiles(t, e, "OPS/toc.ncx")["OPS/toc.ncx"]
+	wantContains(t, "toc.ncx", ncx,
+		`<text>Where rivers begin</text>`,
+		`<content src="xhtml/chapter001.xhtml#c1" />`,
+		`<text>Underground springs</text>`,
+		`<content src="xhtml/chapter001.xhtml#springs" />`,
+		`<text>Where rivers end</text>`,
+		`<content src="xhtml/chapter002.xhtml#c2" />`)
+	for _, skip := range []string{"<text>Sources</text>", "<text>Lost</text>"} {
+		if strings.Contains(ncx, skip) {
+			t.Errorf("toc.ncx has %v, which isn't in the DAISY NCX:\n%s", skip, ncx)
+		}
+	}
+	if i, j := strings.Index(ncx, "<text>Underground springs</text>"), strings.Index(ncx, "<text>Where rivers end</text>"); strings.Count(ncx[i:j], "</navPoint>") != 2 {
+		t.Errorf("toc.ncx doesn't nest the springs under the sources, or the mouths at the top level:\n%s", ncx)
+	}
+}
+
+func TestImportDTBookErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"missing.xml": "",
+		"html.xml":    `<html><body><p>Not a dtbook</p></body></html>`,
+		"nobook.xml":  `<dtbook><head></head></dtbook>`,
+		"noimage.xml": `<dtbook><book><bodymatter><level1><h1>A</h1><img src="nothere.png" alt="" /></level1></bodymatter></book></dtbook>`,
+	} {
+		p := filepath.Join(dir, name)
+		if content != "" {
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := ImportDTBook(p); err == nil {
+			t.Errorf("ImportDTBook(%v) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestImportDocBook(t *testing.T) {
+	e, err := ImportDocBook(filepath.Join("testdata", "docbook", "book.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.title, "Weaving for Beginners"; got != want {
+		t.Errorf("title = %q, want %q", got, want)
+	}
+	f := importedFiles(t, e, "OPS/xhtml/chapter001.xhtml", "OPS/xhtml/chapter002.xhtml", "OPS/xhtml/index.xhtml", "OPS/toc.ncx", "OPS/content.opf", "OPS/images/loom.png")
+	wantContains(t, "chapter001.xhtml", f["OPS/xhtml/chapter001.xhtml"],
+		`<h1>Preface</h1>`,
+		`<p class="para">Read `,
+		`<a href="chapter002.xhtml#looms">looms</a>`)
+	wantContains(t, "chapter002.xhtml", f["OPS/xhtml/chapter002.xhtml"],
+		`<title>Getting Started</title>`,
+		`<h1>Getting Started</h1>`,
+		`<p class="para">Weaving needs a loom.<span class="footnote"><span class="para">Or a frame.</span></span></p>`,
+		`<div id="looms" class="section">`,
+		`<h2>Looms</h2>`,
+		`<strong>warp</strong>`,
+		`<a id="indexterm1"></a>`,
+		`<p class="caption">A floor loom</p>`,
+		`<img src="../images/loom.png" alt="A floor loom" />`,
+		`<caption>Yarn weights</caption>`,
+		`<tr class="row"><td>Lace</td><td>0</td></tr>`,
+		`<h3>Frame Looms</h3>`,
+		`<div id="section2" class="section">`,
+		`<pre class="programlisting">warp &lt; weft</pre>`)
+	if strings.Contains(f["OPS/xhtml/chapter002.xhtml"], ">A floor loom</h") {
+		t.Errorf("figure title became a heading:\n%s", f["OPS/xhtml/chapter002.xhtml"])
+	}
+	wantContains(t, "index.xhtml", f["OPS/xhtml/index.xhtml"],
+		`<li>warp: <a href="chapter002.xhtml#indexterm1">Looms</a>, <a href="chapter002.xhtml#indexterm2">Yarn</a></li>`)
+	wantContains(t, "content.opf", f["OPS/content.opf"],
+		`Iris Loom</dc:creator>`,
+		`<dc:publisher>Warp &amp; Weft</dc:publisher>`,
+		`<dc:description>An introduction to weaving.</dc:description>`)
+	wantContains(t, "toc.ncx", f["OPS/toc.ncx"],
+		`<text>Preface</text>`,
+		`<text>Getting Started</text>`,
+		`<content src="xhtml/chapter002.xhtml#looms" />`,
+		`<content src="xhtml/chapter002.xhtml#section2" />`,
+		`<text>Index</text>`)
+}
+
+func TestImportDocBookErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"missing.xml":    "",
+		"empty.xml":      `<book><info><title>Empty</title></info></book>`,
+		"noimage.xml":    `<chapter><title>A</title><mediaobject><imageobject><imagedata fileref="nothere.png"/></imageobject></mediaobject></chapter>`,
+		"unbalanced.xml": `<book><chapter><title>A</title>`,
+	} {
+		p := filepath.Join(dir, name)
+		if content != "" {
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := ImportDocBook(p); err == nil {
+			t.Errorf("ImportDocBook(%v) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestImportDOCX(t *testing.T) {
+	e, err := ImportDOCX(filepath.Join("testdata", "docx", "sample.docx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := importedFiles(t, e, "OPS/xhtml/chapter001.xhtml", "OPS/xhtml/chapter002.xhtml", "OPS/css/docx.css", "OPS/toc.ncx", "OPS/content.opf", "OPS/images/image1.png")
+	wantContains(t, "chapter001.xhtml", f["OPS/xhtml/chapter001.xhtml"],
+		`<title>Spring</title>`,
+		`<link rel="stylesheet" type="text/css" href="../css/docx.css" />`,
+		`<h1 id="spring">Spring</h1>`,
+		`<p>Plant <strong>peas &amp; beans</strong> early; see <a href="https://example.com/seeds">the seed list</a>.</p>`,
+		`<h2 id="beds">Beds</h2>`,
+		"<ul>\n<li>Dig</li>\n<li>Rake</li>\n</ul>",
+		`<img src="../images/image1.png" alt="A raised bed" />`)
+	wantContains(t, "chapter002.xhtml", f["OPS/xhtml/chapter002.xhtml"],
+		`<h1 id="summer">Summer</h1>`,
+		`<p class="docx-Quote">Water in the evening.</p>`,
+		`<tr><td><p>Tomatoes</p></td><td><p>July</p></td></tr>`)
+	wantContains(t, "docx.css", f["OPS/css/docx.css"],
+		`.docx-Quote { font-style: italic; text-align: center; }`)
+	wantContains(t, "content.opf", f["OPS/content.opf"],
+		`<dc:title>Garden Notes</dc:title>`,
+		`Rowan Field</dc:creator>`,
+		`<dc:language>en</dc:language>`)
+	wantContains(t, "toc.ncx", f["OPS/toc.ncx"],
+		`<text>Spring</text>`,
+		`<content src="xhtml/chapter001.xhtml#beds" />`,
+		`<text>Summer</text>`)
+}
+
+// writeZip writes a zip archive holding the given files to a new file
+// in dir and returns its name.
+func writeZip(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for name, content := range files {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(dir, "*.docx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestImportDOCXErrors(t *testing.T) {
+	old := maxZipEntrySize
+	maxZipEntrySize = 1 << 10
+	t.Cleanup(func() { maxZipEntrySize = old })
+
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.docx")
+	if err := os.WriteFile(garbage, []byte("PK\x03\x04 not really a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	body := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body><w:p><w:r><w:t>Hi</w:t></w:r></w:p></w:body></w:document>`
+	for _, tc := range []struct {
+		name string
+		file string
+	}{
+		{"missing", filepath.Join(dir, "missing.docx")},
+		{"not a zip", garbage},
+		{"no document", writeZip(t, dir, map[string]string{"word/other.xml": body})},
+		{"no body", writeZip(t, dir, map[string]string{"word/document.xml": `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"></w:document>`})},
+		{"malformed document", writeZip(t, dir, map[string]string{"word/document.xml": `<w:document><w:body><w:p>`})},
+		{"malformed styles", writeZip(t, dir, map[string]string{"word/document.xml": body, "word/styles.xml": `<w:styles><w:style`})},
+		{"oversized document", writeZip(t, dir, map[string]string{"word/document.xml": strings.Replace(body, "Hi", strings.Repeat("x", 2<<10), 1)})},
+		{"oversized image", writeZip(t, dir, map[string]string{
+			"word/document.xml":            strings.Replace(body, "<w:t>Hi</w:t>", `<w:drawing><a:blip xmlns:a="a" xmlns:r="r" r:embed="rId1"/></w:drawing>`, 1),
+			"word/_rels/document.xml.rels": `<Relationships><Relationship Id="rId1" Target="media/big.png"/></Relationships>`,
+			"word/media/big.png":           strings.Repeat("x", 2<<10),
+		})},
+	} {
+		if _, err := ImportDOCX(tc.file); err == nil {
+			t.Errorf("ImportDOCX(%v) succeeded, want an error", tc.name)
+		}
+	}
+
+	// Relationships that point outside the archive are only ever looked
+	// up inside it.
+	outside := writeZip(t, dir, map[string]string{
+		"word/document.xml":            strings.Replace(body, "<w:t>Hi</w:t>", `<w:t>Hi</w:t><w:drawing><a:blip xmlns:a="a" xmlns:r="r" r:embed="rId1"/></w:drawing>`, 1),
+		"word/_rels/document.xml.rels": `<Relationships><Relationship Id="rId1" Target="../../../../etc/passwd"/></Relationships>`,
+	})
+	e, err := ImportDOCX(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := importedFiles(t, e, "OPS/xhtml/chapter001.xhtml")["OPS/xhtml/chapter001.xhtml"]; strings.Contains(c, "<img") {
+		t.Errorf("image outside the archive was imported:\n%s", c)
+	}
+}
+
+func TestImportLaTeX(t *testing.T) {
+	e, err := ImportLaTeX(filepath.Join("testdata", "latex", "book.tex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := importedFiles(t, e, "OPS/xhtml/chapter001.xhtml", "OPS/xhtml/chapter002.xhtml", "OPS/toc.ncx", "OPS/content.opf")
+	ch1 := f["OPS/xhtml/chapter001.xhtml"]
+	wantContains(t, "chapter001.xhtml", ch1,
+		`<h1 id="counting">Counting</h1>`,
+		`<h2 id="sums">Sums</h2>`,
+		`<h3 id="small-sums">Small sums</h3>`,
+		`<mrow><mn>1</mn><mo>&lt;</mo><mn>2</mn></mrow>`,
+		`and that a &lt; b &amp; b &gt; c for <em class="emph">some</em> a, b, and c.`,
+		`<div class="math"><math xmlns="http://www.w3.org/1998/Math/MathML" display="block">`,
+		`<strong class="textbf">positive</strong>`,
+		`<code class="verb">a&lt;b &amp;&amp; c</code>`)
+	if strings.Contains(ch1, "comment") {
+		t.Errorf("chapter001.xhtml kept a comment:\n%s", ch1)
+	}
+	wantContains(t, "chapter002.xhtml", f["OPS/xhtml/chapter002.xhtml"],
+		"<pre class=\"verbatim\">if (x &lt; 10 &amp;&amp; $y) { \\emph{no} }\n</pre>",
+		"<ul class=\"itemize\">\n<li>First &amp; foremost</li>\n<li>Second</li>\n</ul>")
+	wantContains(t, "content.opf", f["OPS/content.opf"],
+		`<dc:title>Numbers &amp; Shapes</dc:title>`,
+		`Ana Lyst</dc:creator>`,
+		`Geo Metry</dc:creator>`)
+	wantContains(t, "toc.ncx", f["OPS/toc.ncx"],
+		`<text>Counting</text>`,
+		`<content src="xhtml/chapter001.xhtml#sums" />`,
+		`<text>Code</text>`)
+	if strings.Contains(f["OPS/toc.ncx"], "Small sums") {
+		t.Errorf("toc.ncx has a navpoint for a subsection:\n%s", f["OPS/toc.ncx"])
+	}
+}
+
+func TestImportLaTeXErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"missing.tex":     "",
+		"braces.tex":      `\section{Unclosed`,
+		"end.tex":         "\\begin{itemize}\n\\item A\n",
+		"math.tex":        `Some $math`,
+		"verbatim.tex":    "\\begin{verbatim}\ncode\n",
+		"verb.tex":        `\verb|code`,
+		"displaymath.tex": `\[ x^2`,
+	} {
+		p := filepath.Join(dir, name)
+		if content != "" {
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := ImportLaTeX(p); err == nil {
+			t.Errorf("ImportLaTeX(%v) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestLaTeXToMathML(t *testing.T) {
+	const open = `<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow>`
+	for tex, want := range map[string]string{
+		`\frac{a}{b}`:       `<mfrac><mrow><mi>a</mi></mrow><mrow><mi>b</mi></mrow></mfrac>`,
+		`x^2 + y_1`:         `<msup><mi>x</mi><mn>2</mn></msup><mo>+</mo><msub><mi>y</mi><mn>1</mn></msub>`,
+		`\sqrt[3]{x}`:       `<mroot><mrow><mi>x</mi></mrow><mrow><mn>3</mn></mrow></mroot>`,
+		`\alpha \leq \beta`: `<mi>α</mi><mo>≤</mo><mi>β</mi>`,
+		`\text{if } x`:      `<mtext>if </mtext><mi>x</mi>`,
+		`\left( x \right)`:  `<mrow><mo fence="true">(</mo><mi>x</mi><mo fence="true">)</mo></mrow>`,
+		`\mathbf{v}`:        `<mstyle mathvariant="bold"><mrow><mi>v</mi></mrow></mstyle>`,
+		`a < b & c`:         `<mi>a</mi><mo>&lt;</mo><mi>b</mi><mo>&amp;</mo><mi>c</mi>`,
+		`\foo`:              `<mi>foo</mi>`,
+	} {
+		got, err := LaTeXToMathML(tex, false)
+		if err != nil {
+			t.Errorf("LaTeXToMathML(%q) = %v", tex, err)
+			continue
+		}
+		if want = open + want + `</mrow></math>`; got != want {
+			t.Errorf("LaTeXToMathML(%q) = %s, want %s", tex, got, want)
+		}
+	}
+	got, err := LaTeXToMathML("x", true)
+	if want := `<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><mrow><mi>x</mi></mrow></math>`; err != nil || got != want {
+		t.Errorf("LaTeXToMathML(x, true) = %s, %v, want %s", got, err, want)
+	}
+	for _, tex := range []string{`\frac{a`, `}`, `\sqrt[3{x}`, `x^`} {
+		if got, err := LaTeXToMathML(tex, false); err == nil {
+			t.Errorf("LaTeXToMathML(%q) = %s, want an error", tex, got)
+		}
+	}
+}
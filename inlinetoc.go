@@ -0,0 +1,104 @@
+package epub
+
+// This file holds the code that generates inline tables of contents.
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// inlineTOC holds the settings for GenerateInlineTOC.
+type inlineTOC struct {
+	path    string
+	heading string
+	depth   int // Zero means unlimited
+}
+
+// InlineTOCOption configures the page made by GenerateInlineTOC.
+type InlineTOCOption func(*inlineTOC)
+
+// InlineTOCPath sets the path of the generated page in the book. The
+// default is "xhtml/toc.xhtml".
+func InlineTOCPath(path string) InlineTOCOption {
+	return func(t *inlineTOC) { t.path = path }
+}
+
+// InlineTOCHeading sets the heading of the generated page. The
+// default is "Contents".
+func InlineTOCHeading(heading string) InlineTOCOption {
+	return func(t *inlineTOC) { t.heading = heading }
+}
+
+// InlineTOCDepth limits the generated page to the given number of
+// levels of navpoints. The default is to include them all.
+func InlineTOCDepth(depth int) InlineTOCOption {
+	return func(t *inlineTOC) { t.depth = depth }
+}
+
+// GenerateInlineTOC generates a table of contents page from the
+// book's navpoints using the book's theme, and adds it to the book
+// with the given spine order. Unlike the nav document and NCX, which
+// reading systems show in their own menus, this page is part of the
+// book's text, like the contents page of a printed book. The page is
+// tagged as the TOC landmark. The navpoints should be added before
+// this is called.
+//
+// Returns the ID of the generated page.
+func (e *EPub) GenerateInlineTOC(position int, opts ...InlineTOCOption) (Id, error) {
+	t := inlineTOC{path: "xhtml/toc.xhtml", heading: "Contents"}
+	for _, o := range opts {
+		o(&t)
+	}
+	if len(e.navpoints) == 0 {
+		return "", errors.New("the book has no navpoints to make a table of contents from")
+	}
+	if t.depth < 0 {
+		return "", errors.New("table of contents depth can't be negative")
+	}
+	d := e.pageData()
+	d.Heading = t.heading
+	d.TOC = e.tocEntries(t.path, e.navpoints, t.depth)
+	x, err := e.renderPage(e.pageTheme().TOCPage, t.heading, d)
+	if err != nil {
+		return "", err
+	}
+	id, err := e.AddXHTML(t.path, x, position)
+	if err != nil {
+		return "", err
+	}
+	return id, e.SetLandmark(id, LandmarkTOC, "")
+}
+
+// tocEntries returns the template entries for navpoints, with hrefs
+// relative to page, down to the given depth.
+func (e *EPub) tocEntries(page string, np []*Navpoint, depth int) []TOCEntry {
+	np = sortedNavpoints(np)
+	var entries []TOCEntry
+	for _, n := range np {
+		entry := TOCEntry{Label: headingText(e.text(e.navpointLabel(n))), Href: relativeLink(page, n.filename)}
+		if len(n.navpoints) > 0 && depth != 1 {
+			child := 0
+			if depth > 1 {
+				child = depth - 1
+			}
+			entry.Children = e.tocEntries(page, n.navpoints, child)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// relativeLink is like relativeHref, but the target may end in a
+// fragment identifier.
+func relativeLink(from, target string) string {
+	i := strings.IndexByte(target, '#')
+	if i < 0 {
+		return relativeHref(from, target)
+	}
+	href := ""
+	if target[:i] != from {
+		href = relativeHref(from, target[:i])
+	}
+	return href + "#" + (&url.URL{Fragment: target[i+1:]}).EscapedFragment()
+}
@@ -0,0 +1,120 @@
+package epub
+
+// This file holds the code for tagging structural parts of the book,
+// which become the v2 guide and the v3 landmarks.
+
+import (
+	"fmt"
+)
+
+// Landmark identifies the structural role of an XHTML file in the
+// book, such as its cover or the start of the main text.
+type Landmark string
+
+// The landmarks this package knows about. The values are the EPUB 3
+// structural semantics vocabulary terms.
+const (
+	LandmarkCover           Landmark = "cover"
+	LandmarkTitlePage       Landmark = "titlepage"
+	LandmarkTOC             Landmark = "toc"
+	LandmarkBodyMatter      Landmark = "bodymatter"
+	LandmarkCopyrightPage   Landmark = "copyright-page"
+	LandmarkDedication      Landmark = "dedication"
+	LandmarkAcknowledgments Landmark = "acknowledgments"
+	LandmarkBibliography    Landmark = "bibliography"
+	LandmarkGlossary        Landmark = "glossary"
+	LandmarkIndex           Landmark = "index"
+	LandmarkColophon        Landmark = "colophon"
+)
+
+// landmarkInfo holds the v2 guide reference type and the default
+// title for each landmark.
+var landmarkInfo = map[Landmark]struct{ guide, title string }{
+	LandmarkCover:           {"cover", "Cover"},
+	LandmarkTitlePage:       {"title-page", "Title Page"},
+	LandmarkTOC:             {"toc", "Table of Contents"},
+	LandmarkBodyMatter:      {"text", "Start of Content"},
+	LandmarkCopyrightPage:   {"copyright-page", "Copyright"},
+	LandmarkDedication:      {"dedication", "Dedication"},
+	LandmarkAcknowledgments: {"acknowledgements", "Acknowledgments"},
+	LandmarkBibliography:    {"bibliography", "Bibliography"},
+	LandmarkGlossary:        {"glossary", "Glossary"},
+	LandmarkIndex:           {"index", "Index"},
+	LandmarkColophon:        {"colophon", "Colophon"},
+}
+
+type landmark struct {
+	kind  Landmark
+	id    Id
+	title string
+}
+
+// SetLandmark tags the XHTML file with the given ID as a structural
+// part of the book. The tags are written out as the guide in v2
+// books and as the landmarks nav in v3 books, so they only need
+// declaring once. Title is the label reading systems show for the
+// landmark; if it's empty a default title for the kind is used.
+//
+// Each kind of landmark can only point at one file; tagging a second
+// file replaces the first. AddCoverPage and AddTitlePage tag the
+// pages they generate automatically.
+func (e *EPub) SetLandmark(id Id, kind Landmark, title string) error {
+	info, ok := landmarkInfo[kind]
+	if !ok {
+		return fmt.Errorf("unknown landmark %q", kind)
+	}
+	if _, err := e.findXHTML(id); err != nil {
+		return err
+	}
+	if title == "" {
+		title = info.title
+	}
+	l := landmark{kind: kind, id: id, title: title}
+	for i := range e.landmarks {
+		if e.landmarks[i].kind == kind {
+			e.landmarks[i] = l
+			return nil
+		}
+	}
+	e.landmarks = append(e.landmarks, l)
+	return nil
+}
+
+// landmarkHrefs returns the package-relative href of the file each
+// landmark points at, in the order the landmarks were set.
+func (e *EPub) landmarkHrefs() []string {
+	hrefs := make([]string, len(e.landmarks))
+	for i, l := range e.landmarks {
+		x, _ := e.findXHTML(l.id)
+		hrefs[i] = e.manifestHref(x.id, x.name)
+	}
+	return hrefs
+}
+
+// guide returns the v2 guide section of the package document, or nil
+// if the book has no landmarks.
+func (e *EPub) guide() *opfGuide {
+	if len(e.landmarks) == 0 {
+		return nil
+	}
+	g := &opfGuide{}
+	for i, href := range e.landmarkHrefs() {
+		l := e.landmarks[i]
+		g.References = append(g.References, opfReference{Type: landmarkInfo[l.kind].guide, Title: e.plainText(l.title), Href: href})
+	}
+	return g
+}
+
+// landmarksNav returns the v3 landmarks nav of the nav document, or
+// nil if the book has no landmarks.
+func (e *EPub) landmarksNav() *navNav {
+	if len(e.landmarks) == 0 {
+		return nil
+	}
+	n := &navNav{Type: "landmarks", Hidden: "hidden"}
+	for i, href := range e.landmarkHrefs() {
+		l := e.landmarks[i]
+		n.List.Items = append(n.List.Items, navItem{Link: navLink{Type: string(l.kind), Href: href, Text: e.plainText(l.title)}})
+	}
+	return n
+}
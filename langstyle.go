@@ -0,0 +1,262 @@
+package epub
+
+// This file holds the styling the book applies to text in particular
+// languages, such as the fonts and line spacing of Japanese or Arabic.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LanguageStyle is the styling for the XHTML files in a language, set
+// with SetLanguageStyle.
+type LanguageStyle struct {
+	// FontFamily is a CSS font-family list for the files' text, such
+	// as `"Noto Serif CJK JP", serif`.
+	FontFamily string
+	// LineHeight is the CSS line-height of the files' text, such as
+	// "1.75".
+	LineHeight string
+	// WritingMode is the CSS writing-mode, such as "vertical-rl" for
+	// vertical Japanese. It's also written as -epub-writing-mode, for
+	// older reading systems.
+	WritingMode string
+	// Font is the ID of a font added with AddFont to embed for the
+	// language. The stylesheet gets an @font-face rule for it, and its
+	// family goes at the front of FontFamily. Optional.
+	Font Id
+	// CSS is more CSS to add to the stylesheet, after the generated
+	// rules.
+	CSS string
+}
+
+// defaultLanguageStyles are the built-in language styles, by primary
+// language subtag. CJK text is kept horizontal, which is what most
+// books want and all reading systems support; books set vertically
+// should set their own style.
+var defaultLanguageStyles = map[string]LanguageStyle{
+	"ja": {FontFamily: `"Hiragino Mincho ProN", "Yu Mincho", "Noto Serif CJK JP", serif`, LineHeight: "1.75", WritingMode: "horizontal-tb", CSS: "p { line-break: strict; }"},
+	"zh": {FontFamily: `"Songti SC", "Noto Serif CJK SC", serif`, LineHeight: "1.75", WritingMode: "horizontal-tb"},
+	"ko": {FontFamily: `"Apple SD Gothic Neo", "Noto Sans CJK KR", sans-serif`, LineHeight: "1.75", WritingMode: "horizontal-tb", CSS: "p { word-break: keep-all; }"},
+	"ar": {FontFamily: `"Geeza Pro", "Noto Naskh Arabic", serif`, LineHeight: "1.9"},
+	"fa": {FontFamily: `"Geeza Pro", "Noto Naskh Arabic", serif`, LineHeight: "1.9"},
+	"ur": {FontFamily: `"Noto Nastaliq Urdu", "Geeza Pro", serif`, LineHeight: "2.2"},
+	"he": {FontFamily: `"Arial Hebrew", "Noto Serif Hebrew", serif`, LineHeight: "1.6"},
+	"yi": {FontFamily: `"Arial Hebrew", "Noto Serif Hebrew", serif`, LineHeight: "1.6"},
+}
+
+// DefaultLanguageStyle returns the built-in style for a language,
+// which SetLanguageDefaults uses, and whether there is one. There are
+// built-in styles for Chinese, Japanese, and Korean, for Arabic,
+// Persian, and Urdu, and for Hebrew and Yiddish.
+func DefaultLanguageStyle(lang string) (LanguageStyle, bool) {
+	s, ok := defaultLanguageStyles[primaryLanguage(lang)]
+	return s, ok
+}
+
+var languageTagRE = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// SetLanguageStyle sets the style for the XHTML files in a language,
+// such as "ja" or "zh-Hant". The style is written as a stylesheet,
+// css/lang-<lang>.css, that's linked into every XHTML file in the
+// language when the book is written, after the stylesheets added with
+// AddStylesheetWithOptions. A file's language is the one on its html
+// element, or if it has none the book's first language (see
+// AddLanguage). A style for a language applies to its more specific
+// tags too, so a style for "zh" is used for files in "zh-Hant" unless
+// that has a style of its own. Setting a language's style again
+// replaces it.
+//
+// Returns the ID of the language's stylesheet.
+func (e *EPub) SetLanguageStyle(lang string, s LanguageStyle) (Id, error) {
+	if !languageTagRE.MatchString(lang) {
+		return "", fmt.Errorf("%q is not a language tag", lang)
+	}
+	for _, v := range []string{s.FontFamily, s.LineHeight, s.WritingMode} {
+		if strings.ContainsAny(v, ";{}") {
+			return "", fmt.Errorf("invalid CSS value %q in style for %v", v, lang)
+		}
+	}
+	key := strings.ToLower(lang)
+	path := "css/lang-" + key + ".css"
+	css, err := e.languageCSS(path, s)
+	if err != nil {
+		return "", err
+	}
+	if id, ok := e.languageStyles[key]; ok {
+		for i := range e.styles {
+			if e.styles[i].id == id {
+				e.styles[i].contents = css
+			}
+		}
+		return id, nil
+	}
+	id, err := e.addStylesheet(path, css, nil)
+	if err != nil {
+		return "", err
+	}
+	if e.languageStyles == nil {
+		e.languageStyles = make(map[string]Id)
+	}
+	e.languageStyles[key] = id
+	return id, nil
+}
+
+// SetLanguageDefaults controls whether languages that have no style
+// set with SetLanguageStyle get their built-in one (see
+// DefaultLanguageStyle). When it's on, each time the book is written
+// the default style of the book's language, and of the languages of
+// its XHTML files, is set as with SetLanguageStyle, so CJK, Arabic, and
+// Hebrew text gets suitable fonts, line spacing, and writing mode
+// without any work. It's off by default.
+func (e *EPub) SetLanguageDefaults(use bool) {
+	e.languageDefaults = use
+}
+
+// languageCSS returns the stylesheet for a language style, for a
+// stylesheet at path in the book.
+func (e *EPub) languageCSS(path string, s LanguageStyle) ([]byte, error) {
+	var b strings.Builder
+	family := s.FontFamily
+	if s.Font != "" {
+		var f *font
+		for i := range e.fonts {
+			if e.fonts[i].id == s.Font {
+				f = &e.fonts[i]
+			}
+		}
+		if f == nil {
+			return nil, errorf(ErrNotFound, "no font with id %v", s.Font)
+		}
+		rule, fontFamily, err := e.fontFaceRule(*f, path)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(rule + "\n")
+		if family != "" {
+			family = cssString(fontFamily) + ", " + family
+		} else {
+			family = cssString(fontFamily)
+		}
+	}
+	var body strings.Builder
+	if family != "" {
+		fmt.Fprintf(&body, "  font-family: %s;\n", family)
+	}
+	if s.LineHeight != "" {
+		fmt.Fprintf(&body, "  line-height: %s;\n", s.LineHeight)
+	}
+	if s.WritingMode != "" {
+		fmt.Fprintf(&body, "  -epub-writing-mode: %s;\n  writing-mode: %s;\n", s.WritingMode, s.WritingMode)
+	}
+	if body.Len() > 0 {
+		b.WriteString("body {\n" + body.String() + "}\n")
+	}
+	if s.CSS != "" {
+		b.WriteString(strings.TrimSpace(s.CSS) + "\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// htmlLangRE matches the language attribute of an html element.
+var htmlLangRE = regexp.MustCompile(`\s(?:xml:)?lang\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// contentLanguage returns the language declared on the html element
+// of XHTML contents, or the empty string if there isn't one.
+func contentLanguage(c []byte) string {
+	loc := htmlStartRE.FindIndex(c)
+	if loc == nil {
+		return ""
+	}
+	m := htmlLangRE.FindSubmatch(c[loc[0]:loc[1]])
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(string(m[1]) + string(m[2]))
+}
+
+// languageStyle returns the ID of the stylesheet for text in lang,
+// and whether there is one.
+func (e *EPub) languageStyle(lang string) (Id, bool) {
+	for _, l := range languageFallbacks(lang) {
+		if id, ok := e.languageStyles[l]; ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// languageFallbacks returns lang in lower case, followed by the less
+// specific tags it falls back to, such as "zh-hant-tw", "zh-hant", and
+// "zh" for "zh-Hant-TW".
+func languageFallbacks(lang string) []string {
+	lang = strings.ToLower(lang)
+	var ret []string
+	for lang != "" {
+		ret = append(ret, lang)
+		i := strings.LastIndexByte(lang, '-')
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	return ret
+}
+
+// linkLanguageStyle adds a link to the stylesheet for the language of
+// the XHTML contents c, which are the prepared contents of x, if
+// there's one and c doesn't already link to it.
+func (e *EPub) linkLanguageStyle(x xhtml, c []byte) []byte {
+	if len(e.languageStyles) == 0 {
+		return c
+	}
+	lang := contentLanguage(c)
+	if lang == "" {
+		lang = e.language()
+	}
+	id, ok := e.languageStyle(lang)
+	if !ok {
+		return c
+	}
+	for _, s := range e.styles {
+		if s.id != id {
+			continue
+		}
+		href := relativeHref(x.name, s.name)
+		if bytes.Contains(c, []byte(`"`+href+`"`)) {
+			return c
+		}
+		return injectHead(c, fmt.Sprintf("<link rel=\"stylesheet\" type=\"text/css\" %s />\n", attrPair("href", href)))
+	}
+	return c
+}
+
+// addLanguageDefaults sets the built-in style of each language the
+// book uses that has no style of its own, if the book uses the
+// defaults.
+func (e *EPub) addLanguageDefaults() error {
+	if !e.languageDefaults {
+		return nil
+	}
+	langs := []string{e.language()}
+	for _, x := range e.xhtml {
+		langs = append(langs, contentLanguage(x.contents))
+	}
+	for _, lang := range langs {
+		if lang == "" {
+			continue
+		}
+		if _, ok := e.languageStyle(lang); ok {
+			continue
+		}
+		p := primaryLanguage(lang)
+		if s, ok := defaultLanguageStyles[p]; ok {
+			if _, err := e.SetLanguageStyle(p, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,500 @@
+package epub
+
+// This file holds the importer for LaTeX documents.
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	texCommentRE = regexp.MustCompile(`(?m)(^|[^\\])%.*$`)
+	texBlankRE   = regexp.MustCompile(`\n[ \t]*\n\s*`)
+	texCommandRE = regexp.MustCompile(`^\\([a-zA-Z]+)\*?`)
+	texStripRE   = regexp.MustCompile(`\\[a-zA-Z]+\*?`)
+)
+
+// texInline maps LaTeX text commands with one argument to the XHTML
+// elements they convert to.
+var texInline = map[string]string{
+	"emph": "em", "textit": "em", "textbf": "strong", "texttt": "code",
+	"textsc": "span", "underline": "span", "textsuperscript": "sup",
+	"textsubscript": "sub",
+}
+
+// texEnvironments maps LaTeX block environments to the XHTML
+// elements they convert to.
+var texEnvironments = map[string]string{
+	"itemize": "ul", "enumerate": "ol", "description": "dl",
+	"quote": "blockquote", "quotation": "blockquote", "center": "div",
+	"abstract": "div", "verse": "blockquote",
+}
+
+// texMathEnvironments are the LaTeX environments holding display math.
+var texMathEnvironments = map[string]bool{
+	"equation": true, "equation*": true, "displaymath": true,
+	"align": true, "align*": true, "gather": true, "gather*": true,
+	"multline": true, "multline*": true,
+}
+
+// texVerbatimEnvironments are the LaTeX environments whose contents
+// are copied through as preformatted text rather than converted.
+var texVerbatimEnvironments = map[string]bool{
+	"verbatim": true, "verbatim*": true, "lstlisting": true,
+}
+
+// texChapter is a chapter being built up from a LaTeX document.
+type texChapter struct {
+	title    string
+	body     strings.Builder
+	sections []docxSection
+}
+
+// texImporter holds the state needed while importing a LaTeX document.
+type texImporter struct {
+	e        *EPub
+	chapters []*texChapter
+	split    string // The sectioning command that starts a new chapter
+	para     strings.Builder
+	ids      *slugger // Generates heading IDs
+}
+
+// ImportLaTeX creates a new book from a LaTeX document. Source is the
+// name of the .tex file on disk.
+//
+// Each \chapter (or \section, for documents without chapters) starts
+// a new XHTML file and navpoint, with the next sectioning level down
+// becoming child navpoints. Inline and display math is converted to
+// MathML with LaTeXToMathML, and the title and author are taken from
+// the preamble. The contents of verbatim and lstlisting environments
+// and \verb are copied through as preformatted text and code. Only a
+// basic set of text commands and environments is understood; unknown
+// commands are dropped but their arguments kept.
+//
+// Books with MathML should be written as v3 books, which mark the
+// files containing math with the "mathml" manifest property.
+func ImportLaTeX(source string) (*EPub, error) {
+	c, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	src := texCommentRE.ReplaceAllString(string(c), "$1")
+
+	e := New()
+	t := &texImporter{e: e, split: "section", ids: &slugger{slug: Slug, used: make(map[string]bool)}}
+	if strings.Contains(src, `\chapter`) {
+		t.split = "chapter"
+	}
+
+	body := src
+	if i := strings.Index(src, `\begin{document}`); i >= 0 {
+		t.preamble(src[:i])
+		body = src[i+len(`\begin{document}`):]
+	}
+	if i := strings.Index(body, `\end{document}`); i >= 0 {
+		body = body[:i]
+	}
+	if err := t.blocks(body); err != nil {
+		return nil, fmt.Errorf("unable to convert %v: %v", source, err)
+	}
+	t.flush()
+
+	if len(t.chapters) == 0 {
+		t.current()
+	}
+	for i, ch := range t.chapters {
+		page := fmt.Sprintf("xhtml/chapter%03d.xhtml", i+1)
+		title := ch.title
+		if title == "" {
+			title = e.title
+		}
+		if _, err := e.AddXHTML(page, xhtmlPage(title, ch.body.String())); err != nil {
+			return nil, err
+		}
+		if ch.title == "" {
+			continue
+		}
+		np := e.AddNavpoint(ch.title, page, i+1)
+		for j, s := range ch.sections {
+			np.AddNavpoint(s.title, page+"#"+s.id, j+1)
+		}
+	}
+	return e, nil
+}
+
+// preamble picks the book's metadata out of the document preamble.
+func (t *texImporter) preamble(src string) {
+	for _, cmd := range []string{"title", "author"} {
+		i := strings.Index(src, `\`+cmd+`{`)
+		if i < 0 {
+			continue
+		}
+		arg, _, err := texArg(src, i+len(cmd)+1)
+		if err != nil {
+			continue
+		}
+		switch cmd {
+		case "title":
+			t.e.SetTitle(texPlain(arg))
+		case "author":
+			for _, a := range strings.Split(arg, `\and`) {
+				if a = texPlain(a); a != "" {
+					t.e.AddAuthor(a)
+				}
+			}
+		}
+	}
+}
+
+// texArg returns the braced argument starting at src[i] and the index
+// just past it.
+func texArg(src string, i int) (string, int, error) {
+	for i < len(src) && (src[i] == ' ' || src[i] == '\n' || src[i] == '\t') {
+		i++
+	}
+	if i >= len(src) || src[i] != '{' {
+		return "", i, fmt.Errorf("expected { at offset %v", i)
+	}
+	depth := 0
+	for j := i; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return src[i+1 : j], j + 1, nil
+			}
+		}
+	}
+	return "", i, fmt.Errorf("unbalanced braces at offset %v", i)
+}
+
+// texPlain strips commands and braces from LaTeX text, leaving plain
+// text suitable for titles and metadata.
+func texPlain(s string) string {
+	s = strings.NewReplacer(`\&`, "&", `\%`, "%", `\$`, "$", `\#`, "#", `\_`, "_").Replace(s)
+	s = texStripRE.ReplaceAllString(s, "")
+	s = strings.NewReplacer("{", "", "}", "", "~", " ", `\\`, " ").Replace(s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// current returns the chapter being built, starting an untitled one
+// if necessary.
+func (t *texImporter) current() *texChapter {
+	if len(t.chapters) == 0 {
+		t.chapters = append(t.chapters, &texChapter{})
+	}
+	return t.chapters[len(t.chapters)-1]
+}
+
+// flush writes out the paragraph being built, if there is one.
+func (t *texImporter) flush() {
+	p := strings.TrimSpace(t.para.String())
+	t.para.Reset()
+	if p != "" {
+		fmt.Fprintf(&t.current().body, "<p>%s</p>\n", p)
+	}
+}
+
+// sectionLevel returns the heading level for a sectioning command,
+// relative to the command that splits chapters, or 0 if the command
+// isn't a sectioning command.
+func (t *texImporter) sectionLevel(cmd string) int {
+	levels := []string{"part", "chapter", "section", "subsection", "subsubsection", "paragraph"}
+	base := 1
+	if t.split == "section" {
+		base = 2
+	}
+	for i, l := range levels {
+		if l == cmd {
+			if i < base {
+				return 1
+			}
+			return i - base + 1
+		}
+	}
+	return 0
+}
+
+// blocks converts a run of LaTeX body text.
+func (t *texImporter) blocks(src string) error {
+	for i := 0; i < len(src); {
+		switch {
+		case strings.HasPrefix(src[i:], `\begin{`):
+			name, end, err := texArg(src, i+len(`\begin`))
+			if err != nil {
+				return err
+			}
+			closing := `\end{` + name + `}`
+			j := strings.Index(src[end:], closing)
+			if j < 0 {
+				return fmt.Errorf("missing %v", closing)
+			}
+			if err := t.environment(name, src[end:end+j]); err != nil {
+				return err
+			}
+			i = end + j + len(closing)
+		case strings.HasPrefix(src[i:], `$$`), strings.HasPrefix(src[i:], `\[`):
+			closing := "$$"
+			if src[i+1] == '[' {
+				closing = `\]`
+			}
+			j := strings.Index(src[i+2:], closing)
+			if j < 0 {
+				return fmt.Errorf("missing %v", closing)
+			}
+			if err := t.displayMath(src[i+2 : i+2+j]); err != nil {
+				return err
+			}
+			i += 2 + j + len(closing)
+		case src[i] == '\n':
+			if loc := texBlankRE.FindStringIndex(src[i:]); loc != nil && loc[0] == 0 {
+				t.flush()
+				i += loc[1]
+				continue
+			}
+			t.para.WriteByte(' ')
+			i++
+		case src[i] == '\\':
+			n, err := t.command(src, i)
+			if err != nil {
+				return err
+			}
+			i = n
+		default:
+			n, err := t.inline(src, i, &t.para)
+			if err != nil {
+				return err
+			}
+			i = n
+		}
+	}
+	return nil
+}
+
+// command converts the block-level command at src[i], falling back to
+// inline conversion for everything else. It returns the index just
+// past the command.
+func (t *texImporter) command(src string, i int) (int, error) {
+	name := texCommandRE.FindStringSubmatch(src[i:])
+	if name == nil {
+		return t.inline(src, i, &t.para)
+	}
+	end := i + len(name[0])
+	level := t.sectionLevel(name[1])
+	switch {
+	case level > 0:
+		arg, n, err := texArg(src, end)
+		if err != nil {
+			return 0, err
+		}
+		t.flush()
+		title := texPlain(arg)
+		if level == 1 {
+			t.chapters = append(t.chapters, &texChapter{title: title})
+		}
+		ch := t.current()
+		if level > 6 {
+			level = 6
+		}
+		id := t.ids.id(title)
+		if level == 2 {
+			ch.sections = append(ch.sections, docxSection{title: title, id: id})
+		}
+		var h strings.Builder
+		if _, err := t.inline(arg, 0, &h, len(arg)); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(&ch.body, "<h%v %s>%s</h%v>\n", level, attrPair("id", id), h.String(), level)
+		return n, nil
+	case name[1] == "maketitle" || name[1] == "tableofcontents" || name[1] == "newpage" || name[1] == "clearpage":
+		return end, nil
+	case name[1] == "label":
+		_, n, err := texArg(src, end)
+		return n, err
+	}
+	return t.inline(src, i, &t.para)
+}
+
+// environment converts a block environment.
+func (t *texImporter) environment(name, body string) error {
+	if texVerbatimEnvironments[name] {
+		if name == "lstlisting" && strings.HasPrefix(body, "[") {
+			// Skip the listing's options.
+			if j := strings.Index(body, "]"); j > 0 {
+				body = body[j+1:]
+			}
+		}
+		t.flush()
+		body = strings.TrimPrefix(strings.TrimPrefix(body, "\r"), "\n")
+		fmt.Fprintf(&t.current().body, "<pre %s>%s</pre>\n", attrPair("class", strings.TrimSuffix(name, "*")), html.EscapeString(body))
+		return nil
+	}
+	if texMathEnvironments[name] {
+		body = strings.ReplaceAll(body, "&", "")
+		body = strings.ReplaceAll(body, `\\`, " ")
+		return t.displayMath(body)
+	}
+	t.flush()
+	ch := t.current()
+	tag, ok := texEnvironments[name]
+	if !ok {
+		tag = "div"
+	}
+	fmt.Fprintf(&ch.body, "<%s %s>\n", tag, attrPair("class", name))
+	if tag == "ul" || tag == "ol" || tag == "dl" {
+		items := strings.Split(body, `\item`)
+		for _, item := range items[1:] {
+			var b strings.Builder
+			item = strings.TrimSpace(item)
+			label := ""
+			if tag == "dl" && strings.HasPrefix(item, "[") {
+				if j := strings.Index(item, "]"); j > 0 {
+					label, item = item[1:j], item[j+1:]
+				}
+			}
+			if _, err := t.inline(item, 0, &b, len(item)); err != nil {
+				return err
+			}
+			if tag == "dl" {
+				fmt.Fprintf(&ch.body, "<dt>%s</dt><dd>%s</dd>\n", html.EscapeString(texPlain(label)), strings.TrimSpace(b.String()))
+			} else {
+				fmt.Fprintf(&ch.body, "<li>%s</li>\n", strings.TrimSpace(b.String()))
+			}
+		}
+	} else {
+		if err := t.blocks(body); err != nil {
+			return err
+		}
+		t.flush()
+	}
+	fmt.Fprintf(&ch.body, "</%s>\n", tag)
+	return nil
+}
+
+// displayMath writes a block of display math.
+func (t *texImporter) displayMath(tex string) error {
+	m, err := LaTeXToMathML(tex, true)
+	if err != nil {
+		return err
+	}
+	t.flush()
+	fmt.Fprintf(&t.current().body, "<div class=\"math\">%s</div>\n", m)
+	return nil
+}
+
+// texSpecials maps LaTeX character sequences to their text.
+var texSpecials = []string{
+	"---", "—", "--", "–", "``", "“", "''", "”", "~", " ",
+	`\&`, "&", `\%`, "%", `\$`, "$", `\#`, "#", `\_`, "_", `\{`, "{", `\}`, "}",
+	`\ldots`, "…", `\dots`, "…", `\LaTeX`, "LaTeX", `\TeX`, "TeX",
+}
+
+// inline converts inline LaTeX starting at src[i] into b, stopping at
+// the end of the current token (or at limit, if given, after
+// converting everything up to it). It returns the index just past
+// what was converted.
+func (t *texImporter) inline(src string, i int, b *strings.Builder, limit ...int) (int, error) {
+	stop := i + 1
+	if len(limit) > 0 {
+		stop = limit[0]
+	}
+	for i < stop && i < len(src) {
+		matched := false
+		for k := 0; k < len(texSpecials); k += 2 {
+			if strings.HasPrefix(src[i:], texSpecials[k]) {
+				b.WriteString(html.EscapeString(texSpecials[k+1]))
+				i += len(texSpecials[k])
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(src[i:], `\\`):
+			b.WriteString("<br />")
+			i += 2
+		case src[i] == '$' || strings.HasPrefix(src[i:], `\(`):
+			open, closing := 1, "$"
+			if src[i] == '\\' {
+				open, closing = 2, `\)`
+			}
+			j := strings.Index(src[i+open:], closing)
+			if j < 0 {
+				return 0, fmt.Errorf("missing %v", closing)
+			}
+			m, err := LaTeXToMathML(src[i+open:i+open+j], false)
+			if err != nil {
+				return 0, err
+			}
+			b.WriteString(m)
+			i += open + j + len(closing)
+		case src[i] == '\\':
+			name := texCommandRE.FindStringSubmatch(src[i:])
+			if name == nil {
+				// An escaped character we don't know; keep the character.
+				if i+1 < len(src) {
+					b.WriteString(html.EscapeString(src[i+1 : i+2]))
+				}
+				i += 2
+				continue
+			}
+			i += len(name[0])
+			if name[1] == "verb" && i < len(src) {
+				// \verb|text| quotes text up to the next delimiter.
+				j := strings.IndexByte(src[i+1:], src[i])
+				if j < 0 {
+					return 0, fmt.Errorf("unterminated \\verb at offset %v", i)
+				}
+				fmt.Fprintf(b, `<code class="verb">%s</code>`, html.EscapeString(src[i+1:i+1+j]))
+				i += j + 2
+				continue
+			}
+			if name[1] == "label" || name[1] == "index" || name[1] == "ref" || name[1] == "cite" {
+				_, n, err := texArg(src, i)
+				if err != nil {
+					return 0, err
+				}
+				i = n
+				continue
+			}
+			tag := texInline[name[1]]
+			if name[1] == "footnote" {
+				tag = "span"
+			}
+			if i < len(src) && src[i] == '{' {
+				arg, n, err := texArg(src, i)
+				if err != nil {
+					return 0, err
+				}
+				var inner strings.Builder
+				if _, err := t.inline(arg, 0, &inner, len(arg)); err != nil {
+					return 0, err
+				}
+				if tag != "" {
+					fmt.Fprintf(b, `<%s %s>%s</%s>`, tag, attrPair("class", name[1]), inner.String(), tag)
+				} else {
+					b.WriteString(inner.String())
+				}
+				i = n
+			}
+		case src[i] == '{' || src[i] == '}':
+			i++
+		case src[i] == '\n':
+			b.WriteByte(' ')
+			i++
+		default:
+			b.WriteString(html.EscapeString(src[i : i+1]))
+			i++
+		}
+	}
+	return i, nil
+}
@@ -0,0 +1,349 @@
+package epub
+
+// This file holds a small converter from TeX math notation to MathML.
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// texSymbols maps TeX commands to the MathML element and text they
+// produce.
+var texSymbols = map[string][2]string{
+	"alpha": {"mi", "α"}, "beta": {"mi", "β"}, "gamma": {"mi", "γ"}, "delta": {"mi", "δ"},
+	"epsilon": {"mi", "ϵ"}, "varepsilon": {"mi", "ε"}, "zeta": {"mi", "ζ"}, "eta": {"mi", "η"},
+	"theta": {"mi", "θ"}, "vartheta": {"mi", "ϑ"}, "iota": {"mi", "ι"}, "kappa": {"mi", "κ"},
+	"lambda": {"mi", "λ"}, "mu": {"mi", "μ"}, "nu": {"mi", "ν"}, "xi": {"mi", "ξ"},
+	"pi": {"mi", "π"}, "rho": {"mi", "ρ"}, "sigma": {"mi", "σ"}, "tau": {"mi", "τ"},
+	"upsilon": {"mi", "υ"}, "phi": {"mi", "ϕ"}, "varphi": {"mi", "φ"}, "chi": {"mi", "χ"},
+	"psi": {"mi", "ψ"}, "omega": {"mi", "ω"}, "Gamma": {"mi", "Γ"}, "Delta": {"mi", "Δ"},
+	"Theta": {"mi", "Θ"}, "Lambda": {"mi", "Λ"}, "Xi": {"mi", "Ξ"}, "Pi": {"mi", "Π"},
+	"Sigma": {"mi", "Σ"}, "Upsilon": {"mi", "Υ"}, "Phi": {"mi", "Φ"}, "Psi": {"mi", "Ψ"},
+	"Omega": {"mi", "Ω"}, "infty": {"mi", "∞"}, "partial": {"mi", "∂"}, "nabla": {"mi", "∇"},
+	"ell": {"mi", "ℓ"}, "hbar": {"mi", "ℏ"}, "emptyset": {"mi", "∅"},
+	"times": {"mo", "×"}, "cdot": {"mo", "⋅"}, "div": {"mo", "÷"}, "pm": {"mo", "±"},
+	"mp": {"mo", "∓"}, "leq": {"mo", "≤"}, "le": {"mo", "≤"}, "geq": {"mo", "≥"},
+	"ge": {"mo", "≥"}, "neq": {"mo", "≠"}, "ne": {"mo", "≠"}, "approx": {"mo", "≈"},
+	"equiv": {"mo", "≡"}, "sim": {"mo", "∼"}, "propto": {"mo", "∝"}, "in": {"mo", "∈"},
+	"notin": {"mo", "∉"}, "subset": {"mo", "⊂"}, "subseteq": {"mo", "⊆"}, "supset": {"mo", "⊃"},
+	"cup": {"mo", "∪"}, "cap": {"mo", "∩"}, "wedge": {"mo", "∧"}, "vee": {"mo", "∨"},
+	"neg": {"mo", "¬"}, "forall": {"mo", "∀"}, "exists": {"mo", "∃"}, "to": {"mo", "→"},
+	"rightarrow": {"mo", "→"}, "leftarrow": {"mo", "←"}, "Rightarrow": {"mo", "⇒"},
+	"Leftarrow": {"mo", "⇐"}, "leftrightarrow": {"mo", "↔"}, "Leftrightarrow": {"mo", "⇔"},
+	"mapsto": {"mo", "↦"}, "ldots": {"mo", "…"}, "cdots": {"mo", "⋯"}, "dots": {"mo", "…"},
+	"sum": {"mo", "∑"}, "prod": {"mo", "∏"}, "int": {"mo", "∫"}, "oint": {"mo", "∮"},
+	"circ": {"mo", "∘"}, "ast": {"mo", "∗"}, "star": {"mo", "⋆"}, "langle": {"mo", "⟨"},
+	"rangle": {"mo", "⟩"}, "lbrace": {"mo", "{"}, "rbrace": {"mo", "}"}, "{": {"mo", "{"},
+	"}": {"mo", "}"}, "|": {"mo", "‖"}, "mid": {"mo", "|"},
+	"sin": {"mi", "sin"}, "cos": {"mi", "cos"}, "tan": {"mi", "tan"}, "log": {"mi", "log"},
+	"ln": {"mi", "ln"}, "exp": {"mi", "exp"}, "lim": {"mo", "lim"}, "max": {"mo", "max"},
+	"min": {"mo", "min"}, "sup": {"mo", "sup"}, "inf": {"mo", "inf"}, "det": {"mi", "det"},
+}
+
+// texSpaces are the TeX spacing commands, and the widths we give them.
+var texSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ";": "0.278em", " ": "0.333em",
+	"quad": "1em", "qquad": "2em", "!": "0em",
+}
+
+// texParser converts TeX math to MathML.
+type texParser struct {
+	src      []rune
+	pos      int
+	optional int // Nesting depth of optional [] arguments
+}
+
+// LaTeXToMathML converts a fragment of TeX math notation (without the
+// surrounding $ delimiters) to a MathML math element. If display is
+// true the element is marked as display (block) math.
+//
+// Only common constructs are supported: fractions, roots, sub- and
+// superscripts, Greek letters and the usual operator symbols, \text,
+// \mathbf and friends, and \left/\right delimiters. Unknown commands
+// are rendered as their names.
+func LaTeXToMathML(tex string, display bool) (string, error) {
+	p := &texParser{src: []rune(tex)}
+	body, err := p.expr()
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.src) {
+		return "", fmt.Errorf("unexpected %q in math at offset %v", string(p.src[p.pos]), p.pos)
+	}
+	mode := ""
+	if display {
+		mode = ` display="block"`
+	}
+	return fmt.Sprintf(`<math xmlns="http://www.w3.org/1998/Math/MathML"%s><mrow>%s</mrow></math>`, mode, body), nil
+}
+
+func (p *texParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// command reads a command name; the backslash has already been
+// consumed.
+func (p *texParser) command() string {
+	start := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start && p.pos < len(p.src) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+// expr parses a sequence of atoms up to a closing brace, \right, or
+// the end of the input.
+func (p *texParser) expr() (string, error) {
+	var b strings.Builder
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || p.src[p.pos] == '}' || p.src[p.pos] == ']' && p.optional > 0 {
+			return b.String(), nil
+		}
+		if p.peekCommand("right") {
+			return b.String(), nil
+		}
+		a, err := p.scripted()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(a)
+	}
+}
+
+// peekCommand reports whether the next token is the named command.
+func (p *texParser) peekCommand(name string) bool {
+	n := []rune("\\" + name)
+	if p.pos+len(n) > len(p.src) || string(p.src[p.pos:p.pos+len(n)]) != string(n) {
+		return false
+	}
+	end := p.pos + len(n)
+	return end == len(p.src) || !unicode.IsLetter(p.src[end])
+}
+
+// scripted parses an atom and any sub- or superscripts attached to it.
+func (p *texParser) scripted() (string, error) {
+	base, err := p.atom()
+	if err != nil {
+		return "", err
+	}
+	var sub, sup string
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || (p.src[p.pos] != '^' && p.src[p.pos] != '_') {
+			break
+		}
+		c := p.src[p.pos]
+		p.pos++
+		p.skipSpace()
+		a, err := p.atom()
+		if err != nil {
+			return "", err
+		}
+		if c == '^' {
+			sup = a
+		} else {
+			sub = a
+		}
+	}
+	switch {
+	case sub != "" && sup != "":
+		return fmt.Sprintf("<msubsup>%s%s%s</msubsup>", base, sub, sup), nil
+	case sub != "":
+		return fmt.Sprintf("<msub>%s%s</msub>", base, sub), nil
+	case sup != "":
+		return fmt.Sprintf("<msup>%s%s</msup>", base, sup), nil
+	}
+	return base, nil
+}
+
+// group parses a braced group, or a single atom if there's no brace.
+func (p *texParser) group() (string, error) {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '{' {
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return "", err
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '}' {
+			return "", fmt.Errorf("missing } in math")
+		}
+		p.pos++
+		return "<mrow>" + e + "</mrow>", nil
+	}
+	return p.atom()
+}
+
+// rawGroup returns the unparsed text of a braced group.
+func (p *texParser) rawGroup() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		return "", fmt.Errorf("expected { in math at offset %v", p.pos)
+	}
+	depth := 0
+	start := p.pos + 1
+	for ; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return string(p.src[start : p.pos-1]), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("missing } in math")
+}
+
+// atom parses a single atom.
+func (p *texParser) atom() (string, error) {
+	if p.pos >= len(p.src) {
+		return "", fmt.Errorf("unexpected end of math")
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '{':
+		return p.group()
+	case c == '\\':
+		p.pos++
+		return p.commandAtom(p.command())
+	case unicode.IsDigit(c) || c == '.' && p.pos+1 < len(p.src) && unicode.IsDigit(p.src[p.pos+1]):
+		start := p.pos
+		for p.pos < len(p.src) && (unicode.IsDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		return "<mn>" + string(p.src[start:p.pos]) + "</mn>", nil
+	case unicode.IsLetter(c):
+		p.pos++
+		return "<mi>" + string(c) + "</mi>", nil
+	case c == '}':
+		return "", fmt.Errorf("unexpected } in math at offset %v", p.pos)
+	}
+	p.pos++
+	s := string(c)
+	if c == '\'' {
+		s = "′"
+	}
+	return "<mo>" + html.EscapeString(s) + "</mo>", nil
+}
+
+// commandAtom converts a command and its arguments.
+func (p *texParser) commandAtom(name string) (string, error) {
+	if sym, ok := texSymbols[name]; ok {
+		return fmt.Sprintf("<%s>%s</%s>", sym[0], html.EscapeString(sym[1]), sym[0]), nil
+	}
+	if w, ok := texSpaces[name]; ok {
+		return fmt.Sprintf(`<mspace %s />`, attrPair("width", w)), nil
+	}
+	switch name {
+	case "frac", "dfrac", "tfrac":
+		n, err := p.group()
+		if err != nil {
+			return "", err
+		}
+		d, err := p.group()
+		if err != nil {
+			return "", err
+		}
+		return "<mfrac>" + n + d + "</mfrac>", nil
+	case "sqrt":
+		p.skipSpace()
+		if p.pos < len(p.src) && p.src[p.pos] == '[' {
+			p.pos++
+			p.optional++
+			idx, err := p.expr()
+			p.optional--
+			if err != nil {
+				return "", err
+			}
+			if p.pos >= len(p.src) || p.src[p.pos] != ']' {
+				return "", fmt.Errorf("missing ] in math")
+			}
+			p.pos++
+			r, err := p.group()
+			if err != nil {
+				return "", err
+			}
+			return "<mroot>" + r + "<mrow>" + idx + "</mrow></mroot>", nil
+		}
+		r, err := p.group()
+		if err != nil {
+			return "", err
+		}
+		return "<msqrt>" + r + "</msqrt>", nil
+	case "text", "textrm", "mbox", "mathrm", "operatorname":
+		t, err := p.rawGroup()
+		if err != nil {
+			return "", err
+		}
+		if name == "text" || name == "mbox" || name == "textrm" {
+			return "<mtext>" + html.EscapeString(t) + "</mtext>", nil
+		}
+		return `<mi mathvariant="normal">` + html.EscapeString(t) + "</mi>", nil
+	case "mathbf", "mathit", "mathcal", "mathbb", "mathsf", "mathtt", "boldsymbol":
+		variants := map[string]string{
+			"mathbf": "bold", "boldsymbol": "bold-italic", "mathit": "italic",
+			"mathcal": "script", "mathbb": "double-struck", "mathsf": "sans-serif",
+			"mathtt": "monospace",
+		}
+		g, err := p.group()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(`<mstyle %s>%s</mstyle>`, attrPair("mathvariant", variants[name]), g), nil
+	case "left":
+		p.skipSpace()
+		open, err := p.delimiter()
+		if err != nil {
+			return "", err
+		}
+		inner, err := p.expr()
+		if err != nil {
+			return "", err
+		}
+		if !p.peekCommand("right") {
+			return "", fmt.Errorf("\\left without \\right in math")
+		}
+		p.pos += len("\\right")
+		p.skipSpace()
+		closing, err := p.delimiter()
+		if err != nil {
+			return "", err
+		}
+		return "<mrow>" + open + inner + closing + "</mrow>", nil
+	}
+	return "<mi>" + html.EscapeString(name) + "</mi>", nil
+}
+
+// delimiter parses the delimiter after \left or \right. A "." is an
+// empty delimiter.
+func (p *texParser) delimiter() (string, error) {
+	if p.pos >= len(p.src) {
+		return "", fmt.Errorf("missing delimiter in math")
+	}
+	c := p.src[p.pos]
+	if c == '.' {
+		p.pos++
+		return "", nil
+	}
+	if c == '\\' {
+		p.pos++
+		name := p.command()
+		if sym, ok := texSymbols[name]; ok {
+			return `<mo fence="true">` + html.EscapeString(sym[1]) + "</mo>", nil
+		}
+		return "", fmt.Errorf("unknown delimiter \\%v in math", name)
+	}
+	p.pos++
+	return `<mo fence="true">` + html.EscapeString(string(c)) + "</mo>", nil
+}
@@ -0,0 +1,257 @@
+package epub
+
+// This file holds the code for audio and video resources, and the
+// text tracks that go with them.
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"strings"
+)
+
+type media struct {
+	name      string
+	contents  []byte
+	mediaType string
+	id        Id
+	poster    Id // Image shown before a video plays, if any
+	fallback  Id // Manifest fallback for the media, if any
+	tracks    []track
+}
+
+// track is a timed text track attached to a video.
+type track struct {
+	id      Id     // The ID of the WebVTT file
+	kind    string // subtitles, captions, descriptions, chapters, or metadata
+	srclang string
+	label   string
+}
+
+// addMedia adds an audio or video file to the book. Kind is "audio"
+// or "video" and is used to check the file's extension.
+func (e *EPub) addMedia(kind, path string, contents []byte) (Id, error) {
+	mt, _, ok := LookupMediaType(path)
+	if !ok || !strings.HasPrefix(mt, kind+"/") {
+		return "", errorf(ErrUnsupportedFormat, "unrecognized %v file extension for %q", kind, path)
+	}
+	m := media{name: path, contents: contents, mediaType: mt, id: e.nextId(kind)}
+	e.media = append(e.media, m)
+	return m.id, nil
+}
+
+// AddAudio adds an audio file to the ePub book. Path is the relative
+// path in the book to the file, and contents is the audio itself. The
+// file type is taken from the file extension.
+//
+// Returns the ID of the added file, or an error if something went wrong.
+func (e *EPub) AddAudio(path string, contents []byte) (Id, error) {
+	return e.addMedia("audio", path, contents)
+}
+
+// AddAudioFile adds the named audio file to the ePub book. source is
+// the name of the file to be added while dest is the name the file
+// should have in the ePub book.
+//
+// Returns the ID of the added file, or an error if something went
+// wrong reading the file.
+func (e *EPub) AddAudioFile(source, dest string) (Id, error) {
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.AddAudio(dest, c)
+	})
+}
+
+// AddVideo adds a video file to the ePub book. Path is the relative
+// path in the book to the file, and contents is the video itself. The
+// file type is taken from the file extension.
+//
+// Video isn't a core media type in ePub, so videos should have a
+// fallback set with SetMediaFallback.
+//
+// Returns the ID of the added file, or an error if something went wrong.
+func (e *EPub) AddVideo(path string, contents []byte) (Id, error) {
+	return e.addMedia("video", path, contents)
+}
+
+// AddVideoFile adds the named video file to the ePub book. source is
+// the name of the file to be added while dest is the name the file
+// should have in the ePub book.
+//
+// Returns the ID of the added file, or an error if something went
+// wrong reading the file.
+func (e *EPub) AddVideoFile(source, dest string) (Id, error) {
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.AddVideo(dest, c)
+	})
+}
+
+// AddTextTrack adds a WebVTT subtitle or caption file to the ePub
+// book. Path is the relative path in the book to the file, and
+// contents is the WebVTT text itself. Use AddVideoTrack to attach the
+// track to a video.
+//
+// Returns the ID of the added file, or an error if something went wrong.
+func (e *EPub) AddTextTrack(path, contents string) (Id, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".vtt" {
+		return "", errorf(ErrUnsupportedFormat, "text track %q must have a .vtt extension", path)
+	}
+	if !strings.HasPrefix(strings.TrimPrefix(contents, "\ufeff"), "WEBVTT") {
+		return "", errorf(ErrUnsupportedFormat, "text track %q is not a WebVTT file", path)
+	}
+	m := media{name: path, contents: []byte(contents), mediaType: "text/vtt", id: e.nextId("track")}
+	e.media = append(e.media, m)
+	return m.id, nil
+}
+
+// validTrackKinds are the kinds of timed text track HTML allows.
+var validTrackKinds = map[string]bool{
+	"subtitles": true, "captions": true, "descriptions": true,
+	"chapters": true, "metadata": true,
+}
+
+// AddVideoTrack attaches a text track added with AddTextTrack to a
+// video, so that VideoMarkup includes a track element for it. Kind is
+// the HTML track kind ("captions", "subtitles", and so on), srclang
+// the language of the track, and label the name reading systems show
+// for it. Video must be a video added with AddVideo, not audio.
+func (e *EPub) AddVideoTrack(video, textTrack Id, kind, srclang, label string) error {
+	if !validTrackKinds[kind] {
+		return errorf(ErrInvalidArgument, "invalid track kind %v", kind)
+	}
+	m, err := e.findVideo(video)
+	if err != nil {
+		return err
+	}
+	t, err := e.findMedia(textTrack)
+	if err != nil {
+		return err
+	}
+	if t.mediaType != "text/vtt" {
+		return errorf(ErrUnsupportedFormat, "%v is not a text track", textTrack)
+	}
+	m.tracks = append(m.tracks, track{id: textTrack, kind: kind, srclang: srclang, label: label})
+	return nil
+}
+
+// findMedia returns the audio or video file with the given ID.
+func (e *EPub) findMedia(id Id) (*media, error) {
+	for i := range e.media {
+		if e.media[i].id == id {
+			return &e.media[i], nil
+		}
+	}
+	return nil, errorf(ErrNotFound, "no audio or video with id %v", id)
+}
+
+// findVideo returns the video with the given ID.
+func (e *EPub) findVideo(id Id) (*media, error) {
+	m, err := e.findMedia(id)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(m.mediaType, "video/") {
+		return nil, errorf(ErrUnsupportedFormat, "%v is %v, not a video", id, m.mediaType)
+	}
+	return m, nil
+}
+
+// findImage returns the image with the given ID.
+func (e *EPub) findImage(id Id) (*image, error) {
+	if i, ok := e.imageIndex[id]; ok && i < len(e.images) && e.images[i].id == id {
+		return &e.images[i], nil
+	}
+	for i := range e.images {
+		if e.images[i].id == id {
+			return &e.images[i], nil
+		}
+	}
+	return nil, errorf(ErrNotFound, "no image with id %v", id)
+}
+
+// findXHTML returns the XHTML file with the given ID.
+func (e *EPub) findXHTML(id Id) (*xhtml, error) {
+	for i := range e.xhtml {
+		if e.xhtml[i].id == id {
+			return &e.xhtml[i], nil
+		}
+	}
+	return nil, errorf(ErrNotFound, "no XHTML file with id %v", id)
+}
+
+// SetMediaPoster sets the poster image for a video, which is
+// displayed before the video plays. Video is the ID of a video added
+// with AddVideo and poster the ID of an image added with AddImage.
+func (e *EPub) SetMediaPoster(video, poster Id) error {
+	m, err := e.findVideo(video)
+	if err != nil {
+		return err
+	}
+	if _, err := e.findImage(poster); err != nil {
+		return err
+	}
+	m.poster = poster
+	return nil
+}
+
+// SetMediaFallback sets the manifest fallback for an audio or video
+// file. Fallback is the ID of an XHTML file, added with AddXHTML,
+// that reading systems which can't play the media will show
+// instead. This is required for non-core media types such as video.
+func (e *EPub) SetMediaFallback(media, fallback Id) error {
+	m, err := e.findMedia(media)
+	if err != nil {
+		return err
+	}
+	if _, err := e.findXHTML(fallback); err != nil {
+		return err
+	}
+	m.fallback = fallback
+	return nil
+}
+
+// VideoMarkup returns a video element for the given video, suitable
+// for including in the XHTML file named from. The video's poster, if
+// any, is included, and fallbackText is shown by reading systems that
+// don't support the video element. If the video has a fallback XHTML
+// file, the fallback text links to it. Video must be a video added
+// with AddVideo.
+func (e *EPub) VideoMarkup(video Id, from, fallbackText string) (string, error) {
+	m, err := e.findVideo(video)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<video %s controls="controls"`, attrPair("src", relativeHref(from, m.name)))
+	if m.poster != "" {
+		p, err := e.findImage(m.poster)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(" " + attrPair("poster", relativeHref(from, p.name)))
+	}
+	b.WriteString(">\n")
+	for _, t := range m.tracks {
+		tm, err := e.findMedia(t.id)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, `  <track %s %s`, attrPair("kind", t.kind), attrPair("src", relativeHref(from, tm.name)))
+		if t.srclang != "" {
+			b.WriteString(" " + attrPair("srclang", t.srclang))
+		}
+		if t.label != "" {
+			b.WriteString(" " + attrPair("label", t.label))
+		}
+		b.WriteString(" />\n")
+	}
+	text := html.EscapeString(fallbackText)
+	if m.fallback != "" {
+		x, err := e.findXHTML(m.fallback)
+		if err != nil {
+			return "", err
+		}
+		text = fmt.Sprintf(`<a %s>%s</a>`, attrPair("href", relativeHref(from, x.name)), text)
+	}
+	fmt.Fprintf(&b, "  <p>%s</p>\n</video>", text)
+	return b.String(), nil
+}
@@ -0,0 +1,144 @@
+package epub
+
+// This file holds the registry of the media types of the files that
+// can go in a book.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// mediaTypeEntry is a registered media type.
+type mediaTypeEntry struct {
+	mediaType string
+	core      bool
+}
+
+var (
+	mediaTypesMu sync.RWMutex
+	// mediaTypes maps lowercase file extensions to their media types.
+	mediaTypes = map[string]mediaTypeEntry{
+		".gif":   {"image/gif", true},
+		".jpg":   {"image/jpeg", true},
+		".jpeg":  {"image/jpeg", true},
+		".png":   {"image/png", true},
+		".svg":   {"image/svg+xml", true},
+		".webp":  {"image/webp", true},
+		".xhtml": {"application/xhtml+xml", true},
+		".css":   {"text/css", true},
+		".js":    {"application/javascript", true},
+		".otf":   {"application/opentype", true},
+		".ttf":   {"font/ttf", true},
+		".woff":  {"font/woff", true},
+		".woff2": {"font/woff2", true},
+		".ncx":   {"application/x-dtbncx+xml", true},
+		".smil":  {"application/smil+xml", true},
+		".pls":   {"application/pls+xml", true},
+		".mp3":   {"audio/mpeg", true},
+		".m4a":   {"audio/mp4", true},
+		".aac":   {"audio/mp4", true},
+		".ogg":   {"audio/ogg", true},
+		".opus":  {"audio/ogg; codecs=opus", true},
+		".mp4":   {"video/mp4", false},
+		".m4v":   {"video/mp4", false},
+		".webm":  {"video/webm", false},
+		".ogv":   {"video/ogg", false},
+		".vtt":   {"text/vtt", false},
+	}
+)
+
+// RegisterMediaType registers the media type of files with the given
+// extension, such as ".xpgt", so they can be added with AddResource.
+// Core is whether the type is one of ePub's core media types, which
+// reading systems must support; files of other types should have a
+// fallback set with SetMediaFallback. Registering an extension again
+// replaces its media type, so built-in types can be overridden too.
+//
+// The registry is shared by all books.
+func RegisterMediaType(ext, mediaType string, core bool) error {
+	if !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.ContainsAny(ext, "/\\") {
+		return fmt.Errorf("invalid file extension %q", ext)
+	}
+	if i := strings.Index(mediaType, "/"); i <= 0 || i == len(mediaType)-1 {
+		return fmt.Errorf("invalid media type %q", mediaType)
+	}
+	mediaTypesMu.Lock()
+	defer mediaTypesMu.Unlock()
+	mediaTypes[strings.ToLower(ext)] = mediaTypeEntry{mediaType, core}
+	return nil
+}
+
+// LookupMediaType returns the media type registered for the extension
+// of the named file, whether it's a core media type, and whether
+// there is one.
+func LookupMediaType(name string) (mediaType string, core, ok bool) {
+	mediaTypesMu.RLock()
+	defer mediaTypesMu.RUnlock()
+	m, ok := mediaTypes[strings.ToLower(filepath.Ext(name))]
+	return m.mediaType, m.core, ok
+}
+
+// isCoreMediaType reports whether a media type is registered as a
+// core media type.
+func isCoreMediaType(mediaType string) bool {
+	mediaTypesMu.RLock()
+	defer mediaTypesMu.RUnlock()
+	for _, m := range mediaTypes {
+		if m.core && m.mediaType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// AddResource adds a file of any type registered with
+// RegisterMediaType to the ePub book, such as an Adobe page template
+// or a pronunciation lexicon. Path is the relative path in the book to
+// the file, and contents is the file itself. The file's media type is
+// looked up from its extension. It's listed in the manifest but not
+// the spine. XHTML files, images, stylesheets, scripts, and fonts have
+// their own Add methods, and can't be added this way.
+//
+// Returns the ID of the added file, or an error if something went wrong.
+func (e *EPub) AddResource(path string, contents []byte) (Id, error) {
+	mt, _, ok := LookupMediaType(path)
+	if !ok {
+		return "", errorf(ErrUnsupportedFormat, "no media type registered for %q", path)
+	}
+	switch {
+	case mt == "application/xhtml+xml", strings.HasPrefix(mt, "image/"), mt == "text/css", mt == "application/javascript", mt == "application/opentype":
+		return "", fmt.Errorf("%q is a %v file; use its own Add method", path, mt)
+	}
+	m := media{name: path, contents: contents, mediaType: mt, id: e.nextId("res")}
+	e.media = append(e.media, m)
+	return m.id, nil
+}
+
+// AddResourceFile adds the named file to the ePub book, as with
+// AddResource. source is the name of the file to be added while dest
+// is the name the file should have in the ePub book.
+//
+// Returns the ID of the added file, or an error if something went
+// wrong reading the file.
+func (e *EPub) AddResourceFile(source, dest string) (Id, error) {
+	return e.addFile(source, func(c []byte) (Id, error) {
+		return e.AddResource(dest, c)
+	})
+}
+
+// foreignWarnings returns warnings for files of types that aren't core
+// media types and have no fallback. Video and text tracks are left
+// out, since ePub lets the video element use them without one, and so
+// are annotations, which are only linked from the package document.
+func (e *EPub) foreignWarnings() []string {
+	var warnings []string
+	for _, m := range e.media {
+		if m.fallback != "" || isCoreMediaType(m.mediaType) || strings.HasPrefix(m.mediaType, "video/") || m.mediaType == "text/vtt" || m.mediaType == annotationMediaType {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("%v is a %v file, which isn't a core media type, and has no fallback", m.name, m.mediaType))
+	}
+	return warnings
+}
@@ -1,9 +1,13 @@
 package epub
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -15,6 +19,26 @@ func (e *EPub) AddLanguage(l string) error {
 	return nil
 }
 
+// SetPropagateLanguage controls whether the book's language is added
+// to XHTML files that don't declare one when the book is
+// written. Accessibility checkers flag files without a language on
+// their html element, but it's tedious to add to every file by
+// hand. The first language added with AddLanguage is used.
+func (e *EPub) SetPropagateLanguage(propagate bool) {
+	e.propagateLanguage = propagate
+}
+
+// language returns the book's primary language, or the empty string
+// if it has none.
+func (e *EPub) language() string {
+	for _, m := range e.metadata {
+		if m.kind == "dc:language" {
+			return m.value
+		}
+	}
+	return ""
+}
+
 // SetTitle sets the title of the book.
 func (e *EPub) SetTitle(title string) {
 	e.title = title
@@ -24,29 +48,48 @@ func (e *EPub) SetTitle(title string) {
 // AddAuthor adds an author's name to the list of authors for the book.
 func (e *EPub) AddAuthor(author string) {
 	e.authors = append(e.authors, author)
-	e.AddCreator(author, "aut")
+	e.noteError(e.AddCreator(author, "aut"))
 }
 
 func (e *EPub) AddArtist(artist string) {
 	e.artists = append(e.artists, artist)
-	e.AddCreator(artist, "art")
+	e.noteError(e.AddCreator(artist, "art"))
+}
+
+// AddIllustrator adds an illustrator's name to the book's creators.
+func (e *EPub) AddIllustrator(illustrator string) {
+	e.noteError(e.AddCreator(illustrator, "ill"))
+}
+
+// AddTranslator adds a translator's name to the book's contributors.
+func (e *EPub) AddTranslator(translator string) {
+	e.noteError(e.AddContributor(translator, "trl"))
+}
+
+// AddEditor adds an editor's name to the book's contributors.
+func (e *EPub) AddEditor(editor string) {
+	e.noteError(e.AddContributor(editor, "edt"))
+}
+
+// AddNarrator adds a narrator's name to the book's contributors. For
+// v3 books the narrator is also written as the media:narrator of the
+// book's media overlays, which reading systems show for read-aloud
+// audio.
+func (e *EPub) AddNarrator(narrator string) {
+	e.narrators = append(e.narrators, narrator)
+	e.noteError(e.AddContributor(narrator, "nrt"))
 }
 
 // AddCreator adds a creator entry to the epub file. The creator type
 // must come from the list of valid creators at
 // http://www.loc.gov/marc/relators/relaterm.html and will return an
-// error if an invalid entry is passed.
+// error if an invalid entry is passed. ValidRoles lists the codes, and
+// the error suggests any that look like what was meant.
 func (e *EPub) AddCreator(creator string, role string) error {
-	if !validRoles[role] {
-		return fmt.Errorf("invalid role %v", role)
+	if err := checkRole(role); err != nil {
+		return err
 	}
-	m := metadata{
-		kind:  "dc:creator",
-		value: creator,
-		pairs: []pair{{v2prefix: "opf:", key: "role", value: role, scheme: "marc:relators"}},
-	}
-	e.metadata = append(e.metadata, m)
-	return nil
+	return e.addPerson("dc:creator", Person{Name: creator, Role: role})
 }
 
 // AddContributor adds a creator entry to the epub file. The contributor type
@@ -54,75 +97,147 @@ func (e *EPub) AddCreator(creator string, role string) error {
 // http://www.loc.gov/marc/relators/relaterm.html and will return an
 // error if an invalid entry is passed.
 func (e *EPub) AddContributor(creator string, role string) error {
-	if !validRoles[role] {
-		return fmt.Errorf("invalid role %v", role)
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	return e.addPerson("dc:contributor", Person{Name: creator, Role: role})
+}
+
+// Person describes a creator or contributor of the book, along with
+// the details that refine their entry.
+type Person struct {
+	Name string
+	// SortName is the name as it should be sorted, such as "Austen,
+	// Jane". Optional.
+	SortName string
+	// Role is the person's MARC relator code, such as "aut" or
+	// "ill". Optional.
+	Role string
+	// AlternateScripts holds the name written in other scripts, keyed
+	// by language code, such as {"ja": "村上 春樹"}. Only written for v3
+	// books.
+	AlternateScripts map[string]string
+	// DisplaySeq is the order the person is listed in among the book's
+	// creators or contributors, starting from 1. Zero means
+	// unspecified. Only written for v3 books.
+	DisplaySeq int
+}
+
+// AddCreatorPerson adds a creator entry for a person to the epub
+// file, with all of the person's details. It's an error if the
+// person has no name or an invalid role.
+func (e *EPub) AddCreatorPerson(p Person) error {
+	return e.addPerson("dc:creator", p)
+}
+
+// AddContributorPerson adds a contributor entry for a person to the
+// epub file, with all of the person's details. It's an error if the
+// person has no name or an invalid role.
+func (e *EPub) AddContributorPerson(p Person) error {
+	return e.addPerson("dc:contributor", p)
+}
+
+// addPerson adds a creator or contributor entry of the given kind.
+func (e *EPub) addPerson(kind string, p Person) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("person must have a name")
 	}
-	m := metadata{
-		kind:  "dc:contributor",
-		value: creator,
-		pairs: []pair{{v2prefix: "opf:", key: "role", value: role, scheme: "marc:relators"}},
+	if p.Role != "" {
+		if err := checkRole(p.Role); err != nil {
+			return err
+		}
 	}
-	e.metadata = append(e.metadata, m)
+	if p.DisplaySeq < 0 {
+		return fmt.Errorf("invalid display sequence %v", p.DisplaySeq)
+	}
+	me := NewMetadataEntry(kind, p.Name)
+	if p.Role != "" {
+		me.RefineScheme("role", p.Role, "marc:relators")
+	}
+	if p.SortName != "" {
+		me.Refine("file-as", p.SortName)
+	}
+	langs := make([]string, 0, len(p.AlternateScripts))
+	for l := range p.AlternateScripts {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	for _, l := range langs {
+		me.RefineV3("alternate-script", p.AlternateScripts[l], l)
+	}
+	if p.DisplaySeq > 0 {
+		me.RefineV3("display-seq", strconv.Itoa(p.DisplaySeq), "")
+	}
+	e.metadata = append(e.metadata, me.m)
 	return nil
 }
 
-// List of valid roles, from
-// http://www.loc.gov/marc/relators/relaterm.html
-var validRoles = map[string]bool{
-	"abr": true, "act": true, "adp": true, "rcp": true,
-	"anl": true, "anm": true, "ann": true, "apl": true, "ape": true,
-	"app": true, "arc": true, "arr": true, "acp": true, "adi": true,
-	"art": true, "ard": true, "asg": true, "asn": true, "att": true,
-	"auc": true, "aut": true, "aqt": true, "aft": true, "aud": true,
-	"aui": true, "ato": true, "ant": true, "bnd": true, "bdd": true,
-	"blw": true, "bkd": true, "bkp": true, "bjd": true, "bpd": true,
-	"bsl": true, "brl": true, "brd": true, "cll": true, "ctg": true,
-	"cas": true, "cns": true, "chr": true, "cng": true, "cli": true,
-	"cor": true, "col": true, "clt": true, "clr": true, "cmm": true,
-	"cwt": true, "com": true, "cpl": true, "cpt": true, "cpe": true,
-	"cmp": true, "cmt": true, "ccp": true, "cnd": true, "con": true,
-	"csl": true, "csp": true, "cos": true, "cot": true, "coe": true,
-	"cts": true, "ctt": true, "cte": true, "ctr": true, "ctb": true,
-	"cpc": true, "cph": true, "crr": true, "crp": true, "cst": true,
-	"cou": true, "crt": true, "cov": true, "cre": true, "cur": true,
-	"dnc": true, "dtc": true, "dtm": true, "dte": true, "dto": true,
-	"dfd": true, "dft": true, "dfe": true, "dgg": true, "dgs": true,
-	"dln": true, "dpc": true, "dpt": true, "dsr": true, "drt": true,
-	"dis": true, "dbp": true, "dst": true, "dnr": true, "drm": true,
-	"dub": true, "edt": true, "edc": true, "edm": true, "elg": true,
-	"elt": true, "enj": true, "eng": true, "egr": true, "etr": true,
-	"evp": true, "exp": true, "fac": true, "fld": true, "fmd": true,
-	"fds": true, "flm": true, "fmp": true, "fmk": true, "fpy": true,
-	"frg": true, "fmo": true, "fnd": true, "gis": true, "hnr": true,
-	"hst": true, "his": true, "ilu": true, "ill": true, "ins": true,
-	"itr": true, "ive": true, "ivr": true, "inv": true, "isb": true,
-	"jud": true, "jug": true, "lbr": true, "ldr": true, "lsa": true,
-	"led": true, "len": true, "lil": true, "lit": true, "lie": true,
-	"lel": true, "let": true, "lee": true, "lbt": true, "lse": true,
-	"lso": true, "lgd": true, "ltg": true, "lyr": true, "mfp": true,
-	"mfr": true, "mrb": true, "mrk": true, "med": true, "mdc": true,
-	"mte": true, "mtk": true, "mod": true, "mon": true, "mcp": true,
-	"msd": true, "mus": true, "nrt": true, "osp": true, "opn": true,
-	"orm": true, "org": true, "oth": true, "own": true, "pan": true,
-	"ppm": true, "pta": true, "pth": true, "pat": true, "prf": true,
-	"pma": true, "pht": true, "ptf": true, "ptt": true, "pte": true,
-	"plt": true, "pra": true, "pre": true, "prt": true, "pop": true,
-	"prm": true, "prc": true, "pro": true, "prn": true, "prs": true,
-	"pmn": true, "prd": true, "prp": true, "prg": true, "pdr": true,
-	"pfr": true, "prv": true, "pup": true, "pbl": true, "pbd": true,
-	"ppt": true, "rdd": true, "rpc": true, "rce": true, "rcd": true,
-	"red": true, "ren": true, "rpt": true, "rps": true, "rth": true,
-	"rtm": true, "res": true, "rsp": true, "rst": true, "rse": true,
-	"rpy": true, "rsg": true, "rsr": true, "rev": true, "rbr": true,
-	"sce": true, "sad": true, "aus": true, "scr": true, "scl": true,
-	"spy": true, "sec": true, "sll": true, "std": true, "stg": true,
-	"sgn": true, "sng": true, "sds": true, "spk": true, "spn": true,
-	"sgd": true, "stm": true, "stn": true, "str": true, "stl": true,
-	"sht": true, "srv": true, "tch": true, "tcd": true, "tld": true,
-	"tlp": true, "ths": true, "trc": true, "trl": true, "tyd": true,
-	"tyg": true, "uvp": true, "vdg": true, "vac": true, "wit": true,
-	"wde": true, "wdc": true, "wam": true, "wac": true, "wal": true,
-	"wat": true, "win": true, "wpr": true, "wst": true}
+// AddIdentifier adds an extra identifier for the book, such as an
+// ISBN. Scheme names the identifier's scheme ("ISBN", "DOI", and so
+// on) and may be empty. The identifier can then be made the book's
+// primary identifier with SetPrimaryIdentifier.
+//
+// The scheme is only written out for v2 books; v3 books should use
+// URN-style values such as "urn:isbn:9780000000000" instead.
+func (e *EPub) AddIdentifier(value, scheme string) error {
+	if value == "" {
+		return errors.New("identifier must not be empty")
+	}
+	for _, m := range e.metadata {
+		if m.kind == "dc:identifier" && m.value == value {
+			return errorf(ErrDuplicateID, "identifier %q already added", value)
+		}
+	}
+	me := NewMetadataEntry("dc:identifier", value)
+	if scheme != "" {
+		me.Refine("scheme", scheme)
+	}
+	e.metadata = append(e.metadata, me.m)
+	return nil
+}
+
+// SetPrimaryIdentifier makes the identifier with the given value the
+// book's unique identifier. The value must be the book's UUID (in
+// "urn:uuid:" form) or an identifier added with AddIdentifier. The
+// package unique-identifier, the NCX dtb:uid, and (for v3 books) the
+// dc:identifier with id "BookId" all refer to the primary identifier.
+func (e *EPub) SetPrimaryIdentifier(value string) error {
+	found := -1
+	for i, m := range e.metadata {
+		if m.kind == "dc:identifier" && m.value == value {
+			found = i
+		}
+	}
+	if found < 0 {
+		return errorf(ErrNotFound, "no identifier %q; add it with AddIdentifier first", value)
+	}
+	for i, m := range e.metadata {
+		if !isBookID(m) {
+			continue
+		}
+		var pairs []pair
+		for _, p := range m.pairs {
+			if p.key != "id" {
+				pairs = append(pairs, p)
+			}
+		}
+		e.metadata[i].pairs = pairs
+	}
+	e.metadata[found].pairs = append([]pair{{key: "id", value: "BookId"}}, e.metadata[found].pairs...)
+	return nil
+}
+
+// PrimaryIdentifier returns the book's unique identifier. Unless
+// changed with SetPrimaryIdentifier, this is the book's UUID in
+// "urn:uuid:" form.
+func (e *EPub) PrimaryIdentifier() string {
+	for _, m := range e.metadata {
+		if isBookID(m) {
+			return m.value
+		}
+	}
+	return e.uuid
+}
 
 // AddPublisher adds a publisher entry for the book.
 func (e *EPub) AddPublisher(pub string) {
@@ -180,3 +295,97 @@ func (e *EPub) SetEntryNumber(n string) error {
 	e.entry = n
 	return nil
 }
+
+// SetNormalizeText controls whether the book's metadata strings and
+// table of contents labels are normalized when the book is written.
+// Normalizing strips HTML tags, decodes HTML entities such as
+// &eacute; or &#8217; to UTF-8 (many reading systems don't decode
+// them, and XML doesn't define most of them), collapses runs of
+// whitespace, and escapes the result properly for XML. It's useful
+// when titles and labels come from HTML sources.
+//
+// By default strings are written out exactly as given.
+func (e *EPub) SetNormalizeText(normalize bool) {
+	e.normalizeText = normalize
+}
+
+var (
+	tagRE   = regexp.MustCompile(`<[^>]*>`)
+	spaceRE = regexp.MustCompile(`[ \t\r\n]+`)
+)
+
+// text returns s as it should be written into the book's XML files.
+func (e *EPub) text(s string) string {
+	if !e.normalizeText {
+		return s
+	}
+	// Entities are decoded after whitespace is collapsed so that
+	// non-breaking spaces survive.
+	s = strings.TrimSpace(spaceRE.ReplaceAllString(tagRE.ReplaceAllString(s, ""), " "))
+	return html.EscapeString(html.UnescapeString(s))
+}
+
+// AddRawMetadata adds an opaque chunk of XML to the metadata section
+// of the book's OPF file. The XML is written out as given, apart from
+// its indentation, after all the metadata this package generates
+// itself, for both v2 and v3 books.
+//
+// This is intended for vendor-specific metadata (calibre's series
+// tags, for example) that this package doesn't otherwise know
+// about. No checking is done on the XML, so it's possible to create
+// an invalid book this way.
+func (e *EPub) AddRawMetadata(raw string) {
+	e.rawMetadata = append(e.rawMetadata, raw)
+}
+
+// AddPackageAttribute adds an extra attribute to the OPF file's
+// package element, such as a prefix or xml:lang declaration. The
+// value is escaped when written. Attributes this package writes
+// itself (version, unique-identifier, and xmlns) can't be overridden
+// this way.
+func (e *EPub) AddPackageAttribute(name, value string) error {
+	switch name {
+	case "version", "unique-identifier", "xmlns":
+		return errorf(ErrReserved, "package attribute %v is reserved", name)
+	}
+	e.rawPackageAttrs = append(e.rawPackageAttrs, pair{key: name, value: value})
+	return nil
+}
+
+// packageMetadata returns the book's metadata as it's written into
+// the package document, with subject paths expanded, style policies
+// applied, any derived sort keys added, and in the book's metadata
+// order.
+func (e *EPub) packageMetadata() []metadata {
+	md := e.styleMetadata(e.canonicalSubjects(e.expandSubjects(e.metadata)))
+	if e.autoSortKeys {
+		md = e.addSortKeys(md)
+	}
+	return e.orderMetadata(md)
+}
+
+// rawMetadataXML returns the opaque metadata the book is carrying, as
+// XML.
+func (e *EPub) rawMetadataXML() string {
+	var b strings.Builder
+	for _, r := range e.rawMetadata {
+		b.WriteString(strings.TrimSpace(r))
+	}
+	return b.String()
+}
+
+// packageAttrs returns the extra package attributes.
+func (e *EPub) packageAttrs() []xml.Attr {
+	var ret []xml.Attr
+	for _, p := range e.rawPackageAttrs {
+		ret = append(ret, xmlAttr(p.key, p.value))
+	}
+	return ret
+}
+
+// plainText returns s as plain text for the XML encoder to escape,
+// normalized if the book normalizes text. Entities in s are decoded,
+// so text that's already escaped isn't escaped twice.
+func (e *EPub) plainText(s string) string {
+	return html.UnescapeString(e.text(s))
+}
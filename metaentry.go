@@ -0,0 +1,149 @@
+package epub
+
+// This file holds metadata entries and their refinements, which are
+// written as attributes in v2 books and as refining meta elements in
+// v3 books.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metadataNameRE matches the names of metadata elements and
+// properties: XML names with an optional prefix, such as "dc:subject"
+// or "file-as".
+var metadataNameRE = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_.-]*:)?[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// v2Element returns m as it's written in a v2 book, with the given
+// text: an element whose attributes are m's refinements, named with
+// their v2 prefixes. Refinements only v3 books can express are left
+// out.
+func (m metadata) v2Element(text string) xmlElement {
+	x := newElement(m.kind, text)
+	for _, p := range m.pairs {
+		if p.v3only {
+			continue
+		}
+		x.Attrs = append(x.Attrs, xmlAttr(p.v2prefix+p.key, p.value))
+	}
+	x.Attrs = append(x.Attrs, m.attrs...)
+	return x
+}
+
+// v3Elements returns m as it's written in a v3 book, with the given
+// text and id: the element, followed by a meta element refining it
+// for each of its refinements, named with their v3 prefixes.
+func (m metadata) v3Elements(id, text string) []xmlElement {
+	ret := []xmlElement{newElement(m.kind, text, "id", id)}
+	ret[0].Attrs = append(ret[0].Attrs, m.attrs...)
+	for _, p := range m.pairs {
+		x := newElement("meta", p.value, "refines", "#"+id, "property", p.v3prefix+p.key)
+		if p.scheme != "" {
+			x.Attrs = append(x.Attrs, xmlAttr("scheme", p.scheme))
+		}
+		if p.lang != "" {
+			x.Attrs = append(x.Attrs, xmlAttr("xml:lang", p.lang))
+		}
+		ret = append(ret, x)
+	}
+	return ret
+}
+
+// MetadataEntry is a package metadata element, such as a dc:creator,
+// along with the properties that refine it, for AddMetadataEntry. It
+// knows how to write itself for either version: in v2 books the
+// refinements are opf: attributes of the element, and in v3 books
+// they're meta elements that refine it. Build one with
+// NewMetadataEntry and its Refine methods:
+//
+//	m := NewMetadataEntry("dc:publisher", "Acme Books").
+//		Refine("file-as", "Acme").
+//		RefineV3("alternate-script", "アクメ", "ja")
+type MetadataEntry struct {
+	m metadata
+}
+
+// NewMetadataEntry returns an entry for the metadata element with the
+// given name, including its prefix, such as "dc:rights", and value.
+func NewMetadataEntry(element, value string) *MetadataEntry {
+	return &MetadataEntry{m: metadata{kind: element, value: value}}
+}
+
+// Refine adds a property refining the entry, written as the opf:
+// attribute of that name in v2 books and as a meta element with that
+// property in v3 books. It returns the entry.
+func (me *MetadataEntry) Refine(property, value string) *MetadataEntry {
+	return me.RefineScheme(property, value, "")
+}
+
+// RefineScheme is like Refine, but gives the scheme the property's
+// value is drawn from, such as "marc:relators" for roles. Only v3
+// books can record the scheme.
+func (me *MetadataEntry) RefineScheme(property, value, scheme string) *MetadataEntry {
+	me.m.pairs = append(me.m.pairs, pair{v2prefix: "opf:", key: property, value: value, scheme: scheme})
+	return me
+}
+
+// RefineV3 adds a property refining the entry that only v3 books can
+// express, such as "alternate-script" or "display-seq", so it's left
+// out of v2 books. Lang is the language of the value, if it isn't the
+// book's language. It returns the entry.
+func (me *MetadataEntry) RefineV3(property, value, lang string) *MetadataEntry {
+	me.m.pairs = append(me.m.pairs, pair{key: property, value: value, lang: lang, v3only: true})
+	return me
+}
+
+// XML returns the entry as it's written into the package document of
+// a book of the given version. Id is the ID the element gets in v3
+// books, which its refinements refer to; the book assigns its own when
+// it's written. The XML isn't indented.
+func (me *MetadataEntry) XML(version float64, id string) (string, error) {
+	var elems []xmlElement
+	if version >= 3 {
+		elems = me.m.v3Elements(id, me.m.value)
+	} else {
+		elems = []xmlElement{me.m.v2Element(me.m.value)}
+	}
+	var b strings.Builder
+	for i, x := range elems {
+		c, err := xml.Marshal(x)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.Write(c)
+	}
+	return b.String(), nil
+}
+
+// AddMetadataEntry adds a metadata entry built with NewMetadataEntry
+// to the book. Changes made to the entry afterwards don't affect the
+// book. Identifiers are added with AddIdentifier and meta elements
+// with AddRawMetadata instead, since they're written differently.
+//
+// Returns an error if the element or a property has an invalid name,
+// or the entry has no value.
+func (e *EPub) AddMetadataEntry(me *MetadataEntry) error {
+	m := me.m
+	switch {
+	case m.kind == "dc:identifier", m.kind == "meta":
+		return errorf(ErrReserved, "%v entries can't be added with AddMetadataEntry", m.kind)
+	case !metadataNameRE.MatchString(m.kind):
+		return fmt.Errorf("%q is not a valid metadata element name", m.kind)
+	case strings.TrimSpace(m.value) == "":
+		return errors.New("metadata entry must have a value")
+	}
+	for _, p := range m.pairs {
+		if !metadataNameRE.MatchString(p.key) {
+			return fmt.Errorf("%q is not a valid metadata property name", p.key)
+		}
+	}
+	m.pairs = append([]pair(nil), m.pairs...)
+	e.metadata = append(e.metadata, m)
+	return nil
+}
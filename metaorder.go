@@ -0,0 +1,77 @@
+package epub
+
+// This file holds the code that orders the package metadata.
+
+import (
+	"sort"
+	"strings"
+)
+
+// MetadataOrder says what order the package metadata is written in.
+type MetadataOrder int
+
+const (
+	// MetadataStandard writes the metadata in a fixed order: the
+	// identifiers, titles, and languages reading systems require,
+	// then the other Dublin Core elements, then meta elements. Items
+	// of the same kind stay in the order they were added, so the
+	// output doesn't depend on the order different kinds of metadata
+	// were set. It's the default.
+	MetadataStandard MetadataOrder = iota
+	// MetadataInsertion writes the metadata in the order it was added.
+	MetadataInsertion
+)
+
+// metadataRank is the position of each Dublin Core element in the
+// standard metadata order.
+var metadataRank = map[string]int{
+	"dc:identifier":  0,
+	"dc:title":       1,
+	"dc:language":    2,
+	"dc:creator":     3,
+	"dc:contributor": 4,
+	"dc:publisher":   5,
+	"dc:date":        6,
+	"dc:description": 7,
+	"dc:subject":     8,
+	"dc:type":        9,
+	"dc:format":      10,
+	"dc:source":      11,
+	"dc:relation":    12,
+	"dc:coverage":    13,
+	"dc:rights":      14,
+}
+
+// SetMetadataOrder sets the order the package metadata is written
+// in. The standard order keeps diffs between builds small, since
+// moving a call such as SetTitle doesn't move the output, and
+// satisfies ingestion systems that expect the identifier, title, and
+// language first.
+func (e *EPub) SetMetadataOrder(o MetadataOrder) {
+	e.metadataOrder = o
+}
+
+// orderMetadata returns md in the book's metadata order.
+func (e *EPub) orderMetadata(md []metadata) []metadata {
+	if e.metadataOrder == MetadataInsertion {
+		return md
+	}
+	ret := append([]metadata(nil), md...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return metadataPosition(ret[i].kind) < metadataPosition(ret[j].kind)
+	})
+	return ret
+}
+
+// metadataPosition returns the rank of a kind of metadata in the
+// standard order. Dublin Core elements this package doesn't know go
+// after the ones it does, and meta elements go last.
+func metadataPosition(kind string) int {
+	if r, ok := metadataRank[kind]; ok {
+		return r
+	}
+	if strings.HasPrefix(kind, "dc:") {
+		return len(metadataRank)
+	}
+	return len(metadataRank) + 1
+}
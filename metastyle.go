@@ -0,0 +1,168 @@
+package epub
+
+// This file holds the style policies that tidy the package metadata
+// as it's written.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Casing is how a metadata style policy changes the case of values.
+type Casing int
+
+const (
+	// CaseAsIs leaves values' case alone.
+	CaseAsIs Casing = iota
+	// CaseTitle capitalizes each word, apart from articles, short
+	// conjunctions, and short prepositions that aren't the first or
+	// last word, as in "The Lord of the Rings".
+	CaseTitle
+	// CaseSentence capitalizes the first word and lowercases the
+	// others, as in "The lord of the rings".
+	CaseSentence
+)
+
+// MetadataStyle is a style policy for one kind of package metadata,
+// set with SetMetadataStyle.
+type MetadataStyle struct {
+	Case Casing
+	// TrimPeriod removes a single trailing period, as catalog records
+	// often have. Ellipses are left alone, but a trailing abbreviation
+	// such as "Inc." loses its period too.
+	TrimPeriod bool
+	// CollapseSpace trims leading and trailing whitespace and collapses
+	// runs of whitespace inside values to single spaces.
+	CollapseSpace bool
+}
+
+// SetMetadataStyle sets the style policy for the package metadata
+// element named kind, such as "dc:title" or "dc:subject", or removes
+// it if s is nil. The policy is applied to every element of that kind
+// as the book is written, so metadata set by many hands, or imported
+// from many catalogs, comes out consistent. The values the book
+// holds, and those used elsewhere in it, such as on a title page,
+// aren't changed.
+//
+// Casing follows English conventions. Words that are already
+// capitalized inside or written all in capitals, such as "iPhone" or
+// "NASA", keep their case, but there's no telling proper nouns from
+// ordinary words, so sentence case lowercases "Paris" along with
+// "Rings"; it's best kept for fields such as subjects.
+func (e *EPub) SetMetadataStyle(kind string, s *MetadataStyle) error {
+	if _, ok := metadataRank[kind]; !ok {
+		return fmt.Errorf("%v isn't a Dublin Core element this package writes", kind)
+	}
+	if s != nil && (s.Case < CaseAsIs || s.Case > CaseSentence) {
+		return fmt.Errorf("unknown casing %v", s.Case)
+	}
+	if s == nil {
+		delete(e.metadataStyles, kind)
+		return nil
+	}
+	if e.metadataStyles == nil {
+		e.metadataStyles = make(map[string]MetadataStyle)
+	}
+	e.metadataStyles[kind] = *s
+	return nil
+}
+
+// styleMetadata returns md with the book's metadata style policies
+// applied.
+func (e *EPub) styleMetadata(md []metadata) []metadata {
+	if len(e.metadataStyles) == 0 {
+		return md
+	}
+	ret := make([]metadata, len(md))
+	for i, m := range md {
+		if s, ok := e.metadataStyles[m.kind]; ok {
+			m.value = s.apply(m.value)
+		}
+		ret[i] = m
+	}
+	return ret
+}
+
+// apply returns value styled by the policy.
+func (s MetadataStyle) apply(value string) string {
+	if s.CollapseSpace {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	if s.TrimPeriod {
+		if t := strings.TrimRightFunc(value, unicode.IsSpace); strings.HasSuffix(t, ".") && !strings.HasSuffix(t, "..") {
+			value = t[:len(t)-1]
+		}
+	}
+	switch s.Case {
+	case CaseTitle, CaseSentence:
+		value = recase(value, s.Case)
+	}
+	return value
+}
+
+// recase returns s in title or sentence case. Words are separated by
+// spaces; the first word, and the first word after a colon, are
+// always capitalized.
+func recase(s string, c Casing) string {
+	words := strings.Split(s, " ")
+	last := len(words) - 1
+	for last > 0 && words[last] == "" {
+		last--
+	}
+	start := true
+	for i, w := range words {
+		if w == "" {
+			continue
+		}
+		switch {
+		case start:
+			w = upperFirst(w)
+		case c == CaseTitle && (i == last || !minorWords[strings.ToLower(strings.TrimFunc(w, notLetter))]):
+			w = upperFirst(w)
+		case isCapitalized(w) && !isPronounI(w):
+			w = strings.ToLower(w)
+		}
+		words[i] = w
+		start = strings.HasSuffix(w, ":")
+	}
+	return strings.Join(words, " ")
+}
+
+// notLetter reports whether r isn't a letter.
+func notLetter(r rune) bool {
+	return !unicode.IsLetter(r)
+}
+
+// upperFirst returns w with its first letter in upper case.
+func upperFirst(w string) string {
+	i := strings.IndexFunc(w, unicode.IsLetter)
+	if i < 0 {
+		return w
+	}
+	r, n := utf8.DecodeRuneInString(w[i:])
+	return w[:i] + string(unicode.ToUpper(r)) + w[i+n:]
+}
+
+// isPronounI reports whether w is the pronoun "I", or a contraction
+// of it such as "I'm", which stays capitalized.
+func isPronounI(w string) bool {
+	return w == "I" || strings.HasPrefix(w, "I'") || strings.HasPrefix(w, "I’")
+}
+
+// isCapitalized reports whether w is written with its first letter in
+// upper case and the rest in lower case, and so is safe to lowercase.
+func isCapitalized(w string) bool {
+	first := true
+	for _, r := range w {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if first != unicode.IsUpper(r) {
+			return false
+		}
+		first = false
+	}
+	return !first
+}
@@ -0,0 +1,206 @@
+package epub
+
+// This file holds the typed models of the package document, NCX, and
+// nav document, which the writers fill in and marshal with
+// encoding/xml.
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// The namespaces of the package document.
+const (
+	opfNamespace = "http://www.idpf.org/2007/opf"
+	dcNamespace  = "http://purl.org/dc/elements/1.1/"
+)
+
+// xmlElement is a generic XML element with text content, such as a
+// piece of package metadata. Its name includes any namespace prefix,
+// such as "dc:title".
+type xmlElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+}
+
+// newElement returns an element with the given name, text, and
+// attributes, given as name/value pairs.
+func newElement(name, text string, attrs ...string) xmlElement {
+	x := xmlElement{XMLName: xml.Name{Local: name}, Text: text}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		x.Attrs = append(x.Attrs, xmlAttr(attrs[i], attrs[i+1]))
+	}
+	return x
+}
+
+// xmlAttr returns an attribute. Its name includes any namespace
+// prefix, such as "opf:role".
+func xmlAttr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: name}, Value: value}
+}
+
+// opfPackage is the package document.
+type opfPackage struct {
+	XMLName  xml.Name    `xml:"package"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Version  string      `xml:"version,attr"`
+	UniqueID string      `xml:"unique-identifier,attr"`
+	Attrs    []xml.Attr  `xml:",any,attr"`
+	Metadata opfMetadata `xml:"metadata"`
+	Manifest opfManifest `xml:"manifest"`
+	Spine    opfSpine    `xml:"spine"`
+	Guide    *opfGuide   `xml:"guide"`
+}
+
+// opfMetadata is the package document's metadata section. Raw holds
+// the opaque metadata added with AddRawMetadata, which is written
+// after the elements as is.
+type opfMetadata struct {
+	XmlnsDC  string `xml:"xmlns:dc,attr"`
+	XmlnsOPF string `xml:"xmlns:opf,attr,omitempty"`
+	Elements []xmlElement
+	Raw      string `xml:",innerxml"`
+}
+
+type opfManifest struct {
+	Items []opfItem `xml:"item"`
+}
+
+type opfItem struct {
+	ID         Id     `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr,omitempty"`
+	Fallback   Id     `xml:"fallback,attr,omitempty"`
+}
+
+type opfSpine struct {
+	TOC      Id           `xml:"toc,attr,omitempty"`
+	Itemrefs []opfItemref `xml:"itemref"`
+}
+
+type opfItemref struct {
+	ID         string `xml:"id,attr,omitempty"`
+	IDRef      Id     `xml:"idref,attr"`
+	Linear     string `xml:"linear,attr,omitempty"`
+	Properties string `xml:"properties,attr,omitempty"`
+}
+
+type opfGuide struct {
+	References []opfReference `xml:"reference"`
+}
+
+type opfReference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+// ncxDocument is the NCX table of contents.
+type ncxDocument struct {
+	XMLName    xml.Name     `xml:"ncx"`
+	Version    string       `xml:"version,attr"`
+	Xmlns      string       `xml:"xmlns,attr"`
+	XmlnsMbp   string       `xml:"xmlns:mbp,attr,omitempty"`
+	Meta       []xmlElement `xml:"head>meta"`
+	DocTitle   string       `xml:"docTitle>text"`
+	DocAuthors []string     `xml:"docAuthor>text"`
+	NavMap     ncxNavMap    `xml:"navMap"`
+	PageList   *ncxPageList `xml:"pageList"`
+	NavLists   []ncxNavList `xml:"navList"`
+}
+
+type ncxNavMap struct {
+	NavPoints []ncxNavPoint `xml:"navPoint"`
+}
+
+type ncxNavPoint struct {
+	ID        string        `xml:"id,attr"`
+	Class     string        `xml:"class,attr,omitempty"`
+	PlayOrder int           `xml:"playOrder,attr"`
+	Label     string        `xml:"navLabel>text"`
+	Content   ncxContent    `xml:"content"`
+	Meta      []xmlElement  `xml:"mbp:meta"`
+	NavPoints []ncxNavPoint `xml:"navPoint"`
+}
+
+type ncxContent struct {
+	Src string `xml:"src,attr"`
+}
+
+type ncxPageList struct {
+	Label   string          `xml:"navLabel>text"`
+	Targets []ncxPageTarget `xml:"pageTarget"`
+}
+
+type ncxPageTarget struct {
+	ID        string     `xml:"id,attr"`
+	Type      string     `xml:"type,attr"`
+	Value     int        `xml:"value,attr"`
+	PlayOrder int        `xml:"playOrder,attr"`
+	Label     string     `xml:"navLabel>text"`
+	Content   ncxContent `xml:"content"`
+}
+
+type ncxNavList struct {
+	Class   string         `xml:"class,attr,omitempty"`
+	Label   string         `xml:"navLabel>text"`
+	Targets []ncxNavTarget `xml:"navTarget"`
+}
+
+type ncxNavTarget struct {
+	ID        string     `xml:"id,attr"`
+	PlayOrder int        `xml:"playOrder,attr"`
+	Label     string     `xml:"navLabel>text"`
+	Content   ncxContent `xml:"content"`
+}
+
+// navDocument is the v3 nav document.
+type navDocument struct {
+	XMLName   xml.Name `xml:"html"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	XmlnsEpub string   `xml:"xmlns:epub,attr"`
+	Title     string   `xml:"head>title"`
+	Navs      []navNav `xml:"body>nav"`
+}
+
+type navNav struct {
+	Type    string  `xml:"epub:type,attr"`
+	ID      string  `xml:"id,attr,omitempty"`
+	Hidden  string  `xml:"hidden,attr,omitempty"`
+	Heading string  `xml:"h1,omitempty"`
+	List    navList `xml:"ol"`
+}
+
+type navList struct {
+	Items []navItem `xml:"li"`
+}
+
+type navItem struct {
+	Link navLink  `xml:"a"`
+	List *navList `xml:"ol"`
+}
+
+type navLink struct {
+	Type  string `xml:"epub:type,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Title string `xml:"title,attr,omitempty"`
+	Text  string `xml:",chardata"`
+}
+
+// encodeXML marshals v and writes it after header, which holds the
+// XML declaration and any DOCTYPE, formatted with the book's XML
+// indent.
+func (e *EPub) encodeXML(w io.Writer, header string, v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := formatXML(append([]byte(header), b...), e.indent())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(f)
+	return err
+}
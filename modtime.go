@@ -0,0 +1,97 @@
+package epub
+
+// This file holds the modification times of the book's resources,
+// which go on their zip entries and let incremental builds skip
+// writing books that haven't changed.
+
+import (
+	"os"
+	"time"
+)
+
+// SetModTime sets the modification time of the resource with the
+// given ID. It's written as the time of the resource's entry in the
+// zip archive, and used by WriteIfChanged. Resources added from files,
+// with AddImageFile and the like or AddReader, get their file's
+// modification time; others have none until it's set. Setting the
+// zero time removes a resource's modification time.
+func (e *EPub) SetModTime(id Id, t time.Time) error {
+	if !e.hasID(id) {
+		return errorf(ErrNotFound, "no resource with ID %v", id)
+	}
+	if t.IsZero() {
+		delete(e.modTimes, id)
+		return nil
+	}
+	if e.modTimes == nil {
+		e.modTimes = make(map[Id]time.Time)
+	}
+	e.modTimes[id] = t
+	return nil
+}
+
+// ModTime returns the modification time of the resource with the
+// given ID, and whether it has one.
+func (e *EPub) ModTime(id Id) (time.Time, bool) {
+	t, ok := e.modTimes[id]
+	return t, ok
+}
+
+// LastModified returns the latest modification time of the book's
+// resources, and whether every resource has one; if any doesn't, the
+// book's age can't be known.
+func (e *EPub) LastModified() (time.Time, bool) {
+	var last time.Time
+	all := true
+	for _, id := range e.manifestIDs() {
+		t, ok := e.modTimes[id]
+		if !ok {
+			all = false
+			continue
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last, all
+}
+
+// WriteIfChanged writes the book to the named file, as with Write,
+// unless the file already exists and is newer than every resource in
+// the book, and reports whether it wrote the book. It's meant for
+// build pipelines that rebuild books from source files, so unchanged
+// books are skipped.
+//
+// Only the resources' modification times are compared, so a book
+// that has a resource with no modification time is always written,
+// and changes to the book's metadata or table of contents alone
+// aren't noticed.
+func (e *EPub) WriteIfChanged(name string) (bool, error) {
+	if fi, err := os.Stat(name); err == nil {
+		if last, ok := e.LastModified(); ok && !last.After(fi.ModTime()) {
+			return false, nil
+		}
+	}
+	if err := e.Write(name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// addFile reads the file source, as readSource does, and adds its
+// contents to the book with add, giving the resource the file's
+// modification time.
+func (e *EPub) addFile(source string, add func(c []byte) (Id, error)) (Id, error) {
+	c, t, err := e.readSource(source)
+	if err != nil {
+		return "", err
+	}
+	id, err := add(c)
+	if err != nil {
+		return "", err
+	}
+	if !t.IsZero() {
+		e.SetModTime(id, t)
+	}
+	return id, nil
+}
@@ -0,0 +1,112 @@
+package epub
+
+// This file holds the code that adds previous and next links to the
+// book's XHTML files.
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// NavLinks configures the previous and next chapter links added by
+// SetNavLinks.
+type NavLinks struct {
+	// Header and Footer say where the links go: at the start of each
+	// file's body, at the end, or both. If neither is set they go at
+	// the end.
+	Header bool
+	Footer bool
+	// Previous and Next are the text of the links. They default to
+	// "Previous" and "Next".
+	Previous string
+	Next     string
+}
+
+// SetNavLinks adds links to the previous and next files in the spine
+// to each XHTML file when the book is written, for readers on
+// devices where the table of contents is awkward to get to. The links
+// follow the final spine order, so they stay right however the files
+// were added. They're written as a div with class "navlinks", holding
+// links with classes "prev" and "next", for stylesheets to style.
+//
+// Passing nil turns the links off again.
+func (e *EPub) SetNavLinks(n *NavLinks) {
+	if n == nil {
+		e.navLinks = nil
+		return
+	}
+	c := *n
+	if !c.Header && !c.Footer {
+		c.Footer = true
+	}
+	if c.Previous == "" {
+		c.Previous = "Previous"
+	}
+	if c.Next == "" {
+		c.Next = "Next"
+	}
+	e.navLinks = &c
+}
+
+var (
+	bodyStartRE = regexp.MustCompile(`(?i)<body\b[^>]*>`)
+	bodyCloseRE = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+// addNavLinks adds the previous and next links to the contents of x.
+func (e *EPub) addNavLinks(x xhtml, c []byte) []byte {
+	prev, next := e.spineNeighbours(x)
+	if prev == nil && next == nil {
+		return c
+	}
+	var b strings.Builder
+	b.WriteString(`<div class="navlinks">`)
+	if prev != nil {
+		fmt.Fprintf(&b, `<a class="prev" rel="prev" %s>%s</a>`, attrPair("href", relativeHref(x.name, prev.name)), html.EscapeString(e.navLinks.Previous))
+	}
+	if prev != nil && next != nil {
+		b.WriteString(" ")
+	}
+	if next != nil {
+		fmt.Fprintf(&b, `<a class="next" rel="next" %s>%s</a>`, attrPair("href", relativeHref(x.name, next.name)), html.EscapeString(e.navLinks.Next))
+	}
+	b.WriteString("</div>\n")
+	block := b.String()
+
+	start := bodyStartRE.FindIndex(c)
+	end := bodyCloseRE.FindIndex(c)
+	if start == nil || end == nil || end[0] < start[1] {
+		return c
+	}
+	ret := make([]byte, 0, len(c)+2*len(block)+2)
+	ret = append(ret, c[:start[1]]...)
+	if e.navLinks.Header {
+		ret = append(ret, '\n')
+		ret = append(ret, block...)
+	}
+	ret = append(ret, c[start[1]:end[0]]...)
+	if e.navLinks.Footer {
+		ret = append(ret, block...)
+	}
+	return append(ret, c[end[0]:]...)
+}
+
+// spineNeighbours returns the files before and after x in the spine,
+// or nil at either end.
+func (e *EPub) spineNeighbours(x xhtml) (prev, next *xhtml) {
+	before := func(a, b xhtml) bool {
+		return a.order < b.order || (a.order == b.order && a.baseOrder < b.baseOrder)
+	}
+	for i := range e.xhtml {
+		y := &e.xhtml[i]
+		if before(*y, x) && (prev == nil || before(*prev, *y)) {
+			prev = y
+		}
+		if before(x, *y) && (next == nil || before(*y, *next)) {
+			next = y
+		}
+	}
+	return prev, next
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package epub
+
+// raceEnabled reports whether the tests were built with the race
+// detector, which makes allocation counts meaningless.
+const raceEnabled = false
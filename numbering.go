@@ -0,0 +1,148 @@
+package epub
+
+// This file holds the code that numbers chapters.
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChapterNumbering configures the numbering of chapters added with
+// AddChapter and Part.AddChapter.
+type ChapterNumbering struct {
+	// Format makes a chapter's label from its number and title: "%d"
+	// is replaced with the number, "%s" with the title, and "%%" with
+	// a percent sign. For example, "Chapter %d — %s".
+	Format string
+	// If true each part's chapters are numbered from 1; otherwise
+	// chapters are numbered through the whole book.
+	RestartPerPart bool
+	// If true the label also replaces the text of the first h1 heading
+	// in each chapter's file, or is added as an h1 heading at the start
+	// of the body if there isn't one.
+	Headings bool
+}
+
+// SetChapterNumbering numbers the book's chapters when it's written.
+// The numbered label is used for the chapter's navpoint, and
+// optionally its heading, and is available for running heads and the
+// like through ChapterLabel. Chapters are numbered in table of contents order.
+// Passing nil turns numbering off again.
+func (e *EPub) SetChapterNumbering(n *ChapterNumbering) error {
+	if n != nil && !strings.Contains(n.Format, "%d") {
+		return errors.New("chapter number format must contain %d")
+	}
+	if n != nil {
+		c := *n
+		n = &c
+	}
+	e.numbering = n
+	return nil
+}
+
+// AddChapter adds an XHTML file to the book as a chapter, along with
+// a top-level navpoint labeled with its title. The title is numbered
+// as set by SetChapterNumbering. Chapters appear in the spine in the
+// order they're added, like files added with AddXHTML. To add a
+// chapter to a part use Part.AddChapter.
+//
+// Returns the ID of the added file.
+func (e *EPub) AddChapter(title, path, contents string) (Id, error) {
+	id, err := e.AddXHTML(path, contents)
+	if err != nil {
+		return "", err
+	}
+	e.AddNavpoint(title, path, len(e.navpoints)+1).chapter = true
+	return id, nil
+}
+
+// ChapterLabel returns the label of the chapter in the XHTML file
+// with the given ID, numbered if SetChapterNumbering was called, and
+// whether the file is a chapter.
+func (e *EPub) ChapterLabel(id Id) (string, bool) {
+	x, err := e.findXHTML(id)
+	if err != nil {
+		return "", false
+	}
+	n := e.chapterNavpoint(x.name)
+	if n == nil {
+		return "", false
+	}
+	return e.navpointLabel(n), true
+}
+
+// chapterNavpoint returns the navpoint of the chapter in the named
+// file, or nil if it isn't a chapter.
+func (e *EPub) chapterNavpoint(name string) *Navpoint {
+	var find func([]*Navpoint) *Navpoint
+	find = func(np []*Navpoint) *Navpoint {
+		for _, n := range np {
+			if n.chapter && n.filename == name {
+				return n
+			}
+			if f := find(n.navpoints); f != nil {
+				return f
+			}
+		}
+		return nil
+	}
+	return find(e.navpoints)
+}
+
+// navpointLabel returns the label a navpoint should be written with.
+func (e *EPub) navpointLabel(n *Navpoint) string {
+	if !n.chapter || e.numbering == nil {
+		return n.label
+	}
+	num := e.chapterNumber(n)
+	return strings.NewReplacer("%d", strconv.Itoa(num), "%s", n.label, "%%", "%").Replace(e.numbering.Format)
+}
+
+// chapterNumber returns the number of the chapter with the given
+// navpoint.
+func (e *EPub) chapterNumber(c *Navpoint) int {
+	count := 0
+	var walk func([]*Navpoint) bool
+	walk = func(np []*Navpoint) bool {
+		np = sortedNavpoints(np)
+		for _, n := range np {
+			if n.part && e.numbering.RestartPerPart {
+				count = 0
+			}
+			if n.chapter {
+				count++
+				if n == c {
+					return true
+				}
+			}
+			if walk(n.navpoints) {
+				return true
+			}
+		}
+		return false
+	}
+	walk(e.navpoints)
+	return count
+}
+
+var h1RE = regexp.MustCompile(`(?is)<h1\b[^>]*>(.*?)</h1\s*>`)
+
+// numberHeading puts the chapter's label into the first h1 heading of
+// the named file's contents.
+func (e *EPub) numberHeading(name string, c []byte) []byte {
+	n := e.chapterNavpoint(name)
+	if n == nil {
+		return c
+	}
+	h := html.EscapeString(headingText(e.text(e.navpointLabel(n))))
+	if loc := h1RE.FindSubmatchIndex(c); loc != nil {
+		return []byte(string(c[:loc[2]]) + h + string(c[loc[3]:]))
+	}
+	if loc := bodyStartRE.FindIndex(c); loc != nil {
+		return []byte(string(c[:loc[1]]) + "\n<h1>" + h + "</h1>" + string(c[loc[1]:]))
+	}
+	return c
+}
@@ -0,0 +1,838 @@
+package epub
+
+// This file holds the code to read existing ePub files back into an
+// EPub.
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bookReader holds the state needed while reading an ePub file.
+type bookReader struct {
+	e      *EPub
+	files  map[string][]byte // The archive's files, by name
+	opf    string            // The package document's name in the archive
+	ids    map[string]Id     // New IDs of manifest items, by their ID in the file
+	paths  map[string]Id     // New IDs of XHTML files, by path in the book
+	nav    string            // The v3 nav document's name in the archive, if any
+	ncx    string            // The NCX's name in the archive, if any
+	refine map[string][]*xnode
+	// The prefixes the package document declares for namespaces, by
+	// namespace URI.
+	prefixes map[string]string
+}
+
+// Open reads the named ePub file into a new EPub, which can then be
+// changed with the Add and Set methods and written back out, in
+// either version, with Write, WriteV2, or WriteV3. See Parse.
+func Open(name string) (*EPub, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse reads a serialized ePub file into a new EPub. See ReadFrom.
+func Parse(book []byte) (*EPub, error) {
+	return ReadFrom(bytes.NewReader(book), int64(len(book)))
+}
+
+// ReadFrom reads an ePub file of the given size into a new EPub. The
+// book keeps its version, metadata, files, spine order, table of
+// contents, page list, and landmarks (or guide); the NCX and nav
+// document are regenerated from the table of contents when the book
+// is written, as is the modification date.
+//
+// Reading is best-effort, and some things don't survive it: XHTML
+// files that aren't in the spine are added to the end of it, and the
+// manifest's properties are worked out afresh. Spine itemrefs keep
+// their linear and properties attributes. Metadata elements keep
+// attributes and refinements this package doesn't model, and elements
+// it doesn't know at all are carried over with AddRawMetadata.
+//
+// Fonts obfuscated with the IDPF or Adobe algorithm are restored, and
+// IDPF obfuscation is turned back on with SetFontObfuscation; Adobe
+// obfuscated fonts are written out plain. Books
+// with resources that are really encrypted, as with DRM, can't be
+// read. Neither can books with a file larger than 256MB, or more than
+// 1GB of files in all, which guards against zip bombs.
+func ReadFrom(r io.ReaderAt, size int64) (*EPub, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files, err := zipContents(z)
+	if err != nil {
+		return nil, err
+	}
+	container, ok := files["META-INF/container.xml"]
+	if !ok {
+		return nil, errorf(ErrUnsupportedFormat, "no META-INF/container.xml")
+	}
+	root, err := parseXML(bytes.NewReader(container))
+	if err != nil {
+		return nil, errorf(ErrUnsupportedFormat, "unable to parse META-INF/container.xml: %v", err)
+	}
+	rf := root.find("rootfile")
+	if rf == nil {
+		return nil, errorf(ErrUnsupportedFormat, "container has no rootfile")
+	}
+
+	br := &bookReader{
+		e:      New(),
+		files:  files,
+		opf:    rf.attr("full-path"),
+		ids:    make(map[string]Id),
+		paths:  make(map[string]Id),
+		refine: make(map[string][]*xnode),
+	}
+	opfData, ok := files[br.opf]
+	if !ok {
+		return nil, errorf(ErrUnsupportedFormat, "no package document %v", br.opf)
+	}
+	opf, err := parseXML(bytes.NewReader(opfData))
+	if err != nil {
+		return nil, errorf(ErrUnsupportedFormat, "unable to parse %v: %v", br.opf, err)
+	}
+	br.readNamespaces(opf)
+	if err := br.readVersion(opf); err != nil {
+		return nil, err
+	}
+	if err := br.readEncryption(opf); err != nil {
+		return nil, err
+	}
+	if err := br.readManifest(opf); err != nil {
+		return nil, err
+	}
+	if err := br.readMetadata(opf); err != nil {
+		return nil, err
+	}
+	br.readChapterMetadata(opf)
+	if err := br.readTOC(opf); err != nil {
+		return nil, err
+	}
+	return br.e, nil
+}
+
+// maxZipTotalSize is the most that's read from all the files in a
+// book being read. It's a variable so tests can lower it.
+var maxZipTotalSize int64 = 1 << 30
+
+// zipContents returns the contents of the files in an archive, by
+// name. It fails if any file is larger than maxZipEntrySize, or all
+// of them together are larger than maxZipTotalSize.
+func zipContents(z *zip.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	var total int64
+	for _, f := range z.File {
+		c, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if total += int64(len(c)); total > maxZipTotalSize {
+			return nil, fmt.Errorf("book is larger than %v bytes", maxZipTotalSize)
+		}
+		files[f.Name] = c
+	}
+	return files, nil
+}
+
+// readVersion sets the book's version and package attributes.
+func (br *bookReader) readVersion(opf *xnode) error {
+	v := opf.attr("version")
+	switch {
+	case strings.HasPrefix(v, "2."):
+		br.e.SetVersion(2)
+	case strings.HasPrefix(v, "3."):
+		br.e.SetVersion(3)
+	default:
+		return errorf(ErrUnsupportedVersion, "unsupported package version %q", v)
+	}
+	for _, a := range opf.attrs {
+		switch {
+		case a.Name.Space == "xmlns" || a.Name.Local == "xmlns":
+		case a.Name.Local == "version" || a.Name.Local == "unique-identifier":
+		default:
+			br.e.AddPackageAttribute(br.qualifiedName(a.Name, true), a.Value)
+		}
+	}
+	return nil
+}
+
+// readNamespaces records the namespace prefixes declared anywhere in
+// the package document. The first declaration of a namespace wins.
+func (br *bookReader) readNamespaces(n *xnode) {
+	if br.prefixes == nil {
+		br.prefixes = make(map[string]string)
+	}
+	for _, a := range n.attrs {
+		if _, ok := br.prefixes[a.Value]; a.Name.Space == "xmlns" && !ok {
+			br.prefixes[a.Value] = a.Name.Local
+		}
+	}
+	for _, c := range n.elements() {
+		br.readNamespaces(c)
+	}
+}
+
+// qualifiedName returns the name an element or attribute parsed by
+// parseXML should be written with in the package document: its local
+// name, with the prefix the package document declared for its
+// namespace. Elements in the package document's own namespace aren't
+// prefixed.
+func (br *bookReader) qualifiedName(n xml.Name, attr bool) string {
+	switch {
+	case n.Space == "", !attr && n.Space == opfNamespace:
+		return n.Local
+	case n.Space == "http://www.w3.org/XML/1998/namespace":
+		return "xml:" + n.Local
+	case n.Space == "xmlns":
+		return "xmlns:" + n.Local
+	}
+	if p, ok := br.prefixes[n.Space]; ok {
+		return p + ":" + n.Local
+	}
+	return n.Local
+}
+
+// bookPath returns the path in the book, relative to the package
+// document, of an href in the named archive file. External links are
+// returned unchanged.
+func (br *bookReader) bookPath(from, href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("bad link %q in %v: %v", href, from, err)
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return href, nil
+	}
+	p := u.Path
+	if p == "" {
+		p = path.Base(from)
+	}
+	p = path.Join(path.Dir(from), p)
+	if dir := path.Dir(br.opf); dir != "." {
+		if !strings.HasPrefix(p, dir+"/") {
+			return "", errorf(ErrUnsupportedFormat, "%v is outside the package document's directory", p)
+		}
+		p = p[len(dir)+1:]
+	}
+	if u.Fragment != "" {
+		p += "#" + u.Fragment
+	}
+	return p, nil
+}
+
+// archivePath returns the name in the archive of an href in the
+// package document.
+func (br *bookReader) archivePath(href string) string {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	return path.Join(path.Dir(br.opf), href)
+}
+
+// readManifest adds the files in the manifest to the book, with the
+// XHTML files in spine order.
+func (br *bookReader) readManifest(opf *xnode) error {
+	e := br.e
+	spine := make(map[string]int)
+	refs := make(map[string]*xnode)
+	if s := opf.find("spine"); s != nil {
+		for i, ref := range s.findAll("itemref") {
+			spine[ref.attr("idref")] = i + 1
+			refs[ref.attr("idref")] = ref
+		}
+	}
+	items := opf.findAll("item")
+	var fallbacks []*xnode
+	for _, item := range items {
+		id, href, mt := item.attr("id"), item.attr("href"), item.attr("media-type")
+		name, err := br.bookPath(br.opf, href)
+		if err != nil {
+			return err
+		}
+		contents, ok := br.files[br.archivePath(href)]
+		props := " " + item.attr("properties") + " "
+		switch {
+		case mt == "application/x-dtbncx+xml":
+			br.ncx = br.archivePath(href)
+			continue
+		case strings.Contains(props, " nav ") && spine[id] == 0:
+			br.nav = br.archivePath(href)
+			continue
+		case strings.Contains(props, " nav "):
+			br.nav = br.archivePath(href)
+		}
+		if !ok {
+			return errorf(ErrNotFound, "manifest item %v (%v) isn't in the book", id, href)
+		}
+		var nid Id
+		switch {
+		case mt == "application/xhtml+xml":
+			order := spine[id]
+			if order == 0 {
+				order = len(items) + 1
+			}
+			if nid, err = e.addXHTML(name, contents, order); err != nil {
+				return err
+			}
+			br.paths[name] = nid
+			if ref := refs[id]; ref != nil {
+				x, _ := e.findXHTML(nid)
+				x.linear, x.spineProps = ref.attr("linear"), ref.attr("properties")
+			}
+		case strings.HasPrefix(mt, "image/"):
+			i := image{name: name, filetype: strings.TrimPrefix(mt, "image/"), contents: contents, id: e.nextId("img")}
+			e.addImageEntry(i)
+			nid = i.id
+			if strings.Contains(props, " cover-image ") {
+				e.SetCoverImage(nid)
+			}
+		case mt == "text/css":
+			nid, _ = e.addStylesheet(name, contents, nil)
+		case mt == "application/javascript" || mt == "text/javascript":
+			nid, _ = e.addJavaScript(name, contents, nil)
+		case (mt == "application/opentype" || mt == "font/otf" || mt == "application/vnd.ms-opentype") && strings.HasSuffix(name, ".otf"):
+			// Fonts are added as they are, even if their licenses
+			// restrict embedding; Warnings reports those.
+			f := font{name: name, contents: contents, id: e.nextId("font")}
+			e.fonts = append(e.fonts, f)
+			nid = f.id
+		default:
+			// Everything else, including other kinds of fonts, keeps its
+			// media type.
+			m := media{name: name, contents: contents, mediaType: mt, id: e.nextId("media")}
+			e.media = append(e.media, m)
+			nid = m.id
+		}
+		br.ids[id] = nid
+		if item.attr("fallback") != "" {
+			fallbacks = append(fallbacks, item)
+		}
+	}
+	for _, item := range fallbacks {
+		if m, err := e.findMedia(br.ids[item.attr("id")]); err == nil {
+			m.fallback = br.ids[item.attr("fallback")]
+		}
+	}
+	return nil
+}
+
+// dcElements are the Dublin Core elements copied into the book as they
+// are.
+var dcElements = map[string]bool{
+	"publisher": true, "description": true, "subject": true, "date": true,
+	"rights": true, "source": true, "relation": true, "coverage": true,
+	"type": true, "format": true,
+}
+
+// revisionRE matches the content of a revision meta element written by
+// AddRevision.
+var revisionRE = regexp.MustCompile(`^(\S+) \(([^)]*)\)(?:: (.*))?$`)
+
+// readMetadata copies the package metadata into the book.
+func (br *bookReader) readMetadata(opf *xnode) error {
+	e := br.e
+	md := opf.find("metadata")
+	if md == nil {
+		return errorf(ErrUnsupportedFormat, "%v has no metadata", br.opf)
+	}
+	for _, m := range md.elements() {
+		if r := strings.TrimPrefix(m.attr("refines"), "#"); m.name == "meta" && r != "" {
+			br.refine[r] = append(br.refine[r], m)
+		}
+	}
+
+	unique := opf.attr("unique-identifier")
+	for _, m := range md.elements() {
+		value := m.textContent()
+		switch m.name {
+		case "identifier":
+			if err := br.readIdentifier(m, m.attr("id") == unique); err != nil {
+				return err
+			}
+		case "title":
+			if e.title == "" {
+				e.title = value
+			}
+			br.readDC(m)
+		case "language":
+			e.AddLanguage(value)
+		case "creator", "contributor":
+			br.readPerson(m)
+		case "meta":
+			br.readMeta(m)
+		default:
+			if dcElements[m.name] {
+				br.readDC(m)
+			} else {
+				br.readUnknown(m)
+			}
+		}
+	}
+	return nil
+}
+
+// readDC adds a Dublin Core element to the book's metadata, along with
+// what refines it: its opf: attributes in v2 books, and the meta
+// elements refining it in v3 books. Its other attributes, apart from
+// its ID, are kept as they are.
+func (br *bookReader) readDC(m *xnode) {
+	md := metadata{kind: "dc:" + m.name, value: m.textContent()}
+	for _, a := range m.attrs {
+		switch {
+		case a.Name.Space == "" && (a.Name.Local == "id" || a.Name.Local == "xmlns"), a.Name.Space == "xmlns":
+		case a.Name.Space == opfNamespace:
+			md.pairs = append(md.pairs, pair{v2prefix: "opf:", key: a.Name.Local, value: a.Value})
+		default:
+			md.attrs = append(md.attrs, xmlAttr(br.qualifiedName(a.Name, true), a.Value))
+		}
+	}
+	for _, r := range br.refine[m.attr("id")] {
+		p := pair{key: r.attr("property"), value: r.textContent(), scheme: r.attr("scheme"), lang: r.attr("lang")}
+		if p.key == "file-as" || p.key == "role" {
+			p.v2prefix = "opf:"
+		} else {
+			p.v3only = true
+		}
+		md.pairs = append(md.pairs, p)
+	}
+	br.e.metadata = append(br.e.metadata, md)
+}
+
+// readUnknown carries a metadata element this package doesn't know,
+// and the meta elements refining it, over with AddRawMetadata.
+func (br *bookReader) readUnknown(m *xnode) {
+	br.e.AddRawMetadata(br.rawElement(m))
+	for _, r := range br.refine[m.attr("id")] {
+		br.e.AddRawMetadata(br.rawElement(r))
+	}
+}
+
+// readChapterMetadata copies the metadata refining spine itemrefs, as
+// written by SetChapterMetadata, into the book.
+func (br *bookReader) readChapterMetadata(opf *xnode) {
+	for _, ref := range opf.findAll("itemref") {
+		var md ChapterMetadata
+		found := false
+		for _, m := range br.refine[ref.attr("id")] {
+			value := m.textContent()
+			switch m.attr("property") {
+			case "dcterms:creator":
+				md.Authors = append(md.Authors, value)
+			case "dcterms:date":
+				md.Date = value
+			case "dcterms:source":
+				md.Source = value
+			default:
+				continue
+			}
+			found = true
+		}
+		if found {
+			br.e.SetChapterMetadata(br.ids[ref.attr("idref")], md)
+		}
+	}
+}
+
+// readIdentifier adds an identifier to the book, making it the
+// primary one if it's the package's unique identifier.
+func (br *bookReader) readIdentifier(m *xnode, primary bool) error {
+	e := br.e
+	value := m.textContent()
+	if primary && strings.HasPrefix(value, "urn:uuid:") {
+		if err := e.SetUUID(strings.TrimPrefix(value, "urn:uuid:")); err == nil {
+			return nil
+		}
+	}
+	if err := e.AddIdentifier(value, m.attr("scheme")); err != nil {
+		return err
+	}
+	if !primary {
+		return nil
+	}
+	if err := e.SetPrimaryIdentifier(value); err != nil {
+		return err
+	}
+	// Drop the UUID identifier New made, so it doesn't pile up with
+	// each round trip.
+	for i, m := range e.metadata {
+		if m.kind == "dc:identifier" && m.value == e.uuid {
+			e.metadata = append(e.metadata[:i], e.metadata[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// readPerson adds a creator or contributor to the book, with the
+// details from its attributes (v2) or refining meta elements (v3).
+func (br *bookReader) readPerson(m *xnode) {
+	e := br.e
+	p := Person{Name: m.textContent(), Role: m.attr("role"), SortName: m.attr("file-as")}
+	for _, r := range br.refine[m.attr("id")] {
+		v := r.textContent()
+		switch r.attr("property") {
+		case "role":
+			p.Role = v
+		case "file-as":
+			p.SortName = v
+		case "alternate-script":
+			if p.AlternateScripts == nil {
+				p.AlternateScripts = make(map[string]string)
+			}
+			p.AlternateScripts[r.attr("lang")] = v
+		case "display-seq":
+			p.DisplaySeq, _ = strconv.Atoi(v)
+		}
+	}
+	if checkRole(p.Role) != nil {
+		p.Role = ""
+	}
+	if m.name == "creator" {
+		if e.AddCreatorPerson(p) == nil && (p.Role == "" || p.Role == "aut") {
+			e.authors = append(e.authors, p.Name)
+		}
+		return
+	}
+	if e.AddContributorPerson(p) == nil && p.Role == "nrt" {
+		e.narrators = append(e.narrators, p.Name)
+	}
+}
+
+// readMeta copies a meta element into the book.
+func (br *bookReader) readMeta(m *xnode) {
+	e := br.e
+	value := m.textContent()
+	switch {
+	case m.attr("refines") != "":
+		// Handled with the element it refines, or by the
+		// collection below.
+		return
+	case m.attr("name") == "cover":
+		// Cover images are marked in the manifest for v3 books.
+		if id, ok := br.ids[m.attr("content")]; ok && e.coverID != id {
+			e.SetCoverImage(id)
+		}
+		return
+	case m.attr("name") == "drm-free":
+		e.SetDRMFree(m.attr("content") == "true")
+		return
+	case m.attr("name") == onSaleProperty:
+		if t, err := time.Parse(time.RFC3339, m.attr("content")); err == nil {
+			e.SetOnSaleDate(t)
+			return
+		}
+	case e.readPeriodicalMeta(m):
+		return
+	case m.attr("name") == "revision":
+		if r := revisionRE.FindStringSubmatch(m.attr("content")); r != nil && e.AddRevision(r[1], r[2], r[3]) == nil {
+			return
+		}
+	}
+	switch m.attr("property") {
+	case "dcterms:modified", "media:narrator":
+		// The modification date is regenerated, and narrators are
+		// read from their contributor entries.
+		return
+	case "rendition:layout":
+		e.SetFixedLayout(value == "pre-paginated")
+		return
+	case "rendition:spread":
+		return
+	case onSaleProperty:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			e.SetOnSaleDate(t)
+			return
+		}
+	case "belongs-to-collection":
+		kind := ""
+		for _, r := range br.refine[m.attr("id")] {
+			switch r.attr("property") {
+			case "collection-type":
+				kind = r.textContent()
+			case "group-position":
+				e.SetEntryNumber(r.textContent())
+			}
+		}
+		if kind == "set" {
+			e.SetSet(value)
+		} else {
+			e.SetSeries(value)
+		}
+		return
+	}
+	e.AddRawMetadata(br.rawElement(m))
+}
+
+// rawElement returns an element of the package document, such as a
+// meta element, as XML, declaring the namespace prefixes it uses so it
+// can be carried over with AddRawMetadata as it is.
+func (br *bookReader) rawElement(m *xnode) string {
+	spaces := make(map[string]bool)
+	var inner strings.Builder
+	br.writeRaw(&inner, m, spaces)
+	var decls []string
+	for s := range spaces {
+		if p, ok := br.prefixes[s]; ok {
+			decls = append(decls, " "+attrPair("xmlns:"+p, s))
+		}
+	}
+	sort.Strings(decls)
+	// Put the declarations in the element's start tag, just after its
+	// name.
+	raw := inner.String()
+	i := len(br.qualifiedName(xml.Name{Space: m.space, Local: m.name}, false)) + 1
+	return raw[:i] + strings.Join(decls, "") + raw[i:]
+}
+
+// writeRaw writes n as XML, noting the namespaces whose prefixes it
+// uses in spaces.
+func (br *bookReader) writeRaw(b *strings.Builder, n *xnode, spaces map[string]bool) {
+	if n.name == "" {
+		b.WriteString(html.EscapeString(n.text))
+		return
+	}
+	name := xml.Name{Space: n.space, Local: n.name}
+	b.WriteString("<" + br.qualifiedName(name, false))
+	if _, ok := br.prefixes[n.space]; ok && n.space != opfNamespace {
+		spaces[n.space] = true
+	} else if n.space != "" && n.space != opfNamespace {
+		b.WriteString(" " + attrPair("xmlns", n.space))
+	}
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" && a.Name.Space == "" {
+			continue
+		}
+		if _, ok := br.prefixes[a.Name.Space]; ok {
+			spaces[a.Name.Space] = true
+		}
+		b.WriteString(" " + attrPair(br.qualifiedName(a.Name, true), a.Value))
+	}
+	if len(n.children) == 0 {
+		b.WriteString(" />")
+		return
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		br.writeRaw(b, c, spaces)
+	}
+	b.WriteString("</" + br.qualifiedName(name, false) + ">")
+}
+
+// guideLandmarks maps v2 guide reference types to landmarks.
+var guideLandmarks = func() map[string]Landmark {
+	m := make(map[string]Landmark)
+	for l, info := range landmarkInfo {
+		m[info.guide] = l
+	}
+	return m
+}()
+
+// readTOC reads the book's table of contents, page list, list of
+// illustrations, and landmarks from the nav document, or from the NCX and guide if
+// there's no nav document.
+func (br *bookReader) readTOC(opf *xnode) error {
+	if br.nav != "" {
+		n, err := parseXML(bytes.NewReader(br.files[br.nav]))
+		if err != nil {
+			return fmt.Errorf("unable to parse %v: %v", br.nav, err)
+		}
+		for _, nav := range n.findAll("nav") {
+			ol := nav.find("ol")
+			if ol == nil {
+				continue
+			}
+			switch nav.attr("type") {
+			case "toc":
+				if err := br.readNavList(ol, nil); err != nil {
+					return err
+				}
+			case "page-list":
+				for _, a := range ol.findAll("a") {
+					p, err := br.bookPath(br.nav, a.attr("href"))
+					if err != nil {
+						return err
+					}
+					br.e.AddPageTarget(a.textContent(), p)
+				}
+			case "loi":
+				for _, a := range ol.findAll("a") {
+					p, err := br.bookPath(br.nav, a.attr("href"))
+					if err != nil {
+						return err
+					}
+					br.e.AddIllustrationTarget(a.textContent(), p)
+				}
+			case "landmarks":
+				for _, a := range ol.findAll("a") {
+					if err := br.setLandmark(Landmark(a.attr("type")), a.textContent(), br.nav, a.attr("href")); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if guide := opf.find("guide"); guide != nil {
+		for _, r := range guide.findAll("reference") {
+			if err := br.setLandmark(guideLandmarks[r.attr("type")], r.attr("title"), br.opf, r.attr("href")); err != nil {
+				return err
+			}
+		}
+	}
+	if br.ncx == "" {
+		return nil
+	}
+	n, err := parseXML(bytes.NewReader(br.files[br.ncx]))
+	if err != nil {
+		return fmt.Errorf("unable to parse %v: %v", br.ncx, err)
+	}
+	if m := n.find("navMap"); m != nil {
+		if err := br.readNavPoints(m, nil); err != nil {
+			return err
+		}
+	}
+	if pl := n.find("pageList"); pl != nil {
+		for _, pt := range pl.findAll("pageTarget") {
+			label, src := "", ""
+			if l := pt.find("navLabel"); l != nil {
+				label = l.textContent()
+			}
+			if c := pt.find("content"); c != nil {
+				src = c.attr("src")
+			}
+			p, err := br.bookPath(br.ncx, src)
+			if err != nil {
+				return err
+			}
+			br.e.AddPageTarget(label, p)
+		}
+	}
+	for _, nl := range n.findAll("navList") {
+		if nl.attr("class") != "loi" {
+			continue
+		}
+		for _, nt := range nl.findAll("navTarget") {
+			label, src := "", ""
+			if l := nt.find("navLabel"); l != nil {
+				label = l.textContent()
+			}
+			if c := nt.find("content"); c != nil {
+				src = c.attr("src")
+			}
+			p, err := br.bookPath(br.ncx, src)
+			if err != nil {
+				return err
+			}
+			br.e.AddIllustrationTarget(label, p)
+		}
+	}
+	return nil
+}
+
+// addNavpoint adds a navpoint to the book, or to parent if it's not
+// nil.
+func (br *bookReader) addNavpoint(parent *Navpoint, label, name string, order int) *Navpoint {
+	if parent == nil {
+		return br.e.AddNavpoint(label, name, order)
+	}
+	return parent.AddNavpoint(label, name, order)
+}
+
+// readNavList reads the entries of a nav document list.
+func (br *bookReader) readNavList(ol *xnode, parent *Navpoint) error {
+	order := 0
+	for _, li := range ol.elements() {
+		if li.name != "li" {
+			continue
+		}
+		label, href := "", ""
+		var sub *xnode
+		for _, c := range li.elements() {
+			switch c.name {
+			case "a", "span":
+				label, href = c.textContent(), c.attr("href")
+			case "ol":
+				sub = c
+			}
+		}
+		p := ""
+		if href != "" {
+			var err error
+			if p, err = br.bookPath(br.nav, href); err != nil {
+				return err
+			}
+		}
+		order++
+		np := br.addNavpoint(parent, label, p, order)
+		if sub != nil {
+			if err := br.readNavList(sub, np); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readNavPoints reads the navPoints of an NCX navMap or navPoint.
+func (br *bookReader) readNavPoints(n *xnode, parent *Navpoint) error {
+	order := 0
+	for _, c := range n.elements() {
+		if c.name != "navPoint" {
+			continue
+		}
+		label, src := "", ""
+		if l := c.find("navLabel"); l != nil {
+			label = l.textContent()
+		}
+		if content := c.find("content"); content != nil {
+			src = content.attr("src")
+		}
+		p, err := br.bookPath(br.ncx, src)
+		if err != nil {
+			return err
+		}
+		order++
+		if err := br.readNavPoints(c, br.addNavpoint(parent, label, p, order)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLandmark tags the XHTML file an href in the named archive file
+// points at with a landmark. Unknown landmarks are ignored.
+func (br *bookReader) setLandmark(kind Landmark, title, from, href string) error {
+	if _, ok := landmarkInfo[kind]; !ok {
+		return nil
+	}
+	p, err := br.bookPath(from, href)
+	if err != nil {
+		return err
+	}
+	if i := strings.IndexByte(p, '#'); i >= 0 {
+		p = p[:i]
+	}
+	id, ok := br.paths[p]
+	if !ok {
+		return nil
+	}
+	return br.e.SetLandmark(id, kind, title)
+}
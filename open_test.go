@@ -0,0 +1,773 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// richBook returns a book that uses most of the package's features.
+func richBook(t testing.TB, version float64) *EPub {
+	t.Helper()
+	e := New()
+	e.SetVersion(version)
+	e.SetTitle("Salt & Pepper")
+	e.AddAuthor("Jane Doe")
+	e.AddCreatorPerson(Person{Name: "Haruki", SortName: "Murakami, H", Role: "ill", AlternateScripts: map[string]string{"ja": "村上"}, DisplaySeq: 2})
+	e.AddNarrator("Nora")
+	e.AddLanguage("en")
+	e.AddPublisher("Pub")
+	e.AddDescription("A book")
+	e.AddSubject("Cooking")
+	e.AddIdentifier("urn:isbn:9780000000000", "ISBN")
+	e.SetSeries("Spice")
+	e.SetEntryNumber("2")
+	e.AddRawMetadata(`<meta name="calibre:rating" content="8" />`)
+	e.AddRevision("1.1", "2020-01-01", "fixed typos")
+	e.SetDRMFree(true)
+	cover, err := e.AddImage("images/cover.png", testPNG(t, 10, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetCoverImage(cover)
+	e.AddStylesheet("css/a.css", "p { margin: 0; }")
+	e.AddJavaScript("js/a.js", "var a;")
+	e.AddFont("fonts/a.otf", []byte("font"))
+	a, _ := e.AddXHTML("text/a.xhtml", xhtmlPage("A", `<p id="p1">A</p>`), 2)
+	e.AddXHTML("text/b.xhtml", xhtmlPage("B", "<p>B</p>"), 1)
+	np := e.AddNavpoint("Chapter & One", "text/a.xhtml", 1)
+	np.AddNavpoint("Sub", "text/a.xhtml#p1", 1)
+	e.AddNavpoint("Two", "text/b.xhtml", 2)
+	e.AddPageTarget("1", "text/a.xhtml#p1")
+	e.SetLandmark(a, LandmarkBodyMatter, "Start")
+	return e
+}
+
+func TestParse(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		b, err := richBook(t, v).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := Parse(b)
+		if err != nil {
+			t.Fatalf("v%v: Parse() = %v", v, err)
+		}
+		if e.Version() != v {
+			t.Errorf("v%v: Version() = %v", v, e.Version())
+		}
+		if e.title != "Salt & Pepper" || !reflect.DeepEqual(e.authors, []string{"Jane Doe"}) {
+			t.Errorf("v%v: title %q and authors %q not read", v, e.title, e.authors)
+		}
+		again, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := Diff(b, again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The modification date may tick over.
+		var md []MetadataChange
+		for _, m := range d.Metadata {
+			if m.Name != "meta dcterms:modified" {
+				md = append(md, m)
+			}
+		}
+		d.Metadata = md
+		if !d.Empty() {
+			t.Errorf("v%v: book changed by a round trip:\n%v", v, d)
+		}
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	b, err := richBook(t, 3).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := t.TempDir() + "/book.epub"
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e, err := ReadFrom(f, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version() != 3 || e.title != "Salt & Pepper" || len(e.xhtml) == 0 {
+		t.Errorf("ReadFrom read version %v, title %q, and %v XHTML files", e.Version(), e.title, len(e.xhtml))
+	}
+	if _, err := ReadFrom(f, int64(len(b))/2); err == nil {
+		t.Errorf("ReadFrom of half the book succeeded")
+	}
+}
+
+func TestParseUnmodeled(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		b, err := richBook(t, v).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opf := "OPS/content.opf"
+		if v == 3 {
+			opf = "OPS/book.opf"
+		}
+		b = editZip(t, b, opf, strings.NewReplacer(
+			`<itemref idref="xhtml1" />`, `<itemref idref="xhtml1" linear="no" properties="page-spread-left" />`,
+			`<dc:publisher`, `<dc:publisher xml:lang="fr"`,
+			`<dc:description`, `<dc:date opf:event="publication" xmlns:opf="http://www.idpf.org/2007/opf">2020-01-01</dc:date><dc:description`,
+			`</metadata>`, `<x:rating xmlns:x="urn:example" x:scale="10">8</x:rating></metadata>`,
+		).Replace)
+		e, err := Parse(b)
+		if err != nil {
+			t.Fatalf("v%v: Parse() = %v", v, err)
+		}
+		again, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			`<itemref idref="xhtml1" linear="no"`,
+			`xml:lang="fr">Pub</dc:publisher>`,
+			`<x:rating xmlns:x="urn:example" x:scale="10">8</x:rating>`,
+		}
+		if v == 3 {
+			want = append(want, `properties="page-spread-left"`)
+		} else {
+			want = append(want, `<dc:date opf:event="publication">2020-01-01</dc:date>`)
+		}
+		wantContains(t, fmt.Sprintf("v%v %v", v, opf), zipFile(t, again, opf), want...)
+
+		// Nothing more is lost by a second round trip.
+		e, err = Parse(again)
+		if err != nil {
+			t.Fatalf("v%v: Parse() = %v", v, err)
+		}
+		third, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := Diff(again, third)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var md []MetadataChange
+		for _, m := range d.Metadata {
+			if m.Name != "meta dcterms:modified" {
+				md = append(md, m)
+			}
+		}
+		d.Metadata = md
+		if !d.Empty() {
+			t.Errorf("v%v: book changed by a second round trip:\n%v", v, d)
+		}
+	}
+}
+
+// editZip returns book with the named file's contents passed through
+// edit.
+func editZip(t *testing.T, book []byte, name string, edit func(string) string) []byte {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for _, f := range r.File {
+		c := zipFile(t, book, f.Name)
+		if f.Name == name {
+			c = edit(c)
+		}
+		w, err := z.CreateHeader(&zip.FileHeader{Name: f.Name, Method: f.Method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestParseConvert(t *testing.T) {
+	b, err := richBook(t, 2).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetVersion(3)
+	v3, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav := zipFile(t, v3, "OPS/__toc.xhtml")
+	for _, want := range []string{`<a href="text/a.xhtml">Chapter &amp; One</a>`, `<a href="text/a.xhtml#p1">Sub</a>`, `<a epub:type="bodymatter" href="text/a.xhtml">Start</a>`} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("converted nav document doesn't contain %q:\n%s", want, nav)
+		}
+	}
+	opf := zipFile(t, v3, "OPS/book.opf")
+	for _, want := range []string{`properties="cover-image"`, `<dc:identifier id="BookId">urn:uuid:`, `property="file-as">Murakami, H</meta>`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("converted package document doesn't contain %q:\n%s", want, opf)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse([]byte("not a zip file")); err == nil {
+		t.Errorf("Parse(garbage) succeeded")
+	}
+	e := simpleBook(t)
+	if err := e.SetEncryption("xhtml1", &Encryption{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(b); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Parse(encrypted book) = %v, want ErrUnsupportedFormat", err)
+	}
+
+	// Books too large to read safely.
+	b, err = richBook(t, 3).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []*int64{&maxZipEntrySize, &maxZipTotalSize} {
+		old := *limit
+		*limit = 1 << 10
+		_, err := Parse(b)
+		*limit = old
+		if err == nil {
+			t.Errorf("Parse succeeded with a %v byte limit", 1<<10)
+		}
+	}
+}
+
+func TestParseObfuscatedFonts(t *testing.T) {
+	font := bytes.Repeat([]byte("OTTO font data "), 100)
+	for _, v := range []float64{2, 3} {
+		e := richBook(t, v)
+		id, err := e.AddFont("fonts/b.otf", font)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.SetFontObfuscation(true)
+		b, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zipFile(t, b, "OPS/fonts/b.otf") == string(font) {
+			t.Fatalf("v%v: font wasn't obfuscated", v)
+		}
+		r, err := Parse(b)
+		if err != nil {
+			t.Fatalf("v%v: Parse(book with obfuscated fonts) = %v", v, err)
+		}
+		if !r.obfuscateFonts {
+			t.Errorf("v%v: font obfuscation is off after reading an obfuscated book", v)
+		}
+		if !bytes.Equal(fontContents(t, r, "fonts/b.otf"), font) {
+			t.Errorf("v%v: font %v wasn't deobfuscated", v, id)
+		}
+		again, err := r.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := zipFile(t, again, "OPS/fonts/b.otf"), zipFile(t, b, "OPS/fonts/b.otf"); got != want {
+			t.Errorf("v%v: font obfuscated differently after a round trip", v)
+		}
+	}
+
+	// Adobe's obfuscation is keyed by the UUID's bytes and isn't
+	// applied when writing, so the font is written as it is and read
+	// back as though it had been obfuscated.
+	e := richBook(t, 2)
+	if err := e.SetUUID("a1b2c3d4-0000-4000-8000-00000000beef"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := e.AddFont("fonts/b.otf", font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetEncryption(id, &Encryption{Algorithm: adobeObfuscation}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse(book with Adobe obfuscated fonts) = %v", err)
+	}
+	want, err := adobeObfuscateFont(font, e.PrimaryIdentifier())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fontContents(t, r, "fonts/b.otf"); !bytes.Equal(got, want) {
+		t.Errorf("Adobe obfuscated font wasn't deobfuscated")
+	}
+	if r.obfuscateFonts {
+		t.Errorf("IDPF font obfuscation turned on by a book using Adobe's")
+	}
+
+	// Adobe's key must be a UUID.
+	if err := e.AddIdentifier("isbn:9780000000002", "ISBN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetPrimaryIdentifier("isbn:9780000000002"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = e.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(b); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Parse(Adobe obfuscation keyed by an ISBN) = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// fontContents returns the contents of the named font in e.
+func fontContents(t *testing.T, e *EPub, name string) []byte {
+	t.Helper()
+	for _, f := range e.fonts {
+		if f.name == name {
+			return f.contents
+		}
+	}
+	t.Fatalf("no font %v", name)
+	return nil
+}
+
+func TestStripVendorMetadata(t *testing.T) {
+	e := simpleBook(t)
+	e.AddRawMetadata(`<meta name="calibre:timestamp" content="2020-01-01T00:00:00+00:00" />`)
+	e.AddRawMetadata(`<meta name="Sigil version" content="1.9.0" />`)
+	e.AddRawMetadata(`<meta name="keep" content="me" />`)
+	e.AddContributor("calibre (5.0) [https://calibre-ebook.com]", "bkp")
+	e.AddContributor("Jane Producer", "bkp")
+	e.AddIdentifier("1234", "calibre")
+	e.media = append(e.media, media{name: "iTunesMetadata.plist", contents: []byte("<plist/>"), mediaType: "application/xml", id: e.nextId("media")})
+	e.AddXHTML("b.xhtml", xhtmlPage("B", "<p>One</p>\n<hr class=\"sigil_split_marker\" />\n<p>Two</p>"))
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Parse(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.StripVendorMetadata()
+	if len(got) != 6 {
+		t.Errorf("StripVendorMetadata() = %q, want 6 removals", got)
+	}
+	out, err := r.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, out, "OPS/content.opf")
+	for _, s := range []string{"calibre", "Sigil", "iTunesMetadata"} {
+		if strings.Contains(opf, s) {
+			t.Errorf("package document still mentions %v:\n%s", s, opf)
+		}
+	}
+	for _, s := range []string{`name="keep"`, "Jane Producer"} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("package document lost %v:\n%s", s, opf)
+		}
+	}
+	if x := zipFile(t, out, "OPS/b.xhtml"); strings.Contains(x, "sigil") || !strings.Contains(x, "<p>One</p>\n<p>Two</p>") {
+		t.Errorf("section marker not cleanly removed:\n%s", x)
+	}
+	if got := r.StripVendorMetadata(); len(got) != 0 {
+		t.Errorf("second StripVendorMetadata() = %q, want nothing", got)
+	}
+}
+
+func TestReplaceCover(t *testing.T) {
+	for _, v := range []float64{2, 3} {
+		book, err := richBook(t, v).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := Parse(book)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, c, err := e.Cover()
+		if err != nil {
+			t.Fatalf("v%v: Cover() = %v", v, err)
+		}
+		if want := testPNG(t, 10, 16); !bytes.Equal(c, want) {
+			t.Errorf("v%v: Cover() contents don't match the original cover", v)
+		}
+
+		jpeg := testJPEG(t, 20, 32)
+		if err := e.ReplaceCover(jpeg); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := e.ImageInfo(id); err != nil || info != (ImageInfo{Width: 20, Height: 32, Format: "jpeg"}) {
+			t.Errorf("v%v: ImageInfo() = %+v, %v after ReplaceCover", v, info, err)
+		}
+		out, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := zipFile(t, out, "OPS/images/cover.png"); got != string(jpeg) {
+			t.Errorf("v%v: written cover isn't the replacement", v)
+		}
+		if err := e.ReplaceCover([]byte("not an image")); err == nil {
+			t.Errorf("v%v: ReplaceCover accepted a bad image", v)
+		}
+	}
+
+	e := simpleBook(t)
+	if _, _, err := e.Cover(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cover() = %v for a book without a cover, want ErrNotFound", err)
+	}
+	if err := e.ReplaceCover(testPNG(t, 2, 2)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReplaceCover() = %v for a book without a cover, want ErrNotFound", err)
+	}
+}
+
+func TestProbeMetadata(t *testing.T) {
+	dir, err := os.MkdirTemp("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, v := range []float64{2, 3} {
+		e := richBook(t, v)
+		book, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "book.epub")
+		if err := os.WriteFile(name, book, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ProbeMetadata(name)
+		if err != nil {
+			t.Fatalf("v%v: %v", v, err)
+		}
+		want := Metadata{
+			Version:     "2.0",
+			Title:       "Salt & Pepper",
+			Authors:     []string{"Jane Doe"},
+			Languages:   []string{"en"},
+			Publishers:  []string{"Pub"},
+			Identifier:  e.PrimaryIdentifier(),
+			Description: "A book",
+			Subjects:    []string{"Cooking"},
+			Cover:       "OPS/images/cover.png",
+		}
+		if v == 3 {
+			want.Version = "3.0"
+			want.Series, want.SeriesIndex = "Spice", "2"
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("v%v: ProbeMetadata() = %+v, want %+v", v, got, want)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.epub")
+	if err := os.WriteFile(bad, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProbeMetadata(bad); err == nil {
+		t.Errorf("ProbeMetadata succeeded on a bad file")
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const container = `<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`
+	type entry struct {
+		name, contents string
+		method         uint16
+		extra          []byte
+	}
+	mimetype := entry{name: "mimetype", contents: "application/epub+zip"}
+	containerEntry := entry{name: "META-INF/container.xml", contents: container, method: zip.Deflate}
+	opf := entry{name: "OPS/content.opf", contents: "<package/>", method: zip.Deflate}
+	write := func(entries ...entry) string {
+		var b bytes.Buffer
+		z := zip.NewWriter(&b)
+		for _, e := range entries {
+			w, err := z.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Extra: e.extra})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(e.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "book.epub")
+		if err := os.WriteFile(name, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	for _, v := range []float64{2, 3} {
+		book, err := richBook(t, v).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "book.epub")
+		if err := os.WriteFile(name, book, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyFile(name); err != nil {
+			t.Errorf("v%v: VerifyFile() = %v", v, err)
+		}
+	}
+	if err := VerifyFile(write(mimetype, containerEntry, opf)); err != nil {
+		t.Errorf("VerifyFile(minimal book) = %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		entries []entry
+	}{
+		{"mimetype second", []entry{containerEntry, mimetype, opf}},
+		{"compressed mimetype", []entry{{name: "mimetype", contents: "application/epub+zip", method: zip.Deflate}, containerEntry, opf}},
+		{"mimetype with extra field", []entry{{name: "mimetype", contents: "application/epub+zip", extra: []byte{0xfe, 0xca, 0, 0}}, containerEntry, opf}},
+		{"wrong mimetype", []entry{{name: "mimetype", contents: "application/epub+zip\n"}, containerEntry, opf}},
+		{"no container", []entry{mimetype, opf}},
+		{"no rootfile", []entry{mimetype, {name: "META-INF/container.xml", contents: "<container/>"}, opf}},
+		{"missing package document", []entry{mimetype, containerEntry}},
+	} {
+		if err := VerifyFile(write(tc.entries...)); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("VerifyFile(%v) = %v, want ErrUnsupportedFormat", tc.desc, err)
+		}
+	}
+	bad := filepath.Join(dir, "bad.epub")
+	if err := os.WriteFile(bad, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFile(bad); err == nil {
+		t.Errorf("VerifyFile succeeded on a bad file")
+	}
+}
+
+func TestChapterMetadata(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	b, err := e.AddXHTML("b.xhtml", xhtmlPage("The Second Story", "<p>B</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddNavpoint("The First Story", "a.xhtml", 1)
+	md := ChapterMetadata{Authors: []string{"Ann Smith", "Bo Jones"}, Date: "1998-04", Source: "Weird Tales"}
+	if err := e.SetChapterMetadata("xhtml1", md); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetChapterMetadata(b, ChapterMetadata{Date: "1999"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetChapterMetadata(b, ChapterMetadata{Date: "April 1999"}); err == nil {
+		t.Errorf("SetChapterMetadata accepted a bad date")
+	}
+	if _, err := e.AddCreditsPage(100); err != nil {
+		t.Fatal(err)
+	}
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/book.opf")
+	for _, want := range []string{
+		`<itemref id="ref-xhtml1" idref="xhtml1"`,
+		`<meta refines="#ref-xhtml1" property="dcterms:creator">Bo Jones</meta>`,
+		`<meta refines="#ref-xhtml1" property="dcterms:source">Weird Tales</meta>`,
+		`<meta refines="#ref-` + string(b) + `" property="dcterms:date">1999</meta>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document lacks %s:\n%s", want, opf)
+		}
+	}
+	credits := zipFile(t, book, "OPS/xhtml/credits.xhtml")
+	for _, want := range []string{
+		`<a href="../a.xhtml">The First Story</a>, by Ann Smith and Bo Jones. First published in Weird Tales, 1998-04.`,
+		`<a href="../b.xhtml">The Second Story</a>. First published 1999.`,
+	} {
+		if !strings.Contains(credits, want) {
+			t.Errorf("credits page lacks %s:\n%s", want, credits)
+		}
+	}
+
+	e, err = Parse(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.ChapterMetadata(e.spineOrder()[0].id); !ok || !reflect.DeepEqual(got, md) {
+		t.Errorf("ChapterMetadata() after Parse = %+v, %v; want %+v", got, ok, md)
+	}
+	if _, ok := e.ChapterMetadata(e.spineOrder()[2].id); ok {
+		t.Errorf("the credits page has metadata after Parse")
+	}
+}
+
+func TestSetPeriodical(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	p := Periodical{Title: "The Monthly Review", Kind: PeriodicalMagazine, Issue: "42", Volume: "7", Frequency: "monthly", ISSN: "0317-8471"}
+	if err := e.SetPeriodical(Periodical{Title: "X", ISSN: "12345678"}); err == nil {
+		t.Errorf("SetPeriodical accepted a bad ISSN")
+	}
+	if err := e.SetPeriodical(p); err != nil {
+		t.Fatal(err)
+	}
+	news := e.AddNavpoint("News", "a.xhtml", 1)
+	news.AddArticle("Storm hits coast", "By Jane Doe", "a.xhtml#storm", 1)
+	news.AddArticle("Bridge reopens", "", "a.xhtml#bridge", 2)
+
+	book, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/book.opf")
+	for _, want := range []string{
+		`<meta name="calibre:publication_type" content="periodical:magazine:The Monthly Review" />`,
+		`<meta property="dcterms:isPartOf">The Monthly Review</meta>`,
+		`<meta property="schema:issueNumber">42</meta>`,
+		`<meta property="dcterms:accrualPeriodicity">monthly</meta>`,
+		`<meta property="schema:issn">0317-8471</meta>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document lacks %s:\n%s", want, opf)
+		}
+	}
+	ncx, err := e.RenderNCX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`xmlns:mbp="http://mobipocket.com/ns/mbp"`,
+		`<navPoint id="navpointid_0" class="section"`,
+		`<navPoint id="navpointid_0_0" class="article"`,
+		`<mbp:meta name="author">By Jane Doe</mbp:meta>`,
+	} {
+		if !strings.Contains(string(ncx), want) {
+			t.Errorf("NCX lacks %s:\n%s", want, ncx)
+		}
+	}
+	if strings.Count(string(ncx), "<mbp:meta") != 1 {
+		t.Errorf("NCX has bylines for articles without them:\n%s", ncx)
+	}
+
+	e, err = Parse(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.Periodical(); !ok || got != p {
+		t.Errorf("Periodical() after Parse = %+v, %v; want %+v", got, ok, p)
+	}
+	if len(e.rawMetadata) != 0 {
+		t.Errorf("periodical metadata kept as raw metadata: %q", e.rawMetadata)
+	}
+}
+
+// FuzzReadFrom checks that malformed container files, package
+// documents, NCXs, and nav documents can't make reading a book panic
+// or hang, and that books that can be read can be written back out.
+func FuzzReadFrom(f *testing.F) {
+	// The books' other files are taken from richBook, so that the
+	// package documents in the corpus have something to refer to.
+	names := map[string]string{"opf": "OPS/content.opf", "ncx": "OPS/toc.ncx", "nav": "OPS/__toc.xhtml"}
+	others := make(map[string][]byte)
+	for _, version := range []float64{2, 3} {
+		b, err := richBook(f, version).Serialize()
+		if err != nil {
+			f.Fatal(err)
+		}
+		files, err := readZip(b)
+		if err != nil {
+			f.Fatal(err)
+		}
+		opf := files["OPS/content.opf"]
+		if version == 3 {
+			opf = files["OPS/book.opf"]
+		}
+		container := bytes.Replace(files["META-INF/container.xml"], []byte("OPS/book.opf"), []byte("OPS/content.opf"), 1)
+		f.Add(string(container), string(opf), string(files[names["ncx"]]), string(files[names["nav"]]))
+		for name, c := range files {
+			if strings.HasPrefix(name, "OPS/") && !strings.HasSuffix(name, ".opf") {
+				others[name] = c
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, container, opf, ncx, nav string) {
+		var buf bytes.Buffer
+		z := zip.NewWriter(&buf)
+		write := func(name string, c []byte) {
+			w, err := z.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write("mimetype", []byte("application/epub+zip"))
+		write("META-INF/container.xml", []byte(container))
+		write(names["opf"], []byte(opf))
+		write(names["ncx"], []byte(ncx))
+		write(names["nav"], []byte(nav))
+		for name, c := range others {
+			if name != names["ncx"] && name != names["nav"] {
+				write(name, c)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		e, err := Parse(buf.Bytes())
+		if err != nil {
+			return
+		}
+		// The book may well not be valid; writing it just mustn't panic.
+		e.Serialize()
+	})
+}
+
+// readZip returns the contents of the files in a serialized book, by
+// name.
+func readZip(book []byte) (map[string][]byte, error) {
+	z, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		return nil, err
+	}
+	return zipContents(z)
+}
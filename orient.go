@@ -0,0 +1,164 @@
+package epub
+
+// This file holds the code that handles the EXIF orientation of JPEG
+// images.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	img "image"
+	"image/jpeg"
+)
+
+// orientQuality is the JPEG quality rotated images are re-encoded
+// with.
+const orientQuality = 95
+
+// SetAutoOrient controls whether JPEG images added with AddImage and
+// its relatives are rotated to match their EXIF orientation tag.
+// Cameras and phones often store photos sideways and record how to
+// turn them in the tag, but several reading systems ignore it and
+// show the photo sideways. With auto orientation on, such images are
+// decoded, rotated or flipped, and re-encoded so they're the right
+// way up without the tag. Re-encoding drops the image's other
+// metadata, including any color profile, and loses a little quality.
+// Images already in the book aren't changed.
+//
+// With auto orientation off, the default, Warnings reports JPEG
+// images whose orientation tag says they need turning.
+func (e *EPub) SetAutoOrient(auto bool) {
+	e.autoOrient = auto
+}
+
+// orientImage returns the contents of an image added to the book,
+// rotated to match its EXIF orientation if auto orientation is on,
+// along with its config.
+func (e *EPub) orientImage(contents []byte, format string, cfg img.Config) ([]byte, img.Config, error) {
+	if !e.autoOrient || format != "jpeg" {
+		return contents, cfg, nil
+	}
+	o := exifOrientation(contents)
+	if o <= 1 {
+		return contents, cfg, nil
+	}
+	src, err := jpeg.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, cfg, err
+	}
+	dst := orient(src, o)
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, dst, &jpeg.Options{Quality: orientQuality}); err != nil {
+		return nil, cfg, err
+	}
+	cfg.Width, cfg.Height = dst.Bounds().Dx(), dst.Bounds().Dy()
+	return b.Bytes(), cfg, nil
+}
+
+// orientationWarnings reports JPEG images whose EXIF orientation
+// reading systems may ignore.
+func (e *EPub) orientationWarnings() []string {
+	var warnings []string
+	for _, i := range e.images {
+		if i.filetype != "jpeg" {
+			continue
+		}
+		if o := exifOrientation(i.contents); o > 1 {
+			warnings = append(warnings, fmt.Sprintf("%v has EXIF orientation %v, which some reading systems ignore; use SetAutoOrient to rotate it", i.name, o))
+		}
+	}
+	return warnings
+}
+
+// orient returns src transformed as EXIF orientation o says it should
+// be displayed.
+func orient(src img.Image, o int) img.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := img.NewRGBA(img.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch o {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the EXIF orientation of JPEG image contents,
+// from 1 to 8, or 0 if it has none.
+func exifOrientation(c []byte) int {
+	if len(c) < 4 || c[0] != 0xff || c[1] != 0xd8 {
+		return 0
+	}
+	for off := 2; off+4 <= len(c) && c[off] == 0xff; {
+		marker := c[off+1]
+		if marker == 0xda || marker == 0xd9 {
+			return 0
+		}
+		end := off + 2 + int(binary.BigEndian.Uint16(c[off+2:]))
+		if end < off+4 || end > len(c) {
+			return 0
+		}
+		if seg := c[off+4 : end]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		off = end
+	}
+	return 0
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of a
+// TIFF header, as found in an EXIF segment, or 0 if it has none.
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(t[4:]))
+	if ifd < 0 || ifd+2 > len(t) {
+		return 0
+	}
+	n := int(order.Uint16(t[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(t) {
+			return 0
+		}
+		if order.Uint16(t[entry:]) == 0x0112 {
+			if o := int(order.Uint16(t[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
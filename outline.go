@@ -0,0 +1,221 @@
+package epub
+
+// This file holds the code that exports the book's structure for
+// review, and imports it from a file editors maintain.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// OutlineFormat is the format Outline writes the book's outline in.
+type OutlineFormat int
+
+const (
+	// OutlineMarkdown writes the outline as a Markdown document, with
+	// the table of contents as a nested list of links and the spine as
+	// a numbered list.
+	OutlineMarkdown OutlineFormat = iota
+	// OutlineJSON writes the outline as a JSON-encoded BookOutline.
+	OutlineJSON
+)
+
+// BookOutline is the structure of a book, as exported by Outline.
+type BookOutline struct {
+	Title string         `json:"title"`
+	TOC   []OutlineEntry `json:"toc"`
+	Spine []SpineEntry   `json:"spine"`
+}
+
+// OutlineEntry is an entry in the table of contents of a BookOutline.
+type OutlineEntry struct {
+	// Label is the entry's label, as it appears in the table of
+	// contents.
+	Label string `json:"label"`
+	// Path is the path in the book the entry points to, which may have
+	// a fragment identifier.
+	Path     string         `json:"path"`
+	Children []OutlineEntry `json:"children,omitempty"`
+}
+
+// SpineEntry is a file in the reading order of a BookOutline.
+type SpineEntry struct {
+	ID   Id     `json:"id"`
+	Path string `json:"path"`
+	// Title is the content of the file's title element, if it has one.
+	Title string `json:"title,omitempty"`
+}
+
+// Outline returns the book's table of contents tree and its reading
+// order, in the given format. Editors and proofreaders can use it to
+// review the book's structure without opening it in a reading system.
+// The table of contents labels are as they'd be written into the book,
+// numbered and shortened as set up with SetChapterNumbering and
+// SetTOCLabelLimit.
+func (e *EPub) Outline(format OutlineFormat) ([]byte, error) {
+	o := e.outline()
+	switch format {
+	case OutlineMarkdown:
+		return []byte(o.markdown()), nil
+	case OutlineJSON:
+		return json.MarshalIndent(o, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown outline format %v", format)
+}
+
+// titleRE matches the title element of an XHTML file.
+var titleRE = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+
+// outline returns the book's outline.
+func (e *EPub) outline() *BookOutline {
+	o := &BookOutline{Title: e.title, TOC: []OutlineEntry{}, Spine: []SpineEntry{}}
+	var walk func(np []*Navpoint) []OutlineEntry
+	walk = func(np []*Navpoint) []OutlineEntry {
+		var entries []OutlineEntry
+		for _, n := range np {
+			label, _ := e.tocLabel(e.navpointLabel(n))
+			entries = append(entries, OutlineEntry{Label: label, Path: n.filename, Children: walk(n.navpoints)})
+		}
+		return entries
+	}
+	if toc := walk(e.navpoints); toc != nil {
+		o.TOC = toc
+	}
+	for _, x := range e.spineOrder() {
+		s := SpineEntry{ID: x.id, Path: x.name}
+		if m := titleRE.FindSubmatch(x.contents); m != nil {
+			s.Title = strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " ")
+		}
+		o.Spine = append(o.Spine, s)
+	}
+	return o
+}
+
+// markdownEscaper escapes the characters that are special in Markdown
+// text.
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`)
+
+// markdown returns the outline as a Markdown document.
+func (o *BookOutline) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n## Table of contents\n\n", markdownEscaper.Replace(o.Title))
+	var walk func(entries []OutlineEntry, depth int)
+	walk = func(entries []OutlineEntry, depth int) {
+		for _, n := range entries {
+			fmt.Fprintf(&b, "%s- [%s](%s)\n", strings.Repeat("  ", depth), markdownEscaper.Replace(n.Label), escapeLink(n.Path))
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(o.TOC, 0)
+	b.WriteString("\n## Reading order\n\n")
+	for i, s := range o.Spine {
+		fmt.Fprintf(&b, "%d. [%s](%s)", i+1, markdownEscaper.Replace(s.Path), escapeLink(s.Path))
+		if s.Title != "" {
+			fmt.Fprintf(&b, " %s", markdownEscaper.Replace(s.Title))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ImportTOC sets the book's table of contents and reading order from
+// a JSON document in the format Outline writes (see BookOutline), so
+// they can be maintained by editors in a file rather than in Go code.
+// The document's title, and the titles of its spine entries, are
+// ignored.
+//
+// The document's table of contents replaces the book's navpoints,
+// if it has one. Labels should be written without the numbers
+// SetChapterNumbering adds, which Outline includes. The spine entries
+// name XHTML files already in the book, by path or ID, in reading
+// order; files the spine doesn't list follow those it does, in their
+// current order. A document with no spine leaves the reading order
+// alone.
+//
+// Unknown fields are errors, to catch misspellings. Nothing is changed
+// if the document has an error.
+func (e *EPub) ImportTOC(r io.Reader) error {
+	var o BookOutline
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&o); err != nil {
+		return fmt.Errorf("unable to parse TOC: %v", err)
+	}
+
+	var navpoints []*Navpoint
+	var walk func(entries []OutlineEntry, add func(label, name string, order int) *Navpoint) error
+	walk = func(entries []OutlineEntry, add func(label, name string, order int) *Navpoint) error {
+		for i, n := range entries {
+			if strings.TrimSpace(n.Label) == "" || n.Path == "" {
+				return fmt.Errorf("TOC entry %q for %q needs a label and a path", n.Label, n.Path)
+			}
+			np := add(n.Label, n.Path, i)
+			if err := walk(n.Children, np.AddNavpoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(o.TOC, func(label, name string, order int) *Navpoint {
+		n := &Navpoint{label: label, filename: name, order: order}
+		navpoints = append(navpoints, n)
+		return n
+	})
+	if err != nil {
+		return err
+	}
+
+	orders := make(map[int]int) // Spine positions, by index in e.xhtml
+	for i, s := range o.Spine {
+		if s.Path == "" && s.ID == "" {
+			return fmt.Errorf("spine entry %v needs a path or an ID", i+1)
+		}
+		found := false
+		for j, x := range e.xhtml {
+			if (s.Path != "" && x.name == s.Path) || (s.ID != "" && x.id == s.ID) {
+				if s.Path != "" && s.ID != "" && (x.name != s.Path || x.id != s.ID) {
+					return fmt.Errorf("spine entry %v is for %v, not %v", s.ID, x.name, s.Path)
+				}
+				if _, ok := orders[j]; ok {
+					return fmt.Errorf("%v is in the spine more than once", x.name)
+				}
+				orders[j] = i
+				found = true
+				break
+			}
+		}
+		if !found {
+			if s.Path != "" {
+				return errorf(ErrNotFound, "no XHTML file %v in the book", s.Path)
+			}
+			return errorf(ErrNotFound, "no XHTML file with id %v in the book", s.ID)
+		}
+	}
+
+	if o.TOC != nil {
+		e.navpoints = navpoints
+	}
+	if o.Spine != nil {
+		// Files keep their place among those the spine doesn't list,
+		// after those it does.
+		rest := len(o.Spine)
+		for _, x := range e.spineOrder() {
+			for j := range e.xhtml {
+				if e.xhtml[j].id != x.id {
+					continue
+				}
+				if i, ok := orders[j]; ok {
+					e.xhtml[j].order = i
+				} else {
+					e.xhtml[j].order = rest
+					rest++
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package epub
+
+// This file holds the code for grouping chapters into parts.
+
+import (
+	"fmt"
+	"html/template"
+)
+
+// Part is a group of chapters, such as "Part One" of a novel. Its
+// chapters are nested under it in the table of contents, and it can
+// have a divider page of its own. Parts are made with AddPart.
+type Part struct {
+	e     *EPub
+	title string
+	np    *Navpoint
+	// The number of the part, counting from 1, for naming its divider
+	// page.
+	num int
+}
+
+// AddPart adds a part to the book, with a top-level navpoint labeled
+// title. Chapters are added to the part with its AddChapter and
+// AddNavpoint methods; the part's navpoint points at its divider page
+// if it has one, or its first chapter otherwise. It's an error to
+// write a book with a part that has neither.
+func (e *EPub) AddPart(title string) *Part {
+	np := e.AddNavpoint(title, "", len(e.navpoints)+1)
+	np.part = true
+	p := &Part{e: e, title: title, np: np, num: len(e.parts) + 1}
+	e.parts = append(e.parts, p)
+	return p
+}
+
+// Title returns the part's title.
+func (p *Part) Title() string {
+	return p.title
+}
+
+// AddChapter adds an XHTML file to the book as a chapter of the part,
+// along with a navpoint labeled label under the part's navpoint. The
+// label is numbered as set by SetChapterNumbering. Chapters appear in
+// the spine in the order they're added, like files added with
+// AddXHTML.
+//
+// Returns the ID of the added file.
+func (p *Part) AddChapter(label, path, contents string) (Id, error) {
+	id, err := p.e.AddXHTML(path, contents)
+	if err != nil {
+		return "", err
+	}
+	p.AddNavpoint(label, path, len(p.np.navpoints)+1).chapter = true
+	return id, nil
+}
+
+// AddNavpoint adds a navpoint under the part's navpoint, for chapters
+// added to the book some other way. The arguments are as for the
+// book's AddNavpoint.
+func (p *Part) AddNavpoint(label, name string, order int) *Navpoint {
+	if p.np.filename == "" {
+		p.np.filename = name
+	}
+	return p.np.AddNavpoint(label, name, order)
+}
+
+// AddDivider generates a divider page showing the part's title, using
+// the book's theme, and adds it to the book. The part's navpoint
+// points at it. The page goes in the spine where it's added, so it
+// should be added before the part's chapters.
+//
+// Returns the ID of the generated page.
+func (p *Part) AddDivider() (Id, error) {
+	t := p.e.pageTheme().PartPage
+	if t == nil {
+		// Themes written before part pages existed.
+		t = partPageTemplate
+	}
+	d := p.e.pageData()
+	d.Heading = p.title
+	x, err := p.e.renderPage(t, p.title, d)
+	if err != nil {
+		return "", err
+	}
+	page := fmt.Sprintf("xhtml/part%02d.xhtml", p.num)
+	id, err := p.e.AddXHTML(page, x)
+	if err != nil {
+		return "", err
+	}
+	p.np.filename = page
+	return id, nil
+}
+
+// validateParts checks that every part has somewhere for its navpoint
+// to point.
+func (e *EPub) validateParts() error {
+	for _, p := range e.parts {
+		if p.np.filename == "" {
+			return fmt.Errorf("part %q has no chapters or divider page", p.title)
+		}
+	}
+	return nil
+}
+
+var partPageTemplate = template.Must(template.New("part").Parse(`<div class="part">
+<h1>{{.Heading}}</h1>
+</div>`))
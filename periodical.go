@@ -0,0 +1,195 @@
+package epub
+
+// This file holds the code for books that are issues of magazines,
+// newspapers, and other periodicals.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PeriodicalKind is the kind of periodical a book is an issue of.
+type PeriodicalKind int
+
+const (
+	PeriodicalMagazine PeriodicalKind = iota
+	PeriodicalNewspaper
+	PeriodicalJournal
+)
+
+var periodicalKinds = []string{"magazine", "newspaper", "journal"}
+
+func (k PeriodicalKind) String() string {
+	if k < 0 || int(k) >= len(periodicalKinds) {
+		return fmt.Sprintf("PeriodicalKind(%d)", int(k))
+	}
+	return periodicalKinds[k]
+}
+
+// Periodical describes the periodical a book is an issue of.
+type Periodical struct {
+	// Title is the periodical's name, such as "The Monthly Review".
+	// The book's own title is normally the issue's, such as "The
+	// Monthly Review, March 2024".
+	Title string
+	Kind  PeriodicalKind
+	// Issue and Volume are the issue and volume numbers, if it has
+	// them.
+	Issue  string
+	Volume string
+	// Frequency is how often the periodical is published, such as
+	// "monthly".
+	Frequency string
+	// ISSN is the periodical's International Standard Serial Number,
+	// such as "0317-8471".
+	ISSN string
+}
+
+var issnRE = regexp.MustCompile(`^\d{4}-\d{3}[\dX]$`)
+
+// SetPeriodical marks the book as an issue of a periodical, for
+// newsstand-style publishing. The periodical's kind and title are
+// written into the package metadata of both v2 and v3 books as a meta
+// element named "calibre:publication_type", the convention Kindle and
+// calibre periodicals use. V3 books also get the title as
+// dcterms:isPartOf, the issue and volume as schema:issueNumber and
+// schema:volumeNumber, the frequency as dcterms:accrualPeriodicity,
+// and the ISSN as schema:issn.
+//
+// Use AddArticle to add the issue's articles to the table of contents.
+func (e *EPub) SetPeriodical(p Periodical) error {
+	if p.Title == "" {
+		return errors.New("periodicals must have a title")
+	}
+	if p.Kind < 0 || int(p.Kind) >= len(periodicalKinds) {
+		return fmt.Errorf("unknown periodical kind %v", p.Kind)
+	}
+	if p.ISSN != "" && !issnRE.MatchString(p.ISSN) {
+		return fmt.Errorf("ISSN %q isn't of the form NNNN-NNNC", p.ISSN)
+	}
+	e.periodical = &p
+	return nil
+}
+
+// Periodical returns the periodical the book is an issue of, and
+// whether it is one.
+func (e *EPub) Periodical() (Periodical, bool) {
+	if e.periodical == nil {
+		return Periodical{}, false
+	}
+	return *e.periodical, true
+}
+
+// periodicalElements returns the periodical metadata for a book of the
+// given version as package metadata elements.
+func (e *EPub) periodicalElements(version float64) []xmlElement {
+	p := e.periodical
+	if p == nil {
+		return nil
+	}
+	ret := []xmlElement{newElement("meta", "", "name", "calibre:publication_type", "content", fmt.Sprintf("periodical:%v:%v", p.Kind, p.Title))}
+	if version < 3 {
+		return ret
+	}
+	add := func(property, value string) {
+		if value != "" {
+			ret = append(ret, newElement("meta", e.plainText(value), "property", property))
+		}
+	}
+	add("dcterms:isPartOf", p.Title)
+	add("schema:volumeNumber", p.Volume)
+	add("schema:issueNumber", p.Issue)
+	add("dcterms:accrualPeriodicity", p.Frequency)
+	add("schema:issn", p.ISSN)
+	return ret
+}
+
+// readPeriodicalMeta copies a meta element written by SetPeriodical
+// into the book, reporting whether it was one.
+func (e *EPub) readPeriodicalMeta(m *xnode) bool {
+	p := e.periodical
+	if p == nil {
+		p = &Periodical{}
+	}
+	value := m.textContent()
+	switch m.attr("property") {
+	case "dcterms:isPartOf":
+		p.Title = value
+	case "schema:volumeNumber":
+		p.Volume = value
+	case "schema:issueNumber":
+		p.Issue = value
+	case "dcterms:accrualPeriodicity":
+		p.Frequency = value
+	case "schema:issn":
+		p.ISSN = value
+	default:
+		parts := strings.SplitN(m.attr("content"), ":", 3)
+		if m.attr("name") != "calibre:publication_type" || len(parts) != 3 || parts[0] != "periodical" {
+			return false
+		}
+		for i, k := range periodicalKinds {
+			if parts[1] == k {
+				p.Kind = PeriodicalKind(i)
+			}
+		}
+		p.Title = parts[2]
+	}
+	e.periodical = p
+	return true
+}
+
+// AddArticle adds a top-level table of contents entry for an article
+// in a periodical, as with AddNavpoint. Byline is the article's
+// byline, such as "By Jane Doe", or empty if it has none.
+//
+// In the NCX, articles are marked with the class "article" and the
+// entries containing them with "section", and bylines are written as
+// mbp:meta elements named "author", as Kindle periodicals expect.
+func (e *EPub) AddArticle(title, byline, name string, order int) *Navpoint {
+	n := e.AddNavpoint(title, name, order)
+	n.article, n.byline = true, byline
+	return n
+}
+
+// AddArticle adds an article entry under a section of a periodical's
+// table of contents, as with EPub.AddArticle.
+func (n *Navpoint) AddArticle(title, byline, name string, order int) *Navpoint {
+	nn := n.AddNavpoint(title, name, order)
+	nn.article, nn.byline = true, byline
+	return nn
+}
+
+// mbpNamespace is the namespace of the NCX's byline elements.
+const mbpNamespace = "http://mobipocket.com/ns/mbp"
+
+// hasBylines reports whether any article in the table of contents has
+// a byline.
+func (e *EPub) hasBylines() bool {
+	var walk func(np []*Navpoint) bool
+	walk = func(np []*Navpoint) bool {
+		for _, n := range np {
+			if n.byline != "" || walk(n.navpoints) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(e.navpoints)
+}
+
+// ncxClass returns the NCX class of n: "article" for articles and
+// "section" for entries containing them.
+func ncxClass(n *Navpoint) string {
+	if n.article {
+		return "article"
+	}
+	for _, c := range n.navpoints {
+		if c.article {
+			return "section"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,151 @@
+package epub
+
+// This file holds plates sections, the pages of captioned
+// illustrations gathered at the back of history and photography
+// books, and the list of illustrations that points to them.
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Plate is an illustration for AddPlates.
+type Plate struct {
+	// Path is the relative path to the image in the book, and
+	// Contents the image itself.
+	Path     string
+	Contents []byte
+	// Alt is the image's alt text. If it's empty the caption is used.
+	Alt string
+	// Caption is the text shown under the image, which also labels its
+	// entry in the list of illustrations.
+	Caption string
+	// Credit is the credit line shown under the caption, such as
+	// "Photograph by Dorothea Lange, Library of Congress". Optional.
+	Credit string
+	// Creator, if not nil, is whoever made the image, who's added to
+	// the book's metadata as a contributor, with their role, such as
+	// "pht" or "ill". People credited for several plates are added
+	// once.
+	Creator *Person
+}
+
+// AddIllustrationTarget adds an entry to the book's list of
+// illustrations. Label describes the illustration, and name is the
+// URI of the point in the book where it is, typically a fragment ID in
+// an XHTML file. The list is written as the v3 nav document's "loi"
+// nav and as a navList in the NCX.
+//
+// Illustrations are listed in the order they were added.
+func (e *EPub) AddIllustrationTarget(label string, name string) {
+	e.illustrations = append(e.illustrations, pageTarget{label: label, filename: name})
+}
+
+// AddPlates adds a plates section to the book: an XHTML page at path
+// with the given heading, showing each plate's image with its caption
+// and credit, in the spine at the given order. The page gets a
+// navpoint labeled with the heading, each plate gets an entry in the
+// list of illustrations (see AddIllustrationTarget), each image gets
+// its alt text (see SetAltText), and the plates' creators are added as
+// contributors.
+//
+// Returns the ID of the page. If a plate has neither alt text nor a
+// caption, or its image can't be added, nothing is added to the book.
+func (e *EPub) AddPlates(path, heading string, order int, plates []Plate) (_ Id, err error) {
+	if len(plates) == 0 {
+		return "", errors.New("plates section has no plates")
+	}
+	if strings.TrimSpace(heading) == "" {
+		return "", errors.New("plates section must have a heading")
+	}
+	for i, p := range plates {
+		if strings.TrimSpace(p.Alt) == "" && strings.TrimSpace(p.Caption) == "" {
+			return "", fmt.Errorf("plate %v (%v) has no alt text or caption", i+1, p.Path)
+		}
+		if p.Creator != nil {
+			if strings.TrimSpace(p.Creator.Name) == "" {
+				return "", fmt.Errorf("plate %v (%v) has a creator with no name", i+1, p.Path)
+			}
+			if p.Creator.Role != "" {
+				if err := checkRole(p.Creator.Role); err != nil {
+					return "", err
+				}
+			}
+			if p.Creator.DisplaySeq < 0 {
+				return "", fmt.Errorf("plate %v (%v) has a creator with invalid display sequence %v", i+1, p.Path, p.Creator.DisplaySeq)
+			}
+		}
+	}
+	n := len(e.images)
+	defer func() {
+		// Don't leave the images of a section that's refused in the book.
+		if err != nil {
+			for _, i := range e.images[n:] {
+				delete(e.imageIndex, i.id)
+			}
+			e.images = e.images[:n]
+		}
+	}()
+	var body strings.Builder
+	var ids []Id
+	for i, p := range plates {
+		id, err := e.AddImage(p.Path, p.Contents)
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+		alt := p.Alt
+		if strings.TrimSpace(alt) == "" {
+			alt = p.Caption
+		}
+		fmt.Fprintf(&body, "<div class=\"plate\" %s>\n<div><img %s %s /></div>\n", attrPair("id", fmt.Sprintf("plate%d", i+1)), attrPair("src", relativeHref(path, p.Path)), attrPair("alt", alt))
+		if p.Caption != "" {
+			fmt.Fprintf(&body, "<p class=\"caption\">%s</p>\n", html.EscapeString(p.Caption))
+		}
+		if p.Credit != "" {
+			fmt.Fprintf(&body, "<p class=\"credit\">%s</p>\n", html.EscapeString(p.Credit))
+		}
+		body.WriteString("</div>\n")
+	}
+	x := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+<title>%[1]s</title>
+</head>
+<body>
+<h1>%[1]s</h1>
+%[2]s</body>
+</html>
+`, html.EscapeString(heading), body.String())
+	page, err := e.AddXHTML(path, x, order)
+	if err != nil {
+		return "", err
+	}
+
+	// The page is in the book, so nothing below can fail.
+	e.AddNavpoint(heading, path, len(e.navpoints)+1)
+	credited := make(map[[2]string]bool) // Creators' names and roles
+	for i, p := range plates {
+		alt := p.Alt
+		if strings.TrimSpace(alt) == "" {
+			alt = p.Caption
+		}
+		e.SetAltText(ids[i], alt)
+		label := p.Caption
+		if label == "" {
+			label = alt
+		}
+		e.AddIllustrationTarget(label, fmt.Sprintf("%v#plate%d", path, i+1))
+		if c := p.Creator; c != nil {
+			key := [2]string{c.Name, c.Role}
+			if !credited[key] {
+				credited[key] = true
+				e.AddContributorPerson(*c)
+			}
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,116 @@
+package epub
+
+// This file holds the option that puts the files needed to show a
+// book's first pages at the front of its archive, for reading systems
+// that stream books.
+
+import (
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SetPreload makes the book's archive start with what's needed to
+// show its first pages: right after the package document, ahead of
+// the table of contents, come the cover image, then the first pages
+// XHTML files in reading order, each followed by the stylesheets,
+// fonts, images, and other files it refers to that haven't come
+// already. Reading systems that stream books with HTTP range
+// requests can then fetch everything for the first pages in a few
+// contiguous reads. The rest of the book follows in the usual order
+// (see zipEntries). The book's reading order isn't affected.
+//
+// Zero, the default, doesn't move anything ahead of the table of
+// contents.
+func (e *EPub) SetPreload(pages int) {
+	e.preload = pages
+}
+
+// preloadRefRE matches the attributes of XHTML elements that refer to
+// the files they need to be shown.
+var preloadRefRE = regexp.MustCompile(`(?i)\s(?:src|href|xlink:href|poster|data)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// preloadEntries moves the entries needed by the first pages of the
+// book, as set with SetPreload, to the front of entries, and returns
+// how many it moved.
+func (e *EPub) preloadEntries(entries []zipEntry) ([]zipEntry, int) {
+	if e.preload <= 0 {
+		return entries, 0
+	}
+	index := make(map[string]int, len(entries))
+	for i, ze := range entries {
+		index[ze.name] = i
+	}
+	pages := make(map[string]bool)
+	for _, x := range e.xhtml {
+		pages[e.zipName(x.id, x.name)] = true
+	}
+
+	var head []zipEntry
+	placed := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		i, ok := index[name]
+		if !ok || placed[name] {
+			return
+		}
+		placed[name] = true
+		ze := entries[i]
+		head = append(head, ze)
+		var refs []string
+		switch {
+		case strings.HasSuffix(strings.ToLower(name), ".css"):
+			refs = cssReferences(ze.contents)
+		case pages[name]:
+			for _, m := range preloadRefRE.FindAllSubmatch(ze.contents, -1) {
+				refs = append(refs, string(m[1])+string(m[2]))
+			}
+		}
+		for _, r := range refs {
+			target, ok := resolveRef(name, r)
+			// Links to other pages don't pull them forward; pages
+			// stay in reading order.
+			if ok && !pages[target] {
+				visit(target)
+			}
+		}
+	}
+
+	if e.coverID != "" {
+		if i, err := e.findImage(e.coverID); err == nil {
+			visit(e.zipName(i.id, i.name))
+		}
+	}
+	for n, x := range e.spineOrder() {
+		if n >= e.preload {
+			break
+		}
+		visit(e.zipName(x.id, x.name))
+	}
+	n := len(head)
+	for _, ze := range entries {
+		if !placed[ze.name] {
+			head = append(head, ze)
+		}
+	}
+	return head, n
+}
+
+// resolveRef returns the zip entry name of the file the reference ref
+// in the entry named from points to, and false if it points outside
+// the book.
+func resolveRef(from, ref string) (string, bool) {
+	ref = strings.TrimSpace(html.UnescapeString(ref))
+	if i := strings.IndexAny(ref, "#?"); i >= 0 {
+		ref = ref[:i]
+	}
+	if ref == "" || urlSchemeRE.MatchString(ref) || strings.HasPrefix(ref, "/") {
+		return "", false
+	}
+	if u, err := url.PathUnescape(ref); err == nil {
+		ref = u
+	}
+	return path.Join(path.Dir(from), ref), true
+}
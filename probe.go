@@ -0,0 +1,179 @@
+package epub
+
+// This file holds the code that reads a book's metadata without
+// loading the rest of it.
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Metadata is the commonly needed metadata of an ePub file, as read
+// by ProbeMetadata.
+type Metadata struct {
+	// Version is the package document's version, such as "2.0" or
+	// "3.0".
+	Version string
+	Title   string
+	// Authors are the creators with the "aut" role, or no role.
+	Authors    []string
+	Languages  []string
+	Publishers []string
+	// Identifier is the book's unique identifier.
+	Identifier  string
+	Description string
+	Subjects    []string
+	Date        string
+	// Series and SeriesIndex are the series the book belongs to and
+	// its place in it, from either a v3 collection or calibre's
+	// series metadata.
+	Series      string
+	SeriesIndex string
+	// Cover is the path of the cover image in the archive, if the book
+	// has one.
+	Cover string
+}
+
+// ProbeMetadata reads the metadata of the named ePub file. Only the
+// archive's directory, its container.xml, and its package document are
+// read, so it's much faster than Open for scanning many books, such as
+// when importing a library.
+func ProbeMetadata(name string) (Metadata, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer z.Close()
+
+	read := func(name string) (*xnode, error) {
+		for _, f := range z.File {
+			if f.Name != name {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			n, err := parseXML(r)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse %v: %v", name, err)
+			}
+			return n, nil
+		}
+		return nil, errorf(ErrUnsupportedFormat, "no %v", name)
+	}
+
+	container, err := read("META-INF/container.xml")
+	if err != nil {
+		return Metadata{}, err
+	}
+	rf := container.find("rootfile")
+	if rf == nil {
+		return Metadata{}, errorf(ErrUnsupportedFormat, "container has no rootfile")
+	}
+	opfName := rf.attr("full-path")
+	pkg, err := read(opfName)
+	if err != nil {
+		return Metadata{}, err
+	}
+	md := pkg.find("metadata")
+	if md == nil {
+		return Metadata{}, errorf(ErrUnsupportedFormat, "%v has no metadata", opfName)
+	}
+	return probeMetadata(pkg, md, opfName), nil
+}
+
+// probeMetadata reads the metadata from a package document.
+func probeMetadata(pkg, md *xnode, opfName string) Metadata {
+	ret := Metadata{Version: pkg.attr("version")}
+	refine := make(map[string][]*xnode)
+	for _, m := range md.elements() {
+		if r := strings.TrimPrefix(m.attr("refines"), "#"); m.name == "meta" && r != "" {
+			refine[r] = append(refine[r], m)
+		}
+	}
+	refined := func(m *xnode, property string) string {
+		for _, r := range refine[m.attr("id")] {
+			if r.attr("property") == property {
+				return r.textContent()
+			}
+		}
+		return ""
+	}
+
+	unique := pkg.attr("unique-identifier")
+	var coverID string
+	for _, m := range md.elements() {
+		value := m.textContent()
+		switch m.name {
+		case "title":
+			if ret.Title == "" {
+				ret.Title = value
+			}
+		case "creator":
+			role := m.attr("role")
+			if r := refined(m, "role"); r != "" {
+				role = r
+			}
+			if role == "" || role == "aut" {
+				ret.Authors = append(ret.Authors, value)
+			}
+		case "language":
+			ret.Languages = append(ret.Languages, value)
+		case "publisher":
+			ret.Publishers = append(ret.Publishers, value)
+		case "identifier":
+			if m.attr("id") == unique || ret.Identifier == "" {
+				ret.Identifier = value
+			}
+		case "description":
+			ret.Description = value
+		case "subject":
+			ret.Subjects = append(ret.Subjects, value)
+		case "date":
+			if ret.Date == "" {
+				ret.Date = value
+			}
+		case "meta":
+			switch {
+			case m.attr("name") == "cover":
+				coverID = m.attr("content")
+			case m.attr("name") == "calibre:series" && ret.Series == "":
+				ret.Series = m.attr("content")
+			case m.attr("name") == "calibre:series_index" && ret.SeriesIndex == "":
+				ret.SeriesIndex = m.attr("content")
+			case m.attr("property") == "belongs-to-collection":
+				if t := refined(m, "collection-type"); t == "series" || t == "" {
+					ret.Series, ret.SeriesIndex = value, refined(m, "group-position")
+				}
+			}
+		}
+	}
+
+	// v3 books mark the cover in the manifest, which takes precedence
+	// over the v2 cover meta element.
+	var cover, v2Cover *xnode
+	for _, item := range pkg.findAll("item") {
+		switch {
+		case cover == nil && strings.Contains(" "+item.attr("properties")+" ", " cover-image "):
+			cover = item
+		case v2Cover == nil && coverID != "" && item.attr("id") == coverID:
+			v2Cover = item
+		}
+	}
+	if cover == nil {
+		cover = v2Cover
+	}
+	if cover != nil {
+		href := cover.attr("href")
+		if u, err := url.Parse(href); err == nil {
+			href = u.Path
+		}
+		ret.Cover = path.Join(path.Dir(opfName), href)
+	}
+	return ret
+}
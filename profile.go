@@ -0,0 +1,219 @@
+package epub
+
+// This file holds the code that controls which flavour of XHTML the
+// book's content documents are written as.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// ContentProfile is the flavour of XHTML a content document is written
+// as. ePub 2 content documents are XHTML 1.1, while ePub 3 ones are
+// XHTML5, the XML syntax of HTML5; files that are fine for one
+// generally aren't for the other.
+type ContentProfile int
+
+const (
+	// ProfileAuto writes XHTML5 in v3 books. In v2 books files are
+	// written as they were given, DOCTYPE and all, apart from losing
+	// srcset attributes, which XHTML 1.1 doesn't have. This is the
+	// default.
+	ProfileAuto ContentProfile = iota
+	// ProfileXHTML11 writes XHTML 1.1.
+	ProfileXHTML11
+	// ProfileXHTML5 writes XHTML5.
+	ProfileXHTML5
+)
+
+func (p ContentProfile) String() string {
+	switch p {
+	case ProfileAuto:
+		return "auto"
+	case ProfileXHTML11:
+		return "XHTML 1.1"
+	case ProfileXHTML5:
+		return "XHTML5"
+	}
+	return fmt.Sprintf("ContentProfile(%d)", int(p))
+}
+
+// SetContentProfile sets the flavour of XHTML the book's content
+// documents are written as. When the book is written each XHTML file's
+// DOCTYPE is rewritten to match its profile, XHTML5 files that use
+// epub: attributes get the namespace declared, XHTML 1.1 files lose
+// the srcset attributes XHTML 1.1 doesn't have, and language attributes
+// are added in the form the profile wants. Pages this package
+// generates, such as title pages, are made in the book's profile too,
+// and Warnings reports files whose profile doesn't suit the book's
+// version or that use markup their profile doesn't have.
+//
+// The default, ProfileAuto, picks the profile from the version the
+// book is written as, though in v2 books files are left as they are
+// rather than rewritten as XHTML 1.1; set ProfileXHTML11 explicitly
+// to have them rewritten. SetFileContentProfile overrides the profile
+// for single files.
+func (e *EPub) SetContentProfile(p ContentProfile) {
+	e.contentProfile = p
+}
+
+// SetFileContentProfile sets the flavour of XHTML a single XHTML file
+// is written as, overriding the book's profile as set with
+// SetContentProfile. Setting it to ProfileAuto makes the file follow
+// the book again.
+func (e *EPub) SetFileContentProfile(id Id, p ContentProfile) error {
+	x, err := e.findXHTML(id)
+	if err != nil {
+		return err
+	}
+	x.profile = p
+	return nil
+}
+
+// bookProfile returns the profile of the book's content documents
+// when it's written in the given version.
+func (e *EPub) bookProfile(version float64) ContentProfile {
+	switch {
+	case e.contentProfile != ProfileAuto:
+		return e.contentProfile
+	case version >= 3:
+		return ProfileXHTML5
+	}
+	return ProfileXHTML11
+}
+
+// fileProfile returns the profile x is written as in a book of the
+// given version.
+func (e *EPub) fileProfile(x xhtml, version float64) ContentProfile {
+	if x.profile != ProfileAuto {
+		return x.profile
+	}
+	return e.bookProfile(version)
+}
+
+// fixesDoctype reports whether x's DOCTYPE is rewritten to suit its
+// profile in a book of the given version. V2 books pass their files
+// through unless a profile's been asked for, as they did before there
+// were profiles.
+func (e *EPub) fixesDoctype(x xhtml, version float64) bool {
+	return version >= 3 || x.profile != ProfileAuto || e.contentProfile != ProfileAuto
+}
+
+const (
+	xhtml11Doctype = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">`
+	opsNamespace   = "http://www.idpf.org/2007/ops"
+)
+
+var (
+	// html5DoctypeRE matches an XHTML5 DOCTYPE.
+	html5DoctypeRE = regexp.MustCompile(`(?i)<!DOCTYPE\s+html\s*>`)
+	// epubAttrRE matches an attribute in the epub: namespace.
+	epubAttrRE = regexp.MustCompile(`\sepub:[\w-]+\s*=`)
+	// epubNamespaceRE matches a declaration of the epub: namespace.
+	epubNamespaceRE = regexp.MustCompile(`\sxmlns:epub\s*=`)
+	// srcsetRE matches a srcset attribute, which XHTML 1.1 doesn't
+	// have.
+	srcsetRE = regexp.MustCompile(`\ssrcset\s*=\s*(?:"[^"]*"|'[^']*')`)
+	// html5ElementRE matches elements that are new in HTML5, and so
+	// not part of XHTML 1.1.
+	html5ElementRE = regexp.MustCompile(`<(article|aside|audio|figcaption|figure|footer|header|main|mark|nav|section|video)\b`)
+)
+
+// usesEPUBAttrs reports whether XHTML contents have attributes in the
+// epub: namespace.
+func usesEPUBAttrs(c []byte) bool {
+	return bytes.Contains(c, []byte("epub:")) && epubAttrRE.Match(c)
+}
+
+// stripSrcset removes the srcset attributes from XHTML contents,
+// leaving images' src.
+func stripSrcset(c []byte) []byte {
+	if !bytes.Contains(c, []byte("srcset")) {
+		return c
+	}
+	return srcsetRE.ReplaceAll(c, nil)
+}
+
+// fixDoctype rewrites the DOCTYPE of XHTML contents to suit the given
+// profile. For XHTML 1.1 it removes srcset attributes, leaving images'
+// src, and for XHTML5 declares the epub: namespace if it's used but
+// not declared.
+func fixDoctype(c []byte, p ContentProfile) []byte {
+	switch p {
+	case ProfileXHTML11:
+		c = stripSrcset(c)
+		return html5DoctypeRE.ReplaceAll(c, []byte(xhtml11Doctype))
+	case ProfileXHTML5:
+		c = fixV2XHTML(c)
+		// Check the html start tag before scanning the whole file, and
+		// only use the regexp on files that might have epub: attributes.
+		loc := htmlStartRE.FindIndex(c)
+		if loc == nil || epubNamespaceRE.Match(c[loc[0]:loc[1]]) || !usesEPUBAttrs(c) {
+			return c
+		}
+		attr := " " + attrPair("xmlns:epub", opsNamespace)
+		end := loc[1] - 1
+		ret := make([]byte, 0, len(c)+len(attr))
+		ret = append(ret, c[:end]...)
+		ret = append(ret, attr...)
+		return append(ret, c[end:]...)
+	}
+	return c
+}
+
+// profileWarnings returns warnings for content documents whose profile
+// doesn't suit the version the book targets, or that use markup their
+// profile doesn't have.
+func (e *EPub) profileWarnings() []string {
+	var warnings []string
+	for _, x := range e.xhtml {
+		p := e.fileProfile(x, e.version)
+		switch {
+		case e.version < 3 && p == ProfileXHTML5:
+			warnings = append(warnings, fmt.Sprintf("%v is written as XHTML5, which ePub 2 reading systems may not support", x.name))
+		case e.version >= 3 && p == ProfileXHTML11:
+			warnings = append(warnings, fmt.Sprintf("%v is written as XHTML 1.1, which isn't valid in ePub 3", x.name))
+		}
+		if p != ProfileXHTML11 {
+			continue
+		}
+		if m := html5ElementRE.FindSubmatch(x.contents); m != nil {
+			warnings = append(warnings, fmt.Sprintf("%v uses the %s element, which XHTML 1.1 doesn't have", x.name, m[1]))
+		}
+		if usesEPUBAttrs(x.contents) {
+			warnings = append(warnings, fmt.Sprintf("%v uses epub: attributes, which XHTML 1.1 doesn't have", x.name))
+		}
+	}
+	return warnings
+}
+
+// profilePage wraps body in a complete XHTML document of the given
+// profile with the given title. Stylesheets are hrefs of CSS files to
+// link in.
+func profilePage(p ContentProfile, title, body string, stylesheets ...string) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	if p == ProfileXHTML5 {
+		fmt.Fprintf(&b, "<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"%s\">\n", opsNamespace)
+	} else {
+		b.WriteString(xhtml11Doctype + "\n<html xmlns=\"http://www.w3.org/1999/xhtml\">\n")
+	}
+	fmt.Fprintf(&b, "<head>\n<title>%s</title>\n", html.EscapeString(title))
+	for _, s := range stylesheets {
+		fmt.Fprintf(&b, "<link rel=\"stylesheet\" type=\"text/css\" %s />\n", attrPair("href", s))
+	}
+	fmt.Fprintf(&b, "</head>\n<body>\n%s\n</body>\n</html>\n", body)
+	return b.String()
+}
+
+// XHTMLPage wraps body, which is XHTML body content, in a complete
+// XHTML document with the given title, with the DOCTYPE and namespace
+// declarations of the book's content profile for the version it's set
+// to. Stylesheets are hrefs of CSS files to link in. The result is
+// ready to pass to AddXHTML.
+func (e *EPub) XHTMLPage(title, body string, stylesheets ...string) string {
+	return profilePage(e.bookProfile(e.version), title, body, stylesheets...)
+}
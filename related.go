@@ -0,0 +1,190 @@
+package epub
+
+// This file holds the links from the book to related resources
+// elsewhere, such as where to buy it or the next book in its series,
+// and the "Also by" page generated from an author's catalog.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Relations for AddLink. They're absolute IRIs, so they need no
+// prefix declaration, and aren't tied to any one store.
+const (
+	// RelAcquisition links to where the book can be bought or
+	// borrowed.
+	RelAcquisition = "http://opds-spec.org/acquisition"
+	// RelPreview links to a preview of the book, such as a sample or a
+	// trailer.
+	RelPreview = "http://opds-spec.org/acquisition/sample"
+	// RelAuthor links to the author's site.
+	RelAuthor = "http://schema.org/author"
+	// RelNext links to the next book in the series.
+	RelNext = "http://www.w3.org/1999/xhtml/vocab#next"
+)
+
+// packageLinkRels are the link relations the EPUB 3 package document
+// defines, which can be used without a prefix.
+var packageLinkRels = map[string]bool{
+	"alternate": true, "marc21xml-record": true, "mods-record": true, "onix-record": true,
+	"record": true, "voicing": true, "xml-signature": true, "xmp-record": true,
+}
+
+type relatedLink struct {
+	rel, href, mediaType string
+	id                   Id // The linked resource, if it's in the book
+}
+
+// AddLink adds a link to a resource related to the book, outside it,
+// such as where to buy it (RelAcquisition), a preview or trailer
+// (RelPreview), the author's site (RelAuthor), or the next book in the
+// series (RelNext). Rel may also be any other relation the EPUB 3
+// package document allows: an absolute IRI, a prefixed name, or one of
+// the relations it defines, such as "record". Href must be an absolute
+// URL, and mediaType is the media type of what it points at, such as
+// "video/mp4" for a trailer, or empty if it's a web page.
+//
+// Links are written as link elements in the package metadata of v3
+// books only.
+func (e *EPub) AddLink(rel, href, mediaType string) error {
+	for _, r := range strings.Fields(rel) {
+		if !strings.Contains(r, ":") && !packageLinkRels[r] {
+			return fmt.Errorf("link relation %q needs a prefix or must be an IRI", r)
+		}
+	}
+	if strings.TrimSpace(rel) == "" {
+		return errors.New("links must have a relation")
+	}
+	if u, err := url.Parse(href); err != nil || !u.IsAbs() {
+		return fmt.Errorf("link href %q isn't an absolute URL", href)
+	}
+	e.links = append(e.links, relatedLink{rel: strings.Join(strings.Fields(rel), " "), href: href, mediaType: mediaType})
+	return nil
+}
+
+// linkElements returns the book's related links as v3 package metadata
+// elements.
+func (e *EPub) linkElements() []xmlElement {
+	var ret []xmlElement
+	for _, l := range e.links {
+		href := l.href
+		if m, err := e.findMedia(l.id); l.id != "" && err == nil {
+			href = e.manifestHref(m.id, m.name)
+		}
+		x := newElement("link", "", "rel", l.rel, "href", href)
+		if l.mediaType != "" {
+			x.Attrs = append(x.Attrs, xmlAttr("media-type", l.mediaType))
+		}
+		ret = append(ret, x)
+	}
+	return ret
+}
+
+// CatalogEntry is a book in an author's catalog, for AddAlsoByPage.
+type CatalogEntry struct {
+	Title string
+	// Series is the series the book is in, if any, and Position its
+	// place in it, such as "2".
+	Series   string
+	Position string
+	// Href is a link to the book, such as its page on the author's
+	// site or a store, or empty.
+	Href string
+}
+
+// CatalogSeries is a series of books in an author's catalog, as
+// passed to a theme's AlsoByPage template. Books in no series are
+// grouped in one with no name.
+type CatalogSeries struct {
+	Name    string
+	Entries []CatalogEntry
+}
+
+// alsoByPath is where AddAlsoByPage puts the page.
+const alsoByPath = "xhtml/alsoby.xhtml"
+
+// AddAlsoByPage generates an "Also by" page listing an author's other
+// books, using the book's theme, and adds it to the book with the
+// given spine order. It's conventionally back matter, so order should
+// normally put it at the end of the book.
+//
+// The catalog's books are grouped by series, in the order the series
+// first appear, with the books in no series last. Books in a series
+// are listed by position, and the others in the order given. The book
+// itself is left out, if it's in the catalog.
+//
+// Returns the ID of the generated page.
+func (e *EPub) AddAlsoByPage(author string, catalog []CatalogEntry, order int) (Id, error) {
+	d := e.pageData()
+	d.Heading = "Also by " + author
+	var standalone []CatalogEntry
+	index := make(map[string]int)
+	for _, c := range catalog {
+		if c.Title == "" {
+			return "", errors.New("catalog entries must have a title")
+		}
+		if strings.EqualFold(strings.TrimSpace(c.Title), strings.TrimSpace(e.title)) {
+			continue
+		}
+		if c.Series == "" {
+			standalone = append(standalone, c)
+			continue
+		}
+		i, ok := index[c.Series]
+		if !ok {
+			i = len(d.AlsoBy)
+			index[c.Series] = i
+			d.AlsoBy = append(d.AlsoBy, CatalogSeries{Name: c.Series})
+		}
+		d.AlsoBy[i].Entries = append(d.AlsoBy[i].Entries, c)
+	}
+	for _, s := range d.AlsoBy {
+		sort.SliceStable(s.Entries, func(i, j int) bool {
+			return positionLess(s.Entries[i].Position, s.Entries[j].Position)
+		})
+	}
+	if len(standalone) > 0 {
+		d.AlsoBy = append(d.AlsoBy, CatalogSeries{Entries: standalone})
+	}
+	if len(d.AlsoBy) == 0 {
+		return "", errors.New("the catalog has no other books")
+	}
+	t := e.pageTheme().AlsoByPage
+	if t == nil {
+		// Themes written before "Also by" pages existed.
+		t = alsoByTemplate
+	}
+	x, err := e.renderPage(t, d.Heading, d)
+	if err != nil {
+		return "", err
+	}
+	return e.AddXHTML(alsoByPath, x, order)
+}
+
+// positionLess reports whether the series position a comes before b.
+// Numeric positions are compared as numbers and come before others.
+func positionLess(a, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return fa < fb
+	case errA == nil || errB == nil:
+		return errA == nil
+	}
+	return a < b
+}
+
+var alsoByTemplate = template.Must(template.New("alsoby").Parse(`<div class="alsoby">
+<h1>{{.Heading}}</h1>
+{{range .AlsoBy}}{{if .Name}}<h2>{{.Name}}</h2>
+{{end}}<ul>
+{{range .Entries}}<li>{{if .Href}}<a href="{{.Href}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}</li>
+{{end}}</ul>
+{{end}}</div>`))
@@ -0,0 +1,399 @@
+package epub
+
+// This file holds the checks for resources the book's XHTML and CSS
+// load from the web, and the code that downloads them into the book.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// remoteURLRE matches URLs of resources on the web.
+	remoteURLRE = regexp.MustCompile(`(?i)^(?:https?:)?//`)
+	// resourceTagRE matches the start tags of XHTML elements that load
+	// resources. Group 1 is the element name and group 2 its
+	// attributes.
+	resourceTagRE = regexp.MustCompile(`(?is)<((?:\w+:)?(?:img|image|input|audio|video|source|track|iframe|embed|object|script|link))\b([^>]*)>`)
+	// resourceAttrRE matches the attributes of those elements that
+	// hold the resources' URLs.
+	resourceAttrRE = regexp.MustCompile(`(?i)\s((?:xlink:)?href|src|srcset|poster|data)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	// stylesheetRelRE matches the rel attribute of links to
+	// stylesheets.
+	stylesheetRelRE = regexp.MustCompile(`(?i)\srel\s*=\s*["'][^"']*\bstylesheet\b`)
+)
+
+// remoteRef is a reference from a file in the book to a resource on
+// the web.
+type remoteRef struct {
+	raw string // The URL as written in the file
+	url string // The URL, unescaped
+	// What the resource is: "image", "stylesheet", "script", "audio",
+	// "video", "font", or "" if it's something else.
+	kind string
+}
+
+// allowed reports whether the resource can be remote. EPUB only lets
+// audio, video, and fonts be left outside the book.
+func (r remoteRef) allowed() bool {
+	return r.kind == "audio" || r.kind == "video" || r.kind == "font"
+}
+
+// remoteKind returns the kind of remote resource the URL u points at,
+// going by its extension, or def if the extension doesn't say.
+func remoteKind(u, def string) string {
+	p := u
+	if pu, err := url.Parse(u); err == nil {
+		p = pu.Path
+	}
+	mt, _, ok := LookupMediaType(p)
+	switch {
+	case !ok:
+		return def
+	case strings.HasPrefix(mt, "image/"):
+		return "image"
+	case strings.HasPrefix(mt, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mt, "video/"):
+		return "video"
+	case strings.HasPrefix(mt, "font/"), mt == "application/opentype":
+		return "font"
+	case mt == "text/css":
+		return "stylesheet"
+	}
+	return def
+}
+
+// cssRemoteRefs returns the references to remote resources in the CSS
+// c, from @import rules and url() values.
+func cssRemoteRefs(c []byte) []remoteRef {
+	// Remote URLs all have "//", and the regexps are slow to scan large
+	// files with, so they're only used on files that might match.
+	if !bytes.Contains(c, []byte("//")) {
+		return nil
+	}
+	if bytes.Contains(c, []byte("/*")) {
+		c = cssCommentRE.ReplaceAll(c, nil)
+	}
+	var refs []remoteRef
+	for _, re := range []*regexp.Regexp{cssImportRE, cssURLRE} {
+		def := "image"
+		if re == cssImportRE {
+			if !containsFold(c, "@import") {
+				continue
+			}
+			def = "stylesheet"
+		} else if !containsFold(c, "url(") {
+			continue
+		}
+		for _, m := range re.FindAllSubmatch(c, -1) {
+			raw := string(m[1]) + string(m[2])
+			if len(m) > 3 {
+				raw += string(m[3])
+			}
+			raw = strings.TrimSpace(raw)
+			if remoteURLRE.MatchString(raw) {
+				refs = append(refs, remoteRef{raw: raw, url: raw, kind: remoteKind(raw, def)})
+			}
+		}
+	}
+	return refs
+}
+
+// containsFold reports whether b contains the ASCII string s, ignoring
+// case.
+func containsFold(b []byte, s string) bool {
+	first := string([]byte{s[0], s[0] | 0x20, s[0] &^ 0x20})
+	for i := 0; i+len(s) <= len(b); i++ {
+		j := bytes.IndexAny(b[i:len(b)-len(s)+1], first)
+		if j < 0 {
+			return false
+		}
+		i += j
+		if bytes.EqualFold(b[i:i+len(s)], []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// xhtmlRemoteRefs returns the references to remote resources in the
+// XHTML contents c: the resources its elements load, and those in its
+// CSS. Links to web pages aren't included.
+func xhtmlRemoteRefs(c []byte) []remoteRef {
+	if !bytes.Contains(c, []byte("//")) {
+		return nil
+	}
+	var refs []remoteRef
+	for _, tag := range resourceTagRE.FindAllSubmatch(c, -1) {
+		elem := strings.ToLower(string(tag[1]))
+		if i := strings.IndexByte(elem, ':'); i >= 0 {
+			elem = elem[i+1:]
+		}
+		if elem == "link" && !stylesheetRelRE.Match(tag[2]) {
+			continue
+		}
+		for _, a := range resourceAttrRE.FindAllSubmatch(tag[2], -1) {
+			attr := strings.ToLower(string(a[1]))
+			var raws []string
+			if attr == "srcset" {
+				for _, cand := range strings.Split(string(a[2])+string(a[3]), ",") {
+					if f := strings.Fields(cand); len(f) > 0 {
+						raws = append(raws, f[0])
+					}
+				}
+			} else {
+				raws = []string{string(a[2]) + string(a[3])}
+			}
+			for _, raw := range raws {
+				u := strings.TrimSpace(html.UnescapeString(raw))
+				if !remoteURLRE.MatchString(u) {
+					continue
+				}
+				var kind string
+				switch {
+				case elem == "img" || elem == "image" || elem == "input" || attr == "poster":
+					kind = "image"
+				case elem == "audio" || elem == "video":
+					kind = elem
+				case elem == "script":
+					kind = "script"
+				case elem == "link":
+					kind = "stylesheet"
+				case elem == "source":
+					kind = remoteKind(u, "")
+				}
+				refs = append(refs, remoteRef{raw: raw, url: u, kind: kind})
+			}
+		}
+	}
+	return append(refs, cssRemoteRefs(c)...)
+}
+
+// xhtmlRemoteRefs returns the references to remote resources in x as
+// it's written in a book of the given version.
+func (e *EPub) xhtmlRemoteRefs(x xhtml, version float64) []remoteRef {
+	return e.cachedRefs(preparedKey{x.id, version}, func() []remoteRef {
+		return xhtmlRemoteRefs(e.prepareXHTML(x, version))
+	})
+}
+
+// styleRemoteRefs returns the references to remote resources in the
+// stylesheet s as it's written.
+func (e *EPub) styleRemoteRefs(s style) []remoteRef {
+	return e.cachedRefs(preparedKey{s.id, 0}, func() []remoteRef {
+		return cssRemoteRefs(e.styleContents(s))
+	})
+}
+
+// cachedRefs returns the references to remote resources cached under
+// k while the book is written, finding them with find if they aren't.
+func (e *EPub) cachedRefs(k preparedKey, find func() []remoteRef) []remoteRef {
+	if e.prepared == nil {
+		return find()
+	}
+	refs, ok := e.prepared.refs[k]
+	if !ok {
+		refs = find()
+		e.prepared.refs[k] = refs
+	}
+	return refs
+}
+
+// hasAllowedRemote reports whether any of refs is a remote resource
+// EPUB allows, which needs the remote-resources manifest property.
+func hasAllowedRemote(refs []remoteRef) bool {
+	for _, r := range refs {
+		if r.allowed() {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteResourceErrors returns an error for each reference in the
+// book's XHTML files and stylesheets to a remote resource that EPUB
+// requires to be in the book.
+func (e *EPub) remoteResourceErrors() []error {
+	var errs []error
+	report := func(name string, refs []remoteRef) {
+		for _, r := range refs {
+			if r.allowed() {
+				continue
+			}
+			what := r.kind
+			if what == "" {
+				what = "resource"
+			}
+			errs = append(errs, errorf(ErrRemoteResource, "%v loads the %v %q from the web; it must be in the book (see LocalizeRemoteResources)", name, what, r.url))
+		}
+	}
+	for _, x := range e.spineOrder() {
+		report(x.name, e.xhtmlRemoteRefs(x, e.version))
+	}
+	for _, s := range e.styles {
+		report(s.name, e.styleRemoteRefs(s))
+	}
+	return errs
+}
+
+// remoteWarnings returns warnings for the remote resources the book
+// loads that must be in it.
+func (e *EPub) remoteWarnings() []string {
+	var warnings []string
+	for _, err := range e.remoteResourceErrors() {
+		warnings = append(warnings, err.Error())
+	}
+	return warnings
+}
+
+// localizedExts are the kinds of remote resource
+// LocalizeRemoteResources downloads, and the extension each is given
+// if its URL has none. Images are recognized by their contents.
+var localizedExts = map[string]string{"image": "", "stylesheet": ".css", "script": ".js"}
+
+// LocalizeRemoteResources downloads the images, stylesheets, and
+// scripts the book's XHTML files and stylesheets load from the web,
+// adds them to the book under "remote/", and points the references
+// to them at the copies, so the book works offline and meets EPUB's
+// requirement that they be in the book. Stylesheets are handled after
+// they're downloaded too, so the images they use are downloaded as
+// well. Audio, video, and fonts, which EPUB lets stay on the web, are
+// left alone, as are other remote resources, such as iframes, which
+// Warnings still reports.
+//
+// Fetch is called with each URL, once, and returns the resource's
+// contents; it's given "https:" URLs for protocol-relative references.
+// A simple fetch is
+//
+//	func(u string) ([]byte, error) {
+//		resp, err := http.Get(u)
+//		if err != nil {
+//			return nil, err
+//		}
+//		defer resp.Body.Close()
+//		if resp.StatusCode != http.StatusOK {
+//			return nil, fmt.Errorf("%v: %v", u, resp.Status)
+//		}
+//		return io.ReadAll(resp.Body)
+//	}
+//
+// Returns the IDs of the added resources. If fetching or adding a
+// resource fails, the error is a *ResourceError, and the resources
+// added before it stay in the book.
+func (e *EPub) LocalizeRemoteResources(fetch func(url string) ([]byte, error)) ([]Id, error) {
+	var ids []Id
+	local := make(map[string]string) // Book paths of downloaded URLs
+	localize := func(from string, refs []remoteRef) (map[string]string, error) {
+		hrefs := make(map[string]string)
+		for _, r := range refs {
+			ext, ok := localizedExts[r.kind]
+			if !ok {
+				continue
+			}
+			name, ok := local[r.url]
+			if !ok {
+				u := r.url
+				if strings.HasPrefix(u, "//") {
+					u = "https:" + u
+				}
+				contents, err := fetch(u)
+				if err != nil {
+					return nil, &ResourceError{Op: "fetch", Path: u, Err: err}
+				}
+				name = e.remotePath(u, ext)
+				var id Id
+				switch r.kind {
+				case "image":
+					id, err = e.AddImage(name, contents)
+				case "stylesheet":
+					id, err = e.AddStylesheet(name, string(contents))
+				case "script":
+					id, err = e.AddJavaScript(name, string(contents))
+				}
+				if err != nil {
+					return nil, &ResourceError{Op: "add", Path: u, Err: err}
+				}
+				ids = append(ids, id)
+				local[r.url] = name
+			}
+			hrefs[r.raw] = relativeHref(from, name)
+		}
+		return hrefs, nil
+	}
+	for i := range e.xhtml {
+		x := &e.xhtml[i]
+		hrefs, err := localize(x.name, xhtmlRemoteRefs(x.contents))
+		if err != nil {
+			return ids, err
+		}
+		c := resourceTagRE.ReplaceAllFunc(x.contents, func(tag []byte) []byte {
+			return resourceAttrRE.ReplaceAllFunc(tag, func(attr []byte) []byte {
+				return replaceRefs(attr, hrefs)
+			})
+		})
+		x.contents = replaceCSSRefs(c, hrefs)
+	}
+	// Downloaded stylesheets are added to e.styles, so they're
+	// localized in turn.
+	for i := 0; i < len(e.styles); i++ {
+		name, c := e.styles[i].name, e.styles[i].contents
+		hrefs, err := localize(name, cssRemoteRefs(c))
+		if err != nil {
+			return ids, err
+		}
+		e.styles[i].contents = replaceCSSRefs(c, hrefs)
+	}
+	return ids, nil
+}
+
+// replaceCSSRefs replaces the URLs in the @import rules and url()
+// values of the CSS in c with their new hrefs.
+func replaceCSSRefs(c []byte, hrefs map[string]string) []byte {
+	if len(hrefs) == 0 {
+		return c
+	}
+	for _, re := range []*regexp.Regexp{cssImportRE, cssURLRE} {
+		c = re.ReplaceAllFunc(c, func(ref []byte) []byte {
+			return replaceRefs(ref, hrefs)
+		})
+	}
+	return c
+}
+
+// replaceRefs replaces the URLs in b, a reference taken from a file,
+// with their new hrefs.
+func replaceRefs(b []byte, hrefs map[string]string) []byte {
+	for raw, href := range hrefs {
+		b = bytes.ReplaceAll(b, []byte(raw), []byte(href))
+	}
+	return b
+}
+
+// remotePath returns the path in the book for a copy of the resource
+// at the URL u: its file name under "remote/", with the extension ext
+// if it has none, numbered if another file already has the name.
+func (e *EPub) remotePath(u, ext string) string {
+	base := "resource"
+	if pu, err := url.Parse(u); err == nil && path.Base(pu.Path) != "." && path.Base(pu.Path) != "/" {
+		base = path.Base(pu.Path)
+	}
+	if path.Ext(base) == "" {
+		base += ext
+	}
+	taken := make(map[string]bool)
+	e.eachFile(func(name string, _ []byte) {
+		taken[name] = true
+	})
+	name := "remote/" + base
+	ext = path.Ext(base)
+	for n := 2; taken[name]; n++ {
+		name = fmt.Sprintf("remote/%v-%d%v", strings.TrimSuffix(base, ext), n, ext)
+	}
+	return name
+}
@@ -0,0 +1,109 @@
+package epub
+
+// This file holds the API for rendering the files this package
+// generates without building the whole book.
+
+import (
+	"bytes"
+	"strings"
+)
+
+// RenderPackageDocument returns the book's package document (the OPF
+// file) for the book's version, exactly as it would be written into
+// the book, without building the rest of the book. This is useful for
+// tests and for tools that only need to check the metadata.
+//
+// Unlike Serialize, RenderPackageDocument doesn't validate the book
+// first.
+func (e *EPub) RenderPackageDocument() ([]byte, error) {
+	var b bytes.Buffer
+	var err error
+	switch e.version {
+	case 2:
+		err = e.writeContent(&b)
+	case 3, 3.3:
+		err = e.writeRenditionV3(&b)
+	default:
+		err = errorf(ErrUnsupportedVersion, "Unable to create epub version %v files", e.version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// RenderNCX returns the book's NCX table of contents (toc.ncx), as it
+// would be written into the book. The NCX is rendered even if the
+// book wouldn't include one; see SetNCX.
+func (e *EPub) RenderNCX() ([]byte, error) {
+	var b bytes.Buffer
+	if err := e.writeToc(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// RenderNav returns the book's v3 navigation document, as it would be
+// written into a v3 book. The nav document is rendered even for v2
+// books, which don't include one.
+func (e *EPub) RenderNav() ([]byte, error) {
+	var b bytes.Buffer
+	if err := e.writeTocV3(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ManifestItem is an entry in the book's manifest.
+type ManifestItem struct {
+	ID        Id
+	Href      string // Relative to the package document
+	MediaType string
+	// Properties are the item's v3 properties, such as "nav" or
+	// "cover-image".
+	Properties []string
+	// Fallback is the ID of the item's fallback, if any.
+	Fallback Id
+	// Encryption is how the item is encrypted or obfuscated, as listed
+	// in META-INF/encryption.xml, or nil if it isn't.
+	Encryption *Encryption
+}
+
+// ManifestPlan is the manifest and spine of the book's package
+// document.
+type ManifestPlan struct {
+	Items []ManifestItem
+	// Spine holds the IDs of the spine's itemrefs, in reading order.
+	Spine []Id
+}
+
+// ManifestPreview returns the manifest items and spine itemrefs the
+// book's package document would have if the book were written now in
+// its version, including the generated nav document and NCX, without
+// building the book. Like RenderPackageDocument it doesn't validate
+// the book first.
+func (e *EPub) ManifestPreview() (*ManifestPlan, error) {
+	var m opfManifest
+	var s opfSpine
+	switch e.version {
+	case 2:
+		m, s = e.v2Manifest(), e.spine(2)
+	case 3, 3.3:
+		m, s = e.v3Manifest(), e.spine(3)
+	default:
+		return nil, errorf(ErrUnsupportedVersion, "Unable to create epub version %v files", e.version)
+	}
+	p := &ManifestPlan{}
+	enc := e.encryptedResources()
+	for _, i := range m.Items {
+		item := ManifestItem{ID: i.ID, Href: i.Href, MediaType: i.MediaType, Properties: strings.Fields(i.Properties), Fallback: i.Fallback}
+		if x, ok := enc[i.ID]; ok {
+			item.Encryption = &x
+		}
+		p.Items = append(p.Items, item)
+	}
+	for _, r := range s.Itemrefs {
+		p.Spine = append(p.Spine, r.IDRef)
+	}
+	return p, nil
+}
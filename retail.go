@@ -0,0 +1,373 @@
+package epub
+
+// This file holds the code that adjusts books for retailers' ingestion
+// pipelines.
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Retailer identifies a retail channel with its own ingestion
+// requirements, for SerializeFor and WriteFor.
+type Retailer int
+
+const (
+	RetailerKindle Retailer = iota
+	RetailerGooglePlay
+	RetailerKobo
+)
+
+// retailProfile holds a retailer's documented ingestion quirks.
+type retailProfile struct {
+	name string
+	// If true the book always gets an NCX and a guide, with a
+	// bodymatter ("text") entry if the book doesn't have one.
+	ncx bool
+	// If true the v2 cover meta element is written in v3 books too.
+	coverMeta bool
+	// If true scripts are stripped from the book.
+	stripScripts bool
+	// If true embedded audio and video are reported as ignored.
+	noMedia bool
+	// CSS declarations the retailer doesn't support, if any.
+	unsupportedCSS *regexp.Regexp
+	// Cover requirements. Covers should be in one of coverFormats and
+	// at least minCover pixels on the short side and minCoverLong on
+	// the long side; idealWidth and idealHeight are the recommended
+	// size. If coverRatio isn't zero it's the recommended ratio of the
+	// long side to the short side.
+	coverFormats []string
+	minCover     int
+	minCoverLong int
+	idealWidth   int
+	idealHeight  int
+	coverRatio   float64
+	// If true the retailer matches files to titles by ISBN.
+	wantISBN bool
+	// Where DRM is controlled. No retailer reads DRM flags from the
+	// file; it's chosen when the book is uploaded, and uploaded files
+	// must not be encrypted.
+	drm string
+}
+
+var retailProfiles = map[Retailer]*retailProfile{
+	RetailerKindle: {
+		name:           "Kindle",
+		ncx:            true,
+		coverMeta:      true,
+		stripScripts:   true,
+		noMedia:        true,
+		unsupportedCSS: kindleCSSRE,
+		coverFormats:   []string{"jpeg"},
+		minCover:       625,
+		minCoverLong:   1000,
+		idealWidth:     1600,
+		idealHeight:    2560,
+		coverRatio:     1.6,
+		drm:            "DRM is chosen in the KDP bookshelf when the book is published",
+	},
+	RetailerGooglePlay: {
+		name:         "Google Play Books",
+		coverFormats: []string{"jpeg", "png"},
+		minCover:     640,
+		minCoverLong: 640,
+		idealWidth:   1600,
+		idealHeight:  2560,
+		wantISBN:     true,
+		drm:          "DRM is chosen per book in the Google Play Partner Center",
+	},
+	RetailerKobo: {
+		name:         "Kobo",
+		ncx:          true,
+		coverFormats: []string{"jpeg", "png"},
+		minCover:     1000,
+		minCoverLong: 1400,
+		idealWidth:   1600,
+		idealHeight:  2400,
+		coverRatio:   1.5,
+		drm:          "DRM is chosen per book in Kobo Writing Life",
+	},
+}
+
+var (
+	// cssBlockRE matches the innermost declaration blocks of a
+	// stylesheet. Group 1 is the block's declarations.
+	cssBlockRE = regexp.MustCompile(`\{([^{}]*)\}`)
+	// kindleCSSRE matches CSS declarations that Kindle's rendering
+	// engines don't support. Positioning is only a problem when it's
+	// fixed.
+	kindleCSSRE = regexp.MustCompile(`(?i)^\s*(?:-webkit-|-moz-)?(?:(?:transform|transition|animation|filter|columns|column-count|column-gap)[a-z-]*\s*:|position\s*:\s*fixed\b)`)
+)
+
+// removeCSS removes the declarations matching re from the stylesheet
+// css, and returns the result along with the removed declarations.
+func removeCSS(css []byte, re *regexp.Regexp) ([]byte, []string) {
+	var removed []string
+	ret := cssBlockRE.ReplaceAllFunc(css, func(block []byte) []byte {
+		decls := strings.Split(string(block[1:len(block)-1]), ";")
+		var kept []string
+		for i, d := range decls {
+			switch {
+			case !re.MatchString(d):
+				kept = append(kept, d)
+			case i == len(decls)-1:
+				// Keep the whitespace before the closing brace.
+				removed = append(removed, strings.TrimSpace(d))
+				kept = append(kept, d[len(strings.TrimRight(d, " \t\r\n")):])
+			default:
+				removed = append(removed, strings.TrimSpace(d))
+			}
+		}
+		return []byte("{" + strings.Join(kept, ";") + "}")
+	})
+	return ret, removed
+}
+
+// SerializeFor returns the book serialized for ingestion by the given
+// retailer, along with notes describing what was changed and what the
+// retailer will ignore or may reject. The book itself isn't modified,
+// so one book can be exported to each channel in turn.
+//
+// Every profile checks the cover image against the retailer's size,
+// aspect ratio, and format guidelines. Beyond that:
+//   - Kindle: see SerializeForKindle.
+//   - Google Play Books: notes when the book has no ISBN identifier,
+//     since Google matches files to titles by ISBN (or the GGKEY it
+//     assigns).
+//   - Kobo: always has an NCX and guide, which older Kobo devices use
+//     for navigation.
+//
+// No retailer reads DRM settings from the file; the notes say where
+// each one is set.
+func (e *EPub) SerializeFor(r Retailer) ([]byte, []string, error) {
+	p, ok := retailProfiles[r]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown retailer %v", r)
+	}
+	v, notes := e.retailVariant(p)
+	buf, err := v.Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, notes, nil
+}
+
+// WriteFor writes the book, adjusted for the given retailer as
+// described for SerializeFor, to the named file. It returns the notes
+// describing what was changed and what the retailer will ignore.
+func (e *EPub) WriteFor(r Retailer, name string) ([]string, error) {
+	buf, notes, err := e.SerializeFor(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(name, buf, 0666); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// SerializeForKindle returns the book serialized for ingestion by
+// Kindle Previewer and the Kindle Direct Publishing pipeline, along
+// with notes describing what was changed and what Kindle will ignore.
+// The conversion to Amazon's own formats is still done by Amazon's
+// tools; this just produces the ePub they handle best. The book itself
+// isn't modified. It's the same as SerializeFor(RetailerKindle).
+//
+// The Kindle variant of the book:
+//   - always has an NCX and a guide, which Kindle uses for navigation
+//     and for the location it opens the book at;
+//   - gets a "text" guide entry pointing at the first untagged spine
+//     file if no file was tagged with LandmarkBodyMatter;
+//   - declares its cover with the v2 cover meta element, which Kindle
+//     requires even in v3 books;
+//   - has CSS transforms, transitions, animations, filters, columns,
+//     and fixed positioning removed from its stylesheets;
+//   - has its scripts stripped, as with SetStripScripts.
+func (e *EPub) SerializeForKindle() ([]byte, []string, error) {
+	return e.SerializeFor(RetailerKindle)
+}
+
+// WriteForKindle writes the Kindle variant of the book, as described
+// for SerializeForKindle, to the named file. It returns the notes
+// describing what was changed and what Kindle will ignore.
+func (e *EPub) WriteForKindle(name string) ([]string, error) {
+	return e.WriteFor(RetailerKindle, name)
+}
+
+// SetTargetRetailers declares the retailers the book will be uploaded
+// to. Warnings then checks the cover image against each retailer's
+// guidelines: its format, its minimum size, its aspect ratio, and the
+// recommended resolution. Stores reject uploads with bad covers, so
+// it's cheap insurance to check at build time.
+func (e *EPub) SetTargetRetailers(rs ...Retailer) error {
+	for _, r := range rs {
+		if _, ok := retailProfiles[r]; !ok {
+			return fmt.Errorf("unknown retailer %v", r)
+		}
+	}
+	e.retailers = append([]Retailer(nil), rs...)
+	return nil
+}
+
+// retailWarnings returns warnings about ways the book doesn't meet
+// its target retailers' cover guidelines.
+func (e *EPub) retailWarnings() []string {
+	var warnings []string
+	for _, r := range e.retailers {
+		p := retailProfiles[r]
+		notes := e.coverNotes(p)
+		warnings = append(warnings, notes...)
+		if len(notes) > 0 || e.coverID == "" {
+			continue
+		}
+		// The cover is acceptable; check it's as sharp as the retailer
+		// would like.
+		info, err := e.ImageInfo(e.coverID)
+		if err != nil {
+			continue
+		}
+		long := info.Width
+		if info.Height > long {
+			long = info.Height
+		}
+		if long < p.idealHeight {
+			warnings = append(warnings, fmt.Sprintf("the cover image is %vx%v; %v recommends at least %v pixels on the long edge (ideally %vx%v)", info.Width, info.Height, p.name, p.idealHeight, p.idealWidth, p.idealHeight))
+		}
+	}
+	return warnings
+}
+
+// retailVariant returns a copy of the book adjusted for a retailer,
+// and notes about the adjustments. The copy shares unmodified
+// contents with the original.
+func (e *EPub) retailVariant(p *retailProfile) (*EPub, []string) {
+	v := *e
+	var notes []string
+
+	if p.ncx {
+		ncx := true
+		v.ncx = &ncx
+		v.landmarks = append([]landmark(nil), e.landmarks...)
+		tagged := make(map[Id]bool)
+		hasText, hasTOC := false, false
+		for _, l := range e.landmarks {
+			tagged[l.id] = true
+			hasText = hasText || l.kind == LandmarkBodyMatter
+			hasTOC = hasTOC || l.kind == LandmarkTOC
+		}
+		if !hasText {
+			for _, x := range e.spineOrder() {
+				if !tagged[x.id] {
+					v.landmarks = append(v.landmarks, landmark{kind: LandmarkBodyMatter, id: x.id, title: landmarkInfo[LandmarkBodyMatter].title})
+					notes = append(notes, fmt.Sprintf("%v will open the book at %v; tag the start of the text with LandmarkBodyMatter to change this", p.name, x.name))
+					break
+				}
+			}
+		}
+		if !hasTOC {
+			notes = append(notes, fmt.Sprintf("no inline table of contents is tagged with LandmarkTOC; %v recommends one", p.name))
+		}
+	}
+	v.coverMeta = v.coverMeta || p.coverMeta
+
+	notes = append(notes, e.coverNotes(p)...)
+	if p.wantISBN && !e.hasISBN() {
+		notes = append(notes, fmt.Sprintf("the book has no ISBN identifier; %v matches files to titles by ISBN (see AddIdentifier)", p.name))
+	}
+
+	if p.unsupportedCSS != nil {
+		v.styles = make([]style, len(e.styles))
+		for i, s := range e.styles {
+			v.styles[i] = s
+			c, removed := removeCSS(s.contents, p.unsupportedCSS)
+			if len(removed) > 0 {
+				v.styles[i].contents = c
+				notes = append(notes, fmt.Sprintf("removed CSS %v doesn't support from %v: %v", p.name, s.name, strings.Join(removed, "; ")))
+			}
+		}
+	}
+
+	if p.stripScripts && len(e.scripts) > 0 && !e.stripScripts {
+		v.stripScripts = true
+		notes = append(notes, fmt.Sprintf("removed scripts; %v doesn't run JavaScript", p.name))
+	}
+	if p.noMedia {
+		for _, m := range e.media {
+			if strings.HasPrefix(m.mediaType, "audio/") || strings.HasPrefix(m.mediaType, "video/") {
+				notes = append(notes, fmt.Sprintf("%v doesn't play embedded audio or video; %v will be ignored", p.name, m.name))
+			}
+		}
+	}
+	if p.drm != "" {
+		notes = append(notes, p.drm)
+	}
+	return &v, notes
+}
+
+// coverNotes returns notes about ways the book's cover doesn't meet a
+// retailer's guidelines.
+func (e *EPub) coverNotes(p *retailProfile) []string {
+	if e.coverID == "" {
+		return []string{fmt.Sprintf("the book has no cover image; %v requires one (see SetCoverImage)", p.name)}
+	}
+	info, err := e.ImageInfo(e.coverID)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to check the cover image: %v", err)}
+	}
+	var notes []string
+	formatOK := false
+	for _, f := range p.coverFormats {
+		formatOK = formatOK || info.Format == f
+	}
+	if !formatOK {
+		notes = append(notes, fmt.Sprintf("the cover image is %v; %v wants %v covers", info.Format, p.name, strings.ToUpper(strings.Join(p.coverFormats, " or "))))
+	}
+	short, long := info.Width, info.Height
+	if short > long {
+		short, long = long, short
+	}
+	if short < p.minCover || long < p.minCoverLong {
+		notes = append(notes, fmt.Sprintf("the cover image is %vx%v; %v requires at least %vx%v and recommends %vx%v", info.Width, info.Height, p.name, p.minCover, p.minCoverLong, p.idealWidth, p.idealHeight))
+	}
+	if r := float64(long) / float64(short); p.coverRatio != 0 && math.Abs(r-p.coverRatio) > coverRatioTolerance*p.coverRatio {
+		notes = append(notes, fmt.Sprintf("the cover image's aspect ratio is 1:%.2f; %v recommends 1:%v", r, p.name, p.coverRatio))
+	}
+	return notes
+}
+
+// coverRatioTolerance is how far, as a fraction, a cover's aspect
+// ratio can be from a retailer's recommended one before it's noted.
+const coverRatioTolerance = 0.1
+
+// hasISBN reports whether the book has an ISBN identifier.
+func (e *EPub) hasISBN() bool {
+	for _, m := range e.metadata {
+		if m.kind != "dc:identifier" {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(m.value), "urn:isbn:") {
+			return true
+		}
+		for _, p := range m.pairs {
+			if p.key == "scheme" && strings.EqualFold(p.value, "ISBN") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spineOrder returns the book's XHTML files in spine order, without
+// reordering the book itself.
+func (e *EPub) spineOrder() []xhtml {
+	x := append([]xhtml(nil), e.xhtml...)
+	sort.Slice(x, func(i, j int) bool {
+		return x[i].order < x[j].order || (x[i].order == x[j].order && x[i].baseOrder < x[j].baseOrder)
+	})
+	return x
+}
@@ -0,0 +1,154 @@
+package epub
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSerializeForKindle(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	cover, err := e.AddImage("images/cover.png", testPNG(t, 100, 160))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetCoverImage(cover)
+	e.AddStylesheet("css/main.css", "p { margin: 0; transform: rotate(5deg); position: fixed }\nh1 { position: relative; -webkit-transition-duration: 1s; }\n")
+	e.AddJavaScript("js/a.js", "alert(1);")
+
+	book, notes, err := e.SerializeForKindle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf := zipFile(t, book, "OPS/book.opf")
+	for _, want := range []string{`<meta name="cover" content="` + string(cover) + `" />`, `spine toc="ncx"`, `<reference type="text" title="Start of Content" href="a.xhtml" />`} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("Kindle package doesn't contain %q:\n%s", want, opf)
+		}
+	}
+	if strings.Contains(opf, "js/a.js") {
+		t.Errorf("Kindle package still has scripts:\n%s", opf)
+	}
+	zipFile(t, book, "OPS/toc.ncx")
+	css := zipFile(t, book, "OPS/css/main.css")
+	if want := "p { margin: 0; }\nh1 { position: relative; }\n"; css != want {
+		t.Errorf("Kindle CSS = %q, want %q", css, want)
+	}
+
+	all := strings.Join(notes, "\n")
+	for _, want := range []string{"a.xhtml", "JPEG", "100x160", "transform: rotate(5deg)", "JavaScript"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Kindle notes don't mention %q:\n%s", want, all)
+		}
+	}
+
+	// The book itself is untouched.
+	plain, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, plain, "OPS/book.opf"); strings.Contains(opf, `name="cover"`) || strings.Contains(opf, "<guide>") {
+		t.Errorf("Kindle adjustments leaked into the book:\n%s", opf)
+	}
+
+	name := t.TempDir() + "/kindle.epub"
+	written, err := e.WriteForKindle(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, notes) {
+		t.Errorf("WriteForKindle notes = %q, want %q", written, notes)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opf := zipFile(t, b, "OPS/book.opf"); !strings.Contains(opf, `<meta name="cover" content="`+string(cover)+`" />`) {
+		t.Errorf("written Kindle package has no cover meta:\n%s", opf)
+	}
+}
+
+func TestWriteFor(t *testing.T) {
+	e := simpleBook(t)
+	e.SetVersion(3)
+	cover, err := e.AddImage("images/cover.png", testPNG(t, 1100, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetCoverImage(cover)
+
+	_, notes, err := e.SerializeFor(RetailerGooglePlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := strings.Join(notes, "\n"); !strings.Contains(all, "ISBN") || strings.Contains(all, "1100x1500") || !strings.Contains(all, "Partner Center") {
+		t.Errorf("unexpected Google Play notes:\n%s", all)
+	}
+	e.AddIdentifier("urn:isbn:9780000000002", "")
+	if _, notes, _ = e.SerializeFor(RetailerGooglePlay); strings.Contains(strings.Join(notes, "\n"), "ISBN") {
+		t.Errorf("Google Play notes complain about the ISBN when there is one:\n%s", strings.Join(notes, "\n"))
+	}
+
+	book, notes, err := e.SerializeFor(RetailerKobo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := strings.Join(notes, "\n"); strings.Contains(all, "cover image is") {
+		t.Errorf("Kobo notes complain about a good cover:\n%s", all)
+	}
+	zipFile(t, book, "OPS/toc.ncx")
+
+	if _, err := e.WriteFor(Retailer(99), t.TempDir()+"/book.epub"); err == nil {
+		t.Errorf("WriteFor accepted an unknown retailer")
+	}
+}
+
+func TestSetTargetRetailers(t *testing.T) {
+	e := simpleBook(t)
+	if err := e.SetTargetRetailers(RetailerKobo, Retailer(99)); err == nil {
+		t.Errorf("SetTargetRetailers accepted an unknown retailer")
+	}
+	if len(e.Warnings()) != 0 {
+		t.Errorf("Warnings() = %v with no target retailers", e.Warnings())
+	}
+	if err := e.SetTargetRetailers(RetailerKindle, RetailerKobo); err != nil {
+		t.Fatal(err)
+	}
+	if w := strings.Join(e.Warnings(), "\n"); !strings.Contains(w, "no cover image; Kindle") || !strings.Contains(w, "no cover image; Kobo") {
+		t.Errorf("Warnings don't note the missing cover:\n%s", w)
+	}
+
+	for _, c := range []struct {
+		w, h int
+		want []string
+		bad  []string
+	}{
+		// Too small for both, and square.
+		{500, 500, []string{"Kindle requires at least 625x1000", "Kobo requires", "1:1.00; Kindle recommends 1:1.6", "Kobo recommends 1:1.5"}, nil},
+		// Big enough for Kobo but below the recommended resolution.
+		{1000, 1500, []string{"Kobo recommends at least 2400 pixels on the long edge"}, []string{"requires", "aspect ratio"}},
+		// Ideal for Kobo, but not for Kindle.
+		{1600, 2400, []string{"Kindle recommends at least 2560 pixels"}, []string{"Kobo", "aspect ratio"}},
+	} {
+		e := simpleBook(t)
+		cover, err := e.AddImage("images/cover.jpg", testJPEG(t, c.w, c.h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.SetCoverImage(cover)
+		e.SetTargetRetailers(RetailerKindle, RetailerKobo)
+		w := strings.Join(e.Warnings(), "\n")
+		for _, want := range c.want {
+			if !strings.Contains(w, want) {
+				t.Errorf("%vx%v cover warnings don't mention %q:\n%s", c.w, c.h, want, w)
+			}
+		}
+		for _, bad := range c.bad {
+			if strings.Contains(w, bad) {
+				t.Errorf("%vx%v cover warnings mention %q:\n%s", c.w, c.h, bad, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package epub
+
+// This file holds the code for recording a book's revision history.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"regexp"
+)
+
+// Revision is an entry in a book's revision history.
+type Revision struct {
+	// Version is the edition's version, such as "1.1".
+	Version string
+	// Date is the date of the revision, as YYYY, YYYY-MM, or
+	// YYYY-MM-DD.
+	Date string
+	// Notes describes what changed.
+	Notes string
+}
+
+var revisionDateRE = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// AddRevision adds an entry to the book's revision history, so
+// updated editions can be told apart from the file itself. Revisions
+// should be added oldest first.
+//
+// Each revision is written into the package metadata as a meta
+// element named "revision", with content like "1.1 (2024-03-01):
+// Fixed typos", in both v2 and v3 books. Use AddVersionHistoryPage to
+// also show the history to readers.
+func (e *EPub) AddRevision(version, date, notes string) error {
+	if version == "" {
+		return errors.New("revisions must have a version")
+	}
+	if !revisionDateRE.MatchString(date) {
+		return fmt.Errorf("revision date %q isn't of the form YYYY, YYYY-MM, or YYYY-MM-DD", date)
+	}
+	for _, r := range e.revisions {
+		if r.Version == version {
+			return fmt.Errorf("revision %v already added", version)
+		}
+	}
+	e.revisions = append(e.revisions, Revision{Version: version, Date: date, Notes: notes})
+	return nil
+}
+
+// Revisions returns the book's revision history, oldest first.
+func (e *EPub) Revisions() []Revision {
+	return append([]Revision(nil), e.revisions...)
+}
+
+// revisionElements returns the revision history as package metadata
+// elements.
+func (e *EPub) revisionElements() []xmlElement {
+	var ret []xmlElement
+	for _, r := range e.revisions {
+		c := fmt.Sprintf("%v (%v)", r.Version, r.Date)
+		if r.Notes != "" {
+			c += ": " + r.Notes
+		}
+		ret = append(ret, newElement("meta", "", "name", "revision", "content", c))
+	}
+	return ret
+}
+
+// AddVersionHistoryPage generates a "Version history" page listing
+// the revisions added with AddRevision, newest first, using the
+// book's theme, and adds it to the book with the given spine order.
+// It's intended as back matter, so order should normally put it at
+// the end of the book. The revisions should be added before this is
+// called.
+//
+// Returns the ID of the generated page.
+func (e *EPub) AddVersionHistoryPage(order int) (Id, error) {
+	if len(e.revisions) == 0 {
+		return "", errors.New("the book has no revisions")
+	}
+	t := e.pageTheme().VersionHistoryPage
+	if t == nil {
+		// Themes written before version history pages existed.
+		t = versionHistoryTemplate
+	}
+	d := e.pageData()
+	for i := len(e.revisions) - 1; i >= 0; i-- {
+		d.Revisions = append(d.Revisions, e.revisions[i])
+	}
+	x, err := e.renderPage(t, "Version History", d)
+	if err != nil {
+		return "", err
+	}
+	return e.AddXHTML("xhtml/history.xhtml", x, order)
+}
+
+var versionHistoryTemplate = template.Must(template.New("history").Parse(`<div class="history">
+<h1>Version History</h1>
+<dl>
+{{range .Revisions}}<dt>{{.Version}} ({{.Date}})</dt>
+{{if .Notes}}<dd>{{.Notes}}</dd>
+{{end}}{{end}}</dl>
+</div>`))
@@ -0,0 +1,371 @@
+package epub
+
+// This file holds the MARC relator codes used for creator and
+// contributor roles.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidRoles returns the MARC relator codes that can be used as
+// creator and contributor roles, sorted.
+func ValidRoles() []string {
+	roles := make([]string, 0, len(validRoles))
+	for r := range validRoles {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// RoleDescription returns the MARC relator term for a role code, such
+// as "Author" for "aut". The boolean is false if the code isn't a
+// valid role.
+func RoleDescription(code string) (string, bool) {
+	d, ok := validRoles[code]
+	return d, ok
+}
+
+// checkRole returns an error if role isn't a valid MARC relator code.
+// The error suggests codes the caller might have meant.
+func checkRole(role string) error {
+	if _, ok := validRoles[role]; ok {
+		return nil
+	}
+	s := roleSuggestions(role)
+	if len(s) == 0 {
+		return errorf(ErrInvalidRole, "invalid role %q", role)
+	}
+	for i, c := range s {
+		s[i] = fmt.Sprintf("%q (%v)", c, validRoles[c])
+	}
+	return errorf(ErrInvalidRole, "invalid role %q; did you mean %v?", role, strings.Join(s, " or "))
+}
+
+// roleSuggestions returns up to three valid role codes that role might
+// have been meant as. The best guesses are codes that differ only in
+// case, codes that role starts with ("auth" for "aut"), and codes
+// whose description role names ("illustrator" for "ill"); failing
+// those, codes whose description starts with role, and then codes that
+// are one letter off.
+func roleSuggestions(role string) []string {
+	r := strings.ToLower(strings.TrimSpace(role))
+	if r == "" {
+		return nil
+	}
+	codes := ValidRoles()
+	var ret []string
+	for _, c := range codes {
+		if c == r || (len(r) > 3 && c == r[:3]) || strings.ToLower(validRoles[c]) == r {
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) == 0 && len(r) >= 3 {
+		for _, c := range codes {
+			if strings.HasPrefix(strings.ToLower(validRoles[c]), r) {
+				ret = append(ret, c)
+			}
+		}
+	}
+	if len(ret) == 0 {
+		for _, c := range codes {
+			if oneLetterOff(c, r) {
+				ret = append(ret, c)
+			}
+		}
+	}
+	if len(ret) > 3 {
+		ret = ret[:3]
+	}
+	return ret
+}
+
+// oneLetterOff reports whether two strings of the same length differ
+// in exactly one position.
+func oneLetterOff(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	diff := 0
+	for i := range a {
+		if a[i] != b[i] {
+			diff++
+		}
+	}
+	return diff == 1
+}
+
+// validRoles maps the valid roles to their descriptions, from
+// http://www.loc.gov/marc/relators/relaterm.html
+var validRoles = map[string]string{
+	"abr": "Abridger",
+	"act": "Actor",
+	"adp": "Adapter",
+	"rcp": "Addressee",
+	"anl": "Analyst",
+	"anm": "Animator",
+	"ann": "Annotator",
+	"apl": "Appellant",
+	"ape": "Appellee",
+	"app": "Applicant",
+	"arc": "Architect",
+	"arr": "Arranger",
+	"acp": "Art copyist",
+	"adi": "Art director",
+	"art": "Artist",
+	"ard": "Artistic director",
+	"asg": "Assignee",
+	"asn": "Associated name",
+	"att": "Attributed name",
+	"auc": "Auctioneer",
+	"aut": "Author",
+	"aqt": "Author in quotations or text abstracts",
+	"aft": "Author of afterword, colophon, etc.",
+	"aud": "Author of dialog",
+	"aui": "Author of introduction, etc.",
+	"ato": "Autographer",
+	"ant": "Bibliographic antecedent",
+	"bnd": "Binder",
+	"bdd": "Binding designer",
+	"blw": "Blurb writer",
+	"bkd": "Book designer",
+	"bkp": "Book producer",
+	"bjd": "Bookjacket designer",
+	"bpd": "Bookplate designer",
+	"bsl": "Bookseller",
+	"brl": "Braille embosser",
+	"brd": "Broadcaster",
+	"cll": "Calligrapher",
+	"ctg": "Cartographer",
+	"cas": "Caster",
+	"cns": "Censor",
+	"chr": "Choreographer",
+	"cng": "Cinematographer",
+	"cli": "Client",
+	"cor": "Collection registrar",
+	"col": "Collector",
+	"clt": "Collotyper",
+	"clr": "Colorist",
+	"cmm": "Commentator",
+	"cwt": "Commentator for written text",
+	"com": "Compiler",
+	"cpl": "Complainant",
+	"cpt": "Complainant-appellant",
+	"cpe": "Complainant-appellee",
+	"cmp": "Composer",
+	"cmt": "Compositor",
+	"ccp": "Conceptor",
+	"cnd": "Conductor",
+	"con": "Conservator",
+	"csl": "Consultant",
+	"csp": "Consultant to a project",
+	"cos": "Contestant",
+	"cot": "Contestant-appellant",
+	"coe": "Contestant-appellee",
+	"cts": "Contestee",
+	"ctt": "Contestee-appellant",
+	"cte": "Contestee-appellee",
+	"ctr": "Contractor",
+	"ctb": "Contributor",
+	"cpc": "Copyright claimant",
+	"cph": "Copyright holder",
+	"crr": "Corrector",
+	"crp": "Correspondent",
+	"cst": "Costume designer",
+	"cou": "Court governed",
+	"crt": "Court reporter",
+	"cov": "Cover designer",
+	"cre": "Creator",
+	"cur": "Curator",
+	"dnc": "Dancer",
+	"dtc": "Data contributor",
+	"dtm": "Data manager",
+	"dte": "Dedicatee",
+	"dto": "Dedicator",
+	"dfd": "Defendant",
+	"dft": "Defendant-appellant",
+	"dfe": "Defendant-appellee",
+	"dgg": "Degree granting institution",
+	"dgs": "Degree supervisor",
+	"dln": "Delineator",
+	"dpc": "Depicted",
+	"dpt": "Depositor",
+	"dsr": "Designer",
+	"drt": "Director",
+	"dis": "Dissertant",
+	"dbp": "Distribution place",
+	"dst": "Distributor",
+	"dnr": "Donor",
+	"drm": "Draftsman",
+	"dub": "Dubious author",
+	"edt": "Editor",
+	"edc": "Editor of compilation",
+	"edm": "Editor of moving image work",
+	"elg": "Electrician",
+	"elt": "Electrotyper",
+	"enj": "Enacting jurisdiction",
+	"eng": "Engineer",
+	"egr": "Engraver",
+	"etr": "Etcher",
+	"evp": "Event place",
+	"exp": "Expert",
+	"fac": "Facsimilist",
+	"fld": "Field director",
+	"fmd": "Film director",
+	"fds": "Film distributor",
+	"flm": "Film editor",
+	"fmp": "Film producer",
+	"fmk": "Filmmaker",
+	"fpy": "First party",
+	"frg": "Forger",
+	"fmo": "Former owner",
+	"fnd": "Funder",
+	"gis": "Geographic information specialist",
+	"hnr": "Honoree",
+	"hst": "Host",
+	"his": "Host institution",
+	"ilu": "Illuminator",
+	"ill": "Illustrator",
+	"ins": "Inscriber",
+	"itr": "Instrumentalist",
+	"ive": "Interviewee",
+	"ivr": "Interviewer",
+	"inv": "Inventor",
+	"isb": "Issuing body",
+	"jud": "Judge",
+	"jug": "Jurisdiction governed",
+	"lbr": "Laboratory",
+	"ldr": "Laboratory director",
+	"lsa": "Landscape architect",
+	"led": "Lead",
+	"len": "Lender",
+	"lil": "Libelant",
+	"lit": "Libelant-appellant",
+	"lie": "Libelant-appellee",
+	"lel": "Libelee",
+	"let": "Libelee-appellant",
+	"lee": "Libelee-appellee",
+	"lbt": "Librettist",
+	"lse": "Licensee",
+	"lso": "Licensor",
+	"lgd": "Lighting designer",
+	"ltg": "Lithographer",
+	"lyr": "Lyricist",
+	"mfp": "Manufacture place",
+	"mfr": "Manufacturer",
+	"mrb": "Marbler",
+	"mrk": "Markup editor",
+	"med": "Medium",
+	"mdc": "Metadata contact",
+	"mte": "Metal-engraver",
+	"mtk": "Minute taker",
+	"mod": "Moderator",
+	"mon": "Monitor",
+	"mcp": "Music copyist",
+	"msd": "Musical director",
+	"mus": "Musician",
+	"nrt": "Narrator",
+	"osp": "Onscreen presenter",
+	"opn": "Opponent",
+	"orm": "Organizer",
+	"org": "Originator",
+	"oth": "Other",
+	"own": "Owner",
+	"pan": "Panelist",
+	"ppm": "Papermaker",
+	"pta": "Patent applicant",
+	"pth": "Patent holder",
+	"pat": "Patron",
+	"prf": "Performer",
+	"pma": "Permitting agency",
+	"pht": "Photographer",
+	"ptf": "Plaintiff",
+	"ptt": "Plaintiff-appellant",
+	"pte": "Plaintiff-appellee",
+	"plt": "Platemaker",
+	"pra": "Praeses",
+	"pre": "Presenter",
+	"prt": "Printer",
+	"pop": "Printer of plates",
+	"prm": "Printmaker",
+	"prc": "Process contact",
+	"pro": "Producer",
+	"prn": "Production company",
+	"prs": "Production designer",
+	"pmn": "Production manager",
+	"prd": "Production personnel",
+	"prp": "Production place",
+	"prg": "Programmer",
+	"pdr": "Project director",
+	"pfr": "Proofreader",
+	"prv": "Provider",
+	"pup": "Publication place",
+	"pbl": "Publisher",
+	"pbd": "Publishing director",
+	"ppt": "Puppeteer",
+	"rdd": "Radio director",
+	"rpc": "Radio producer",
+	"rce": "Recording engineer",
+	"rcd": "Recordist",
+	"red": "Redaktor",
+	"ren": "Renderer",
+	"rpt": "Reporter",
+	"rps": "Repository",
+	"rth": "Research team head",
+	"rtm": "Research team member",
+	"res": "Researcher",
+	"rsp": "Respondent",
+	"rst": "Respondent-appellant",
+	"rse": "Respondent-appellee",
+	"rpy": "Responsible party",
+	"rsg": "Restager",
+	"rsr": "Restorationist",
+	"rev": "Reviewer",
+	"rbr": "Rubricator",
+	"sce": "Scenarist",
+	"sad": "Scientific advisor",
+	"aus": "Screenwriter",
+	"scr": "Scribe",
+	"scl": "Sculptor",
+	"spy": "Second party",
+	"sec": "Secretary",
+	"sll": "Seller",
+	"std": "Set designer",
+	"stg": "Setting",
+	"sgn": "Signer",
+	"sng": "Singer",
+	"sds": "Sound designer",
+	"spk": "Speaker",
+	"spn": "Sponsor",
+	"sgd": "Stage director",
+	"stm": "Stage manager",
+	"stn": "Standards body",
+	"str": "Stereotyper",
+	"stl": "Storyteller",
+	"sht": "Supporting host",
+	"srv": "Surveyor",
+	"tch": "Teacher",
+	"tcd": "Technical director",
+	"tld": "Television director",
+	"tlp": "Television producer",
+	"ths": "Thesis advisor",
+	"trc": "Transcriber",
+	"trl": "Translator",
+	"tyd": "Type designer",
+	"tyg": "Typographer",
+	"uvp": "University place",
+	"vdg": "Videographer",
+	"vac": "Voice actor",
+	"wit": "Witness",
+	"wde": "Wood engraver",
+	"wdc": "Woodcutter",
+	"wam": "Writer of accompanying material",
+	"wac": "Writer of added commentary",
+	"wal": "Writer of added lyrics",
+	"wat": "Writer of added text",
+	"win": "Writer of introduction",
+	"wpr": "Writer of preface",
+	"wst": "Writer of supplementary textual content",
+}
@@ -0,0 +1,171 @@
+package epub
+
+// This file holds the sanitizer for XHTML from untrusted sources.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// SanitizePolicy is an allow-list describing the XHTML that survives
+// sanitizing. Elements that aren't allowed are removed but their
+// contents are kept, except for the elements in Drop, which are
+// removed along with everything inside them. Attributes that aren't
+// allowed are removed.
+type SanitizePolicy struct {
+	// Elements maps the allowed elements to the attributes allowed on
+	// them, in addition to GlobalAttributes.
+	Elements map[string][]string
+	// GlobalAttributes are allowed on every allowed element.
+	GlobalAttributes []string
+	// Drop lists the elements that are removed with their contents.
+	Drop []string
+	// URLSchemes lists the schemes allowed in URL attributes (href,
+	// src, and cite). Relative URLs are always allowed; URLs with any
+	// other scheme are removed.
+	URLSchemes []string
+}
+
+// DefaultSanitizePolicy returns a policy that allows common text
+// markup, links, images, and tables, without scripts, styles,
+// embedded content, forms, or SVG and MathML. Links may be relative
+// or use http, https, or mailto. The returned policy can be modified
+// freely.
+func DefaultSanitizePolicy() *SanitizePolicy {
+	p := &SanitizePolicy{
+		Elements: map[string][]string{
+			"a":          {"href"},
+			"img":        {"src", "alt", "width", "height"},
+			"blockquote": {"cite"},
+			"q":          {"cite"},
+			"ol":         {"start", "type"},
+			"td":         {"colspan", "rowspan"},
+			"th":         {"colspan", "rowspan", "scope"},
+		},
+		GlobalAttributes: []string{"id", "class", "title", "lang", "dir"},
+		Drop:             []string{"script", "style", "iframe", "object", "embed", "applet", "frame", "frameset", "form", "template", "svg", "math"},
+		URLSchemes:       []string{"http", "https", "mailto"},
+	}
+	for _, el := range strings.Fields(`abbr article aside b bdi bdo br caption cite code col colgroup
+dd del dfn div dl dt em figcaption figure footer h1 h2 h3 h4 h5 h6 header hr i ins kbd li
+mark p pre rp rt ruby s samp section small span strong sub sup table tbody tfoot thead tr u ul var`) {
+		if _, ok := p.Elements[el]; !ok {
+			p.Elements[el] = nil
+		}
+	}
+	return p
+}
+
+// SetSanitizer makes the book sanitize every XHTML file added to it
+// from then on with the given policy, for books built from untrusted
+// input such as user-submitted HTML. The body of each file is
+// filtered through the policy and the file is rebuilt around it,
+// keeping only the title and linked stylesheets from the head.
+// Passing nil turns sanitizing off.
+func (e *EPub) SetSanitizer(p *SanitizePolicy) {
+	e.sanitizer = p
+}
+
+// voidElements are the allowed elements that never have content.
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true, "col": true}
+
+// urlAttributes are the attributes whose values are URLs.
+var urlAttributes = map[string]bool{"href": true, "src": true, "cite": true}
+
+// sanitize returns contents filtered through the policy.
+func (p *SanitizePolicy) sanitize(contents []byte) ([]byte, error) {
+	root, err := parseXML(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse XHTML: %w", err)
+	}
+	title := ""
+	if t := root.find("title"); t != nil {
+		title = t.textContent()
+	}
+	var sheets []string
+	for _, l := range root.findAll("link") {
+		if strings.EqualFold(l.attr("rel"), "stylesheet") && p.safeURL(l.attr("href")) {
+			sheets = append(sheets, l.attr("href"))
+		}
+	}
+	var b strings.Builder
+	if body := root.find("body"); body != nil {
+		for _, c := range body.children {
+			p.write(&b, c)
+		}
+	}
+	return []byte(xhtmlPage(title, b.String(), sheets...)), nil
+}
+
+// write writes the sanitized form of n.
+func (p *SanitizePolicy) write(b *strings.Builder, n *xnode) {
+	if n.name == "" {
+		b.WriteString(html.EscapeString(n.text))
+		return
+	}
+	name := strings.ToLower(n.name)
+	for _, d := range p.Drop {
+		if name == d {
+			return
+		}
+	}
+	allowed, ok := p.Elements[name]
+	if !ok {
+		for _, c := range n.children {
+			p.write(b, c)
+		}
+		return
+	}
+	b.WriteString("<" + name)
+	for _, a := range n.attrs {
+		key := strings.ToLower(a.Name.Local)
+		if a.Name.Space == "xml" || a.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+			if key == "lang" {
+				b.WriteString(" " + attrPair("xml:lang", a.Value))
+			}
+			continue
+		}
+		if a.Name.Space != "" || !(contains(allowed, key) || contains(p.GlobalAttributes, key)) {
+			continue
+		}
+		if urlAttributes[key] && !p.safeURL(a.Value) {
+			continue
+		}
+		b.WriteString(" " + attrPair(key, a.Value))
+	}
+	if voidElements[name] {
+		b.WriteString(" />")
+		return
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		p.write(b, c)
+	}
+	b.WriteString("</" + name + ">")
+}
+
+// safeURL reports whether u is relative or uses an allowed scheme.
+func (p *SanitizePolicy) safeURL(u string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return false
+	}
+	if parsed.Scheme == "" {
+		// Be conservative: anything that a browser might read as a
+		// scheme isn't relative.
+		return !strings.Contains(strings.SplitN(u, "/", 2)[0], ":")
+	}
+	return contains(p.URLSchemes, strings.ToLower(parsed.Scheme))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
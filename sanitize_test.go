@@ -0,0 +1,55 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	e := simpleBook(t)
+	e.SetSanitizer(DefaultSanitizePolicy())
+	body := `<h1 onclick="steal()">Title</h1>
+<p class="x" style="background: url(evil)">Some <b>bold</b> and <blink>blinking</blink> text.</p>
+<script>steal();</script>
+<iframe src="https://evil.example/"><p>fallback</p></iframe>
+<p xml:lang="fr"><a href="javascript:steal()">bad</a> <a href=" JavaScript:steal()">bad</a> <a href="https://example.com/?a=1&amp;b=2">good</a> <a href="b.xhtml#x">local</a></p>
+<img src="images/a.png" alt="A" onerror="steal()" /><img src="data:image/png;base64,AAAA" alt="B" />`
+	id, err := e.AddXHTML("b.xhtml", xhtmlPage("B & C", body, "css/main.css", "javascript:steal()"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := e.findXHTML(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(x.contents)
+	for _, bad := range []string{"onclick", "style=", "<blink", "<script", "steal", "iframe", "fallback", "onerror", "data:"} {
+		if strings.Contains(got, bad) {
+			t.Errorf("sanitized XHTML contains %q:\n%s", bad, got)
+		}
+	}
+	for _, want := range []string{
+		"<title>B &amp; C</title>",
+		`<link rel="stylesheet" type="text/css" href="css/main.css" />`,
+		`<h1>Title</h1>`,
+		`<p class="x">Some <b>bold</b> and blinking text.</p>`,
+		`<p xml:lang="fr"><a>bad</a> <a>bad</a> <a href="https://example.com/?a=1&amp;b=2">good</a> <a href="b.xhtml#x">local</a></p>`,
+		`<img src="images/a.png" alt="A" /><img alt="B" />`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sanitized XHTML missing %s:\n%s", want, got)
+		}
+	}
+
+	if _, err := e.AddXHTML("c.xhtml", "<html><body><p>unclosed</body>"); err == nil {
+		t.Errorf("AddXHTML accepted unparseable XHTML while sanitizing")
+	}
+
+	e.SetSanitizer(nil)
+	if id, err = e.AddXHTML("d.xhtml", xhtmlPage("D", body)); err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := e.findXHTML(id); !strings.Contains(string(x.contents), "<script>") {
+		t.Errorf("XHTML was sanitized after SetSanitizer(nil)")
+	}
+}
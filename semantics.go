@@ -0,0 +1,251 @@
+package epub
+
+// This file holds the EPUB structural semantics vocabulary, the terms
+// used in epub:type attributes, and the checks that catch misspelled
+// terms in the book's XHTML files.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SemanticType is a term from the EPUB 3 Structural Semantics
+// Vocabulary, for epub:type attributes. Reading systems use the terms
+// to find a book's footnotes, chapters, and so on, and ignore terms
+// they don't know, so a misspelled term quietly turns the feature
+// off; Warnings reports them, and strict mode (see SetStrict) makes
+// them errors.
+type SemanticType string
+
+// Commonly used structural semantics terms. CheckSemanticType knows
+// the rest of the vocabulary too.
+const (
+	// Document partitions.
+	TypeCover       SemanticType = "cover"
+	TypeFrontmatter SemanticType = "frontmatter"
+	TypeBodymatter  SemanticType = "bodymatter"
+	TypeBackmatter  SemanticType = "backmatter"
+
+	// Divisions.
+	TypeVolume     SemanticType = "volume"
+	TypePart       SemanticType = "part"
+	TypeChapter    SemanticType = "chapter"
+	TypeSubchapter SemanticType = "subchapter"
+	TypeDivision   SemanticType = "division"
+
+	// Sections and components.
+	TypeAbstract        SemanticType = "abstract"
+	TypeForeword        SemanticType = "foreword"
+	TypePreface         SemanticType = "preface"
+	TypePrologue        SemanticType = "prologue"
+	TypeIntroduction    SemanticType = "introduction"
+	TypePreamble        SemanticType = "preamble"
+	TypeConclusion      SemanticType = "conclusion"
+	TypeEpilogue        SemanticType = "epilogue"
+	TypeAfterword       SemanticType = "afterword"
+	TypeEpigraph        SemanticType = "epigraph"
+	TypeAppendix        SemanticType = "appendix"
+	TypeColophon        SemanticType = "colophon"
+	TypeCredits         SemanticType = "credits"
+	TypeIndex           SemanticType = "index"
+	TypeGlossary        SemanticType = "glossary"
+	TypeBibliography    SemanticType = "bibliography"
+	TypeTitlepage       SemanticType = "titlepage"
+	TypeHalftitlepage   SemanticType = "halftitlepage"
+	TypeCopyrightPage   SemanticType = "copyright-page"
+	TypeSeriespage      SemanticType = "seriespage"
+	TypeAcknowledgments SemanticType = "acknowledgments"
+	TypeDedication      SemanticType = "dedication"
+	TypeErrata          SemanticType = "errata"
+	TypeSidebar         SemanticType = "sidebar"
+	TypePullquote       SemanticType = "pullquote"
+
+	// Navigation.
+	TypeTOC       SemanticType = "toc"
+	TypeLandmarks SemanticType = "landmarks"
+	TypePageList  SemanticType = "page-list"
+	TypePagebreak SemanticType = "pagebreak"
+
+	// Titles and headings.
+	TypeTitle     SemanticType = "title"
+	TypeSubtitle  SemanticType = "subtitle"
+	TypeFulltitle SemanticType = "fulltitle"
+	TypeLabel     SemanticType = "label"
+	TypeOrdinal   SemanticType = "ordinal"
+
+	// Notes and references.
+	TypeFootnote    SemanticType = "footnote"
+	TypeFootnotes   SemanticType = "footnotes"
+	TypeEndnote     SemanticType = "endnote"
+	TypeEndnotes    SemanticType = "endnotes"
+	TypeNoteref     SemanticType = "noteref"
+	TypeBacklink    SemanticType = "backlink"
+	TypeBiblioref   SemanticType = "biblioref"
+	TypeGlossref    SemanticType = "glossref"
+	TypeGlossterm   SemanticType = "glossterm"
+	TypeGlossdef    SemanticType = "glossdef"
+	TypeBiblioentry SemanticType = "biblioentry"
+)
+
+// semanticTypes is the whole of the EPUB 3 Structural Semantics
+// Vocabulary, including the terms it deprecates, which reading systems
+// still recognize.
+var semanticTypes = map[string]bool{}
+
+func init() {
+	for _, t := range strings.Fields(`
+		cover frontmatter bodymatter backmatter
+		volume part chapter subchapter division
+		abstract foreword preface prologue introduction preamble
+		conclusion epilogue afterword epigraph
+		toc toc-brief landmarks loa loi lot lov
+		appendix colophon credits keywords
+		index index-headnotes index-legend index-group index-entry-list
+		index-entry index-term index-editor-note index-locator
+		index-locator-list index-locator-range index-xref-preferred
+		index-xref-related index-term-category index-term-categories
+		glossary glossterm glossdef bibliography biblioentry
+		titlepage halftitlepage copyright-page seriespage acknowledgments
+		imprint imprimatur contributors other-credits errata dedication
+		revision-history case-study help marginalia notice pullquote
+		sidebar tip warning halftitle fulltitle covertitle title subtitle
+		label ordinal bridgehead learning-objective learning-objectives
+		learning-outcome learning-outcomes learning-resource
+		learning-resources learning-standard learning-standards
+		answer answers assessment assessments feedback
+		fill-in-the-blank-problem general-problem qna match-problem
+		multiple-choice-problem practice question practices
+		true-false-problem panel panel-group balloon text-area sound-area
+		annotation note footnote endnote rearnote footnotes endnotes
+		rearnotes annoref biblioref glossref noteref backlink credit
+		keyword topic-sentence concluding-sentence pagebreak page-list
+		table table-row table-cell list list-item figure aside`) {
+		semanticTypes[t] = true
+	}
+}
+
+// CheckSemanticType checks the value of an epub:type attribute, which
+// is one or more terms separated by spaces. Unprefixed terms must be
+// in the EPUB 3 Structural Semantics Vocabulary; prefixed terms, such
+// as "z3998:fiction", aren't checked. The error for an unknown term
+// matches ErrUnknownSemanticType and suggests terms that might have
+// been meant, such as "chapter" for "chaptre".
+func CheckSemanticType(value string) error {
+	for _, t := range strings.Fields(value) {
+		if strings.Contains(t, ":") || semanticTypes[t] {
+			continue
+		}
+		s := semanticSuggestions(t)
+		if len(s) == 0 {
+			return errorf(ErrUnknownSemanticType, "unknown epub:type %q", t)
+		}
+		for i, c := range s {
+			s[i] = fmt.Sprintf("%q", c)
+		}
+		return errorf(ErrUnknownSemanticType, "unknown epub:type %q; did you mean %v?", t, strings.Join(s, " or "))
+	}
+	return nil
+}
+
+// semanticSuggestions returns up to three terms that t might have been
+// meant as: terms that differ from it only in case, failing that ones
+// two or fewer edits away, or one for short words, closest first.
+func semanticSuggestions(t string) []string {
+	lower := strings.ToLower(t)
+	if semanticTypes[lower] {
+		return []string{lower}
+	}
+	type guess struct {
+		term string
+		dist int
+	}
+	limit := 2
+	if len(lower) <= 4 {
+		limit = 1
+	}
+	var guesses []guess
+	for term := range semanticTypes {
+		if d := editDistance(lower, term); d <= limit {
+			guesses = append(guesses, guess{term, d})
+		}
+	}
+	sort.Slice(guesses, func(i, j int) bool {
+		if guesses[i].dist != guesses[j].dist {
+			return guesses[i].dist < guesses[j].dist
+		}
+		return guesses[i].term < guesses[j].term
+	})
+	var ret []string
+	for i := 0; i < len(guesses) && i < 3; i++ {
+		ret = append(ret, guesses[i].term)
+	}
+	return ret
+}
+
+// editDistance returns the number of single letter insertions,
+// deletions, substitutions, and swaps of adjacent letters it takes to
+// turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// epubTypeValueRE matches an epub:type attribute, capturing its value.
+var epubTypeValueRE = regexp.MustCompile(`\sepub:type\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// semanticTypeErrors returns an error for each XHTML file in the book
+// that has an epub:type attribute with an unknown term.
+func (e *EPub) semanticTypeErrors() []error {
+	var errs []error
+	for _, x := range e.xhtml {
+		for _, m := range epubTypeValueRE.FindAllSubmatch(x.contents, -1) {
+			if err := CheckSemanticType(string(m[1]) + string(m[2])); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", x.name, err))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// semanticWarnings returns warnings for the XHTML files that use
+// unknown epub:type terms.
+func (e *EPub) semanticWarnings() []string {
+	var warnings []string
+	for _, err := range e.semanticTypeErrors() {
+		warnings = append(warnings, err.Error())
+	}
+	return warnings
+}
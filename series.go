@@ -0,0 +1,148 @@
+package epub
+
+// This file holds Series, which builds the books of a multi-volume
+// project from one set of shared metadata and resources.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// Series holds what the books of a series share: the series name,
+// authors, publisher, and languages, and fonts and stylesheets every
+// volume includes. Each call to Volume makes a new book with all of
+// them already set, so the volumes of a multi-volume build can't drift
+// apart.
+type Series struct {
+	Name      string
+	Authors   []string
+	Publisher string
+	Languages []string
+	// Version is the ePub version of the volumes. The default is 3,
+	// since series metadata is only written for v3 books.
+	Version float64
+	// Options are passed to New for each volume, for settings such as
+	// a theme.
+	Options []Option
+
+	// shared holds the fonts and stylesheets added to the series, with
+	// the IDs they have in every volume.
+	shared *EPub
+	// The entry numbers of the volumes made so far, and their titles.
+	entries map[string]string
+	catalog []CatalogEntry
+}
+
+// NewSeries returns a Series with the given name and authors.
+func NewSeries(name string, authors ...string) *Series {
+	return &Series{Name: name, Authors: authors}
+}
+
+func (s *Series) sharedBook() *EPub {
+	if s.shared == nil {
+		s.shared = New()
+	}
+	return s.shared
+}
+
+// AddFont adds a font to every volume of the series, as with
+// EPub.AddFont. It must be called before the volumes are made.
+//
+// Returns the ID the font has in every volume.
+func (s *Series) AddFont(path string, contents []byte) (Id, error) {
+	if len(s.entries) > 0 {
+		return "", fmt.Errorf("can't add font %v after volumes have been made", path)
+	}
+	return s.sharedBook().AddFont(path, contents)
+}
+
+// AddStylesheet adds a stylesheet to every volume of the series, as
+// with EPub.AddStylesheet. It must be called before the volumes are
+// made.
+//
+// Returns the ID the stylesheet has in every volume.
+func (s *Series) AddStylesheet(path, contents string) (Id, error) {
+	if len(s.entries) > 0 {
+		return "", fmt.Errorf("can't add stylesheet %v after volumes have been made", path)
+	}
+	return s.sharedBook().AddStylesheet(path, contents)
+}
+
+// AddStylesheetWithOptions adds a stylesheet to every volume of the
+// series that's linked into all their XHTML files, as with
+// EPub.AddStylesheetWithOptions. It must be called before the volumes
+// are made.
+//
+// Returns the ID the stylesheet has in every volume.
+func (s *Series) AddStylesheetWithOptions(path, contents string, opts StyleOptions) (Id, error) {
+	if len(s.entries) > 0 {
+		return "", fmt.Errorf("can't add stylesheet %v after volumes have been made", path)
+	}
+	return s.sharedBook().AddStylesheetWithOptions(path, contents, opts)
+}
+
+// Volume returns a new book for the volume of the series with the
+// given title and entry number, such as "2" or "1.5" (see
+// SetEntryNumber). The book has the series' metadata, fonts, and
+// stylesheets, and a UUID derived from the series name and entry
+// number, so rebuilding a volume gives it the same identifier. Each
+// entry number can only be used once.
+func (s *Series) Volume(title, entry string) (*EPub, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("series has no name")
+	}
+	entry = strings.TrimSpace(entry)
+	if t, ok := s.entries[entry]; ok {
+		return nil, fmt.Errorf("entry %v of %v is already %q", entry, s.Name, t)
+	}
+	e := New(s.Options...)
+	version := s.Version
+	if version == 0 {
+		version = 3
+	}
+	if err := e.SetVersion(version); err != nil {
+		return nil, err
+	}
+	e.SetTitle(title)
+	if err := e.SetSeries(s.Name); err != nil {
+		return nil, err
+	}
+	if err := e.SetEntryNumber(entry); err != nil {
+		return nil, err
+	}
+	for _, a := range s.Authors {
+		e.AddAuthor(a)
+	}
+	if s.Publisher != "" {
+		e.AddPublisher(s.Publisher)
+	}
+	for _, l := range s.Languages {
+		if err := e.AddLanguage(l); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.SetUUID(uuid.NewV5(NamespaceUUID, s.Name+"\x00"+entry).String()); err != nil {
+		return nil, err
+	}
+	if s.shared != nil {
+		e.fonts = append(e.fonts, s.shared.fonts...)
+		e.styles = append(e.styles, s.shared.styles...)
+		for class, n := range s.shared.lastId {
+			e.lastId[class] = n
+		}
+	}
+
+	if s.entries == nil {
+		s.entries = make(map[string]string)
+	}
+	s.entries[entry] = title
+	s.catalog = append(s.catalog, CatalogEntry{Title: title, Series: s.Name, Position: entry})
+	return e, nil
+}
+
+// Catalog returns the volumes made so far, for AddAlsoByPage.
+func (s *Series) Catalog() []CatalogEntry {
+	return append([]CatalogEntry(nil), s.catalog...)
+}
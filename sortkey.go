@@ -0,0 +1,150 @@
+package epub
+
+// This file holds the code that derives sort keys for titles and
+// names.
+
+import (
+	"strings"
+)
+
+// Transliterator supplies the readings of strings for sorting, such
+// as the kana reading of a Japanese title written in kanji or the
+// pinyin of a Chinese name. It's used by SetAutoSortKeys for
+// languages whose writing doesn't sort by itself.
+type Transliterator interface {
+	// Reading returns the reading of s, which is in the language
+	// lang, and whether it has one.
+	Reading(s, lang string) (string, bool)
+}
+
+// leadingArticles holds the articles dropped from the start of titles
+// when deriving sort keys, by primary language subtag. Articles that
+// elide, such as French "l'", end with an apostrophe.
+var leadingArticles = map[string][]string{
+	"en": {"the", "a", "an"},
+	"fr": {"le", "la", "les", "un", "une", "l'"},
+	"de": {"der", "die", "das", "ein", "eine"},
+	"es": {"el", "la", "los", "las", "un", "una"},
+	"it": {"il", "lo", "la", "i", "gli", "le", "un", "uno", "una", "l'"},
+	"pt": {"o", "a", "os", "as", "um", "uma"},
+	"nl": {"de", "het", "een"},
+}
+
+// familyNameFirst holds the languages whose personal names are
+// normally written family name first, and so aren't inverted.
+var familyNameFirst = map[string]bool{"ja": true, "zh": true, "ko": true, "hu": true, "vi": true}
+
+// primaryLanguage returns the primary subtag of a language tag, in
+// lower case, such as "en" for "en-GB".
+func primaryLanguage(lang string) string {
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(lang)
+}
+
+// TitleSortKey returns the key a title in the given language should
+// be sorted by: the title with any leading article dropped, so "The
+// Hobbit" sorts as "Hobbit". Articles are known for English, French,
+// German, Spanish, Italian, Portuguese, and Dutch; titles in other
+// languages are returned unchanged apart from trimming spaces.
+func TitleSortKey(title, lang string) string {
+	title = strings.TrimSpace(title)
+	for _, a := range leadingArticles[primaryLanguage(lang)] {
+		if strings.HasSuffix(a, "'") {
+			// Elided articles are often written with a typographic
+			// apostrophe.
+			for _, p := range []string{a, strings.TrimSuffix(a, "'") + "’"} {
+				if hasPrefixFold(title, p) {
+					return strings.TrimSpace(title[len(p):])
+				}
+			}
+			continue
+		}
+		if hasPrefixFold(title, a+" ") && strings.TrimSpace(title[len(a):]) != "" {
+			return strings.TrimSpace(title[len(a):])
+		}
+	}
+	return title
+}
+
+// hasPrefixFold reports whether s begins with prefix, ignoring case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// NameSortKey returns the key a person's name in the given language
+// should be sorted by, such as "Austen, Jane" for "Jane Austen". The
+// last word is taken as the family name; names that already contain
+// a comma, single-word names, and names in languages that put the
+// family name first (Japanese, Chinese, Korean, Hungarian, and
+// Vietnamese) are returned unchanged apart from trimming spaces.
+func NameSortKey(name, lang string) string {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ",") || familyNameFirst[primaryLanguage(lang)] {
+		return name
+	}
+	words := strings.Fields(name)
+	if len(words) < 2 {
+		return name
+	}
+	return words[len(words)-1] + ", " + strings.Join(words[:len(words)-1], " ")
+}
+
+// SetAutoSortKeys controls whether sort keys are derived for the
+// book's title, creators, and contributors when it's written, using
+// TitleSortKey and NameSortKey with the book's language. Creators and
+// contributors that were given a sort name explicitly, through
+// Person.SortName, keep it. Title sort keys are only written for v3
+// books, since v2 has nowhere to put them.
+//
+// If t isn't nil, it's asked for the reading of each title and name
+// first; a reading, if there is one, is used as the sort key as is.
+func (e *EPub) SetAutoSortKeys(auto bool, t Transliterator) {
+	e.autoSortKeys, e.transliterator = auto, t
+}
+
+// addSortKeys returns a copy of md with derived file-as refinements
+// added to titles, creators, and contributors that don't have one.
+func (e *EPub) addSortKeys(md []metadata) []metadata {
+	lang := e.language()
+	ret := make([]metadata, len(md))
+	for i, m := range md {
+		ret[i] = m
+		var key string
+		switch m.kind {
+		case "dc:title":
+			key = e.sortKey(m.value, lang, TitleSortKey)
+		case "dc:creator", "dc:contributor":
+			key = e.sortKey(m.value, lang, NameSortKey)
+		default:
+			continue
+		}
+		if key == "" || key == m.value || hasPair(m, "file-as") {
+			continue
+		}
+		ret[i].pairs = append(append([]pair(nil), m.pairs...), pair{v2prefix: "opf:", key: "file-as", value: key, v3only: m.kind == "dc:title"})
+	}
+	return ret
+}
+
+// sortKey returns the sort key for s, from the book's transliterator
+// if it has a reading and from derive otherwise.
+func (e *EPub) sortKey(s, lang string, derive func(string, string) string) string {
+	if e.transliterator != nil {
+		if r, ok := e.transliterator.Reading(s, lang); ok {
+			return r
+		}
+	}
+	return derive(s, lang)
+}
+
+// hasPair reports whether m has a pair with the given key.
+func hasPair(m metadata, key string) bool {
+	for _, p := range m.pairs {
+		if p.key == key {
+			return true
+		}
+	}
+	return false
+}
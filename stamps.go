@@ -0,0 +1,84 @@
+package epub
+
+// This file holds the code that stamps running heads and page numbers
+// onto generated image pages.
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// StampPosition is where a PageStamp goes on the page.
+type StampPosition int
+
+const (
+	StampTopLeft StampPosition = iota
+	StampTopCenter
+	StampTopRight
+	StampBottomLeft
+	StampBottomCenter
+	StampBottomRight
+)
+
+// stampCSS holds the positioning for each StampPosition.
+var stampCSS = map[StampPosition]string{
+	StampTopLeft:      "top: 2%; left: 4%;",
+	StampTopCenter:    "top: 2%; left: 0; right: 0; text-align: center;",
+	StampTopRight:     "top: 2%; right: 4%; text-align: right;",
+	StampBottomLeft:   "bottom: 2%; left: 4%;",
+	StampBottomCenter: "bottom: 2%; left: 0; right: 0; text-align: center;",
+	StampBottomRight:  "bottom: 2%; right: 4%; text-align: right;",
+}
+
+// PageStamp is text, such as a page number or running head, laid
+// over the pages AddImagePage generates.
+type PageStamp struct {
+	// Text is the text of the stamp. "%d" is replaced with the page
+	// number, "%s" with the book's title, and "%%" with a percent
+	// sign.
+	Text     string
+	Position StampPosition
+	// Class is an extra class for the stamp's div, for stylesheets.
+	// Stamps always have the class "stamp".
+	Class string
+}
+
+// SetPageStamps sets the stamps laid over the pages AddImagePage
+// generates from now on, such as page numbers or a running head with
+// the title of the current section. Stamps are positioned HTML over
+// the image, so the images themselves aren't altered and the text
+// stays sharp and searchable. Call SetPageStamps again at the start of
+// each section to change them; with no stamps, pages aren't stamped.
+//
+// Pages are numbered from 1 in the order they're added with
+// AddImagePage. This is meant for fixed-layout books (see
+// SetFixedLayout).
+func (e *EPub) SetPageStamps(stamps ...PageStamp) error {
+	for _, s := range stamps {
+		if _, ok := stampCSS[s.Position]; !ok {
+			return fmt.Errorf("invalid stamp position %v", s.Position)
+		}
+	}
+	e.pageStamps = append([]PageStamp(nil), stamps...)
+	return nil
+}
+
+// stampHTML returns the style rules and body markup for the current
+// stamps on the given image page.
+func (e *EPub) stampHTML(page int) (css, body string) {
+	if len(e.pageStamps) == 0 {
+		return "", ""
+	}
+	var b strings.Builder
+	r := strings.NewReplacer("%d", strconv.Itoa(page), "%s", e.title, "%%", "%")
+	for _, s := range e.pageStamps {
+		class := "stamp"
+		if s.Class != "" {
+			class += " " + s.Class
+		}
+		fmt.Fprintf(&b, "<div %s %s>%s</div>\n", attrPair("class", class), attrPair("style", stampCSS[s.Position]), html.EscapeString(r.Replace(s.Text)))
+	}
+	return " body { position: relative; } .stamp { position: absolute; font-size: 1.5em; }", b.String()
+}
@@ -0,0 +1,99 @@
+package epub
+
+// This file holds strict mode, which turns the problems this package
+// normally lets slide into errors.
+
+// SetStrict turns strict mode on or off. It's off by default.
+//
+// In strict mode Validate, and so writing the book, fails on problems
+// that are otherwise ignored or only reported by Warnings:
+//
+//   - errors from methods that have no way to return them, such as
+//     AddAuthor with an empty name
+//   - resources of any kind added at the same path, or moved to the
+//     same path with SetZipPath (matching ErrDuplicatePath)
+//   - a cover set with SetCoverImage that isn't an image in the book
+//     (matching ErrNotFound)
+//   - images over the per-image size budget set with SetSizeBudget
+//     (matching ErrOverBudget)
+//   - epub:type attributes with terms that aren't in the structural
+//     semantics vocabulary (matching ErrUnknownSemanticType)
+//   - images, stylesheets, and other resources loaded from the web
+//     that must be in the book (matching ErrRemoteResource)
+//
+// This is meant for build pipelines that want zero tolerance. Errors
+// from methods with no way to return them are recorded whether or not
+// strict mode is on when they're called.
+func (e *EPub) SetStrict(strict bool) {
+	e.strict = strict
+}
+
+// noteError records an error from a method that has no way to return
+// it, for strict mode to report.
+func (e *EPub) noteError(err error) {
+	if err != nil {
+		e.ignoredErrs = append(e.ignoredErrs, err)
+	}
+}
+
+// validateStrict runs the strict mode checks, if strict mode is on.
+func (e *EPub) validateStrict() error {
+	if !e.strict {
+		return nil
+	}
+	if len(e.ignoredErrs) > 0 {
+		return e.ignoredErrs[0]
+	}
+
+	type resource struct {
+		id   Id
+		name string
+	}
+	var rs []resource
+	for _, i := range e.images {
+		rs = append(rs, resource{i.id, i.name})
+	}
+	for _, x := range e.xhtml {
+		rs = append(rs, resource{x.id, x.name})
+	}
+	for _, s := range e.styles {
+		rs = append(rs, resource{s.id, s.name})
+	}
+	for _, s := range e.scripts {
+		rs = append(rs, resource{s.id, s.name})
+	}
+	for _, f := range e.fonts {
+		rs = append(rs, resource{f.id, f.name})
+	}
+	for _, m := range e.media {
+		rs = append(rs, resource{m.id, m.name})
+	}
+	paths := make(map[string]Id)
+	for _, r := range rs {
+		p := e.zipName(r.id, r.name)
+		if prev, ok := paths[p]; ok {
+			return errorf(ErrDuplicatePath, "%v and %v are both at %q", prev, r.id, p)
+		}
+		paths[p] = r.id
+	}
+
+	if e.coverID != "" {
+		if _, err := e.findImage(e.coverID); err != nil {
+			return errorf(ErrNotFound, "cover %v isn't an image in the book", e.coverID)
+		}
+	}
+	if errs := e.semanticTypeErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	if errs := e.remoteResourceErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	if e.imageBudget > 0 {
+		for _, i := range e.images {
+			if n := int64(len(i.contents)); n > e.imageBudget {
+				return errorf(ErrOverBudget, "image %v is %v, over the %v per-image size budget", i.name, formatSize(n), formatSize(e.imageBudget))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package epub
+
+// This file holds the code for hierarchical subjects, and for tidying
+// up the book's subjects as they're written.
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SubjectStyle controls how hierarchical subjects added with
+// AddSubjectPath are written into the book's metadata. The styles can
+// be combined.
+type SubjectStyle int
+
+const (
+	// SubjectLevels writes each level of the hierarchy as its own
+	// dc:subject, for retailers that treat subjects as keywords.
+	SubjectLevels SubjectStyle = 1 << iota
+	// SubjectPaths writes the whole hierarchy as a single dc:subject,
+	// with the levels joined by the separator, for retailers that take
+	// category paths.
+	SubjectPaths
+)
+
+// defaultSubjectSeparator joins the levels of subject paths unless
+// SetSubjectStyle says otherwise.
+const defaultSubjectSeparator = " / "
+
+// AddSubjectPath adds a hierarchical subject to the book, from the
+// most general level to the most specific, such as "Fiction",
+// "Fantasy", "Epic". By default it's written both as a dc:subject for
+// each level and as a single "Fiction / Fantasy / Epic" dc:subject;
+// use SetSubjectStyle to change this. Levels shared by several paths
+// are only written once.
+func (e *EPub) AddSubjectPath(levels ...string) error {
+	if len(levels) == 0 {
+		return errors.New("subject paths must have at least one level")
+	}
+	path := make([]string, len(levels))
+	for i, l := range levels {
+		path[i] = strings.TrimSpace(l)
+		if path[i] == "" {
+			return errors.New("subject path levels can't be empty")
+		}
+	}
+	e.subjectPaths = append(e.subjectPaths, path)
+	return nil
+}
+
+// SetSubjectStyle controls how subjects added with AddSubjectPath are
+// written. Separator joins the levels of SubjectPaths subjects; if
+// it's empty " / " is used.
+func (e *EPub) SetSubjectStyle(style SubjectStyle, separator string) error {
+	if style&(SubjectLevels|SubjectPaths) == 0 || style&^(SubjectLevels|SubjectPaths) != 0 {
+		return errors.New("invalid subject style")
+	}
+	if separator == "" {
+		separator = defaultSubjectSeparator
+	}
+	e.subjectStyle, e.subjectSeparator = style, separator
+	return nil
+}
+
+// SubjectCase is the letter case subjects are written in.
+type SubjectCase int
+
+const (
+	// SubjectCaseAsIs leaves subjects as they were added. This is the
+	// default.
+	SubjectCaseAsIs SubjectCase = iota
+	// SubjectLowerCase writes subjects in lower case, as keywords.
+	SubjectLowerCase
+	// SubjectTitleCase capitalizes each word of subjects, apart from
+	// short words like "and" and "of" that don't start the subject.
+	SubjectTitleCase
+)
+
+// SetSubjectCase sets the letter case the book's subjects, including
+// the levels and paths of subjects added with AddSubjectPath, are
+// written in.
+//
+// Whatever the case, subjects are tidied up when the book is written:
+// surrounding whitespace is trimmed, runs of whitespace inside them
+// are collapsed to a single space, empty subjects are dropped, and
+// subjects that differ only in letter case are written once, as they
+// were first added. This cleans up metadata pasted from spreadsheets,
+// which routinely has messy duplicates.
+func (e *EPub) SetSubjectCase(c SubjectCase) error {
+	if c < SubjectCaseAsIs || c > SubjectTitleCase {
+		return errors.New("invalid subject case")
+	}
+	e.subjectCase = c
+	return nil
+}
+
+// canonicalSubjects returns md with its dc:subject entries tidied up
+// and recased, and duplicates removed.
+func (e *EPub) canonicalSubjects(md []metadata) []metadata {
+	ret := make([]metadata, 0, len(md))
+	seen := make(map[string]bool)
+	for _, m := range md {
+		if m.kind != "dc:subject" {
+			ret = append(ret, m)
+			continue
+		}
+		m.value = recaseSubject(strings.Join(strings.Fields(m.value), " "), e.subjectCase)
+		key := strings.ToLower(m.value)
+		if m.value == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// minorWords are the words SubjectTitleCase and CaseTitle leave in
+// lower case.
+var minorWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "by": true,
+	"for": true, "in": true, "of": true, "on": true, "or": true, "the": true,
+	"to": true, "with": true,
+}
+
+// recaseSubject returns the subject s in the letter case c.
+func recaseSubject(s string, c SubjectCase) string {
+	switch c {
+	case SubjectLowerCase:
+		return strings.ToLower(s)
+	case SubjectTitleCase:
+		words := strings.Split(strings.ToLower(s), " ")
+		for i, w := range words {
+			if w == "" || i > 0 && minorWords[w] {
+				continue
+			}
+			r, n := utf8.DecodeRuneInString(w)
+			words[i] = string(unicode.ToTitle(r)) + w[n:]
+		}
+		return strings.Join(words, " ")
+	}
+	return s
+}
+
+// expandSubjects returns md with the book's subject paths expanded
+// into dc:subject entries.
+func (e *EPub) expandSubjects(md []metadata) []metadata {
+	if len(e.subjectPaths) == 0 {
+		return md
+	}
+	style, sep := e.subjectStyle, e.subjectSeparator
+	if style == 0 {
+		style, sep = SubjectLevels|SubjectPaths, defaultSubjectSeparator
+	}
+	md = append([]metadata(nil), md...)
+	seen := make(map[string]bool)
+	for _, m := range md {
+		if m.kind == "dc:subject" {
+			seen[m.value] = true
+		}
+	}
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			md = append(md, metadata{kind: "dc:subject", value: s})
+		}
+	}
+	for _, p := range e.subjectPaths {
+		if style&SubjectLevels != 0 {
+			for _, l := range p {
+				add(l)
+			}
+		}
+		if style&SubjectPaths != 0 {
+			add(strings.Join(p, sep))
+		}
+	}
+	return md
+}
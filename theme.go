@@ -0,0 +1,416 @@
+package epub
+
+// This file holds the themes used to style the pages this package
+// generates.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Theme bundles the styling for a book: a stylesheet that's linked
+// into every XHTML file, font choices, and the templates used for
+// pages this package generates, such as title and cover pages.
+//
+// Templates are html/template templates that render the body of the
+// page; this package supplies the surrounding XHTML document.
+type Theme struct {
+	// Name identifies the theme for RegisterTheme and LookupTheme.
+	Name string
+	// CSS is the theme's stylesheet.
+	CSS string
+	// BodyFont and HeadingFont are CSS font-family lists. They're
+	// applied after the theme's CSS, so they override it.
+	BodyFont    string
+	HeadingFont string
+	// TitlePage renders the title page. It's passed a PageData.
+	TitlePage *template.Template
+	// CoverPage renders the cover page. It's passed a PageData with
+	// Image and Alt set.
+	CoverPage *template.Template
+	// TOCPage renders inline tables of contents. It's passed a
+	// PageData with Heading and TOC set.
+	TOCPage *template.Template
+	// VersionHistoryPage renders the version history page. It's
+	// passed a PageData with Revisions set.
+	VersionHistoryPage *template.Template
+	// PartPage renders the divider pages of parts. It's passed a
+	// PageData with Heading set to the part's title.
+	PartPage *template.Template
+	// DRMFreeNotice renders the colophon block added by SetDRMFree.
+	// It's passed a PageData.
+	DRMFreeNotice *template.Template
+	// CreditsPage renders the credits page. It's passed a PageData
+	// with Credits set.
+	CreditsPage *template.Template
+	// AlsoByPage renders the "Also by" page. It's passed a PageData
+	// with Heading and AlsoBy set.
+	AlsoByPage *template.Template
+}
+
+// PageData is the data passed to a theme's page templates.
+type PageData struct {
+	Title      string
+	Authors    []string
+	Publishers []string
+	// Image is the href of the cover image, relative to the page.
+	Image string
+	// Alt is the cover image's alt text: the text registered with
+	// SetAltText, or the book's title.
+	Alt string
+	// Heading is the heading of generated pages that have one, such as
+	// inline tables of contents.
+	Heading string
+	// TOC is the book's table of contents.
+	TOC []TOCEntry
+	// Revisions is the book's revision history, newest first.
+	Revisions []Revision
+	// Credits are the chapters with their own metadata, in reading
+	// order.
+	Credits []Credit
+	// AlsoBy is the author's catalog, grouped by series.
+	AlsoBy []CatalogSeries
+}
+
+// TOCEntry is an entry in the table of contents passed to a theme's
+// TOC template.
+type TOCEntry struct {
+	Label    string
+	Href     string // Relative to the page being generated
+	Children []TOCEntry
+}
+
+// Option configures a book created with New.
+type Option func(*EPub)
+
+// WithTheme styles the book with the given theme. The theme's
+// stylesheet is added to the book and linked into every XHTML file,
+// and its templates are used for generated pages. If the theme can't
+// be used, the error is returned by Validate and when the book is
+// written.
+func WithTheme(t *Theme) Option {
+	return func(e *EPub) {
+		if t == nil {
+			e.setOptionErr(errors.New("WithTheme needs a theme"))
+			return
+		}
+		e.theme = t
+		if _, err := e.AddStylesheetWithOptions("css/theme.css", t.stylesheet(), StyleOptions{}); err != nil {
+			e.setOptionErr(fmt.Errorf("unable to add the stylesheet of theme %q: %v", t.Name, err))
+		}
+	}
+}
+
+// stylesheet returns the theme's CSS with its font choices applied.
+func (t *Theme) stylesheet() string {
+	css := t.CSS
+	if t.BodyFont != "" {
+		css += fmt.Sprintf("\nbody { font-family: %s; }\n", t.BodyFont)
+	}
+	if t.HeadingFont != "" {
+		css += fmt.Sprintf("\nh1, h2, h3, h4, h5, h6 { font-family: %s; }\n", t.HeadingFont)
+	}
+	return css
+}
+
+type styleVar struct {
+	name, value string
+}
+
+var styleVarNameRE = regexp.MustCompile(`^--[A-Za-z0-9_-]+$`)
+
+// SetStyleVariable sets a CSS custom property, such as "--accent", for
+// the whole book. The properties are written as a :root rule, so
+// stylesheets can use them with var(--accent). Setting a property a
+// second time replaces its value.
+//
+// By default the rule goes in a generated stylesheet,
+// css/variables.css, that's linked into every XHTML file. Use
+// SetStyleVariableSheet to put it at the top of an existing sheet
+// instead.
+func (e *EPub) SetStyleVariable(name, value string) error {
+	if !styleVarNameRE.MatchString(name) {
+		return errorf(ErrInvalidArgument, "%q is not a valid CSS custom property name", name)
+	}
+	if strings.TrimSpace(value) == "" || strings.ContainsAny(value, ";{}") {
+		return errorf(ErrInvalidArgument, "invalid value %q for CSS custom property %v", value, name)
+	}
+	if e.varSheet == "" {
+		id, err := e.addStylesheet("css/variables.css", nil, &StyleOptions{})
+		if err != nil {
+			return err
+		}
+		e.varSheet, e.ownVarSheet = id, true
+	}
+	for i := range e.styleVars {
+		if e.styleVars[i].name == name {
+			e.styleVars[i].value = value
+			return nil
+		}
+	}
+	e.styleVars = append(e.styleVars, styleVar{name, value})
+	return nil
+}
+
+// SetStyleVariableSheet makes SetStyleVariable's :root rule go at the
+// top of the stylesheet with the given ID, rather than in a generated
+// stylesheet.
+func (e *EPub) SetStyleVariableSheet(id Id) error {
+	if id == e.varSheet {
+		return nil
+	}
+	found := false
+	for _, s := range e.styles {
+		if s.id == id {
+			found = true
+		}
+	}
+	if !found {
+		return errorf(ErrNotFound, "no stylesheet with id %v", id)
+	}
+	if e.ownVarSheet {
+		for i, s := range e.styles {
+			if s.id == e.varSheet {
+				e.styles = append(e.styles[:i], e.styles[i+1:]...)
+				break
+			}
+		}
+	}
+	e.varSheet, e.ownVarSheet = id, false
+	return nil
+}
+
+// styleContents returns the contents of s as they should be written
+// into the book, with the custom property rule prepended if s holds
+// it.
+func (e *EPub) styleContents(s style) []byte {
+	if s.id != e.varSheet || len(e.styleVars) == 0 {
+		return s.contents
+	}
+	var b bytes.Buffer
+	b.WriteString(":root {\n")
+	for _, v := range e.styleVars {
+		fmt.Fprintf(&b, "  %s: %s;\n", v.name, v.value)
+	}
+	b.WriteString("}\n")
+	b.Write(s.contents)
+	return b.Bytes()
+}
+
+var (
+	themesMu sync.Mutex
+	themes   = map[string]*Theme{}
+)
+
+// RegisterTheme makes a theme available by name through
+// LookupTheme. It's an error to register a nil theme, a theme without
+// a name, or two themes with the same name.
+func RegisterTheme(t *Theme) error {
+	if t == nil {
+		return errorf(ErrInvalidArgument, "nil theme")
+	}
+	if t.Name == "" {
+		return errorf(ErrInvalidArgument, "themes must have a name")
+	}
+	themesMu.Lock()
+	defer themesMu.Unlock()
+	if _, ok := themes[t.Name]; ok {
+		return errorf(ErrInvalidArgument, "theme %q already registered", t.Name)
+	}
+	themes[t.Name] = t
+	return nil
+}
+
+// LookupTheme returns the registered theme with the given name. The
+// built-in themes are "classic" and "modern".
+func LookupTheme(name string) (*Theme, bool) {
+	themesMu.Lock()
+	defer themesMu.Unlock()
+	t, ok := themes[name]
+	return t, ok
+}
+
+// pageTheme returns the theme to use for generated pages, falling
+// back to the classic theme's templates if the book has no theme.
+func (e *EPub) pageTheme() *Theme {
+	if e.theme != nil {
+		return e.theme
+	}
+	return classicTheme
+}
+
+// renderPage renders a theme template into a complete XHTML page in
+// the book's content profile.
+func (e *EPub) renderPage(t *template.Template, title string, data PageData) (string, error) {
+	if t == nil {
+		return "", errors.New("theme has no template for this page")
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return e.XHTMLPage(title, b.String()), nil
+}
+
+// pageData returns the template data for a page in the book.
+func (e *EPub) pageData() PageData {
+	d := PageData{Title: e.title, Authors: e.authors}
+	for _, m := range e.metadata {
+		if m.kind == "dc:publisher" {
+			d.Publishers = append(d.Publishers, m.value)
+		}
+	}
+	return d
+}
+
+// AddTitlePage generates a title page from the book's title, authors,
+// and publishers using the book's theme, and adds it to the book
+// with the given spine order. The book's metadata should be set
+// before this is called. The page is tagged as the title page
+// landmark.
+//
+// Returns the ID of the generated page.
+func (e *EPub) AddTitlePage(order int) (Id, error) {
+	x, err := e.renderPage(e.pageTheme().TitlePage, e.title, e.pageData())
+	if err != nil {
+		return "", err
+	}
+	id, err := e.AddXHTML("xhtml/title.xhtml", x, order)
+	if err != nil {
+		return "", err
+	}
+	return id, e.SetLandmark(id, LandmarkTitlePage, "")
+}
+
+// AddCoverPage generates a page displaying the cover image using the
+// book's theme, and adds it to the book with the given spine
+// order. Image is the ID of an image added with AddImage; it's also
+// set as the book's cover image, and the page is tagged as the cover
+// landmark.
+//
+// Returns the ID of the generated page.
+func (e *EPub) AddCoverPage(image Id, order int) (Id, error) {
+	i, err := e.findImage(image)
+	if err != nil {
+		return "", err
+	}
+	page := "xhtml/cover.xhtml"
+	d := e.pageData()
+	d.Image = relativeHref(page, i.name)
+	d.Alt = i.alt
+	if d.Alt == "" {
+		d.Alt = e.title
+	}
+	x, err := e.renderPage(e.pageTheme().CoverPage, "Cover", d)
+	if err != nil {
+		return "", err
+	}
+	e.SetCoverImage(image)
+	id, err := e.AddXHTML(page, x, order)
+	if err != nil {
+		return "", err
+	}
+	return id, e.SetLandmark(id, LandmarkCover, "")
+}
+
+var (
+	titlePageTemplate = template.Must(template.New("title").Parse(`<div class="titlepage">
+<h1 class="title">{{.Title}}</h1>
+{{range .Authors}}<p class="author">{{.}}</p>
+{{end}}{{range .Publishers}}<p class="publisher">{{.}}</p>
+{{end}}</div>`))
+	coverPageTemplate = template.Must(template.New("cover").Parse(`<div class="cover"><img src="{{.Image}}" alt="{{.Alt}}" /></div>`))
+	tocPageTemplate   = template.Must(template.New("toc").Parse(`<div class="toc">
+<h1>{{.Heading}}</h1>
+{{template "entries" .TOC}}
+</div>
+{{define "entries"}}<ol>
+{{range .}}<li><a href="{{.Href}}">{{.Label}}</a>{{if .Children}}
+{{template "entries" .Children}}{{end}}</li>
+{{end}}</ol>{{end}}`))
+
+	classicTheme = &Theme{
+		Name: "classic",
+		CSS: `body { margin: 0 5%; line-height: 1.4; text-align: justify; }
+p { margin: 0; text-indent: 1.5em; }
+h1, h2, h3 { text-align: center; font-weight: normal; margin: 2em 0 1em; }
+.titlepage { text-align: center; margin-top: 30%; }
+.titlepage .title { font-size: 2em; }
+.titlepage .author { font-size: 1.3em; font-style: italic; text-indent: 0; margin-top: 1em; }
+.titlepage .publisher { font-size: 0.9em; text-indent: 0; margin-top: 4em; }
+.cover { text-align: center; margin: 0; padding: 0; }
+.cover img { max-width: 100%; max-height: 100%; }
+.toc ol { list-style-type: none; padding-left: 1em; }
+.toc li { margin: 0.3em 0; }
+.history dt { font-weight: bold; margin-top: 1em; }
+.history dd { margin-left: 1.5em; }
+.navlinks { text-align: center; text-indent: 0; font-size: 0.9em; margin: 1em 0; }
+.part { text-align: center; margin-top: 40%; }
+.drm-free { margin-top: 2em; font-size: 0.85em; }
+.drm-free p { text-indent: 0; margin-bottom: 0.5em; }
+.credits p { text-indent: 0; margin-bottom: 0.8em; }
+.alsoby ul { list-style-type: none; padding-left: 0; }
+.alsoby li { margin: 0.3em 0; font-style: italic; }
+`,
+		BodyFont:           `Georgia, "Times New Roman", serif`,
+		HeadingFont:        `Georgia, "Times New Roman", serif`,
+		TitlePage:          titlePageTemplate,
+		CoverPage:          coverPageTemplate,
+		TOCPage:            tocPageTemplate,
+		VersionHistoryPage: versionHistoryTemplate,
+		PartPage:           partPageTemplate,
+		DRMFreeNotice:      drmFreeTemplate,
+		CreditsPage:        creditsTemplate,
+		AlsoByPage:         alsoByTemplate,
+	}
+
+	modernTheme = &Theme{
+		Name: "modern",
+		CSS: `body { margin: 0 4%; line-height: 1.5; }
+p { margin: 0 0 0.8em; }
+h1, h2, h3 { font-weight: bold; margin: 1.5em 0 0.8em; }
+h1 { font-size: 1.8em; border-bottom: 2px solid #888; padding-bottom: 0.2em; }
+.titlepage { margin-top: 25%; }
+.titlepage .title { font-size: 2.4em; border: none; }
+.titlepage .author { font-size: 1.2em; margin-top: 1em; }
+.titlepage .publisher { font-size: 0.8em; margin-top: 5em; text-transform: uppercase; letter-spacing: 0.1em; }
+.cover { text-align: center; margin: 0; padding: 0; }
+.cover img { max-width: 100%; max-height: 100%; }
+.toc ol { list-style-type: none; padding-left: 0; }
+.toc ol ol { padding-left: 1.5em; }
+.toc li { margin: 0.4em 0; }
+.history dt { font-weight: bold; margin-top: 1.2em; }
+.history dd { margin: 0.3em 0 0 1em; }
+.navlinks { display: flex; justify-content: space-between; font-size: 0.85em; margin: 1em 0; }
+.part { margin-top: 35%; }
+.part h1 { font-size: 2.2em; border: none; text-transform: uppercase; letter-spacing: 0.15em; }
+.drm-free { margin-top: 2em; font-size: 0.85em; color: #555; }
+.credits p { margin-bottom: 1em; }
+.alsoby ul { list-style-type: none; padding-left: 0; }
+.alsoby li { margin: 0.4em 0; }
+`,
+		BodyFont:           `"Helvetica Neue", Helvetica, Arial, sans-serif`,
+		HeadingFont:        `"Helvetica Neue", Helvetica, Arial, sans-serif`,
+		TitlePage:          titlePageTemplate,
+		CoverPage:          coverPageTemplate,
+		TOCPage:            tocPageTemplate,
+		VersionHistoryPage: versionHistoryTemplate,
+		PartPage:           partPageTemplate,
+		DRMFreeNotice:      drmFreeTemplate,
+		CreditsPage:        creditsTemplate,
+		AlsoByPage:         alsoByTemplate,
+	}
+)
+
+func init() {
+	for _, t := range []*Theme{classicTheme, modernTheme} {
+		if err := RegisterTheme(t); err != nil {
+			panic(fmt.Sprintf("can't register built-in theme: %v", err))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package epub
+
+import (
+	"errors"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestWithTheme(t *testing.T) {
+	th := &Theme{
+		Name:      "test",
+		CSS:       "p { color: black; }",
+		BodyFont:  "serif",
+		TitlePage: template.Must(template.New("title").Parse(`<h1 class="custom">{{.Title}}</h1>{{range .Authors}}<p>{{.}}</p>{{end}}`)),
+	}
+	e := New(WithTheme(th))
+	e.SetTitle("Salt & Pepper")
+	e.AddAuthor("Jane Doe")
+	e.AddLanguage("en")
+	if _, err := e.AddXHTML("a.xhtml", xhtmlPage("A", "<p>A</p>")); err != nil {
+		t.Fatal(err)
+	}
+	title, err := e.AddTitlePage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddCoverPage("img1", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddCoverPage(missing image) = %v, want ErrNotFound", err)
+	}
+	e.SetVersion(3)
+	b, err := e.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContains(t, "theme.css", zipFile(t, b, "OPS/css/theme.css"), "p { color: black; }", "body { font-family: serif; }")
+	wantContains(t, "title page", zipFile(t, b, "OPS/xhtml/title.xhtml"),
+		`<h1 class="custom">Salt &amp; Pepper</h1><p>Jane Doe</p>`,
+		`href="../css/theme.css"`)
+	wantContains(t, "nav", zipFile(t, b, "OPS/__toc.xhtml"), `epub:type="titlepage" href="xhtml/title.xhtml"`)
+	wantContains(t, "a.xhtml", zipFile(t, b, "OPS/a.xhtml"), `href="css/theme.css"`)
+	if x, err := e.findXHTML(title); err != nil || x.order != 0 {
+		t.Errorf("title page %v not at the front of the spine: %v", title, err)
+	}
+
+	// A theme without a cover template can't make cover pages.
+	img, err := e.AddImage("images/cover.png", testPNG(t, 10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddCoverPage(img, 0); err == nil {
+		t.Errorf("AddCoverPage succeeded without a cover template")
+	}
+
+	e = New(WithTheme(nil))
+	e.SetTitle("Title")
+	e.AddLanguage("en")
+	if err := e.Validate(); err == nil {
+		t.Errorf("Validate() accepted a book made with a nil theme")
+	}
+	if _, err := e.Serialize(); err == nil {
+		t.Errorf("Serialize() wrote a book made with a nil theme")
+	}
+}
+
+func TestAddCoverPage(t *testing.T) {
+	e := simpleBook(t)
+	img, err := e.AddImage("images/cover.png", testPNG(t, 10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover, err := e.AddCoverPage(img, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.coverID != img {
+		t.Errorf("AddCoverPage didn't set the cover image: %v", e.coverID)
+	}
+	b, err := e.SerializeV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := zipFile(t, b, "OPS/xhtml/cover.xhtml")
+	wantContains(t, string(cover), page, `<div class="cover"><img src="../images/cover.png" alt="Title" /></div>`)
+	if strings.Contains(page, "theme.css") {
+		t.Errorf("cover page links a theme stylesheet without a theme:\n%s", page)
+	}
+	wantContains(t, "content.opf", zipFile(t, b, "OPS/content.opf"), `<meta name="cover" content="`+string(img)+`" />`)
+}
+
+func TestRegisterTheme(t *testing.T) {
+	for _, name := range []string{"classic", "modern"} {
+		th, ok := LookupTheme(name)
+		if !ok || th.Name != name || th.CSS == "" {
+			t.Errorf("LookupTheme(%q) = %+v, %v, want the built-in theme", name, th, ok)
+		}
+	}
+	if th, ok := LookupTheme("no such theme"); ok || th != nil {
+		t.Errorf("LookupTheme of a missing theme = %+v, %v", th, ok)
+	}
+
+	th := &Theme{Name: "registertheme-test", CSS: "p { margin: 0; }"}
+	if err := RegisterTheme(th); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		themesMu.Lock()
+		delete(themes, th.Name)
+		themesMu.Unlock()
+	})
+	if got, ok := LookupTheme(th.Name); !ok || got != th {
+		t.Errorf("LookupTheme(%q) = %+v, %v, want the registered theme", th.Name, got, ok)
+	}
+	for name, bad := range map[string]*Theme{
+		"nil":       nil,
+		"no name":   {CSS: "p {}"},
+		"duplicate": {Name: th.Name},
+		"built-in":  {Name: "classic"},
+	} {
+		if err := RegisterTheme(bad); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("RegisterTheme(%v) = %v, want ErrInvalidArgument", name, err)
+		}
+	}
+	if got, _ := LookupTheme(th.Name); got != th {
+		t.Errorf("registering a duplicate replaced the theme: %+v", got)
+	}
+}
@@ -0,0 +1,52 @@
+package epub
+
+// This file holds the code that shortens long table of contents
+// labels.
+
+import (
+	"errors"
+	"strings"
+)
+
+// SetTOCLabelLimit limits table of contents labels to max characters,
+// including the ellipsis that replaces the rest of longer labels. Some
+// reading devices wrap very long labels badly or even crash on them.
+// Labels are cut at a word boundary where possible. If ellipsis is
+// empty "…" is used. A max of zero, the default, means labels are
+// never shortened.
+//
+// Shortened labels keep their full text in the title attribute of
+// the link in v3 nav documents. The NCX has nowhere to put it, so its
+// labels are just shortened. Labels are shortened as plain text, so
+// any markup in a shortened label is dropped.
+func (e *EPub) SetTOCLabelLimit(max int, ellipsis string) error {
+	if ellipsis == "" {
+		ellipsis = "…"
+	}
+	if max < 0 || (max > 0 && max <= len([]rune(ellipsis))) {
+		return errors.New("TOC label limit must be zero or longer than the ellipsis")
+	}
+	e.tocLabelMax, e.tocEllipsis = max, ellipsis
+	return nil
+}
+
+// tocLabel returns a table of contents label as it should be written,
+// shortened if it's over the limit, and the full label for a
+// title attribute if it was shortened.
+func (e *EPub) tocLabel(label string) (text, title string) {
+	text = headingText(e.text(label))
+	if e.tocLabelMax == 0 {
+		return text, ""
+	}
+	plain := []rune(text)
+	if len(plain) <= e.tocLabelMax {
+		return text, ""
+	}
+	cut := e.tocLabelMax - len([]rune(e.tocEllipsis))
+	short := string(plain[:cut])
+	if i := strings.LastIndex(short, " "); i > len(short)/2 {
+		short = short[:i]
+	}
+	short = strings.TrimRight(short, " ,;:.&-–—")
+	return short + e.tocEllipsis, text
+}
@@ -5,11 +5,9 @@ package epub
 import (
 	"archive/zip"
 	"bytes"
-	"compress/flate"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"sort"
+	"os"
 	"strconv"
 )
 
@@ -20,7 +18,7 @@ func (e *EPub) WriteV2(name string) error {
 		return err
 	}
 
-	if err = ioutil.WriteFile(name, buf, 0666); err != nil {
+	if err = os.WriteFile(name, buf, 0666); err != nil {
 		return err
 	}
 
@@ -30,7 +28,22 @@ func (e *EPub) WriteV2(name string) error {
 
 // SerializeV2 returns a byteslice containing the built epub.
 func (e *EPub) SerializeV2() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	if err := e.runBeforeWrite(); err != nil {
+		return nil, err
+	}
+	return e.serializeV2(e.writeCache())
+}
+
+// serializeV2 builds the book, sharing compressed files through cache
+// if it's not nil.
+func (e *EPub) serializeV2(cache entryCache) ([]byte, error) {
+	defer e.cachePrepared()()
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	e.reportWarnings(2)
+
+	buf := bytes.NewBuffer(make([]byte, 0, e.contentSize()))
 	z := zip.NewWriter(buf)
 
 	// Make sure we're using deflate, which is the only compression
@@ -39,9 +52,7 @@ func (e *EPub) SerializeV2() ([]byte, error) {
 	// anyway we also turn on max compression. This doesn't make much
 	// difference for most books (text compresses really well already,
 	// and images don't) but that's fine.
-	z.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.BestCompression)
-	})
+	registerCompressor(z, e.deflater)
 
 	// add mimetype. Need to use the CreateHeader method because the
 	// mimetype file needs to be uncompressed.
@@ -53,77 +64,49 @@ func (e *EPub) SerializeV2() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Fprint(w, "application/epub+zip")
+	fmt.Fprint(w, epubMediaType)
 
-	// Add the images.
-	for _, i := range e.images {
-		w, err = z.Create("OPS/" + i.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write(i.contents)
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", i.name, length, len(i.contents), err)
-		}
+	// The container and package files come first, since reading
+	// systems need them to find everything else.
+	if err = e.addContainer(z); err != nil {
+		return nil, err
 	}
 
-	// Add the xhtml.
-	for _, x := range e.xhtml {
-		w, err = z.Create("OPS/" + x.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write([]byte(x.contents))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", x.name, length, len(x.contents), err)
-		}
+	if err = e.addEncryption(z); err != nil {
+		return nil, err
 	}
 
-	// Add the css.
-	for _, s := range e.styles {
-		w, err = z.Create("OPS/" + s.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write([]byte(s.contents))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", s.name, length, len(s.contents), err)
-		}
+	if err = e.addBuildManifest(z); err != nil {
+		return nil, err
 	}
 
-	// Add the javascript.
-	for _, s := range e.scripts {
-		w, err = z.Create("OPS/" + s.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write([]byte(s.contents))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", s.name, length, len(s.contents), err)
-		}
+	if err = e.addContent(z); err != nil {
+		return nil, err
 	}
 
-	// Add the fonts.
-	for _, f := range e.fonts {
-		w, err = z.Create("OPS/" + f.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write(f.contents)
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", f.name, length, len(f.contents), err)
-		}
+	// Add the book's files. They're written in reading order, so
+	// streaming readers can show the first pages early, and any
+	// preloaded ones (see SetPreload) go ahead of the table of
+	// contents.
+	entries, err := e.zipEntries(2)
+	if err != nil {
+		return nil, err
 	}
-
-	if err = e.addContent(z); err != nil {
+	if entries, err = e.transformEntries(entries); err != nil {
 		return nil, err
 	}
-
-	if err = e.addToc(z); err != nil {
+	entries, n := e.preloadEntries(e.obfuscateEntries(entries))
+	if err = writeZipEntries(z, entries[:n], cache, e.deflater); err != nil {
 		return nil, err
 	}
 
-	if err = e.addContainer(z); err != nil {
+	if e.wantNCX(2) {
+		if err = e.addToc(z); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writeZipEntries(z, entries[n:], cache, e.deflater); err != nil {
 		return nil, err
 	}
 
@@ -141,81 +124,81 @@ func (e *EPub) addContent(z *zip.Writer) error {
 	if err != nil {
 		return err
 	}
-
-	// First the header
-	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
-<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="BookId">
-`)
-
-	e.addMetadata(w)
-	e.addManifest(w)
-	e.addSpine(w)
-
-	// Close it off
-	fmt.Fprintf(w, "</package>\n")
-	return nil
+	return e.writeContent(w)
 }
 
-func (e *EPub) addManifest(w io.Writer) error {
-	fmt.Fprintf(w, "  <manifest>\n")
+// writeContent writes the v2 package document.
+func (e *EPub) writeContent(w io.Writer) error {
+	p := &opfPackage{
+		Xmlns:    opfNamespace,
+		Version:  "2.0",
+		UniqueID: "BookId",
+		Attrs:    e.packageAttrs(),
+		Metadata: e.v2Metadata(),
+		Manifest: e.v2Manifest(),
+		Spine:    e.spine(2),
+		Guide:    e.guide(),
+	}
+	return e.encodeXML(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n", p)
+}
 
-	fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", "ncx", "toc.ncx", "application/x-dtbncx+xml")
+// v2Manifest returns the manifest of a v2 book.
+func (e *EPub) v2Manifest() opfManifest {
+	var m opfManifest
+	add := func(id Id, name, mediaType string) {
+		m.Items = append(m.Items, opfItem{ID: id, Href: e.manifestHref(id, name), MediaType: mediaType})
+	}
 
+	if e.wantNCX(2) {
+		m.Items = append(m.Items, opfItem{ID: e.ncxID, Href: "toc.ncx", MediaType: "application/x-dtbncx+xml"})
+	}
 	for _, i := range e.images {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", i.id, i.name, "image/"+i.filetype)
+		add(i.id, i.name, "image/"+i.filetype)
 	}
 	for _, x := range e.xhtml {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", x.id, x.name, "application/xhtml+xml")
+		add(x.id, x.name, "application/xhtml+xml")
 	}
 	for _, s := range e.styles {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", s.id, s.name, "text/css")
+		add(s.id, s.name, "text/css")
 	}
-	for _, s := range e.scripts {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", s.id, s.name, "application/javascript")
+	for _, s := range e.bookScripts() {
+		add(s.id, s.name, "application/javascript")
 	}
 	for _, f := range e.fonts {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", f.id, f.name, "application/opentype")
+		add(f.id, f.name, "application/opentype")
 	}
-
-	fmt.Fprintf(w, "  </manifest>\n")
-	return nil
-}
-
-func (e *EPub) addSpine(w io.Writer) error {
-	fmt.Fprintf(w, "  <spine toc=\"ncx\">\n")
-	x := e.xhtml
-	sort.Slice(x, func(i, j int) bool {
-		return x[i].order < x[j].order || (x[i].order == x[j].order && x[i].baseOrder < x[j].baseOrder)
-	})
-	for _, n := range x {
-		fmt.Fprintf(w, "    <itemref idref=%q />\n", n.id)
+	for _, md := range e.media {
+		m.Items = append(m.Items, opfItem{ID: md.id, Href: e.manifestHref(md.id, md.name), MediaType: md.mediaType, Fallback: md.fallback})
 	}
-	fmt.Fprintf(w, "  </spine>\n")
-
-	return nil
+	return m
 }
 
-// addMetadata adds the metadata section.
-func (e *EPub) addMetadata(w io.Writer) error {
-	fmt.Fprintf(w, `  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
-`)
-
-	for _, m := range e.metadata {
-		fmt.Fprintf(w, `    <%s`, m.kind)
-		for _, p := range m.pairs {
-			fmt.Fprintf(w, ` %s%s="%s"`, p.v2prefix, p.key, p.value)
-		}
-		// If there's a value then it's a container-style XML thing
-		if len(m.value) != 0 {
-			fmt.Fprintf(w, ">%s</%s>\n", m.value, m.kind)
-		} else {
-			// No value means plain standalone element XML thing
-			fmt.Fprintf(w, " />\n")
+// spine returns the spine of a book of the given version, which is
+// the same for both versions apart from the reference to the NCX.
+func (e *EPub) spine(version float64) opfSpine {
+	s := opfSpine{TOC: e.spineTOC(version)}
+	for _, n := range e.spineOrder() {
+		ref := opfItemref{ID: itemrefID(n), IDRef: n.id, Linear: n.linear}
+		// Only v3 itemrefs have properties.
+		if version >= 3 {
+			ref.Properties = n.spineProps
 		}
+		s.Itemrefs = append(s.Itemrefs, ref)
 	}
+	return s
+}
 
-	fmt.Fprintf(w, "  </metadata>\n")
-	return nil
+// v2Metadata returns the metadata section of a v2 book.
+func (e *EPub) v2Metadata() opfMetadata {
+	md := opfMetadata{XmlnsDC: dcNamespace, XmlnsOPF: opfNamespace, Raw: e.rawMetadataXML()}
+	for _, m := range e.packageMetadata() {
+		md.Elements = append(md.Elements, m.v2Element(e.plainText(m.value)))
+	}
+	md.Elements = append(md.Elements, e.revisionElements()...)
+	md.Elements = append(md.Elements, e.drmFreeElements()...)
+	md.Elements = append(md.Elements, e.onSaleElements(2)...)
+	md.Elements = append(md.Elements, e.periodicalElements(2)...)
+	return md
 }
 
 // addToc adds the toc.ncx file.
@@ -224,38 +207,63 @@ func (e *EPub) addToc(z *zip.Writer) error {
 	if err != nil {
 		return err
 	}
+	return e.writeToc(w)
+}
 
-	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
-<!DOCTYPE ncx PUBLIC "-//NISO//DTD ncx 2005-1//EN" "http://www.daisy.org/z3986/2005/ncx-2005-1.dtd">
-
-<ncx version="2005-1" xmlns="http://www.daisy.org/z3986/2005/ncx/">
-  <head>
-    <meta name="dtb:uid" content=%q />
-    <meta name="dtb:depth" content="1" />
-    <meta name="dtb:totalPageCount" content="0" />
-    <meta name="dtb:maxPageNumber" content="0" />
-  </head>
- `, e.uuid)
-	fmt.Fprintf(w, `  <docTitle>
-    <text>%s</text>
-  </docTitle>
-`, e.title)
-
-	if len(e.authors) > 0 {
-		fmt.Fprintf(w, "  <docAuthor>\n")
-		for _, a := range e.authors {
-			fmt.Fprintf(w, "    <text>%s</text>\n", a)
-		}
-		fmt.Fprintf(w, "  </docAuthor>\n")
+// writeToc writes the NCX.
+func (e *EPub) writeToc(w io.Writer) error {
+	navPoints, order := e.ncxNavPoints(e.navpoints, 1, "navpointid")
+	n := &ncxDocument{
+		Version: "2005-1",
+		Xmlns:   "http://www.daisy.org/z3986/2005/ncx/",
+		Meta: []xmlElement{
+			newElement("meta", "", "name", "dtb:uid", "content", e.PrimaryIdentifier()),
+			newElement("meta", "", "name", "dtb:depth", "content", strconv.Itoa(ncxDepth(navPoints))),
+			newElement("meta", "", "name", "dtb:totalPageCount", "content", strconv.Itoa(len(e.pages))),
+			newElement("meta", "", "name", "dtb:maxPageNumber", "content", strconv.Itoa(len(e.pages))),
+		},
+		DocTitle: e.plainText(e.title),
+	}
+	for _, a := range e.authors {
+		n.DocAuthors = append(n.DocAuthors, e.plainText(a))
 	}
 
-	fmt.Fprintf(w, "  <navMap>\n")
-	writeNavpoints(e.navpoints, 1, "navpointid", "    ", w)
+	n.NavMap.NavPoints = navPoints
+	if e.hasBylines() {
+		n.XmlnsMbp = mbpNamespace
+	}
 
-	fmt.Fprintf(w, "  </navMap>\n")
+	if len(e.pages) > 0 {
+		n.PageList = &ncxPageList{Label: "Pages"}
+		for i, p := range e.pages {
+			n.PageList.Targets = append(n.PageList.Targets, ncxPageTarget{
+				ID:        fmt.Sprintf("pagetarget_%v", i),
+				Type:      "normal",
+				Value:     i + 1,
+				PlayOrder: order,
+				Label:     e.plainText(p.label),
+				Content:   ncxContent{Src: escapeLink(p.filename)},
+			})
+			order++
+		}
+	}
+	if len(e.illustrations) > 0 {
+		l := ncxNavList{Class: "loi", Label: "List of Illustrations"}
+		for i, p := range e.illustrations {
+			l.Targets = append(l.Targets, ncxNavTarget{
+				ID:        fmt.Sprintf("illustration_%v", i),
+				PlayOrder: order,
+				Label:     e.plainText(p.label),
+				Content:   ncxContent{Src: escapeLink(p.filename)},
+			})
+			order++
+		}
+		n.NavLists = append(n.NavLists, l)
+	}
 
-	fmt.Fprintf(w, "</ncx>\n")
-	return nil
+	return e.encodeXML(w, `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE ncx PUBLIC "-//NISO//DTD ncx 2005-1//EN" "http://www.daisy.org/z3986/2005/ncx-2005-1.dtd">
+`, n)
 }
 
 // addContainer adds the container file to the EPub.
@@ -274,21 +282,38 @@ func (e *EPub) addContainer(z *zip.Writer) error {
 	return nil
 }
 
-func writeNavpoints(np []*Navpoint, order int, baseID, prefix string, w io.Writer) int {
-	sort.Slice(np, func(i, j int) bool { return np[i].order < np[j].order })
+// ncxDepth returns the depth of the tree of navpoints, which is at
+// least 1 even for an empty navMap.
+func ncxDepth(np []ncxNavPoint) int {
+	depth := 1
+	for _, p := range np {
+		if len(p.NavPoints) > 0 {
+			if d := ncxDepth(p.NavPoints) + 1; d > depth {
+				depth = d
+			}
+		}
+	}
+	return depth
+}
 
+// ncxNavPoints returns the NCX navPoints for np, numbering them from
+// order, and the next play order number.
+func (e *EPub) ncxNavPoints(np []*Navpoint, order int, baseID string) ([]ncxNavPoint, int) {
+	np = sortedNavpoints(np)
+
+	var ret []ncxNavPoint
 	for i, n := range np {
 		id := baseID + "_" + strconv.Itoa(i)
-		fmt.Fprintf(w, "%s<navPoint id=%q playOrder=\"%v\">\n", prefix, id, order)
+		label, _ := e.tocLabel(e.navpointLabel(n))
+		p := ncxNavPoint{ID: id, Class: ncxClass(n), PlayOrder: order, Label: label, Content: ncxContent{Src: escapeLink(n.filename)}}
+		if n.byline != "" {
+			p.Meta = append(p.Meta, newElement("mbp:meta", e.plainText(n.byline), "name", "author"))
+		}
 		order++
-		fmt.Fprintf(w, "%s  <navLabel>\n", prefix)
-		fmt.Fprintf(w, "%s    <text>%s</text>\n", prefix, n.label)
-		fmt.Fprintf(w, "%s  </navLabel>\n", prefix)
-		fmt.Fprintf(w, "%s  <content src=%q />\n", prefix, n.filename)
 		if len(n.navpoints) != 0 {
-			order = writeNavpoints(n.navpoints, order, id, prefix+"  ", w)
+			p.NavPoints, order = e.ncxNavPoints(n.navpoints, order, id)
 		}
-		fmt.Fprintf(w, "%s</navPoint>\n", prefix)
+		ret = append(ret, p)
 	}
-	return order
+	return ret, order
 }
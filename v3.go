@@ -3,31 +3,23 @@ package epub
 import (
 	"archive/zip"
 	"bytes"
-	"compress/flate"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"os"
 	"regexp"
-	"sort"
+	"strings"
 	"time"
 )
 
 // This file holds the code to write epub version 3 format files.
 
-// sub performs a global search and replace, because Go's regex
-// package is a bit inconvenient to use.
-func sub(in, regex, repl string) string {
-	r := regexp.MustCompile(regex)
-	return r.ReplaceAllString(in, repl)
-}
-
 func (e *EPub) WriteV3(name string) error {
 	buf, err := e.SerializeV3()
 	if err != nil {
 		return err
 	}
 
-	if err = ioutil.WriteFile(name, buf, 0666); err != nil {
+	if err = os.WriteFile(name, buf, 0666); err != nil {
 		return err
 	}
 
@@ -35,7 +27,22 @@ func (e *EPub) WriteV3(name string) error {
 }
 
 func (e *EPub) SerializeV3() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	if err := e.runBeforeWrite(); err != nil {
+		return nil, err
+	}
+	return e.serializeV3(e.writeCache())
+}
+
+// serializeV3 builds the book, sharing compressed files through cache
+// if it's not nil.
+func (e *EPub) serializeV3(cache entryCache) ([]byte, error) {
+	defer e.cachePrepared()()
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	e.reportWarnings(3)
+
+	buf := bytes.NewBuffer(make([]byte, 0, e.contentSize()))
 	z := zip.NewWriter(buf)
 
 	// Make sure we're using deflate, which is the only compression
@@ -44,9 +51,7 @@ func (e *EPub) SerializeV3() ([]byte, error) {
 	// anyway we also turn on max compression. This doesn't make much
 	// difference for most books (text compresses really well already,
 	// and images don't) but that's fine.
-	z.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.BestCompression)
-	})
+	registerCompressor(z, e.deflater)
 
 	// add mimetype. Need to use the CreateHeader method because the
 	// mimetype file needs to be uncompressed.
@@ -58,81 +63,53 @@ func (e *EPub) SerializeV3() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Fprint(w, "application/epub+zip")
+	fmt.Fprint(w, epubMediaType)
 
-	// Add the images.
-	for _, i := range e.images {
-		w, err = z.Create("OPS/" + i.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write(i.contents)
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", i.name, length, len(i.contents), err)
-		}
+	// The container and package files come first, since reading
+	// systems need them to find everything else.
+	if err = e.addContainerV3(z); err != nil {
+		return nil, err
 	}
 
-	// Add the xhtml.
-	for _, x := range e.xhtml {
-		w, err = z.Create("OPS/" + x.name)
-		if err != nil {
-			return nil, err
-		}
-		c := x.contents
-		if e.fixV2XHTML {
-			c = fixV2XHTML(c)
-		}
-		length, err := w.Write([]byte(c))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", x.name, length, len(x.contents), err)
-		}
+	if err = e.addEncryption(z); err != nil {
+		return nil, err
 	}
 
-	// Add the css.
-	for _, s := range e.styles {
-		w, err = z.Create("OPS/" + s.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write([]byte(s.contents))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", s.name, length, len(s.contents), err)
-		}
+	if err = e.addBuildManifest(z); err != nil {
+		return nil, err
 	}
 
-	// Add the javascript.
-	for _, s := range e.scripts {
-		w, err = z.Create("OPS/" + s.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write([]byte(s.contents))
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", s.name, length, len(s.contents), err)
-		}
+	if err = e.addRenditionsV3(z); err != nil {
+		return nil, err
 	}
 
-	// Add the fonts.
-	for _, f := range e.fonts {
-		w, err = z.Create("OPS/" + f.name)
-		if err != nil {
-			return nil, err
-		}
-		length, err := w.Write(f.contents)
-		if err != nil {
-			return nil, fmt.Errorf("unable to write %v, %v of %v bytes: %v", f.name, length, len(f.contents), err)
-		}
+	// Add the book's files. They're written in reading order, so
+	// streaming readers can show the first pages early, and any
+	// preloaded ones (see SetPreload) go ahead of the table of
+	// contents.
+	entries, err := e.zipEntries(3)
+	if err != nil {
+		return nil, err
+	}
+	if entries, err = e.transformEntries(entries); err != nil {
+		return nil, err
+	}
+	entries, n := e.preloadEntries(e.obfuscateEntries(entries))
+	if err = writeZipEntries(z, entries[:n], cache, e.deflater); err != nil {
+		return nil, err
 	}
 
 	if err = e.addTocV3(z); err != nil {
 		return nil, err
 	}
 
-	if err = e.addContainerV3(z); err != nil {
-		return nil, err
+	if e.wantNCX(3) {
+		if err = e.addToc(z); err != nil {
+			return nil, err
+		}
 	}
 
-	if err = e.addRenditionsV3(z); err != nil {
+	if err = writeZipEntries(z, entries[n:], cache, e.deflater); err != nil {
 		return nil, err
 	}
 
@@ -145,11 +122,6 @@ func (e *EPub) SerializeV3() ([]byte, error) {
 
 }
 
-func (e *EPub) obfuscate(raw []byte) []byte {
-
-	return nil
-}
-
 func (e *EPub) addContainerV3(z *zip.Writer) error {
 	w, err := z.Create("META-INF/container.xml")
 	if err != nil {
@@ -184,131 +156,172 @@ func (e *EPub) addRenditionsV3(z *zip.Writer) error {
 	if err != nil {
 		return err
 	}
+	return e.writeRenditionV3(w)
+}
 
-	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
-	fmt.Fprintf(w, "<package xmlns=\"http://www.idpf.org/2007/opf\" version=\"3.0\" unique-identifier=\"BookId\">\n")
-
-	e.addV3Metadata(w)
-	e.addV3Manifest(w)
-	e.addV3Spine(w)
-
-	fmt.Fprintf(w, "</package>\n")
-
-	return nil
+// writeRenditionV3 writes the v3 package document.
+func (e *EPub) writeRenditionV3(w io.Writer) error {
+	p := &opfPackage{
+		Xmlns:    opfNamespace,
+		Version:  "3.0",
+		UniqueID: "BookId",
+		Attrs:    e.packageAttrs(),
+		Metadata: e.v3Metadata(),
+		Manifest: e.v3Manifest(),
+		Spine:    e.spine(3),
+	}
+	// The guide is a legacy feature, but books that carry an NCX for
+	// older reading systems benefit from it too.
+	if e.wantNCX(3) {
+		p.Guide = e.guide()
+	}
+	return e.encodeXML(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n", p)
 }
 
-func (e *EPub) addV3Metadata(w io.Writer) error {
-	fmt.Fprintf(w, "  <metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n")
+// v3Metadata returns the metadata section of a v3 book.
+func (e *EPub) v3Metadata() opfMetadata {
+	md := opfMetadata{XmlnsDC: dcNamespace, Raw: e.rawMetadataXML()}
+	add := func(name, text string, attrs ...string) {
+		md.Elements = append(md.Elements, newElement(name, text, attrs...))
+	}
 	idCount := 0
 	seenDCTerms := false
-	for _, m := range e.metadata {
+	for _, m := range e.packageMetadata() {
 		idCount++
 		switch m.kind {
 		case "meta":
-			// We skip the meta entries, they're probably cover image
+			// We skip the meta entries, they're probably cover image,
+			// unless we've been asked to keep the cover one.
+			if e.coverMeta {
+				x := newElement("meta", "")
+				for _, p := range m.pairs {
+					x.Attrs = append(x.Attrs, xmlAttr(p.key, p.value))
+				}
+				md.Elements = append(md.Elements, x)
+			}
 		case "dc:identifier":
-			fmt.Fprintf(w, `    <dc:identifier id="BookId">%s</dc:identifier>`, m.value)
-			fmt.Fprintf(w, "\n")
+			id := fmt.Sprintf("id%v", idCount)
+			if isBookID(m) {
+				id = "BookId"
+			}
+			add("dc:identifier", m.value, "id", id)
 		default:
 			// Note if we've seen a modified time entry. We need one, and
 			// will add one if necessary.
 			if m.kind == "dcterms:modified" {
 				seenDCTerms = true
 			}
-			fmt.Fprintf(w, `    <%s id="id%v"`, m.kind, idCount)
-			// If there's a value then it's a container-style XML thing
-			if len(m.value) != 0 {
-				fmt.Fprintf(w, ">%s</%s>\n", m.value, m.kind)
-			} else {
-				// No value means plain standalone element XML thing
-				fmt.Fprintf(w, " />\n")
-			}
-			// Write out the modifiers.
-			for _, p := range m.pairs {
-				fmt.Fprintf(w, `    <meta refines="#id%v" property="%s%s"`, idCount, p.v3prefix, p.key)
-				if p.scheme != "" {
-					fmt.Fprintf(w, ` scheme="%s"`, p.scheme)
-				}
-				fmt.Fprintf(w, ">%s</meta>\n", p.value)
-			}
+			id := fmt.Sprintf("id%v", idCount)
+			md.Elements = append(md.Elements, m.v3Elements(id, e.plainText(m.value))...)
 		}
 	}
 	if !seenDCTerms {
-		fmt.Fprintf(w, "    <meta property=\"dcterms:modified\">%s</meta>\n", time.Now().Format("2006-01-02T15:04:05Z"))
+		add("meta", time.Now().Format("2006-01-02T15:04:05Z"), "property", "dcterms:modified")
 	}
 	if e.seriesName != "" || e.setName != "" {
 		if e.seriesName != "" {
-			fmt.Fprintf(w, "    <meta property=\"belongs-to-collection\" id=\"seriesinfo\">%s</meta>\n", e.seriesName)
-			fmt.Fprint(w, "    <meta refines=\"#seriesinfo\" property=\"collection-type\">series</meta>\n")
+			add("meta", e.plainText(e.seriesName), "property", "belongs-to-collection", "id", "seriesinfo")
+			add("meta", "series", "refines", "#seriesinfo", "property", "collection-type")
 		}
 		if e.setName != "" {
-			fmt.Fprintf(w, "    <meta property=\"belongs-to-collection\" id=\"seriesinfo\">%s</meta>\n", e.setName)
-			fmt.Fprint(w, "    <meta refines=\"#seriesinfo\" property=\"collection-type\">set</meta>\n")
+			add("meta", e.plainText(e.setName), "property", "belongs-to-collection", "id", "seriesinfo")
+			add("meta", "set", "refines", "#seriesinfo", "property", "collection-type")
 		}
 		if e.entry != "" {
-			fmt.Fprintf(w, "    <meta refines=\"#seriesinfo\" property=\"group-position\">%s</meta>\n", e.entry)
+			add("meta", e.entry, "refines", "#seriesinfo", "property", "group-position")
 		}
 	}
-	fmt.Fprintf(w, "  </metadata>\n")
-
-	return nil
+	for _, n := range e.narrators {
+		add("meta", e.plainText(n), "property", "media:narrator")
+	}
+	if e.fixedLayout {
+		add("meta", "pre-paginated", "property", "rendition:layout")
+		add("meta", "none", "property", "rendition:spread")
+	}
+	md.Elements = append(md.Elements, e.revisionElements()...)
+	md.Elements = append(md.Elements, e.drmFreeElements()...)
+	md.Elements = append(md.Elements, e.onSaleElements(3)...)
+	md.Elements = append(md.Elements, e.chapterMetaElements()...)
+	md.Elements = append(md.Elements, e.periodicalElements(3)...)
+	md.Elements = append(md.Elements, e.eduElements()...)
+	md.Elements = append(md.Elements, e.linkElements()...)
+	return md
 }
 
-func (e *EPub) addV3Manifest(w io.Writer) error {
-	fmt.Fprintf(w, "  <manifest>\n")
+// v3Manifest returns the manifest of a v3 book.
+func (e *EPub) v3Manifest() opfManifest {
+	var m opfManifest
+	add := func(id Id, name, mediaType, properties string) {
+		m.Items = append(m.Items, opfItem{ID: id, Href: e.manifestHref(id, name), MediaType: mediaType, Properties: properties})
+	}
 
 	for _, i := range e.images {
-		extraBits := ""
+		props := ""
 		if i.id == e.coverID {
-			extraBits += ` properties="cover-image"`
+			props = "cover-image"
 		}
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q %s/>\n", i.id, i.name, "image/"+i.filetype, extraBits)
+		add(i.id, i.name, "image/"+i.filetype, props)
 	}
 	for _, x := range e.xhtml {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", x.id, x.name, "application/xhtml+xml")
+		add(x.id, x.name, "application/xhtml+xml", strings.Join(e.xhtmlProperties(x, 3), " "))
 	}
 	for _, s := range e.styles {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", s.id, s.name, "text/css")
+		props := ""
+		if hasAllowedRemote(e.styleRemoteRefs(s)) {
+			props = "remote-resources"
+		}
+		add(s.id, s.name, "text/css", props)
 	}
-	for _, s := range e.scripts {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", s.id, s.name, "application/javascript")
+	for _, s := range e.bookScripts() {
+		add(s.id, s.name, e.scriptMediaType(), "")
 	}
 	for _, f := range e.fonts {
-		fmt.Fprintf(w, "    <item id=%q href=%q media-type=%q />\n", f.id, f.name, "application/opentype")
+		add(f.id, f.name, e.fontMediaType(), "")
+	}
+	for _, md := range e.media {
+		m.Items = append(m.Items, opfItem{ID: md.id, Href: e.manifestHref(md.id, md.name), MediaType: md.mediaType, Fallback: md.fallback})
 	}
 	// Add an entry for our TOC. Needs the "nav" property to note TOC-ness.
-	fmt.Fprintf(w, "    <item id=%q properties=%q href=%q media-type=%q	/>\n", "ncx", "nav", "__toc.xhtml", "application/xhtml+xml")
-	fmt.Fprintf(w, "  </manifest>\n")
-	return nil
+	m.Items = append(m.Items, opfItem{ID: e.navID, Href: "__toc.xhtml", MediaType: "application/xhtml+xml", Properties: "nav"})
+	if e.wantNCX(3) {
+		m.Items = append(m.Items, opfItem{ID: e.ncxID, Href: "toc.ncx", MediaType: "application/x-dtbncx+xml"})
+	}
+	return m
 }
 
-func (e *EPub) addV3Spine(w io.Writer) error {
-	fmt.Fprintf(w, "  <spine>\n")
-	x := e.xhtml
-	sort.Slice(x, func(i, j int) bool {
-		return x[i].order < x[j].order || (x[i].order == x[j].order && x[i].baseOrder < x[j].baseOrder)
-	})
-	for _, n := range x {
-		fmt.Fprintf(w, "    <itemref idref=%q />\n", n.id)
+// fontMediaType returns the manifest media type for fonts, which are
+// all OpenType. EPUB 3.0 books keep the historical
+// application/opentype type, which reading systems have long accepted;
+// 3.3 books use the registered font/otf type.
+func (e *EPub) fontMediaType() string {
+	if e.version == 3.3 {
+		return "font/otf"
 	}
+	return "application/opentype"
+}
 
-	fmt.Fprintf(w, "  </spine>\n")
-	return nil
+// scriptMediaType returns the manifest media type for JavaScript
+// files. EPUB 3.3 prefers text/javascript, per RFC 9239.
+func (e *EPub) scriptMediaType() string {
+	if e.version == 3.3 {
+		return "text/javascript"
+	}
+	return "application/javascript"
 }
 
+// v2DoctypeRE matches the DOCTYPE of a v2-compatible xhtml file.
+var v2DoctypeRE = regexp.MustCompile(`^(?ms)(<\?xml[^>]*>\s*<!DOCTYPE)\b[^>]*>`)
+
 // fixV2XHTML patches up epub v2-compatible xhtml to make it v3
 // compatible. It's annoying to have to do this, but files that are
 // fine for v2 don't work for v3, and vice versa.
-func fixV2XHTML(o string) string {
-	ret := o
+func fixV2XHTML(o []byte) []byte {
 	// v2 xhtml wants a:
 	// <!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
 	// tag, but v3 wants:
 	// <!DOCTYPE html>
 	// so strip out the extra doctype bits for v3 cleanup.
-	ret = sub(ret, `^(?ms)(<\?xml[^>]*>\s*<!DOCTYPE)\b[^>]*>`, "$1 html>")
-
-	return ret
+	return v2DoctypeRE.ReplaceAll(o, []byte("$1 html>"))
 }
 
 func (e *EPub) addTocV3(z *zip.Writer) error {
@@ -316,38 +329,55 @@ func (e *EPub) addTocV3(z *zip.Writer) error {
 	if err != nil {
 		return err
 	}
+	return e.writeTocV3(w)
+}
 
-	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
-<!DOCTYPE xhtml>
-<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
-<head>
-<title>%s</title>
-</head>
-<body>`, e.title)
-	fmt.Fprintf(w, `<nav epub:type="toc" id="toc">
-  <h1>Table of Contents</h1>
-`)
-	writeV3Navpoints(e.navpoints, "    ", w)
-
-	fmt.Fprintf(w, "</nav>\n")
-	fmt.Fprintf(w, "</body>\n")
-	fmt.Fprintf(w, "</html>\n")
-	return nil
+// writeTocV3 writes the v3 nav document.
+func (e *EPub) writeTocV3(w io.Writer) error {
+	n := &navDocument{
+		Xmlns:     "http://www.w3.org/1999/xhtml",
+		XmlnsEpub: "http://www.idpf.org/2007/ops",
+		Title:     e.plainText(e.title),
+		Navs: []navNav{{
+			Type:    "toc",
+			ID:      "toc",
+			Heading: "Table of Contents",
+			List:    e.navList(e.navpoints),
+		}},
+	}
+	if len(e.pages) > 0 {
+		pages := navNav{Type: "page-list", Hidden: "hidden"}
+		for _, p := range e.pages {
+			pages.List.Items = append(pages.List.Items, navItem{Link: navLink{Href: escapeLink(p.filename), Text: e.plainText(p.label)}})
+		}
+		n.Navs = append(n.Navs, pages)
+	}
+	if len(e.illustrations) > 0 {
+		loi := navNav{Type: "loi", Heading: "List of Illustrations", Hidden: "hidden"}
+		for _, p := range e.illustrations {
+			loi.List.Items = append(loi.List.Items, navItem{Link: navLink{Href: escapeLink(p.filename), Text: e.plainText(p.label)}})
+		}
+		n.Navs = append(n.Navs, loi)
+	}
+	if l := e.landmarksNav(); l != nil {
+		n.Navs = append(n.Navs, *l)
+	}
+	return e.encodeXML(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE xhtml>\n", n)
 }
 
-func writeV3Navpoints(np []*Navpoint, prefix string, w io.Writer) {
-	fmt.Fprintf(w, "%s<ol>\n", prefix)
-	sort.Slice(np, func(i, j int) bool { return np[i].order < np[j].order })
+// navList returns the nav document list for np.
+func (e *EPub) navList(np []*Navpoint) navList {
+	np = sortedNavpoints(np)
 
+	var l navList
 	for _, n := range np {
-		fmt.Fprintf(w, "%s  <li>\n", prefix)
-		fmt.Fprintf(w, "%s    <a href=%q>%s</a>\n", prefix, n.filename, n.label)
-
+		label, title := e.tocLabel(e.navpointLabel(n))
+		item := navItem{Link: navLink{Href: escapeLink(n.filename), Title: title, Text: label}}
 		if len(n.navpoints) != 0 {
-			writeV3Navpoints(n.navpoints, prefix+"  ", w)
+			sub := e.navList(n.navpoints)
+			item.List = &sub
 		}
-		fmt.Fprintf(w, "%s</li>\n", prefix)
+		l.Items = append(l.Items, item)
 	}
-
-	fmt.Fprintf(w, "%s</ol>\n", prefix)
+	return l
 }
@@ -0,0 +1,146 @@
+package epub
+
+// This file holds the checks we run on a book before writing it out.
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Validate checks the book for structural problems that would make
+// it an invalid ePub, and returns an error describing the first one
+// found. The checks are run automatically when the book is written,
+// but it can be useful to call Validate directly to find problems
+// early.
+//
+// This is not a replacement for an external validator such as
+// ePubCheck; it only catches mistakes that this package can easily
+// detect, such as stylesheets that import or refer to files that
+// aren't in the book. It also checks the book against its size
+// budget, if one was set with SetSizeBudget, runs any content audits
+// added with AddContentAudit, checks the requirements of the EDUPUB
+// profile (see SetEduProfile), runs the extra checks of strict mode
+// (see SetStrict), and refuses books under embargo (see SetEmbargo).
+// Errors from the options passed to New are returned first.
+func (e *EPub) Validate() error {
+	if e.optionErr != nil {
+		return e.optionErr
+	}
+	if err := e.validateEmbargo(); err != nil {
+		return err
+	}
+	if err := e.validateIDs(); err != nil {
+		return err
+	}
+	if err := e.validateSpine(); err != nil {
+		return err
+	}
+	if err := e.validateParts(); err != nil {
+		return err
+	}
+	if err := e.validateDRMFree(); err != nil {
+		return err
+	}
+	if err := e.validateStyleReferences(); err != nil {
+		return err
+	}
+	if err := e.validateEduProfile(); err != nil {
+		return err
+	}
+	if err := e.validateStrict(); err != nil {
+		return err
+	}
+	if err := e.validateSize(); err != nil {
+		return err
+	}
+	if err := e.validateEncryption(); err != nil {
+		return err
+	}
+	if err := e.validateBuildManifest(); err != nil {
+		return err
+	}
+	return e.validateContent()
+}
+
+// validateIDs checks that every manifest ID, including the ones for
+// files we generate, is unique.
+func (e *EPub) validateIDs() error {
+	seen := map[Id]bool{e.navID: true, e.ncxID: true}
+	for _, id := range e.manifestIDs() {
+		if seen[id] {
+			return errorf(ErrDuplicateID, "manifest ID %v is used more than once", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// validateSpine checks that the spine is non-empty and that every
+// spine entry references a distinct manifest item exactly once.
+func (e *EPub) validateSpine() error {
+	if len(e.xhtml) == 0 {
+		return errorf(ErrEmptySpine, "spine is empty: add at least one XHTML file with AddXHTML or AddXHTMLFile")
+	}
+	ids := make(map[Id]string)
+	names := make(map[string]Id)
+	for _, x := range e.xhtml {
+		if prev, ok := ids[x.id]; ok {
+			return errorf(ErrDuplicateID, "spine references manifest item %v twice (%q and %q)", x.id, prev, x.name)
+		}
+		ids[x.id] = x.name
+		if prev, ok := names[x.name]; ok {
+			return errorf(ErrDuplicatePath, "XHTML file %q was added twice (as %v and %v); each file may only appear in the spine once", x.name, prev, x.id)
+		}
+		names[x.name] = x.id
+	}
+	return nil
+}
+
+// deprecatedXHTMLRE matches XHTML elements that EPUB 3.3 deprecates.
+var deprecatedXHTMLRE = regexp.MustCompile(`<epub:(switch|trigger)\b`)
+
+// deprecatedMetaRE matches package metadata that EPUB 3.3 deprecates.
+var deprecatedMetaRE = regexp.MustCompile(`property="rendition:viewport"|property="rendition:spread"[^>]*>\s*portrait\b`)
+
+// Warnings returns descriptions of things in the book that are legal
+// but deprecated or discouraged in the version it targets. Unlike
+// Validate, problems found here don't stop the book being written.
+// Images without alt text (see SetAltText), images over the
+// per-image size budget set with SetSizeBudget, fonts whose licenses
+// limit embedding them (see FontInfo), files that aren't core media
+// types and have no fallback (see RegisterMediaType), content
+// documents that don't suit their content profile (see
+// SetContentProfile), covers that don't meet the guidelines of the
+// retailers set with SetTargetRetailers, images, stylesheets, and
+// other resources loaded from the web that must be in the book (see
+// LocalizeRemoteResources), and warnings from content audits are
+// reported for every book; the other checks are for EPUB
+// 3.3 books (SetVersion(3.3)) only.
+func (e *EPub) Warnings() []string {
+	warnings := append(e.altTextWarnings(), e.orientationWarnings()...)
+	warnings = append(warnings, e.sizeWarnings()...)
+	warnings = append(warnings, e.fontWarnings()...)
+	warnings = append(warnings, e.foreignWarnings()...)
+	warnings = append(warnings, e.profileWarnings()...)
+	warnings = append(warnings, e.retailWarnings()...)
+	warnings = append(warnings, e.auditWarnings()...)
+	warnings = append(warnings, e.semanticWarnings()...)
+	warnings = append(warnings, e.remoteWarnings()...)
+	if e.version != 3.3 {
+		return warnings
+	}
+	if e.wantNCX(3) {
+		warnings = append(warnings, "the NCX is a legacy feature in EPUB 3.3; reading systems use the nav document instead")
+	}
+	for _, x := range e.xhtml {
+		if m := deprecatedXHTMLRE.FindSubmatch(x.contents); m != nil {
+			warnings = append(warnings, fmt.Sprintf("%v uses the epub:%s element, which EPUB 3.3 deprecates", x.name, m[1]))
+		}
+	}
+	for _, m := range e.rawMetadata {
+		if deprecatedMetaRE.MatchString(m) {
+			warnings = append(warnings, fmt.Sprintf("metadata %q is deprecated in EPUB 3.3", m))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,107 @@
+package epub
+
+// This file holds the code that strips the metadata and files that
+// ebook editors and stores leave in books.
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// vendorMetaRE matches raw meta elements written by calibre and
+	// Sigil.
+	vendorMetaRE = regexp.MustCompile(`^<meta\b[^>]*\b(name|property)\s*=\s*["'](calibre:|Sigil version["'])`)
+	// vendorMarkerRE matches the section markers Sigil leaves in
+	// XHTML files for splitting them.
+	vendorMarkerRE = regexp.MustCompile(`(?i)[ \t]*<hr\b[^>]*\bclass\s*=\s*["'](sigil_split_marker|sigilChapterBreak)["'][^>]*/?>[ \t]*\n?`)
+	// vendorToolRE matches the names of tools that record themselves
+	// as the book's producer.
+	vendorToolRE = regexp.MustCompile(`^(calibre|Sigil)\b`)
+)
+
+// vendorFiles are the names of files that ebook tools and stores
+// leave in books, which never belong in retail copies.
+var vendorFiles = map[string]bool{
+	"iTunesMetadata.plist":                 true,
+	"iTunesArtwork":                        true,
+	"calibre_bookmarks.txt":                true,
+	"com.apple.ibooks.display-options.xml": true,
+	".DS_Store":                            true,
+	"Thumbs.db":                            true,
+}
+
+// StripVendorMetadata removes the metadata and files that ebook
+// editors and stores leave in books, so books read with Open can be
+// written back out clean and ready for retail. It removes:
+//
+//   - calibre's meta elements, such as calibre:timestamp and
+//     calibre:title_sort, and Sigil's "Sigil version" meta element
+//   - calibre and Sigil book producer contributor entries
+//   - calibre's own identifiers, unless one is the primary identifier
+//   - files such as iTunesMetadata.plist and calibre_bookmarks.txt
+//   - the section markers Sigil leaves in XHTML files
+//
+// Files that aren't in the manifest, like the calibre_bookmarks.txt
+// calibre usually puts in META-INF, are never read by Open in the
+// first place.
+//
+// Returns a description of each thing removed.
+func (e *EPub) StripVendorMetadata() []string {
+	var removed []string
+
+	raw := e.rawMetadata[:0]
+	for _, r := range e.rawMetadata {
+		if vendorMetaRE.MatchString(strings.TrimSpace(r)) {
+			removed = append(removed, fmt.Sprintf("metadata %v", strings.TrimSpace(r)))
+			continue
+		}
+		raw = append(raw, r)
+	}
+	e.rawMetadata = raw
+
+	primary := e.PrimaryIdentifier()
+	md := e.metadata[:0]
+	for _, m := range e.metadata {
+		if isVendorMetadata(m, primary) {
+			removed = append(removed, fmt.Sprintf("%v %q", m.kind, m.value))
+			continue
+		}
+		md = append(md, m)
+	}
+	e.metadata = md
+
+	media := e.media[:0]
+	for _, m := range e.media {
+		if vendorFiles[path.Base(m.name)] {
+			removed = append(removed, fmt.Sprintf("file %v", m.name))
+			continue
+		}
+		media = append(media, m)
+	}
+	e.media = media
+
+	for i, x := range e.xhtml {
+		if vendorMarkerRE.Match(x.contents) {
+			e.xhtml[i].contents = vendorMarkerRE.ReplaceAll(x.contents, nil)
+			removed = append(removed, fmt.Sprintf("section markers in %v", x.name))
+		}
+	}
+	return removed
+}
+
+// isVendorMetadata reports whether m is metadata an ebook tool added
+// about itself.
+func isVendorMetadata(m metadata, primary string) bool {
+	for _, p := range m.pairs {
+		switch {
+		case m.kind == "dc:contributor" && p.key == "role" && p.value == "bkp":
+			return vendorToolRE.MatchString(m.value)
+		case m.kind == "dc:identifier" && p.key == "scheme" && strings.EqualFold(p.value, "calibre"):
+			return m.value != primary
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package epub
+
+// This file holds a quick check of a book's container, for rejecting
+// files that aren't ePubs before doing anything expensive with them.
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+)
+
+// mimetypeOffset is where the mimetype file's contents start in an
+// ePub: right after its local file header, which has no extra field
+// and is the first thing in the archive. Tools that sniff file types
+// look for "mimetypeapplication/epub+zip" at offset 30.
+const mimetypeOffset = 30 + len("mimetype")
+
+// epubMediaType is the contents of an ePub's mimetype file.
+const epubMediaType = "application/epub+zip"
+
+// VerifyFile checks that the named file meets the basic requirements
+// of the ePub container format: it's a ZIP archive whose first file
+// is an uncompressed mimetype file, with no extra field, holding
+// exactly "application/epub+zip"; it has a META-INF/container.xml;
+// and every package document the container lists is in the archive.
+//
+// Only the archive's directory, the mimetype file, and container.xml
+// are read, so VerifyFile is cheap enough to gate uploads with. A book
+// that passes can still be invalid in other ways; use Open to read it
+// properly. Problems with the container are reported as
+// ErrUnsupportedFormat.
+func VerifyFile(name string) error {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+
+	if len(z.File) == 0 || z.File[0].Name != "mimetype" {
+		return errorf(ErrUnsupportedFormat, "the first file in the archive must be mimetype")
+	}
+	m := z.File[0]
+	if m.Method != zip.Store {
+		return errorf(ErrUnsupportedFormat, "mimetype must be stored uncompressed")
+	}
+	if off, err := m.DataOffset(); err != nil {
+		return err
+	} else if off != int64(mimetypeOffset) {
+		return errorf(ErrUnsupportedFormat, "mimetype must start the archive and have no extra field")
+	}
+	r, err := m.Open()
+	if err != nil {
+		return err
+	}
+	mt, err := io.ReadAll(io.LimitReader(r, int64(len(epubMediaType))+1))
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if string(mt) != epubMediaType {
+		return errorf(ErrUnsupportedFormat, "mimetype is %q, not %q", mt, epubMediaType)
+	}
+
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	c, ok := files["META-INF/container.xml"]
+	if !ok {
+		return errorf(ErrUnsupportedFormat, "no META-INF/container.xml")
+	}
+	cr, err := c.Open()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	container, err := parseXML(cr)
+	if err != nil {
+		return fmt.Errorf("unable to parse META-INF/container.xml: %v", err)
+	}
+	rootfiles := container.findAll("rootfile")
+	if len(rootfiles) == 0 {
+		return errorf(ErrUnsupportedFormat, "container has no rootfile")
+	}
+	for _, rf := range rootfiles {
+		p := rf.attr("full-path")
+		if p == "" {
+			return errorf(ErrUnsupportedFormat, "container has a rootfile with no full-path")
+		}
+		if _, ok := files[p]; !ok {
+			return errorf(ErrUnsupportedFormat, "no package document %v", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package epub
+
+// This file holds the code that reports non-fatal issues to the
+// caller as the book is written.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Warning is a non-fatal issue found while writing the book, such as
+// a fix this package applied to a file or a manifest property it
+// inferred.
+type Warning struct {
+	// Path is the path of the file in the book the warning is about,
+	// or empty if it's about the whole book.
+	Path string
+	// Message describes the issue.
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Path == "" {
+		return w.Message
+	}
+	return w.Path + ": " + w.Message
+}
+
+// SetWarningHandler sets a function that's called with each
+// non-fatal issue found when the book is written with Write,
+// Serialize, or their version-specific forms. The handler gets the
+// warnings Warnings reports, and also learns of the things this
+// package did to the book along the way that would otherwise go
+// unseen: DOCTYPEs rewritten for the content profile, scripts stripped, manifest
+// properties inferred, navigation links or DRM-free notices that
+// couldn't be added, and table of contents labels that were shortened.
+//
+// Warnings never stop the book being written; see SetStrict for that.
+// Passing nil turns the handler off again.
+func (e *EPub) SetWarningHandler(h func(Warning)) {
+	e.warningHandler = h
+}
+
+// reportWarnings passes the warnings for writing the book in the
+// given version to the warning handler, if there is one.
+func (e *EPub) reportWarnings(version float64) {
+	if e.warningHandler == nil {
+		return
+	}
+	for _, w := range e.writeWarnings(version) {
+		e.warningHandler(w)
+	}
+}
+
+// writeWarnings returns the warnings for writing the book in the
+// given version.
+func (e *EPub) writeWarnings(version float64) []Warning {
+	var ret []Warning
+	for _, w := range e.Warnings() {
+		ret = append(ret, Warning{Message: w})
+	}
+	for _, x := range e.spineOrder() {
+		warn := func(format string, args ...interface{}) {
+			ret = append(ret, Warning{Path: x.name, Message: fmt.Sprintf(format, args...)})
+		}
+		if p := e.fileProfile(x, version); e.fixesDoctype(x, version) && !bytes.Equal(fixDoctype(x.contents, p), x.contents) {
+			warn("DOCTYPE rewritten for %v", p)
+		}
+		if e.stripScripts && !bytes.Equal(stripScripts(x.contents), x.contents) {
+			warn("scripts removed")
+		}
+		noBody := bodyStartRE.Find(x.contents) == nil || bodyCloseRE.Find(x.contents) == nil
+		prev, next := e.spineNeighbours(x)
+		if noBody && e.navLinks != nil && (prev != nil || next != nil) {
+			warn("no body element, so navigation links weren't added")
+		}
+		if noBody && e.drmFree && next == nil {
+			warn("no body element, so the DRM-free notice wasn't added")
+		}
+		if version >= 3 {
+			if props := e.xhtmlProperties(x, version); len(props) > 0 {
+				warn("manifest properties inferred: %v", strings.Join(props, " "))
+			}
+		}
+	}
+	var walk func(np []*Navpoint)
+	walk = func(np []*Navpoint) {
+		for _, n := range np {
+			if text, full := e.tocLabel(e.navpointLabel(n)); full != "" {
+				ret = append(ret, Warning{Path: n.filename, Message: fmt.Sprintf("table of contents label %q shortened to %q", full, text)})
+			}
+			walk(n.navpoints)
+		}
+	}
+	walk(e.navpoints)
+	return ret
+}
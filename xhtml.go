@@ -0,0 +1,322 @@
+package epub
+
+// This file holds the code that patches up XHTML files as they're
+// written out.
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var headCloseRE = regexp.MustCompile(`(?i)</head\s*>`)
+
+// preparedKey identifies a file prepared for a book of a given
+// version. Stylesheets, which are the same in every version, have
+// version 0.
+type preparedKey struct {
+	id      Id
+	version float64
+}
+
+// preparedCache holds what's worked out from the book's files while
+// it's written, so validation, the warnings, the manifest, and the zip
+// writer share the work.
+type preparedCache struct {
+	xhtml map[preparedKey][]byte      // Prepared XHTML contents
+	refs  map[preparedKey][]remoteRef // References to remote resources
+}
+
+// cachePrepared turns on the cache of prepared files while the book
+// is written, and returns the function that turns it off again.
+func (e *EPub) cachePrepared() func() {
+	if e.prepared != nil {
+		// Already on; whoever turned it on turns it off.
+		return func() {}
+	}
+	e.prepared = &preparedCache{
+		xhtml: make(map[preparedKey][]byte),
+		refs:  make(map[preparedKey][]remoteRef),
+	}
+	return func() { e.prepared = nil }
+}
+
+// prepareXHTML returns the contents of x as they should be written
+// into a book of the given version.
+// The original contents are never modified; if nothing needs changing
+// they're returned as-is, without copying.
+func (e *EPub) prepareXHTML(x xhtml, version float64) []byte {
+	if e.prepared == nil {
+		return e.prepareXHTMLContents(x, version)
+	}
+	k := preparedKey{x.id, version}
+	c, ok := e.prepared.xhtml[k]
+	if !ok {
+		c = e.prepareXHTMLContents(x, version)
+		e.prepared.xhtml[k] = c
+	}
+	return c
+}
+
+// prepareXHTMLContents does the work of prepareXHTML.
+func (e *EPub) prepareXHTMLContents(x xhtml, version float64) []byte {
+	c := x.contents
+	profile := e.fileProfile(x, version)
+	// V2 books pass their files through unless a profile's been asked
+	// for, apart from losing the srcset attributes of image sets (see
+	// AddImagePageSet).
+	if e.fixesDoctype(x, version) {
+		c = fixDoctype(c, profile)
+	} else {
+		c = stripSrcset(c)
+	}
+	if e.stripScripts {
+		c = stripScripts(c)
+	}
+	c = e.hyphenate(c)
+	if e.propagateLanguage {
+		c = addLanguage(c, e.language(), profile)
+	}
+	if e.navLinks != nil {
+		c = e.addNavLinks(x, c)
+	}
+	if e.drmFree {
+		c = e.addDRMFreeNotice(x, c)
+	}
+	if e.headingSlug != nil {
+		c, _ = addHeadingIDs(c, e.headingSlug)
+	}
+	if e.hasAltText {
+		c = e.fillAltText(x.name, c)
+	}
+	if e.numbering != nil && e.numbering.Headings {
+		c = e.numberHeading(x.name, c)
+	}
+	c = e.linkStylesheets(x.name, c)
+	c = e.linkLanguageStyle(x, c)
+	c = e.linkScripts(x.name, c)
+	return c
+}
+
+var (
+	scriptRE = regexp.MustCompile(`(?i)<script\b`)
+	mathRE   = regexp.MustCompile(`<(\w+:)?math\b`)
+)
+
+// xhtmlProperties returns the v3 manifest properties for x when it's
+// written in a book of the given version.
+func (e *EPub) xhtmlProperties(x xhtml, version float64) []string {
+	contents := e.prepareXHTML(x, version)
+	var props []string
+	if mathRE.Match(contents) {
+		props = append(props, "mathml")
+	}
+	if scriptRE.Match(contents) {
+		props = append(props, "scripted")
+	}
+	if hasAllowedRemote(e.xhtmlRemoteRefs(x, version)) {
+		props = append(props, "remote-resources")
+	}
+	return props
+}
+
+var (
+	scriptElementRE = regexp.MustCompile(`(?is)<script\b[^>]*?(/>|>.*?</script\s*>)`)
+	eventAttrRE     = regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// stripScripts removes script elements and event handler attributes
+// from XHTML contents.
+func stripScripts(c []byte) []byte {
+	if !scriptRE.Match(c) && !eventAttrRE.Match(c) {
+		return c
+	}
+	c = scriptElementRE.ReplaceAll(c, nil)
+	return eventAttrRE.ReplaceAll(c, nil)
+}
+
+var (
+	htmlStartRE = regexp.MustCompile(`<html\b[^>]*>`)
+	langAttrRE  = regexp.MustCompile(`\s(xml:)?lang\s*=`)
+)
+
+// addLanguage adds language attributes to the html element of XHTML
+// contents that doesn't have any. XHTML 1.1 only has xml:lang; XHTML5
+// files get both xml:lang and lang.
+func addLanguage(c []byte, lang string, profile ContentProfile) []byte {
+	if lang == "" {
+		return c
+	}
+	loc := htmlStartRE.FindIndex(c)
+	if loc == nil || langAttrRE.Match(c[loc[0]:loc[1]]) {
+		return c
+	}
+	attrs := " " + attrPair("xml:lang", lang)
+	if profile == ProfileXHTML5 {
+		attrs += " " + attrPair("lang", lang)
+	}
+	end := loc[1] - 1
+	ret := make([]byte, 0, len(c)+len(attrs))
+	ret = append(ret, c[:end]...)
+	ret = append(ret, attrs...)
+	return append(ret, c[end:]...)
+}
+
+// relativeHref returns the href that refers to the book file target
+// from the book file from. The href is percent-encoded.
+func relativeHref(from, target string) string {
+	dir := path.Dir(from)
+	if dir == "." {
+		return escapePath(target)
+	}
+	fromParts := strings.Split(dir, "/")
+	targetParts := strings.Split(target, "/")
+	i := 0
+	for i < len(fromParts) && i < len(targetParts)-1 && fromParts[i] == targetParts[i] {
+		i++
+	}
+	return escapePath(strings.Repeat("../", len(fromParts)-i) + strings.Join(targetParts[i:], "/"))
+}
+
+// escapePath percent-encodes a book file path for use as an href, so
+// names with spaces or non-ASCII characters make valid IRIs. Zip
+// entry names are never escaped, only references to them. The path is
+// a raw name, so a percent sign in it is escaped too: a file named
+// "a%20b.xhtml" is referred to as "a%2520b.xhtml".
+func escapePath(p string) string {
+	p = escapeURI(p, "/")
+	// A colon in the first segment would be taken for a scheme.
+	if i := strings.IndexAny(p, ":/"); i >= 0 && p[i] == ':' {
+		p = "./" + p
+	}
+	return p
+}
+
+// escapeLink is like escapePath, but the link may end in a fragment
+// identifier, which is escaped separately.
+func escapeLink(link string) string {
+	i := strings.IndexByte(link, '#')
+	if i < 0 {
+		return escapePath(link)
+	}
+	return escapePath(link[:i]) + "#" + escapeURI(link[i+1:], "/?")
+}
+
+// escapeURI percent-encodes the bytes in s that aren't allowed in a
+// path segment of a URI reference (RFC 3986), other than those in
+// extra.
+func escapeURI(s, extra string) string {
+	i := 0
+	for i < len(s) && !mustEscape(s[i], extra) {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	var b strings.Builder
+	b.WriteString(s[:i])
+	for ; i < len(s); i++ {
+		if mustEscape(s[i], extra) {
+			fmt.Fprintf(&b, "%%%02X", s[i])
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// mustEscape reports whether escapeURI has to escape c.
+func mustEscape(c byte, extra string) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return false
+	default:
+		return strings.IndexByte("-._~!$&'()*+,;=:@", c) < 0 && strings.IndexByte(extra, c) < 0
+	}
+}
+
+// referencesHref reports whether the XHTML contents already have an
+// attribute with the given value, in either kind of quotes.
+func referencesHref(contents []byte, href string) bool {
+	return bytes.Contains(contents, []byte(`"`+href+`"`)) || bytes.Contains(contents, []byte(`'`+href+`'`))
+}
+
+// linkStylesheets adds link elements to the head of the XHTML
+// contents for every stylesheet added with options that the file
+// doesn't already reference.
+func (e *EPub) linkStylesheets(name string, contents []byte) []byte {
+	var links strings.Builder
+	for _, s := range e.styles {
+		if s.opts == nil {
+			continue
+		}
+		href := relativeHref(name, s.name)
+		if referencesHref(contents, href) {
+			continue
+		}
+		rel := "stylesheet"
+		if s.opts.Alternate {
+			rel = "alternate stylesheet"
+		}
+		fmt.Fprintf(&links, `<link %s type="text/css" %s`, attrPair("rel", rel), attrPair("href", href))
+		if s.opts.Title != "" {
+			links.WriteString(" " + attrPair("title", s.opts.Title))
+		}
+		if s.opts.Media != "" {
+			links.WriteString(" " + attrPair("media", s.opts.Media))
+		}
+		links.WriteString(" />\n")
+	}
+	if links.Len() == 0 {
+		return contents
+	}
+	return injectHead(contents, links.String())
+}
+
+// injectHead inserts extra into the head of the XHTML contents, just
+// before the closing head tag. Contents without a head are returned
+// unchanged.
+func injectHead(contents []byte, extra string) []byte {
+	loc := headCloseRE.FindIndex(contents)
+	if loc == nil {
+		return contents
+	}
+	ret := make([]byte, 0, len(contents)+len(extra))
+	ret = append(ret, contents[:loc[0]]...)
+	ret = append(ret, extra...)
+	return append(ret, contents[loc[0]:]...)
+}
+
+// linkScripts adds script elements to the head of the XHTML contents
+// for every script added with options that the file doesn't already
+// reference.
+func (e *EPub) linkScripts(name string, contents []byte) []byte {
+	var links strings.Builder
+	for _, j := range e.bookScripts() {
+		if j.opts == nil {
+			continue
+		}
+		href := relativeHref(name, j.name)
+		if referencesHref(contents, href) {
+			continue
+		}
+		typ := "text/javascript"
+		if j.opts.Module {
+			typ = "module"
+		}
+		fmt.Fprintf(&links, `<script %s %s`, attrPair("type", typ), attrPair("src", href))
+		if j.opts.Defer {
+			links.WriteString(` defer="defer"`)
+		}
+		if j.opts.Async {
+			links.WriteString(` async="async"`)
+		}
+		links.WriteString("></script>\n")
+	}
+	if links.Len() == 0 {
+		return contents
+	}
+	return injectHead(contents, links.String())
+}
@@ -0,0 +1,233 @@
+package epub
+
+// This file holds the code that formats the XML files this package
+// generates.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// defaultXMLIndent is the indent XML files are written with unless
+// SetXMLIndent says otherwise.
+const defaultXMLIndent = "  "
+
+// SetXMLIndent sets the indentation used for each level of nesting in
+// the package document, NCX, and nav document the book is written
+// with. The default is two spaces. An empty indent writes them
+// compactly, with no whitespace between elements. Indent may only
+// contain spaces and tabs. Elements holding text, such as TOC labels,
+// are written on one line with their text unchanged.
+func (e *EPub) SetXMLIndent(indent string) error {
+	if strings.Trim(indent, " \t") != "" {
+		return fmt.Errorf("XML indent %q isn't spaces and tabs", indent)
+	}
+	e.xmlIndent, e.xmlIndentSet = indent, true
+	return nil
+}
+
+// indent returns the indent the book's XML files are written with.
+func (e *EPub) indent() string {
+	if !e.xmlIndentSet {
+		return defaultXMLIndent
+	}
+	return e.xmlIndent
+}
+
+// fnode is a node in an XML document being formatted. Nodes that
+// aren't elements hold their already-encoded markup in raw.
+type fnode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*fnode
+	raw      string
+	// If true the node is character data.
+	text bool
+}
+
+// formatXML re-encodes an XML document with the given indent.
+// Namespace prefixes are kept as written.
+func formatXML(src []byte, indent string) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	// Nodes are allocated in blocks, and the output buffer sized from
+	// the input, since this runs for every XML file in every book.
+	var block []fnode
+	node := func(n fnode) *fnode {
+		if len(block) == cap(block) {
+			block = make([]fnode, 0, 64)
+		}
+		block = append(block, n)
+		return &block[len(block)-1]
+	}
+	root := &fnode{}
+	stack := []*fnode{root}
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to format XML: %v", err)
+		}
+		top := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			// RawToken gives each start element attributes of its own.
+			n := node(fnode{name: rawName(t.Name), attrs: t.Attr})
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 {
+				return nil, errors.New("unable to format XML: unbalanced end tag")
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			raw := string(t)
+			if bytes.ContainsAny(t, "&<]") {
+				raw = xmlTextEscaper.Replace(raw)
+			}
+			top.children = append(top.children, node(fnode{raw: raw, text: true}))
+		case xml.Comment:
+			top.children = append(top.children, node(fnode{raw: "<!--" + string(t) + "-->"}))
+		case xml.ProcInst:
+			top.children = append(top.children, node(fnode{raw: "<?" + t.Target + " " + string(t.Inst) + "?>"}))
+		case xml.Directive:
+			top.children = append(top.children, node(fnode{raw: "<!" + string(t) + ">"}))
+		}
+	}
+	if len(stack) != 1 {
+		return nil, errors.New("unable to format XML: unclosed element")
+	}
+
+	var b bytes.Buffer
+	b.Grow(len(src) + len(src)/2)
+	for _, c := range root.children {
+		if c.text {
+			continue
+		}
+		writeFormatted(&b, c, 0, indent)
+		if indent != "" {
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes(), nil
+}
+
+var xmlTextEscaper = strings.NewReplacer("]]>", "]]&gt;", "&", "&amp;", "<", "&lt;")
+
+// rawName returns an element or attribute name with its namespace
+// prefix, as returned by RawToken.
+func rawName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// hasText reports whether n has character data that isn't just
+// whitespace.
+func (n *fnode) hasText() bool {
+	for _, c := range n.children {
+		if c.text && strings.TrimSpace(c.raw) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFormatted writes n at the given depth. Elements with text are
+// written inline, exactly; other elements have their whitespace
+// replaced with indentation.
+func writeFormatted(b *bytes.Buffer, n *fnode, depth int, indent string) {
+	if n.name == "" {
+		b.WriteString(n.raw)
+		return
+	}
+	writeStartTag(b, n)
+	inline := n.hasText()
+	children := n.children
+	if !inline {
+		children = children[:0:0]
+		for _, c := range n.children {
+			if !c.text {
+				children = append(children, c)
+			}
+		}
+	}
+	if len(children) == 0 {
+		b.WriteString(" />")
+		return
+	}
+	b.WriteString(">")
+	for _, c := range children {
+		if inline {
+			writeInline(b, c)
+			continue
+		}
+		writeIndent(b, depth+1, indent)
+		writeFormatted(b, c, depth+1, indent)
+	}
+	if !inline {
+		writeIndent(b, depth, indent)
+	}
+	b.WriteString("</")
+	b.WriteString(n.name)
+	b.WriteByte('>')
+}
+
+// writeInline writes n and its children without changing their
+// whitespace.
+func writeInline(b *bytes.Buffer, n *fnode) {
+	if n.name == "" {
+		b.WriteString(n.raw)
+		return
+	}
+	writeStartTag(b, n)
+	if len(n.children) == 0 {
+		b.WriteString(" />")
+		return
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		writeInline(b, c)
+	}
+	b.WriteString("</")
+	b.WriteString(n.name)
+	b.WriteByte('>')
+}
+
+// writeIndent starts a new line at the given depth, unless the indent
+// is empty.
+func writeIndent(b *bytes.Buffer, depth int, indent string) {
+	if indent == "" {
+		return
+	}
+	b.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		b.WriteString(indent)
+	}
+}
+
+// writeStartTag writes the start of n's start tag: its name and
+// attributes.
+func writeStartTag(b *bytes.Buffer, n *fnode) {
+	b.WriteByte('<')
+	b.WriteString(n.name)
+	for _, a := range n.attrs {
+		b.WriteByte(' ')
+		if a.Name.Space != "" {
+			b.WriteString(a.Name.Space)
+			b.WriteByte(':')
+		}
+		b.WriteString(a.Name.Local)
+		b.WriteString(`="`)
+		b.WriteString(escapeAttr(a.Value))
+		b.WriteByte('"')
+	}
+}